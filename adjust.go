@@ -0,0 +1,319 @@
+package nest
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "strconv"
+    "strings"
+
+    "github.com/70ziko/NEST/colorspace"
+)
+
+// Adjustments are display settings for the main image, such as a
+// radiology window and level. They are applied when the image is rendered
+// by ToImage, Reader.ReadRegionImage and the tile server, and never to the
+// stored pixels. The zero value changes nothing.
+type Adjustments struct {
+    // Exposure scales linear light by 2^Exposure.
+    Exposure float64
+    // Window and Level stretch the sRGB values from Level-Window/2 to
+    // Level+Window/2, on a 0-255 scale, over the full range and clamp the
+    // rest. A zero Window leaves values alone.
+    Window, Level float64
+    // Brightness is added to values on a 0-1 scale.
+    Brightness float64
+    // Contrast scales values around middle gray by 1+Contrast.
+    Contrast float64
+    // Gamma raises values to 1/Gamma; 0 and 1 leave them alone.
+    Gamma float64
+    // LUT, when set, maps the colors after the other adjustments.
+    LUT *LUT
+}
+
+// LUT is a color lookup table, as read from a .cube file by ParseCubeLUT.
+type LUT struct {
+    // Name identifies the table, such as the file it came from.
+    Name string
+    // Dimension is 1 for a curve per channel and 3 for a color cube.
+    Dimension int
+    // Size is the number of entries along each axis.
+    Size int
+    // Table holds RGB outputs from 0 to 1: Size entries for a 1D table, and
+    // Size^3 for a 3D one with red changing fastest, then green, then blue.
+    Table [][3]float32
+}
+
+func (a *Adjustments) check() error {
+    for _, v := range []float64{a.Exposure, a.Window, a.Level, a.Brightness, a.Contrast, a.Gamma} {
+        if math.IsNaN(v) || math.IsInf(v, 0) {
+            return fmt.Errorf("adjustments must be finite")
+        }
+    }
+    if a.Window < 0 || a.Gamma < 0 || a.Contrast < -1 {
+        return fmt.Errorf("adjustments have negative window, gamma or contrast factor")
+    }
+    if l := a.LUT; l != nil {
+        if len(l.Name) > math.MaxUint16 {
+            return fmt.Errorf("LUT name is too long to store")
+        }
+        n := l.Size
+        switch {
+        case l.Dimension == 1 && n >= 2 && n <= 65536:
+        case l.Dimension == 3 && n >= 2 && n <= 256:
+            n = n * n * n
+        default:
+            return fmt.Errorf("invalid %dD LUT of size %d", l.Dimension, l.Size)
+        }
+        if len(l.Table) != n {
+            return fmt.Errorf("%dD LUT of size %d has %d entries, not %d", l.Dimension, l.Size, len(l.Table), n)
+        }
+    }
+    return nil
+}
+
+// curve returns the output on a 0-1 scale of every 8-bit sRGB value before
+// the LUT.
+func (a *Adjustments) curve() [256]float64 {
+    var c [256]float64
+    for i := range c {
+        v := float64(i) / 255
+        if a.Exposure != 0 {
+            v = colorspace.LinearToSRGB(min(colorspace.SRGBToLinear(v)*math.Exp2(a.Exposure), 1))
+        }
+        if a.Window > 0 {
+            v = (v*255 - a.Level + a.Window/2) / a.Window
+        }
+        v = (v-0.5)*(1+a.Contrast) + 0.5 + a.Brightness
+        v = min(max(v, 0), 1)
+        if a.Gamma > 0 && a.Gamma != 1 {
+            v = math.Pow(v, 1/a.Gamma)
+        }
+        c[i] = v
+    }
+    return c
+}
+
+// apply adjusts the RGB of img in place. A nil a changes nothing.
+func (a *Adjustments) apply(img *image.RGBA) {
+    if a == nil || *a == (Adjustments{}) {
+        return
+    }
+    curve := a.curve()
+    var tables [3][256]uint8
+    for ch := range tables {
+        for i, v := range curve {
+            if a.LUT != nil && a.LUT.Dimension == 1 {
+                v = float64(a.LUT.lookup1D(v, ch))
+            }
+            tables[ch][i] = uint8(math.Round(v * 255))
+        }
+    }
+    b := img.Rect
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+        row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+        for i := 0; i+3 < len(row); i += 4 {
+            if a.LUT != nil && a.LUT.Dimension == 3 {
+                out := a.LUT.lookup3D(curve[row[i]], curve[row[i+1]], curve[row[i+2]])
+                for ch, v := range out {
+                    row[i+ch] = uint8(math.Round(min(max(float64(v), 0), 1) * 255))
+                }
+                continue
+            }
+            row[i], row[i+1], row[i+2] = tables[0][row[i]], tables[1][row[i+1]], tables[2][row[i+2]]
+        }
+    }
+}
+
+func (l *LUT) lookup1D(v float64, ch int) float32 {
+    pos := v * float64(l.Size-1)
+    i := min(int(pos), l.Size-2)
+    f := float32(pos - float64(i))
+    return l.Table[i][ch]*(1-f) + l.Table[i+1][ch]*f
+}
+
+// lookup3D interpolates the cube trilinearly.
+func (l *LUT) lookup3D(r, g, b float64) [3]float32 {
+    n := l.Size
+    var idx [3]int
+    var frac [3]float32
+    for c, v := range []float64{r, g, b} {
+        pos := v * float64(n-1)
+        idx[c] = min(int(pos), n-2)
+        frac[c] = float32(pos - float64(idx[c]))
+    }
+    var out [3]float32
+    for corner := 0; corner < 8; corner++ {
+        w := float32(1)
+        at := 0
+        for c, stride := range []int{1, n, n * n} {
+            k := idx[c]
+            if corner>>c&1 != 0 {
+                k++
+                w *= frac[c]
+            } else {
+                w *= 1 - frac[c]
+            }
+            at += k * stride
+        }
+        for c := range out {
+            out[c] += w * l.Table[at][c]
+        }
+    }
+    return out
+}
+
+// ParseCubeLUT reads a 1D or 3D LUT in the .cube format used by Resolve
+// and most grading tools. Only the default 0-1 input domain is supported.
+func ParseCubeLUT(r io.Reader) (*LUT, error) {
+    l := &LUT{}
+    sc := bufio.NewScanner(r)
+    line := 0
+    for sc.Scan() {
+        line++
+        f := strings.Fields(sc.Text())
+        if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+            continue
+        }
+        switch f[0] {
+        case "TITLE":
+            l.Name = strings.Trim(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(sc.Text()), "TITLE")), `"`)
+            continue
+        case "LUT_1D_SIZE", "LUT_3D_SIZE":
+            if len(f) != 2 || l.Dimension != 0 {
+                return nil, fmt.Errorf("cube line %d: unexpected %s", line, f[0])
+            }
+            n, err := strconv.Atoi(f[1])
+            if err != nil {
+                return nil, fmt.Errorf("cube line %d: invalid size %q", line, f[1])
+            }
+            l.Dimension, l.Size = 1, n
+            if f[0] == "LUT_3D_SIZE" {
+                l.Dimension = 3
+            }
+            continue
+        case "DOMAIN_MIN", "DOMAIN_MAX":
+            want := 0.0
+            if f[0] == "DOMAIN_MAX" {
+                want = 1
+            }
+            for _, v := range f[1:] {
+                if x, err := strconv.ParseFloat(v, 64); err != nil || x != want {
+                    return nil, fmt.Errorf("cube line %d: only the 0-1 domain is supported", line)
+                }
+            }
+            continue
+        }
+        if len(f) != 3 {
+            return nil, fmt.Errorf("cube line %d: expected three values", line)
+        }
+        var e [3]float32
+        for c, v := range f {
+            x, err := strconv.ParseFloat(v, 32)
+            if err != nil {
+                return nil, fmt.Errorf("cube line %d: invalid value %q", line, v)
+            }
+            e[c] = float32(x)
+        }
+        l.Table = append(l.Table, e)
+    }
+    if err := sc.Err(); err != nil {
+        return nil, fmt.Errorf("failed to read cube LUT: %w", err)
+    }
+    if l.Dimension == 0 {
+        return nil, fmt.Errorf("cube LUT has no LUT_1D_SIZE or LUT_3D_SIZE")
+    }
+    if err := (&Adjustments{LUT: l}).check(); err != nil {
+        return nil, err
+    }
+    return l, nil
+}
+
+// Adjustments are stored in an ADJS chunk:
+//
+//	exposure float64 | window float64 | level float64 | brightness float64 |
+//	    contrast float64 | gamma float64 | LUT dimension uint8 |
+//	    [name length uint16 | name | size uint32 | entries * 3 float32]
+//
+// with the bracketed part present when the dimension is not 0.
+func (a *Adjustments) encode(order binary.ByteOrder) []byte {
+    var buf bytes.Buffer
+    binary.Write(&buf, order, [6]float64{a.Exposure, a.Window, a.Level, a.Brightness, a.Contrast, a.Gamma})
+    if a.LUT == nil {
+        buf.WriteByte(0)
+        return buf.Bytes()
+    }
+    buf.WriteByte(uint8(a.LUT.Dimension))
+    binary.Write(&buf, order, uint16(len(a.LUT.Name)))
+    buf.WriteString(a.LUT.Name)
+    binary.Write(&buf, order, uint32(a.LUT.Size))
+    binary.Write(&buf, order, a.LUT.Table)
+    return buf.Bytes()
+}
+
+func decodeAdjustments(reader io.Reader, order binary.ByteOrder, length uint64) (*Adjustments, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkAdjustments, err)
+    }
+    r := bytes.NewReader(data)
+    fail := func(err error) (*Adjustments, error) {
+        return nil, fmt.Errorf("failed to decode %s chunk: %w", ChunkAdjustments, err)
+    }
+    var v [6]float64
+    if err := binary.Read(r, order, &v); err != nil {
+        return fail(err)
+    }
+    a := &Adjustments{Exposure: v[0], Window: v[1], Level: v[2], Brightness: v[3], Contrast: v[4], Gamma: v[5]}
+    dim, err := r.ReadByte()
+    if err != nil {
+        return fail(err)
+    }
+    if dim != 0 {
+        l := &LUT{Dimension: int(dim)}
+        var n uint16
+        if err := binary.Read(r, order, &n); err != nil {
+            return fail(err)
+        }
+        name := make([]byte, n)
+        if _, err := io.ReadFull(r, name); err != nil {
+            return fail(err)
+        }
+        var size uint32
+        if err := binary.Read(r, order, &size); err != nil {
+            return fail(err)
+        }
+        l.Name, l.Size = string(name), int(size)
+        if int64(r.Len())%12 != 0 {
+            return fail(fmt.Errorf("LUT entries are truncated"))
+        }
+        l.Table = make([][3]float32, r.Len()/12)
+        if err := binary.Read(r, order, l.Table); err != nil {
+            return fail(err)
+        }
+        a.LUT = l
+    }
+    if err := a.check(); err != nil {
+        return fail(err)
+    }
+    return a, nil
+}
+
+func (nr *Reader) loadAdjustments() error {
+    offset, length, ok, err := nr.findChunk(ChunkAdjustments)
+    if err != nil || !ok {
+        return err
+    }
+    nr.adjustments, err = decodeAdjustments(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+    return err
+}
+
+// Adjustments returns the file's display adjustments, or nil when it has
+// none.
+func (nr *Reader) Adjustments() *Adjustments {
+    return nr.adjustments
+}
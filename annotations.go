@@ -0,0 +1,151 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "slices"
+    "strings"
+)
+
+// Annotation is a note on a region of the main image, identified by an ID
+// unique within the file.
+type Annotation struct {
+    ID   string
+    Rect image.Rectangle
+    Text string
+}
+
+// Annotation returns the annotation with the given ID, or nil.
+func (nif *NestedImageFile) Annotation(id string) *Annotation {
+    i, ok := slices.BinarySearchFunc(nif.Annotations, id, func(a Annotation, id string) int {
+        return strings.Compare(a.ID, id)
+    })
+    if !ok {
+        return nil
+    }
+    return &nif.Annotations[i]
+}
+
+// putAnnotation adds a or replaces the annotation with its ID, keeping
+// Annotations sorted by ID.
+func (nif *NestedImageFile) putAnnotation(a Annotation) {
+    i, ok := slices.BinarySearchFunc(nif.Annotations, a.ID, func(a Annotation, id string) int {
+        return strings.Compare(a.ID, id)
+    })
+    if ok {
+        nif.Annotations[i] = a
+        return
+    }
+    nif.Annotations = slices.Insert(nif.Annotations, i, a)
+}
+
+func (nif *NestedImageFile) deleteAnnotation(id string) {
+    nif.Annotations = slices.DeleteFunc(nif.Annotations, func(a Annotation) bool {
+        return a.ID == id
+    })
+}
+
+func checkAnnotation(a Annotation) error {
+    if a.ID == "" {
+        return fmt.Errorf("annotation ID must not be empty")
+    }
+    if len(a.ID) > math.MaxUint16 || len(a.Text) > math.MaxUint32 {
+        return fmt.Errorf("annotation %q is too long to store", a.ID)
+    }
+    return nil
+}
+
+// The annotation layer is stored in an ANNO chunk, sorted by ID:
+//
+//	count uint32 | count * (ID length uint16 | ID | rect 4 * int32 | text length uint32 | text)
+func encodeAnnotations(annotations []Annotation, order binary.ByteOrder) []byte {
+    var buf bytes.Buffer
+    binary.Write(&buf, order, uint32(len(annotations)))
+    for _, a := range annotations {
+        binary.Write(&buf, order, uint16(len(a.ID)))
+        buf.WriteString(a.ID)
+        binary.Write(&buf, order, [4]int32{int32(a.Rect.Min.X), int32(a.Rect.Min.Y), int32(a.Rect.Max.X), int32(a.Rect.Max.Y)})
+        binary.Write(&buf, order, uint32(len(a.Text)))
+        buf.WriteString(a.Text)
+    }
+    return buf.Bytes()
+}
+
+func decodeAnnotations(reader io.Reader, order binary.ByteOrder, length uint64) ([]Annotation, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkAnnotations, err)
+    }
+    r := bytes.NewReader(data)
+    fail := func(err error) ([]Annotation, error) {
+        return nil, fmt.Errorf("failed to decode %s chunk: %w", ChunkAnnotations, err)
+    }
+    var count uint32
+    if err := binary.Read(r, order, &count); err != nil {
+        return fail(err)
+    }
+    if int64(count)*22 > int64(r.Len()) {
+        return fail(fmt.Errorf("%d annotations do not fit in %d bytes", count, r.Len()))
+    }
+    annotations := make([]Annotation, count)
+    for i := range annotations {
+        a := &annotations[i]
+        var n uint16
+        if err := binary.Read(r, order, &n); err != nil {
+            return fail(err)
+        }
+        id := make([]byte, n)
+        if _, err := io.ReadFull(r, id); err != nil {
+            return fail(err)
+        }
+        var rect [4]int32
+        if err := binary.Read(r, order, &rect); err != nil {
+            return fail(err)
+        }
+        var tn uint32
+        if err := binary.Read(r, order, &tn); err != nil {
+            return fail(err)
+        }
+        if int64(tn) > int64(r.Len()) {
+            return fail(fmt.Errorf("annotation %q text of %d bytes is truncated", id, tn))
+        }
+        text := make([]byte, tn)
+        if _, err := io.ReadFull(r, text); err != nil {
+            return fail(err)
+        }
+        a.ID, a.Text = string(id), string(text)
+        a.Rect = image.Rect(int(rect[0]), int(rect[1]), int(rect[2]), int(rect[3]))
+    }
+    slices.SortFunc(annotations, func(a, b Annotation) int {
+        return strings.Compare(a.ID, b.ID)
+    })
+    return annotations, nil
+}
+
+// Annotate adds a, or replaces the annotation with the same ID.
+func (nif *NestedImageFile) Annotate(a Annotation) error {
+    if err := checkAnnotation(a); err != nil {
+        return err
+    }
+    nif.putAnnotation(a)
+    nif.record(CollabOp{Kind: CollabAnnotate, ID: a.ID, Rect: a.Rect, Text: a.Text})
+    nif.audit(AuditAnnotate, a.ID, a.Rect)
+    return nil
+}
+
+// RemoveAnnotation reports whether an annotation with the given ID existed.
+func (nif *NestedImageFile) RemoveAnnotation(id string) bool {
+    a := nif.Annotation(id)
+    if a == nil {
+        return false
+    }
+    rect := a.Rect
+    nif.deleteAnnotation(id)
+    nif.record(CollabOp{Kind: CollabDelete, ID: id})
+    nif.audit(AuditAnnotate, "removed "+id, rect)
+    return true
+}
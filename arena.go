@@ -0,0 +1,40 @@
+package nest
+
+// Arena holds the pixels of a decoded main image. Passing the same Arena in
+// ReadOptions reuses its storage across decodes; each decode overwrites the
+// image of the one before, so only the latest file read with an Arena is
+// valid.
+type Arena struct {
+    pix  []PixeLink
+    rows [][]PixeLink
+}
+
+func (a *Arena) fits(width, height int) bool {
+    return a != nil && cap(a.pix) >= width*height && cap(a.rows) >= height
+}
+
+// image returns width x height rows that share one backing slice. A nil
+// Arena always allocates.
+func (a *Arena) image(width, height int) [][]PixeLink {
+    if a == nil {
+        return pixelRows(width, height)
+    }
+    if !a.fits(width, height) {
+        a.pix = make([]PixeLink, width*height)
+        a.rows = make([][]PixeLink, height)
+    }
+    return cutRows(a.pix[:width*height], a.rows[:height], width)
+}
+
+// pixelRows allocates an image as a single slice with rows cut from it, so a
+// tall image costs two allocations rather than one per row.
+func pixelRows(width, height int) [][]PixeLink {
+    return cutRows(make([]PixeLink, width*height), make([][]PixeLink, height), width)
+}
+
+func cutRows(pix []PixeLink, rows [][]PixeLink, width int) [][]PixeLink {
+    for y := range rows {
+        rows[y] = pix[y*width : (y+1)*width : (y+1)*width]
+    }
+    return rows
+}
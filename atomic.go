@@ -0,0 +1,108 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+)
+
+// AtomicFile is a temporary file next to its target that replaces the target
+// on Commit, so readers never see a partially written file. A crash before
+// Commit leaves the target untouched.
+type AtomicFile struct {
+    *os.File
+    target string
+    sync   bool
+    done   bool
+    // lock is the target's exclusive lock, held until Commit or Abort.
+    lock *os.File
+}
+
+// CreateAtomic starts writing filename. With sync set, Commit flushes the
+// data and the directory entry to stable storage before returning. The new
+// file keeps the mode of the file it replaces, or gets 0644.
+//
+// When filename has a lock sidecar, see LockedFile, the exclusive lock of
+// OpenExclusive is held on it until Commit or Abort, and CreateAtomic fails
+// with ErrLocked while anyone else holds it.
+func CreateAtomic(filename string, sync bool) (*AtomicFile, error) {
+    lock, err := lockForWrite(filename)
+    if err != nil {
+        return nil, err
+    }
+    dir, base := filepath.Split(filename)
+    if dir == "" {
+        dir = "."
+    }
+    file, err := os.CreateTemp(dir, "."+base+".tmp-*")
+    if err != nil {
+        releaseSidecar(lock)
+        return nil, err
+    }
+    mode := os.FileMode(0o644)
+    if info, err := os.Stat(filename); err == nil {
+        mode = info.Mode().Perm()
+    }
+    if err := file.Chmod(mode); err != nil {
+        file.Close()
+        os.Remove(file.Name())
+        releaseSidecar(lock)
+        return nil, err
+    }
+    return &AtomicFile{File: file, target: filename, sync: sync, lock: lock}, nil
+}
+
+// Commit closes the file and renames it over the target.
+func (f *AtomicFile) Commit() error {
+    if f.done {
+        return errors.New("atomic file already committed or aborted")
+    }
+    f.done = true
+    defer releaseSidecar(f.lock)
+    if f.sync {
+        if err := f.File.Sync(); err != nil {
+            f.File.Close()
+            os.Remove(f.Name())
+            return fmt.Errorf("failed to sync file: %w", err)
+        }
+    }
+    if err := f.File.Close(); err != nil {
+        os.Remove(f.Name())
+        return fmt.Errorf("failed to close file: %w", err)
+    }
+    if err := os.Rename(f.Name(), f.target); err != nil {
+        os.Remove(f.Name())
+        return fmt.Errorf("failed to replace %s: %w", f.target, err)
+    }
+    if f.sync {
+        return syncDir(filepath.Dir(f.target))
+    }
+    return nil
+}
+
+// Abort discards the temporary file. It does nothing after Commit, so it can
+// be deferred.
+func (f *AtomicFile) Abort() error {
+    if f.done {
+        return nil
+    }
+    f.done = true
+    defer releaseSidecar(f.lock)
+    f.File.Close()
+    return os.Remove(f.Name())
+}
+
+// syncDir makes a rename durable. Platforms that cannot open or sync a
+// directory are not treated as failures.
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return nil
+    }
+    defer d.Close()
+    if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) && !errors.Is(err, errors.ErrUnsupported) {
+        return fmt.Errorf("failed to sync directory: %w", err)
+    }
+    return nil
+}
@@ -0,0 +1,277 @@
+package nest
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "slices"
+    "time"
+)
+
+// Operations the library records in the audit log.
+const (
+    AuditSetPixels         = "set-pixels"
+    AuditLinksFromMask     = "links-from-mask"
+    AuditAddLinkChannel    = "add-link-channel"
+    AuditRemoveLinkChannel = "remove-link-channel"
+    AuditResize            = "resize"
+    AuditSetNested         = "set-nested"
+    AuditAnnotate          = "annotate"
+    AuditMergeEdits        = "merge-edits"
+    AuditPlaceTemplate     = "place-template"
+    AuditRedact            = "redact"
+    AuditScrub             = "scrub"
+    AuditIngest            = "ingest"
+)
+
+// AuditEntry is one change to a file. Regions are in main image pixels and
+// empty when the change is not tied to an area, such as adding a channel.
+type AuditEntry struct {
+    Actor   string
+    Time    time.Time
+    Op      string
+    Detail  string
+    Regions []image.Rectangle
+    // Hash is SHA-256 over the previous entry's Hash and this entry, so
+    // changing or dropping any entry breaks every hash after it.
+    Hash [32]byte
+}
+
+// AuditLog is a hash-chained history of changes, stored in the AUDT chunk.
+// While a file has one, its mutating methods append to it; direct writes to
+// MainImage, Frame.Rows and UncheckedSet bypass it.
+type AuditLog struct {
+    // Actor is recorded as who made each following change.
+    Actor string
+
+    entries []AuditEntry
+    // sealed entries have their Hash set and are never changed again.
+    sealed int
+}
+
+// EnableAudit starts recording changes made by actor, keeping any log the
+// file already has.
+func (nif *NestedImageFile) EnableAudit(actor string) *AuditLog {
+    if nif.Audit == nil {
+        nif.Audit = &AuditLog{}
+    }
+    nif.Audit.Actor = actor
+    return nif.Audit
+}
+
+// Append records an application-defined change.
+func (l *AuditLog) Append(op, detail string, regions ...image.Rectangle) {
+    l.seal()
+    l.entries = append(l.entries, AuditEntry{
+        Actor:   l.Actor,
+        Time:    time.Now().UTC(),
+        Op:      op,
+        Detail:  detail,
+        Regions: regions,
+    })
+}
+
+// Entries returns the log, oldest first.
+func (l *AuditLog) Entries() []AuditEntry {
+    l.seal()
+    return l.entries
+}
+
+// touch records a pixel write. Consecutive writes by the same actor merge
+// into one entry covering their bounding box until another entry follows.
+func (l *AuditLog) touch(x, y int) {
+    r := image.Rect(x, y, x+1, y+1)
+    if n := len(l.entries); n > l.sealed {
+        last := &l.entries[n-1]
+        if last.Op == AuditSetPixels && last.Actor == l.Actor {
+            last.Regions[0] = last.Regions[0].Union(r)
+            return
+        }
+    }
+    l.Append(AuditSetPixels, "", r)
+}
+
+// clone copies the log for a file derived from this one.
+func (l *AuditLog) clone() *AuditLog {
+    l.seal()
+    return &AuditLog{Actor: l.Actor, entries: slices.Clone(l.entries), sealed: l.sealed}
+}
+
+func (nif *NestedImageFile) audit(op, detail string, regions ...image.Rectangle) {
+    if nif.Audit != nil {
+        nif.Audit.Append(op, detail, regions...)
+    }
+}
+
+// seal hashes every entry not yet hashed.
+func (l *AuditLog) seal() {
+    for ; l.sealed < len(l.entries); l.sealed++ {
+        var prev [32]byte
+        if l.sealed > 0 {
+            prev = l.entries[l.sealed-1].Hash
+        }
+        e := &l.entries[l.sealed]
+        e.Hash = auditHash(prev, e)
+    }
+}
+
+// auditHash always encodes big-endian so the chain doesn't depend on the
+// file's byte order.
+func auditHash(prev [32]byte, e *AuditEntry) [32]byte {
+    h := sha256.New()
+    h.Write(prev[:])
+    writeAuditEntry(h, binary.BigEndian, e)
+    return [32]byte(h.Sum(nil))
+}
+
+// Verify recomputes the chain and reports the first entry whose hash does
+// not match.
+func (l *AuditLog) Verify() error {
+    var prev [32]byte
+    for i := range l.entries[:l.sealed] {
+        e := &l.entries[i]
+        if auditHash(prev, e) != e.Hash {
+            return fmt.Errorf("audit entry %d does not match its hash", i)
+        }
+        prev = e.Hash
+    }
+    return nil
+}
+
+// Export writes the log as JSON lines with hex hashes.
+func (l *AuditLog) Export(w io.Writer) error {
+    enc := json.NewEncoder(w)
+    for _, e := range l.Entries() {
+        regions := make([][4]int, len(e.Regions))
+        for i, r := range e.Regions {
+            regions[i] = [4]int{r.Min.X, r.Min.Y, r.Dx(), r.Dy()}
+        }
+        err := enc.Encode(struct {
+            Actor   string    `json:"actor"`
+            Time    time.Time `json:"time"`
+            Op      string    `json:"op"`
+            Detail  string    `json:"detail,omitempty"`
+            Regions [][4]int  `json:"regions,omitempty"`
+            Hash    string    `json:"hash"`
+        }{e.Actor, e.Time, e.Op, e.Detail, regions, hex.EncodeToString(e.Hash[:])})
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// The AUDT chunk lists the entries:
+//
+//	count uint32 | actor length uint16 | actor | unix nanoseconds int64 |
+//	    op length uint16 | op | detail length uint16 | detail |
+//	    region count uint32 | x, y, w, h int32... | hash [32]byte ...
+func writeAuditEntry(w io.Writer, order binary.ByteOrder, e *AuditEntry) {
+    writeString := func(s string) {
+        binary.Write(w, order, uint16(len(s)))
+        io.WriteString(w, s)
+    }
+    writeString(e.Actor)
+    binary.Write(w, order, e.Time.UnixNano())
+    writeString(e.Op)
+    writeString(e.Detail)
+    binary.Write(w, order, uint32(len(e.Regions)))
+    for _, r := range e.Regions {
+        binary.Write(w, order, [4]int32{int32(r.Min.X), int32(r.Min.Y), int32(r.Dx()), int32(r.Dy())})
+    }
+}
+
+func (l *AuditLog) chunk(order binary.ByteOrder) (*Chunk, error) {
+    l.seal()
+    var buf bytes.Buffer
+    binary.Write(&buf, order, uint32(len(l.entries)))
+    for i := range l.entries {
+        e := &l.entries[i]
+        if len(e.Actor) > math.MaxUint16 || len(e.Op) > math.MaxUint16 || len(e.Detail) > math.MaxUint16 {
+            return nil, fmt.Errorf("audit entry %d has a field longer than %d bytes", i, math.MaxUint16)
+        }
+        writeAuditEntry(&buf, order, e)
+        buf.Write(e.Hash[:])
+    }
+    return &Chunk{Type: ChunkAudit, Data: buf.Bytes()}, nil
+}
+
+func decodeAuditLog(reader io.Reader, order binary.ByteOrder, length uint64) (*AuditLog, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkAudit, err)
+    }
+    r := bytes.NewReader(data)
+    fail := func(err error) (*AuditLog, error) {
+        return nil, fmt.Errorf("failed to decode %s chunk: %w", ChunkAudit, err)
+    }
+    readString := func() (string, error) {
+        var n uint16
+        if err := binary.Read(r, order, &n); err != nil {
+            return "", err
+        }
+        b := make([]byte, n)
+        _, err := io.ReadFull(r, b)
+        return string(b), err
+    }
+
+    var count uint32
+    if err := binary.Read(r, order, &count); err != nil {
+        return fail(err)
+    }
+    if int64(count)*50 > int64(r.Len()) {
+        return fail(fmt.Errorf("%d entries do not fit in %d bytes", count, r.Len()))
+    }
+    l := &AuditLog{entries: make([]AuditEntry, count), sealed: int(count)}
+    for i := range l.entries {
+        e := &l.entries[i]
+        var err error
+        if e.Actor, err = readString(); err != nil {
+            return fail(err)
+        }
+        var nanos int64
+        if err := binary.Read(r, order, &nanos); err != nil {
+            return fail(err)
+        }
+        e.Time = time.Unix(0, nanos).UTC()
+        if e.Op, err = readString(); err != nil {
+            return fail(err)
+        }
+        if e.Detail, err = readString(); err != nil {
+            return fail(err)
+        }
+        var n uint32
+        if err := binary.Read(r, order, &n); err != nil {
+            return fail(err)
+        }
+        if int64(n)*16 > int64(r.Len()) {
+            return fail(fmt.Errorf("entry %d lists %d regions in %d bytes", i, n, r.Len()))
+        }
+        rects := make([][4]int32, n)
+        if err := binary.Read(r, order, rects); err != nil {
+            return fail(err)
+        }
+        for _, v := range rects {
+            e.Regions = append(e.Regions, image.Rect(int(v[0]), int(v[1]), int(v[0]+v[2]), int(v[1]+v[3])))
+        }
+        if _, err := io.ReadFull(r, e.Hash[:]); err != nil {
+            return fail(err)
+        }
+    }
+    return l, nil
+}
+
+// AuditLog reads the AUDT chunk. Files without one return nil.
+func (nr *Reader) AuditLog() (*AuditLog, error) {
+    offset, length, ok, err := nr.findChunk(ChunkAudit)
+    if err != nil || !ok {
+        return nil, err
+    }
+    return decodeAuditLog(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+}
@@ -0,0 +1,305 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "io"
+    "math"
+
+    "github.com/70ziko/NEST/tilemath"
+)
+
+// Band is one spectral channel of multispectral imagery, such as a
+// satellite's near infrared, with a 16-bit sample for every main image
+// pixel. The main image holds an RGB rendering of the bands, so readers
+// that don't know about bands still show something useful.
+type Band struct {
+    Name string
+    // Samples holds one value per pixel, row by row.
+    Samples []uint16
+}
+
+// BandMapping renders three bands as RGB. Samples from Low to High are
+// stretched over 0-255 and clamped outside it; a zero High means 65535.
+type BandMapping struct {
+    R, G, B   int
+    Low, High uint16
+}
+
+// AddBand appends a band and returns its index.
+func (nif *NestedImageFile) AddBand(name string, samples []uint16) (int, error) {
+    width, height := int(nif.Header.Width), int(nif.Header.Height)
+    if len(samples) != width*height {
+        return 0, fmt.Errorf("band %q has %d samples, the main image has %d pixels", name, len(samples), width*height)
+    }
+    if len(name) > math.MaxUint16 {
+        return 0, fmt.Errorf("band name is %d bytes, the limit is %d", len(name), math.MaxUint16)
+    }
+    if len(nif.Bands) >= math.MaxUint16 {
+        return 0, fmt.Errorf("file already has %d bands", len(nif.Bands))
+    }
+    nif.Bands = append(nif.Bands, Band{Name: name, Samples: samples})
+    return len(nif.Bands) - 1, nil
+}
+
+// BandIndex returns the index of the band called name, or -1.
+func (nif *NestedImageFile) BandIndex(name string) int {
+    for i := range nif.Bands {
+        if nif.Bands[i].Name == name {
+            return i
+        }
+    }
+    return -1
+}
+
+func (m BandMapping) check(bands int) error {
+    for _, b := range []int{m.R, m.G, m.B} {
+        if b < 0 || b >= bands {
+            return fmt.Errorf("band mapping uses band %d of %d", b, bands)
+        }
+    }
+    if m.High != 0 && m.High <= m.Low {
+        return fmt.Errorf("band mapping range %d-%d is empty", m.Low, m.High)
+    }
+    return nil
+}
+
+func (m BandMapping) scale(v uint16) uint8 {
+    high := m.High
+    if high == 0 {
+        high = math.MaxUint16
+    }
+    switch {
+    case v <= m.Low:
+        return 0
+    case v >= high:
+        return 255
+    }
+    return uint8((int(v-m.Low)*255 + int(high-m.Low)/2) / int(high-m.Low))
+}
+
+// RenderBands draws the bands m selects as an RGB image.
+func (nif *NestedImageFile) RenderBands(m BandMapping) (*image.RGBA, error) {
+    if err := m.check(len(nif.Bands)); err != nil {
+        return nil, err
+    }
+    width, height := int(nif.Header.Width), int(nif.Header.Height)
+    img := image.NewRGBA(image.Rect(0, 0, width, height))
+    r, g, b := nif.Bands[m.R].Samples, nif.Bands[m.G].Samples, nif.Bands[m.B].Samples
+    for i := range r {
+        img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = m.scale(r[i]), m.scale(g[i]), m.scale(b[i]), 0xff
+    }
+    return img, nil
+}
+
+// ShowBands replaces the main image colors with the rendering of m, keeping
+// links. The samples are stored as they are, whatever the header color
+// space.
+func (nif *NestedImageFile) ShowBands(m BandMapping) error {
+    if err := m.check(len(nif.Bands)); err != nil {
+        return err
+    }
+    width := int(nif.Header.Width)
+    r, g, b := nif.Bands[m.R].Samples, nif.Bands[m.G].Samples, nif.Bands[m.B].Samples
+    for y, row := range nif.MainImage {
+        for x := range row {
+            i := y*width + x
+            row[x].R, row[x].G, row[x].B = m.scale(r[i]), m.scale(g[i]), m.scale(b[i])
+        }
+    }
+    return nil
+}
+
+type bandHeader struct {
+    Index  uint16
+    Width  uint32
+    Height uint32
+}
+
+// Each band is stored in a BAND chunk, tiled on the main image grid so
+// regions can be read without the rest:
+//
+//	name length uint16 | name | bandHeader | tiles
+//
+// Every tile holds TileSize*TileSize uint16 samples in row-major order,
+// padded at the right and bottom edges, and tiles are in row-major order.
+func (b *Band) chunk(index int, grid tilemath.Grid, order binary.ByteOrder) *Chunk {
+    var buf bytes.Buffer
+    binary.Write(&buf, order, uint16(len(b.Name)))
+    buf.WriteString(b.Name)
+    binary.Write(&buf, order, bandHeader{Index: uint16(index), Width: uint32(grid.Width), Height: uint32(grid.Height)})
+    ts := grid.TileSize
+    tile := make([]uint16, ts*ts)
+    for ty := 0; ty < grid.Rows(); ty++ {
+        for tx := 0; tx < grid.Cols(); tx++ {
+            clear(tile)
+            r := grid.TileBounds(tx, ty)
+            for y := r.Min.Y; y < r.Max.Y; y++ {
+                copy(tile[(y-r.Min.Y)*ts:], b.Samples[y*grid.Width+r.Min.X:y*grid.Width+r.Max.X])
+            }
+            binary.Write(&buf, order, tile)
+        }
+    }
+    return &Chunk{Type: ChunkBand, Data: buf.Bytes()}
+}
+
+func (nif *NestedImageFile) writeBands(writer io.Writer, order binary.ByteOrder) error {
+    grid := nif.grid()
+    for i := range nif.Bands {
+        b := &nif.Bands[i]
+        if len(b.Samples) != grid.Width*grid.Height {
+            return fmt.Errorf("band %q has %d samples, the main image has %d pixels", b.Name, len(b.Samples), grid.Width*grid.Height)
+        }
+        if err := b.chunk(i, grid, order).write(writer, order); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// bandLayout locates the parts of a BAND chunk from its header.
+type bandLayout struct {
+    name  string
+    index int
+    tiles int64 // offset of the first tile within the chunk
+}
+
+func readBandLayout(r io.ReaderAt, offset int64, length uint64, order binary.ByteOrder, grid tilemath.Grid) (bandLayout, error) {
+    var n uint16
+    sr := io.NewSectionReader(r, offset, int64(length))
+    if err := binary.Read(sr, order, &n); err != nil {
+        return bandLayout{}, fmt.Errorf("failed to read band name: %w", err)
+    }
+    name := make([]byte, n)
+    if _, err := io.ReadFull(sr, name); err != nil {
+        return bandLayout{}, fmt.Errorf("failed to read band name: %w", err)
+    }
+    var hdr bandHeader
+    if err := binary.Read(sr, order, &hdr); err != nil {
+        return bandLayout{}, fmt.Errorf("failed to read band %q: %w", name, err)
+    }
+    if int(hdr.Width) != grid.Width || int(hdr.Height) != grid.Height {
+        return bandLayout{}, fmt.Errorf("band %q is %dx%d, the main image is %dx%d", name, hdr.Width, hdr.Height, grid.Width, grid.Height)
+    }
+    l := bandLayout{name: string(name), index: int(hdr.Index), tiles: 2 + int64(n) + int64(binary.Size(hdr))}
+    tileBytes := int64(grid.TileSize) * int64(grid.TileSize) * 2
+    if l.tiles+int64(grid.Cols())*int64(grid.Rows())*tileBytes != int64(length) {
+        return bandLayout{}, fmt.Errorf("band %q chunk is %d bytes, not %d tiles", name, length, grid.Cols()*grid.Rows())
+    }
+    return l, nil
+}
+
+// readRegion decodes rect of the band, reading only the tiles it touches.
+func (l bandLayout) readRegion(r io.ReaderAt, offset int64, order binary.ByteOrder, grid tilemath.Grid, rect image.Rectangle) ([]uint16, error) {
+    w := rect.Dx()
+    out := make([]uint16, w*rect.Dy())
+    ts := grid.TileSize
+    tile := make([]uint16, ts*ts)
+    raw := make([]byte, ts*ts*2)
+    tiles := grid.TileRange(rect)
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            at := offset + l.tiles + int64(ty*grid.Cols()+tx)*int64(len(raw))
+            if _, err := r.ReadAt(raw, at); err != nil {
+                return nil, fmt.Errorf("failed to read band %q tile (%d, %d): %w", l.name, tx, ty, err)
+            }
+            binary.Read(bytes.NewReader(raw), order, tile)
+            part := grid.TileBounds(tx, ty).Intersect(rect)
+            for y := part.Min.Y; y < part.Max.Y; y++ {
+                for x := part.Min.X; x < part.Max.X; x++ {
+                    out[(y-rect.Min.Y)*w+x-rect.Min.X] = tile[(y%ts)*ts+x%ts]
+                }
+            }
+        }
+    }
+    return out, nil
+}
+
+func decodeBand(reader io.Reader, order binary.ByteOrder, length uint64, grid tilemath.Grid) (Band, int, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return Band{}, 0, fmt.Errorf("failed to read %s chunk: %w", ChunkBand, err)
+    }
+    ra := bytes.NewReader(data)
+    l, err := readBandLayout(ra, 0, length, order, grid)
+    if err != nil {
+        return Band{}, 0, err
+    }
+    samples, err := l.readRegion(ra, 0, order, grid, image.Rect(0, 0, grid.Width, grid.Height))
+    if err != nil {
+        return Band{}, 0, err
+    }
+    return Band{Name: l.name, Samples: samples}, l.index, nil
+}
+
+// bands lists the BAND chunks by index.
+func (nr *Reader) bands() (map[int]bandLayout, map[int]int64, error) {
+    layouts, offsets := map[int]bandLayout{}, map[int]int64{}
+    grid := nr.Grid()
+    err := nr.walkChunks(func(t ChunkType, offset int64, length uint64) (bool, error) {
+        if t != ChunkBand {
+            return true, nil
+        }
+        l, err := readBandLayout(nr.r, offset, length, nr.order, grid)
+        if err != nil {
+            return false, err
+        }
+        layouts[l.index], offsets[l.index] = l, offset
+        return true, nil
+    })
+    return layouts, offsets, err
+}
+
+// BandNames lists the bands in index order.
+func (nr *Reader) BandNames() ([]string, error) {
+    layouts, _, err := nr.bands()
+    if err != nil {
+        return nil, err
+    }
+    names := make([]string, len(layouts))
+    for i := range names {
+        l, ok := layouts[i]
+        if !ok {
+            return nil, fmt.Errorf("file has %d bands but no band %d", len(layouts), i)
+        }
+        names[i] = l.name
+    }
+    return names, nil
+}
+
+// ReadBandRegion returns the samples of band i inside rect, row by row,
+// reading only the tiles of that band that rect touches.
+func (nr *Reader) ReadBandRegion(i int, rect image.Rectangle) ([]uint16, error) {
+    layouts, offsets, err := nr.bands()
+    if err != nil {
+        return nil, err
+    }
+    l, ok := layouts[i]
+    if !ok {
+        return nil, fmt.Errorf("file has no band %d", i)
+    }
+    return l.readRegion(nr.r, offsets[i], nr.order, nr.Grid(), rect.Intersect(nr.Bounds()))
+}
+
+// RenderBandRegion draws rect of the bands m selects. The image bounds start
+// at rect.Min after clipping.
+func (nr *Reader) RenderBandRegion(m BandMapping, rect image.Rectangle) (*image.RGBA, error) {
+    if err := m.check(int(nr.Header.Bands)); err != nil {
+        return nil, err
+    }
+    rect = rect.Intersect(nr.Bounds())
+    var planes [3][]uint16
+    for c, b := range []int{m.R, m.G, m.B} {
+        var err error
+        if planes[c], err = nr.ReadBandRegion(b, rect); err != nil {
+            return nil, err
+        }
+    }
+    img := image.NewRGBA(rect)
+    for i := range planes[0] {
+        img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = m.scale(planes[0][i]), m.scale(planes[1][i]), m.scale(planes[2][i]), 0xff
+    }
+    return img, nil
+}
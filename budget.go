@@ -0,0 +1,51 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "time"
+    "unsafe"
+)
+
+var ErrMemoryBudget = errors.New("memory budget exceeded")
+
+var pixeLinkSize = int64(unsafe.Sizeof(PixeLink{}))
+
+// memoryBudget tracks projected allocations during a decode, and the
+// deadline it must finish by. A nil budget never refuses a reservation and
+// never expires.
+type memoryBudget struct {
+    limit    int64
+    used     int64
+    deadline time.Time
+}
+
+// newMemoryBudget returns nil when neither limit nor deadline is set. A
+// limit of zero or less means no memory limit.
+func newMemoryBudget(limit int64, deadline time.Time) *memoryBudget {
+    if limit <= 0 && deadline.IsZero() {
+        return nil
+    }
+    return &memoryBudget{limit: limit, deadline: deadline}
+}
+
+func (b *memoryBudget) reserve(n int64, what string) error {
+    if b == nil || b.limit <= 0 {
+        return nil
+    }
+    if n < 0 || n > b.limit-b.used {
+        return fmt.Errorf("%w: %s needs %d bytes, %d of %d already in use", ErrMemoryBudget, what, n, b.used, b.limit)
+    }
+    b.used += n
+    return nil
+}
+
+// check fails with ErrDecodeTimeout once the deadline has passed. Decode
+// loops call it for every tile and chunk, so the deadline holds even where
+// no read is made.
+func (b *memoryBudget) check() error {
+    if b == nil || b.deadline.IsZero() || time.Now().Before(b.deadline) {
+        return nil
+    }
+    return ErrDecodeTimeout
+}
@@ -0,0 +1,175 @@
+package nest
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "io"
+    "math"
+)
+
+// Canvas places the main image on a larger logical document, such as a
+// whiteboard whose content covers a small part of it. Only the main image
+// is stored as tiles; the rest of the canvas renders as Background. The
+// canvas is laid out in displayed coordinates, after the orientation.
+type Canvas struct {
+    // Width and Height are the size of the document. Zero uses the
+    // displayed size of the main image.
+    Width, Height int
+    // Origin is where the main image's top left corner sits.
+    Origin image.Point
+    // Background is the document color, drawn wherever the main image
+    // doesn't cover the canvas. Its zero value is transparent.
+    Background color.RGBA
+}
+
+// bounds returns the canvas rectangle and the displayed main image's place
+// in it, for a main image of displayed size w by h.
+func (c *Canvas) bounds(w, h int) (canvas, content image.Rectangle) {
+    content = image.Rect(0, 0, w, h)
+    if c == nil {
+        return content, content
+    }
+    content = content.Add(c.Origin)
+    cw, ch := c.Width, c.Height
+    if cw == 0 {
+        cw = w
+    }
+    if ch == 0 {
+        ch = h
+    }
+    return image.Rect(0, 0, cw, ch), content
+}
+
+func (c *Canvas) check(w, h int) error {
+    if c.Width < 0 || c.Height < 0 || c.Width > math.MaxUint32 || c.Height > math.MaxUint32 {
+        return fmt.Errorf("invalid canvas size %dx%d", c.Width, c.Height)
+    }
+    if bg := c.Background; bg.R > bg.A || bg.G > bg.A || bg.B > bg.A {
+        return fmt.Errorf("canvas background %v is not alpha-premultiplied", bg)
+    }
+    canvas, content := c.bounds(w, h)
+    if !content.In(canvas) {
+        return fmt.Errorf("main image at %v does not fit the %dx%d canvas", content, canvas.Dx(), canvas.Dy())
+    }
+    return nil
+}
+
+// CanvasBounds returns the bounds of the document, which are those of the
+// displayed main image when the file has no Canvas.
+func (nif *NestedImageFile) CanvasBounds() image.Rectangle {
+    canvas, _ := nif.Canvas.bounds(nif.displaySize())
+    return canvas
+}
+
+func (nif *NestedImageFile) displaySize() (int, int) {
+    return nif.Header.Orientation.Size(int(nif.Header.Width), int(nif.Header.Height))
+}
+
+// RenderCanvas renders the part of the document inside rect: the main image
+// as ToImage shows it, over the background. The image bounds are rect
+// after clipping to the canvas.
+func (nif *NestedImageFile) RenderCanvas(rect image.Rectangle) (*image.RGBA, error) {
+    canvas, content := nif.Canvas.bounds(nif.displaySize())
+    return renderCanvas(nif.Canvas, rect, canvas, content, func(r image.Rectangle) (*image.RGBA, error) {
+        return nif.ToImage().SubImage(r).(*image.RGBA), nil
+    })
+}
+
+// CanvasBounds returns the bounds of the document, which are those of the
+// displayed main image when the file has no Canvas.
+func (nr *Reader) CanvasBounds() image.Rectangle {
+    b := nr.OrientedBounds()
+    canvas, _ := nr.canvas.bounds(b.Dx(), b.Dy())
+    return canvas
+}
+
+// Canvas returns the file's canvas, or nil when it has none.
+func (nr *Reader) Canvas() *Canvas {
+    return nr.canvas
+}
+
+// ReadCanvasRegion is RenderCanvas reading only the tiles under rect, so
+// regions of a whiteboard far from its content decode nothing.
+func (nr *Reader) ReadCanvasRegion(rect image.Rectangle) (*image.RGBA, error) {
+    b := nr.OrientedBounds()
+    canvas, content := nr.canvas.bounds(b.Dx(), b.Dy())
+    return renderCanvas(nr.canvas, rect, canvas, content, nr.ReadOrientedRegion)
+}
+
+// StoredRect returns the stored main image pixels shown by rect on the
+// canvas. It is empty when rect only covers background.
+func (nr *Reader) StoredRect(rect image.Rectangle) image.Rectangle {
+    b := nr.OrientedBounds()
+    _, content := nr.canvas.bounds(b.Dx(), b.Dy())
+    part := rect.Intersect(content).Sub(content.Min)
+    return nr.Header.Orientation.StoredRect(part, int(nr.Header.Width), int(nr.Header.Height))
+}
+
+// renderCanvas fills rect with the background and draws the main image
+// pixels under it, read by read in displayed main image coordinates.
+func renderCanvas(c *Canvas, rect, canvas, content image.Rectangle, read func(image.Rectangle) (*image.RGBA, error)) (*image.RGBA, error) {
+    rect = rect.Intersect(canvas)
+    if rect.Empty() {
+        return nil, errors.New("region does not overlap the canvas")
+    }
+    dst := image.NewRGBA(rect)
+    if c != nil {
+        draw.Draw(dst, rect, image.NewUniform(c.Background), image.Point{}, draw.Src)
+    }
+    part := rect.Intersect(content)
+    if part.Empty() {
+        return dst, nil
+    }
+    src, err := read(part.Sub(content.Min))
+    if err != nil {
+        return nil, err
+    }
+    draw.Draw(dst, part, src, src.Rect.Min, draw.Src)
+    return dst, nil
+}
+
+// A canvas is stored in a CNVS chunk:
+//
+//	width uint32 | height uint32 | origin x uint32 | origin y uint32 | R G B A
+func (c *Canvas) encode(order binary.ByteOrder) []byte {
+    b := make([]byte, 20)
+    order.PutUint32(b[0:], uint32(c.Width))
+    order.PutUint32(b[4:], uint32(c.Height))
+    order.PutUint32(b[8:], uint32(c.Origin.X))
+    order.PutUint32(b[12:], uint32(c.Origin.Y))
+    b[16], b[17], b[18], b[19] = c.Background.R, c.Background.G, c.Background.B, c.Background.A
+    return b
+}
+
+func decodeCanvas(reader io.Reader, order binary.ByteOrder, length uint64) (*Canvas, error) {
+    if length != 20 {
+        return nil, fmt.Errorf("%s chunk is %d bytes, want 20", ChunkCanvas, length)
+    }
+    var b [20]byte
+    if _, err := io.ReadFull(reader, b[:]); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkCanvas, err)
+    }
+    return &Canvas{
+        Width:      int(order.Uint32(b[0:])),
+        Height:     int(order.Uint32(b[4:])),
+        Origin:     image.Pt(int(order.Uint32(b[8:])), int(order.Uint32(b[12:]))),
+        Background: color.RGBA{b[16], b[17], b[18], b[19]},
+    }, nil
+}
+
+func (nr *Reader) loadCanvas() error {
+    offset, length, ok, err := nr.findChunk(ChunkCanvas)
+    if err != nil || !ok {
+        return err
+    }
+    nr.canvas, err = decodeCanvas(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+    if err != nil {
+        return err
+    }
+    b := nr.OrientedBounds()
+    return nr.canvas.check(b.Dx(), b.Dy())
+}
@@ -0,0 +1,560 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "math"
+    "mime"
+    "strconv"
+    "strings"
+    "sync"
+    "unicode/utf8"
+
+    "golang.org/x/image/font"
+    "golang.org/x/image/font/gofont/gobold"
+    "golang.org/x/image/font/gofont/gobolditalic"
+    "golang.org/x/image/font/gofont/goitalic"
+    "golang.org/x/image/font/gofont/gomono"
+    "golang.org/x/image/font/gofont/gomonobold"
+    "golang.org/x/image/font/gofont/gomonobolditalic"
+    "golang.org/x/image/font/gofont/gomonoitalic"
+    "golang.org/x/image/font/gofont/goregular"
+    "golang.org/x/image/font/opentype"
+    "golang.org/x/image/math/fixed"
+)
+
+// MIME types of caption content. The data is the caption text itself, in
+// UTF-8, and its style travels as MIME type parameters.
+const (
+    MIMETypeText     = "text/plain"
+    MIMETypeMarkdown = "text/markdown"
+)
+
+// Caption is text a hotspot opens instead of an image, such as an
+// explanation of the linked area.
+type Caption struct {
+    Text string
+    // Markdown selects the Markdown subset RenderCaption understands:
+    // headings, paragraphs, lists, fenced code, rules, bold, italic, code
+    // spans and links. Otherwise each line of Text is drawn as it is.
+    Markdown bool
+    Style    CaptionStyle
+}
+
+// CaptionStyle controls how a caption is drawn. Zero fields take defaults.
+type CaptionStyle struct {
+    // FontSize is the body text size in pixels, 16 by default.
+    FontSize float64
+    // Width is the width the text wraps to, padding included, 320 pixels
+    // by default.
+    Width int
+    // Padding surrounds the text, half the font size by default.
+    Padding int
+    // Color and Background are CSS colors such as "#333" or "white",
+    // black on white by default. Background may be "none".
+    Color      string
+    Background string
+}
+
+func (s CaptionStyle) withDefaults() CaptionStyle {
+    if s.FontSize <= 0 {
+        s.FontSize = 16
+    }
+    if s.Width <= 0 {
+        s.Width = 320
+    }
+    if s.Padding <= 0 {
+        s.Padding = int(math.Round(s.FontSize / 2))
+    }
+    if s.Color == "" {
+        s.Color = "black"
+    }
+    if s.Background == "" {
+        s.Background = "white"
+    }
+    return s
+}
+
+// mimeType returns the MIME type c is stored under, with its style as
+// parameters.
+func (c Caption) mimeType() string {
+    t := MIMETypeText
+    if c.Markdown {
+        t = MIMETypeMarkdown
+    }
+    params := map[string]string{"charset": "utf-8"}
+    if c.Style.FontSize > 0 {
+        params["size"] = strconv.FormatFloat(c.Style.FontSize, 'f', -1, 64)
+    }
+    if c.Style.Width > 0 {
+        params["width"] = strconv.Itoa(c.Style.Width)
+    }
+    if c.Style.Padding > 0 {
+        params["padding"] = strconv.Itoa(c.Style.Padding)
+    }
+    if c.Style.Color != "" {
+        params["color"] = c.Style.Color
+    }
+    if c.Style.Background != "" {
+        params["background"] = c.Style.Background
+    }
+    return mime.FormatMediaType(t, params)
+}
+
+// Caption returns the caption nc holds, or false when nc is nil or not
+// text. Style parameters that do not parse are left at their defaults.
+func (nc *NestedContent) Caption() (Caption, bool) {
+    if nc == nil {
+        return Caption{}, false
+    }
+    t, params, err := mime.ParseMediaType(nc.MIMEType)
+    if err != nil && !errors.Is(err, mime.ErrInvalidMediaParameter) {
+        return Caption{}, false
+    }
+    if t != MIMETypeText && t != MIMETypeMarkdown {
+        return Caption{}, false
+    }
+    c := Caption{Text: string(nc.Data), Markdown: t == MIMETypeMarkdown}
+    c.Style.FontSize, _ = strconv.ParseFloat(params["size"], 64)
+    c.Style.Width, _ = strconv.Atoi(params["width"])
+    c.Style.Padding, _ = strconv.Atoi(params["padding"])
+    c.Style.Color, c.Style.Background = params["color"], params["background"]
+    return c, true
+}
+
+// NewCaptionNested builds a nested entry holding c, with c rendered by
+// RenderCaption as its pixels for readers that only show pixels.
+func NewCaptionNested(c Caption) (NestedImage, error) {
+    img, err := RenderCaption(c)
+    if err != nil {
+        return NestedImage{}, err
+    }
+    ni, err := NewNestedImage(overWhite(img))
+    if err != nil {
+        return NestedImage{}, err
+    }
+    ni.Content = &NestedContent{MIMEType: c.mimeType(), Data: []byte(c.Text)}
+    return ni, nil
+}
+
+// RenderCaption draws c at its style's width, as tall as the text needs,
+// in the Go fonts.
+func RenderCaption(c Caption) (*image.RGBA, error) {
+    return renderCaption(c, 0)
+}
+
+// captionLinkColor draws link text.
+var captionLinkColor = color.NRGBA{0x1a, 0x5f, 0xb4, 0xff}
+
+// renderCaption draws c, cropped or extended to height h unless h is 0.
+func renderCaption(c Caption, h int) (*image.RGBA, error) {
+    st := c.Style.withDefaults()
+    if st.Width > math.MaxUint16 || st.FontSize > float64(st.Width) || 2*st.Padding >= st.Width {
+        return nil, fmt.Errorf("caption style does not fit %d pixels wide", st.Width)
+    }
+    fg, ok := svgColor(st.Color)
+    if !ok || fg == nil {
+        return nil, fmt.Errorf("caption has invalid color %q", st.Color)
+    }
+    bg, ok := svgColor(st.Background)
+    if !ok {
+        return nil, fmt.Errorf("caption has invalid background %q", st.Background)
+    }
+    fonts, err := captionFonts()
+    if err != nil {
+        return nil, err
+    }
+
+    l := &captionLayout{fonts: fonts, faces: map[captionFace]font.Face{}, style: st, y: st.Padding}
+    defer l.close()
+    var blocks []captionBlock
+    if c.Markdown {
+        blocks = parseMarkdown(c.Text)
+    } else {
+        blocks = parsePlainText(c.Text)
+    }
+    for i, b := range blocks {
+        if err := l.block(b, i == len(blocks)-1); err != nil {
+            return nil, err
+        }
+    }
+    if h <= 0 {
+        h = l.y + st.Padding
+    }
+    if int64(st.Width)*int64(h) > math.MaxInt32 {
+        return nil, fmt.Errorf("caption is too long to render")
+    }
+
+    dst := image.NewRGBA(image.Rect(0, 0, st.Width, h))
+    if bg != nil {
+        draw.Draw(dst, dst.Rect, image.NewUniform(*bg), image.Point{}, draw.Src)
+    }
+    for _, r := range l.rules {
+        draw.Draw(dst, r, image.NewUniform(*fg), image.Point{}, draw.Over)
+    }
+    for _, p := range l.pieces {
+        src := image.NewUniform(*fg)
+        if p.flags&captionLink != 0 {
+            src = image.NewUniform(captionLinkColor)
+        }
+        d := font.Drawer{Dst: dst, Src: src, Face: l.faces[p.face], Dot: p.dot}
+        d.DrawString(p.text)
+    }
+    return dst, nil
+}
+
+// Style flags of caption text. The low three bits select the font.
+const (
+    captionBold = 1 << iota
+    captionItalic
+    captionMono
+    captionLink
+)
+
+var captionFonts = sync.OnceValues(func() ([8]*opentype.Font, error) {
+    var fonts [8]*opentype.Font
+    for i, ttf := range [8][]byte{
+        goregular.TTF, gobold.TTF, goitalic.TTF, gobolditalic.TTF,
+        gomono.TTF, gomonobold.TTF, gomonoitalic.TTF, gomonobolditalic.TTF,
+    } {
+        f, err := opentype.Parse(ttf)
+        if err != nil {
+            return fonts, fmt.Errorf("failed to load caption font: %w", err)
+        }
+        fonts[i] = f
+    }
+    return fonts, nil
+})
+
+// captionBlock is a paragraph, heading, list item or line of code.
+type captionBlock struct {
+    text string
+    // level is 1 to 6 for headings.
+    level int
+    // marker is the bullet or number of a list item.
+    marker string
+    // inline parses Markdown emphasis, code spans and links in text.
+    inline bool
+    // pre keeps the text as it is, in the monospace font.
+    pre  bool
+    rule bool
+    // gap adds space after the block.
+    gap bool
+}
+
+// parsePlainText returns a block per line.
+func parsePlainText(text string) []captionBlock {
+    lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+    blocks := make([]captionBlock, len(lines))
+    for i, line := range lines {
+        blocks[i] = captionBlock{text: line}
+    }
+    return blocks
+}
+
+func parseMarkdown(text string) []captionBlock {
+    var blocks []captionBlock
+    var para []string
+    flush := func() {
+        if para != nil {
+            blocks = append(blocks, captionBlock{text: strings.Join(para, " "), inline: true, gap: true})
+            para = nil
+        }
+    }
+    lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+    for i := 0; i < len(lines); i++ {
+        line := strings.TrimRight(lines[i], " \t")
+        trimmed := strings.TrimLeft(line, " \t")
+        switch {
+        case strings.HasPrefix(trimmed, "```"):
+            flush()
+            start := len(blocks)
+            for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+                blocks = append(blocks, captionBlock{text: strings.TrimRight(lines[i], " \t"), pre: true})
+            }
+            if len(blocks) > start {
+                blocks[len(blocks)-1].gap = true
+            }
+        case trimmed == "":
+            flush()
+        case isMarkdownRule(trimmed):
+            flush()
+            blocks = append(blocks, captionBlock{rule: true, gap: true})
+        case strings.HasPrefix(trimmed, "#"):
+            level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+            if level > 6 || (level < len(trimmed) && trimmed[level] != ' ') {
+                para = append(para, trimmed)
+                break
+            }
+            flush()
+            blocks = append(blocks, captionBlock{text: strings.Trim(trimmed[level:], " #"), level: level, inline: true, gap: true})
+        default:
+            if marker, rest, ok := markdownListItem(trimmed); ok {
+                flush()
+                blocks = append(blocks, captionBlock{text: rest, marker: marker, inline: true, gap: true})
+                continue
+            }
+            // Indented lines right after a list item continue it.
+            if para == nil && line != trimmed && len(blocks) > 0 && blocks[len(blocks)-1].marker != "" {
+                blocks[len(blocks)-1].text += " " + trimmed
+                continue
+            }
+            para = append(para, trimmed)
+        }
+    }
+    flush()
+    // List items sit together, spaced only from what follows them.
+    for i := range blocks {
+        if blocks[i].marker != "" && i+1 < len(blocks) && blocks[i+1].marker != "" {
+            blocks[i].gap = false
+        }
+    }
+    return blocks
+}
+
+func isMarkdownRule(s string) bool {
+    s = strings.ReplaceAll(s, " ", "")
+    return len(s) >= 3 && (strings.Trim(s, "-") == "" || strings.Trim(s, "*") == "" || strings.Trim(s, "_") == "")
+}
+
+// markdownListItem splits "- item" and "3. item" into marker and text.
+func markdownListItem(s string) (string, string, bool) {
+    if len(s) >= 2 && strings.IndexByte("-*+", s[0]) >= 0 && s[1] == ' ' {
+        return "•", strings.TrimSpace(s[2:]), true
+    }
+    n := len(s) - len(strings.TrimLeft(s, "0123456789"))
+    if n > 0 && n < 10 && len(s) > n+1 && (s[n] == '.' || s[n] == ')') && s[n+1] == ' ' {
+        return s[:n] + ".", strings.TrimSpace(s[n+2:]), true
+    }
+    return "", "", false
+}
+
+// captionRun is text in one style.
+type captionRun struct {
+    text  string
+    flags int
+}
+
+// parseInline splits Markdown text into runs at emphasis, code spans and
+// links. Links keep only their text.
+func parseInline(s string, flags int) []captionRun {
+    var runs []captionRun
+    var cur strings.Builder
+    emit := func() {
+        if cur.Len() > 0 {
+            runs = append(runs, captionRun{cur.String(), flags})
+            cur.Reset()
+        }
+    }
+    for i := 0; i < len(s); {
+        c := s[i]
+        switch {
+        case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()#+-.!", s[i+1]) >= 0:
+            cur.WriteByte(s[i+1])
+            i += 2
+            continue
+        case c == '`':
+            if j := strings.IndexByte(s[i+1:], '`'); j >= 0 {
+                emit()
+                runs = append(runs, captionRun{s[i+1 : i+1+j], flags | captionMono})
+                i += j + 2
+                continue
+            }
+        case (c == '*' || c == '_') && i+1 < len(s) && s[i+1] == c:
+            emit()
+            flags ^= captionBold
+            i += 2
+            continue
+        case c == '*' || c == '_':
+            // A marker can only open before text, and underscores
+            // inside words are literal.
+            opens := i+1 < len(s) && s[i+1] != ' '
+            inWord := i > 0 && i+1 < len(s) && isWordByte(s[i-1]) && isWordByte(s[i+1])
+            if (flags&captionItalic != 0 || opens) && !(c == '_' && inWord) {
+                emit()
+                flags ^= captionItalic
+                i++
+                continue
+            }
+        case c == '[':
+            if j := strings.Index(s[i:], "]("); j > 0 {
+                if k := strings.IndexByte(s[i+j:], ')'); k >= 0 {
+                    emit()
+                    runs = append(runs, parseInline(s[i+1:i+j], flags|captionLink)...)
+                    i += j + k + 1
+                    continue
+                }
+            }
+        }
+        cur.WriteByte(c)
+        i++
+    }
+    emit()
+    return runs
+}
+
+func isWordByte(b byte) bool {
+    return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= 0x80
+}
+
+type captionFace struct {
+    font int
+    size float64
+}
+
+// captionPiece is text drawn at a baseline position.
+type captionPiece struct {
+    text  string
+    flags int
+    face  captionFace
+    dot   fixed.Point26_6
+}
+
+type captionLayout struct {
+    fonts  [8]*opentype.Font
+    faces  map[captionFace]font.Face
+    style  CaptionStyle
+    pieces []captionPiece
+    rules  []image.Rectangle
+    // y is the top of the next line.
+    y int
+}
+
+func (l *captionLayout) close() {
+    for _, f := range l.faces {
+        f.Close()
+    }
+}
+
+func (l *captionLayout) face(flags int, size float64) (captionFace, font.Face, error) {
+    key := captionFace{flags & 7, size}
+    if f, ok := l.faces[key]; ok {
+        return key, f, nil
+    }
+    f, err := opentype.NewFace(l.fonts[key.font], &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingNone})
+    if err != nil {
+        return key, nil, fmt.Errorf("failed to load caption font: %w", err)
+    }
+    l.faces[key] = f
+    return key, f, nil
+}
+
+// headingScale sizes headings by level relative to body text.
+var headingScale = [7]float64{1, 1.6, 1.35, 1.15, 1, 1, 1}
+
+// block lays out b below the blocks before it, wrapping its words.
+func (l *captionLayout) block(b captionBlock, last bool) error {
+    st := l.style
+    size := st.FontSize * headingScale[b.level]
+    lineHeight := int(math.Ceil(size * 1.3))
+    left, right := st.Padding, st.Width-st.Padding
+    if b.marker != "" {
+        left += int(math.Ceil(size * 1.5))
+    }
+    if b.rule {
+        t := max(int(size/16), 1)
+        mid := l.y + lineHeight/2
+        l.rules = append(l.rules, image.Rect(left, mid-t/2, right, mid-t/2+t))
+        l.y += lineHeight
+        return nil
+    }
+
+    var runs []captionRun
+    base := 0
+    if b.level > 0 {
+        base = captionBold
+    }
+    switch {
+    case b.pre:
+        runs = []captionRun{{strings.ReplaceAll(b.text, "\t", "    "), captionMono}}
+    case b.inline:
+        runs = parseInline(b.text, base)
+    default:
+        runs = []captionRun{{b.text, 0}}
+    }
+
+    _, body, err := l.face(base, size)
+    if err != nil {
+        return err
+    }
+    ascent := body.Metrics().Ascent
+    x := fixed.I(left)
+    if b.pre {
+        // Code keeps its indentation.
+        _, mono, err := l.face(captionMono, size)
+        if err != nil {
+            return err
+        }
+        indent := len(runs[0].text) - len(strings.TrimLeft(runs[0].text, " "))
+        x += font.MeasureString(mono, strings.Repeat(" ", indent))
+    }
+    baseline := func() fixed.Int26_6 { return fixed.I(l.y) + ascent }
+    if b.marker != "" {
+        key, f, err := l.face(0, size)
+        if err != nil {
+            return err
+        }
+        mx := fixed.I(left) - font.MeasureString(f, b.marker) - fixed.I(int(size*0.4))
+        l.pieces = append(l.pieces, captionPiece{b.marker, 0, key, fixed.Point26_6{X: mx, Y: baseline()}})
+    }
+
+    empty := true
+    for _, r := range runs {
+        key, f, err := l.face(r.flags, size)
+        if err != nil {
+            return err
+        }
+        space := font.MeasureString(f, " ")
+        words := strings.Split(r.text, " ")
+        for i, w := range words {
+            gap := fixed.Int26_6(0)
+            if i > 0 && !empty {
+                gap = space
+            }
+            if w == "" {
+                x += gap
+                continue
+            }
+            width := font.MeasureString(f, w)
+            if !empty && x+gap+width > fixed.I(right) {
+                l.y += lineHeight
+                x, gap, empty = fixed.I(left), 0, true
+            }
+            // Words wider than a line are broken between characters.
+            for empty && width > fixed.I(right)-x && utf8.RuneCountInString(w) > 1 {
+                n := fitPrefix(f, w, fixed.I(right)-x)
+                l.pieces = append(l.pieces, captionPiece{w[:n], r.flags, key, fixed.Point26_6{X: x, Y: baseline()}})
+                l.y += lineHeight
+                x, w = fixed.I(left), w[n:]
+                width = font.MeasureString(f, w)
+            }
+            l.pieces = append(l.pieces, captionPiece{w, r.flags, key, fixed.Point26_6{X: x + gap, Y: baseline()}})
+            x += gap + width
+            empty = false
+        }
+    }
+    l.y += lineHeight
+    if b.gap && !last {
+        l.y += int(math.Ceil(st.FontSize * 0.5))
+    }
+    return nil
+}
+
+// fitPrefix returns the byte length of the longest prefix of s, at least
+// one character, no wider than limit.
+func fitPrefix(f font.Face, s string, limit fixed.Int26_6) int {
+    n := 0
+    var width fixed.Int26_6
+    for i, r := range s {
+        adv, _ := f.GlyphAdvance(r)
+        if i > 0 && width+adv > limit {
+            return n
+        }
+        width += adv
+        n = i + utf8.RuneLen(r)
+    }
+    return n
+}
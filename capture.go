@@ -0,0 +1,81 @@
+package nest
+
+import (
+    "fmt"
+    "image"
+    "image/draw"
+)
+
+// Capture builds a file from a full resolution source where every crop
+// becomes a nested image, linked as 1, 2, ... from the region it was cut
+// from. Crops are clipped to the source and later crops win where they
+// overlap. With opts.MainSize set, the main image is a reduced overview of
+// the source and the links are scaled with it.
+func Capture(src image.Image, crops []image.Rectangle, opts CaptureOptions) (*NestedImageFile, error) {
+    b := src.Bounds()
+    if b.Empty() {
+        return nil, fmt.Errorf("source image is empty")
+    }
+
+    nested := make([]NestedImage, len(crops))
+    for i, c := range crops {
+        c = c.Intersect(b)
+        if c.Empty() {
+            return nil, fmt.Errorf("crop %d (%v) does not overlap the %v source", i, crops[i], b)
+        }
+        ni, err := NewNestedImage(subImage(src, c))
+        if err != nil {
+            return nil, fmt.Errorf("crop %d: %w", i, err)
+        }
+        ni.Role = RoleDetail
+        nested[i] = ni
+    }
+
+    w, h := b.Dx(), b.Dy()
+    if opts.MainSize > 0 && max(w, h) > opts.MainSize {
+        if w >= h {
+            w, h = opts.MainSize, max(h*opts.MainSize/w, 1)
+        } else {
+            w, h = max(w*opts.MainSize/h, 1), opts.MainSize
+        }
+    }
+    main := src
+    if w != b.Dx() || h != b.Dy() {
+        rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+        draw.Draw(rgba, rgba.Rect, src, b.Min, draw.Src)
+        main = ResizeImage(rgba, w, h, AreaFilter)
+    }
+
+    nif := FromImage(main, opts.ImportOptions)
+    nif.NestedImages = nested
+    nif.Header.NestedCount = uint32(len(nested))
+    for i, c := range crops {
+        c = c.Intersect(b).Sub(b.Min)
+        // Scale the crop into main image coordinates, rounding outwards so
+        // small crops keep at least one linked pixel.
+        r := image.Rect(c.Min.X*w/b.Dx(), c.Min.Y*h/b.Dy(), ceilDiv(c.Max.X*w, b.Dx()), ceilDiv(c.Max.Y*h, b.Dy()))
+        for y := r.Min.Y; y < r.Max.Y; y++ {
+            for x := r.Min.X; x < r.Max.X; x++ {
+                nif.MainImage[y][x].NestedIdx = uint32(i + 1)
+            }
+        }
+    }
+    return nif, nil
+}
+
+func ceilDiv(a, b int) int {
+    return (a + b - 1) / b
+}
+
+// subImage returns the part of img inside r, copying only when img has no
+// SubImage method.
+func subImage(img image.Image, r image.Rectangle) image.Image {
+    if s, ok := img.(interface {
+        SubImage(image.Rectangle) image.Image
+    }); ok {
+        return s.SubImage(r)
+    }
+    rgba := image.NewRGBA(r)
+    draw.Draw(rgba, r, img, r.Min, draw.Src)
+    return rgba
+}
@@ -0,0 +1,351 @@
+package nest
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "image/png"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// CatalogExt is the extension of catalog sidecar files.
+const CatalogExt = ".nestcat"
+
+const (
+    catalogMagic   = "NCAT"
+    catalogVersion = 1
+
+    maxCatalogField = 64 << 20
+)
+
+// CatalogEntry summarises one file of a collection. Path is slash separated
+// and relative to the catalogued directory.
+type CatalogEntry struct {
+    Path        string
+    SHA256      [32]byte
+    Size        int64
+    ModTime     int64
+    Width       uint32
+    Height      uint32
+    TileSize    uint16
+    NestedCount uint32
+    Metadata    Metadata
+    // Thumbnail is PNG encoded, or empty when thumbnails were disabled.
+    Thumbnail []byte
+}
+
+func (e *CatalogEntry) ThumbnailImage() (image.Image, error) {
+    if len(e.Thumbnail) == 0 {
+        return nil, errors.New("entry has no thumbnail")
+    }
+    return png.Decode(bytes.NewReader(e.Thumbnail))
+}
+
+// Catalog indexes a collection of NEST files so galleries and queries don't
+// need to open every file.
+type Catalog struct {
+    Entries []CatalogEntry
+}
+
+func (c *Catalog) Lookup(path string) *CatalogEntry {
+    for i := range c.Entries {
+        if c.Entries[i].Path == path {
+            return &c.Entries[i]
+        }
+    }
+    return nil
+}
+
+// Query returns the entries accepted by match, in catalog order.
+func (c *Catalog) Query(match func(*CatalogEntry) bool) []*CatalogEntry {
+    var entries []*CatalogEntry
+    for i := range c.Entries {
+        if match(&c.Entries[i]) {
+            entries = append(entries, &c.Entries[i])
+        }
+    }
+    return entries
+}
+
+// BuildCatalog indexes every .nest file under dir. Entries of prev whose size
+// and modification time are unchanged are reused without reading the file.
+// Files that cannot be read are left out and reported in the returned error.
+func BuildCatalog(dir string, prev *Catalog, opts CatalogOptions) (*Catalog, error) {
+    c := &Catalog{}
+    var errs []error
+    err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".nest") {
+            return nil
+        }
+        rel, err := filepath.Rel(dir, path)
+        if err != nil {
+            return err
+        }
+        rel = filepath.ToSlash(rel)
+        info, err := d.Info()
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", path, err))
+            return nil
+        }
+        if prev != nil {
+            if e := prev.Lookup(rel); e != nil && e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() {
+                c.Entries = append(c.Entries, *e)
+                return nil
+            }
+        }
+        entry, err := catalogFile(path, opts)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", path, err))
+            return nil
+        }
+        entry.Path = rel
+        entry.ModTime = info.ModTime().UnixNano()
+        c.Entries = append(c.Entries, entry)
+        return nil
+    })
+    if err != nil {
+        return c, err
+    }
+    return c, errors.Join(errs...)
+}
+
+func catalogFile(path string, opts CatalogOptions) (CatalogEntry, error) {
+    var entry CatalogEntry
+    file, err := os.Open(path)
+    if err != nil {
+        return entry, err
+    }
+    defer file.Close()
+
+    h := sha256.New()
+    if entry.Size, err = io.Copy(h, file); err != nil {
+        return entry, fmt.Errorf("failed to hash file: %w", err)
+    }
+    copy(entry.SHA256[:], h.Sum(nil))
+
+    nr, err := NewReader(file, entry.Size)
+    if err != nil {
+        return entry, err
+    }
+    entry.Width = nr.Header.Width
+    entry.Height = nr.Header.Height
+    entry.TileSize = nr.Header.TileSize
+    entry.NestedCount = nr.Header.NestedCount
+    if entry.Metadata, err = nr.Metadata(); err != nil {
+        return entry, err
+    }
+
+    size := opts.ThumbnailSize
+    if size == 0 {
+        size = DefaultThumbnailSize
+    }
+    if size < 0 {
+        return entry, nil
+    }
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        return entry, err
+    }
+    nif := &NestedImageFile{}
+    if err := nif.ReadWithOptions(file, ReadOptions{Workers: opts.Workers}); err != nil {
+        return entry, err
+    }
+    var buf bytes.Buffer
+    if err := png.Encode(&buf, fitBox(nif.ToImage(), size)); err != nil {
+        return entry, fmt.Errorf("failed to encode thumbnail: %w", err)
+    }
+    entry.Thumbnail = buf.Bytes()
+    return entry, nil
+}
+
+// fitBox box-filters img down so neither side exceeds size, keeping the
+// aspect ratio. Images that already fit are returned as is.
+func fitBox(img *image.RGBA, size int) *image.RGBA {
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    if w <= size && h <= size {
+        return img
+    }
+    tw, th := size, h*size/w
+    if h > w {
+        tw, th = w*size/h, size
+    }
+    return boxResize(img, max(tw, 1), max(th, 1))
+}
+
+func boxResize(img *image.RGBA, tw, th int) *image.RGBA {
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+    for y := 0; y < th; y++ {
+        y0, y1 := y*h/th, max((y+1)*h/th, y*h/th+1)
+        for x := 0; x < tw; x++ {
+            x0, x1 := x*w/tw, max((x+1)*w/tw, x*w/tw+1)
+            var sum [4]int
+            for sy := y0; sy < y1; sy++ {
+                for sx := x0; sx < x1; sx++ {
+                    i := img.PixOffset(img.Rect.Min.X+sx, img.Rect.Min.Y+sy)
+                    for c := 0; c < 4; c++ {
+                        sum[c] += int(img.Pix[i+c])
+                    }
+                }
+            }
+            n := (y1 - y0) * (x1 - x0)
+            i := dst.PixOffset(x, y)
+            for c := 0; c < 4; c++ {
+                dst.Pix[i+c] = byte((sum[c] + n/2) / n)
+            }
+        }
+    }
+    return dst
+}
+
+type catalogRecord struct {
+    SHA256      [32]byte
+    Size        int64
+    ModTime     int64
+    Width       uint32
+    Height      uint32
+    TileSize    uint16
+    NestedCount uint32
+}
+
+// Catalogs are always little-endian:
+//
+//	Magic "NCAT" | Version uint16 | Count uint32 | entries
+//
+// where each entry is
+//
+//	path length uint16 | path | catalogRecord |
+//	metadata length uint32 | META payload | thumbnail length uint32 | PNG
+func (c *Catalog) Write(writer io.Writer) error {
+    bw := bufio.NewWriter(writer)
+    order := binary.LittleEndian
+    bw.WriteString(catalogMagic)
+    binary.Write(bw, order, uint16(catalogVersion))
+    binary.Write(bw, order, uint32(len(c.Entries)))
+    for i := range c.Entries {
+        e := &c.Entries[i]
+        if len(e.Path) > 0xffff {
+            return fmt.Errorf("catalog path %q is too long", e.Path)
+        }
+        meta, err := e.Metadata.encode(order)
+        if err != nil {
+            return fmt.Errorf("failed to encode metadata of %s: %w", e.Path, err)
+        }
+        binary.Write(bw, order, uint16(len(e.Path)))
+        bw.WriteString(e.Path)
+        rec := catalogRecord{e.SHA256, e.Size, e.ModTime, e.Width, e.Height, e.TileSize, e.NestedCount}
+        binary.Write(bw, order, &rec)
+        binary.Write(bw, order, uint32(len(meta)))
+        bw.Write(meta)
+        binary.Write(bw, order, uint32(len(e.Thumbnail)))
+        bw.Write(e.Thumbnail)
+    }
+    if err := bw.Flush(); err != nil {
+        return fmt.Errorf("failed to write catalog: %w", err)
+    }
+    return nil
+}
+
+func ReadCatalog(reader io.Reader) (*Catalog, error) {
+    br := bufio.NewReader(reader)
+    order := binary.LittleEndian
+    var magic [4]byte
+    if _, err := io.ReadFull(br, magic[:]); err != nil {
+        return nil, fmt.Errorf("failed to read catalog header: %w", err)
+    }
+    if string(magic[:]) != catalogMagic {
+        return nil, errors.New("invalid catalog format")
+    }
+    var version uint16
+    var count uint32
+    if err := binary.Read(br, order, &version); err != nil {
+        return nil, fmt.Errorf("failed to read catalog header: %w", err)
+    }
+    if version < 1 || version > catalogVersion {
+        return nil, fmt.Errorf("unsupported catalog version %d", version)
+    }
+    if err := binary.Read(br, order, &count); err != nil {
+        return nil, fmt.Errorf("failed to read catalog header: %w", err)
+    }
+
+    c := &Catalog{}
+    for i := uint32(0); i < count; i++ {
+        var e CatalogEntry
+        var n uint16
+        if err := binary.Read(br, order, &n); err != nil {
+            return nil, fmt.Errorf("failed to read catalog entry %d: %w", i, err)
+        }
+        path := make([]byte, n)
+        if _, err := io.ReadFull(br, path); err != nil {
+            return nil, fmt.Errorf("failed to read catalog entry %d: %w", i, err)
+        }
+        e.Path = string(path)
+        var rec catalogRecord
+        if err := binary.Read(br, order, &rec); err != nil {
+            return nil, fmt.Errorf("failed to read catalog entry %s: %w", e.Path, err)
+        }
+        e.SHA256, e.Size, e.ModTime = rec.SHA256, rec.Size, rec.ModTime
+        e.Width, e.Height, e.TileSize, e.NestedCount = rec.Width, rec.Height, rec.TileSize, rec.NestedCount
+
+        meta, err := readCatalogField(br)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read metadata of %s: %w", e.Path, err)
+        }
+        if e.Metadata, err = decodeMetadata(bytes.NewReader(meta), order, uint64(len(meta))); err != nil {
+            return nil, fmt.Errorf("failed to decode metadata of %s: %w", e.Path, err)
+        }
+        if e.Thumbnail, err = readCatalogField(br); err != nil {
+            return nil, fmt.Errorf("failed to read thumbnail of %s: %w", e.Path, err)
+        }
+        c.Entries = append(c.Entries, e)
+    }
+    return c, nil
+}
+
+func readCatalogField(reader io.Reader) ([]byte, error) {
+    var n uint32
+    if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+        return nil, err
+    }
+    if n > maxCatalogField {
+        return nil, fmt.Errorf("field of %d bytes exceeds the %d byte limit", n, maxCatalogField)
+    }
+    data := make([]byte, n)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, err
+    }
+    return data, nil
+}
+
+func WriteCatalogFile(filename string, c *Catalog) error {
+    file, err := CreateAtomic(filename, false)
+    if err != nil {
+        return fmt.Errorf("failed to create file: %w", err)
+    }
+    defer file.Abort()
+
+    if err := c.Write(file); err != nil {
+        return err
+    }
+    return file.Commit()
+}
+
+func ReadCatalogFile(filename string) (*Catalog, error) {
+    file, err := os.Open(filename)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open file: %w", err)
+    }
+    defer file.Close()
+
+    return ReadCatalog(file)
+}
@@ -0,0 +1,163 @@
+package nest
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "sort"
+)
+
+var ErrChecksum = errors.New("tile checksum mismatch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func tileChecksum(data []byte) uint32 {
+    return crc32.Checksum(data, crcTable)
+}
+
+// Tile checksums are kept in a TSUM chunk rather than the index, so files
+// stay readable by older readers. It holds a count followed by one CRC-32C
+// per index entry, in index order.
+func (ti *TileIndex) encodeChecksums(order binary.ByteOrder) []byte {
+    data := make([]byte, 4+4*len(ti.Entries))
+    order.PutUint32(data, uint32(len(ti.Entries)))
+    for i, e := range ti.Entries {
+        order.PutUint32(data[4+4*i:], e.Checksum)
+    }
+    return data
+}
+
+func (ti *TileIndex) decodeChecksums(reader io.Reader, order binary.ByteOrder, length uint64) error {
+    if length != 4+4*uint64(len(ti.Entries)) {
+        return fmt.Errorf("%s chunk is %d bytes for %d tiles", ChunkChecksums, length, len(ti.Entries))
+    }
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return fmt.Errorf("failed to read %s chunk: %w", ChunkChecksums, err)
+    }
+    if int(order.Uint32(data)) != len(ti.Entries) {
+        return fmt.Errorf("%s chunk lists %d tiles, the index has %d", ChunkChecksums, order.Uint32(data), len(ti.Entries))
+    }
+    for i := range ti.Entries {
+        ti.Entries[i].Checksum = order.Uint32(data[4+4*i:])
+    }
+    ti.HasChecksums = true
+    return nil
+}
+
+func (nr *Reader) loadChecksums() error {
+    offset, length, ok, err := nr.findChunk(ChunkChecksums)
+    if err != nil || !ok {
+        return err
+    }
+    return nr.Index.decodeChecksums(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+}
+
+// checkTile verifies the stored bytes of a tile when the file has checksums.
+// Corrupt tiles are rebuilt from parity when the file carries it.
+func (nr *Reader) checkTile(e TileIndexEntry, data []byte) ([]byte, error) {
+    if !nr.Index.HasChecksums || tileChecksum(data) == e.Checksum {
+        return data, nil
+    }
+    if nr.parity != nil {
+        fixed, err := nr.recoverTile(nr.Index.position(e.Tile.X, e.Tile.Y))
+        if err == nil {
+            return fixed, nil
+        }
+        return nil, fmt.Errorf("tile (%d, %d): %w, and parity could not rebuild it: %v", e.Tile.X, e.Tile.Y, ErrChecksum, err)
+    }
+    return nil, fmt.Errorf("tile (%d, %d): %w", e.Tile.X, e.Tile.Y, ErrChecksum)
+}
+
+// Verify returns the tiles whose stored bytes don't match their checksum.
+func (nr *Reader) Verify() ([]TileCoord, error) {
+    if !nr.Index.HasChecksums {
+        return nil, errors.New("file has no tile checksums")
+    }
+    var bad []TileCoord
+    for _, e := range nr.Index.Entries {
+        ok, err := nr.tileIntact(e)
+        if err != nil {
+            return bad, err
+        }
+        if !ok {
+            bad = append(bad, e.Tile)
+        }
+    }
+    return bad, nil
+}
+
+func (nr *Reader) tileIntact(e TileIndexEntry) (bool, error) {
+    buf := make([]byte, e.Length)
+    if _, err := nr.r.ReadAt(buf, e.Offset); err != nil {
+        return false, fmt.Errorf("failed to read tile (%d, %d): %w", e.Tile.X, e.Tile.Y, err)
+    }
+    return tileChecksum(buf) == e.Checksum, nil
+}
+
+type RepairReport struct {
+    // FromB lists the tiles that were corrupt in the first copy and taken
+    // from the second.
+    FromB []TileCoord
+    // Lost lists the tiles that were corrupt in both copies. They are
+    // written from the first copy.
+    Lost []TileCoord
+}
+
+// Repair writes a clean copy of a file to dst from two replicas that each
+// may have corrupt tiles. Everything but the tiles is copied from a, and each
+// tile comes from whichever copy passes its checksum. Both replicas must
+// share the same header and tile index. When a tile is corrupt in both, the
+// file is still written and the returned error wraps ErrChecksum.
+func Repair(dst io.Writer, a, b *Reader) (*RepairReport, error) {
+    if !a.Index.HasChecksums {
+        return nil, errors.New("file has no tile checksums")
+    }
+    if a.size != b.size || a.Header != b.Header || len(a.Index.Entries) != len(b.Index.Entries) {
+        return nil, errors.New("files are not replicas of each other")
+    }
+    entries := append([]TileIndexEntry(nil), a.Index.Entries...)
+    for i, e := range entries {
+        if e != b.Index.Entries[i] {
+            return nil, fmt.Errorf("tile index differs at tile (%d, %d)", e.Tile.X, e.Tile.Y)
+        }
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+
+    report := &RepairReport{}
+    pos := int64(0)
+    for _, e := range entries {
+        if _, err := io.Copy(dst, io.NewSectionReader(a.r, pos, e.Offset-pos)); err != nil {
+            return report, fmt.Errorf("failed to copy file data: %w", err)
+        }
+        src := a
+        ok, err := a.tileIntact(e)
+        if err != nil {
+            return report, err
+        }
+        if !ok {
+            if ok, err = b.tileIntact(e); err != nil {
+                return report, err
+            }
+            if ok {
+                src = b
+                report.FromB = append(report.FromB, e.Tile)
+            } else {
+                report.Lost = append(report.Lost, e.Tile)
+            }
+        }
+        if _, err := io.Copy(dst, io.NewSectionReader(src.r, e.Offset, e.Length)); err != nil {
+            return report, fmt.Errorf("failed to copy tile (%d, %d): %w", e.Tile.X, e.Tile.Y, err)
+        }
+        pos = e.Offset + e.Length
+    }
+    if _, err := io.Copy(dst, io.NewSectionReader(a.r, pos, a.size-pos)); err != nil {
+        return report, fmt.Errorf("failed to copy file data: %w", err)
+    }
+    if len(report.Lost) > 0 {
+        return report, fmt.Errorf("%d tiles are corrupt in both copies: %w", len(report.Lost), ErrChecksum)
+    }
+    return report, nil
+}
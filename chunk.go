@@ -0,0 +1,433 @@
+package nest
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+)
+
+type ChunkType [4]byte
+
+var (
+    ChunkPyramid       = ChunkType{'P', 'Y', 'R', 'M'}
+    ChunkMetadata      = ChunkType{'M', 'E', 'T', 'A'}
+    ChunkIndex         = ChunkType{'I', 'N', 'D', 'X'}
+    ChunkAnnotations   = ChunkType{'A', 'N', 'N', 'O'}
+    ChunkTail          = ChunkType{'T', 'A', 'I', 'L'}
+    ChunkLinkChannel   = ChunkType{'L', 'C', 'H', 'N'}
+    ChunkRoles         = ChunkType{'R', 'O', 'L', 'E'}
+    ChunkChecksums     = ChunkType{'T', 'S', 'U', 'M'}
+    ChunkParity        = ChunkType{'P', 'R', 'T', 'Y'}
+    ChunkTransform     = ChunkType{'X', 'F', 'R', 'M'}
+    ChunkProvenance    = ChunkType{'P', 'R', 'O', 'V'}
+    ChunkAudit         = ChunkType{'A', 'U', 'D', 'T'}
+    ChunkPlane         = ChunkType{'Z', 'P', 'L', 'N'}
+    ChunkBand          = ChunkType{'B', 'A', 'N', 'D'}
+    ChunkStats         = ChunkType{'T', 'S', 'T', 'A'}
+    ChunkNoData        = ChunkType{'N', 'O', 'D', 'T'}
+    ChunkPyramidSource = ChunkType{'P', 'S', 'R', 'C'}
+    ChunkTileTimes     = ChunkType{'T', 'T', 'I', 'M'}
+    ChunkCollab        = ChunkType{'C', 'R', 'D', 'T'}
+    ChunkLayers        = ChunkType{'L', 'A', 'Y', 'R'}
+    ChunkNestedContent = ChunkType{'N', 'C', 'O', 'N'}
+    ChunkTemplates     = ChunkType{'T', 'M', 'P', 'L'}
+    ChunkAdjustments   = ChunkType{'A', 'D', 'J', 'S'}
+    ChunkCanvas        = ChunkType{'C', 'N', 'V', 'S'}
+    ChunkClasses       = ChunkType{'T', 'C', 'L', 'S'}
+    ChunkSearchIndex   = ChunkType{'S', 'I', 'D', 'X'}
+    ChunkTrailer       = ChunkType{'T', 'R', 'L', 'R'}
+    // ChunkFree marks the space of a chunk that an edit in place moved to
+    // the end of the file. Readers skip it and writers drop it.
+    ChunkFree = ChunkType{'F', 'R', 'E', 'E'}
+)
+
+const chunkHeaderSize = 12
+
+func (t ChunkType) String() string {
+    return string(t[:])
+}
+
+// Chunks follow the nested images as type + length framed records, so a
+// reader can step over any chunk it does not understand.
+type Chunk struct {
+    Type ChunkType
+    Data []byte
+}
+
+func (c *Chunk) write(writer io.Writer, order binary.ByteOrder) error {
+    if err := writeChunkHeader(writer, order, c.Type, uint64(len(c.Data))); err != nil {
+        return err
+    }
+    if _, err := writer.Write(c.Data); err != nil {
+        return fmt.Errorf("failed to write %s chunk data: %w", c.Type, err)
+    }
+    return nil
+}
+
+func writeChunkHeader(writer io.Writer, order binary.ByteOrder, t ChunkType, length uint64) error {
+    if _, err := writer.Write(t[:]); err != nil {
+        return fmt.Errorf("failed to write %s chunk type: %w", t, err)
+    }
+    if err := binary.Write(writer, order, length); err != nil {
+        return fmt.Errorf("failed to write %s chunk length: %w", t, err)
+    }
+    return nil
+}
+
+// readChunkHeader returns io.EOF when the stream ends cleanly on a chunk
+// boundary.
+func readChunkHeader(reader io.Reader, order binary.ByteOrder) (ChunkType, uint64, error) {
+    var t ChunkType
+    if _, err := io.ReadFull(reader, t[:]); err != nil {
+        if errors.Is(err, io.EOF) {
+            return t, 0, io.EOF
+        }
+        return t, 0, fmt.Errorf("failed to read chunk type: %w", err)
+    }
+    var length uint64
+    if err := binary.Read(reader, order, &length); err != nil {
+        return t, 0, fmt.Errorf("failed to read %s chunk length: %w", t, err)
+    }
+    return t, length, nil
+}
+
+// skipChunk fails on lengths past the end of the stream, so a corrupt
+// length can't seek backwards onto the same chunk.
+func skipChunk(reader io.Reader, t ChunkType, length uint64) error {
+    if length > math.MaxInt64 {
+        return fmt.Errorf("%s chunk length %d is too large", t, length)
+    }
+    if seeker, ok := reader.(io.Seeker); ok {
+        cur, err := seeker.Seek(0, io.SeekCurrent)
+        if err != nil {
+            return fmt.Errorf("failed to skip %s chunk: %w", t, err)
+        }
+        end, err := seeker.Seek(0, io.SeekEnd)
+        if err != nil {
+            return fmt.Errorf("failed to skip %s chunk: %w", t, err)
+        }
+        if length > uint64(end-cur) {
+            return fmt.Errorf("%s chunk of %d bytes extends past the end of the file", t, length)
+        }
+        if _, err := seeker.Seek(cur+int64(length), io.SeekStart); err != nil {
+            return fmt.Errorf("failed to skip %s chunk: %w", t, err)
+        }
+        return nil
+    }
+    if _, err := io.CopyN(io.Discard, reader, int64(length)); err != nil {
+        return fmt.Errorf("failed to skip %s chunk: %w", t, err)
+    }
+    return nil
+}
+
+func (nif *NestedImageFile) readChunks(reader io.Reader, order binary.ByteOrder, budget *memoryBudget) error {
+    for {
+        if err := budget.check(); err != nil {
+            return err
+        }
+        mark := hashMark(reader)
+        t, length, err := readChunkHeader(reader, order)
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if t != ChunkTail {
+            // Only a trailer that is the last chunk covers the file.
+            nif.Trailer, nif.trailerSum = nil, nil
+        }
+        switch t {
+        case ChunkTrailer:
+            tr, err := decodeTrailer(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.Trailer, nif.trailerSum = tr, mark
+        case ChunkIndex:
+            if err := budget.reserve(int64(length), "tile index"); err != nil {
+                return err
+            }
+            limited := io.LimitReader(reader, int64(length))
+            cols, rows := tileGrid(nif.Header.Width, nif.Header.Height, nif.Header.TileSize)
+            index, err := decodeTileIndex(limited, order, length, cols, rows)
+            if err != nil {
+                return err
+            }
+            // The end of a stream is unknown, so offsets are only checked
+            // for sign.
+            if err := index.check(math.MaxInt64, nif.Header.maxTileLength()); err != nil {
+                return err
+            }
+            if err := index.buildLookup(budget); err != nil {
+                return err
+            }
+            if _, err := io.Copy(io.Discard, limited); err != nil {
+                return fmt.Errorf("failed to read %s chunk: %w", t, err)
+            }
+            nif.Index = index
+        case ChunkLinkChannel:
+            width, height := int(nif.Header.Width), int(nif.Header.Height)
+            if err := budget.reserve(int64(length)+int64(width)*int64(height)*4, "link channel"); err != nil {
+                return err
+            }
+            lc, err := decodeLinkChannel(reader, order, length, width, height)
+            if err != nil {
+                return err
+            }
+            nif.LinkChannels = append(nif.LinkChannels, lc)
+        case ChunkChecksums:
+            if nif.Index == nil {
+                if err := skipChunk(reader, t, length); err != nil {
+                    return err
+                }
+                continue
+            }
+            if err := budget.reserve(int64(length), "tile checksums"); err != nil {
+                return err
+            }
+            if err := nif.Index.decodeChecksums(reader, order, length); err != nil {
+                return err
+            }
+        case ChunkStats:
+            if nif.Index == nil {
+                if err := skipChunk(reader, t, length); err != nil {
+                    return err
+                }
+                continue
+            }
+            if err := budget.reserve(int64(length), "tile statistics"); err != nil {
+                return err
+            }
+            if err := nif.Index.decodeStats(reader, order, length); err != nil {
+                return err
+            }
+        case ChunkClasses:
+            if nif.Index == nil {
+                if err := skipChunk(reader, t, length); err != nil {
+                    return err
+                }
+                continue
+            }
+            if err := budget.reserve(int64(length), "tile classes"); err != nil {
+                return err
+            }
+            if err := nif.Index.decodeClasses(reader, order, length); err != nil {
+                return err
+            }
+        case ChunkMetadata:
+            if err := budget.reserve(int64(length), "metadata"); err != nil {
+                return err
+            }
+            m, err := decodeMetadata(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.Metadata = m
+        case ChunkPyramid:
+            limited := io.LimitReader(reader, int64(length))
+            level, err := decodePyramidLevel(limited, nif.Header.tileCodec(nif.dictionary), length, budget, nil)
+            if err != nil {
+                return err
+            }
+            if _, err := io.Copy(io.Discard, limited); err != nil {
+                return fmt.Errorf("failed to read %s chunk: %w", t, err)
+            }
+            nif.Pyramid = append(nif.Pyramid, level)
+        case ChunkAnnotations:
+            if err := budget.reserve(int64(length), "annotations"); err != nil {
+                return err
+            }
+            a, err := decodeAnnotations(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.Annotations = a
+        case ChunkLayers:
+            if err := budget.reserve(int64(length), "layers"); err != nil {
+                return err
+            }
+            layers, err := decodeLayers(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.Layers = layers
+        case ChunkTemplates:
+            if err := budget.reserve(int64(length), "templates"); err != nil {
+                return err
+            }
+            templates, err := decodeTemplates(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.Templates = templates
+        case ChunkAdjustments:
+            if err := budget.reserve(int64(length), "adjustments"); err != nil {
+                return err
+            }
+            a, err := decodeAdjustments(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.Adjustments = a
+        case ChunkCanvas:
+            c, err := decodeCanvas(reader, order, length)
+            if err != nil {
+                return err
+            }
+            if err := c.check(nif.displaySize()); err != nil {
+                return err
+            }
+            nif.Canvas = c
+        case ChunkSearchIndex:
+            // The index is rebuilt from the annotations and metadata on
+            // every write.
+            if err := skipChunk(reader, t, length); err != nil {
+                return err
+            }
+            nif.searchIndexed = true
+        case ChunkCollab:
+            if err := budget.reserve(int64(length), "edit history"); err != nil {
+                return err
+            }
+            c, err := decodeCollab(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.Collab = c
+        case ChunkTileTimes:
+            grid := nif.grid()
+            if err := budget.reserve(int64(length), "tile update times"); err != nil {
+                return err
+            }
+            times, err := decodeTileTimes(reader, order, length, grid.Cols()*grid.Rows())
+            if err != nil {
+                return err
+            }
+            nif.TileTimes = times
+        case ChunkPyramidSource:
+            if err := budget.reserve(int64(length), "pyramid source checksums"); err != nil {
+                return err
+            }
+            hashes, err := decodePyramidSource(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.pyramidSource = hashes
+        case ChunkRoles:
+            if err := nif.readRoles(reader, length); err != nil {
+                return err
+            }
+        case ChunkNestedContent:
+            if err := budget.reserve(int64(length), "nested content"); err != nil {
+                return err
+            }
+            if err := nif.readNestedContent(reader, order, length); err != nil {
+                return err
+            }
+        case ChunkTransform:
+            if err := budget.reserve(int64(length), "transform"); err != nil {
+                return err
+            }
+            tc, err := decodeTransformChain(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.Transform = tc
+        case ChunkProvenance:
+            if err := budget.reserve(int64(length), "provenance"); err != nil {
+                return err
+            }
+            p, err := decodeProvenance(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.Provenance = p
+        case ChunkAudit:
+            if err := budget.reserve(int64(length), "audit log"); err != nil {
+                return err
+            }
+            l, err := decodeAuditLog(reader, order, length)
+            if err != nil {
+                return err
+            }
+            nif.Audit = l
+        case ChunkPlane:
+            limited := io.LimitReader(reader, int64(length))
+            plane, err := nif.decodePlane(limited, nif.Header.tileCodec(nif.dictionary), length, budget)
+            if err != nil {
+                return err
+            }
+            if _, err := io.Copy(io.Discard, limited); err != nil {
+                return fmt.Errorf("failed to read %s chunk: %w", t, err)
+            }
+            nif.Planes = append(nif.Planes, plane)
+        case ChunkNoData:
+            width, height := int64(nif.Header.Width), int64(nif.Header.Height)
+            if err := budget.reserve(int64(length)+(width*height+7)/8, "no-data mask"); err != nil {
+                return err
+            }
+            m, err := decodeNoDataMask(reader, order, length, nif.grid())
+            if err != nil {
+                return err
+            }
+            nif.NoData = m
+        case ChunkBand:
+            if err := budget.reserve(int64(length), "band"); err != nil {
+                return err
+            }
+            band, i, err := decodeBand(reader, order, length, nif.grid())
+            if err != nil {
+                return err
+            }
+            if i >= int(nif.Header.Bands) {
+                return fmt.Errorf("band %q has index %d, the header declares %d bands", band.Name, i, nif.Header.Bands)
+            }
+            if nif.Bands == nil {
+                nif.Bands = make([]Band, nif.Header.Bands)
+            }
+            nif.Bands[i] = band
+        default:
+            if err := skipChunk(reader, t, length); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+func (nif *NestedImageFile) writeChunks(writer io.Writer, order binary.ByteOrder) error {
+    for i := range nif.Chunks {
+        if err := nif.Chunks[i].write(writer, order); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// The TAIL chunk is always written last so random-access readers can find the
+// chunk section and tile index from the end of the file.
+type tailChunk struct {
+    ChunksOffset int64
+    IndexOffset  int64
+}
+
+const tailChunkSize = chunkHeaderSize + 16
+
+func (tc *tailChunk) write(writer io.Writer, order binary.ByteOrder) error {
+    if err := writeChunkHeader(writer, order, ChunkTail, 16); err != nil {
+        return err
+    }
+    return binary.Write(writer, order, tc)
+}
+
+func decodeTail(buf []byte, order binary.ByteOrder) (tailChunk, bool) {
+    var tc tailChunk
+    if len(buf) != tailChunkSize || ChunkType(buf[0:4]) != ChunkTail || order.Uint64(buf[4:12]) != 16 {
+        return tc, false
+    }
+    tc.ChunksOffset = int64(order.Uint64(buf[12:20]))
+    tc.IndexOffset = int64(order.Uint64(buf[20:28]))
+    return tc, true
+}
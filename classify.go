@@ -0,0 +1,140 @@
+package nest
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+)
+
+// TileClass describes what a tile of the main image holds, so writers can
+// store each tile with the codec that suits it. Mixed-content scans, with
+// blank margins, text and photographs on one page, compress far better
+// that way than with a single codec.
+type TileClass uint8
+
+const (
+    // ClassUnknown is used for tiles that were not classified.
+    ClassUnknown TileClass = iota
+    // ClassBlank tiles are one color, give or take scanner noise.
+    ClassBlank
+    // ClassLineArt tiles hold text, drawings or other content with few
+    // colors and sharp edges, which lossy codecs smear.
+    ClassLineArt
+    // ClassPhoto tiles hold continuous tone content.
+    ClassPhoto
+)
+
+func (c TileClass) String() string {
+    switch c {
+    case ClassUnknown:
+        return "unknown"
+    case ClassBlank:
+        return "blank"
+    case ClassLineArt:
+        return "line-art"
+    case ClassPhoto:
+        return "photo"
+    }
+    return fmt.Sprintf("TileClass(%d)", uint8(c))
+}
+
+func ParseTileClass(s string) (TileClass, error) {
+    for c := ClassUnknown; c <= ClassPhoto; c++ {
+        if c.String() == s {
+            return c, nil
+        }
+    }
+    return ClassUnknown, fmt.Errorf("unknown tile class %q", s)
+}
+
+const (
+    // blankRange is the largest spread of any channel in a blank tile.
+    blankRange = 8
+    // lineArtColors is the most distinct colors a line-art tile may use.
+    // Anti-aliased text stays well below it.
+    lineArtColors = 256
+    // lineArtFlat is the share of pixels that repeat their left neighbor
+    // exactly above which a tile with more colors still counts as line art.
+    lineArtFlat = 0.6
+)
+
+// classifyTile classifies the top left w by h pixels of a tile, leaving out
+// the padding past the image edge.
+func classifyTile(tile []PixeLink, tileSize, w, h int) TileClass {
+    if w <= 0 || h <= 0 {
+        return ClassBlank
+    }
+    lo, hi := [3]uint8{255, 255, 255}, [3]uint8{}
+    colors := make(map[uint32]struct{}, lineArtColors+1)
+    flat := 0
+    for y := 0; y < h; y++ {
+        row := tile[y*tileSize : y*tileSize+w]
+        for x, p := range row {
+            for c, v := range [3]uint8{p.R, p.G, p.B} {
+                lo[c], hi[c] = min(lo[c], v), max(hi[c], v)
+            }
+            if len(colors) <= lineArtColors {
+                colors[uint32(p.R)<<16|uint32(p.G)<<8|uint32(p.B)] = struct{}{}
+            }
+            if x > 0 && p.R == row[x-1].R && p.G == row[x-1].G && p.B == row[x-1].B {
+                flat++
+            }
+        }
+    }
+    switch {
+    case hi[0]-lo[0] <= blankRange && hi[1]-lo[1] <= blankRange && hi[2]-lo[2] <= blankRange:
+        return ClassBlank
+    case len(colors) <= lineArtColors, float64(flat) >= lineArtFlat*float64(w*h):
+        return ClassLineArt
+    }
+    return ClassPhoto
+}
+
+// ClassAt returns the class of tile (x, y) when the index has classes.
+func (ti *TileIndex) ClassAt(x, y int) (TileClass, bool) {
+    i := ti.position(x, y)
+    if i < 0 || ti.Classes == nil {
+        return ClassUnknown, false
+    }
+    return ti.Classes[i], true
+}
+
+// Tile classes are kept in a TCLS chunk next to the TSUM chunk: a count
+// followed by one class byte per index entry, in index order.
+func (ti *TileIndex) encodeClasses(order binary.ByteOrder) []byte {
+    data := make([]byte, 4, 4+len(ti.Classes))
+    order.PutUint32(data, uint32(len(ti.Classes)))
+    for _, c := range ti.Classes {
+        data = append(data, byte(c))
+    }
+    return data
+}
+
+func (ti *TileIndex) decodeClasses(reader io.Reader, order binary.ByteOrder, length uint64) error {
+    if length != 4+uint64(len(ti.Entries)) {
+        return fmt.Errorf("%s chunk is %d bytes for %d tiles", ChunkClasses, length, len(ti.Entries))
+    }
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return fmt.Errorf("failed to read %s chunk: %w", ChunkClasses, err)
+    }
+    if count := order.Uint32(data); int(count) != len(ti.Entries) {
+        return fmt.Errorf("%s chunk lists %d tiles, the index has %d", ChunkClasses, count, len(ti.Entries))
+    }
+    ti.Classes = make([]TileClass, len(ti.Entries))
+    for i, b := range data[4:] {
+        if TileClass(b) > ClassPhoto {
+            return fmt.Errorf("%s chunk has unknown tile class %d", ChunkClasses, b)
+        }
+        ti.Classes[i] = TileClass(b)
+    }
+    return nil
+}
+
+func (nr *Reader) loadClasses() error {
+    offset, length, ok, err := nr.findChunk(ChunkClasses)
+    if err != nil || !ok {
+        return err
+    }
+    return nr.Index.decodeClasses(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+)
+
+func adjustFlags(fset *flag.FlagSet) func() error {
+    var a nest.Adjustments
+    fset.Float64Var(&a.Exposure, "exposure", 0, "exposure change in stops")
+    fset.Float64Var(&a.Window, "window", 0, "width of the value window, 0-255 (0 disables windowing)")
+    fset.Float64Var(&a.Level, "level", 0, "center of the value window, 0-255")
+    fset.Float64Var(&a.Brightness, "brightness", 0, "brightness offset, -1 to 1")
+    fset.Float64Var(&a.Contrast, "contrast", 0, "contrast change, from -1 (flat) up; 0 leaves it unchanged")
+    fset.Float64Var(&a.Gamma, "gamma", 0, "display gamma (0 or 1 unchanged)")
+    lutPath := fset.String("lut", "", "apply a 1D or 3D LUT from a .cube file")
+    noLUT := fset.Bool("no-lut", false, "remove the LUT")
+    reset := fset.Bool("reset", false, "remove every adjustment before applying the other flags")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 1 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        name := fset.Arg(0)
+        nif, err := nest.ReadNestedImageFile(name)
+        if err != nil {
+            return err
+        }
+        if settingFlags(fset) == 0 {
+            return printAdjustments(nif.Adjustments)
+        }
+
+        cur := nest.Adjustments{}
+        if nif.Adjustments != nil && !*reset {
+            cur = *nif.Adjustments
+        }
+        // Only the flags given change the stored settings.
+        fset.Visit(func(f *flag.Flag) {
+            switch f.Name {
+            case "exposure":
+                cur.Exposure = a.Exposure
+            case "window":
+                cur.Window = a.Window
+            case "level":
+                cur.Level = a.Level
+            case "brightness":
+                cur.Brightness = a.Brightness
+            case "contrast":
+                cur.Contrast = a.Contrast
+            case "gamma":
+                cur.Gamma = a.Gamma
+            }
+        })
+        if *noLUT {
+            cur.LUT = nil
+        }
+        if *lutPath != "" {
+            f, err := os.Open(*lutPath)
+            if err != nil {
+                return err
+            }
+            cur.LUT, err = nest.ParseCubeLUT(f)
+            f.Close()
+            if err != nil {
+                return fmt.Errorf("%s: %w", *lutPath, err)
+            }
+            if cur.LUT.Name == "" {
+                cur.LUT.Name = *lutPath
+            }
+        }
+        nif.Adjustments = &cur
+        if cur == (nest.Adjustments{}) {
+            nif.Adjustments = nil
+        }
+
+        opts := nest.WriteOptions{
+            TileOrder:   nif.Header.TileOrder,
+            TileStats:   nif.Index != nil && nif.Index.Stats != nil,
+            Adaptive:    nif.Index != nil && nif.Index.Classes != nil,
+            SearchIndex: nif.HasSearchIndex(),
+        }
+        if err := nest.WriteNestedImageFileWithOptions(name, nif, opts); err != nil {
+            return err
+        }
+        return printAdjustments(nif.Adjustments)
+    }
+}
+
+// lutJSON leaves out the table itself.
+type lutJSON struct {
+    Name      string `json:"name"`
+    Dimension int    `json:"dimension"`
+    Size      int    `json:"size"`
+}
+
+type adjustmentsJSON struct {
+    Exposure   float64  `json:"exposure"`
+    Window     float64  `json:"window"`
+    Level      float64  `json:"level"`
+    Brightness float64  `json:"brightness"`
+    Contrast   float64  `json:"contrast"`
+    Gamma      float64  `json:"gamma"`
+    LUT        *lutJSON `json:"lut,omitempty"`
+}
+
+func printAdjustments(a *nest.Adjustments) error {
+    if jsonOutput {
+        if a == nil {
+            return printJSON(nil)
+        }
+        out := adjustmentsJSON{a.Exposure, a.Window, a.Level, a.Brightness, a.Contrast, a.Gamma, nil}
+        if a.LUT != nil {
+            out.LUT = &lutJSON{a.LUT.Name, a.LUT.Dimension, a.LUT.Size}
+        }
+        return printJSON(out)
+    }
+    if a == nil {
+        fmt.Println("no adjustments")
+        return nil
+    }
+    fmt.Printf("exposure %g, window %g, level %g, brightness %g, contrast %g, gamma %g\n",
+        a.Exposure, a.Window, a.Level, a.Brightness, a.Contrast, a.Gamma)
+    if a.LUT != nil {
+        fmt.Printf("%dD LUT %q of size %d\n", a.LUT.Dimension, a.LUT.Name, a.LUT.Size)
+    }
+    return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+)
+
+type auditJSON struct {
+    File    string `json:"file"`
+    Entries int    `json:"entries"`
+}
+
+func auditFlags(fset *flag.FlagSet) func() error {
+    verify := fset.Bool("verify", false, "only check the hash chain")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 1 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        file, err := os.Open(fset.Arg(0))
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        info, err := file.Stat()
+        if err != nil {
+            return err
+        }
+        nr, err := nest.NewReader(file, info.Size())
+        if err != nil {
+            return err
+        }
+        log, err := nr.AuditLog()
+        if err != nil {
+            return err
+        }
+        if log == nil {
+            return fmt.Errorf("%s has no audit log", fset.Arg(0))
+        }
+        if err := log.Verify(); err != nil {
+            return invalid(fmt.Errorf("%s: %w", fset.Arg(0), err))
+        }
+        if *verify {
+            if jsonOutput {
+                return printJSON(auditJSON{File: fset.Arg(0), Entries: len(log.Entries())})
+            }
+            return nil
+        }
+        return log.Export(os.Stdout)
+    }
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "image"
+    "image/color"
+    "os"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// parseHexColor reads #rrggbb or #rrggbbaa as a straight-alpha color.
+func parseHexColor(s string) (color.RGBA, error) {
+    b, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+    if err != nil || (len(b) != 3 && len(b) != 4) {
+        return color.RGBA{}, fmt.Errorf("color %q is not #rrggbb or #rrggbbaa", s)
+    }
+    c := color.NRGBA{b[0], b[1], b[2], 0xff}
+    if len(b) == 4 {
+        c.A = b[3]
+    }
+    return color.RGBAModel.Convert(c).(color.RGBA), nil
+}
+
+func canvasFlags(fset *flag.FlagSet) func() error {
+    size := fset.String("size", "", "document size as WxH")
+    origin := fset.String("origin", "", "position of the main image on the document as x,y")
+    background := fset.String("background", "", "document color as #rrggbb or #rrggbbaa")
+    remove := fset.Bool("remove", false, "remove the canvas")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 1 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        name := fset.Arg(0)
+        nif, err := nest.ReadNestedImageFile(name)
+        if err != nil {
+            return err
+        }
+        if settingFlags(fset) == 0 {
+            return printCanvas(nif)
+        }
+
+        c := nest.Canvas{Background: color.RGBA{0xff, 0xff, 0xff, 0xff}}
+        if nif.Canvas != nil {
+            c = *nif.Canvas
+        }
+        if *size != "" {
+            if n, _ := fmt.Sscanf(*size, "%dx%d", &c.Width, &c.Height); n != 2 || c.Width <= 0 || c.Height <= 0 {
+                return fmt.Errorf("size %q is not WxH", *size)
+            }
+        }
+        if *origin != "" {
+            if n, _ := fmt.Sscanf(*origin, "%d,%d", &c.Origin.X, &c.Origin.Y); n != 2 {
+                return fmt.Errorf("origin %q is not x,y", *origin)
+            }
+        }
+        if *background != "" {
+            if c.Background, err = parseHexColor(*background); err != nil {
+                return err
+            }
+        }
+        nif.Canvas = &c
+        if *remove {
+            nif.Canvas = nil
+        }
+
+        opts := nest.WriteOptions{
+            TileOrder:   nif.Header.TileOrder,
+            TileStats:   nif.Index != nil && nif.Index.Stats != nil,
+            Adaptive:    nif.Index != nil && nif.Index.Classes != nil,
+            SearchIndex: nif.HasSearchIndex(),
+        }
+        if err := nest.WriteNestedImageFileWithOptions(name, nif, opts); err != nil {
+            return err
+        }
+        return printCanvas(nif)
+    }
+}
+
+// canvasJSON gives rectangles as [x, y, w, h] and the background as
+// #rrggbbaa.
+type canvasJSON struct {
+    Canvas     [4]int `json:"canvas"`
+    Content    [4]int `json:"content"`
+    Background string `json:"background"`
+}
+
+func printCanvas(nif *nest.NestedImageFile) error {
+    if nif.Canvas == nil {
+        if jsonOutput {
+            return printJSON(nil)
+        }
+        fmt.Println("no canvas")
+        return nil
+    }
+    b, bg := nif.CanvasBounds(), color.NRGBAModel.Convert(nif.Canvas.Background).(color.NRGBA)
+    content := image.Rectangle{Max: image.Pt(nif.Header.Orientation.Size(int(nif.Header.Width), int(nif.Header.Height)))}.Add(nif.Canvas.Origin)
+    if jsonOutput {
+        return printJSON(canvasJSON{
+            Canvas:     [4]int{b.Min.X, b.Min.Y, b.Dx(), b.Dy()},
+            Content:    [4]int{content.Min.X, content.Min.Y, content.Dx(), content.Dy()},
+            Background: fmt.Sprintf("#%02x%02x%02x%02x", bg.R, bg.G, bg.B, bg.A),
+        })
+    }
+    fmt.Printf("%dx%d canvas, background #%02x%02x%02x%02x, main image at %v\n", b.Dx(), b.Dy(), bg.R, bg.G, bg.B, bg.A, content)
+    return nil
+}
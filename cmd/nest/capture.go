@@ -0,0 +1,58 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "image"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// parseCrop reads x,y,w,h.
+func parseCrop(s string) (image.Rectangle, error) {
+    var x, y, w, h int
+    if n, _ := fmt.Sscanf(s, "%d,%d,%d,%d", &x, &y, &w, &h); n != 4 || w <= 0 || h <= 0 {
+        return image.Rectangle{}, fmt.Errorf("crop %q is not x,y,w,h", s)
+    }
+    return image.Rect(x, y, x+w, y+h), nil
+}
+
+func captureFlags(fset *flag.FlagSet) func() error {
+    mainSize := fset.Int("main-size", 0, "longest side of the main image, 0 for full resolution")
+    tileSize := fset.Uint("tile-size", defaultTileSize(), "tile size in pixels")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() < 3 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        var crops []image.Rectangle
+        for _, s := range fset.Args()[2:] {
+            c, err := parseCrop(s)
+            if err != nil {
+                return err
+            }
+            crops = append(crops, c)
+        }
+        src, err := decodeImageFile(fset.Arg(0))
+        if err != nil {
+            return err
+        }
+        nif, err := nest.Capture(src, crops, nest.CaptureOptions{
+            ImportOptions: nest.ImportOptions{TileSize: uint16(*tileSize)},
+            MainSize:      *mainSize,
+        })
+        if err != nil {
+            return err
+        }
+        opts := nest.WriteOptions{LinkCodec: nest.CodecRLE}
+        opts.ApplyDefaults(defaults)
+        if err := nest.WriteNestedImageFileWithOptions(fset.Arg(1), nif, opts); err != nil {
+            return err
+        }
+        return printWritten(fset.Arg(1))
+    }
+}
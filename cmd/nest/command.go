@@ -0,0 +1,322 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// A command is one nest subcommand. Besides running it, its metadata
+// drives the usage text, shell completions and man pages.
+type command struct {
+    name string
+    // summary describes the command in a line, for the command list.
+    summary string
+    // args sketches the arguments after the flags.
+    args string
+    // description, when set, follows the usage line.
+    description string
+    // flags defines the command's flags on fset and returns the function
+    // that runs the command once they are parsed.
+    flags func(fset *flag.FlagSet) func() error
+}
+
+func (c *command) usageLine() string {
+    return fmt.Sprintf("nest %s [flags] %s", c.name, c.args)
+}
+
+func (c *command) run(args []string) error {
+    fset := flag.NewFlagSet(c.name, flag.ExitOnError)
+    fset.Usage = func() {
+        fmt.Fprintln(fset.Output(), "usage:", c.usageLine())
+        if c.description != "" {
+            fmt.Fprintln(fset.Output(), c.description)
+        }
+        fset.PrintDefaults()
+    }
+    run := c.flags(fset)
+    fset.Parse(args)
+    return run()
+}
+
+// flagList returns the command's flags sorted by name, without running it.
+func (c *command) flagList() []*flag.Flag {
+    fset := flag.NewFlagSet(c.name, flag.ContinueOnError)
+    c.flags(fset)
+    var list []*flag.Flag
+    fset.VisitAll(func(f *flag.Flag) {
+        list = append(list, f)
+    })
+    return list
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+    b, ok := f.Value.(interface{ IsBoolFlag() bool })
+    return ok && b.IsBoolFlag()
+}
+
+// commands lists the subcommands in the order nest help shows them. It is
+// filled in by init because completion and man refer back to it.
+var commands []*command
+
+func findCommand(name string) *command {
+    for _, c := range commands {
+        if c.name == name {
+            return c
+        }
+    }
+    return nil
+}
+
+func printUsage(out *os.File) {
+    fmt.Fprint(out, "usage: nest <command> [arguments]\n\ncommands:\n")
+    for _, c := range commands {
+        fmt.Fprintf(out, "    %-10s %s\n", c.name, c.summary)
+    }
+}
+
+func completionFlags(fset *flag.FlagSet) func() error {
+    // The script is printed as is; --json only makes errors JSON.
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 1 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        switch fset.Arg(0) {
+        case "bash":
+            fmt.Print(bashCompletion())
+        case "zsh":
+            fmt.Print(zshCompletion())
+        case "fish":
+            fmt.Print(fishCompletion())
+        default:
+            return invalid(fmt.Errorf("unknown shell %q, want bash, zsh or fish", fset.Arg(0)))
+        }
+        return nil
+    }
+}
+
+// flagHelp returns the text describing f, on one line.
+func flagHelp(f *flag.Flag) string {
+    _, usage := flag.UnquoteUsage(f)
+    return strings.Join(strings.Fields(usage), " ")
+}
+
+func bashCompletion() string {
+    var b strings.Builder
+    var names []string
+    for _, c := range commands {
+        names = append(names, c.name)
+    }
+    b.WriteString("# bash completion for nest\n\n")
+    b.WriteString("_nest() {\n")
+    b.WriteString("    local cur=${COMP_WORDS[COMP_CWORD]}\n")
+    b.WriteString("    if [[ $COMP_CWORD -eq 1 ]]; then\n")
+    fmt.Fprintf(&b, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+    b.WriteString("        return\n")
+    b.WriteString("    fi\n")
+    b.WriteString("    [[ $cur == -* ]] || return\n")
+    b.WriteString("    local flags\n")
+    b.WriteString("    case ${COMP_WORDS[1]} in\n")
+    for _, c := range commands {
+        var flags []string
+        for _, f := range c.flagList() {
+            flags = append(flags, "--"+f.Name)
+        }
+        fmt.Fprintf(&b, "    %s) flags=%q ;;\n", c.name, strings.Join(flags, " "))
+    }
+    b.WriteString("    esac\n")
+    b.WriteString("    COMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n")
+    b.WriteString("}\n\n")
+    b.WriteString("complete -o default -F _nest nest\n")
+    return b.String()
+}
+
+// zshQuote single-quotes s for zsh.
+func zshQuote(s string) string {
+    return "'" + strings.ReplaceAll(s, `'`, `'\''`) + "'"
+}
+
+// zshEscape escapes the brackets and colons _arguments gives meaning to.
+func zshEscape(s string) string {
+    return strings.NewReplacer(`[`, `\[`, `]`, `\]`, `:`, `\:`).Replace(s)
+}
+
+func zshCompletion() string {
+    var b strings.Builder
+    b.WriteString("#compdef nest\n\n")
+    b.WriteString("_nest() {\n")
+    b.WriteString("    local -a commands\n")
+    b.WriteString("    commands=(\n")
+    for _, c := range commands {
+        fmt.Fprintf(&b, "        %s\n", zshQuote(c.name+":"+c.summary))
+    }
+    b.WriteString("    )\n")
+    b.WriteString("    if (( CURRENT == 2 )); then\n")
+    b.WriteString("        _describe command commands\n")
+    b.WriteString("        return\n")
+    b.WriteString("    fi\n")
+    b.WriteString("    shift words\n")
+    b.WriteString("    (( CURRENT-- ))\n")
+    b.WriteString("    case $words[1] in\n")
+    for _, c := range commands {
+        fmt.Fprintf(&b, "    %s)\n", c.name)
+        b.WriteString("        _arguments")
+        for _, f := range c.flagList() {
+            spec := "--" + f.Name + "[" + zshEscape(flagHelp(f)) + "]"
+            if !isBoolFlag(f) {
+                name, _ := flag.UnquoteUsage(f)
+                spec += ":" + zshEscape(name) + ":_files"
+            }
+            fmt.Fprintf(&b, " \\\n            %s", zshQuote(spec))
+        }
+        b.WriteString(" \\\n            '*:file:_files'\n")
+        b.WriteString("        ;;\n")
+    }
+    b.WriteString("    esac\n")
+    b.WriteString("}\n\n")
+    b.WriteString("_nest \"$@\"\n")
+    return b.String()
+}
+
+// fishQuote quotes s for fish, where only \ and ' are special inside
+// single quotes.
+func fishQuote(s string) string {
+    return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func fishCompletion() string {
+    var b strings.Builder
+    b.WriteString("# fish completion for nest\n\n")
+    b.WriteString("complete -c nest -f\n")
+    for _, c := range commands {
+        fmt.Fprintf(&b, "complete -c nest -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.summary))
+    }
+    for _, c := range commands {
+        cond := fishQuote("__fish_seen_subcommand_from " + c.name)
+        b.WriteString("\n")
+        fmt.Fprintf(&b, "complete -c nest -n %s -F\n", cond)
+        for _, f := range c.flagList() {
+            value := " -r"
+            if isBoolFlag(f) {
+                value = ""
+            }
+            fmt.Fprintf(&b, "complete -c nest -n %s -l %s%s -d %s\n", cond, f.Name, value, fishQuote(flagHelp(f)))
+        }
+    }
+    return b.String()
+}
+
+func manFlags(fset *flag.FlagSet) func() error {
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 1 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        dir := fset.Arg(0)
+        if err := os.MkdirAll(dir, 0o755); err != nil {
+            return err
+        }
+        pages := [][2]string{{"nest.1", manPage()}}
+        for _, c := range commands {
+            pages = append(pages, [2]string{"nest-" + c.name + ".1", c.manPage()})
+        }
+        for _, page := range pages {
+            path := filepath.Join(dir, page[0])
+            if err := os.WriteFile(path, []byte(page[1]), 0o644); err != nil {
+                return err
+            }
+            if err := printWritten(path); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+}
+
+// roff escapes s for a man page line.
+func roff(s string) string {
+    s = strings.NewReplacer(`\`, `\e`, `-`, `\-`).Replace(s)
+    if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+        s = `\&` + s
+    }
+    return s
+}
+
+// sentence turns a summary into a sentence for a DESCRIPTION section.
+func sentence(s string) string {
+    r, n := utf8.DecodeRuneInString(s)
+    return string(unicode.ToUpper(r)) + s[n:] + "."
+}
+
+func manPage() string {
+    var b strings.Builder
+    b.WriteString(".TH NEST 1 \"\" nest \"User Commands\"\n")
+    b.WriteString(".SH NAME\n")
+    b.WriteString("nest \\- convert, inspect, edit and serve NestedImage files\n")
+    b.WriteString(".SH SYNOPSIS\n")
+    b.WriteString(".B nest\n")
+    b.WriteString(".I command\n")
+    b.WriteString("[\\fIarguments\\fR]\n")
+    b.WriteString(".SH COMMANDS\n")
+    for _, c := range commands {
+        fmt.Fprintf(&b, ".TP\n.BR nest\\-%s (1)\n%s\n", roff(c.name), roff(c.summary))
+    }
+    b.WriteString(".SH \"EXIT STATUS\"\n")
+    for _, status := range []struct {
+        code int
+        text string
+    }{
+        {0, "success"},
+        {exitFailed, "the command failed to run"},
+        {exitInvalid, "a usage error or a failed check, such as a file without a trailer"},
+        {exitCorrupt, "a corrupt file: a bad checksum, a trailer mismatch or a truncated file"},
+    } {
+        fmt.Fprintf(&b, ".TP\n.B %d\n%s\n", status.code, roff(status.text))
+    }
+    return b.String()
+}
+
+func (c *command) manPage() string {
+    var b strings.Builder
+    fmt.Fprintf(&b, ".TH NEST\\-%s 1 \"\" nest \"User Commands\"\n", roff(strings.ToUpper(c.name)))
+    b.WriteString(".SH NAME\n")
+    fmt.Fprintf(&b, "nest\\-%s \\- %s\n", roff(c.name), roff(c.summary))
+    b.WriteString(".SH SYNOPSIS\n")
+    fmt.Fprintf(&b, ".B nest %s\n[flags] %s\n", roff(c.name), roff(c.args))
+    b.WriteString(".SH DESCRIPTION\n")
+    if c.description != "" {
+        fmt.Fprintf(&b, "%s\n", roff(c.description))
+    } else {
+        fmt.Fprintf(&b, "%s\n", roff(sentence(c.summary)))
+    }
+    if flags := c.flagList(); len(flags) > 0 {
+        b.WriteString(".SH OPTIONS\n")
+        for _, f := range flags {
+            name, _ := flag.UnquoteUsage(f)
+            if isBoolFlag(f) || name == "" {
+                fmt.Fprintf(&b, ".TP\n.B \\-\\-%s\n", roff(f.Name))
+            } else {
+                fmt.Fprintf(&b, ".TP\n.BI \\-\\-%s \" %s\"\n", roff(f.Name), roff(name))
+            }
+            help := flagHelp(f)
+            switch f.DefValue {
+            case "", "0", "false", "[]":
+            default:
+                help += fmt.Sprintf(" (default %s)", f.DefValue)
+            }
+            fmt.Fprintf(&b, "%s\n", roff(help))
+        }
+    }
+    b.WriteString(".SH \"SEE ALSO\"\n")
+    b.WriteString(".BR nest (1)\n")
+    return b.String()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "math"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+)
+
+type tileQualityJSON struct {
+    X    int      `json:"x"`
+    Y    int      `json:"y"`
+    MSE  float64  `json:"mse"`
+    PSNR *float64 `json:"psnr"`
+    SSIM float64  `json:"ssim"`
+}
+
+type qualityJSON struct {
+    MSE   float64           `json:"mse"`
+    PSNR  *float64          `json:"psnr"`
+    SSIM  float64           `json:"ssim"`
+    Tiles []tileQualityJSON `json:"tiles,omitempty"`
+}
+
+// finite maps the +Inf PSNR of identical data to null, which JSON can hold.
+func finite(v float64) *float64 {
+    if math.IsInf(v, 0) {
+        return nil
+    }
+    return &v
+}
+
+func compareFlags(fset *flag.FlagSet) func() error {
+    tiles := fset.Bool("tiles", false, "include per-tile results")
+    workers := fset.Int("workers", 0, "tiles to decode concurrently")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 2 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        var files [2]*nest.NestedImageFile
+        for i, path := range fset.Args() {
+            var err error
+            opts := nest.ReadOptions{Workers: *workers}
+            opts.ApplyDefaults(defaults)
+            if files[i], err = nest.ReadNestedImageFileWithOptions(path, opts); err != nil {
+                return fmt.Errorf("%s: %w", path, err)
+            }
+        }
+        report, err := nest.Compare(files[0], files[1])
+        if err != nil {
+            return err
+        }
+
+        out := qualityJSON{MSE: report.MSE, PSNR: finite(report.PSNR), SSIM: report.SSIM}
+        if *tiles {
+            for _, t := range report.Tiles {
+                out.Tiles = append(out.Tiles, tileQualityJSON{X: t.Tile.X, Y: t.Tile.Y, MSE: t.MSE, PSNR: finite(t.PSNR), SSIM: t.SSIM})
+            }
+        }
+        if jsonOutput {
+            return printJSON(out)
+        }
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        return enc.Encode(out)
+    }
+}
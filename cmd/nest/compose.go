@@ -0,0 +1,246 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "image"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// A compose source directory holds:
+//
+//	main.{png,jpg,tif}    the main image
+//	links.{png,tif}       optional link map, index = R | G<<8 | B<<16
+//	nested/*              nested images, linked as 1, 2, ... in name order
+type composer struct {
+    dir      string
+    out      string
+    tileSize uint16
+    order    nest.TileOrder
+    store    *nest.DedupStore
+
+    seen   map[string]os.FileInfo
+    main   image.Image
+    links  image.Image
+    nested map[string]nest.NestedImage
+}
+
+type composeJSON struct {
+    Output         string `json:"output"`
+    Tiles          int    `json:"tiles"`
+    Reencoded      int    `json:"reencoded"`
+    NestedReloaded int    `json:"nested_reloaded"`
+    Milliseconds   int64  `json:"milliseconds"`
+}
+
+func composeFlags(fset *flag.FlagSet) func() error {
+    watch := fset.Bool("watch", false, "keep running and rebuild when sources change")
+    interval := fset.Duration("interval", time.Second, "how often to check sources in watch mode")
+    tileSize := fset.Uint("tile-size", defaultTileSize(), "tile size in pixels")
+    tileOrder := fset.String("tile-order", nest.RowMajor.String(), "tile order: row-major, hilbert or center-out")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 2 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        order, err := nest.ParseTileOrder(*tileOrder)
+        if err != nil {
+            return err
+        }
+
+        c := &composer{
+            dir:      fset.Arg(0),
+            out:      fset.Arg(1),
+            tileSize: uint16(*tileSize),
+            order:    order,
+            store:    nest.NewDedupStore(),
+            seen:     map[string]os.FileInfo{},
+            nested:   map[string]nest.NestedImage{},
+        }
+
+        changed, err := c.scan()
+        if err != nil {
+            return err
+        }
+        if err := c.build(changed); err != nil {
+            if !*watch {
+                return err
+            }
+            reportError("compose", "", fmt.Errorf("build failed: %w", err))
+        }
+        if !*watch {
+            return nil
+        }
+
+        if !jsonOutput {
+            fmt.Printf("watching %s for changes\n", c.dir)
+        }
+        for {
+            time.Sleep(*interval)
+            changed, err := c.scan()
+            if err != nil {
+                reportError("compose", "", fmt.Errorf("scan failed: %w", err))
+                continue
+            }
+            if len(changed) == 0 {
+                continue
+            }
+            if err := c.build(changed); err != nil {
+                reportError("compose", "", fmt.Errorf("build failed: %w", err))
+            }
+        }
+    }
+}
+
+func (c *composer) sources() ([]string, error) {
+    var paths []string
+    entries, err := os.ReadDir(c.dir)
+    if err != nil {
+        return nil, err
+    }
+    for _, e := range entries {
+        if !e.IsDir() && isImageFile(e.Name()) {
+            paths = append(paths, filepath.Join(c.dir, e.Name()))
+        }
+    }
+    nested, err := os.ReadDir(filepath.Join(c.dir, "nested"))
+    if err != nil && !errors.Is(err, os.ErrNotExist) {
+        return nil, err
+    }
+    for _, e := range nested {
+        if !e.IsDir() && (isImageFile(e.Name()) || isContentFile(e.Name())) {
+            paths = append(paths, filepath.Join(c.dir, "nested", e.Name()))
+        }
+    }
+    return paths, nil
+}
+
+// scan returns the sources that were added, modified or removed since the
+// previous scan.
+func (c *composer) scan() ([]string, error) {
+    paths, err := c.sources()
+    if err != nil {
+        return nil, err
+    }
+    var changed []string
+    current := map[string]bool{}
+    for _, path := range paths {
+        current[path] = true
+        info, err := os.Stat(path)
+        if err != nil {
+            return nil, err
+        }
+        if prev, ok := c.seen[path]; ok && prev.ModTime().Equal(info.ModTime()) && prev.Size() == info.Size() {
+            continue
+        }
+        c.seen[path] = info
+        changed = append(changed, path)
+    }
+    for path := range c.seen {
+        if !current[path] {
+            delete(c.seen, path)
+            changed = append(changed, path)
+        }
+    }
+    return changed, nil
+}
+
+func (c *composer) build(changed []string) error {
+    start := time.Now()
+    reloaded := 0
+    for _, path := range changed {
+        _, exists := c.seen[path]
+        var img image.Image
+        if exists && !isContentFile(path) {
+            var err error
+            if img, err = decodeImageFile(path); err != nil {
+                return err
+            }
+        }
+        name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+        switch {
+        case filepath.Dir(path) == filepath.Join(c.dir, "nested"):
+            if !exists {
+                delete(c.nested, path)
+                continue
+            }
+            var ni nest.NestedImage
+            var err error
+            if isContentFile(path) {
+                ni, err = loadContentNested(path)
+            } else {
+                ni, err = nest.NewNestedImage(img)
+            }
+            if err != nil {
+                return fmt.Errorf("%s: %w", path, err)
+            }
+            c.nested[path] = ni
+            reloaded++
+        case name == "main":
+            c.main = img
+        case name == "links":
+            c.links = img
+        }
+    }
+    if c.main == nil {
+        return fmt.Errorf("no main image in %s", c.dir)
+    }
+
+    nif := nest.FromImage(c.main, nest.ImportOptions{TileSize: c.tileSize})
+    names := make([]string, 0, len(c.nested))
+    for path := range c.nested {
+        names = append(names, path)
+    }
+    sort.Strings(names)
+    for _, path := range names {
+        nif.NestedImages = append(nif.NestedImages, c.nested[path])
+    }
+    nif.Header.NestedCount = uint32(len(nif.NestedImages))
+
+    if c.links != nil {
+        if err := applyLinkMap(nif, c.links); err != nil {
+            return err
+        }
+    }
+
+    opts := nest.WriteOptions{TileOrder: c.order, LinkCodec: nest.CodecRLE, Dedup: c.store}
+    opts.ApplyDefaults(defaults)
+    if err := nest.WriteNestedImageFileWithOptions(c.out, nif, opts); err != nil {
+        return err
+    }
+    hits, misses := c.store.Stats()
+    c.store.Prune()
+    if jsonOutput {
+        return printJSON(composeJSON{Output: c.out, Tiles: hits + misses, Reencoded: misses, NestedReloaded: reloaded, Milliseconds: time.Since(start).Milliseconds()})
+    }
+    fmt.Printf("wrote %s: %d of %d tiles re-encoded, %d nested images reloaded (%s)\n",
+        c.out, misses, hits+misses, reloaded, time.Since(start).Round(time.Millisecond))
+    return nil
+}
+
+func applyLinkMap(nif *nest.NestedImageFile, links image.Image) error {
+    b := links.Bounds()
+    if b.Dx() != int(nif.Header.Width) || b.Dy() != int(nif.Header.Height) {
+        return fmt.Errorf("link map is %dx%d but the main image is %dx%d", b.Dx(), b.Dy(), nif.Header.Width, nif.Header.Height)
+    }
+    for y := 0; y < b.Dy(); y++ {
+        for x := 0; x < b.Dx(); x++ {
+            r, g, bl, _ := links.At(b.Min.X+x, b.Min.Y+y).RGBA()
+            idx := r>>8 | (g>>8)<<8 | (bl>>8)<<16
+            if idx > nif.Header.NestedCount {
+                return fmt.Errorf("link map references nested image %d at (%d, %d) but only %d exist", idx, x, y, nif.Header.NestedCount)
+            }
+            nif.MainImage[y][x].NestedIdx = idx
+        }
+    }
+    return nil
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "sync"
+
+    nest "github.com/70ziko/NEST"
+    "github.com/70ziko/NEST/colorspace"
+    "github.com/70ziko/NEST/raw"
+)
+
+// convertSettings are the per-file options a config file can set. Zero
+// values leave the previous setting in place.
+type convertSettings struct {
+    TileSize   uint16 `json:"tile_size,omitempty"`
+    TileOrder  string `json:"tile_order,omitempty"`
+    BigEndian  *bool  `json:"big_endian,omitempty"`
+    ColorSpace string `json:"color_space,omitempty"`
+    Dither     string `json:"dither,omitempty"`
+    Levels     int    `json:"levels,omitempty"`
+    Quality    int    `json:"quality,omitempty"`
+    Pyramid    *bool  `json:"pyramid,omitempty"`
+    Filter     string `json:"filter,omitempty"`
+    ECCLevel   int    `json:"ecc_level,omitempty"`
+    Provenance *bool  `json:"provenance,omitempty"`
+    TileStats  *bool  `json:"tile_stats,omitempty"`
+    Adaptive   *bool  `json:"adaptive,omitempty"`
+    Predict    *bool  `json:"predict,omitempty"`
+    // SearchIndex indexes the annotation text and metadata.
+    SearchIndex *bool `json:"search_index,omitempty"`
+    // HighBitDepth keeps 16-bit sources' samples as bands.
+    HighBitDepth *bool `json:"high_bit_depth,omitempty"`
+    // DPI is the resolution PDF pages are rendered at.
+    DPI float64 `json:"dpi,omitempty"`
+    // Dictionary is a trained dictionary file, or "auto" to train one from
+    // each image's own tiles.
+    Dictionary       string `json:"dictionary,omitempty"`
+    SharedDictionary *bool  `json:"shared_dictionary,omitempty"`
+    // Orientation is recorded in the header; empty takes the source's.
+    Orientation string `json:"orientation,omitempty"`
+}
+
+type convertJSON struct {
+    Source string `json:"source"`
+    Output string `json:"output"`
+    // Bytes is the size written, or the estimate with --dry-run.
+    Bytes     int64 `json:"bytes"`
+    Estimated bool  `json:"estimated,omitempty"`
+}
+
+type convertOverride struct {
+    Match string `json:"match"`
+    convertSettings
+}
+
+// convertConfig is read from --config. Overrides are applied in order to
+// every input whose path or base name matches the pattern. Flags given on
+// the command line win over both.
+type convertConfig struct {
+    Defaults  convertSettings   `json:"defaults"`
+    Overrides []convertOverride `json:"overrides"`
+}
+
+func (s convertSettings) merge(o convertSettings) convertSettings {
+    if o.TileSize != 0 {
+        s.TileSize = o.TileSize
+    }
+    if o.TileOrder != "" {
+        s.TileOrder = o.TileOrder
+    }
+    if o.BigEndian != nil {
+        s.BigEndian = o.BigEndian
+    }
+    if o.ColorSpace != "" {
+        s.ColorSpace = o.ColorSpace
+    }
+    if o.Dither != "" {
+        s.Dither = o.Dither
+    }
+    if o.Levels != 0 {
+        s.Levels = o.Levels
+    }
+    if o.Quality != 0 {
+        s.Quality = o.Quality
+    }
+    if o.Pyramid != nil {
+        s.Pyramid = o.Pyramid
+    }
+    if o.Filter != "" {
+        s.Filter = o.Filter
+    }
+    if o.ECCLevel != 0 {
+        s.ECCLevel = o.ECCLevel
+    }
+    if o.Provenance != nil {
+        s.Provenance = o.Provenance
+    }
+    if o.TileStats != nil {
+        s.TileStats = o.TileStats
+    }
+    if o.Adaptive != nil {
+        s.Adaptive = o.Adaptive
+    }
+    if o.Predict != nil {
+        s.Predict = o.Predict
+    }
+    if o.SearchIndex != nil {
+        s.SearchIndex = o.SearchIndex
+    }
+    if o.HighBitDepth != nil {
+        s.HighBitDepth = o.HighBitDepth
+    }
+    if o.DPI != 0 {
+        s.DPI = o.DPI
+    }
+    if o.Orientation != "" {
+        s.Orientation = o.Orientation
+    }
+    if o.Dictionary != "" {
+        s.Dictionary = o.Dictionary
+    }
+    if o.SharedDictionary != nil {
+        s.SharedDictionary = o.SharedDictionary
+    }
+    return s
+}
+
+// settingsFor applies the config to the flag values in base, and then the
+// flags named in given again, so explicit flags, even zero ones, win.
+func (c *convertConfig) settingsFor(path string, base convertSettings, given map[string]bool) convertSettings {
+    s := base.merge(c.Defaults)
+    for _, o := range c.Overrides {
+        full, _ := filepath.Match(o.Match, filepath.ToSlash(path))
+        short, _ := filepath.Match(o.Match, filepath.Base(path))
+        if full || short {
+            s = s.merge(o.convertSettings)
+        }
+    }
+    for name := range given {
+        if set, ok := convertFlagSettings[name]; ok {
+            set(&s, base)
+        }
+    }
+    return s
+}
+
+// convertFlagSettings copies the setting each convert flag controls.
+var convertFlagSettings = map[string]func(s *convertSettings, flags convertSettings){
+    "tile-size":         func(s *convertSettings, f convertSettings) { s.TileSize = f.TileSize },
+    "tile-order":        func(s *convertSettings, f convertSettings) { s.TileOrder = f.TileOrder },
+    "color-space":       func(s *convertSettings, f convertSettings) { s.ColorSpace = f.ColorSpace },
+    "dither":            func(s *convertSettings, f convertSettings) { s.Dither = f.Dither },
+    "levels":            func(s *convertSettings, f convertSettings) { s.Levels = f.Levels },
+    "quality":           func(s *convertSettings, f convertSettings) { s.Quality = f.Quality },
+    "pyramid":           func(s *convertSettings, f convertSettings) { s.Pyramid = f.Pyramid },
+    "filter":            func(s *convertSettings, f convertSettings) { s.Filter = f.Filter },
+    "ecc":               func(s *convertSettings, f convertSettings) { s.ECCLevel = f.ECCLevel },
+    "provenance":        func(s *convertSettings, f convertSettings) { s.Provenance = f.Provenance },
+    "tile-stats":        func(s *convertSettings, f convertSettings) { s.TileStats = f.TileStats },
+    "adaptive":          func(s *convertSettings, f convertSettings) { s.Adaptive = f.Adaptive },
+    "predict":           func(s *convertSettings, f convertSettings) { s.Predict = f.Predict },
+    "search-index":      func(s *convertSettings, f convertSettings) { s.SearchIndex = f.SearchIndex },
+    "high-bit-depth":    func(s *convertSettings, f convertSettings) { s.HighBitDepth = f.HighBitDepth },
+    "dpi":               func(s *convertSettings, f convertSettings) { s.DPI = f.DPI },
+    "orientation":       func(s *convertSettings, f convertSettings) { s.Orientation = f.Orientation },
+    "dictionary":        func(s *convertSettings, f convertSettings) { s.Dictionary = f.Dictionary },
+    "shared-dictionary": func(s *convertSettings, f convertSettings) { s.SharedDictionary = f.SharedDictionary },
+}
+
+type convertJob struct {
+    src string
+    dst string
+}
+
+func convertFlags(fset *flag.FlagSet) func() error {
+    jobs := fset.Int("jobs", runtime.NumCPU(), "number of files converted in parallel")
+    configPath := fset.String("config", "", "JSON file with default and per-file options")
+    tileSize := fset.Uint("tile-size", defaultTileSize(), "tile size in pixels")
+    tileOrder := fset.String("tile-order", nest.RowMajor.String(), "tile order: row-major, hilbert or center-out")
+    colorSpace := fset.String("color-space", colorspace.SRGB.String(), "stored color space: srgb, linear or ycbcr")
+    dither := fset.String("dither", nest.DitherNone.String(), "dithering: none, floyd-steinberg or ordered")
+    levels := fset.Int("levels", 256, "quantization levels per channel")
+    quality := fset.Int("quality", 0, "JPEG quality 1-100 for the RGB planes, 0 for lossless")
+    pyramid := fset.Bool("pyramid", false, "store reduced resolution overviews")
+    filter := fset.String("filter", nest.BoxFilter.Name(), "overview filter: box, bilinear, lanczos or area")
+    ecc := fset.Int("ecc", 0, "parity tiles per group of 16 for recovering damaged tiles")
+    provenance := fset.Bool("provenance", false, "record each output's source file as tile provenance")
+    tileStats := fset.Bool("tile-stats", false, "store per-tile min, max, mean and histogram next to the index")
+    adaptive := fset.Bool("adaptive", false, "classify tiles and store blank and line-art ones losslessly with RLE, photographic ones at --quality")
+    predict := fset.Bool("predict", false, "store lossless tiles as residuals from their left and top neighbors, and focal planes from the plane before")
+    searchIndex := fset.Bool("search-index", false, "store a search index of the annotation text, such as PDF page labels, and metadata")
+    orientation := fset.String("orientation", "", "display orientation to record, such as rotate-90 (default: the JPEG or TIFF source's EXIF orientation)")
+    dictionary := fset.String("dictionary", "", "compress tiles with zstd against a dictionary file from nest dictionary, or \"auto\" to train one per image")
+    sharedDictionary := fset.Bool("shared-dictionary", false, "record only the --dictionary file's ID instead of embedding it; readers need it in NEST_DICTIONARIES")
+    maxSize := fset.String("max-size", "", "abort any output that would grow past this size, such as 40G")
+    spillSize := fset.String("spill-threshold", "", "hold at most this much encoded data in memory and spill the rest to disk, such as 512M")
+    spillDir := fset.String("spill-dir", "", "directory for spill files (default: the system temporary directory)")
+    dryRun := fset.Bool("dry-run", false, "print the estimated size of each output instead of writing it")
+    dpi := fset.Float64("dpi", 150, "resolution to render PDF pages at")
+    highBitDepth := fset.Bool("high-bit-depth", false, "keep the samples of 16-bit sources, such as camera raw files, as red, green and blue bands")
+    demosaic := fset.String("demosaic", raw.AHD.String(), "camera raw demosaicing: ahd, ppg, vng or bilinear")
+    rawTool := fset.String("raw-tool", raw.DefaultTool, "dcraw-compatible program that develops camera raw files")
+    resume := fset.Bool("resume", false, "journal finished tiles so an interrupted conversion continues where it stopped")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() < 2 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        inputs, outDir := fset.Args()[:fset.NArg()-1], fset.Arg(fset.NArg()-1)
+
+        config := &convertConfig{}
+        if *configPath != "" {
+            data, err := os.ReadFile(*configPath)
+            if err != nil {
+                return err
+            }
+            if err := json.Unmarshal(data, config); err != nil {
+                return fmt.Errorf("failed to parse %s: %w", *configPath, err)
+            }
+        }
+        base := convertSettings{TileSize: uint16(*tileSize), TileOrder: *tileOrder, ColorSpace: *colorSpace, Dither: *dither, Levels: *levels, Quality: *quality, Pyramid: pyramid, Filter: *filter, ECCLevel: *ecc, Provenance: provenance, TileStats: tileStats, Adaptive: adaptive, Predict: predict, SearchIndex: searchIndex, HighBitDepth: highBitDepth, DPI: *dpi, Orientation: *orientation, Dictionary: *dictionary, SharedDictionary: sharedDictionary}
+        given := map[string]bool{}
+        fset.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+        quality, err := raw.ParseQuality(*demosaic)
+        if err != nil {
+            return invalid(err)
+        }
+        raw.Register(raw.Options{Tool: *rawTool, Quality: quality})
+
+        work, err := collectInputs(inputs, outDir)
+        if err != nil {
+            return err
+        }
+        if len(work) == 0 {
+            return errors.New("no input images found")
+        }
+
+        if *jobs < 1 {
+            *jobs = 1
+        }
+        limits := outputLimits{maxSize: defaults.MaxOutputBytes, spillDir: defaults.SpillDir, spillThreshold: defaults.SpillThreshold}
+        if *spillDir != "" {
+            limits.spillDir = *spillDir
+        }
+        if *maxSize != "" {
+            if limits.maxSize, err = nest.ParseSize(*maxSize); err != nil {
+                return err
+            }
+        }
+        if *spillSize != "" {
+            if limits.spillThreshold, err = nest.ParseSize(*spillSize); err != nil {
+                return err
+            }
+        }
+        queue := make(chan convertJob)
+        var wg sync.WaitGroup
+        var mu sync.Mutex
+        var failed failures
+        var total int64
+        for i := 0; i < *jobs; i++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                for job := range queue {
+                    var size int64
+                    var err error
+                    if *dryRun {
+                        size, err = estimateFile(job, config.settingsFor(job.src, base, given))
+                        if err == nil && limits.maxSize > 0 && size > limits.maxSize {
+                            err = invalid(fmt.Errorf("estimated %s exceeds the size limit of %s", formatBytes(size), formatBytes(limits.maxSize)))
+                        }
+                    } else if err = convertFile(job, config.settingsFor(job.src, base, given), *resume, limits); err == nil {
+                        var info os.FileInfo
+                        if info, err = os.Stat(job.dst); err == nil {
+                            size = info.Size()
+                        }
+                    }
+                    mu.Lock()
+                    switch {
+                    case err != nil:
+                        failed.add(err)
+                        reportError("convert", job.src, err)
+                    case jsonOutput:
+                        printJSON(convertJSON{Source: job.src, Output: job.dst, Bytes: size, Estimated: *dryRun})
+                    case *dryRun:
+                        total += size
+                        fmt.Printf("%s -> %s: about %s\n", job.src, job.dst, formatBytes(size))
+                    default:
+                        fmt.Printf("%s -> %s\n", job.src, job.dst)
+                    }
+                    mu.Unlock()
+                }
+            }()
+        }
+        for _, job := range work {
+            queue <- job
+        }
+        close(queue)
+        wg.Wait()
+
+        if err := failed.err(len(work)); err != nil {
+            return err
+        }
+        if *dryRun && !jsonOutput {
+            fmt.Printf("about %s in total\n", formatBytes(total))
+        }
+        return nil
+    }
+}
+
+// collectInputs expands globs and walks directories recursively. Files found
+// under a directory keep their relative path below outDir. Two inputs that
+// would be written to the same output, such as a.png and a.jpg, are an
+// error.
+func collectInputs(inputs []string, outDir string) ([]convertJob, error) {
+    var work []convertJob
+    seen := map[string]bool{}
+    outputs := map[string]string{}
+    add := func(src, rel string) error {
+        if seen[src] {
+            return nil
+        }
+        seen[src] = true
+        dst := filepath.Join(outDir, strings.TrimSuffix(rel, filepath.Ext(rel))+".nest")
+        if other, ok := outputs[dst]; ok {
+            return invalid(fmt.Errorf("%s and %s would both be written to %s", other, src, dst))
+        }
+        outputs[dst] = src
+        work = append(work, convertJob{src: src, dst: dst})
+        return nil
+    }
+
+    for _, input := range inputs {
+        matches := []string{input}
+        if strings.ContainsAny(input, "*?[") {
+            var err error
+            if matches, err = filepath.Glob(input); err != nil {
+                return nil, fmt.Errorf("bad pattern %q: %w", input, err)
+            }
+        }
+        for _, match := range matches {
+            info, err := os.Stat(match)
+            if err != nil {
+                return nil, err
+            }
+            if !info.IsDir() {
+                if err := add(match, filepath.Base(match)); err != nil {
+                    return nil, err
+                }
+                continue
+            }
+            root := match
+            err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+                if err != nil {
+                    return err
+                }
+                if d.IsDir() || !(isImageFile(path) || isPDFFile(path)) {
+                    return nil
+                }
+                rel, err := filepath.Rel(root, path)
+                if err != nil {
+                    return err
+                }
+                return add(path, rel)
+            })
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+    return work, nil
+}
+
+// prepareConvert decodes the source of job and returns the file to write
+// with the options to write it with.
+func prepareConvert(job convertJob, s convertSettings, resume bool) (*nest.NestedImageFile, nest.WriteOptions, error) {
+    order, err := nest.ParseTileOrder(s.TileOrder)
+    if err != nil {
+        return nil, nest.WriteOptions{}, err
+    }
+    space, err := colorspace.Parse(s.ColorSpace)
+    if err != nil {
+        return nil, nest.WriteOptions{}, err
+    }
+    dither, err := nest.ParseDitherMode(s.Dither)
+    if err != nil {
+        return nil, nest.WriteOptions{}, err
+    }
+    filter, err := nest.ParseResampleFilter(s.Filter)
+    if err != nil {
+        return nil, nest.WriteOptions{}, err
+    }
+    orientation := nest.OrientationNormal
+    if s.Orientation != "" {
+        if orientation, err = nest.ParseOrientation(s.Orientation); err != nil {
+            return nil, nest.WriteOptions{}, err
+        }
+    }
+
+    var source string
+    if s.Provenance != nil && *s.Provenance {
+        source = filepath.ToSlash(job.src)
+    }
+    opts := nest.ImportOptions{
+        TileSize:     s.TileSize,
+        ColorSpace:   space,
+        Dither:       dither,
+        Levels:       s.Levels,
+        Source:       source,
+        HighBitDepth: s.HighBitDepth != nil && *s.HighBitDepth,
+    }
+    var nif *nest.NestedImageFile
+    if isPDFFile(job.src) {
+        if nif, err = nest.ImportPDFWithOptions(job.src, s.DPI, nest.PDFOptions{ImportOptions: opts}); err != nil {
+            return nil, nest.WriteOptions{}, err
+        }
+    } else {
+        li, err := decodeLayeredFile(job.src)
+        if err != nil {
+            return nil, nest.WriteOptions{}, err
+        }
+        if nif, err = nest.FromLayers(li, opts); err != nil {
+            return nil, nest.WriteOptions{}, fmt.Errorf("%s: %w", job.src, err)
+        }
+    }
+    if s.Orientation == "" {
+        if orientation, err = sourceOrientation(job.src); err != nil {
+            return nil, nest.WriteOptions{}, err
+        }
+    }
+    nif.Header.Orientation = orientation
+    if s.BigEndian != nil && *s.BigEndian {
+        nif.Header.ByteOrder = nest.BigEndian
+    }
+    if s.Pyramid != nil && *s.Pyramid {
+        nif.BuildPyramidWithFilter(filter)
+    }
+    shared := s.SharedDictionary != nil && *s.SharedDictionary
+    var dict *nest.Dictionary
+    switch s.Dictionary {
+    case "":
+    case "auto":
+        if shared {
+            return nil, nest.WriteOptions{}, errors.New("a dictionary trained per image can't be shared")
+        }
+        // Images without repeated content are simply stored without one.
+        dict, _ = nest.TrainDictionary(nif.DictionarySamples(dictionarySamples))
+    default:
+        if dict, err = readDictionary(s.Dictionary); err != nil {
+            return nil, nest.WriteOptions{}, err
+        }
+    }
+    return nif, nest.WriteOptions{
+        TileOrder:        order,
+        Quality:          s.Quality,
+        LinkCodec:        nest.CodecRLE,
+        ECCLevel:         s.ECCLevel,
+        Journal:          resume,
+        TileStats:        s.TileStats != nil && *s.TileStats,
+        Adaptive:         s.Adaptive != nil && *s.Adaptive,
+        Predict:          s.Predict != nil && *s.Predict,
+        SearchIndex:      s.SearchIndex != nil && *s.SearchIndex,
+        Dictionary:       dict,
+        SharedDictionary: shared && dict != nil,
+    }, nil
+}
+
+// outputLimits holds the flags that bound the resources a conversion may
+// use rather than what it stores.
+type outputLimits struct {
+    maxSize        int64
+    spillDir       string
+    spillThreshold int64
+}
+
+func convertFile(job convertJob, s convertSettings, resume bool, limits outputLimits) error {
+    nif, opts, err := prepareConvert(job, s, resume)
+    if err != nil {
+        return err
+    }
+    opts.MaxOutputBytes = limits.maxSize
+    opts.SpillDir = limits.spillDir
+    opts.SpillThreshold = limits.spillThreshold
+    opts.ApplyDefaults(defaults)
+    if err := os.MkdirAll(filepath.Dir(job.dst), 0o755); err != nil {
+        return err
+    }
+    return nest.WriteNestedImageFileWithOptions(job.dst, nif, opts)
+}
+
+// estimateFile returns about how many bytes convertFile would write.
+func estimateFile(job convertJob, s convertSettings) (int64, error) {
+    nif, opts, err := prepareConvert(job, s, false)
+    if err != nil {
+        return 0, err
+    }
+    opts.ApplyDefaults(defaults)
+    // The caller checks the estimate against the size limit.
+    opts.MaxOutputBytes = 0
+    return nest.EstimateSize(nif, opts)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+)
+
+type hashedFile struct {
+    path string
+    hash uint64
+}
+
+type duplicateJSON struct {
+    Path string `json:"path"`
+    Hash string `json:"hash"`
+}
+
+func dedupeFlags(fset *flag.FlagSet) func() error {
+    threshold := fset.Int("threshold", 6, "maximum differing hash bits for files to count as near duplicates")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() == 0 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        var files []hashedFile
+        var failed failures
+        for _, dir := range fset.Args() {
+            entries, err := nest.Scan(dir, nil)
+            if err != nil {
+                reportError("dedupe", dir, err)
+                failed.add(err)
+            }
+            for _, e := range entries {
+                hash, err := perceptualHash(e.Path)
+                if err != nil {
+                    reportError("dedupe", e.Path, err)
+                    failed.add(err)
+                    continue
+                }
+                files = append(files, hashedFile{e.Path, hash})
+            }
+        }
+
+        // Group files transitively: a file joins a group when it is close to
+        // any member.
+        group := make([]int, len(files))
+        for i := range group {
+            group[i] = i
+        }
+        var find func(i int) int
+        find = func(i int) int {
+            if group[i] != i {
+                group[i] = find(group[i])
+            }
+            return group[i]
+        }
+        for i := range files {
+            for j := i + 1; j < len(files); j++ {
+                if nest.HashDistance(files[i].hash, files[j].hash) <= *threshold {
+                    group[find(j)] = find(i)
+                }
+            }
+        }
+
+        members := map[int][]int{}
+        var roots []int
+        for i := range files {
+            r := find(i)
+            if len(members[r]) == 0 {
+                roots = append(roots, r)
+            }
+            members[r] = append(members[r], i)
+        }
+        printed := 0
+        for _, r := range roots {
+            if len(members[r]) < 2 {
+                continue
+            }
+            if jsonOutput {
+                group := make([]duplicateJSON, 0, len(members[r]))
+                for _, i := range members[r] {
+                    group = append(group, duplicateJSON{files[i].path, fmt.Sprintf("%016x", files[i].hash)})
+                }
+                printJSON(group)
+                continue
+            }
+            if printed > 0 {
+                fmt.Println()
+            }
+            for _, i := range members[r] {
+                fmt.Printf("%016x  %s\n", files[i].hash, files[i].path)
+            }
+            printed++
+        }
+
+        if failed.n > 0 {
+            return &exitError{failed.code, fmt.Errorf("%d files or directories could not be read", failed.n)}
+        }
+        return nil
+    }
+}
+
+func perceptualHash(path string) (uint64, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return 0, err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return 0, err
+    }
+    nr, err := nest.NewReader(file, info.Size())
+    if err != nil {
+        return 0, err
+    }
+    return nr.PerceptualHash()
+}
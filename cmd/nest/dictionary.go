@@ -0,0 +1,89 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// dictionarySamples is how many tiles of each file are sampled for
+// training.
+const dictionarySamples = 64
+
+type dictionaryJSON struct {
+    File  string `json:"file"`
+    Bytes int64  `json:"bytes"`
+    ID    string `json:"id"`
+}
+
+func dictionaryFlags(fset *flag.FlagSet) func() error {
+    out := fset.String("o", "nest.dict", "output dictionary file")
+    tileSize := fset.Uint("tile-size", defaultTileSize(), "tile size to sample images other than .nest files at")
+    samples := fset.Int("samples", dictionarySamples, "tiles sampled from each file")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() == 0 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        var all [][]byte
+        for _, name := range fset.Args() {
+            var nif *nest.NestedImageFile
+            if strings.EqualFold(filepath.Ext(name), ".nest") {
+                var err error
+                if nif, err = nest.ReadNestedImageFile(name); err != nil {
+                    return err
+                }
+            } else {
+                img, err := decodeImageFile(name)
+                if err != nil {
+                    return err
+                }
+                nif = nest.FromImage(img, nest.ImportOptions{TileSize: uint16(*tileSize)})
+            }
+            all = append(all, nif.DictionarySamples(*samples)...)
+        }
+        dict, err := nest.TrainDictionary(all)
+        if err != nil {
+            return err
+        }
+        if err := os.WriteFile(*out, dict.Data, 0o644); err != nil {
+            return err
+        }
+        if jsonOutput {
+            return printJSON(dictionaryJSON{File: *out, Bytes: int64(len(dict.Data)), ID: fmt.Sprintf("%08x", dict.ID())})
+        }
+        fmt.Printf("%s: %s, ID %08x\n", *out, formatBytes(int64(len(dict.Data))), dict.ID())
+        return nil
+    }
+}
+
+func readDictionary(name string) (*nest.Dictionary, error) {
+    data, err := os.ReadFile(name)
+    if err != nil {
+        return nil, err
+    }
+    return &nest.Dictionary{Data: data}, nil
+}
+
+// registerDictionaries registers the dictionary files listed in
+// NEST_DICTIONARIES, so files that only record a shared dictionary's ID can
+// be read.
+func registerDictionaries() error {
+    for _, name := range filepath.SplitList(os.Getenv("NEST_DICTIONARIES")) {
+        d, err := readDictionary(name)
+        if err != nil {
+            return err
+        }
+        if err := nest.RegisterDictionary(d); err != nil {
+            return fmt.Errorf("%s: %w", name, err)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "sort"
+
+    nest "github.com/70ziko/NEST"
+)
+
+type planeJSON struct {
+    Plane    string `json:"plane"`
+    Codec    string `json:"codec"`
+    Count    int    `json:"count"`
+    Bytes    int64  `json:"bytes"`
+    RawBytes int64  `json:"raw_bytes"`
+}
+
+type storageJSON struct {
+    File         string           `json:"file"`
+    Total        int64            `json:"total"`
+    Header       int64            `json:"header"`
+    Tiles        int64            `json:"tiles"`
+    NestedImages int64            `json:"nested_images"`
+    Chunks       map[string]int64 `json:"chunks"`
+    Other        int64            `json:"other"`
+    Planes       []planeJSON      `json:"planes,omitempty"`
+}
+
+// chunkGroups names the parts of a file that span several chunk types.
+var chunkGroups = map[nest.ChunkType]string{
+    nest.ChunkIndex:         "index",
+    nest.ChunkChecksums:     "index",
+    nest.ChunkStats:         "index",
+    nest.ChunkClasses:       "index",
+    nest.ChunkTail:          "index",
+    nest.ChunkPyramid:       "pyramid",
+    nest.ChunkPyramidSource: "pyramid",
+    nest.ChunkParity:        "parity",
+    nest.ChunkMetadata:      "metadata",
+}
+
+func planeName(links bool) string {
+    if links {
+        return "link"
+    }
+    return "rgb"
+}
+
+func duFlags(fset *flag.FlagSet) func() error {
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() == 0 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        for _, path := range fset.Args() {
+            rep, err := storageReport(path)
+            if err != nil {
+                return fmt.Errorf("%s: %w", path, err)
+            }
+            if jsonOutput {
+                out := storageJSON{File: path, Total: rep.Total, Header: rep.Header, Tiles: rep.Tiles, NestedImages: rep.NestedImages, Chunks: map[string]int64{}, Other: rep.Other}
+                for t, n := range rep.Chunks {
+                    out.Chunks[t.String()] = n
+                }
+                for _, u := range rep.Planes {
+                    out.Planes = append(out.Planes, planeJSON{Plane: planeName(u.Links), Codec: u.Codec.String(), Count: u.Count, Bytes: u.Bytes, RawBytes: u.RawBytes})
+                }
+                if err := printJSON(out); err != nil {
+                    return err
+                }
+                continue
+            }
+            printStorage(path, rep)
+        }
+        return nil
+    }
+}
+
+func storageReport(path string) (*nest.StorageReport, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return nil, err
+    }
+    nr, err := nest.NewReader(file, info.Size())
+    if err != nil {
+        return nil, err
+    }
+    return nr.StorageReport()
+}
+
+func printStorage(path string, rep *nest.StorageReport) {
+    line := func(indent, name string, n int64) {
+        pct := 0.0
+        if rep.Total > 0 {
+            pct = 100 * float64(n) / float64(rep.Total)
+        }
+        fmt.Printf("%s%-*s %10s %6.1f%%\n", indent, 24-len(indent), name, formatBytes(n), pct)
+    }
+    fmt.Printf("%s: %s\n", path, formatBytes(rep.Total))
+    line("  ", "header", rep.Header)
+    line("  ", "tiles", rep.Tiles)
+    for _, u := range rep.Planes {
+        fmt.Printf("    %-5s %-5s %8d planes %10s, raw %s (%.2fx, %s saved)\n", planeName(u.Links), u.Codec, u.Count, formatBytes(u.Bytes), formatBytes(u.RawBytes), u.Ratio(), formatBytes(u.Saved()))
+    }
+    if rep.NestedImages > 0 {
+        line("  ", "nested images", rep.NestedImages)
+    }
+
+    groups := map[string]int64{}
+    for t, n := range rep.Chunks {
+        name, ok := chunkGroups[t]
+        if !ok {
+            name = t.String() + " chunks"
+        }
+        groups[name] += n
+    }
+    names := make([]string, 0, len(groups))
+    for name := range groups {
+        names = append(names, name)
+    }
+    sort.Slice(names, func(i, j int) bool { return groups[names[i]] > groups[names[j]] })
+    for _, name := range names {
+        line("  ", name, groups[name])
+    }
+    if rep.Other != 0 {
+        line("  ", "other", rep.Other)
+    }
+}
+
+// formatBytes prints n with a binary unit, such as 40.0 GiB.
+func formatBytes(n int64) string {
+    const unit = 1024
+    if n < unit && n > -unit {
+        return fmt.Sprintf("%d B", n)
+    }
+    v, exp := float64(n), 0
+    for v >= unit*unit || v <= -unit*unit {
+        v /= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %ciB", v/unit, "KMGTPE"[exp])
+}
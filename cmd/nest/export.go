@@ -0,0 +1,34 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+)
+
+func exportFlags(fset *flag.FlagSet) func() error {
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 2 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        in, out := fset.Arg(0), fset.Arg(1)
+        if nest.ExporterFor(out) == nil {
+            return invalid(fmt.Errorf("%s: %w; known formats are %s", out, nest.ErrUnknownFormat, strings.Join(nest.ExportExtensions(), ", ")))
+        }
+
+        nif, err := nest.ReadNestedImageFile(in)
+        if err != nil {
+            return fmt.Errorf("%s: %w", in, err)
+        }
+        if err := nest.ExportFile(out, nif); err != nil {
+            return err
+        }
+        return printWritten(out)
+    }
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+    "github.com/70ziko/NEST/remote"
+)
+
+func fetchFlags(fset *flag.FlagSet) func() error {
+    region := fset.String("region", "", "x,y,w,h of the main image to fetch, the whole image when empty")
+    var headers headerFlags
+    fset.Var(&headers, "header", "\"Name: value\" header to send with every request, repeatable")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 2 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        ra, err := remote.Open(fset.Arg(0), remote.Options{Header: http.Header(headers)})
+        if err != nil {
+            return err
+        }
+        reader, err := nest.NewReader(ra, ra.Size())
+        if err != nil {
+            return fmt.Errorf("%s: %w", fset.Arg(0), err)
+        }
+        rect := reader.Bounds()
+        if *region != "" {
+            if rect, err = parseCrop(*region); err != nil {
+                return err
+            }
+        }
+        nif, err := reader.Extract(rect)
+        if err != nil {
+            return err
+        }
+        if err := nest.WriteNestedImageFile(fset.Arg(1), nif); err != nil {
+            return err
+        }
+        return printWritten(fset.Arg(1))
+    }
+}
+
+// headerFlags collects repeated --header flags.
+type headerFlags http.Header
+
+func (h *headerFlags) String() string {
+    return ""
+}
+
+func (h *headerFlags) Set(v string) error {
+    name, value, ok := strings.Cut(v, ":")
+    if !ok {
+        return fmt.Errorf("header %q is not \"Name: value\"", v)
+    }
+    if *h == nil {
+        *h = headerFlags{}
+    }
+    http.Header(*h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+    return nil
+}
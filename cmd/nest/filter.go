@@ -0,0 +1,87 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+    "github.com/70ziko/NEST/filters"
+)
+
+func filterFlags(fset *flag.FlagSet) func() error {
+    autoContrast := fset.Float64("auto-contrast", -1, "stretch each channel to the full range, ignoring this percent of pixels at each end")
+    equalize := fset.Bool("equalize", false, "equalize the histogram of each channel")
+    gamma := fset.Float64("gamma", 0, "raise values to 1/gamma")
+    blur := fset.Float64("blur", 0, "Gaussian blur with this standard deviation in pixels")
+    unsharp := fset.String("unsharp", "", "sharpen with an unsharp mask given as radius,amount[,threshold]")
+    edges := fset.Bool("edges", false, "replace the image with its Sobel edges")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 1 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        var fs []filters.Filter
+        if *autoContrast >= 0 {
+            fs = append(fs, &filters.AutoContrast{Cutoff: *autoContrast})
+        }
+        if *equalize {
+            fs = append(fs, &filters.Equalize{})
+        }
+        if *gamma != 0 {
+            if *gamma < 0 {
+                return fmt.Errorf("gamma must be positive")
+            }
+            fs = append(fs, filters.Gamma(*gamma))
+        }
+        if *blur != 0 {
+            if *blur < 0 {
+                return fmt.Errorf("blur must be positive")
+            }
+            fs = append(fs, &filters.Blur{Sigma: *blur})
+        }
+        if *unsharp != "" {
+            u := &filters.UnsharpMask{}
+            var threshold int
+            n, _ := fmt.Sscanf(*unsharp, "%g,%g,%d", &u.Radius, &u.Amount, &threshold)
+            if n < 2 || u.Radius < 0 || threshold < 0 || threshold > 255 {
+                return fmt.Errorf("unsharp mask %q is not radius,amount[,threshold]", *unsharp)
+            }
+            u.Threshold = uint8(threshold)
+            fs = append(fs, u)
+        }
+        if *edges {
+            fs = append(fs, filters.Sobel{})
+        }
+        if len(fs) == 0 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        name := fset.Arg(0)
+        nif, err := nest.ReadNestedImageFile(name)
+        if err != nil {
+            return err
+        }
+        if err := filters.Apply(nif, fs...); err != nil {
+            return err
+        }
+        if len(nif.Pyramid) > 0 {
+            if _, err := nif.RebuildPyramid(); err != nil {
+                return err
+            }
+        }
+        opts := nest.WriteOptions{
+            TileOrder:   nif.Header.TileOrder,
+            TileStats:   nif.Index != nil && nif.Index.Stats != nil,
+            Adaptive:    nif.Index != nil && nif.Index.Classes != nil,
+            SearchIndex: nif.HasSearchIndex(),
+        }
+        if err := nest.WriteNestedImageFileWithOptions(name, nif, opts); err != nil {
+            return err
+        }
+        return printWritten(name)
+    }
+}
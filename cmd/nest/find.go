@@ -0,0 +1,82 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// tagFlags collects repeated --tag key=value filters.
+type tagFlags map[string]string
+
+func (t tagFlags) String() string {
+    var pairs []string
+    for k, v := range t {
+        pairs = append(pairs, k+"="+v)
+    }
+    return strings.Join(pairs, ",")
+}
+
+func (t tagFlags) Set(s string) error {
+    k, v, ok := strings.Cut(s, "=")
+    if !ok || k == "" {
+        return fmt.Errorf("tag %q is not key=value", s)
+    }
+    t[k] = v
+    return nil
+}
+
+type findJSON struct {
+    Path        string        `json:"path"`
+    Width       uint32        `json:"width"`
+    Height      uint32        `json:"height"`
+    NestedCount uint32        `json:"nested_count"`
+    Metadata    nest.Metadata `json:"metadata,omitempty"`
+}
+
+func findFlags(fset *flag.FlagSet) func() error {
+    tags := tagFlags{}
+    fset.Var(tags, "tag", "only files whose metadata has key=value (repeatable)")
+    minNested := fset.Uint("min-nested", 0, "only files with at least this many nested images")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() == 0 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        match := func(e *nest.ScanEntry) bool {
+            if e.Header.NestedCount < uint32(*minNested) {
+                return false
+            }
+            for k, v := range tags {
+                if got, ok := e.Metadata[k]; !ok || got != v {
+                    return false
+                }
+            }
+            return true
+        }
+
+        var failed error
+        for _, dir := range fset.Args() {
+            entries, err := nest.Scan(dir, match)
+            for _, e := range entries {
+                if jsonOutput {
+                    h := e.Header
+                    printJSON(findJSON{Path: e.Path, Width: h.Width, Height: h.Height, NestedCount: h.NestedCount, Metadata: e.Metadata})
+                    continue
+                }
+                fmt.Println(e.Path)
+            }
+            if err != nil {
+                reportError("find", dir, err)
+                failed = &exitError{exitCode(err), fmt.Errorf("some files under %s could not be read", dir)}
+            }
+        }
+        return failed
+    }
+}
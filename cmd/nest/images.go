@@ -0,0 +1,115 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+    "github.com/70ziko/NEST/raw"
+    "golang.org/x/image/tiff"
+)
+
+func init() {
+    // TIFF comes from golang.org/x/image, which the library only needs for
+    // fonts, so the tool adds it like any other format.
+    nest.RegisterImporter(".tif", decodeTIFF)
+    nest.RegisterImporter(".tiff", decodeTIFF)
+    raw.Register(raw.Options{})
+}
+
+func decodeTIFF(r io.ReaderAt, size int64) (*nest.LayeredImage, error) {
+    img, err := tiff.Decode(io.NewSectionReader(r, 0, size))
+    if err != nil {
+        return nil, err
+    }
+    return nest.SingleLayer(img), nil
+}
+
+// isImageFile reports whether path has an importer registered for it.
+func isImageFile(path string) bool {
+    return nest.ImporterFor(path) != nil
+}
+
+// mediaTypes maps the extensions of audio and video clips to their MIME
+// types.
+var mediaTypes = map[string]string{
+    ".mp3":  "audio/mpeg",
+    ".m4a":  "audio/mp4",
+    ".ogg":  "audio/ogg",
+    ".opus": "audio/ogg",
+    ".wav":  "audio/wav",
+    ".flac": "audio/flac",
+    ".mp4":  "video/mp4",
+    ".webm": "video/webm",
+    ".mov":  "video/quicktime",
+}
+
+// isContentFile reports whether path is a nested entry source other than
+// an image: an SVG document, a plain text or Markdown caption, or an audio
+// or video clip.
+func isContentFile(path string) bool {
+    ext := strings.ToLower(filepath.Ext(path))
+    switch ext {
+    case ".svg", ".txt", ".md":
+        return true
+    }
+    return mediaTypes[ext] != ""
+}
+
+// loadContentNested reads an SVG document, rendered at its own size, a
+// caption in the default style or a clip as a nested entry.
+func loadContentNested(path string) (nest.NestedImage, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nest.NestedImage{}, err
+    }
+    ext := strings.ToLower(filepath.Ext(path))
+    if t := mediaTypes[ext]; t != "" {
+        return nest.NewMediaNested(t, data, nil)
+    }
+    switch ext {
+    case ".svg":
+        return nest.NewSVGNested(data, 0, 0)
+    case ".md":
+        return nest.NewCaptionNested(nest.Caption{Text: string(data), Markdown: true})
+    }
+    return nest.NewCaptionNested(nest.Caption{Text: string(data)})
+}
+
+// isPDFFile reports whether path is a PDF document, which nest convert
+// renders page by page.
+func isPDFFile(path string) bool {
+    return strings.EqualFold(filepath.Ext(path), ".pdf")
+}
+
+// decodeImageFile decodes path, flattening files with layers.
+func decodeImageFile(path string) (image.Image, error) {
+    li, err := decodeLayeredFile(path)
+    if err != nil {
+        return nil, err
+    }
+    return li.Flatten(), nil
+}
+
+func decodeLayeredFile(path string) (*nest.LayeredImage, error) {
+    li, err := nest.ImportFile(path)
+    if errors.Is(err, nest.ErrUnknownFormat) {
+        return nil, fmt.Errorf("%w; known formats are %s", err, strings.Join(nest.ImportExtensions(), ", "))
+    }
+    return li, err
+}
+
+// sourceOrientation returns the EXIF orientation of a JPEG or TIFF file.
+func sourceOrientation(path string) (nest.Orientation, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return 0, err
+    }
+    defer f.Close()
+    return nest.SourceOrientation(f), nil
+}
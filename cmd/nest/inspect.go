@@ -0,0 +1,121 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "time"
+
+    nest "github.com/70ziko/NEST"
+)
+
+func inspectFlags(fset *flag.FlagSet) func() error {
+    verify := fset.Bool("verify", false, "check each file against the hash in its trailer")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() == 0 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        var failed failures
+        for _, path := range fset.Args() {
+            if err := inspectFile(path, *verify); err != nil {
+                reportError("inspect", path, err)
+                failed.add(err)
+            }
+        }
+        return failed.err(fset.NArg())
+    }
+}
+
+type trailerJSON struct {
+    Encoder string    `json:"encoder"`
+    Written time.Time `json:"written"`
+    SHA256  string    `json:"sha256"`
+}
+
+type inspectJSON struct {
+    File        string       `json:"file"`
+    Bytes       int64        `json:"bytes"`
+    Version     uint16       `json:"version"`
+    BigEndian   bool         `json:"big_endian"`
+    Width       uint32       `json:"width"`
+    Height      uint32       `json:"height"`
+    TileSize    uint16       `json:"tile_size"`
+    TileOrder   string       `json:"tile_order"`
+    NestedCount uint32       `json:"nested_count"`
+    Trailer     *trailerJSON `json:"trailer"`
+    // Intact is only set with --verify.
+    Intact *bool `json:"intact,omitempty"`
+}
+
+func inspectFile(path string, verify bool) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return err
+    }
+    nr, err := nest.NewReader(file, info.Size())
+    if err != nil {
+        return err
+    }
+    h := nr.Header
+    t := nr.Trailer()
+    if jsonOutput {
+        out := inspectJSON{
+            File:        path,
+            Bytes:       info.Size(),
+            Version:     h.Version,
+            BigEndian:   h.ByteOrder == nest.BigEndian,
+            Width:       h.Width,
+            Height:      h.Height,
+            TileSize:    h.TileSize,
+            TileOrder:   h.TileOrder.String(),
+            NestedCount: h.NestedCount,
+        }
+        var err error
+        if t != nil {
+            out.Trailer = &trailerJSON{t.Encoder, t.Written, fmt.Sprintf("%x", t.Hash)}
+        }
+        if verify {
+            err = nr.VerifyTrailer()
+            intact := err == nil
+            out.Intact = &intact
+        }
+        if perr := printJSON(out); perr != nil {
+            return perr
+        }
+        return err
+    }
+    fmt.Printf("%s: %s\n", path, formatBytes(info.Size()))
+    order := "little-endian"
+    if h.ByteOrder == nest.BigEndian {
+        order = "big-endian"
+    }
+    fmt.Printf("  format     version %d, %s\n", h.Version, order)
+    fmt.Printf("  image      %dx%d, %d px tiles in %s order, %d nested images\n", h.Width, h.Height, h.TileSize, h.TileOrder, h.NestedCount)
+    if t == nil {
+        fmt.Println("  trailer    none")
+        if verify {
+            return nest.ErrNoTrailer
+        }
+        return nil
+    }
+    fmt.Printf("  encoder    %s\n", t.Encoder)
+    fmt.Printf("  written    %s\n", t.Written.Format(time.RFC3339))
+    fmt.Printf("  sha256     %x\n", t.Hash)
+    if !verify {
+        return nil
+    }
+    if err := nr.VerifyTrailer(); err != nil {
+        fmt.Println("  intact     no")
+        return err
+    }
+    fmt.Println("  intact     yes")
+    return nil
+}
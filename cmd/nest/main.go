@@ -0,0 +1,240 @@
+package main
+
+import (
+    "fmt"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// defaults hold the settings from the user's config file and NEST_*
+// environment variables. Flags given explicitly take precedence.
+var defaults *nest.Defaults
+
+func defaultTileSize() uint {
+    if defaults != nil && defaults.TileSize != 0 {
+        return uint(defaults.TileSize)
+    }
+    return nest.DefaultTileSize
+}
+
+func init() {
+    commands = []*command{
+        {
+            name:    "convert",
+            summary: "convert images, camera raw files and PDF documents to .nest files",
+            args:    "<input|dir|glob>... <outdir>",
+            flags:   convertFlags,
+        },
+        {
+            name:    "compose",
+            summary: "build a .nest file from a directory of sources",
+            args:    "<dir> <out.nest>",
+            flags:   composeFlags,
+        },
+        {
+            name:    "capture",
+            summary: "build a .nest file from a source image and crops of it",
+            args:    "<source> <out.nest> <x,y,w,h>...",
+            flags:   captureFlags,
+        },
+        {
+            name:    "export",
+            summary: "write a file as OpenRaster with its layers and nested images, or as PNG or JPEG",
+            args:    "<file.nest> <out.ora|out.png|out.jpg>",
+            flags:   exportFlags,
+        },
+        {
+            name:        "subset",
+            summary:     "write a region and chosen nested images as a new file for sharing",
+            args:        "<file.nest> <x,y,w,h> <out.nest>",
+            description: "Writes only the region, the nested images listed with --nested and the metadata keys listed with --keep-metadata. Links to other nested images are cleared.",
+            flags:       subsetFlags,
+        },
+        {
+            name:    "find",
+            summary: "list .nest files matching metadata and header filters",
+            args:    "<dir>...",
+            flags:   findFlags,
+        },
+        {
+            name:    "dedupe",
+            summary: "report near-duplicate .nest files by perceptual hash",
+            args:    "<dir>...",
+            flags:   dedupeFlags,
+        },
+        {
+            name:    "repair",
+            summary: "rebuild a file from two copies with different corrupt tiles",
+            args:    "<out.nest> <copy-a.nest> <copy-b.nest>",
+            flags:   repairFlags,
+        },
+        {
+            name:        "compare",
+            summary:     "report PSNR and SSIM between two files as JSON",
+            args:        "<reference.nest> <other.nest>",
+            description: "Prints indented JSON, or a single line with --json.",
+            flags:       compareFlags,
+        },
+        {
+            name:        "audit",
+            summary:     "verify and print a file's audit log",
+            args:        "<file.nest>",
+            description: "Prints the audit log as JSON lines, after checking its hash chain.",
+            flags:       auditFlags,
+        },
+        {
+            name:        "du",
+            summary:     "report where a file's bytes go and what each codec saves",
+            args:        "<file.nest>...",
+            description: "Reports where the bytes of each file go, and what each codec saves.",
+            flags:       duFlags,
+        },
+        {
+            name:        "inspect",
+            summary:     "print who wrote a file and when, and check its content hash",
+            args:        "<file.nest>...",
+            description: "Prints each file's header and trailer: who wrote it, when, and its content hash.",
+            flags:       inspectFlags,
+        },
+        {
+            name:        "dictionary",
+            summary:     "train a tile compression dictionary from sample files",
+            args:        "<file>...",
+            description: "Trains a dictionary for nest convert --dictionary from .nest files or images like the ones it will compress.",
+            flags:       dictionaryFlags,
+        },
+        {
+            name:        "ocr",
+            summary:     "add the words from an hOCR or ALTO OCR result as searchable text",
+            args:        "<file.nest> <result.hocr|result.xml>",
+            description: "Reads .xml files as ALTO and others as hOCR. Each word becomes an annotation with its box.",
+            flags:       ocrFlags,
+        },
+        {
+            name:        "search",
+            summary:     "find words in annotations and metadata, using the search index when there is one",
+            args:        "<query> <file.nest>...",
+            description: "Prints each match in an annotation as the file, the box around it as x,y,w,h, and the annotation ID, and each match in metadata as the file and key.",
+            flags:       searchFlags,
+        },
+        {
+            name:    "overviews",
+            summary: "refresh pyramid tiles after edits",
+            args:    "<file.nest>",
+            flags:   overviewsFlags,
+        },
+        {
+            name:        "adjust",
+            summary:     "set display adjustments such as window and level",
+            args:        "<file.nest>",
+            description: "Without flags, prints the file's display adjustments.",
+            flags:       adjustFlags,
+        },
+        {
+            name:        "canvas",
+            summary:     "place the image on a larger document with a background",
+            args:        "<file.nest>",
+            description: "Without flags, prints the file's canvas.",
+            flags:       canvasFlags,
+        },
+        {
+            name:        "paste",
+            summary:     "draw an image into a file in place",
+            args:        "<file.nest> <image> <x,y>",
+            description: "Draws the image over the main image in place, rewriting only the tiles it covers.",
+            flags:       pasteFlags,
+        },
+        {
+            name:        "filter",
+            summary:     "apply auto-contrast, equalization, gamma, blur, sharpening or edges",
+            args:        "<file.nest>",
+            description: "Filters run in the order listed below and keep every pixel's link.",
+            flags:       filterFlags,
+        },
+        {
+            name:        "redact",
+            summary:     "irreversibly blur or black out regions of a file",
+            args:        "<file.nest> <x,y,w,h>...",
+            description: "Overwrites the regions in the main image, focal planes, bands and pyramid, and the nested images they show or link to, and rewrites the file so no original pixels remain.",
+            flags:       redactFlags,
+        },
+        {
+            name:        "scrub",
+            summary:     "remove identifying metadata, provenance and history before publishing",
+            args:        "<file.nest>",
+            description: "Removes free-form metadata, annotations, provenance, the audit log and edit history, except what the flags keep, and rewrites the file so that scrubbing it again gives the same bytes.",
+            flags:       scrubFlags,
+        },
+        {
+            name:    "sync",
+            summary: "merge shared link and annotation edits between two copies",
+            args:    "<a.nest> <b.nest>",
+            flags:   syncFlags,
+        },
+        {
+            name:    "serve",
+            summary: "serve tiles and regions of a file over HTTP",
+            args:    "<file.nest>",
+            flags:   serveFlags,
+        },
+        {
+            name:    "fetch",
+            summary: "download a region of a remote file as a standalone file",
+            args:    "<url> <out.nest>",
+            flags:   fetchFlags,
+        },
+        {
+            name:    "view",
+            summary: "preview a file in the terminal",
+            args:    "<file.nest>",
+            flags:   viewFlags,
+        },
+        {
+            name:    "completion",
+            summary: "print a bash, zsh or fish completion script",
+            args:    "bash|zsh|fish",
+            flags:   completionFlags,
+        },
+        {
+            name:    "man",
+            summary: "write man pages for nest and its commands",
+            args:    "<dir>",
+            flags:   manFlags,
+        },
+    }
+}
+
+func main() {
+    if len(os.Args) < 2 {
+        printUsage(os.Stderr)
+        os.Exit(2)
+    }
+
+    err := registerDictionaries()
+    if err == nil {
+        defaults, err = nest.LoadDefaults()
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "nest: %v\n", err)
+        os.Exit(1)
+    }
+    switch name := os.Args[1]; name {
+    case "help", "-h", "--help":
+        printUsage(os.Stdout)
+        return
+    default:
+        c := findCommand(name)
+        if c == nil {
+            fmt.Fprintf(os.Stderr, "nest: unknown command %q\n\n", name)
+            printUsage(os.Stderr)
+            os.Exit(2)
+        }
+        err = c.run(os.Args[2:])
+    }
+
+    if err != nil {
+        reportError(os.Args[1], "", err)
+        os.Exit(exitCode(err))
+    }
+}
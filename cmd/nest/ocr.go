@@ -0,0 +1,151 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "image"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// readWords parses an OCR result, as ALTO for .xml files and hOCR otherwise.
+func readWords(path string, dpi float64) ([]nest.Word, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    var words []nest.Word
+    if strings.EqualFold(filepath.Ext(path), ".xml") {
+        words, err = nest.ParseALTO(f, dpi)
+    } else {
+        words, err = nest.ParseHOCR(f)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return words, nil
+}
+
+func ocrFlags(fset *flag.FlagSet) func() error {
+    at := fset.String("at", "", "position of the OCR'd image on the main image as x,y")
+    page := fset.Int("page", 0, "place the words on this page of an imported PDF")
+    dpi := fset.Float64("dpi", 0, "resolution of the OCR'd image, for ALTO measured in mm10 or inch1200")
+    searchIndex := fset.Bool("search-index", false, "store a search index of the annotations and metadata")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 2 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        if *at != "" && *page != 0 {
+            return invalid(fmt.Errorf("--at and --page can't be combined"))
+        }
+        name := fset.Arg(0)
+        nif, err := nest.ReadNestedImageFile(name)
+        if err != nil {
+            return err
+        }
+        var offset image.Point
+        if *at != "" {
+            if n, _ := fmt.Sscanf(*at, "%d,%d", &offset.X, &offset.Y); n != 2 {
+                return invalid(fmt.Errorf("position %q is not x,y", *at))
+            }
+        }
+        if *page != 0 {
+            a := nif.Annotation(nest.PageAnnotationPrefix + strconv.Itoa(*page))
+            if a == nil {
+                return invalid(fmt.Errorf("%s has no page %d", name, *page))
+            }
+            offset = a.Rect.Min
+        }
+        words, err := readWords(fset.Arg(1), *dpi)
+        if err != nil {
+            return err
+        }
+        if err := nif.AddWords(words, offset); err != nil {
+            return err
+        }
+
+        opts := nest.WriteOptions{
+            TileOrder:   nif.Header.TileOrder,
+            TileStats:   nif.Index != nil && nif.Index.Stats != nil,
+            Adaptive:    nif.Index != nil && nif.Index.Classes != nil,
+            SearchIndex: *searchIndex || nif.HasSearchIndex(),
+        }
+        if err := nest.WriteNestedImageFileWithOptions(name, nif, opts); err != nil {
+            return err
+        }
+        return printWritten(name)
+    }
+}
+
+// hitJSON gives rect as [x, y, w, h] on the main image.
+type hitJSON struct {
+    Path       string  `json:"path"`
+    Annotation string  `json:"annotation,omitempty"`
+    Key        string  `json:"key,omitempty"`
+    Rect       *[4]int `json:"rect,omitempty"`
+}
+
+func searchFile(path, query string) ([]nest.SearchHit, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return nil, err
+    }
+    nr, err := nest.NewReader(file, info.Size())
+    if err != nil {
+        return nil, err
+    }
+    return nr.Search(query)
+}
+
+func searchFlags(fset *flag.FlagSet) func() error {
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() < 2 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        query := fset.Arg(0)
+        var fails failures
+        for _, path := range fset.Args()[1:] {
+            hits, err := searchFile(path, query)
+            if err != nil {
+                reportError("search", path, err)
+                fails.add(err)
+                continue
+            }
+            for _, h := range hits {
+                r := h.Rect
+                if jsonOutput {
+                    out := hitJSON{Path: path, Annotation: h.Annotation, Key: h.Key}
+                    if h.Key == "" {
+                        out.Rect = &[4]int{r.Min.X, r.Min.Y, r.Dx(), r.Dy()}
+                    }
+                    if err := printJSON(out); err != nil {
+                        return err
+                    }
+                    continue
+                }
+                if h.Key != "" {
+                    fmt.Printf("%s: metadata %s\n", path, h.Key)
+                    continue
+                }
+                fmt.Printf("%s: %d,%d,%d,%d: %s\n", path, r.Min.X, r.Min.Y, r.Dx(), r.Dy(), h.Annotation)
+            }
+        }
+        return fails.err(fset.NArg() - 1)
+    }
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// Exit codes, so scripts can tell a file that failed a check from a damaged
+// one. Usage errors exit with exitInvalid too.
+const (
+    exitFailed  = 1
+    exitInvalid = 2
+    exitCorrupt = 3
+)
+
+// jsonOutput is set by the --json flag every command has. Commands then
+// print their results to stdout as JSON, one value per line, and errors go
+// to stderr as JSON too.
+var jsonOutput bool
+
+func addJSONFlag(fset *flag.FlagSet) {
+    fset.Var(jsonFlag{}, "json", "print results as JSON, one object per line")
+}
+
+// jsonFlag sets jsonOutput. Unlike a flag defined with BoolVar, defining it
+// leaves jsonOutput alone, so nest completion and nest man can list every
+// command's flags after parsing their own.
+type jsonFlag struct{}
+
+func (jsonFlag) String() string   { return "false" }
+func (jsonFlag) IsBoolFlag() bool { return true }
+
+func (jsonFlag) Set(s string) error {
+    v, err := strconv.ParseBool(s)
+    if err != nil {
+        return err
+    }
+    jsonOutput = v
+    return nil
+}
+
+func printJSON(v any) error {
+    return json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// exitError ends a command with a particular exit code.
+type exitError struct {
+    code int
+    err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// invalid marks err as a failed check rather than a failure to run one.
+func invalid(err error) error {
+    return &exitError{exitInvalid, err}
+}
+
+// exitCode picks the exit code a command failing with err ends with.
+func exitCode(err error) int {
+    var ee *exitError
+    switch {
+    case errors.As(err, &ee):
+        return ee.code
+    case errors.Is(err, nest.ErrChecksum), errors.Is(err, nest.ErrTrailerMismatch),
+        errors.Is(err, nest.ErrNestedImageData), errors.Is(err, io.ErrUnexpectedEOF):
+        return exitCorrupt
+    case errors.Is(err, nest.ErrNoTrailer):
+        return exitInvalid
+    }
+    return exitFailed
+}
+
+type errorJSON struct {
+    Command string `json:"command"`
+    File    string `json:"file,omitempty"`
+    Error   string `json:"error"`
+    Code    int    `json:"code"`
+}
+
+// reportError prints the error a command failed with, or that it hit on
+// one of several files when file is set.
+func reportError(command, file string, err error) {
+    if jsonOutput {
+        json.NewEncoder(os.Stderr).Encode(errorJSON{command, file, err.Error(), exitCode(err)})
+        return
+    }
+    if file != "" {
+        fmt.Fprintf(os.Stderr, "nest %s: %s: %v\n", command, file, err)
+        return
+    }
+    fmt.Fprintf(os.Stderr, "nest %s: %v\n", command, err)
+}
+
+// failures counts the files a command over several files failed on,
+// keeping the most severe exit code among them.
+type failures struct {
+    n    int
+    code int
+}
+
+func (f *failures) add(err error) {
+    f.n++
+    f.code = max(f.code, exitCode(err))
+}
+
+func (f *failures) err(total int) error {
+    if f.n == 0 {
+        return nil
+    }
+    return &exitError{f.code, fmt.Errorf("%d of %d files failed", f.n, total)}
+}
+
+// fileJSON describes a file a command wrote.
+type fileJSON struct {
+    File  string `json:"file"`
+    Bytes int64  `json:"bytes"`
+}
+
+// printWritten reports path, which the command wrote, when printing JSON.
+// Commands that otherwise print nothing stay silent.
+func printWritten(path string) error {
+    if !jsonOutput {
+        return nil
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        return err
+    }
+    return printJSON(fileJSON{path, info.Size()})
+}
+
+// settingFlags counts the flags given on the command line besides --json.
+func settingFlags(fset *flag.FlagSet) int {
+    n := 0
+    fset.Visit(func(f *flag.Flag) {
+        if f.Name != "json" {
+            n++
+        }
+    })
+    return n
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "runtime"
+    "strconv"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+)
+
+type overviewsJSON struct {
+    File             string `json:"file"`
+    TilesRegenerated int    `json:"tiles_regenerated,omitempty"`
+    LevelsAppended   int    `json:"levels_appended,omitempty"`
+}
+
+func overviewsFlags(fset *flag.FlagSet) func() error {
+    levelList := fset.String("levels", "", "comma-separated pyramid levels to keep (default: the levels the file has, or all)")
+    outOfCore := fset.Bool("out-of-core", false, "build every level from the stored tiles and append it without loading the image; the file must have no pyramid yet")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 1 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        if *outOfCore {
+            if *levelList != "" {
+                return errors.New("--levels can't be combined with --out-of-core, which builds every level")
+            }
+            return appendOverviews(fset.Arg(0))
+        }
+
+        var levels []int
+        if *levelList != "" {
+            for _, s := range strings.Split(*levelList, ",") {
+                n, err := strconv.Atoi(strings.TrimSpace(s))
+                if err != nil {
+                    return fmt.Errorf("invalid pyramid level %q", s)
+                }
+                levels = append(levels, n)
+            }
+        }
+
+        name := fset.Arg(0)
+        nif, err := nest.ReadNestedImageFile(name)
+        if err != nil {
+            return err
+        }
+        n, err := nif.RebuildPyramid(levels...)
+        if err != nil {
+            return err
+        }
+        opts := nest.WriteOptions{
+            TileOrder:   nif.Header.TileOrder,
+            TileStats:   nif.Index != nil && nif.Index.Stats != nil,
+            Adaptive:    nif.Index != nil && nif.Index.Classes != nil,
+            SearchIndex: nif.HasSearchIndex(),
+        }
+        if err := nest.WriteNestedImageFileWithOptions(name, nif, opts); err != nil {
+            return err
+        }
+        if jsonOutput {
+            return printJSON(overviewsJSON{File: name, TilesRegenerated: n})
+        }
+        fmt.Printf("%d pyramid tiles regenerated\n", n)
+        return nil
+    }
+}
+
+func appendOverviews(name string) error {
+    f, err := openInPlace(name)
+    if err != nil {
+        return err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return err
+    }
+    nr, err := nest.NewReader(f, info.Size())
+    if err != nil {
+        f.Close()
+        return err
+    }
+    opts := nest.WriteOptions{
+        Adaptive: nr.Index.Classes != nil,
+        Workers:  runtime.NumCPU(),
+    }
+    if err := nest.AppendPyramid(f, opts); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    if jsonOutput {
+        return printJSON(overviewsJSON{File: name, LevelsAppended: nr.Grid().Levels() - 1})
+    }
+    fmt.Printf("%d pyramid levels appended\n", nr.Grid().Levels()-1)
+    return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "image"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+)
+
+func pasteFlags(fset *flag.FlagSet) func() error {
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 3 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        var at image.Point
+        if n, _ := fmt.Sscanf(fset.Arg(2), "%d,%d", &at.X, &at.Y); n != 2 {
+            return fmt.Errorf("position %q is not x,y", fset.Arg(2))
+        }
+        img, err := decodeImageFile(fset.Arg(1))
+        if err != nil {
+            return err
+        }
+        f, err := openInPlace(fset.Arg(0))
+        if err != nil {
+            return err
+        }
+        if err := nest.PasteImage(f, img, at); err != nil {
+            f.Close()
+            return err
+        }
+        if err := f.Close(); err != nil {
+            return err
+        }
+        return printWritten(fset.Arg(0))
+    }
+}
+
+// openInPlace opens an existing file for editing in place under the
+// exclusive lock, failing with nest.ErrLocked while another process holds
+// a lock on it.
+func openInPlace(name string) (*nest.LockedFile, error) {
+    if _, err := os.Stat(name); err != nil {
+        return nil, err
+    }
+    f, err := nest.OpenExclusive(name)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", name, err)
+    }
+    return f, nil
+}
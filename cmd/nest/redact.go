@@ -0,0 +1,56 @@
+package main
+
+import (
+    "flag"
+    "image"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+)
+
+func redactFlags(fset *flag.FlagSet) func() error {
+    mode := fset.String("mode", nest.RedactBlur.String(), "how to destroy the regions: blur or blackout")
+    actor := fset.String("actor", "", "record the redaction in the audit log as made by this actor, starting a log if the file has none")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() < 2 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        m, err := nest.ParseRedactMode(*mode)
+        if err != nil {
+            return invalid(err)
+        }
+        var regions []image.Rectangle
+        for _, s := range fset.Args()[1:] {
+            r, err := parseCrop(s)
+            if err != nil {
+                return invalid(err)
+            }
+            regions = append(regions, r)
+        }
+        name := fset.Arg(0)
+        nif, err := nest.ReadNestedImageFile(name)
+        if err != nil {
+            return err
+        }
+        if *actor != "" {
+            nif.EnableAudit(*actor)
+        }
+        if err := nif.Redact(regions, m); err != nil {
+            return err
+        }
+
+        opts := nest.WriteOptions{
+            TileOrder:   nif.Header.TileOrder,
+            TileStats:   nif.Index != nil && nif.Index.Stats != nil,
+            Adaptive:    nif.Index != nil && nif.Index.Classes != nil,
+            SearchIndex: nif.HasSearchIndex(),
+        }
+        if err := nest.WriteNestedImageFileWithOptions(name, nif, opts); err != nil {
+            return err
+        }
+        return printWritten(name)
+    }
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// repairJSON lists tiles as [x, y] pairs.
+type repairJSON struct {
+    Output string   `json:"output"`
+    FromB  [][2]int `json:"from_b"`
+    Lost   [][2]int `json:"lost"`
+}
+
+func repairFlags(fset *flag.FlagSet) func() error {
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 3 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        var readers [2]*nest.Reader
+        for i, path := range fset.Args()[1:] {
+            file, err := os.Open(path)
+            if err != nil {
+                return err
+            }
+            defer file.Close()
+            info, err := file.Stat()
+            if err != nil {
+                return err
+            }
+            if readers[i], err = nest.NewReader(file, info.Size()); err != nil {
+                return fmt.Errorf("%s: %w", path, err)
+            }
+        }
+
+        out, err := nest.CreateAtomic(fset.Arg(0), true)
+        if err != nil {
+            return err
+        }
+        defer out.Abort()
+
+        report, err := nest.Repair(out, readers[0], readers[1])
+        if report != nil && jsonOutput {
+            out := repairJSON{Output: fset.Arg(0), FromB: [][2]int{}, Lost: [][2]int{}}
+            for _, t := range report.FromB {
+                out.FromB = append(out.FromB, [2]int{t.X, t.Y})
+            }
+            for _, t := range report.Lost {
+                out.Lost = append(out.Lost, [2]int{t.X, t.Y})
+            }
+            printJSON(out)
+        } else if report != nil {
+            for _, t := range report.FromB {
+                fmt.Printf("tile (%d, %d) restored from %s\n", t.X, t.Y, fset.Arg(2))
+            }
+            for _, t := range report.Lost {
+                fmt.Printf("tile (%d, %d) is corrupt in both copies\n", t.X, t.Y)
+            }
+        }
+        if err != nil && !errors.Is(err, nest.ErrChecksum) {
+            return err
+        }
+        if cerr := out.Commit(); cerr != nil {
+            return cerr
+        }
+        return err
+    }
+}
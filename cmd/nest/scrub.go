@@ -0,0 +1,64 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+)
+
+type scrubJSON struct {
+    File    string   `json:"file"`
+    Removed []string `json:"removed"`
+}
+
+func scrubFlags(fset *flag.FlagSet) func() error {
+    keep := fset.String("keep", "", "comma-separated metadata keys to keep")
+    keepAnnotations := fset.Bool("keep-annotations", false, "keep the annotation layer")
+    keepProvenance := fset.Bool("keep-provenance", false, "keep tile provenance")
+    keepHistory := fset.Bool("keep-history", false, "keep the audit log, edit history and tile update times")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 1 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        policy := nest.ScrubPolicy{
+            KeepAnnotations: *keepAnnotations,
+            KeepProvenance:  *keepProvenance,
+            KeepHistory:     *keepHistory,
+        }
+        if *keep != "" {
+            for _, k := range strings.Split(*keep, ",") {
+                policy.KeepMetadata = append(policy.KeepMetadata, strings.TrimSpace(k))
+            }
+        }
+        name := fset.Arg(0)
+        nif, err := nest.ReadNestedImageFile(name)
+        if err != nil {
+            return err
+        }
+        removed := nif.Scrub(policy)
+
+        opts := nest.WriteOptions{
+            TileOrder:   nif.Header.TileOrder,
+            TileStats:   nif.Index != nil && nif.Index.Stats != nil,
+            Adaptive:    nif.Index != nil && nif.Index.Classes != nil,
+            SearchIndex: nif.HasSearchIndex(),
+            Written:     nest.ScrubTime,
+        }
+        if err := nest.WriteNestedImageFileWithOptions(name, nif, opts); err != nil {
+            return err
+        }
+        if jsonOutput {
+            return printJSON(scrubJSON{name, removed})
+        }
+        for _, r := range removed {
+            fmt.Printf("%s: removed %s\n", name, r)
+        }
+        return nil
+    }
+}
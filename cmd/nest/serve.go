@@ -0,0 +1,114 @@
+package main
+
+import (
+    "crypto/subtle"
+    "flag"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+    "github.com/70ziko/NEST/tileserver"
+)
+
+// listenJSON announces where a command that serves a file is listening.
+type listenJSON struct {
+    File string `json:"file"`
+    URL  string `json:"url"`
+}
+
+func serveFlags(fset *flag.FlagSet) func() error {
+    addr := fset.String("addr", "localhost:8080", "address to listen on")
+    cacheMB := fset.Int64("cache-mb", tileserver.DefaultCacheBytes>>20, "megabytes of encoded responses to cache, 0 to disable")
+    cacheDir := fset.String("cache-dir", "", "directory to keep encoded responses in across restarts")
+    cors := fset.String("cors", "", "comma-separated origins allowed to read tiles, or * for any")
+    token := fset.String("token", "", "require \"Authorization: Bearer <token>\" on every request")
+    writable := fset.Bool("writable", false, "accept PUT uploads of tiles and nested images, saved to the file (needs --token)")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 1 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        if *writable && *token == "" {
+            return invalid(fmt.Errorf("--writable needs --token"))
+        }
+
+        var reader *nest.Reader
+        var editor *tileserver.Editor
+        if *writable {
+            var err error
+            if editor, err = tileserver.OpenEditor(fset.Arg(0), nest.WriteOptions{}); err != nil {
+                return err
+            }
+            defer editor.Close()
+            reader = editor.Reader()
+        } else {
+            file, err := os.Open(fset.Arg(0))
+            if err != nil {
+                return err
+            }
+            defer file.Close()
+            info, err := file.Stat()
+            if err != nil {
+                return err
+            }
+            if reader, err = nest.NewReader(file, info.Size()); err != nil {
+                return fmt.Errorf("%s: %w", fset.Arg(0), err)
+            }
+        }
+        info, err := os.Stat(fset.Arg(0))
+        if err != nil {
+            return err
+        }
+
+        cacheBytes := *cacheMB << 20
+        if cacheBytes == 0 {
+            cacheBytes = -1
+        }
+        opts := tileserver.Options{CacheBytes: cacheBytes, CacheDir: *cacheDir, ModTime: info.ModTime()}
+        if *cors != "" {
+            opts.CORS = &tileserver.CORS{AllowedOrigins: strings.Split(*cors, ","), AllowedHeaders: []string{"Authorization"}}
+        }
+        if *token != "" {
+            want := "Bearer " + *token
+            opts.Authorize = func(r *http.Request, _ nest.TileCoord) error {
+                if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+                    return tileserver.ErrUnauthenticated
+                }
+                return nil
+            }
+            if *writable {
+                opts.AuthorizeWrite = opts.Authorize
+                opts.AuthorizeNestedWrite = func(r *http.Request, _ int) error {
+                    return opts.Authorize(r, nest.TileCoord{})
+                }
+            }
+        }
+        var handler *tileserver.Handler
+        if editor != nil {
+            handler, err = tileserver.NewEditable(editor, opts)
+        } else {
+            handler, err = tileserver.New(reader, opts)
+        }
+        if err != nil {
+            return err
+        }
+        ln, err := net.Listen("tcp", *addr)
+        if err != nil {
+            return err
+        }
+        url := "http://" + ln.Addr().String() + "/"
+        if jsonOutput {
+            printJSON(listenJSON{File: fset.Arg(0), URL: url})
+        } else {
+            log.Printf("serving %s on %s", fset.Arg(0), url)
+        }
+        return http.Serve(ln, handler)
+    }
+}
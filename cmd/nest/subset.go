@@ -0,0 +1,59 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+)
+
+func subsetFlags(fset *flag.FlagSet) func() error {
+    nested := fset.String("nested", "", "comma-separated nested images to include, numbered from 1")
+    keep := fset.String("keep-metadata", "", "comma-separated metadata keys to include")
+    annotations := fset.Bool("annotations", false, "include the annotations lying wholly inside the region")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 3 {
+            fset.Usage()
+            os.Exit(2)
+        }
+        region, err := parseCrop(fset.Arg(1))
+        if err != nil {
+            return invalid(err)
+        }
+        var indices []uint32
+        if *nested != "" {
+            for _, s := range strings.Split(*nested, ",") {
+                n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+                if err != nil {
+                    return invalid(fmt.Errorf("nested image %q is not a number", s))
+                }
+                indices = append(indices, uint32(n))
+            }
+        }
+        opts := nest.SubsetOptions{Annotations: *annotations}
+        if *keep != "" {
+            for _, k := range strings.Split(*keep, ",") {
+                opts.MetadataKeys = append(opts.MetadataKeys, strings.TrimSpace(k))
+            }
+        }
+        nif, err := nest.ReadNestedImageFile(fset.Arg(0))
+        if err != nil {
+            return err
+        }
+        out, err := nif.ExportSubset(indices, region, opts)
+        if err != nil {
+            return invalid(err)
+        }
+        wopts := nest.WriteOptions{TileOrder: nif.Header.TileOrder, LinkCodec: nest.CodecRLE}
+        wopts.ApplyDefaults(defaults)
+        if err := nest.WriteNestedImageFileWithOptions(fset.Arg(2), out, wopts); err != nil {
+            return err
+        }
+        return printWritten(fset.Arg(2))
+    }
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+)
+
+type syncJSON struct {
+    File   string `json:"file"`
+    Merged int    `json:"merged"`
+}
+
+func syncFlags(fset *flag.FlagSet) func() error {
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 2 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        var files [2]*nest.NestedImageFile
+        for i, name := range fset.Args() {
+            nif, err := nest.ReadNestedImageFile(name)
+            if err != nil {
+                return fmt.Errorf("%s: %w", name, err)
+            }
+            if nif.Collab == nil {
+                return fmt.Errorf("%s has no shared edit history", name)
+            }
+            files[i] = nif
+        }
+        a, b := files[0], files[1]
+        toA := b.Collab.Since(a.Collab.Version())
+        toB := a.Collab.Since(b.Collab.Version())
+        for i, ops := range [][]nest.CollabOp{toA, toB} {
+            n, err := files[i].MergeOps(ops)
+            if err != nil {
+                return fmt.Errorf("%s: %w", fset.Arg(i), err)
+            }
+            if n > 0 {
+                if err := nest.WriteNestedImageFile(fset.Arg(i), files[i]); err != nil {
+                    return err
+                }
+            }
+            switch {
+            case jsonOutput:
+                printJSON(syncJSON{File: fset.Arg(i), Merged: n})
+            case n > 0:
+                fmt.Printf("%s: %d edits merged\n", fset.Arg(i), n)
+            }
+        }
+        return nil
+    }
+}
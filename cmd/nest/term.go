@@ -0,0 +1,48 @@
+//go:build !windows
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "strings"
+)
+
+func isTerminal(f *os.File) bool {
+    info, err := f.Stat()
+    return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func stty(args ...string) (string, error) {
+    cmd := exec.Command("stty", args...)
+    cmd.Stdin = os.Stdin
+    out, err := cmd.Output()
+    return strings.TrimSpace(string(out)), err
+}
+
+// terminalSize returns the columns and rows of the controlling terminal,
+// or 80x24 when they can't be determined.
+func terminalSize() (int, int) {
+    var rows, cols int
+    if out, err := stty("size"); err == nil {
+        fmt.Sscan(out, &rows, &cols)
+    }
+    if cols <= 0 || rows <= 0 {
+        return 80, 24
+    }
+    return cols, rows
+}
+
+// rawMode switches the terminal to unbuffered input without echo and returns
+// a function restoring the previous state.
+func rawMode() (func(), error) {
+    state, err := stty("-g")
+    if err != nil {
+        return nil, err
+    }
+    if _, err := stty("raw", "-echo"); err != nil {
+        return nil, err
+    }
+    return func() { stty(state) }, nil
+}
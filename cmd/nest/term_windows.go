@@ -0,0 +1,21 @@
+package main
+
+import (
+    "errors"
+    "os"
+)
+
+func isTerminal(f *os.File) bool {
+    info, err := f.Stat()
+    return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func terminalSize() (int, int) {
+    return 80, 24
+}
+
+// rawMode is not implemented on Windows, so nest view only prints the
+// preview there.
+func rawMode() (func(), error) {
+    return nil, errors.ErrUnsupported
+}
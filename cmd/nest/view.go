@@ -0,0 +1,231 @@
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "image"
+    "os"
+
+    nest "github.com/70ziko/NEST"
+    "github.com/70ziko/NEST/colorspace"
+)
+
+func viewFlags(fset *flag.FlagSet) func() error {
+    width := fset.Int("width", 0, "preview width in columns, 0 for the terminal width")
+    static := fset.Bool("static", false, "print the preview and exit instead of browsing with the arrow keys")
+    addJSONFlag(fset)
+
+    return func() error {
+        if fset.NArg() != 1 {
+            fset.Usage()
+            os.Exit(2)
+        }
+
+        file, err := os.Open(fset.Arg(0))
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        info, err := file.Stat()
+        if err != nil {
+            return err
+        }
+        reader, err := nest.NewReader(file, info.Size())
+        if err != nil {
+            return fmt.Errorf("%s: %w", fset.Arg(0), err)
+        }
+
+        cols, rows := terminalSize()
+        if *width > 0 {
+            cols = *width
+        }
+        preview, err := loadPreview(reader, cols, max(rows-2, 1)*2)
+        if err != nil {
+            return err
+        }
+
+        if jsonOutput {
+            return printJSON(newPreviewJSON(fset.Arg(0), preview))
+        }
+
+        v := &viewer{reader: reader, preview: preview, out: bufio.NewWriter(os.Stdout)}
+        if *static || !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+            v.draw(false)
+            return v.out.Flush()
+        }
+
+        restore, err := rawMode()
+        if err != nil {
+            v.draw(false)
+            return v.out.Flush()
+        }
+        defer restore()
+        return v.browse(os.Stdin)
+    }
+}
+
+// loadPreview returns the main image scaled to fit w x h pixels, starting
+// from the smallest stored overview that is still large enough.
+func loadPreview(reader *nest.Reader, w, h int) (*image.RGBA, error) {
+    bounds := reader.Bounds()
+    pw, ph := w, max(bounds.Dy()*w/bounds.Dx(), 1)
+    if ph > h {
+        pw, ph = max(bounds.Dx()*h/bounds.Dy(), 1), h
+    }
+
+    var img *image.RGBA
+    levels, err := reader.PyramidLevels()
+    if err != nil {
+        return nil, err
+    }
+    best := 0
+    for _, n := range levels {
+        l := reader.Grid().Level(n)
+        if n > best && l.Width >= pw && l.Height >= ph {
+            best = n
+        }
+    }
+    if best > 0 {
+        level, err := reader.ReadPyramidLevel(best)
+        if err != nil {
+            return nil, err
+        }
+        colorspace.ConvertPix(level.Data, reader.Header.ColorSpace, colorspace.SRGB)
+        img = level.ToImage()
+    } else if img, err = reader.ReadRegionImage(bounds); err != nil {
+        return nil, err
+    }
+    return nest.ResizeImage(img, pw, ph, nest.AreaFilter), nil
+}
+
+// previewJSON holds the preview's sRGB pixels as #rrggbb, row by row.
+type previewJSON struct {
+    File   string     `json:"file"`
+    Width  int        `json:"width"`
+    Height int        `json:"height"`
+    Pixels [][]string `json:"pixels"`
+}
+
+func newPreviewJSON(file string, preview *image.RGBA) previewJSON {
+    b := preview.Rect
+    out := previewJSON{File: file, Width: b.Dx(), Height: b.Dy(), Pixels: make([][]string, b.Dy())}
+    for y := range out.Pixels {
+        out.Pixels[y] = make([]string, b.Dx())
+        for x := range out.Pixels[y] {
+            c := preview.RGBAAt(b.Min.X+x, b.Min.Y+y)
+            out.Pixels[y][x] = fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+        }
+    }
+    return out
+}
+
+type viewer struct {
+    reader  *nest.Reader
+    preview *image.RGBA
+    out     *bufio.Writer
+    // cx, cy is the cursor in terminal cells; each cell shows two preview
+    // pixels stacked with a half block.
+    cx, cy int
+}
+
+func (v *viewer) cells() (int, int) {
+    return v.preview.Rect.Dx(), (v.preview.Rect.Dy() + 1) / 2
+}
+
+// imagePoint maps the cursor to main image coordinates.
+func (v *viewer) imagePoint() image.Point {
+    b := v.reader.Bounds()
+    return image.Pt(v.cx*b.Dx()/v.preview.Rect.Dx(), 2*v.cy*b.Dy()/v.preview.Rect.Dy())
+}
+
+func (v *viewer) draw(cursor bool) {
+    w, h := v.cells()
+    for cy := 0; cy < h; cy++ {
+        for cx := 0; cx < w; cx++ {
+            top := v.preview.RGBAAt(cx, 2*cy)
+            bottom := top
+            if 2*cy+1 < v.preview.Rect.Dy() {
+                bottom = v.preview.RGBAAt(cx, 2*cy+1)
+            }
+            if cursor && cx == v.cx && cy == v.cy {
+                fmt.Fprintf(v.out, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm+", 255-top.R, 255-top.G, 255-top.B, top.R, top.G, top.B)
+                continue
+            }
+            fmt.Fprintf(v.out, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+        }
+        v.out.WriteString("\x1b[0m\r\n")
+    }
+}
+
+func (v *viewer) status() string {
+    p := v.imagePoint()
+    region, err := v.reader.ReadRegion(image.Rectangle{Min: p, Max: p.Add(image.Pt(1, 1))})
+    if err != nil {
+        return err.Error()
+    }
+    px := region[0][0]
+    s := fmt.Sprintf("(%d, %d) rgb(%d, %d, %d) ", p.X, p.Y, px.R, px.G, px.B)
+    switch v.reader.Header.Payload {
+    case nest.PayloadLink:
+        if px.NestedIdx == 0 {
+            s += "no link"
+        } else {
+            s += fmt.Sprintf("link to nested image %d of %d", px.NestedIdx, v.reader.Header.NestedCount)
+        }
+    case nest.PayloadUint:
+        s += fmt.Sprintf("value %d", px.Uint())
+    case nest.PayloadInt:
+        s += fmt.Sprintf("value %d", px.Int())
+    case nest.PayloadFloat:
+        s += fmt.Sprintf("value %g", px.Float())
+    }
+    return s + "  [arrows move, q quits]"
+}
+
+func (v *viewer) browse(in *os.File) error {
+    keys := bufio.NewReader(in)
+    w, h := v.cells()
+    for {
+        v.out.WriteString("\x1b[H\x1b[2J")
+        v.draw(true)
+        v.out.WriteString(v.status() + "\x1b[K")
+        if err := v.out.Flush(); err != nil {
+            return err
+        }
+
+        b, err := keys.ReadByte()
+        if err != nil {
+            return err
+        }
+        switch b {
+        case 'q', 3, 4:
+            v.out.WriteString("\r\n")
+            return v.out.Flush()
+        case 'h':
+            v.cx--
+        case 'l':
+            v.cx++
+        case 'k':
+            v.cy--
+        case 'j':
+            v.cy++
+        case 0x1b:
+            if next, _ := keys.ReadByte(); next != '[' {
+                continue
+            }
+            switch code, _ := keys.ReadByte(); code {
+            case 'A':
+                v.cy--
+            case 'B':
+                v.cy++
+            case 'C':
+                v.cx++
+            case 'D':
+                v.cx--
+            }
+        }
+        v.cx = min(max(v.cx, 0), w-1)
+        v.cy = min(max(v.cy, 0), h-1)
+    }
+}
@@ -0,0 +1,486 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "image/jpeg"
+    "io"
+    "math"
+    "sync"
+)
+
+type TileCodec uint8
+
+const (
+    CodecRaw TileCodec = iota
+    CodecJPEG
+    CodecRLE
+    CodecZstd
+    CodecDelta
+)
+
+func (c TileCodec) String() string {
+    switch c {
+    case CodecRaw:
+        return "raw"
+    case CodecJPEG:
+        return "jpeg"
+    case CodecRLE:
+        return "rle"
+    case CodecZstd:
+        return "zstd"
+    case CodecDelta:
+        return "delta"
+    }
+    return fmt.Sprintf("TileCodec(%d)", uint8(c))
+}
+
+// Since version 5 every tile is stored as two planes, the RGB plane first and
+// the link plane second, each framed as
+//
+//	codec uint8 | length uint32 | payload
+//
+// Raw planes hold the samples row by row: 3 bytes per pixel for RGB and
+// LinkBits/8 bytes of NestedIdx per pixel for links (4 bytes before version
+// 6). RLE link planes hold (run length, NestedIdx) pairs as uvarints covering
+// the same samples, and RLE RGB planes, written for flat and line-art tiles
+// by WriteOptions.Adaptive, hold (run length, 0xRRGGBB) pairs the same way.
+// Zstd planes, written with WriteOptions.Dictionary, hold the raw samples as
+// a zstd frame compressed against the file's dictionary. Delta planes, written with
+// WriteOptions.Predict, are described with their predictor in predict.go.
+const planeHeaderSize = 5
+
+type tileCodec struct {
+    order     binary.ByteOrder
+    tileSize  int
+    quality   int
+    linkCodec TileCodec
+    linkBytes int
+    signed    bool
+    // adaptive picks the RGB codec of each tile by its TileClass.
+    adaptive bool
+    // predict tries CodecDelta for lossless RGB planes.
+    predict bool
+    // sampler, when set, stands in for most tiles with placeholders.
+    sampler *sizeSampler
+    // dict is the dictionary of zstd planes, and dictID the ID the header
+    // records, which is set without dict when a shared dictionary isn't
+    // registered.
+    dict   *Dictionary
+    dictID uint32
+    // deflaters pools the flate writers of delta planes.
+    deflaters *sync.Pool
+}
+
+// fingerprint identifies the settings that affect encoded output, so cached
+// encodings are only reused under the same settings.
+func (tc *tileCodec) fingerprint() []byte {
+    fp := []byte{orderTag(tc.order), byte(tc.quality), byte(tc.linkCodec), byte(tc.linkBytes), 0, 0}
+    if tc.signed {
+        fp[4] = 1
+    }
+    if tc.adaptive {
+        fp[5] = 1
+    }
+    if tc.predict {
+        fp[5] |= 2
+    }
+    if tc.dictID != 0 {
+        fp = binary.BigEndian.AppendUint32(fp, tc.dictID)
+    }
+    return fp
+}
+
+// encode encodes a main image tile. class only matters to adaptive codecs,
+// and pred, the tiles it may be predicted from, to predicting ones.
+func (tc *tileCodec) encode(tile []PixeLink, class TileClass, pred *prediction) ([]byte, error) {
+    for _, p := range tile {
+        if !tc.fits(p.NestedIdx) {
+            if tc.signed {
+                return nil, fmt.Errorf("payload %d does not fit in %d bits", int32(p.NestedIdx), 8*tc.linkBytes)
+            }
+            return nil, fmt.Errorf("payload %d does not fit in %d bits", p.NestedIdx, 8*tc.linkBytes)
+        }
+    }
+
+    var buf bytes.Buffer
+    if err := tc.encodeRGB(&buf, tile, class, pred); err != nil {
+        return nil, err
+    }
+
+    links := make([]byte, len(tile)*tc.linkBytes)
+    for i, p := range tile {
+        tc.putLink(links[i*tc.linkBytes:], p.NestedIdx)
+    }
+    codec, plane := CodecRaw, links
+    if tc.linkCodec == CodecRLE {
+        if runs := encodeRLE(tile); len(runs) < len(plane) {
+            codec, plane = CodecRLE, runs
+        }
+    }
+    if tc.dict != nil && len(links) > 0 {
+        d, err := tc.compress(links)
+        if err != nil {
+            return nil, err
+        }
+        if len(d) < len(plane) {
+            codec, plane = CodecZstd, d
+        }
+    }
+    tc.writePlane(&buf, codec, plane)
+    return buf.Bytes(), nil
+}
+
+// encodeRGB writes the RGB plane of tile, as JPEG when a quality is set.
+// Adaptive codecs run-length encode blank and line-art tiles instead, and
+// keep line art lossless. Lossless planes are compressed against the
+// dictionary, or predicted from pred when the codec predicts, whenever that
+// is smaller.
+func (tc *tileCodec) encodeRGB(buf *bytes.Buffer, tile []PixeLink, class TileClass, pred *prediction) error {
+    lossless := false
+    if tc.adaptive && (class == ClassBlank || class == ClassLineArt) {
+        runs := appendRuns(nil, len(tile), func(i int) uint32 {
+            return uint32(tile[i].R)<<16 | uint32(tile[i].G)<<8 | uint32(tile[i].B)
+        })
+        if len(runs) < len(tile)*3 {
+            tc.writePlane(buf, CodecRLE, runs)
+            return nil
+        }
+        lossless = class == ClassLineArt
+    }
+    if tc.quality > 0 && !lossless {
+        rgb, err := encodeJPEGPlane(tile, tc.tileSize, tc.quality)
+        if err != nil {
+            return err
+        }
+        tc.writePlane(buf, CodecJPEG, rgb)
+        return nil
+    }
+    rgb := make([]byte, len(tile)*3)
+    for i, p := range tile {
+        rgb[i*3], rgb[i*3+1], rgb[i*3+2] = p.R, p.G, p.B
+    }
+    codec, plane := CodecRaw, rgb
+    if tc.dict != nil {
+        d, err := tc.compress(rgb)
+        if err != nil {
+            return err
+        }
+        if len(d) < len(plane) {
+            codec, plane = CodecZstd, d
+        }
+    }
+    if tc.predict && pred != nil {
+        if d := tc.encodeDelta(tile, pred); len(d) < len(plane) {
+            codec, plane = CodecDelta, d
+        }
+    }
+    tc.writePlane(buf, codec, plane)
+    return nil
+}
+
+func (tc *tileCodec) fits(v uint32) bool {
+    bits := 8 * tc.linkBytes
+    if bits == 32 {
+        return true
+    }
+    if tc.signed {
+        n := int64(int32(v))
+        return n >= -1<<(bits-1) && n < 1<<(bits-1)
+    }
+    return uint64(v) < 1<<bits
+}
+
+func (tc *tileCodec) putLink(b []byte, v uint32) {
+    switch tc.linkBytes {
+    case 1:
+        b[0] = byte(v)
+    case 2:
+        tc.order.PutUint16(b, uint16(v))
+    case 4:
+        tc.order.PutUint32(b, v)
+    }
+}
+
+func (tc *tileCodec) link(b []byte) uint32 {
+    switch tc.linkBytes {
+    case 1:
+        if tc.signed {
+            return uint32(int8(b[0]))
+        }
+        return uint32(b[0])
+    case 2:
+        if tc.signed {
+            return uint32(int16(tc.order.Uint16(b)))
+        }
+        return uint32(tc.order.Uint16(b))
+    case 4:
+        return tc.order.Uint32(b)
+    }
+    return 0
+}
+
+func encodeRLE(tile []PixeLink) []byte {
+    return appendRuns(nil, len(tile), func(i int) uint32 { return tile[i].NestedIdx })
+}
+
+func decodeRLE(data []byte, dst []PixeLink) error {
+    return decodeRuns(data, len(dst), func(i int, v uint32) { dst[i].NestedIdx = v })
+}
+
+// appendRuns run-length encodes the n values returned by value as uvarint
+// (run length, value) pairs.
+func appendRuns(buf []byte, n int, value func(i int) uint32) []byte {
+    for i := 0; i < n; {
+        v := value(i)
+        run := 1
+        for i+run < n && value(i+run) == v {
+            run++
+        }
+        buf = binary.AppendUvarint(buf, uint64(run))
+        buf = binary.AppendUvarint(buf, uint64(v))
+        i += run
+    }
+    return buf
+}
+
+// decodeRuns expands runs produced by appendRuns, which must cover exactly n
+// values.
+func decodeRuns(data []byte, n int, set func(i int, v uint32)) error {
+    i := 0
+    for len(data) > 0 {
+        run, k := binary.Uvarint(data)
+        if k <= 0 {
+            return fmt.Errorf("corrupt RLE run length")
+        }
+        data = data[k:]
+        value, k := binary.Uvarint(data)
+        if k <= 0 || value > math.MaxUint32 {
+            return fmt.Errorf("corrupt RLE value")
+        }
+        data = data[k:]
+        if run > uint64(n-i) {
+            return fmt.Errorf("RLE runs cover more than %d values", n)
+        }
+        for end := i + int(run); i < end; i++ {
+            set(i, uint32(value))
+        }
+    }
+    if i != n {
+        return fmt.Errorf("RLE runs cover %d of %d values", i, n)
+    }
+    return nil
+}
+
+func (tc *tileCodec) writePlane(buf *bytes.Buffer, codec TileCodec, payload []byte) {
+    var hdr [planeHeaderSize]byte
+    hdr[0] = byte(codec)
+    tc.order.PutUint32(hdr[1:], uint32(len(payload)))
+    buf.Write(hdr[:])
+    buf.Write(payload)
+}
+
+// maxPlaneSize bounds plane payloads so a corrupt length cannot force a huge
+// allocation. Encoded planes are never much larger than raw ones.
+func (tc *tileCodec) maxPlaneSize() int {
+    return tc.tileSize*tc.tileSize*8 + 4096
+}
+
+func (tc *tileCodec) readPlane(reader io.Reader) (TileCodec, []byte, error) {
+    var hdr [planeHeaderSize]byte
+    if _, err := io.ReadFull(reader, hdr[:]); err != nil {
+        return 0, nil, err
+    }
+    length := tc.order.Uint32(hdr[1:])
+    if int64(length) > int64(tc.maxPlaneSize()) {
+        return 0, nil, fmt.Errorf("plane of %d bytes exceeds the %d byte limit", length, tc.maxPlaneSize())
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(reader, payload); err != nil {
+        return 0, nil, err
+    }
+    return TileCodec(hdr[0]), payload, nil
+}
+
+// decode decodes a main image tile. src supplies the tiles a predicted
+// tile depends on; it may be nil when there are none.
+func (tc *tileCodec) decode(reader io.Reader, dst []PixeLink, src predictionSource) error {
+    if err := tc.decodeRGB(reader, dst, src); err != nil {
+        return err
+    }
+
+    codec, links, err := tc.readPlane(reader)
+    if err != nil {
+        return fmt.Errorf("failed to read link plane: %w", err)
+    }
+    switch codec {
+    case CodecRaw:
+        if len(links) != len(dst)*tc.linkBytes {
+            return fmt.Errorf("raw link plane is %d bytes, want %d", len(links), len(dst)*tc.linkBytes)
+        }
+        for i := range dst {
+            dst[i].NestedIdx = tc.link(links[i*tc.linkBytes:])
+        }
+    case CodecRLE:
+        if err := decodeRLE(links, dst); err != nil {
+            return err
+        }
+    case CodecZstd:
+        raw, err := tc.decompress(links, len(dst)*tc.linkBytes)
+        if err != nil {
+            return err
+        }
+        for i := range dst {
+            dst[i].NestedIdx = tc.link(raw[i*tc.linkBytes:])
+        }
+    default:
+        return fmt.Errorf("unsupported link codec %s", codec)
+    }
+    return nil
+}
+
+func (tc *tileCodec) decodeRGB(reader io.Reader, dst []PixeLink, src predictionSource) error {
+    codec, rgb, err := tc.readPlane(reader)
+    if err != nil {
+        return fmt.Errorf("failed to read RGB plane: %w", err)
+    }
+    switch codec {
+    case CodecRaw:
+        if len(rgb) != len(dst)*3 {
+            return fmt.Errorf("raw RGB plane is %d bytes, want %d", len(rgb), len(dst)*3)
+        }
+        for i := range dst {
+            dst[i].R, dst[i].G, dst[i].B = rgb[i*3], rgb[i*3+1], rgb[i*3+2]
+        }
+    case CodecJPEG:
+        if err := decodeJPEGPlane(rgb, tc.tileSize, dst); err != nil {
+            return err
+        }
+    case CodecRLE:
+        err := decodeRuns(rgb, len(dst), func(i int, v uint32) {
+            dst[i].R, dst[i].G, dst[i].B = uint8(v>>16), uint8(v>>8), uint8(v)
+        })
+        if err != nil {
+            return err
+        }
+    case CodecZstd:
+        raw, err := tc.decompress(rgb, len(dst)*3)
+        if err != nil {
+            return err
+        }
+        for i := range dst {
+            dst[i].R, dst[i].G, dst[i].B = raw[i*3], raw[i*3+1], raw[i*3+2]
+        }
+    case CodecDelta:
+        if err := tc.decodeDelta(rgb, dst, src); err != nil {
+            return err
+        }
+    default:
+        return fmt.Errorf("unsupported RGB codec %s", codec)
+    }
+    return nil
+}
+
+func encodeJPEGPlane(tile []PixeLink, tileSize, quality int) ([]byte, error) {
+    img := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+    for i, p := range tile {
+        img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = p.R, p.G, p.B, 0xff
+    }
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+        return nil, fmt.Errorf("failed to encode JPEG plane: %w", err)
+    }
+    return buf.Bytes(), nil
+}
+
+func decodeJPEGPlane(data []byte, tileSize int, dst []PixeLink) error {
+    img, err := jpeg.Decode(bytes.NewReader(data))
+    if err != nil {
+        return fmt.Errorf("failed to decode JPEG plane: %w", err)
+    }
+    b := img.Bounds()
+    if b.Dx() != tileSize || b.Dy() != tileSize {
+        return fmt.Errorf("JPEG plane is %dx%d, want %dx%d", b.Dx(), b.Dy(), tileSize, tileSize)
+    }
+    for y := 0; y < tileSize; y++ {
+        for x := 0; x < tileSize; x++ {
+            r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+            p := &dst[y*tileSize+x]
+            p.R, p.G, p.B = byte(r>>8), byte(g>>8), byte(bl>>8)
+        }
+    }
+    return nil
+}
+
+// encodeInOrder runs encode for items 0..n-1 on up to workers goroutines and
+// hands the results to emit strictly in order. Without a spiller, a worker
+// waits for its result to be emitted before taking the next item; with one,
+// workers run ahead of a slow emit and the results waiting for their turn
+// spill to disk past the spiller's threshold.
+func encodeInOrder(n, workers int, sp *spiller, encode func(i int) ([]byte, error), emit func(i int, data []byte) error) error {
+    if workers <= 1 {
+        for i := 0; i < n; i++ {
+            data, err := encode(i)
+            if err != nil {
+                return err
+            }
+            if err := emit(i, data); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+
+    type result struct {
+        data spilled
+        err  error
+    }
+    results := make([]chan result, n)
+    for i := range results {
+        results[i] = make(chan result, 1)
+    }
+    slots := make(chan struct{}, workers)
+    done := make(chan struct{})
+    defer close(done)
+
+    go func() {
+        for i := 0; i < n; i++ {
+            select {
+            case slots <- struct{}{}:
+            case <-done:
+                return
+            }
+            go func(i int) {
+                data, err := encode(i)
+                var held spilled
+                if err == nil {
+                    held, err = sp.put(data)
+                }
+                if sp != nil {
+                    <-slots
+                }
+                results[i] <- result{held, err}
+            }(i)
+        }
+    }()
+
+    for i := 0; i < n; i++ {
+        r := <-results[i]
+        if sp == nil {
+            <-slots
+        }
+        if r.err != nil {
+            return r.err
+        }
+        data, err := sp.take(r.data)
+        if err != nil {
+            return err
+        }
+        if err := emit(i, data); err != nil {
+            return err
+        }
+    }
+    return nil
+}
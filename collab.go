@@ -0,0 +1,370 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "slices"
+    "strings"
+)
+
+// CollabKind is the kind of a shared edit.
+type CollabKind uint8
+
+const (
+    CollabLinks CollabKind = iota
+    CollabAnnotate
+    CollabDelete
+)
+
+func (k CollabKind) String() string {
+    switch k {
+    case CollabLinks:
+        return "links"
+    case CollabAnnotate:
+        return "annotate"
+    case CollabDelete:
+        return "delete"
+    }
+    return "unknown"
+}
+
+func ParseCollabKind(s string) (CollabKind, error) {
+    for _, k := range []CollabKind{CollabLinks, CollabAnnotate, CollabDelete} {
+        if k.String() == s {
+            return k, nil
+        }
+    }
+    return CollabLinks, fmt.Errorf("unknown edit kind %q", s)
+}
+
+// Stamp orders edits across replicas: by Lamport time, then by replica name.
+type Stamp struct {
+    Time    uint64
+    Replica string
+}
+
+func (s Stamp) Compare(o Stamp) int {
+    if s.Time != o.Time {
+        if s.Time < o.Time {
+            return -1
+        }
+        return 1
+    }
+    return strings.Compare(s.Replica, o.Replica)
+}
+
+// CollabOp is one shared edit. CollabLinks sets every link of Channel
+// inside Rect to Link; CollabAnnotate puts the annotation ID with Rect and
+// Text; CollabDelete removes annotation ID.
+type CollabOp struct {
+    Stamp Stamp
+    Kind  CollabKind
+    // Channel names a link channel, or is empty for the main image's links.
+    Channel string
+    Rect    image.Rectangle
+    Link    uint32
+    ID      string
+    Text    string
+}
+
+// VersionVector holds the newest Lamport time seen from each replica.
+type VersionVector map[string]uint64
+
+// Collab lets several annotators edit the links and annotations of copies
+// of one document offline and merge their work. It is a last-writer-wins
+// CRDT: every link pixel and annotation takes the value of the newest edit
+// touching it, so replicas that have seen the same edits agree whatever
+// order they arrived in. Pixels and nested images are not shared.
+//
+// Two replicas sync by exchanging version vectors: each sends Version, the
+// other answers with Since, and each applies what it receives with
+// NestedImageFile.MergeOps. Edits are plain values and travel well as JSON.
+type Collab struct {
+    // Replica names this copy. Every annotator needs a distinct name.
+    Replica string
+
+    clock uint64
+    // ops is every edit seen, sorted by Stamp.
+    ops []CollabOp
+}
+
+// Collaborate starts sharing edits made as replica, keeping any history the
+// file already has. Only EditLinks, Annotate and RemoveAnnotation are
+// shared; links written any other way are not, and merges may overwrite
+// them.
+func (nif *NestedImageFile) Collaborate(replica string) *Collab {
+    if nif.Collab == nil {
+        nif.Collab = &Collab{}
+    }
+    nif.Collab.Replica = replica
+    return nif.Collab
+}
+
+// Version summarizes the edits this replica has seen.
+func (c *Collab) Version() VersionVector {
+    v := VersionVector{}
+    for _, op := range c.ops {
+        v[op.Stamp.Replica] = max(v[op.Stamp.Replica], op.Stamp.Time)
+    }
+    return v
+}
+
+// Since returns the edits a replica at version v has not seen, oldest
+// first.
+func (c *Collab) Since(v VersionVector) []CollabOp {
+    var out []CollabOp
+    for _, op := range c.ops {
+        if t, ok := v[op.Stamp.Replica]; !ok || op.Stamp.Time > t {
+            out = append(out, op)
+        }
+    }
+    return out
+}
+
+// Ops returns every edit seen, oldest first.
+func (c *Collab) Ops() []CollabOp {
+    return c.ops
+}
+
+func (c *Collab) find(s Stamp) (int, bool) {
+    return slices.BinarySearchFunc(c.ops, s, func(op CollabOp, s Stamp) int {
+        return op.Stamp.Compare(s)
+    })
+}
+
+// record stamps a local edit, which is newer than every edit seen.
+func (nif *NestedImageFile) record(op CollabOp) {
+    c := nif.Collab
+    if c == nil {
+        return
+    }
+    c.clock++
+    op.Stamp = Stamp{Time: c.clock, Replica: c.Replica}
+    c.ops = append(c.ops, op)
+}
+
+// EditLinks sets the links of channel inside rect to idx, where an empty
+// channel means the main image's links.
+func (nif *NestedImageFile) EditLinks(channel string, rect image.Rectangle, idx uint32) error {
+    if int(idx) > len(nif.NestedImages) {
+        return fmt.Errorf("link %d is out of range, the file has %d nested images", idx, len(nif.NestedImages))
+    }
+    if channel != "" && nif.LinkChannel(channel) == nil {
+        return fmt.Errorf("file has no link channel %q", channel)
+    }
+    op := CollabOp{Kind: CollabLinks, Channel: channel, Rect: rect.Intersect(nif.Bounds()), Link: idx}
+    nif.setLinks(op, nil)
+    nif.record(op)
+    nif.audit(AuditSetPixels, fmt.Sprintf("links of %q set to %d", channel, idx), op.Rect)
+    return nil
+}
+
+// setLinks applies a CollabLinks edit to the pixels none of later covers.
+func (nif *NestedImageFile) setLinks(op CollabOp, later []image.Rectangle) {
+    var lc *LinkChannel
+    if op.Channel != "" {
+        if lc = nif.LinkChannel(op.Channel); lc == nil {
+            lc, _ = nif.AddLinkChannel(op.Channel)
+        }
+    }
+    r := op.Rect.Intersect(nif.Bounds())
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+    pixels:
+        for x := r.Min.X; x < r.Max.X; x++ {
+            for _, l := range later {
+                if (image.Point{x, y}).In(l) {
+                    continue pixels
+                }
+            }
+            if lc != nil {
+                lc.Set(x, y, op.Link)
+            } else {
+                nif.MainImage[y][x].NestedIdx = op.Link
+            }
+        }
+    }
+}
+
+// MergeOps applies edits from another replica and returns how many were
+// new. Edits already seen are skipped, so syncing twice is harmless.
+func (nif *NestedImageFile) MergeOps(ops []CollabOp) (int, error) {
+    c := nif.Collab
+    if c == nil {
+        return 0, fmt.Errorf("file is not shared; call Collaborate first")
+    }
+    ops = slices.Clone(ops)
+    slices.SortFunc(ops, func(a, b CollabOp) int {
+        return a.Stamp.Compare(b.Stamp)
+    })
+    merged := 0
+    for _, op := range ops {
+        if op.Stamp.Replica == "" || op.Kind > CollabDelete {
+            return merged, fmt.Errorf("invalid edit %+v", op)
+        }
+        i, seen := c.find(op.Stamp)
+        if seen {
+            continue
+        }
+        newer := c.ops[i:]
+        switch op.Kind {
+        case CollabLinks:
+            var later []image.Rectangle
+            for _, o := range newer {
+                if o.Kind == CollabLinks && o.Channel == op.Channel && o.Rect.Overlaps(op.Rect) {
+                    later = append(later, o.Rect)
+                }
+            }
+            nif.setLinks(op, later)
+        case CollabAnnotate, CollabDelete:
+            superseded := slices.ContainsFunc(newer, func(o CollabOp) bool {
+                return o.Kind != CollabLinks && o.ID == op.ID
+            })
+            if superseded {
+                break
+            }
+            if op.Kind == CollabAnnotate {
+                nif.putAnnotation(Annotation{ID: op.ID, Rect: op.Rect, Text: op.Text})
+            } else {
+                nif.deleteAnnotation(op.ID)
+            }
+        }
+        c.ops = slices.Insert(c.ops, i, op)
+        c.clock = max(c.clock, op.Stamp.Time)
+        merged++
+    }
+    if merged > 0 {
+        nif.audit(AuditMergeEdits, fmt.Sprintf("%d edits merged", merged))
+    }
+    return merged, nil
+}
+
+// Merge pulls the edits of other, another copy of the document, into nif.
+func (nif *NestedImageFile) Merge(other *NestedImageFile) (int, error) {
+    if nif.Collab == nil || other.Collab == nil {
+        return 0, fmt.Errorf("both files must be shared; call Collaborate first")
+    }
+    return nif.MergeOps(other.Collab.Since(nif.Collab.Version()))
+}
+
+// The edit history is stored in a CRDT chunk:
+//
+//	replica length uint16 | replica | clock uint64 | count uint32 | ops
+//
+// Each op is
+//
+//	time uint64 | replica length uint16 | replica | kind uint8 |
+//	channel length uint16 | channel | rect 4 * int32 | link uint32 |
+//	ID length uint16 | ID | text length uint32 | text
+func (c *Collab) chunk(order binary.ByteOrder) (*Chunk, error) {
+    var buf bytes.Buffer
+    writeString := func(s string) {
+        binary.Write(&buf, order, uint16(len(s)))
+        buf.WriteString(s)
+    }
+    if len(c.Replica) > math.MaxUint16 {
+        return nil, fmt.Errorf("replica name is %d bytes, the limit is %d", len(c.Replica), math.MaxUint16)
+    }
+    writeString(c.Replica)
+    binary.Write(&buf, order, c.clock)
+    binary.Write(&buf, order, uint32(len(c.ops)))
+    for _, op := range c.ops {
+        if len(op.Stamp.Replica) > math.MaxUint16 || len(op.Channel) > math.MaxUint16 || len(op.ID) > math.MaxUint16 || len(op.Text) > math.MaxUint32 {
+            return nil, fmt.Errorf("edit %d by %q has a field too long to store", op.Stamp.Time, op.Stamp.Replica)
+        }
+        binary.Write(&buf, order, op.Stamp.Time)
+        writeString(op.Stamp.Replica)
+        buf.WriteByte(byte(op.Kind))
+        writeString(op.Channel)
+        binary.Write(&buf, order, [4]int32{int32(op.Rect.Min.X), int32(op.Rect.Min.Y), int32(op.Rect.Max.X), int32(op.Rect.Max.Y)})
+        binary.Write(&buf, order, op.Link)
+        writeString(op.ID)
+        binary.Write(&buf, order, uint32(len(op.Text)))
+        buf.WriteString(op.Text)
+    }
+    return &Chunk{Type: ChunkCollab, Data: buf.Bytes()}, nil
+}
+
+func decodeCollab(reader io.Reader, order binary.ByteOrder, length uint64) (*Collab, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkCollab, err)
+    }
+    r := bytes.NewReader(data)
+    fail := func(err error) (*Collab, error) {
+        return nil, fmt.Errorf("failed to decode %s chunk: %w", ChunkCollab, err)
+    }
+    readString := func() (string, error) {
+        var n uint16
+        if err := binary.Read(r, order, &n); err != nil {
+            return "", err
+        }
+        b := make([]byte, n)
+        _, err := io.ReadFull(r, b)
+        return string(b), err
+    }
+
+    c := &Collab{}
+    var err error
+    if c.Replica, err = readString(); err != nil {
+        return fail(err)
+    }
+    var count uint32
+    if err := binary.Read(r, order, &c.clock); err != nil {
+        return fail(err)
+    }
+    if err := binary.Read(r, order, &count); err != nil {
+        return fail(err)
+    }
+    if int64(count)*39 > int64(r.Len()) {
+        return fail(fmt.Errorf("%d edits do not fit in %d bytes", count, r.Len()))
+    }
+    c.ops = make([]CollabOp, count)
+    for i := range c.ops {
+        op := &c.ops[i]
+        if err := binary.Read(r, order, &op.Stamp.Time); err != nil {
+            return fail(err)
+        }
+        if op.Stamp.Replica, err = readString(); err != nil {
+            return fail(err)
+        }
+        kind, err := r.ReadByte()
+        if err != nil {
+            return fail(err)
+        }
+        op.Kind = CollabKind(kind)
+        if op.Channel, err = readString(); err != nil {
+            return fail(err)
+        }
+        var rect [4]int32
+        if err := binary.Read(r, order, &rect); err != nil {
+            return fail(err)
+        }
+        op.Rect = image.Rect(int(rect[0]), int(rect[1]), int(rect[2]), int(rect[3]))
+        if err := binary.Read(r, order, &op.Link); err != nil {
+            return fail(err)
+        }
+        if op.ID, err = readString(); err != nil {
+            return fail(err)
+        }
+        var tn uint32
+        if err := binary.Read(r, order, &tn); err != nil {
+            return fail(err)
+        }
+        if int64(tn) > int64(r.Len()) {
+            return fail(fmt.Errorf("edit text of %d bytes is truncated", tn))
+        }
+        text := make([]byte, tn)
+        if _, err := io.ReadFull(r, text); err != nil {
+            return fail(err)
+        }
+        op.Text = string(text)
+        if i > 0 && c.ops[i-1].Stamp.Compare(op.Stamp) >= 0 {
+            return fail(fmt.Errorf("edits are out of order"))
+        }
+    }
+    return c, nil
+}
@@ -0,0 +1,28 @@
+package nest
+
+import "image/color"
+
+// PixeLinkColor is a PixeLink as a color.Color, so generic image code can
+// carry links along with colors. It is always opaque.
+//
+// Converting it to any other color type drops the link. Converting another
+// color to it with PixeLinkModel gives a zero NestedIdx and composites
+// translucent colors over black.
+type PixeLinkColor PixeLink
+
+func (c PixeLinkColor) RGBA() (r, g, b, a uint32) {
+    r, g, b = uint32(c.R), uint32(c.G), uint32(c.B)
+    return r | r<<8, g | g<<8, b | b<<8, 0xffff
+}
+
+// PixeLinkModel converts colors to PixeLinkColor, keeping the link of values
+// that already are one.
+var PixeLinkModel color.Model = color.ModelFunc(pixeLinkModel)
+
+func pixeLinkModel(c color.Color) color.Color {
+    if p, ok := c.(PixeLinkColor); ok {
+        return p
+    }
+    r, g, b, _ := c.RGBA()
+    return PixeLinkColor{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8)}
+}
@@ -0,0 +1,124 @@
+// Package colorspace converts RGB samples between sRGB, linear light and
+// YCbCr so NEST images can be stored and processed in the space that suits
+// the pipeline.
+package colorspace
+
+import (
+    "fmt"
+    "image/color"
+    "math"
+)
+
+type Space uint8
+
+const (
+    SRGB Space = iota
+    Linear
+    YCbCr
+)
+
+func (s Space) String() string {
+    switch s {
+    case SRGB:
+        return "srgb"
+    case Linear:
+        return "linear"
+    case YCbCr:
+        return "ycbcr"
+    }
+    return fmt.Sprintf("Space(%d)", uint8(s))
+}
+
+func Parse(name string) (Space, error) {
+    for _, s := range []Space{SRGB, Linear, YCbCr} {
+        if s.String() == name {
+            return s, nil
+        }
+    }
+    return SRGB, fmt.Errorf("unknown color space %q", name)
+}
+
+func (s Space) MarshalText() ([]byte, error) {
+    return []byte(s.String()), nil
+}
+
+func (s *Space) UnmarshalText(text []byte) error {
+    v, err := Parse(string(text))
+    if err != nil {
+        return err
+    }
+    *s = v
+    return nil
+}
+
+// SRGBToLinear applies the inverse sRGB transfer function to a value in [0, 1].
+func SRGBToLinear(v float64) float64 {
+    if v <= 0.04045 {
+        return v / 12.92
+    }
+    return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// LinearToSRGB applies the sRGB transfer function to a value in [0, 1].
+func LinearToSRGB(v float64) float64 {
+    if v <= 0.0031308 {
+        return v * 12.92
+    }
+    return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+var toLinear8, toSRGB8 [256]byte
+var toSRGB16 [256]uint16
+
+func init() {
+    for i := range toLinear8 {
+        v := float64(i) / 255
+        toLinear8[i] = byte(math.Round(SRGBToLinear(v) * 255))
+        toSRGB8[i] = byte(math.Round(LinearToSRGB(v) * 255))
+        toSRGB16[i] = uint16(math.Round(LinearToSRGB(v) * 0xffff))
+    }
+}
+
+func ToLinear8(v byte) byte {
+    return toLinear8[v]
+}
+
+func ToSRGB8(v byte) byte {
+    return toSRGB8[v]
+}
+
+// ToSRGB16 converts a linear 8-bit value to sRGB at 16 bits, keeping the
+// precision ToSRGB8 rounds away in the shadows.
+func ToSRGB16(v byte) uint16 {
+    return toSRGB16[v]
+}
+
+// Convert8 converts one 8-bit RGB triple from one space to another.
+func Convert8(r, g, b byte, from, to Space) (byte, byte, byte) {
+    if from == to {
+        return r, g, b
+    }
+    switch from {
+    case Linear:
+        r, g, b = toSRGB8[r], toSRGB8[g], toSRGB8[b]
+    case YCbCr:
+        r, g, b = color.YCbCrToRGB(r, g, b)
+    }
+    switch to {
+    case Linear:
+        r, g, b = toLinear8[r], toLinear8[g], toLinear8[b]
+    case YCbCr:
+        r, g, b = color.RGBToYCbCr(r, g, b)
+    }
+    return r, g, b
+}
+
+// ConvertPix converts interleaved RGB triples in place.
+func ConvertPix(pix []byte, from, to Space) {
+    if from == to {
+        return
+    }
+    for i := 0; i+2 < len(pix); i += 3 {
+        pix[i], pix[i+1], pix[i+2] = Convert8(pix[i], pix[i+1], pix[i+2], from, to)
+    }
+}
@@ -0,0 +1,125 @@
+package nest
+
+import (
+    "fmt"
+    "math"
+)
+
+// TileQuality holds the difference between two files over one tile of the
+// first file's grid.
+type TileQuality struct {
+    Tile TileCoord
+    MSE  float64
+    // PSNR in decibels, +Inf when the tile is identical.
+    PSNR float64
+    SSIM float64
+}
+
+// QualityReport compares the colors of two main images. MSE and PSNR are
+// over the R, G and B samples; SSIM is the mean over 8x8 windows of luma.
+type QualityReport struct {
+    MSE   float64
+    PSNR  float64
+    SSIM  float64
+    Tiles []TileQuality
+}
+
+const ssimWindow = 8
+
+var (
+    ssimC1 = math.Pow(0.01*255, 2)
+    ssimC2 = math.Pow(0.03*255, 2)
+)
+
+// Compare measures how far b is from a, typically a lossy re-encode of it.
+// Both files must have the same dimensions and color space; links are
+// ignored.
+func Compare(a, b *NestedImageFile) (QualityReport, error) {
+    var report QualityReport
+    if a.Header.Width != b.Header.Width || a.Header.Height != b.Header.Height {
+        return report, fmt.Errorf("cannot compare a %dx%d image with a %dx%d one", a.Header.Width, a.Header.Height, b.Header.Width, b.Header.Height)
+    }
+    if a.Header.ColorSpace != b.Header.ColorSpace {
+        return report, fmt.Errorf("cannot compare %s samples with %s ones", a.Header.ColorSpace, b.Header.ColorSpace)
+    }
+
+    grid := a.grid()
+    var sqErr, ssimSum float64
+    var samples, windows int
+    for ty := 0; ty < grid.Rows(); ty++ {
+        for tx := 0; tx < grid.Cols(); tx++ {
+            r := grid.TileBounds(tx, ty)
+            var tileErr, tileSSIM float64
+            var tileWindows int
+            for wy := r.Min.Y; wy < r.Max.Y; wy += ssimWindow {
+                for wx := r.Min.X; wx < r.Max.X; wx += ssimWindow {
+                    se, s := windowQuality(a, b, wx, wy, min(wx+ssimWindow, r.Max.X), min(wy+ssimWindow, r.Max.Y))
+                    tileErr += se
+                    tileSSIM += s
+                    tileWindows++
+                }
+            }
+            n := r.Dx() * r.Dy() * 3
+            mse := tileErr / float64(n)
+            report.Tiles = append(report.Tiles, TileQuality{
+                Tile: TileCoord{tx, ty},
+                MSE:  mse,
+                PSNR: psnr(mse),
+                SSIM: tileSSIM / float64(tileWindows),
+            })
+            sqErr += tileErr
+            samples += n
+            ssimSum += tileSSIM
+            windows += tileWindows
+        }
+    }
+    if samples > 0 {
+        report.MSE = sqErr / float64(samples)
+        report.PSNR = psnr(report.MSE)
+        report.SSIM = ssimSum / float64(windows)
+    }
+    return report, nil
+}
+
+func psnr(mse float64) float64 {
+    if mse == 0 {
+        return math.Inf(1)
+    }
+    return 10 * math.Log10(255*255/mse)
+}
+
+// windowQuality returns the summed squared RGB error and the luma SSIM of the
+// window [x0, x1) x [y0, y1).
+func windowQuality(a, b *NestedImageFile, x0, y0, x1, y1 int) (float64, float64) {
+    var sqErr, sumA, sumB, sumAA, sumBB, sumAB float64
+    for y := y0; y < y1; y++ {
+        for x := x0; x < x1; x++ {
+            pa, pb := a.MainImage[y][x], b.MainImage[y][x]
+            for _, d := range [3]float64{
+                float64(pa.R) - float64(pb.R),
+                float64(pa.G) - float64(pb.G),
+                float64(pa.B) - float64(pb.B),
+            } {
+                sqErr += d * d
+            }
+            la, lb := luma(pa), luma(pb)
+            sumA += la
+            sumB += lb
+            sumAA += la * la
+            sumBB += lb * lb
+            sumAB += la * lb
+        }
+    }
+    n := float64((x1 - x0) * (y1 - y0))
+    muA, muB := sumA/n, sumB/n
+    varA := sumAA/n - muA*muA
+    varB := sumBB/n - muB*muB
+    cov := sumAB/n - muA*muB
+    ssim := (2*muA*muB + ssimC1) * (2*cov + ssimC2) /
+        ((muA*muA + muB*muB + ssimC1) * (varA + varB + ssimC2))
+    return sqErr, ssim
+}
+
+func luma(p PixeLink) float64 {
+    return 0.299*float64(p.R) + 0.587*float64(p.G) + 0.114*float64(p.B)
+}
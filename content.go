@@ -0,0 +1,183 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "image/draw"
+    "io"
+    "math"
+)
+
+// MIMETypeSVG marks nested content holding an SVG document.
+const MIMETypeSVG = "image/svg+xml"
+
+// ErrNoContent is returned for nested images that hold only pixels.
+var ErrNoContent = errors.New("nested image has no content beyond its pixels")
+
+// NestedContent is the source of a nested entry that is not RGB pixels,
+// such as a vector diagram. The entry's pixels hold a rendering of it for
+// readers that only show pixels.
+type NestedContent struct {
+    MIMEType string
+    Data     []byte
+}
+
+// NewSVGNested builds a nested entry holding an SVG document, with the
+// document rendered over white at w x h as its pixels. When w or h is zero
+// it is taken from the document's own size and aspect ratio.
+func NewSVGNested(svg []byte, w, h int) (NestedImage, error) {
+    if w <= 0 || h <= 0 {
+        sw, sh, err := svgSize(svg)
+        if err != nil {
+            return NestedImage{}, err
+        }
+        switch {
+        case w <= 0 && h <= 0:
+            w, h = sw, sh
+        case w <= 0:
+            w = max(h*sw/sh, 1)
+        default:
+            h = max(w*sh/sw, 1)
+        }
+    }
+    if w > math.MaxUint16 || h > math.MaxUint16 {
+        return NestedImage{}, fmt.Errorf("nested image is %dx%d, larger than %d pixels on a side", w, h, math.MaxUint16)
+    }
+    img, err := rasterizeSVG(svg, w, h)
+    if err != nil {
+        return NestedImage{}, err
+    }
+    ni, err := NewNestedImage(overWhite(img))
+    if err != nil {
+        return NestedImage{}, err
+    }
+    ni.Content = &NestedContent{MIMEType: MIMETypeSVG, Data: svg}
+    return ni, nil
+}
+
+// overWhite flattens img onto an opaque white background.
+func overWhite(img *image.RGBA) *image.RGBA {
+    dst := image.NewRGBA(img.Rect)
+    draw.Draw(dst, dst.Rect, image.White, image.Point{}, draw.Src)
+    draw.Draw(dst, dst.Rect, img, img.Rect.Min, draw.Over)
+    return dst
+}
+
+// Render returns the entry at w x h. Vector content is rasterized at that
+// size, over transparency, and captions are drawn again, so they stay
+// sharp at any zoom; other entries have their pixels resampled with f.
+func (ni *NestedImage) Render(w, h int, f ResampleFilter) (*image.RGBA, error) {
+    if w <= 0 || h <= 0 {
+        return nil, fmt.Errorf("cannot render a nested image at %dx%d", w, h)
+    }
+    if ni.Content != nil && ni.Content.MIMEType == MIMETypeSVG {
+        return rasterizeSVG(ni.Content.Data, w, h)
+    }
+    if c, ok := ni.Content.Caption(); ok && ni.Width > 0 {
+        // Captions are laid out again at the new width, with the text
+        // scaled to match.
+        st := c.Style.withDefaults()
+        f := float64(w) / float64(ni.Width)
+        c.Style = CaptionStyle{FontSize: st.FontSize * f, Width: w, Padding: max(int(math.Round(float64(st.Padding)*f)), 1), Color: st.Color, Background: st.Background}
+        return renderCaption(c, h)
+    }
+    img := ni.ToImage()
+    if w == img.Rect.Dx() && h == img.Rect.Dy() {
+        return img, nil
+    }
+    return ResizeImage(img, w, h, f), nil
+}
+
+// Content is stored in one NCON chunk per entry that has it, after the
+// nested images:
+//
+//	index uint32 | MIME type length uint16 | MIME type | data
+//
+// with entries indexed from 0.
+func (nif *NestedImageFile) writeNestedContent(writer io.Writer, order binary.ByteOrder) error {
+    for i, ni := range nif.NestedImages {
+        if ni.Content == nil {
+            continue
+        }
+        if len(ni.Content.MIMEType) > math.MaxUint16 {
+            return fmt.Errorf("nested image %d MIME type is too long to store", i)
+        }
+        var buf bytes.Buffer
+        binary.Write(&buf, order, uint32(i))
+        binary.Write(&buf, order, uint16(len(ni.Content.MIMEType)))
+        buf.WriteString(ni.Content.MIMEType)
+        buf.Write(ni.Content.Data)
+        if err := (&Chunk{Type: ChunkNestedContent, Data: buf.Bytes()}).write(writer, order); err != nil {
+            return fmt.Errorf("failed to write nested image %d content: %w", i, err)
+        }
+    }
+    return nil
+}
+
+func (nif *NestedImageFile) readNestedContent(reader io.Reader, order binary.ByteOrder, length uint64) error {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return fmt.Errorf("failed to read %s chunk: %w", ChunkNestedContent, err)
+    }
+    if len(data) < 6 || int(order.Uint16(data[4:]))+6 > len(data) {
+        return fmt.Errorf("%s chunk is truncated", ChunkNestedContent)
+    }
+    i := order.Uint32(data)
+    if int64(i) >= int64(len(nif.NestedImages)) {
+        return fmt.Errorf("%s chunk is for nested image %d of %d", ChunkNestedContent, i, len(nif.NestedImages))
+    }
+    n := int(order.Uint16(data[4:]))
+    nif.NestedImages[i].Content = &NestedContent{MIMEType: string(data[6 : 6+n]), Data: data[6+n:]}
+    return nil
+}
+
+// findNestedContent locates the content of nested image i, numbered from
+// 0, returning its MIME type and where its data lies in the file.
+func (nr *Reader) findNestedContent(i int) (string, int64, int64, bool, error) {
+    var mimeType string
+    var offset, length int64
+    found := false
+    err := nr.walkChunks(func(t ChunkType, o int64, l uint64) (bool, error) {
+        if t != ChunkNestedContent {
+            return true, nil
+        }
+        var hdr [6]byte
+        if l < 6 {
+            return false, fmt.Errorf("%s chunk is truncated", ChunkNestedContent)
+        }
+        if _, err := nr.r.ReadAt(hdr[:], o); err != nil {
+            return false, fmt.Errorf("failed to read %s chunk: %w", ChunkNestedContent, err)
+        }
+        if int(nr.order.Uint32(hdr[:])) != i {
+            return true, nil
+        }
+        n := uint64(nr.order.Uint16(hdr[4:]))
+        if n+6 > l {
+            return false, fmt.Errorf("%s chunk is truncated", ChunkNestedContent)
+        }
+        name := make([]byte, n)
+        if _, err := nr.r.ReadAt(name, o+6); err != nil {
+            return false, fmt.Errorf("failed to read %s chunk: %w", ChunkNestedContent, err)
+        }
+        mimeType, offset, length, found = string(name), o+6+int64(n), int64(l-6-n), true
+        return false, nil
+    })
+    return mimeType, offset, length, found, err
+}
+
+// nestedContent reads the content of nested image i, or returns nil when
+// it has none.
+func (nr *Reader) nestedContent(i int) (*NestedContent, error) {
+    mimeType, offset, length, ok, err := nr.findNestedContent(i)
+    if err != nil || !ok {
+        return nil, err
+    }
+    data := make([]byte, length)
+    if _, err := nr.r.ReadAt(data, offset); err != nil {
+        return nil, fmt.Errorf("failed to read nested image %d content: %w", i, err)
+    }
+    return &NestedContent{MIMEType: mimeType, Data: data}, nil
+}
@@ -0,0 +1,88 @@
+package nest
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "sync"
+)
+
+// DedupStore caches encoded tiles by content hash so repeated writes of a
+// mostly unchanged image only encode the tiles that differ. It is safe for
+// concurrent use and may be shared between files.
+type DedupStore struct {
+    mu      sync.Mutex
+    entries map[[sha256.Size]byte]*dedupEntry
+    gen     int
+    hits    int
+    misses  int
+}
+
+type dedupEntry struct {
+    data []byte
+    gen  int
+}
+
+func NewDedupStore() *DedupStore {
+    return &DedupStore{entries: make(map[[sha256.Size]byte]*dedupEntry)}
+}
+
+func (ds *DedupStore) encode(tc *tileCodec, tile []PixeLink, class TileClass) ([]byte, error) {
+    if ds == nil {
+        return tc.encode(tile, class, nil)
+    }
+    var key [sha256.Size]byte
+    h := sha256.New()
+    h.Write(encodeTile(tile, tc.order))
+    h.Write(tc.fingerprint())
+    h.Write([]byte{byte(class)})
+    h.Sum(key[:0])
+
+    ds.mu.Lock()
+    if e, ok := ds.entries[key]; ok {
+        e.gen = ds.gen
+        ds.hits++
+        ds.mu.Unlock()
+        return e.data, nil
+    }
+    ds.misses++
+    ds.mu.Unlock()
+
+    data, err := tc.encode(tile, class, nil)
+    if err != nil {
+        return nil, err
+    }
+    ds.mu.Lock()
+    ds.entries[key] = &dedupEntry{data: data, gen: ds.gen}
+    ds.mu.Unlock()
+    return data, nil
+}
+
+// Stats reports how many tiles were served from the store and how many had
+// to be encoded since the last call to Prune.
+func (ds *DedupStore) Stats() (hits, misses int) {
+    ds.mu.Lock()
+    defer ds.mu.Unlock()
+    return ds.hits, ds.misses
+}
+
+// Prune drops every entry not used since the previous Prune and resets the
+// counters. Call it after each write to keep the store bounded by the size of
+// the most recent file.
+func (ds *DedupStore) Prune() {
+    ds.mu.Lock()
+    defer ds.mu.Unlock()
+    for key, e := range ds.entries {
+        if e.gen != ds.gen {
+            delete(ds.entries, key)
+        }
+    }
+    ds.gen++
+    ds.hits, ds.misses = 0, 0
+}
+
+func orderTag(order binary.ByteOrder) byte {
+    if order == binary.BigEndian {
+        return 'M'
+    }
+    return 'I'
+}
@@ -0,0 +1,303 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "io/fs"
+    "math"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// Defaults are option settings shared by the programs using this package on
+// a machine, so a team can agree on them once instead of passing them to
+// every invocation. Zero fields leave options as they are.
+type Defaults struct {
+    TileSize uint16
+    // Quality and Predict choose how tiles are compressed. Setting both is
+    // an error, as it is in WriteOptions.
+    Quality int
+    Predict bool
+    // Workers sets the concurrency of both reads and writes.
+    Workers  int
+    ECCLevel int
+    // MaxMemory and MaxNestedImageSize bound reads, MaxOutputBytes writes.
+    MaxMemory          int64
+    MaxNestedImageSize int64
+    MaxOutputBytes     int64
+    SpillThreshold     int64
+    SpillDir           string
+
+    // Path is the config file the defaults were read from, or empty.
+    Path string
+}
+
+// defaultsKeys are the settings a config file or the environment can hold.
+// Each is also read from the environment variable NEST_ followed by the key
+// in upper case, such as NEST_TILE_SIZE.
+var defaultsKeys = []struct {
+    key string
+    set func(d *Defaults, value string) error
+}{
+    {"tile_size", func(d *Defaults, v string) error {
+        n, err := strconv.ParseUint(v, 10, 16)
+        if err == nil && n == 0 {
+            err = errors.New("must be positive")
+        }
+        d.TileSize = uint16(n)
+        return err
+    }},
+    {"quality", func(d *Defaults, v string) error {
+        n, err := strconv.Atoi(v)
+        if err == nil && (n < 0 || n > 100) {
+            err = errors.New("must be between 0 and 100")
+        }
+        d.Quality = n
+        return err
+    }},
+    {"predict", func(d *Defaults, v string) (err error) {
+        d.Predict, err = strconv.ParseBool(v)
+        return err
+    }},
+    {"workers", func(d *Defaults, v string) (err error) {
+        d.Workers, err = strconv.Atoi(v)
+        return err
+    }},
+    {"ecc_level", func(d *Defaults, v string) (err error) {
+        d.ECCLevel, err = strconv.Atoi(v)
+        return err
+    }},
+    {"max_memory", func(d *Defaults, v string) (err error) {
+        d.MaxMemory, err = ParseSize(v)
+        return err
+    }},
+    {"max_nested_image_size", func(d *Defaults, v string) (err error) {
+        d.MaxNestedImageSize, err = ParseSize(v)
+        return err
+    }},
+    {"max_output_size", func(d *Defaults, v string) (err error) {
+        d.MaxOutputBytes, err = ParseSize(v)
+        return err
+    }},
+    {"spill_threshold", func(d *Defaults, v string) (err error) {
+        d.SpillThreshold, err = ParseSize(v)
+        return err
+    }},
+    {"spill_dir", func(d *Defaults, v string) error {
+        d.SpillDir = v
+        return nil
+    }},
+}
+
+// LoadDefaults reads the defaults from the config file named by NEST_CONFIG,
+// or else from nest/config.toml or nest/config.yaml in the user's config
+// directory (~/.config on Linux), and then from NEST_* environment
+// variables, which take precedence. Neither needs to exist.
+//
+// Config files hold one key per line, such as
+//
+//	tile_size = 512
+//	max_output_size = "40G"
+//
+// in TOML, or "tile_size: 512" in YAML. Sizes take binary units, as in
+// ParseSize. Tables, lists and nesting are not supported.
+func LoadDefaults() (*Defaults, error) {
+    path, err := defaultsPath()
+    if err != nil {
+        return nil, err
+    }
+    d := &Defaults{}
+    values := map[string]string{}
+    if path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read config: %w", err)
+        }
+        sep := byte('=')
+        if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+            sep = ':'
+        }
+        if values, err = parseConfig(data, sep); err != nil {
+            return nil, fmt.Errorf("%s: %w", path, err)
+        }
+        d.Path = path
+    }
+    for _, k := range defaultsKeys {
+        if v, ok := os.LookupEnv("NEST_" + strings.ToUpper(k.key)); ok {
+            values[k.key] = v
+        }
+    }
+    for _, k := range defaultsKeys {
+        v, ok := values[k.key]
+        if !ok {
+            continue
+        }
+        delete(values, k.key)
+        if err := k.set(d, v); err != nil {
+            return nil, fmt.Errorf("invalid %s %q: %w", k.key, v, unwrapNum(err))
+        }
+    }
+    for key := range values {
+        return nil, fmt.Errorf("%s: unknown setting %q", path, key)
+    }
+    if d.Quality > 0 && d.Predict {
+        return nil, errors.New("default quality and predict can't be combined")
+    }
+    return d, nil
+}
+
+// unwrapNum drops the function and input strconv errors repeat.
+func unwrapNum(err error) error {
+    var ne *strconv.NumError
+    if errors.As(err, &ne) {
+        return ne.Err
+    }
+    return err
+}
+
+func defaultsPath() (string, error) {
+    if path := os.Getenv("NEST_CONFIG"); path != "" {
+        return path, nil
+    }
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        // Without a home directory there is no config file to read.
+        return "", nil
+    }
+    for _, name := range []string{"config.toml", "config.yaml"} {
+        path := filepath.Join(dir, "nest", name)
+        _, err := os.Stat(path)
+        if err == nil {
+            return path, nil
+        }
+        if !errors.Is(err, fs.ErrNotExist) {
+            return "", fmt.Errorf("failed to read config: %w", err)
+        }
+    }
+    return "", nil
+}
+
+// parseConfig reads the flat subset of TOML and YAML LoadDefaults accepts:
+// a key, sep and a value on each line, where the value may be quoted and
+// # starts a comment.
+func parseConfig(data []byte, sep byte) (map[string]string, error) {
+    values := map[string]string{}
+    for i, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || line[0] == '#' || line == "---" {
+            continue
+        }
+        key, value, ok := strings.Cut(line, string(sep))
+        key = strings.TrimSpace(key)
+        if !ok || key == "" || strings.ContainsAny(key, " \t[]") {
+            return nil, fmt.Errorf("line %d: expected key %c value", i+1, sep)
+        }
+        value, err := configValue(strings.TrimSpace(value))
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %w", i+1, err)
+        }
+        if _, dup := values[key]; dup {
+            return nil, fmt.Errorf("line %d: %s is set twice", i+1, key)
+        }
+        values[key] = value
+    }
+    return values, nil
+}
+
+// configValue unquotes a value and strips a trailing comment.
+func configValue(s string) (string, error) {
+    var value string
+    switch {
+    case strings.HasPrefix(s, `"`):
+        quoted, err := strconv.QuotedPrefix(s)
+        if err != nil {
+            return "", fmt.Errorf("bad string %s", s)
+        }
+        value, _ = strconv.Unquote(quoted)
+        s = s[len(quoted):]
+    case strings.HasPrefix(s, "'"):
+        end := strings.IndexByte(s[1:], '\'')
+        if end < 0 {
+            return "", fmt.Errorf("bad string %s", s)
+        }
+        value, s = s[1:end+1], s[end+2:]
+    default:
+        if i := strings.Index(s, " #"); i >= 0 {
+            s = s[:i]
+        }
+        return strings.TrimSpace(s), nil
+    }
+    if s = strings.TrimSpace(s); s != "" && s[0] != '#' {
+        return "", fmt.Errorf("unexpected %s after string", s)
+    }
+    return value, nil
+}
+
+// ParseSize reads a size such as 1048576, 512K, 40G or 2TiB, with binary
+// units.
+func ParseSize(s string) (int64, error) {
+    t := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+    shift := 0
+    if n := len(t); n > 0 {
+        if i := strings.IndexByte("KMGTPE", t[n-1]); i >= 0 {
+            shift, t = 10*(i+1), t[:n-1]
+        }
+    }
+    n, err := strconv.ParseInt(strings.TrimSpace(t), 10, 64)
+    if err != nil || n < 0 || n > math.MaxInt64>>shift {
+        return 0, fmt.Errorf("invalid size %q", s)
+    }
+    return n << shift, nil
+}
+
+// ApplyDefaults fills the options left at zero from d, which may be nil.
+func (opts *WriteOptions) ApplyDefaults(d *Defaults) {
+    if d == nil {
+        return
+    }
+    // Either compression setting given explicitly overrides both defaults.
+    if opts.Quality == 0 && !opts.Predict {
+        opts.Quality = d.Quality
+        opts.Predict = d.Predict
+    }
+    if opts.Workers == 0 {
+        opts.Workers = d.Workers
+    }
+    if opts.ECCLevel == 0 {
+        opts.ECCLevel = d.ECCLevel
+    }
+    if opts.MaxOutputBytes == 0 {
+        opts.MaxOutputBytes = d.MaxOutputBytes
+    }
+    if opts.SpillThreshold == 0 {
+        opts.SpillThreshold = d.SpillThreshold
+    }
+    if opts.SpillDir == "" {
+        opts.SpillDir = d.SpillDir
+    }
+}
+
+// ApplyDefaults fills the options left at zero from d, which may be nil.
+func (opts *ReadOptions) ApplyDefaults(d *Defaults) {
+    if d == nil {
+        return
+    }
+    if opts.Workers == 0 {
+        opts.Workers = d.Workers
+    }
+    if opts.MaxMemory == 0 {
+        opts.MaxMemory = d.MaxMemory
+    }
+    if opts.MaxNestedImageSize == 0 {
+        opts.MaxNestedImageSize = d.MaxNestedImageSize
+    }
+}
+
+// ApplyDefaults fills the options left at zero from d, which may be nil.
+func (opts *ImportOptions) ApplyDefaults(d *Defaults) {
+    if d != nil && opts.TileSize == 0 {
+        opts.TileSize = d.TileSize
+    }
+}
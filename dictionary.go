@@ -0,0 +1,266 @@
+package nest
+
+import (
+    "container/heap"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "sync"
+
+    "github.com/klauspost/compress/zstd"
+)
+
+// MaxDictionarySize is the largest dictionary a file can embed, as the
+// header that holds it records its size in 16 bits.
+const MaxDictionarySize = 60 << 10
+
+// Dictionary is a zstd dictionary for CodecZstd planes. Tiles that share
+// content with it, such as the glyphs of scanned text, compress far better
+// than they would alone. Data is in the zstd dictionary format, so
+// dictionaries trained by the zstd tool with --train work as well as those
+// from TrainDictionary.
+type Dictionary struct {
+    Data []byte
+
+    once sync.Once
+    enc  *zstd.Encoder
+    dec  *zstd.Decoder
+    err  error
+}
+
+// ID identifies the dictionary in file headers.
+func (d *Dictionary) ID() uint32 {
+    return max(tileChecksum(d.Data), 1)
+}
+
+func (d *Dictionary) check() error {
+    if len(d.Data) == 0 || len(d.Data) > MaxDictionarySize {
+        return fmt.Errorf("dictionary is %d bytes, want 1 to %d", len(d.Data), MaxDictionarySize)
+    }
+    if _, err := zstd.InspectDictionary(d.Data); err != nil {
+        return fmt.Errorf("invalid zstd dictionary: %w", err)
+    }
+    return nil
+}
+
+// coders returns the encoder and decoder of planes compressed against the
+// dictionary, creating them on first use. Both are safe for concurrent use.
+func (d *Dictionary) coders() (*zstd.Encoder, *zstd.Decoder, error) {
+    d.once.Do(func() {
+        d.enc, d.err = zstd.NewWriter(nil, zstd.WithEncoderDict(d.Data), zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderCRC(false))
+        if d.err != nil {
+            d.err = fmt.Errorf("invalid zstd dictionary: %w", d.err)
+            return
+        }
+        // Capping output at the buffer DecodeAll is given bounds what a
+        // crafted plane can make it allocate.
+        d.dec, d.err = zstd.NewReader(nil, zstd.WithDecoderDicts(d.Data), zstd.WithDecodeAllCapLimit(true))
+        if d.err != nil {
+            d.err = fmt.Errorf("invalid zstd dictionary: %w", d.err)
+        }
+    })
+    return d.enc, d.dec, d.err
+}
+
+// compress compresses a plane against the codec's dictionary.
+func (tc *tileCodec) compress(payload []byte) ([]byte, error) {
+    enc, _, err := tc.dict.coders()
+    if err != nil {
+        return nil, err
+    }
+    return enc.EncodeAll(payload, nil), nil
+}
+
+// decompress expands a CodecZstd plane that must hold exactly n bytes.
+func (tc *tileCodec) decompress(payload []byte, n int) ([]byte, error) {
+    if tc.dict == nil {
+        if tc.dictID == 0 {
+            return nil, errors.New("zstd plane in a file without a dictionary")
+        }
+        return nil, fmt.Errorf("tiles use shared dictionary %08x, which is not registered", tc.dictID)
+    }
+    _, dec, err := tc.dict.coders()
+    if err != nil {
+        return nil, err
+    }
+    out, err := dec.DecodeAll(payload, make([]byte, 0, n))
+    if err != nil {
+        return nil, fmt.Errorf("failed to decompress plane: %w", err)
+    }
+    if len(out) != n {
+        return nil, fmt.Errorf("zstd plane holds %d bytes, want %d", len(out), n)
+    }
+    return out, nil
+}
+
+var dictionaries sync.Map
+
+// RegisterDictionary makes d available to every file written with it as a
+// shared dictionary, which only records its ID. Files that embed their
+// dictionary need no registration.
+func RegisterDictionary(d *Dictionary) error {
+    if err := d.check(); err != nil {
+        return err
+    }
+    dictionaries.Store(d.ID(), d)
+    return nil
+}
+
+func registeredDictionary(id uint32) *Dictionary {
+    if d, ok := dictionaries.Load(id); ok {
+        return d.(*Dictionary)
+    }
+    return nil
+}
+
+// dictionaryGram is the length of the substrings TrainDictionary counts,
+// and dictionarySegment the length of the pieces it picks. dictionaryTables
+// is the room it leaves for the entropy tables zstd stores with the content,
+// and dictionarySample the longest piece of sample zstd derives them from.
+const (
+    dictionaryGram    = 8
+    dictionarySegment = 64
+    dictionaryTables  = 4 << 10
+    dictionarySample  = 32 << 10
+)
+
+// TrainDictionary builds a dictionary of up to MaxDictionarySize bytes from
+// samples of the plane data it will compress, such as those returned by
+// DictionarySamples. It picks the sample segments whose 8-byte substrings
+// recur in the most samples, skipping ones already covered, as the content,
+// placing the best last where matches reach them with the shortest offsets.
+// zstd then derives the dictionary's entropy tables from the samples.
+func TrainDictionary(samples [][]byte) (*Dictionary, error) {
+    const maxContent = MaxDictionarySize - dictionaryTables
+    // seen counts the samples each substring occurs in.
+    seen := map[uint64]int{}
+    for _, s := range samples {
+        for g := range grams(s) {
+            seen[g]++
+        }
+    }
+
+    score := func(seg []byte) int {
+        n := 0
+        for g := range grams(seg) {
+            if c := seen[g]; c > 1 {
+                n += c
+            }
+        }
+        return n
+    }
+    var h segmentHeap
+    for _, s := range samples {
+        for i := 0; i+dictionaryGram <= len(s); i += dictionarySegment {
+            seg := s[i:min(i+dictionarySegment, len(s))]
+            if n := score(seg); n > 0 {
+                h = append(h, segmentScore{seg, n})
+            }
+        }
+    }
+    heap.Init(&h)
+
+    var picked [][]byte
+    size := 0
+    for h.Len() > 0 && size < maxContent {
+        top := heap.Pop(&h).(segmentScore)
+        // Scores only drop as segments are picked, so a segment that still
+        // beats the next best after rescoring is the best left.
+        if n := score(top.seg); n != top.score {
+            if n > 0 {
+                heap.Push(&h, segmentScore{top.seg, n})
+            }
+            continue
+        }
+        seg := top.seg[:min(len(top.seg), maxContent-size)]
+        for g := range grams(seg) {
+            delete(seen, g)
+        }
+        picked = append(picked, seg)
+        size += len(seg)
+    }
+    if size < dictionaryGram {
+        return nil, errors.New("samples share no content to build a dictionary from")
+    }
+
+    content := make([]byte, 0, size)
+    for i := len(picked) - 1; i >= 0; i-- {
+        content = append(content, picked[i]...)
+    }
+    // zstd derives invalid match length tables from samples with matches
+    // longer than 64 KiB, so long ones are cut up.
+    var contents [][]byte
+    for _, s := range samples {
+        for len(s) > dictionarySample {
+            contents = append(contents, s[:dictionarySample])
+            s = s[dictionarySample:]
+        }
+        contents = append(contents, s)
+    }
+    // zstd reserves IDs below 2^15 and from 2^31 for registered
+    // dictionaries.
+    data, err := zstd.BuildDict(zstd.BuildDictOptions{
+        ID:       1<<15 | tileChecksum(content)>>1,
+        Contents: contents,
+        History:  content,
+        Offsets:  [3]int{1, 4, 8},
+        Level:    zstd.SpeedBestCompression,
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to build dictionary: %w", err)
+    }
+    d := &Dictionary{Data: data}
+    if err := d.check(); err != nil {
+        return nil, err
+    }
+    return d, nil
+}
+
+// grams returns the distinct 8-byte substrings of b.
+func grams(b []byte) map[uint64]struct{} {
+    set := map[uint64]struct{}{}
+    for i := 0; i+dictionaryGram <= len(b); i++ {
+        set[binary.LittleEndian.Uint64(b[i:])] = struct{}{}
+    }
+    return set
+}
+
+type segmentScore struct {
+    seg   []byte
+    score int
+}
+
+type segmentHeap []segmentScore
+
+func (h segmentHeap) Len() int           { return len(h) }
+func (h segmentHeap) Less(i, j int) bool { return h[i].score > h[j].score }
+func (h segmentHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *segmentHeap) Push(x any)        { *h = append(*h, x.(segmentScore)) }
+
+func (h *segmentHeap) Pop() any {
+    old := *h
+    x := old[len(old)-1]
+    *h = old[:len(old)-1]
+    return x
+}
+
+// DictionarySamples returns the raw RGB planes of up to n main image tiles
+// spread evenly over the image, for TrainDictionary.
+func (nif *NestedImageFile) DictionarySamples(n int) [][]byte {
+    cols, rows := tileGrid(nif.Header.Width, nif.Header.Height, nif.Header.TileSize)
+    total := cols * rows
+    if n <= 0 || total == 0 {
+        return nil
+    }
+    ts := int(nif.Header.TileSize)
+    var samples [][]byte
+    for i := 0; i < total && len(samples) < n; i += max(1, total/n) {
+        tile := nif.extractTile(i%cols*ts, i/cols*ts, ts)
+        rgb := make([]byte, 0, 3*len(tile))
+        for _, p := range tile {
+            rgb = append(rgb, p.R, p.G, p.B)
+        }
+        samples = append(samples, rgb)
+    }
+    return samples
+}
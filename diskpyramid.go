@@ -0,0 +1,248 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+
+    "github.com/70ziko/NEST/tilemath"
+)
+
+// AppendPyramid builds pyramid levels 1 and up for the file open in ws and
+// appends them without loading the main image, so overviews of images far
+// larger than memory can be built on a laptop. Each level tile is the 2×2
+// mean of the four tiles below it, read back from the file as needed: main
+// image tiles for level 1, and the level appended just before for the
+// rest. Only a few tiles per worker are held at a time. The result matches
+// BuildPyramid with the box filter wherever level sizes are even, and the
+// main image tile checksums are recorded too, so RebuildPyramid can refresh
+// the levels after later edits.
+//
+// ws must also implement io.ReaderAt, as *os.File does, and the file must
+// end in a TAIL chunk and have no pyramid yet. Of opts, only Quality,
+// Adaptive, Workers and Encoder are used. The levels are written over the
+// TAIL chunk and the trailer before it, which are written again once they
+// are done, so work on a copy when an interrupted run would be costly.
+func AppendPyramid(ws io.WriteSeeker, opts WriteOptions) error {
+    ra, ok := ws.(io.ReaderAt)
+    if !ok {
+        return errors.New("AppendPyramid needs a file that can also be read at offsets, such as *os.File")
+    }
+    size, err := ws.Seek(0, io.SeekEnd)
+    if err != nil {
+        return err
+    }
+    nr, err := NewReader(ra, size)
+    if err != nil {
+        return err
+    }
+    buf := make([]byte, tailChunkSize)
+    if size < tailChunkSize {
+        return errors.New("file has no TAIL chunk to append the pyramid before")
+    }
+    if _, err := ra.ReadAt(buf, size-tailChunkSize); err != nil {
+        return fmt.Errorf("failed to read tail chunk: %w", err)
+    }
+    tail, ok := decodeTail(buf, nr.order)
+    if !ok {
+        return errors.New("file has no TAIL chunk to append the pyramid before")
+    }
+    for _, t := range []ChunkType{ChunkPyramid, ChunkPyramidSource} {
+        if _, _, found, err := nr.findChunk(t); err != nil || found {
+            if err == nil {
+                err = errors.New("file already has a pyramid, which RebuildPyramid refreshes")
+            }
+            return err
+        }
+    }
+
+    grid := nr.Grid()
+    if grid.Levels() < 2 {
+        return nil
+    }
+    tc := nr.codec()
+    tc.quality = opts.Quality
+    tc.adaptive = opts.Adaptive
+    b := &pyramidAppender{
+        nr:      nr,
+        ws:      ws,
+        tc:      tc,
+        workers: opts.Workers,
+        offset:  size - tailChunkSize,
+        hashes:  make([]uint32, grid.Cols()*grid.Rows()),
+    }
+    if nr.trailer != nil {
+        b.offset = nr.trailerOffset
+    }
+    var prev *storedLevel
+    for n := 1; n < grid.Levels(); n++ {
+        if prev, err = b.appendLevel(n, prev); err != nil {
+            return err
+        }
+    }
+
+    if _, err := ws.Seek(b.offset, io.SeekStart); err != nil {
+        return err
+    }
+    data := make([]byte, 4, 4+4*len(b.hashes))
+    nr.order.PutUint32(data, uint32(len(b.hashes)))
+    data, _ = binary.Append(data, nr.order, b.hashes)
+    if err := (&Chunk{Type: ChunkPyramidSource, Data: data}).write(ws, nr.order); err != nil {
+        return err
+    }
+    end, err := ws.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return err
+    }
+    sum, err := nr.hashTo(end)
+    if err != nil {
+        return err
+    }
+    trailer := &Trailer{Encoder: opts.encoder(), Written: opts.written()}
+    copy(trailer.Hash[:], sum)
+    if err := trailer.chunk(nr.order).write(ws, nr.order); err != nil {
+        return fmt.Errorf("failed to write trailer: %w", err)
+    }
+    if err := tail.write(ws, nr.order); err != nil {
+        return fmt.Errorf("failed to write tail chunk: %w", err)
+    }
+    return nil
+}
+
+type pyramidAppender struct {
+    nr      *Reader
+    ws      io.WriteSeeker
+    tc      *tileCodec
+    workers int
+    // offset is where the next chunk goes.
+    offset int64
+    // hashes are the main image tile checksums, filled in as level 1 reads
+    // the tiles.
+    hashes []uint32
+}
+
+// appendLevel writes level n as a PYRM chunk at b.offset, reducing the
+// tiles of prev, or of the main image when prev is nil. The chunk header
+// and tile lengths are written last, once the tiles are.
+func (b *pyramidAppender) appendLevel(n int, prev *storedLevel) (*storedLevel, error) {
+    grid := b.nr.Grid()
+    g, pg := grid.Level(n), grid.Level(n-1)
+    cols, count := g.Cols(), g.Cols()*g.Rows()
+    l := &storedLevel{
+        hdr:     pyramidHeader{Level: uint8(n), Width: uint32(g.Width), Height: uint32(g.Height), Count: uint32(count)},
+        offsets: make([]int64, count),
+        lengths: make([]uint32, count),
+    }
+    start := b.offset
+    pos := start + chunkHeaderSize + int64(binary.Size(l.hdr)) + 4*int64(count)
+    if _, err := b.ws.Seek(pos, io.SeekStart); err != nil {
+        return nil, err
+    }
+    err := encodeInOrder(count, b.workers, nil, func(i int) ([]byte, error) {
+        tile, err := b.reduce(i%cols, i/cols, pg, prev)
+        if err != nil {
+            return nil, err
+        }
+        class := ClassUnknown
+        if b.tc.adaptive {
+            r := g.TileBounds(i%cols, i/cols)
+            class = classifyTile(tile, b.tc.tileSize, r.Dx(), r.Dy())
+        }
+        var buf bytes.Buffer
+        if err := b.tc.encodeRGB(&buf, tile, class, nil); err != nil {
+            return nil, err
+        }
+        return buf.Bytes(), nil
+    }, func(i int, data []byte) error {
+        if _, err := b.ws.Write(data); err != nil {
+            return err
+        }
+        l.offsets[i], l.lengths[i] = pos, uint32(len(data))
+        pos += int64(len(data))
+        return nil
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to build pyramid level %d: %w", n, err)
+    }
+
+    if _, err := b.ws.Seek(start, io.SeekStart); err != nil {
+        return nil, err
+    }
+    if err := writeChunkHeader(b.ws, b.tc.order, ChunkPyramid, uint64(pos-start-chunkHeaderSize)); err != nil {
+        return nil, err
+    }
+    if err := binary.Write(b.ws, b.tc.order, &l.hdr); err != nil {
+        return nil, fmt.Errorf("failed to write pyramid header: %w", err)
+    }
+    if err := binary.Write(b.ws, b.tc.order, l.lengths); err != nil {
+        return nil, fmt.Errorf("failed to write pyramid tile lengths: %w", err)
+    }
+    b.offset = pos
+    return l, nil
+}
+
+// reduce returns tile (tx, ty) of a level as the 2×2 means of the pixels of
+// the level below, laid out by pg. Pixels pair up across tile edges when
+// the tile size is odd, so sums are kept by output pixel.
+func (b *pyramidAppender) reduce(tx, ty int, pg tilemath.Grid, prev *storedLevel) ([]PixeLink, error) {
+    ts := b.tc.tileSize
+    sums := make([][4]int, ts*ts)
+    for q := 0; q < 4; q++ {
+        sx, sy := 2*tx+q%2, 2*ty+q/2
+        if sx >= pg.Cols() || sy >= pg.Rows() {
+            continue
+        }
+        src, err := b.sourceTile(sx, sy, pg, prev)
+        if err != nil {
+            return nil, err
+        }
+        r := pg.TileBounds(sx, sy)
+        for y := r.Min.Y; y < r.Max.Y; y++ {
+            oy := y/2 - ty*ts
+            for x := r.Min.X; x < r.Max.X; x++ {
+                p := src[(y-r.Min.Y)*ts+x-r.Min.X]
+                s := &sums[oy*ts+x/2-tx*ts]
+                s[0] += int(p.R)
+                s[1] += int(p.G)
+                s[2] += int(p.B)
+                s[3]++
+            }
+        }
+    }
+    tile := make([]PixeLink, ts*ts)
+    for i, s := range sums {
+        if n := s[3]; n > 0 {
+            tile[i] = PixeLink{R: byte((s[0] + n/2) / n), G: byte((s[1] + n/2) / n), B: byte((s[2] + n/2) / n)}
+        }
+    }
+    return tile, nil
+}
+
+// sourceTile reads tile (x, y) of the level below: from the main image,
+// recording its checksum, or from the PYRM chunk written before.
+func (b *pyramidAppender) sourceTile(x, y int, pg tilemath.Grid, prev *storedLevel) ([]PixeLink, error) {
+    if prev == nil {
+        tile, err := b.nr.ReadTile(x, y)
+        if err != nil {
+            return nil, err
+        }
+        rgb := make([]byte, 0, 3*len(tile))
+        for _, p := range tile {
+            rgb = append(rgb, p.R, p.G, p.B)
+        }
+        b.hashes[y*pg.Cols()+x] = tileColorHash(rgb, pg.TileBounds(x, y), b.tc.tileSize)
+        return tile, nil
+    }
+    i := y*pg.Cols() + x
+    buf := make([]byte, prev.lengths[i])
+    if _, err := b.nr.r.ReadAt(buf, prev.offsets[i]); err != nil {
+        return nil, fmt.Errorf("failed to read pyramid level %d tile %d: %w", prev.hdr.Level, i, err)
+    }
+    tile := make([]PixeLink, b.tc.tileSize*b.tc.tileSize)
+    if err := b.tc.decodeRGB(bytes.NewReader(buf), tile, nil); err != nil {
+        return nil, fmt.Errorf("failed to decode pyramid level %d tile %d: %w", prev.hdr.Level, i, err)
+    }
+    return tile, nil
+}
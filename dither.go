@@ -0,0 +1,119 @@
+package nest
+
+import (
+    "fmt"
+    "math"
+
+    "github.com/70ziko/NEST/colorspace"
+)
+
+type DitherMode uint8
+
+const (
+    DitherNone DitherMode = iota
+    DitherFloydSteinberg
+    DitherOrdered
+)
+
+func (d DitherMode) String() string {
+    switch d {
+    case DitherNone:
+        return "none"
+    case DitherFloydSteinberg:
+        return "floyd-steinberg"
+    case DitherOrdered:
+        return "ordered"
+    }
+    return "unknown"
+}
+
+func ParseDitherMode(s string) (DitherMode, error) {
+    for _, d := range []DitherMode{DitherNone, DitherFloydSteinberg, DitherOrdered} {
+        if d.String() == s {
+            return d, nil
+        }
+    }
+    return DitherNone, fmt.Errorf("unknown dither mode %q", s)
+}
+
+var bayer8 = [8][8]float64{
+    {0, 32, 8, 40, 2, 34, 10, 42},
+    {48, 16, 56, 24, 50, 18, 58, 26},
+    {12, 44, 4, 36, 14, 46, 6, 38},
+    {60, 28, 52, 20, 62, 30, 54, 22},
+    {3, 35, 11, 43, 1, 33, 9, 41},
+    {51, 19, 59, 27, 49, 17, 57, 25},
+    {15, 47, 7, 39, 13, 45, 5, 37},
+    {63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// quantizer reduces 16-bit source samples to 8-bit output with the requested
+// number of levels, diffusing or ordering the rounding error when asked.
+type quantizer struct {
+    mode   DitherMode
+    levels float64
+    space  colorspace.Space
+    // Floyd–Steinberg error for the current and next row, per channel, with
+    // one pixel of padding on each side.
+    cur, next [][3]float64
+}
+
+func newQuantizer(opts ImportOptions, width int) *quantizer {
+    levels := opts.Levels
+    if levels < 2 || levels > 256 {
+        levels = 256
+    }
+    q := &quantizer{mode: opts.Dither, levels: float64(levels), space: opts.ColorSpace}
+    if q.mode == DitherFloydSteinberg {
+        q.cur = make([][3]float64, width+2)
+        q.next = make([][3]float64, width+2)
+    }
+    return q
+}
+
+// pixel converts one source pixel given as 16-bit sRGB components.
+func (q *quantizer) pixel(x, y int, r, g, b uint32) (byte, byte, byte) {
+    in := [3]float64{float64(r) / 0xffff, float64(g) / 0xffff, float64(b) / 0xffff}
+    if q.space == colorspace.Linear {
+        for c := range in {
+            in[c] = colorspace.SRGBToLinear(in[c])
+        }
+    }
+
+    var out [3]byte
+    step := 1 / (q.levels - 1)
+    for c, v := range in {
+        switch q.mode {
+        case DitherFloydSteinberg:
+            v += q.cur[x+1][c]
+        case DitherOrdered:
+            v += (bayer8[y%8][x%8]/64 - 0.5) * step
+        }
+        level := math.Round(math.Max(0, math.Min(1, v)) / step)
+        quantized := level * step
+        out[c] = byte(math.Round(quantized * 255))
+
+        if q.mode == DitherFloydSteinberg {
+            err := v - quantized
+            q.cur[x+2][c] += err * 7 / 16
+            q.next[x][c] += err * 3 / 16
+            q.next[x+1][c] += err * 5 / 16
+            q.next[x+2][c] += err * 1 / 16
+        }
+    }
+
+    if q.space == colorspace.YCbCr {
+        return colorspace.Convert8(out[0], out[1], out[2], colorspace.SRGB, colorspace.YCbCr)
+    }
+    return out[0], out[1], out[2]
+}
+
+func (q *quantizer) endRow() {
+    if q.mode != DitherFloydSteinberg {
+        return
+    }
+    q.cur, q.next = q.next, q.cur
+    for i := range q.next {
+        q.next[i] = [3]float64{}
+    }
+}
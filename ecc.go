@@ -0,0 +1,312 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+)
+
+// Tiles are protected in groups of eccGroupSize consecutive index entries.
+// Each group gets ECCLevel Reed–Solomon parity shards, so up to ECCLevel
+// tiles per group that fail their checksum can be rebuilt on read.
+const eccGroupSize = 16
+
+// GF(2^8) arithmetic over the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+var gfExp, gfLog = func() (exp [512]byte, log [256]byte) {
+    x := 1
+    for i := 0; i < 255; i++ {
+        exp[i] = byte(x)
+        log[x] = byte(i)
+        x <<= 1
+        if x&0x100 != 0 {
+            x ^= 0x11d
+        }
+    }
+    for i := 255; i < 512; i++ {
+        exp[i] = exp[i-255]
+    }
+    return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+    if a == 0 || b == 0 {
+        return 0
+    }
+    return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+    return gfExp[255-int(gfLog[a])]
+}
+
+// mulAdd sets dst[i] ^= c * src[i].
+func mulAdd(dst, src []byte, c byte) {
+    if c == 0 {
+        return
+    }
+    lc := int(gfLog[c])
+    for i, s := range src {
+        if s != 0 {
+            dst[i] ^= gfExp[lc+int(gfLog[s])]
+        }
+    }
+}
+
+// parityCoeff is the Cauchy matrix entry for parity row i and data column j.
+// Any square selection of identity and Cauchy rows is invertible, so any
+// group members that survive are enough to rebuild the rest.
+func parityCoeff(groupSize, i, j int) byte {
+    return gfInv(byte(groupSize+i) ^ byte(j))
+}
+
+// encodeParity computes parity shards over data shards padded to shardLen.
+func encodeParity(data [][]byte, groupSize, parity, shardLen int) [][]byte {
+    out := make([][]byte, parity)
+    for i := range out {
+        out[i] = make([]byte, shardLen)
+        for j, d := range data {
+            mulAdd(out[i], d, parityCoeff(groupSize, i, j))
+        }
+    }
+    return out
+}
+
+// reconstructShard rebuilds data shard want from the intact data shards and
+// the parity shards. Missing shards are nil.
+func reconstructShard(data [][]byte, parity [][]byte, groupSize, want, shardLen int) ([]byte, error) {
+    k := len(data)
+    rows := make([][]byte, 0, k)
+    shards := make([][]byte, 0, k)
+    for j, d := range data {
+        if d != nil {
+            row := make([]byte, k)
+            row[j] = 1
+            rows = append(rows, row)
+            shards = append(shards, d)
+        }
+    }
+    for i := 0; len(rows) < k && i < len(parity); i++ {
+        if parity[i] == nil {
+            continue
+        }
+        row := make([]byte, k)
+        for j := range row {
+            row[j] = parityCoeff(groupSize, i, j)
+        }
+        rows = append(rows, row)
+        shards = append(shards, parity[i])
+    }
+    if len(rows) < k {
+        return nil, fmt.Errorf("%d of %d tiles in the group are damaged, parity can rebuild %d", countNil(data), k, len(parity))
+    }
+
+    // Invert the selected rows with Gauss-Jordan elimination, keeping only
+    // the row of the inverse that yields shard want.
+    inv := make([][]byte, k)
+    for i := range inv {
+        inv[i] = make([]byte, k)
+        inv[i][i] = 1
+    }
+    for col := 0; col < k; col++ {
+        pivot := -1
+        for r := col; r < k; r++ {
+            if rows[r][col] != 0 {
+                pivot = r
+                break
+            }
+        }
+        if pivot < 0 {
+            return nil, errors.New("parity matrix is singular")
+        }
+        rows[col], rows[pivot] = rows[pivot], rows[col]
+        inv[col], inv[pivot] = inv[pivot], inv[col]
+        scale := gfInv(rows[col][col])
+        for j := 0; j < k; j++ {
+            rows[col][j] = gfMul(rows[col][j], scale)
+            inv[col][j] = gfMul(inv[col][j], scale)
+        }
+        for r := 0; r < k; r++ {
+            if r == col || rows[r][col] == 0 {
+                continue
+            }
+            f := rows[r][col]
+            for j := 0; j < k; j++ {
+                rows[r][j] ^= gfMul(f, rows[col][j])
+                inv[r][j] ^= gfMul(f, inv[col][j])
+            }
+        }
+    }
+
+    out := make([]byte, shardLen)
+    for j, s := range shards {
+        mulAdd(out, s, inv[want][j])
+    }
+    return out, nil
+}
+
+func countNil(shards [][]byte) int {
+    n := 0
+    for _, s := range shards {
+        if s == nil {
+            n++
+        }
+    }
+    return n
+}
+
+type eccHeader struct {
+    GroupSize uint16
+    Parity    uint16
+    Groups    uint32
+}
+
+// eccWriter collects tiles as they are written and computes parity for each
+// completed group.
+type eccWriter struct {
+    parity    int
+    group     [][]byte
+    shardLens []uint32
+    shards    [][]byte
+}
+
+func newECCWriter(level int) (*eccWriter, error) {
+    if level < 0 || level > eccGroupSize {
+        return nil, fmt.Errorf("ECCLevel must be between 0 and %d", eccGroupSize)
+    }
+    if level == 0 {
+        return nil, nil
+    }
+    return &eccWriter{parity: level}, nil
+}
+
+func (ew *eccWriter) add(tile []byte) {
+    if ew == nil {
+        return
+    }
+    ew.group = append(ew.group, append([]byte(nil), tile...))
+    if len(ew.group) == eccGroupSize {
+        ew.flush()
+    }
+}
+
+func (ew *eccWriter) flush() {
+    if len(ew.group) == 0 {
+        return
+    }
+    shardLen := 0
+    for _, t := range ew.group {
+        shardLen = max(shardLen, len(t))
+    }
+    for i, t := range ew.group {
+        ew.group[i] = append(t, make([]byte, shardLen-len(t))...)
+    }
+    ew.shardLens = append(ew.shardLens, uint32(shardLen))
+    ew.shards = append(ew.shards, encodeParity(ew.group, eccGroupSize, ew.parity, shardLen)...)
+    ew.group = ew.group[:0]
+}
+
+// The PRTY chunk holds
+//
+//	eccHeader | Groups * shard length uint32 | Groups * Parity shards
+func (ew *eccWriter) chunk(order binary.ByteOrder) *Chunk {
+    if ew == nil {
+        return nil
+    }
+    ew.flush()
+    hdr := eccHeader{GroupSize: eccGroupSize, Parity: uint16(ew.parity), Groups: uint32(len(ew.shardLens))}
+    size := binary.Size(hdr) + 4*len(ew.shardLens)
+    for _, s := range ew.shards {
+        size += len(s)
+    }
+    buf := bytes.NewBuffer(make([]byte, 0, size))
+    binary.Write(buf, order, &hdr)
+    binary.Write(buf, order, ew.shardLens)
+    for _, s := range ew.shards {
+        buf.Write(s)
+    }
+    return &Chunk{Type: ChunkParity, Data: buf.Bytes()}
+}
+
+// eccIndex locates the parity shards of each group inside the PRTY chunk.
+type eccIndex struct {
+    eccHeader
+    shardLens []uint32
+    offsets   []int64
+}
+
+func (nr *Reader) loadParity() error {
+    offset, length, ok, err := nr.findChunk(ChunkParity)
+    if err != nil || !ok {
+        return err
+    }
+    idx := &eccIndex{}
+    hdrSize := int64(binary.Size(idx.eccHeader))
+    if int64(length) < hdrSize {
+        return fmt.Errorf("%s chunk is truncated", ChunkParity)
+    }
+    if err := binary.Read(io.NewSectionReader(nr.r, offset, hdrSize), nr.order, &idx.eccHeader); err != nil {
+        return fmt.Errorf("failed to read %s chunk: %w", ChunkParity, err)
+    }
+    groups := (len(nr.Index.Entries) + int(idx.GroupSize) - 1) / max(int(idx.GroupSize), 1)
+    if idx.GroupSize == 0 || int(idx.GroupSize)+int(idx.Parity) > 256 || int(idx.Groups) != groups || hdrSize+4*int64(idx.Groups) > int64(length) {
+        return fmt.Errorf("%s chunk does not match the tile index", ChunkParity)
+    }
+    idx.shardLens = make([]uint32, idx.Groups)
+    if err := binary.Read(io.NewSectionReader(nr.r, offset+hdrSize, 4*int64(idx.Groups)), nr.order, idx.shardLens); err != nil {
+        return fmt.Errorf("failed to read %s chunk: %w", ChunkParity, err)
+    }
+    pos := offset + hdrSize + 4*int64(idx.Groups)
+    for _, n := range idx.shardLens {
+        idx.offsets = append(idx.offsets, pos)
+        pos += int64(n) * int64(idx.Parity)
+    }
+    if pos > offset+int64(length) {
+        return fmt.Errorf("%s chunk is truncated", ChunkParity)
+    }
+    nr.parity = idx
+    return nil
+}
+
+// recoverTile rebuilds the stored bytes of index entry i from the other
+// tiles of its group and the parity shards.
+func (nr *Reader) recoverTile(i int) ([]byte, error) {
+    p := nr.parity
+    g := i / int(p.GroupSize)
+    first := g * int(p.GroupSize)
+    last := min(first+int(p.GroupSize), len(nr.Index.Entries))
+    shardLen := int(p.shardLens[g])
+
+    data := make([][]byte, last-first)
+    for j := range data {
+        e := nr.Index.Entries[first+j]
+        if first+j == i || e.Length > int64(shardLen) {
+            continue
+        }
+        buf := make([]byte, shardLen)
+        if _, err := nr.r.ReadAt(buf[:e.Length], e.Offset); err != nil {
+            return nil, fmt.Errorf("failed to read tile (%d, %d): %w", e.Tile.X, e.Tile.Y, err)
+        }
+        if tileChecksum(buf[:e.Length]) == e.Checksum {
+            data[j] = buf
+        }
+    }
+    parity := make([][]byte, p.Parity)
+    for j := range parity {
+        parity[j] = make([]byte, shardLen)
+        if _, err := nr.r.ReadAt(parity[j], p.offsets[g]+int64(j*shardLen)); err != nil {
+            return nil, fmt.Errorf("failed to read parity: %w", err)
+        }
+    }
+
+    shard, err := reconstructShard(data, parity, int(p.GroupSize), i-first, shardLen)
+    if err != nil {
+        return nil, err
+    }
+    e := nr.Index.Entries[i]
+    if e.Length > int64(shardLen) || tileChecksum(shard[:e.Length]) != e.Checksum {
+        return nil, errors.New("rebuilt tile does not match its checksum")
+    }
+    return shard[:e.Length], nil
+}
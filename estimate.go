@@ -0,0 +1,63 @@
+package nest
+
+import (
+    "io"
+    "sync"
+)
+
+// estimateSamples is about how many tiles EstimateSize encodes for real.
+const estimateSamples = 256
+
+// EstimateSize returns the size of the file nif.WriteWithOptions would
+// write with opts, without writing it, so batch jobs can plan storage and
+// reject oversized outputs early. The size is exact when every plane is
+// stored raw. Otherwise only a sample of the tiles spread over the image is
+// encoded, and each of the rest is counted at the mean size of the sampled
+// tiles of its class; everything else in the file is still measured
+// exactly.
+func EstimateSize(nif *NestedImageFile, opts WriteOptions) (int64, error) {
+    // Placeholder tiles must not end up in a shared store.
+    opts.Dedup = nil
+    if opts.Quality > 0 || opts.Adaptive || opts.LinkCodec != CodecRaw {
+        g := nif.grid()
+        opts.sampler = &sizeSampler{every: max(1, g.Cols()*g.Rows()/estimateSamples), sums: map[int][2]int{}}
+    }
+    cw := &countingWriter{w: io.Discard}
+    if err := nif.write(cw, opts, nil); err != nil {
+        return 0, err
+    }
+    return cw.n, nil
+}
+
+// sizeSampler encodes every so many tiles for EstimateSize and stands in
+// for the others with zero-filled placeholders of the mean encoded size of
+// the sampled tiles of the same kind.
+type sizeSampler struct {
+    every int
+    mu    sync.Mutex
+    // sums holds the sample count and total encoded bytes by kind.
+    sums map[int][2]int
+}
+
+// encode runs encode for tile i, or returns a placeholder when tile i is
+// not sampled and tiles of its kind have been.
+func (s *sizeSampler) encode(i, kind int, encode func() ([]byte, error)) ([]byte, error) {
+    if s == nil {
+        return encode()
+    }
+    s.mu.Lock()
+    sum, ok := s.sums[kind]
+    s.mu.Unlock()
+    if ok && i%s.every != 0 {
+        return make([]byte, sum[1]/sum[0]), nil
+    }
+    data, err := encode()
+    if err != nil {
+        return nil, err
+    }
+    s.mu.Lock()
+    sum = s.sums[kind]
+    s.sums[kind] = [2]int{sum[0] + 1, sum[1] + len(data)}
+    s.mu.Unlock()
+    return data, nil
+}
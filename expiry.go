@@ -0,0 +1,151 @@
+package nest
+
+import (
+    "encoding/binary"
+    "fmt"
+    "image"
+    "io"
+    "time"
+)
+
+// TileTTLKey is the metadata key holding how long a tile stays fresh after
+// its last update, as a Go duration such as "15m". Files regenerated from
+// live feeds set it so tile servers can tell clients when to come back.
+const TileTTLKey = "tile-ttl"
+
+// MarkUpdated records t as the update time of every tile rect touches.
+// Updaters call it after writing fresh pixels from their source.
+func (nif *NestedImageFile) MarkUpdated(rect image.Rectangle, t time.Time) {
+    grid := nif.grid()
+    if len(nif.TileTimes) != grid.Cols()*grid.Rows() {
+        nif.TileTimes = make([]time.Time, grid.Cols()*grid.Rows())
+    }
+    tiles := grid.TileRange(rect.Intersect(nif.Bounds()))
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            nif.TileTimes[ty*grid.Cols()+tx] = t
+        }
+    }
+}
+
+// TileUpdated returns when tile (tx, ty) was last updated, or the zero time
+// when that is unknown.
+func (nif *NestedImageFile) TileUpdated(tx, ty int) time.Time {
+    grid := nif.grid()
+    if !grid.Contains(tx, ty) || len(nif.TileTimes) != grid.Cols()*grid.Rows() {
+        return time.Time{}
+    }
+    return nif.TileTimes[ty*grid.Cols()+tx]
+}
+
+// StaleTiles lists the tiles last updated before olderThan, in row-major
+// order. Tiles of unknown age are always stale.
+func (nif *NestedImageFile) StaleTiles(olderThan time.Time) []TileCoord {
+    return staleTiles(nif.TileTimes, nif.grid().Cols(), nif.grid().Rows(), olderThan)
+}
+
+func staleTiles(times []time.Time, cols, rows int, olderThan time.Time) []TileCoord {
+    var stale []TileCoord
+    for i := 0; i < cols*rows; i++ {
+        if i >= len(times) || times[i].Before(olderThan) {
+            stale = append(stale, TileCoord{X: i % cols, Y: i / cols})
+        }
+    }
+    return stale
+}
+
+// parseTileTTL reads TileTTLKey, returning zero when it is absent.
+func parseTileTTL(m Metadata) (time.Duration, error) {
+    v, ok := m[TileTTLKey]
+    if !ok {
+        return 0, nil
+    }
+    ttl, err := time.ParseDuration(v)
+    if err != nil || ttl < 0 {
+        return 0, fmt.Errorf("invalid %s %q", TileTTLKey, v)
+    }
+    return ttl, nil
+}
+
+// Tile update times are kept in a TTIM chunk, one per main image tile in
+// row-major order:
+//
+//	count uint32 | count * Unix nanoseconds int64
+//
+// Zero stands for an unknown time.
+func encodeTileTimes(times []time.Time, order binary.ByteOrder) []byte {
+    data := make([]byte, 4+8*len(times))
+    order.PutUint32(data, uint32(len(times)))
+    for i, t := range times {
+        if !t.IsZero() {
+            order.PutUint64(data[4+8*i:], uint64(t.UnixNano()))
+        }
+    }
+    return data
+}
+
+func decodeTileTimes(reader io.Reader, order binary.ByteOrder, length uint64, tiles int) ([]time.Time, error) {
+    if length != 4+8*uint64(tiles) {
+        return nil, fmt.Errorf("%s chunk is %d bytes for %d tiles", ChunkTileTimes, length, tiles)
+    }
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkTileTimes, err)
+    }
+    if int(order.Uint32(data)) != tiles {
+        return nil, fmt.Errorf("%s chunk lists %d tiles, the grid has %d", ChunkTileTimes, order.Uint32(data), tiles)
+    }
+    times := make([]time.Time, tiles)
+    for i := range times {
+        if ns := int64(order.Uint64(data[4+8*i:])); ns != 0 {
+            times[i] = time.Unix(0, ns).UTC()
+        }
+    }
+    return times, nil
+}
+
+func (nr *Reader) loadTileTimes() error {
+    offset, length, ok, err := nr.findChunk(ChunkTileTimes)
+    if err != nil || !ok {
+        return err
+    }
+    grid := nr.Grid()
+    if nr.updated, err = decodeTileTimes(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length, grid.Cols()*grid.Rows()); err != nil {
+        return err
+    }
+    md, err := nr.Metadata()
+    if err != nil {
+        return err
+    }
+    nr.ttl, err = parseTileTTL(md)
+    return err
+}
+
+// TileUpdated returns when tile (tx, ty) was last updated. It reports false
+// when the file doesn't record it.
+func (nr *Reader) TileUpdated(tx, ty int) (time.Time, bool) {
+    grid := nr.Grid()
+    if nr.updated == nil || !grid.Contains(tx, ty) {
+        return time.Time{}, false
+    }
+    t := nr.updated[ty*grid.Cols()+tx]
+    return t, !t.IsZero()
+}
+
+// TileExpires returns when tile (tx, ty) goes stale: its update time plus
+// the TileTTLKey duration. It reports false when either is missing.
+func (nr *Reader) TileExpires(tx, ty int) (time.Time, bool) {
+    t, ok := nr.TileUpdated(tx, ty)
+    if !ok || nr.ttl == 0 {
+        return time.Time{}, false
+    }
+    return t.Add(nr.ttl), true
+}
+
+// StaleTiles lists the tiles last updated before olderThan, in row-major
+// order. Tiles of unknown age, which is all of them in files without update
+// times, are always stale.
+func (nr *Reader) StaleTiles(olderThan time.Time) []TileCoord {
+    grid := nr.Grid()
+    return staleTiles(nr.updated, grid.Cols(), grid.Rows(), olderThan)
+}
@@ -0,0 +1,47 @@
+package nest
+
+import (
+    "image"
+
+    "github.com/70ziko/NEST/colorspace"
+)
+
+// ToImage renders the main image as sRGB, converting from the color space
+// recorded in the header and applying the display adjustments and the
+// orientation. Links are not represented.
+func (nif *NestedImageFile) ToImage() *image.RGBA {
+    img := nif.rawImage()
+    nif.Adjustments.apply(img)
+    o := nif.Header.Orientation
+    w, h := int(nif.Header.Width), int(nif.Header.Height)
+    dw, dh := o.Size(w, h)
+    return o.orient(img, image.Rect(0, 0, dw, dh), w, h)
+}
+
+// rawImage is ToImage without the display adjustments and orientation.
+func (nif *NestedImageFile) rawImage() *image.RGBA {
+    img := image.NewRGBA(image.Rect(0, 0, int(nif.Header.Width), int(nif.Header.Height)))
+    for y, row := range nif.MainImage {
+        if y >= img.Rect.Dy() {
+            break
+        }
+        for x, p := range row {
+            if x >= img.Rect.Dx() {
+                break
+            }
+            i := img.PixOffset(x, y)
+            img.Pix[i], img.Pix[i+1], img.Pix[i+2] = colorspace.Convert8(p.R, p.G, p.B, nif.Header.ColorSpace, colorspace.SRGB)
+            img.Pix[i+3] = 0xff
+        }
+    }
+    return img
+}
+
+func (ni *NestedImage) ToImage() *image.RGBA {
+    img := image.NewRGBA(image.Rect(0, 0, int(ni.Width), int(ni.Height)))
+    for i := 0; i*3+2 < len(ni.Data) && i*4 < len(img.Pix); i++ {
+        copy(img.Pix[i*4:i*4+3], ni.Data[i*3:i*3+3])
+        img.Pix[i*4+3] = 0xff
+    }
+    return img
+}
@@ -0,0 +1,70 @@
+package nest
+
+import (
+    "image"
+    "slices"
+)
+
+// Extract reads the part of the main image inside rect as a standalone
+// file, touching only the tiles under rect, the nested images it links to
+// and the metadata. Tiles are checked against their checksums when the file
+// has them. Links are renumbered to the nested images that were kept; link
+// channels and the pyramid are left out. A transform is kept, shifted so the
+// region still lands where it did, and so is the no-data mask under rect.
+func (nr *Reader) Extract(rect image.Rectangle) (*NestedImageFile, error) {
+    rect = rect.Intersect(nr.Bounds())
+    region, err := nr.ReadRegion(rect)
+    if err != nil {
+        return nil, err
+    }
+    meta, err := nr.Metadata()
+    if err != nil {
+        return nil, err
+    }
+    out := &NestedImageFile{Header: nr.Header, MainImage: region, Metadata: meta}
+    out.Header.Width, out.Header.Height = uint32(rect.Dx()), uint32(rect.Dy())
+    out.Header.NestedCount = 0
+    if out.Transform, err = nr.Transform(); err != nil {
+        return nil, err
+    }
+    if out.Transform != nil {
+        out.Transform = append(TransformChain{Translate(float64(rect.Min.X), float64(rect.Min.Y))}, out.Transform...)
+    }
+    mask, err := nr.NoData()
+    if err != nil {
+        return nil, err
+    }
+    out.NoData = mask.sub(rect)
+    if nr.Header.Payload != PayloadLink {
+        return out, nil
+    }
+
+    renumber := map[uint32]uint32{}
+    for _, row := range region {
+        for _, p := range row {
+            if p.NestedIdx != 0 {
+                renumber[p.NestedIdx] = 0
+            }
+        }
+    }
+    var want []int
+    for idx := range renumber {
+        want = append(want, int(idx)-1)
+    }
+    slices.Sort(want)
+    images, err := nr.readNestedImages(want)
+    if err != nil {
+        return nil, err
+    }
+    for k, i := range want {
+        renumber[uint32(i+1)] = uint32(k + 1)
+        out.NestedImages = append(out.NestedImages, *images[k])
+    }
+    for _, row := range region {
+        for x := range row {
+            row[x].NestedIdx = renumber[row[x].NestedIdx]
+        }
+    }
+    out.Header.NestedCount = uint32(len(out.NestedImages))
+    return out, nil
+}
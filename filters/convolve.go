@@ -0,0 +1,156 @@
+package filters
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "math"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// Kernel is a convolution filter. Apply reads an apron of Halo pixels from
+// the neighboring tiles, so each tile comes out as if the whole image had
+// been convolved at once; only at the edges of the image are samples past
+// the edge taken from the nearest edge pixel.
+type Kernel struct {
+    // Width and Height are the odd size of the matrix.
+    Width, Height int
+    // Weights holds the matrix row by row, centered on the output pixel.
+    Weights []float64
+    // Offset is added to every result, such as 128 to show the signed
+    // response of an edge kernel around middle gray.
+    Offset float64
+}
+
+// BoxBlur returns a kernel averaging the square of the given radius around
+// each pixel.
+func BoxBlur(radius int) *Kernel {
+    n := 2*radius + 1
+    k := &Kernel{Width: n, Height: n, Weights: make([]float64, n*n)}
+    for i := range k.Weights {
+        k.Weights[i] = 1 / float64(n*n)
+    }
+    return k
+}
+
+// Laplacian returns a kernel responding to edges in every direction, shown
+// around middle gray.
+func Laplacian() *Kernel {
+    return &Kernel{Width: 3, Height: 3, Weights: []float64{0, 1, 0, 1, -4, 1, 0, 1, 0}, Offset: 128}
+}
+
+// Emboss returns a kernel shading edges as if lit from the top left.
+func Emboss() *Kernel {
+    return &Kernel{Width: 3, Height: 3, Weights: []float64{-2, -1, 0, -1, 1, 1, 0, 1, 2}}
+}
+
+func (k *Kernel) check() error {
+    if k.Width <= 0 || k.Height <= 0 || k.Width%2 == 0 || k.Height%2 == 0 {
+        return fmt.Errorf("kernel size %dx%d is not odd", k.Width, k.Height)
+    }
+    if len(k.Weights) != k.Width*k.Height {
+        return fmt.Errorf("%dx%d kernel has %d weights", k.Width, k.Height, len(k.Weights))
+    }
+    return nil
+}
+
+func (k *Kernel) Halo() int {
+    return max(k.Width, k.Height) / 2
+}
+
+func (k *Kernel) Tile(dst, src *image.RGBA) {
+    rx, ry := k.Width/2, k.Height/2
+    r, b := dst.Rect, src.Rect
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        i := dst.PixOffset(r.Min.X, y)
+        for x := r.Min.X; x < r.Max.X; x, i = x+1, i+4 {
+            var sum [3]float64
+            for ky := 0; ky < k.Height; ky++ {
+                sy := min(max(y+ky-ry, b.Min.Y), b.Max.Y-1)
+                for kx := 0; kx < k.Width; kx++ {
+                    w := k.Weights[ky*k.Width+kx]
+                    s := src.PixOffset(min(max(x+kx-rx, b.Min.X), b.Max.X-1), sy)
+                    sum[0] += w * float64(src.Pix[s])
+                    sum[1] += w * float64(src.Pix[s+1])
+                    sum[2] += w * float64(src.Pix[s+2])
+                }
+            }
+            for ch, v := range sum {
+                dst.Pix[i+ch] = clamp8(v + k.Offset)
+            }
+            dst.Pix[i+3] = 0xff
+        }
+    }
+}
+
+// Blur is a Gaussian blur with standard deviation Sigma. It is separable,
+// so it stays fast for large radii where a Kernel would not.
+type Blur struct {
+    Sigma float64
+}
+
+func (bl *Blur) Halo() int {
+    return int(math.Ceil(3 * bl.Sigma))
+}
+
+func (bl *Blur) Tile(dst, src *image.RGBA) {
+    blur := gaussianBlur(src, bl.Sigma, dst.Rect)
+    for i, j := 0, 0; i < len(dst.Pix); i, j = i+4, j+3 {
+        dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = clamp8(blur[j]), clamp8(blur[j+1]), clamp8(blur[j+2]), 0xff
+    }
+}
+
+// Sobel marks edges with the magnitude of the Sobel gradient of each
+// channel, black on flat areas and bright across sharp edges.
+type Sobel struct{}
+
+func (Sobel) Halo() int { return 1 }
+
+func (Sobel) Tile(dst, src *image.RGBA) {
+    r, b := dst.Rect, src.Rect
+    at := func(x, y, ch int) float64 {
+        return float64(src.Pix[src.PixOffset(min(max(x, b.Min.X), b.Max.X-1), min(max(y, b.Min.Y), b.Max.Y-1))+ch])
+    }
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        i := dst.PixOffset(r.Min.X, y)
+        for x := r.Min.X; x < r.Max.X; x, i = x+1, i+4 {
+            for ch := 0; ch < 3; ch++ {
+                gx := at(x+1, y-1, ch) + 2*at(x+1, y, ch) + at(x+1, y+1, ch) - at(x-1, y-1, ch) - 2*at(x-1, y, ch) - at(x-1, y+1, ch)
+                gy := at(x-1, y+1, ch) + 2*at(x, y+1, ch) + at(x+1, y+1, ch) - at(x-1, y-1, ch) - 2*at(x, y-1, ch) - at(x+1, y-1, ch)
+                dst.Pix[i+ch] = clamp8(math.Hypot(gx, gy))
+            }
+            dst.Pix[i+3] = 0xff
+        }
+    }
+}
+
+func clamp8(v float64) uint8 {
+    return uint8(math.Round(min(max(v, 0), 255)))
+}
+
+// Region filters rect of the main image of the file nr reads, decoding only
+// the tiles under rect and its apron. Filters that implement Preparer need
+// the whole image and are refused. The image bounds are rect after
+// clipping.
+func Region(nr *nest.Reader, rect image.Rectangle, f Filter) (*image.RGBA, error) {
+    if _, ok := f.(Preparer); ok {
+        return nil, fmt.Errorf("filter %T depends on the whole image", f)
+    }
+    if c, ok := f.(interface{ check() error }); ok {
+        if err := c.check(); err != nil {
+            return nil, err
+        }
+    }
+    rect = rect.Intersect(nr.Bounds())
+    if rect.Empty() {
+        return nil, errors.New("region does not overlap the image")
+    }
+    src, err := nr.ReadRegionAs(rect.Inset(-f.Halo()), nest.FormatRGBA)
+    if err != nil {
+        return nil, err
+    }
+    dst := image.NewRGBA(rect)
+    f.Tile(dst, src.(*image.RGBA))
+    return dst, nil
+}
@@ -0,0 +1,306 @@
+// Package filters makes common photographic fixes to the main image of a
+// NEST file, such as auto-contrast and sharpening, without exporting it to
+// another tool and losing the link plane. Filters run tile by tile and only
+// change colors; every pixel keeps its link, and pixels marked as holding
+// no data are left alone.
+package filters
+
+import (
+    "fmt"
+    "image"
+    "math"
+
+    nest "github.com/70ziko/NEST"
+    "github.com/70ziko/NEST/colorspace"
+    "github.com/70ziko/NEST/tilemath"
+)
+
+// Filter recolors the main image one tile at a time. Colors are 8-bit sRGB
+// whatever the color space the file stores.
+type Filter interface {
+    // Halo is how many pixels around a tile the filter reads.
+    Halo() int
+    // Tile writes the filtered colors of dst.Rect, reading src, which covers
+    // dst.Rect grown by Halo and clipped to the image.
+    Tile(dst, src *image.RGBA)
+}
+
+// A Histogram counts the sRGB values of each channel over the pixels of an
+// image that hold data.
+type Histogram [3][256]uint64
+
+// Preparer is implemented by filters that depend on the whole image, such
+// as Equalize. Apply calls Prepare with the image's histogram before
+// filtering any tile.
+type Preparer interface {
+    Prepare(h *Histogram)
+}
+
+// Apply runs the filters over the main image of nif in turn. Each filter
+// sees the output of the one before. Pyramid levels are not refreshed;
+// call RebuildPyramid afterwards.
+func Apply(nif *nest.NestedImageFile, filters ...Filter) error {
+    w, h := int(nif.Header.Width), int(nif.Header.Height)
+    if len(nif.MainImage) < h {
+        return fmt.Errorf("main image has %d rows, the header says %d", len(nif.MainImage), h)
+    }
+    ts := int(nif.Header.TileSize)
+    if ts == 0 {
+        ts = nest.DefaultTileSize
+    }
+    grid := tilemath.NewGrid(w, h, ts)
+    for _, f := range filters {
+        if c, ok := f.(interface{ check() error }); ok {
+            if err := c.check(); err != nil {
+                return err
+            }
+        }
+        if p, ok := f.(Preparer); ok {
+            p.Prepare(histogram(nif, grid))
+        }
+        // Tiles are stored once every tile has been filtered when the filter
+        // reads its neighbors, so none of them sees filtered input.
+        halo := f.Halo()
+        var pending []*image.RGBA
+        for ty := 0; ty < grid.Rows(); ty++ {
+            for tx := 0; tx < grid.Cols(); tx++ {
+                r := grid.TileBounds(tx, ty)
+                dst := image.NewRGBA(r)
+                f.Tile(dst, load(nif, r.Inset(-halo).Intersect(grid.Bounds())))
+                if halo > 0 {
+                    pending = append(pending, dst)
+                } else {
+                    store(nif, dst)
+                }
+            }
+        }
+        for _, dst := range pending {
+            store(nif, dst)
+        }
+    }
+    return nil
+}
+
+// load reads the main image colors inside r as sRGB.
+func load(nif *nest.NestedImageFile, r image.Rectangle) *image.RGBA {
+    img := image.NewRGBA(r)
+    space := nif.Header.ColorSpace
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        i := img.PixOffset(r.Min.X, y)
+        for _, p := range nif.MainImage[y][r.Min.X:r.Max.X] {
+            img.Pix[i], img.Pix[i+1], img.Pix[i+2] = colorspace.Convert8(p.R, p.G, p.B, space, colorspace.SRGB)
+            img.Pix[i+3] = 0xff
+            i += 4
+        }
+    }
+    return img
+}
+
+// store writes the colors of img back into the main image, keeping links
+// and skipping pixels without data.
+func store(nif *nest.NestedImageFile, img *image.RGBA) {
+    r, space := img.Rect, nif.Header.ColorSpace
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        i := img.PixOffset(r.Min.X, y)
+        row := nif.MainImage[y]
+        for x := r.Min.X; x < r.Max.X; x, i = x+1, i+4 {
+            if !nif.NoData.Valid(x, y) {
+                continue
+            }
+            p := &row[x]
+            p.R, p.G, p.B = colorspace.Convert8(img.Pix[i], img.Pix[i+1], img.Pix[i+2], colorspace.SRGB, space)
+        }
+    }
+}
+
+func histogram(nif *nest.NestedImageFile, grid tilemath.Grid) *Histogram {
+    var h Histogram
+    for ty := 0; ty < grid.Rows(); ty++ {
+        for tx := 0; tx < grid.Cols(); tx++ {
+            img := load(nif, grid.TileBounds(tx, ty))
+            r := img.Rect
+            for y := r.Min.Y; y < r.Max.Y; y++ {
+                i := img.PixOffset(r.Min.X, y)
+                for x := r.Min.X; x < r.Max.X; x, i = x+1, i+4 {
+                    if !nif.NoData.Valid(x, y) {
+                        continue
+                    }
+                    h[0][img.Pix[i]]++
+                    h[1][img.Pix[i+1]]++
+                    h[2][img.Pix[i+2]]++
+                }
+            }
+        }
+    }
+    return &h
+}
+
+// curves is a Filter mapping each channel through a lookup table.
+type curves [3][256]uint8
+
+func (c *curves) Halo() int { return 0 }
+
+func (c *curves) Tile(dst, src *image.RGBA) {
+    for i := 0; i < len(src.Pix); i += 4 {
+        dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = c[0][src.Pix[i]], c[1][src.Pix[i+1]], c[2][src.Pix[i+2]], src.Pix[i+3]
+    }
+}
+
+// AutoContrast stretches each channel so its darkest and brightest values
+// span the full range, ignoring Cutoff percent of the pixels at each end so
+// a few outliers don't defeat it.
+type AutoContrast struct {
+    Cutoff float64
+    curves
+}
+
+func (a *AutoContrast) Prepare(h *Histogram) {
+    for ch, counts := range h {
+        var total uint64
+        for _, n := range counts {
+            total += n
+        }
+        skip := uint64(float64(total) * min(max(a.Cutoff, 0), 50) / 100)
+        lo, hi := 0, 255
+        for n := uint64(0); lo < 255; lo++ {
+            if n += counts[lo]; n > skip {
+                break
+            }
+        }
+        for n := uint64(0); hi > 0; hi-- {
+            if n += counts[hi]; n > skip {
+                break
+            }
+        }
+        for v := range a.curves[ch] {
+            if hi <= lo {
+                a.curves[ch][v] = uint8(v)
+                continue
+            }
+            a.curves[ch][v] = uint8(math.Round(min(max(float64(v-lo)*255/float64(hi-lo), 0), 255)))
+        }
+    }
+}
+
+// Equalize spreads the values of each channel so they are about evenly
+// used, bringing out detail in images whose tones are bunched together.
+type Equalize struct {
+    curves
+}
+
+func (e *Equalize) Prepare(h *Histogram) {
+    for ch, counts := range h {
+        var total, first uint64
+        for _, n := range counts {
+            if first == 0 {
+                first = n
+            }
+            total += n
+        }
+        var cum uint64
+        for v, n := range counts {
+            cum += n
+            if total == first {
+                e.curves[ch][v] = uint8(v)
+                continue
+            }
+            // The cumulative count is rescaled so the darkest value used maps
+            // to 0 and the brightest to 255.
+            e.curves[ch][v] = uint8(math.Round(float64(cum-min(cum, first)) * 255 / float64(total-first)))
+        }
+    }
+}
+
+// Gamma returns a filter raising values to 1/g, brightening midtones when g
+// is above 1 as Adjustments.Gamma does for display.
+func Gamma(g float64) Filter {
+    c := &curves{}
+    for v := range c[0] {
+        out := uint8(v)
+        if g > 0 {
+            out = uint8(math.Round(math.Pow(float64(v)/255, 1/g) * 255))
+        }
+        c[0][v], c[1][v], c[2][v] = out, out, out
+    }
+    return c
+}
+
+// UnsharpMask sharpens by adding back Amount times the difference between
+// the image and a Gaussian blur of it with standard deviation Radius.
+// Differences below Threshold are left alone so noise isn't amplified.
+type UnsharpMask struct {
+    Radius    float64
+    Amount    float64
+    Threshold uint8
+}
+
+func (u *UnsharpMask) Halo() int {
+    return int(math.Ceil(3 * u.Radius))
+}
+
+func (u *UnsharpMask) Tile(dst, src *image.RGBA) {
+    blur := gaussianBlur(src, u.Radius, dst.Rect)
+    for y := dst.Rect.Min.Y; y < dst.Rect.Max.Y; y++ {
+        i, j := dst.PixOffset(dst.Rect.Min.X, y), src.PixOffset(dst.Rect.Min.X, y)
+        for x := dst.Rect.Min.X; x < dst.Rect.Max.X; x, i, j = x+1, i+4, j+4 {
+            for ch := 0; ch < 3; ch++ {
+                v := float64(src.Pix[j+ch])
+                d := v - blur[((y-dst.Rect.Min.Y)*dst.Rect.Dx()+x-dst.Rect.Min.X)*3+ch]
+                if math.Abs(d) >= float64(u.Threshold) {
+                    v += u.Amount * d
+                }
+                dst.Pix[i+ch] = clamp8(v)
+            }
+            dst.Pix[i+3] = src.Pix[j+3]
+        }
+    }
+}
+
+// gaussianBlur returns the RGB of src blurred with standard deviation sigma
+// inside r, as floats. Samples past the edge of src repeat the edge.
+func gaussianBlur(src *image.RGBA, sigma float64, r image.Rectangle) []float64 {
+    n := int(math.Ceil(3 * sigma))
+    kernel := make([]float64, 2*n+1)
+    var sum float64
+    for k := range kernel {
+        d := float64(k - n)
+        kernel[k] = 1
+        if sigma > 0 {
+            kernel[k] = math.Exp(-d * d / (2 * sigma * sigma))
+        }
+        sum += kernel[k]
+    }
+    for k := range kernel {
+        kernel[k] /= sum
+    }
+
+    // Blur rows first, over every row of src that the columns pass reads.
+    b := src.Bounds()
+    rows := image.Rect(r.Min.X, max(r.Min.Y-n, b.Min.Y), r.Max.X, min(r.Max.Y+n, b.Max.Y))
+    tmp := make([]float64, rows.Dx()*rows.Dy()*3)
+    for y := rows.Min.Y; y < rows.Max.Y; y++ {
+        for x := rows.Min.X; x < rows.Max.X; x++ {
+            t := ((y-rows.Min.Y)*rows.Dx() + x - rows.Min.X) * 3
+            for k, w := range kernel {
+                s := src.PixOffset(min(max(x+k-n, b.Min.X), b.Max.X-1), y)
+                tmp[t] += w * float64(src.Pix[s])
+                tmp[t+1] += w * float64(src.Pix[s+1])
+                tmp[t+2] += w * float64(src.Pix[s+2])
+            }
+        }
+    }
+    out := make([]float64, r.Dx()*r.Dy()*3)
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        for x := r.Min.X; x < r.Max.X; x++ {
+            o := ((y-r.Min.Y)*r.Dx() + x - r.Min.X) * 3
+            for k, w := range kernel {
+                sy := min(max(y+k-n, rows.Min.Y), rows.Max.Y-1)
+                t := ((sy-rows.Min.Y)*rows.Dx() + x - rows.Min.X) * 3
+                out[o] += w * tmp[t]
+                out[o+1] += w * tmp[t+1]
+                out[o+2] += w * tmp[t+2]
+            }
+        }
+    }
+    return out
+}
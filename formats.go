@@ -0,0 +1,174 @@
+package nest
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "image"
+    "image/jpeg"
+    "image/png"
+    "io"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+)
+
+// An Importer decodes a source file. Formats without layers return a
+// LayeredImage from SingleLayer.
+type Importer func(r io.ReaderAt, size int64) (*LayeredImage, error)
+
+// An Exporter encodes nif in some format.
+type Exporter func(w io.Writer, nif *NestedImageFile) error
+
+var (
+    importers sync.Map
+    exporters sync.Map
+)
+
+func init() {
+    for _, ext := range []string{".png", ".jpg", ".jpeg"} {
+        RegisterImporter(ext, decodeStandard)
+    }
+    RegisterImporter(".psd", func(r io.ReaderAt, size int64) (*LayeredImage, error) {
+        return DecodePSD(io.NewSectionReader(r, 0, size))
+    })
+    RegisterImporter(".ora", DecodeORA)
+
+    RegisterExporter(".ora", EncodeORA)
+    RegisterExporter(".png", func(w io.Writer, nif *NestedImageFile) error {
+        return png.Encode(w, nif.ToImage())
+    })
+    RegisterExporter(".jpg", encodeJPEG)
+    RegisterExporter(".jpeg", encodeJPEG)
+}
+
+// RegisterImporter makes ImportFile and the nest tool read files whose
+// extension is ext, such as ".heic", with fn. Packages adding a format
+// usually register it from an init function, so importing them for their
+// side effects is enough, as with image.RegisterFormat. A later
+// registration for the same extension replaces the earlier one.
+func RegisterImporter(ext string, fn Importer) {
+    importers.Store(formatKey(ext), fn)
+}
+
+// RegisterExporter makes ExportFile and nest export write files whose
+// extension is ext with fn.
+func RegisterExporter(ext string, fn Exporter) {
+    exporters.Store(formatKey(ext), fn)
+}
+
+func formatKey(ext string) string {
+    ext = strings.ToLower(ext)
+    if !strings.HasPrefix(ext, ".") {
+        ext = "." + ext
+    }
+    return ext
+}
+
+// ImporterFor returns the importer registered for path's extension, or nil.
+func ImporterFor(path string) Importer {
+    if fn, ok := importers.Load(formatKey(filepath.Ext(path))); ok {
+        return fn.(Importer)
+    }
+    return nil
+}
+
+// ExporterFor returns the exporter registered for path's extension, or nil.
+func ExporterFor(path string) Exporter {
+    if fn, ok := exporters.Load(formatKey(filepath.Ext(path))); ok {
+        return fn.(Exporter)
+    }
+    return nil
+}
+
+// ImportExtensions and ExportExtensions list the registered extensions in
+// order.
+func ImportExtensions() []string {
+    return formatKeys(&importers)
+}
+
+func ExportExtensions() []string {
+    return formatKeys(&exporters)
+}
+
+func formatKeys(m *sync.Map) []string {
+    var exts []string
+    m.Range(func(k, _ any) bool {
+        exts = append(exts, k.(string))
+        return true
+    })
+    slices.Sort(exts)
+    return exts
+}
+
+// ErrUnknownFormat is returned for files whose extension has no importer or
+// exporter registered.
+var ErrUnknownFormat = errors.New("unknown file format")
+
+// ImportFile decodes path with the importer registered for its extension.
+func ImportFile(path string) (*LayeredImage, error) {
+    fn := ImporterFor(path)
+    if fn == nil {
+        return nil, fmt.Errorf("%s: %w", path, ErrUnknownFormat)
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    li, err := fn(f, info.Size())
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+    }
+    return li, nil
+}
+
+// ExportFile writes nif to path with the exporter registered for its
+// extension.
+func ExportFile(path string, nif *NestedImageFile) error {
+    fn := ExporterFor(path)
+    if fn == nil {
+        return fmt.Errorf("%s: %w", path, ErrUnknownFormat)
+    }
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(f)
+    if err := fn(w, nif); err != nil {
+        f.Close()
+        return fmt.Errorf("failed to encode %s: %w", path, err)
+    }
+    if err := w.Flush(); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// SingleLayer wraps an image without layers for an Importer to return.
+func SingleLayer(img image.Image) *LayeredImage {
+    b := img.Bounds()
+    return &LayeredImage{Width: b.Dx(), Height: b.Dy(), Composite: img}
+}
+
+// decodeStandard reads any format registered with the image package.
+func decodeStandard(r io.ReaderAt, size int64) (*LayeredImage, error) {
+    img, _, err := image.Decode(io.NewSectionReader(r, 0, size))
+    if err != nil {
+        return nil, err
+    }
+    return SingleLayer(img), nil
+}
+
+// encodeJPEG writes the main image at the default JPEG quality. Links and
+// nested images are lost.
+func encodeJPEG(w io.Writer, nif *NestedImageFile) error {
+    return jpeg.Encode(w, nif.ToImage(), nil)
+}
@@ -0,0 +1,126 @@
+package nest
+
+import (
+    "image"
+    "image/color"
+)
+
+// Frame is a rectangular view of a main image. Like image.RGBA.SubImage, a
+// sub-frame shares pixels with the image it was cut from and keeps its
+// coordinates, so (x, y) addresses the same pixel in both.
+//
+// Frame implements draw.Image, so image/draw and font drawers can paint onto
+// it. Colors are the file's samples as stored, without color space
+// conversion. At returns PixeLinkColor values; Set stores the link of a
+// PixeLinkColor and keeps the pixel's link for any other color, so painting
+// leaves links alone while a draw.Src copy between frames carries them.
+type Frame struct {
+    Rect image.Rectangle
+
+    file *NestedImageFile
+    // rows[y-Rect.Min.Y][x-Rect.Min.X] is the pixel at (x, y).
+    rows [][]PixeLink
+}
+
+// Frame returns a view of the whole main image.
+func (nif *NestedImageFile) Frame() *Frame {
+    return &Frame{Rect: nif.Bounds(), file: nif, rows: nif.MainImage}
+}
+
+// SubImage returns a view of the part of the main image inside r.
+func (nif *NestedImageFile) SubImage(r image.Rectangle) *Frame {
+    return nif.Frame().SubImage(r)
+}
+
+// SubImage returns a view of the part of f inside r. Only the row headers are
+// allocated; pixels stay shared.
+func (f *Frame) SubImage(r image.Rectangle) *Frame {
+    r = r.Intersect(f.Rect)
+    if r.Empty() {
+        return &Frame{file: f.file}
+    }
+    rows := make([][]PixeLink, r.Dy())
+    for y := range rows {
+        row := f.rows[r.Min.Y-f.Rect.Min.Y+y]
+        rows[y] = row[r.Min.X-f.Rect.Min.X : r.Max.X-f.Rect.Min.X : r.Max.X-f.Rect.Min.X]
+    }
+    return &Frame{Rect: r, file: f.file, rows: rows}
+}
+
+func (f *Frame) Bounds() image.Rectangle {
+    return f.Rect
+}
+
+// PixeLinkAt returns the PixeLink at (x, y), or the zero PixeLink outside f.
+func (f *Frame) PixeLinkAt(x, y int) PixeLink {
+    if !(image.Point{x, y}).In(f.Rect) {
+        return PixeLink{}
+    }
+    return f.rows[y-f.Rect.Min.Y][x-f.Rect.Min.X]
+}
+
+// SetPixeLink stores p at (x, y), ignoring coordinates outside f.
+func (f *Frame) SetPixeLink(x, y int, p PixeLink) {
+    if !(image.Point{x, y}).In(f.Rect) {
+        return
+    }
+    f.rows[y-f.Rect.Min.Y][x-f.Rect.Min.X] = p
+    f.touch(x, y)
+}
+
+func (f *Frame) ColorModel() color.Model {
+    return PixeLinkModel
+}
+
+func (f *Frame) At(x, y int) color.Color {
+    return PixeLinkColor(f.PixeLinkAt(x, y))
+}
+
+// Set paints c at (x, y). The main image has no alpha, so a translucent c is
+// stored as if composited over black; draw.Draw with draw.Over already
+// blends with At before calling Set.
+func (f *Frame) Set(x, y int, c color.Color) {
+    if !(image.Point{x, y}).In(f.Rect) {
+        return
+    }
+    p := &f.rows[y-f.Rect.Min.Y][x-f.Rect.Min.X]
+    f.touch(x, y)
+    if c, ok := c.(PixeLinkColor); ok {
+        *p = PixeLink(c)
+        return
+    }
+    r, g, b, _ := c.RGBA()
+    p.R, p.G, p.B = uint8(r>>8), uint8(g>>8), uint8(b>>8)
+}
+
+func (f *Frame) touch(x, y int) {
+    if f.file.Audit != nil {
+        f.file.Audit.touch(x, y)
+    }
+}
+
+// Rows returns the frame's pixels row by row, starting at Rect.Min. Writes
+// through them change the underlying image.
+func (f *Frame) Rows() [][]PixeLink {
+    return f.rows
+}
+
+// File returns a file whose main image is f, so a window of a larger image
+// can be written on its own. Pixels, nested images, metadata and chunks are
+// shared with the source file; link channels, focal planes, bands and the
+// pyramid are dropped since they cover the whole image.
+func (f *Frame) File() *NestedImageFile {
+    out := &NestedImageFile{
+        Header:       f.file.Header,
+        MainImage:    f.rows,
+        NestedImages: f.file.NestedImages,
+        Metadata:     f.file.Metadata,
+        Chunks:       f.file.Chunks,
+    }
+    out.Header.Width, out.Header.Height = uint32(f.Rect.Dx()), uint32(f.Rect.Dy())
+    out.NoData = f.file.NoData.sub(f.Rect)
+    if f.file.Transform != nil {
+        out.Transform = append(TransformChain{Translate(float64(f.Rect.Min.X), float64(f.Rect.Min.Y))}, f.file.Transform...)
+    }
+    return out
+}
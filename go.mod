@@ -1,3 +1,10 @@
 module github.com/70ziko/NEST
 
-go 1.22.1
+go 1.23
+
+require (
+	github.com/klauspost/compress v1.18.4
+	golang.org/x/image v0.24.0
+)
+
+require golang.org/x/text v0.22.0 // indirect
@@ -0,0 +1,274 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "sync"
+
+    "github.com/70ziko/NEST/colorspace"
+)
+
+type Endianness uint8
+
+const (
+    LittleEndian Endianness = iota
+    BigEndian
+)
+
+var (
+    littleEndianMark = [2]byte{'I', 'I'}
+    bigEndianMark    = [2]byte{'M', 'M'}
+)
+
+func (e Endianness) order() binary.ByteOrder {
+    if e == BigEndian {
+        return binary.BigEndian
+    }
+    return binary.LittleEndian
+}
+
+func (e Endianness) mark() [2]byte {
+    if e == BigEndian {
+        return bigEndianMark
+    }
+    return littleEndianMark
+}
+
+func (e Endianness) String() string {
+    if e == BigEndian {
+        return "big-endian"
+    }
+    return "little-endian"
+}
+
+func ParseEndianness(s string) (Endianness, error) {
+    for _, e := range []Endianness{LittleEndian, BigEndian} {
+        if e.String() == s {
+            return e, nil
+        }
+    }
+    return LittleEndian, fmt.Errorf("unknown byte order %q", s)
+}
+
+// headerBody holds the fields that follow the fixed prefix. New fields are
+// only ever appended, and HeaderSize lets readers ignore ones they don't know.
+type headerBody struct {
+    Width       uint32
+    Height      uint32
+    TileSize    uint16
+    NestedCount uint32
+    TileOrder   uint8
+    ColorSpace  uint8
+    LinkBits    uint8
+    Payload     uint8
+    Bands       uint16
+    Orientation uint8
+    // Dictionary is the ID of the tiles' preset dictionary, and
+    // DictionarySize the length of the copy embedded after the body, zero
+    // for a shared dictionary.
+    Dictionary     uint32
+    DictionarySize uint16
+}
+
+// On disk since version 3:
+//
+//    Magic [4]byte | ByteOrder "II"/"MM" | Version | HeaderSize | body | dictionary
+//
+// Versions 1 and 2 have no byte order mark and are always little-endian.
+// An embedded dictionary counts toward HeaderSize. dict is embedded when set.
+func (h *FileHeader) write(writer io.Writer, dict *Dictionary) error {
+    order := h.ByteOrder.order()
+    mark := h.ByteOrder.mark()
+    body := h.body()
+    var embedded []byte
+    if dict != nil {
+        embedded = dict.Data
+        body.DictionarySize = uint16(len(embedded))
+    }
+
+    if _, err := writer.Write(h.Magic[:]); err != nil {
+        return err
+    }
+    if _, err := writer.Write(mark[:]); err != nil {
+        return err
+    }
+    if err := binary.Write(writer, order, h.Version); err != nil {
+        return err
+    }
+    if err := binary.Write(writer, order, uint16(binary.Size(body)+len(embedded))); err != nil {
+        return err
+    }
+    if err := binary.Write(writer, order, &body); err != nil {
+        return err
+    }
+    _, err := writer.Write(embedded)
+    return err
+}
+
+// read returns the dictionary the tiles were compressed with: the embedded
+// copy, or the registered shared one. It is nil when there is none, or when
+// a shared dictionary isn't registered; decoding zstd planes fails then.
+func (h *FileHeader) read(reader io.Reader) (*Dictionary, error) {
+    if _, err := io.ReadFull(reader, h.Magic[:]); err != nil {
+        return nil, err
+    }
+    if string(h.Magic[:]) != MAGIC {
+        return nil, errors.New("invalid file format")
+    }
+
+    var mark [2]byte
+    if _, err := io.ReadFull(reader, mark[:]); err != nil {
+        return nil, err
+    }
+
+    var body headerBody
+    var raw []byte
+    switch mark {
+    case littleEndianMark, bigEndianMark:
+        h.ByteOrder = LittleEndian
+        if mark == bigEndianMark {
+            h.ByteOrder = BigEndian
+        }
+        order := h.ByteOrder.order()
+        if err := binary.Read(reader, order, &h.Version); err != nil {
+            return nil, err
+        }
+        var size uint16
+        if err := binary.Read(reader, order, &size); err != nil {
+            return nil, err
+        }
+        var err error
+        if raw, err = readHeaderBody(reader, order, int(size), &body); err != nil {
+            return nil, err
+        }
+    default:
+        h.ByteOrder = LittleEndian
+        h.Version = binary.LittleEndian.Uint16(mark[:])
+        if _, err := readHeaderBody(reader, binary.LittleEndian, legacyBodySize, &body); err != nil {
+            return nil, err
+        }
+    }
+
+    if h.Version < 1 || h.Version > VERSION {
+        return nil, fmt.Errorf("unsupported file format version %d", h.Version)
+    }
+    h.setBody(body)
+    switch h.LinkBits {
+    case 0, 8, 16, 32:
+    default:
+        return nil, fmt.Errorf("unsupported link width of %d bits", h.LinkBits)
+    }
+    if h.Payload > PayloadFloat {
+        return nil, fmt.Errorf("unknown payload kind %d", h.Payload)
+    }
+    if h.Orientation > OrientationRotate270 {
+        return nil, fmt.Errorf("unknown orientation %d", h.Orientation)
+    }
+    if h.Dictionary == 0 {
+        return nil, nil
+    }
+    if body.DictionarySize == 0 {
+        return registeredDictionary(h.Dictionary), nil
+    }
+    n := int(body.DictionarySize)
+    if n > len(raw)-binary.Size(body) {
+        return nil, fmt.Errorf("header is too short for its %d byte dictionary", n)
+    }
+    dict := &Dictionary{Data: raw[len(raw)-n:]}
+    if dict.ID() != h.Dictionary {
+        return nil, fmt.Errorf("embedded dictionary does not match its ID %08x", h.Dictionary)
+    }
+    return dict, nil
+}
+
+// Versions 1 and 2 stored Width, Height, TileSize and NestedCount only.
+const legacyBodySize = 14
+
+// readHeaderBody reads size bytes of header body. Fields missing from older
+// headers decode as zero and unknown trailing fields are ignored. It returns
+// the raw body, which ends with any embedded dictionary so that fields
+// added later still come before it.
+func readHeaderBody(reader io.Reader, order binary.ByteOrder, size int, body *headerBody) ([]byte, error) {
+    raw := make([]byte, size)
+    if _, err := io.ReadFull(reader, raw); err != nil {
+        return nil, err
+    }
+    buf := make([]byte, binary.Size(body))
+    copy(buf, raw)
+    return raw, binary.Read(bytes.NewReader(buf), order, body)
+}
+
+func (h *FileHeader) body() headerBody {
+    return headerBody{
+        Width:       h.Width,
+        Height:      h.Height,
+        TileSize:    h.TileSize,
+        NestedCount: h.NestedCount,
+        TileOrder:   uint8(h.TileOrder),
+        ColorSpace:  uint8(h.ColorSpace),
+        LinkBits:    h.LinkBits,
+        Payload:     uint8(h.Payload),
+        Bands:       h.Bands,
+        Orientation: uint8(h.Orientation),
+        Dictionary:  h.Dictionary,
+    }
+}
+
+func (h *FileHeader) setBody(body headerBody) {
+    h.Width = body.Width
+    h.Height = body.Height
+    h.TileSize = body.TileSize
+    h.NestedCount = body.NestedCount
+    h.TileOrder = TileOrder(body.TileOrder)
+    h.ColorSpace = colorspace.Space(body.ColorSpace)
+    h.LinkBits = body.LinkBits
+    h.Payload = PayloadKind(body.Payload)
+    h.Bands = body.Bands
+    h.Orientation = Orientation(body.Orientation)
+    h.Dictionary = body.Dictionary
+    if h.Version < 6 {
+        h.LinkBits = 32
+    }
+}
+
+// linkBitsFor returns the narrowest link index width that can address count
+// nested images.
+func linkBitsFor(count uint32) uint8 {
+    switch {
+    case count == 0:
+        return 0
+    case count <= math.MaxUint8:
+        return 8
+    case count <= math.MaxUint16:
+        return 16
+    }
+    return 32
+}
+
+// maxTileLength bounds the stored size of one tile: two planes for coded
+// tiles, raw pixels for files older than version 5.
+func (h *FileHeader) maxTileLength() int64 {
+    ts := int64(h.TileSize)
+    if h.Version < 5 {
+        return ts * ts * pixeLinkDiskSize
+    }
+    return 2 * (planeHeaderSize + int64(h.tileCodec(nil).maxPlaneSize()))
+}
+
+// tileCodec returns the codec of the tiles, compressing planes against dict
+// when set.
+func (h *FileHeader) tileCodec(dict *Dictionary) *tileCodec {
+    return &tileCodec{
+        order:     h.ByteOrder.order(),
+        tileSize:  int(h.TileSize),
+        linkBytes: int(h.LinkBits) / 8,
+        signed:    h.Payload == PayloadInt,
+        dict:      dict,
+        dictID:    h.Dictionary,
+        deflaters: &sync.Pool{},
+    }
+}
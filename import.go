@@ -0,0 +1,89 @@
+package nest
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "math"
+)
+
+// HighBitDepthBands name the bands ImportOptions.HighBitDepth stores the
+// red, green and blue samples in.
+var HighBitDepthBands = [3]string{"red", "green", "blue"}
+
+// isDeep reports whether img has more than 8 bits per channel.
+func isDeep(img image.Image) bool {
+    switch img.ColorModel() {
+    case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+        return true
+    }
+    return false
+}
+
+// FromImage builds a file whose main image holds the pixels of img and no
+// links. Alpha is dropped after compositing onto black, and fully
+// transparent pixels become no data when opts.NoDataFromAlpha is set.
+func FromImage(img image.Image, opts ImportOptions) *NestedImageFile {
+    tileSize := opts.TileSize
+    if tileSize == 0 {
+        tileSize = DefaultTileSize
+    }
+    b := img.Bounds()
+    nif := NewNestedImageFile(b.Dx(), b.Dy(), tileSize)
+    nif.Header.ColorSpace = opts.ColorSpace
+    q := newQuantizer(opts, b.Dx())
+    var deep [3][]uint16
+    if opts.HighBitDepth && isDeep(img) {
+        for i := range deep {
+            deep[i] = make([]uint16, 0, b.Dx()*b.Dy())
+        }
+    }
+    for y := 0; y < b.Dy(); y++ {
+        row := nif.MainImage[y]
+        for x := 0; x < b.Dx(); x++ {
+            r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+            p := &row[x]
+            p.R, p.G, p.B = q.pixel(x, y, r, g, bl)
+            if deep[0] != nil {
+                deep[0] = append(deep[0], uint16(r))
+                deep[1] = append(deep[1], uint16(g))
+                deep[2] = append(deep[2], uint16(bl))
+            }
+            if a == 0 && opts.NoDataFromAlpha {
+                if nif.NoData == nil {
+                    nif.NoData = NewNoDataMask(b.Dx(), b.Dy())
+                }
+                nif.NoData.SetValid(x, y, false)
+            }
+        }
+        q.endRow()
+    }
+    if deep[0] != nil {
+        for i, name := range HighBitDepthBands {
+            nif.Bands = append(nif.Bands, Band{Name: name, Samples: deep[i]})
+        }
+    }
+    if opts.Source != "" {
+        nif.RecordProvenance(nif.Bounds(), ProvenanceRecord{Op: OpImport, Source: opts.Source})
+    }
+    return nif
+}
+
+func NewNestedImage(img image.Image) (NestedImage, error) {
+    b := img.Bounds()
+    if b.Dx() > math.MaxUint16 || b.Dy() > math.MaxUint16 {
+        return NestedImage{}, fmt.Errorf("nested image is %dx%d, larger than %d pixels on a side", b.Dx(), b.Dy(), math.MaxUint16)
+    }
+    ni := NestedImage{
+        Width:  uint16(b.Dx()),
+        Height: uint16(b.Dy()),
+        Data:   make([]byte, 0, b.Dx()*b.Dy()*3),
+    }
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+        for x := b.Min.X; x < b.Max.X; x++ {
+            r, g, bl, _ := img.At(x, y).RGBA()
+            ni.Data = append(ni.Data, byte(r>>8), byte(g>>8), byte(bl>>8))
+        }
+    }
+    return ni, nil
+}
@@ -0,0 +1,188 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "unsafe"
+)
+
+type TileIndexEntry struct {
+    Tile   TileCoord
+    Offset int64
+    Length int64
+    // Checksum is the CRC-32C of the stored tile, valid when the index
+    // HasChecksums.
+    Checksum uint32
+}
+
+// TileIndex records where each tile of the main image starts in the file,
+// in the order the tiles were written.
+type TileIndex struct {
+    Order   TileOrder
+    Cols    int
+    Rows    int
+    Entries []TileIndexEntry
+    // HasChecksums is set when the file carries a TSUM chunk.
+    HasChecksums bool
+    // Stats holds one TileStats per entry, in Entries order, when the file
+    // carries a TSTA chunk.
+    Stats []TileStats
+    // Classes holds one TileClass per entry, in Entries order, when the
+    // file carries a TCLS chunk.
+    Classes []TileClass
+
+    byCoord []int
+}
+
+func (ti *TileIndex) Lookup(x, y int) (TileIndexEntry, bool) {
+    i := ti.position(x, y)
+    if i < 0 {
+        return TileIndexEntry{}, false
+    }
+    return ti.Entries[i], true
+}
+
+// position returns the index of the entry for tile (x, y) in Entries, or -1.
+func (ti *TileIndex) position(x, y int) int {
+    if x < 0 || y < 0 || x >= ti.Cols || y >= ti.Rows {
+        return -1
+    }
+    if ti.byCoord == nil {
+        ti.buildLookup(nil)
+    }
+    return ti.byCoord[y*ti.Cols+x]
+}
+
+// buildLookup builds the coordinate lookup position uses, one int per tile
+// of the grid, charging it to budget.
+func (ti *TileIndex) buildLookup(budget *memoryBudget) error {
+    if err := budget.reserve(int64(ti.Cols)*int64(ti.Rows)*int64(unsafe.Sizeof(0)), "tile index lookup"); err != nil {
+        return err
+    }
+    ti.byCoord = make([]int, ti.Cols*ti.Rows)
+    for i := range ti.byCoord {
+        ti.byCoord[i] = -1
+    }
+    for i, e := range ti.Entries {
+        ti.byCoord[e.Tile.Y*ti.Cols+e.Tile.X] = i
+    }
+    return nil
+}
+
+// check rejects entries that lie outside a file of size bytes or claim more
+// than maxLength bytes, before anything allocates buffers for them.
+func (ti *TileIndex) check(size, maxLength int64) error {
+    for _, e := range ti.Entries {
+        if e.Length < 0 || e.Length > maxLength {
+            return fmt.Errorf("tile (%d, %d) has length %d, the limit is %d", e.Tile.X, e.Tile.Y, e.Length, maxLength)
+        }
+        if e.Offset < 0 || e.Offset > size-e.Length {
+            return fmt.Errorf("tile (%d, %d) at offset %d extends past the end of the file", e.Tile.X, e.Tile.Y, e.Offset)
+        }
+    }
+    return nil
+}
+
+type indexHeader struct {
+    Order uint8
+    Cols  uint32
+    Rows  uint32
+    Count uint32
+}
+
+type indexRecord struct {
+    X, Y   uint32
+    Offset uint64
+    Length uint64
+}
+
+func (ti *TileIndex) encode(order binary.ByteOrder) ([]byte, error) {
+    var buf bytes.Buffer
+    hdr := indexHeader{
+        Order: uint8(ti.Order),
+        Cols:  uint32(ti.Cols),
+        Rows:  uint32(ti.Rows),
+        Count: uint32(len(ti.Entries)),
+    }
+    if err := binary.Write(&buf, order, &hdr); err != nil {
+        return nil, err
+    }
+    for _, e := range ti.Entries {
+        rec := indexRecord{
+            X:      uint32(e.Tile.X),
+            Y:      uint32(e.Tile.Y),
+            Offset: uint64(e.Offset),
+            Length: uint64(e.Length),
+        }
+        if err := binary.Write(&buf, order, &rec); err != nil {
+            return nil, err
+        }
+    }
+    return buf.Bytes(), nil
+}
+
+// decodeTileIndex decodes an index of the cols by rows tile grid the header
+// declares, rejecting one for any other grid.
+func decodeTileIndex(reader io.Reader, order binary.ByteOrder, length uint64, cols, rows int) (*TileIndex, error) {
+    var hdr indexHeader
+    if err := binary.Read(reader, order, &hdr); err != nil {
+        return nil, fmt.Errorf("failed to read index header: %w", err)
+    }
+    if int64(hdr.Cols) != int64(cols) || int64(hdr.Rows) != int64(rows) {
+        return nil, fmt.Errorf("index is for a %dx%d tile grid, the header declares %dx%d", hdr.Cols, hdr.Rows, cols, rows)
+    }
+    if uint64(hdr.Count) > uint64(hdr.Cols)*uint64(hdr.Rows) {
+        return nil, fmt.Errorf("index lists %d tiles for a %dx%d grid", hdr.Count, hdr.Cols, hdr.Rows)
+    }
+    if uint64(binary.Size(hdr))+uint64(hdr.Count)*uint64(binary.Size(indexRecord{})) > length {
+        return nil, fmt.Errorf("index lists %d tiles but the chunk is only %d bytes", hdr.Count, length)
+    }
+    ti := &TileIndex{
+        Order:   TileOrder(hdr.Order),
+        Cols:    int(hdr.Cols),
+        Rows:    int(hdr.Rows),
+        Entries: make([]TileIndexEntry, hdr.Count),
+    }
+    for i := range ti.Entries {
+        var rec indexRecord
+        if err := binary.Read(reader, order, &rec); err != nil {
+            return nil, fmt.Errorf("failed to read index entry %d: %w", i, err)
+        }
+        if rec.X >= hdr.Cols || rec.Y >= hdr.Rows {
+            return nil, fmt.Errorf("index entry %d at (%d, %d) is outside the tile grid", i, rec.X, rec.Y)
+        }
+        if rec.Offset > math.MaxInt64 || rec.Length > math.MaxInt64 {
+            return nil, fmt.Errorf("index entry %d has offset %d and length %d", i, rec.Offset, rec.Length)
+        }
+        ti.Entries[i] = TileIndexEntry{
+            Tile:   TileCoord{int(rec.X), int(rec.Y)},
+            Offset: int64(rec.Offset),
+            Length: int64(rec.Length),
+        }
+    }
+    return ti, nil
+}
+
+// ErrOutputTooLarge is returned by writes that would exceed
+// WriteOptions.MaxOutputBytes.
+var ErrOutputTooLarge = errors.New("output exceeds the size limit")
+
+type countingWriter struct {
+    w io.Writer
+    n int64
+    // limit, when positive, is the most bytes the writer accepts.
+    limit int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+    if cw.limit > 0 && cw.n+int64(len(p)) > cw.limit {
+        return 0, fmt.Errorf("%w of %d bytes", ErrOutputTooLarge, cw.limit)
+    }
+    n, err := cw.w.Write(p)
+    cw.n += int64(n)
+    return n, err
+}
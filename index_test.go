@@ -0,0 +1,47 @@
+package nest
+
+import (
+    "bytes"
+    "testing"
+)
+
+// withIndexGrid returns a copy of data whose tile index claims a cols by
+// rows grid.
+func withIndexGrid(t *testing.T, data []byte, cols, rows uint32) []byte {
+    t.Helper()
+    nr, err := NewReader(bytes.NewReader(data), int64(len(data)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    index := int64(-1)
+    err = nr.walkChunks(func(ct ChunkType, offset int64, length uint64) (bool, error) {
+        if ct == ChunkIndex {
+            index = offset
+        }
+        return true, nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if index < 0 {
+        t.Fatal("file has no tile index")
+    }
+    crafted := bytes.Clone(data)
+    nr.order.PutUint32(crafted[index+1:], cols)
+    nr.order.PutUint32(crafted[index+5:], rows)
+    return crafted
+}
+
+// TestNewReaderIndexGrid gives a 64x64 file an index for a grid of 2^34
+// tiles, whose coordinate lookup alone would exhaust memory.
+func TestNewReaderIndexGrid(t *testing.T) {
+    nif := NewNestedImageFile(64, 64, 16)
+    var buf bytes.Buffer
+    if err := nif.Write(&buf); err != nil {
+        t.Fatal(err)
+    }
+    data := withIndexGrid(t, buf.Bytes(), 1<<20, 1<<14)
+    if _, err := NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
+        t.Fatal("NewReader accepted an index for another tile grid")
+    }
+}
@@ -0,0 +1,267 @@
+package nest
+
+import (
+    "fmt"
+    "io"
+    "slices"
+    "strings"
+    "time"
+
+    "github.com/70ziko/NEST/colorspace"
+    "github.com/70ziko/NEST/tilemath"
+)
+
+// IngestChunks are the chunks holding content beyond the pixels and links,
+// which Ingest strips unless IngestPolicy.AllowChunks lists them. The other
+// chunks are derived from the pixels and written anew.
+var IngestChunks = []ChunkType{
+    ChunkMetadata, ChunkAnnotations, ChunkLinkChannel, ChunkRoles,
+    ChunkNestedContent, ChunkTransform, ChunkProvenance, ChunkAudit,
+    ChunkPlane, ChunkBand, ChunkNoData, ChunkTileTimes, ChunkCollab,
+    ChunkLayers, ChunkTemplates, ChunkAdjustments, ChunkCanvas,
+}
+
+type IngestPolicy struct {
+    // UntrustedOptions bound the memory and time the decode may take.
+    UntrustedOptions
+    // MaxWidth and MaxHeight bound the main image. Zero means no limit
+    // beyond MaxMemory.
+    MaxWidth, MaxHeight int
+    // MaxNestedImages bounds the number of nested images. Zero means no
+    // limit beyond MaxMemory.
+    MaxNestedImages int
+    // AllowChunks lists the chunks of IngestChunks to keep.
+    AllowChunks []ChunkType
+    // TileSize the file is retiled to. Zero means DefaultTileSize.
+    TileSize uint16
+    // ColorSpace and ByteOrder the file is converted to. The zero values
+    // are sRGB and little-endian.
+    ColorSpace colorspace.Space
+    ByteOrder  Endianness
+    // Pyramid builds a pyramid for files uploaded without one. Pyramids
+    // that came with a file are always rebuilt.
+    Pyramid bool
+}
+
+// An IngestReport says what Ingest changed.
+type IngestReport struct {
+    // Stripped lists the chunks removed because the policy does not allow
+    // them, in the order of IngestChunks.
+    Stripped []ChunkType
+    // Normalized describes each change to the pixel format and layout, such
+    // as "tile size 512 to 256".
+    Normalized []string
+    // PyramidLevels is the number of pyramid levels rebuilt.
+    PyramidLevels int
+}
+
+// Ingest prepares a file submitted by a user for storing on a server in one
+// call. It decodes r with DecodeUntrusted, rejects files larger than policy
+// allows or whose links point past their nested images, strips the chunks
+// the policy does not allow, converts the pixels to the policy's color space,
+// byte order and tile size, and rebuilds the pyramid from the main image so
+// previews can't show something other than the pixels. Errors wrap
+// ErrMemoryBudget, ErrDecodeTimeout or a *DecodePanicError when those limits
+// were hit.
+func Ingest(r io.Reader, policy IngestPolicy) (*NestedImageFile, IngestReport, error) {
+    var report IngestReport
+    nif, err := DecodeUntrusted(r, policy.UntrustedOptions)
+    if err != nil {
+        return nil, report, err
+    }
+    if err := nif.checkIngest(policy); err != nil {
+        return nil, report, err
+    }
+
+    for _, t := range IngestChunks {
+        if !slices.Contains(policy.AllowChunks, t) && nif.stripChunk(t) {
+            report.Stripped = append(report.Stripped, t)
+        }
+    }
+
+    if space := policy.ColorSpace; space != nif.Header.ColorSpace {
+        report.Normalized = append(report.Normalized, fmt.Sprintf("color space %s to %s", nif.Header.ColorSpace, space))
+        nif.convertColorSpace(space)
+    }
+    if order := policy.ByteOrder; order != nif.Header.ByteOrder {
+        report.Normalized = append(report.Normalized, fmt.Sprintf("byte order %s to %s", nif.Header.ByteOrder, order))
+        nif.Header.ByteOrder = order
+    }
+    tileSize := policy.TileSize
+    if tileSize == 0 {
+        tileSize = DefaultTileSize
+    }
+    if tileSize != nif.Header.TileSize {
+        report.Normalized = append(report.Normalized, fmt.Sprintf("tile size %d to %d", nif.Header.TileSize, tileSize))
+        nif.retile(tileSize)
+    }
+
+    if len(nif.Pyramid) > 0 || policy.Pyramid {
+        nif.Pyramid, nif.pyramidSource = nil, nil
+        if _, err := nif.RebuildPyramid(); err != nil {
+            return nil, report, fmt.Errorf("failed to rebuild the pyramid: %w", err)
+        }
+        report.PyramidLevels = len(nif.Pyramid)
+    }
+    if len(report.Normalized) > 0 {
+        nif.audit(AuditIngest, strings.Join(report.Normalized, ", "))
+    }
+    return nif, report, nil
+}
+
+// checkIngest rejects files past the policy's limits and the inconsistencies
+// writing the file back would fail on.
+func (nif *NestedImageFile) checkIngest(policy IngestPolicy) error {
+    w, h := int(nif.Header.Width), int(nif.Header.Height)
+    if policy.MaxWidth > 0 && w > policy.MaxWidth {
+        return fmt.Errorf("image is %d pixels wide, the limit is %d", w, policy.MaxWidth)
+    }
+    if policy.MaxHeight > 0 && h > policy.MaxHeight {
+        return fmt.Errorf("image is %d pixels high, the limit is %d", h, policy.MaxHeight)
+    }
+    if policy.MaxNestedImages > 0 && len(nif.NestedImages) > policy.MaxNestedImages {
+        return fmt.Errorf("file has %d nested images, the limit is %d", len(nif.NestedImages), policy.MaxNestedImages)
+    }
+    for i := range nif.NestedImages {
+        if err := nif.NestedImages[i].check(i, 0, true); err != nil {
+            return err
+        }
+    }
+    for y, row := range nif.MainImage {
+        for x, p := range row {
+            if err := nif.checkLink(p.NestedIdx); err != nil {
+                return fmt.Errorf("pixel (%d, %d): %w", x, y, err)
+            }
+        }
+    }
+    for _, lc := range nif.LinkChannels {
+        for _, idx := range lc.Links {
+            if int64(idx) > int64(len(nif.NestedImages)) {
+                return fmt.Errorf("link channel %q: link %d points past the %d nested images", lc.Name, idx, len(nif.NestedImages))
+            }
+        }
+    }
+    if err := nif.checkLayers(); err != nil {
+        return err
+    }
+    if err := nif.checkTemplates(); err != nil {
+        return err
+    }
+    if nif.Adjustments != nil {
+        if err := nif.Adjustments.check(); err != nil {
+            return err
+        }
+    }
+    if nif.Canvas != nil {
+        if err := nif.Canvas.check(nif.Header.Orientation.Size(w, h)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// stripChunk removes what chunk t would hold and reports whether there was
+// any.
+func (nif *NestedImageFile) stripChunk(t ChunkType) bool {
+    var had bool
+    switch t {
+    case ChunkMetadata:
+        // Keep the filter the pyramid is rebuilt with.
+        filter, ok := nif.Metadata[PyramidFilterKey]
+        had = len(nif.Metadata) > 1 || (len(nif.Metadata) == 1 && !ok)
+        nif.Metadata = nil
+        if ok {
+            nif.Metadata = Metadata{PyramidFilterKey: filter}
+        }
+    case ChunkAnnotations:
+        had, nif.Annotations = len(nif.Annotations) > 0, nil
+    case ChunkLinkChannel:
+        had, nif.LinkChannels = len(nif.LinkChannels) > 0, nil
+    case ChunkRoles:
+        for i := range nif.NestedImages {
+            had = had || nif.NestedImages[i].Role != RoleUnspecified
+            nif.NestedImages[i].Role = RoleUnspecified
+        }
+    case ChunkNestedContent:
+        for i := range nif.NestedImages {
+            had = had || nif.NestedImages[i].Content != nil
+            nif.NestedImages[i].Content = nil
+        }
+    case ChunkTransform:
+        had, nif.Transform = len(nif.Transform) > 0, nil
+    case ChunkProvenance:
+        had, nif.Provenance = nif.Provenance != nil, nil
+    case ChunkAudit:
+        had, nif.Audit = nif.Audit != nil, nil
+    case ChunkPlane:
+        had, nif.Planes = len(nif.Planes) > 0, nil
+    case ChunkBand:
+        had, nif.Bands = len(nif.Bands) > 0, nil
+    case ChunkNoData:
+        had, nif.NoData = nif.NoData != nil, nil
+    case ChunkTileTimes:
+        had, nif.TileTimes = nif.TileTimes != nil, nil
+    case ChunkCollab:
+        had, nif.Collab = nif.Collab != nil, nil
+    case ChunkLayers:
+        had, nif.Layers = len(nif.Layers) > 0, nil
+    case ChunkTemplates:
+        had, nif.Templates = len(nif.Templates) > 0, nil
+    case ChunkAdjustments:
+        had, nif.Adjustments = nif.Adjustments != nil, nil
+    case ChunkCanvas:
+        had, nif.Canvas = nif.Canvas != nil, nil
+    }
+    return had
+}
+
+// convertColorSpace converts the main image and focal planes to space. The
+// pyramid is left for the caller to rebuild.
+func (nif *NestedImageFile) convertColorSpace(space colorspace.Space) {
+    from := nif.Header.ColorSpace
+    for _, row := range nif.MainImage {
+        for x := range row {
+            p := &row[x]
+            p.R, p.G, p.B = colorspace.Convert8(p.R, p.G, p.B, from, space)
+        }
+    }
+    for i := range nif.Planes {
+        colorspace.ConvertPix(nif.Planes[i].Data, from, space)
+    }
+    nif.Header.ColorSpace = space
+}
+
+// retile moves what is kept per tile to a grid of size pixel tiles. The
+// pyramid is left for the caller to rebuild.
+func (nif *NestedImageFile) retile(size uint16) {
+    src := nif.grid()
+    nif.Header.TileSize = size
+    dst := nif.grid()
+    if nif.Provenance != nil {
+        nif.Provenance = nif.Provenance.resampled(src, dst)
+    }
+    if nif.TileTimes != nil {
+        nif.TileTimes = retileTimes(nif.TileTimes, src, dst)
+    }
+}
+
+// retileTimes gives each tile of dst the oldest update time of the src
+// tiles it covers, so no stale part of it looks fresh.
+func retileTimes(times []time.Time, src, dst tilemath.Grid) []time.Time {
+    out := make([]time.Time, dst.Cols()*dst.Rows())
+    for ty := 0; ty < dst.Rows(); ty++ {
+        for tx := 0; tx < dst.Cols(); tx++ {
+            r := src.TileRange(dst.TileBounds(tx, ty))
+            oldest := times[r.Min.Y*src.Cols()+r.Min.X]
+            for sy := r.Min.Y; sy < r.Max.Y; sy++ {
+                for sx := r.Min.X; sx < r.Max.X; sx++ {
+                    if t := times[sy*src.Cols()+sx]; t.Before(oldest) {
+                        oldest = t
+                    }
+                }
+            }
+            out[ty*dst.Cols()+tx] = oldest
+        }
+    }
+    return out
+}
@@ -0,0 +1,69 @@
+package nest
+
+import "iter"
+
+// Tiles yields every tile of the main image in row-major order. Each tile is
+// a fresh TileSize x TileSize copy, padded with zero PixeLinks past the
+// image edge like the tiles Write stores.
+func (nif *NestedImageFile) Tiles() iter.Seq2[TileCoord, []PixeLink] {
+    return func(yield func(TileCoord, []PixeLink) bool) {
+        ts := int(nif.Header.TileSize)
+        cols, rows := tileGrid(nif.Header.Width, nif.Header.Height, nif.Header.TileSize)
+        for y := 0; y < rows; y++ {
+            for x := 0; x < cols; x++ {
+                if !yield(TileCoord{x, y}, nif.extractTile(x*ts, y*ts, ts)) {
+                    return
+                }
+            }
+        }
+    }
+}
+
+// AllNested yields the nested images with their 0-based position; link
+// index i+1 refers to image i. Nested(x, y) looks one up by pixel instead.
+func (nif *NestedImageFile) AllNested() iter.Seq2[int, *NestedImage] {
+    return func(yield func(int, *NestedImage) bool) {
+        for i := range nif.NestedImages {
+            if !yield(i, &nif.NestedImages[i]) {
+                return
+            }
+        }
+    }
+}
+
+// Tiles yields the tiles in the order they are stored, decoding each only
+// when it is reached. Iteration stops at the first read error, which the
+// returned function reports once the loop is done.
+func (nr *Reader) Tiles() (iter.Seq2[TileCoord, []PixeLink], func() error) {
+    var err error
+    seq := func(yield func(TileCoord, []PixeLink) bool) {
+        for _, e := range nr.Index.Entries {
+            var tile []PixeLink
+            if tile, err = nr.ReadTile(e.Tile.X, e.Tile.Y); err != nil {
+                return
+            }
+            if !yield(e.Tile, tile) {
+                return
+            }
+        }
+    }
+    return seq, func() error { return err }
+}
+
+// AllNested yields the nested images one at a time as ReadNestedImage reads
+// them, reporting a read error like Tiles does.
+func (nr *Reader) AllNested() (iter.Seq2[int, *NestedImage], func() error) {
+    var err error
+    seq := func(yield func(int, *NestedImage) bool) {
+        for i := 0; i < int(nr.Header.NestedCount); i++ {
+            var ni *NestedImage
+            if ni, err = nr.ReadNestedImage(i); err != nil {
+                return
+            }
+            if !yield(i, ni) {
+                return
+            }
+        }
+    }
+    return seq, func() error { return err }
+}
@@ -0,0 +1,214 @@
+package nest
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+)
+
+const journalMagic = "NJNL"
+
+// journalRecord notes one tile that reached the partial file. Source is the
+// checksum of the tile's pixels, so a resumed write only keeps tiles whose
+// source hasn't changed.
+type journalRecord struct {
+    Seq      uint32
+    Offset   int64
+    Length   int64
+    Checksum uint32
+    Source   uint32
+}
+
+var journalRecordSize = int64(binary.Size(journalRecord{}))
+
+// A journal is made of the partial output file and a log of finished tiles:
+//
+//	Magic "NJNL" | settings SHA-256 | journalRecord...
+//
+// always little-endian. A torn last record is ignored.
+type journal struct {
+    path     string
+    data     *os.File
+    log      *os.File
+    sync     bool
+    records  []journalRecord
+    settings [sha256.Size]byte
+    end      int64
+}
+
+func openJournal(filename string, sync bool) (*journal, error) {
+    j := &journal{path: filename, sync: sync}
+    var err error
+    if j.data, err = os.OpenFile(filename+".partial", os.O_RDWR|os.O_CREATE, 0o644); err != nil {
+        return nil, err
+    }
+    if j.log, err = os.OpenFile(filename+".journal", os.O_RDWR|os.O_CREATE, 0o644); err != nil {
+        j.data.Close()
+        return nil, err
+    }
+
+    raw, err := io.ReadAll(j.log)
+    if err != nil {
+        j.close()
+        return nil, fmt.Errorf("failed to read journal: %w", err)
+    }
+    if len(raw) < len(journalMagic)+sha256.Size || string(raw[:len(journalMagic)]) != journalMagic {
+        return j, nil
+    }
+    copy(j.settings[:], raw[len(journalMagic):])
+    r := bytes.NewReader(raw[len(journalMagic)+sha256.Size:])
+    for int64(r.Len()) >= journalRecordSize {
+        var rec journalRecord
+        binary.Read(r, binary.LittleEndian, &rec)
+        j.records = append(j.records, rec)
+    }
+    return j, nil
+}
+
+// resume keeps the longest run of recorded tiles that follow the header
+// contiguously, pass their checksum and satisfy keep. Anything after them is
+// discarded and the files are positioned for appending.
+func (j *journal) resume(header, settings []byte, keep func(journalRecord) bool) ([]journalRecord, error) {
+    sum := sha256.Sum256(append(append([]byte(nil), header...), settings...))
+    var kept []journalRecord
+    if sum == j.settings {
+        prefix := make([]byte, len(header))
+        if _, err := j.data.ReadAt(prefix, 0); err == nil && bytes.Equal(prefix, header) {
+            end := int64(len(header))
+            for i, rec := range j.records {
+                if int(rec.Seq) != i || rec.Offset != end || rec.Length <= 0 || !keep(rec) {
+                    break
+                }
+                data, err := j.tile(rec)
+                if err != nil || tileChecksum(data) != rec.Checksum {
+                    break
+                }
+                kept = append(kept, rec)
+                end = rec.Offset + rec.Length
+            }
+            if len(kept) > 0 {
+                j.end = end
+            }
+        }
+    }
+
+    if err := j.data.Truncate(j.end); err != nil {
+        return nil, fmt.Errorf("failed to truncate partial file: %w", err)
+    }
+    if _, err := j.data.Seek(j.end, io.SeekStart); err != nil {
+        return nil, err
+    }
+    if err := j.log.Truncate(0); err != nil {
+        return nil, fmt.Errorf("failed to truncate journal: %w", err)
+    }
+    if _, err := j.log.Seek(0, io.SeekStart); err != nil {
+        return nil, err
+    }
+    var buf bytes.Buffer
+    buf.WriteString(journalMagic)
+    buf.Write(sum[:])
+    binary.Write(&buf, binary.LittleEndian, kept)
+    if _, err := j.log.Write(buf.Bytes()); err != nil {
+        return nil, fmt.Errorf("failed to write journal: %w", err)
+    }
+    j.records = kept
+    return kept, nil
+}
+
+func (j *journal) tile(rec journalRecord) ([]byte, error) {
+    data := make([]byte, rec.Length)
+    if _, err := j.data.ReadAt(data, rec.Offset); err != nil {
+        return nil, fmt.Errorf("failed to read journaled tile %d: %w", rec.Seq, err)
+    }
+    return data, nil
+}
+
+// record logs a tile after its bytes were written to the partial file. With
+// sync set the tile is made durable before the record that vouches for it.
+func (j *journal) record(rec journalRecord) error {
+    if j.sync {
+        if err := j.data.Sync(); err != nil {
+            return fmt.Errorf("failed to sync partial file: %w", err)
+        }
+    }
+    if err := binary.Write(j.log, binary.LittleEndian, &rec); err != nil {
+        return fmt.Errorf("failed to write journal: %w", err)
+    }
+    if j.sync {
+        if err := j.log.Sync(); err != nil {
+            return fmt.Errorf("failed to sync journal: %w", err)
+        }
+    }
+    return nil
+}
+
+// commit moves the finished partial file into place and drops the journal.
+func (j *journal) commit() error {
+    if j.sync {
+        if err := j.data.Sync(); err != nil {
+            return fmt.Errorf("failed to sync file: %w", err)
+        }
+    }
+    err := j.data.Close()
+    j.data = nil
+    if err != nil {
+        return fmt.Errorf("failed to close file: %w", err)
+    }
+    if err := os.Rename(j.path+".partial", j.path); err != nil {
+        return fmt.Errorf("failed to replace %s: %w", j.path, err)
+    }
+    j.log.Close()
+    j.log = nil
+    if err := os.Remove(j.path + ".journal"); err != nil && !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+    if j.sync {
+        return syncDir(filepath.Dir(j.path))
+    }
+    return nil
+}
+
+// abort removes both files, for writes that must not be resumed.
+func (j *journal) abort() {
+    j.close()
+    j.data, j.log = nil, nil
+    os.Remove(j.path + ".partial")
+    os.Remove(j.path + ".journal")
+}
+
+// close leaves both files in place so a later write can resume.
+func (j *journal) close() {
+    if j.data != nil {
+        j.data.Close()
+    }
+    if j.log != nil {
+        j.log.Close()
+    }
+}
+
+func writeJournaled(filename string, nif *NestedImageFile, opts WriteOptions) error {
+    lock, err := lockForWrite(filename)
+    if err != nil {
+        return err
+    }
+    defer releaseSidecar(lock)
+    j, err := openJournal(filename, opts.Sync)
+    if err != nil {
+        return fmt.Errorf("failed to open journal: %w", err)
+    }
+    defer j.close()
+
+    if err := nif.write(j.data, opts, j); err != nil {
+        // Resuming would only run into the limit again.
+        if errors.Is(err, ErrOutputTooLarge) {
+            j.abort()
+        }
+        return err
+    }
+    return j.commit()
+}
@@ -0,0 +1,339 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "io"
+    "math"
+)
+
+// LayeredImage is layered artwork, such as a decoded PSD or OpenRaster
+// file, before it becomes NEST content.
+type LayeredImage struct {
+    Width, Height int
+    // Layers are listed bottom to top.
+    Layers []SourceLayer
+    // Composite is the flattened image saved with the artwork, or nil.
+    Composite image.Image
+    // Metadata, such as a camera's capture settings, is recorded in the
+    // file's metadata by FromLayers.
+    Metadata Metadata
+}
+
+// SourceLayer is one layer of a LayeredImage, or a layer group when Group
+// is set.
+type SourceLayer struct {
+    Name string
+    // Image holds the layer's pixels positioned on the canvas. It is nil for
+    // groups and empty layers.
+    Image *image.NRGBA
+    // Opacity is between 0 and 1.
+    Opacity float64
+    Hidden  bool
+    Group   bool
+    // Children are the members of a group, bottom to top.
+    Children []SourceLayer
+}
+
+// Flatten returns the saved composite, or the visible layers drawn over
+// transparency with normal blending when there is none.
+func (li *LayeredImage) Flatten() image.Image {
+    if li.Composite != nil {
+        return li.Composite
+    }
+    dst := image.NewRGBA(image.Rect(0, 0, li.Width, li.Height))
+    compositeLayers(dst, li.Layers)
+    return dst
+}
+
+// compositeLayers draws the visible layers over dst, bottom to top.
+func compositeLayers(dst *image.RGBA, layers []SourceLayer) {
+    for _, l := range layers {
+        if l.Hidden {
+            continue
+        }
+        var src image.Image
+        switch {
+        case l.Group:
+            group := image.NewRGBA(dst.Rect)
+            compositeLayers(group, l.Children)
+            src = group
+        case l.Image != nil:
+            src = l.Image
+        default:
+            continue
+        }
+        r := src.Bounds().Intersect(dst.Rect)
+        mask := image.NewUniform(color.Alpha{A: opacity8(l.Opacity)})
+        draw.DrawMask(dst, r, src, r.Min, mask, image.Point{}, draw.Over)
+    }
+}
+
+func opacity8(o float64) uint8 {
+    return uint8(math.Round(min(max(o, 0), 1) * 255))
+}
+
+// Layer is one layer of imported artwork. Its pixels, or for a group the
+// composite of its members, are kept in a nested image, and a link channel
+// links the main image pixels the layer covers to it.
+type Layer struct {
+    Name string
+    // Parent indexes Layers for members of a group and is -1 at the top
+    // level. Parents come before their members, which are listed bottom to
+    // top.
+    Parent int
+    Group  bool
+    Hidden bool
+    // Opacity scales the layer's alpha, 255 being opaque.
+    Opacity uint8
+    // Rect is the layer's extent on the main image.
+    Rect image.Rectangle
+    // Nested numbers the nested image from 1, like links. Empty layers have
+    // none and no channel.
+    Nested  uint32
+    Channel string
+}
+
+// FromLayers builds a file whose main image is li flattened, without
+// losing the layers: every layer keeps its pixels in a nested image and
+// its coverage in a link channel named after its path, such as
+// "Sky/Clouds", and every group becomes a nested image of its members
+// composited. Where a visible top-level group covers a main image pixel,
+// the pixel links to the group. Nested images have no alpha, so
+// transparent layer pixels are stored black.
+func FromLayers(li *LayeredImage, opts ImportOptions) (*NestedImageFile, error) {
+    if li.Width <= 0 || li.Height <= 0 {
+        return nil, fmt.Errorf("layered image is %dx%d", li.Width, li.Height)
+    }
+    main := li.Flatten()
+    if b := main.Bounds(); b.Dx() != li.Width || b.Dy() != li.Height {
+        return nil, fmt.Errorf("composite is %dx%d, the canvas is %dx%d", b.Dx(), b.Dy(), li.Width, li.Height)
+    }
+    nif := FromImage(main, opts)
+    for k, v := range li.Metadata {
+        if nif.Metadata == nil {
+            nif.Metadata = Metadata{}
+        }
+        nif.Metadata[k] = v
+    }
+    imp := layerImport{nif: nif, canvas: image.Rect(0, 0, li.Width, li.Height), names: map[string]bool{}}
+    if _, err := imp.add(li.Layers, -1, ""); err != nil {
+        return nil, err
+    }
+    nif.Header.NestedCount = uint32(len(nif.NestedImages))
+
+    for _, l := range nif.Layers {
+        if l.Parent != -1 || !l.Group || l.Hidden || l.Nested == 0 {
+            continue
+        }
+        lc := nif.LinkChannel(l.Channel)
+        for y := l.Rect.Min.Y; y < l.Rect.Max.Y; y++ {
+            for x := l.Rect.Min.X; x < l.Rect.Max.X; x++ {
+                if lc.At(x, y) != 0 {
+                    nif.MainImage[y][x].NestedIdx = l.Nested
+                }
+            }
+        }
+    }
+    return nif, nil
+}
+
+type layerImport struct {
+    nif    *NestedImageFile
+    canvas image.Rectangle
+    // names holds the channel names handed out so far.
+    names map[string]bool
+}
+
+// unique returns name, or name with a number appended when a sibling
+// already took it.
+func (imp *layerImport) unique(name string) string {
+    n := name
+    for i := 2; imp.names[n]; i++ {
+        n = fmt.Sprintf("%s (%d)", name, i)
+    }
+    imp.names[n] = true
+    return n
+}
+
+// add appends layers as members of parent and returns the union of their
+// extents.
+func (imp *layerImport) add(layers []SourceLayer, parent int, path string) (image.Rectangle, error) {
+    nif := imp.nif
+    var union image.Rectangle
+    for _, l := range layers {
+        name := l.Name
+        if name == "" {
+            name = "Layer"
+        }
+        channel := imp.unique(path + name)
+        i := len(nif.Layers)
+        nif.Layers = append(nif.Layers, Layer{
+            Name:    l.Name,
+            Parent:  parent,
+            Group:   l.Group,
+            Hidden:  l.Hidden,
+            Opacity: opacity8(l.Opacity),
+        })
+
+        var rect image.Rectangle
+        var src image.Image
+        if l.Group {
+            r, err := imp.add(l.Children, i, channel+"/")
+            if err != nil {
+                return union, err
+            }
+            group := image.NewRGBA(r)
+            compositeLayers(group, l.Children)
+            rect, src = r, group
+        } else if l.Image != nil {
+            rect, src = l.Image.Bounds().Intersect(imp.canvas), l.Image
+        }
+        if rect.Empty() {
+            continue
+        }
+        union = union.Union(rect)
+
+        ni, err := NewNestedImage(subImage(src, rect))
+        if err != nil {
+            return union, fmt.Errorf("layer %q: %w", channel, err)
+        }
+        ni.Role = RoleDetail
+        nif.NestedImages = append(nif.NestedImages, ni)
+        idx := uint32(len(nif.NestedImages))
+        lc, err := nif.AddLinkChannel(channel)
+        if err != nil {
+            return union, err
+        }
+        if l.Group {
+            for j := i + 1; j < len(nif.Layers); j++ {
+                m := nif.Layers[j]
+                if m.Parent != i || m.Nested == 0 {
+                    continue
+                }
+                for k, v := range nif.LinkChannel(m.Channel).Links {
+                    if v != 0 {
+                        lc.Links[k] = idx
+                    }
+                }
+            }
+        } else {
+            for y := rect.Min.Y; y < rect.Max.Y; y++ {
+                for x := rect.Min.X; x < rect.Max.X; x++ {
+                    if l.Image.NRGBAAt(x, y).A != 0 {
+                        lc.Set(x, y, idx)
+                    }
+                }
+            }
+        }
+        layer := &nif.Layers[i]
+        layer.Rect, layer.Nested, layer.Channel = rect, idx, channel
+    }
+    return union, nil
+}
+
+// The layer tree is stored in a LAYR chunk, in Layers order:
+//
+//	count uint32 | count * (name length uint16 | name | channel length uint16 | channel |
+//	    parent int32 | flags uint8 | opacity uint8 | rect 4 * int32 | nested uint32)
+//
+// with flag 1 marking groups and 2 hidden layers.
+func encodeLayers(layers []Layer, order binary.ByteOrder) []byte {
+    var buf bytes.Buffer
+    binary.Write(&buf, order, uint32(len(layers)))
+    for _, l := range layers {
+        binary.Write(&buf, order, uint16(len(l.Name)))
+        buf.WriteString(l.Name)
+        binary.Write(&buf, order, uint16(len(l.Channel)))
+        buf.WriteString(l.Channel)
+        var flags uint8
+        if l.Group {
+            flags |= 1
+        }
+        if l.Hidden {
+            flags |= 2
+        }
+        binary.Write(&buf, order, int32(l.Parent))
+        buf.WriteByte(flags)
+        buf.WriteByte(l.Opacity)
+        binary.Write(&buf, order, [4]int32{int32(l.Rect.Min.X), int32(l.Rect.Min.Y), int32(l.Rect.Max.X), int32(l.Rect.Max.Y)})
+        binary.Write(&buf, order, l.Nested)
+    }
+    return buf.Bytes()
+}
+
+func (nif *NestedImageFile) checkLayers() error {
+    for i, l := range nif.Layers {
+        if l.Parent < -1 || l.Parent >= i || (l.Parent >= 0 && !nif.Layers[l.Parent].Group) {
+            return fmt.Errorf("layer %d has invalid parent %d", i, l.Parent)
+        }
+        if int(l.Nested) > len(nif.NestedImages) {
+            return fmt.Errorf("layer %d links to nested image %d of %d", i, l.Nested, len(nif.NestedImages))
+        }
+        if len(l.Name) > math.MaxUint16 || len(l.Channel) > math.MaxUint16 {
+            return fmt.Errorf("layer %d name is too long to store", i)
+        }
+    }
+    return nil
+}
+
+func decodeLayers(reader io.Reader, order binary.ByteOrder, length uint64) ([]Layer, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkLayers, err)
+    }
+    r := bytes.NewReader(data)
+    fail := func(err error) ([]Layer, error) {
+        return nil, fmt.Errorf("failed to decode %s chunk: %w", ChunkLayers, err)
+    }
+    var count uint32
+    if err := binary.Read(r, order, &count); err != nil {
+        return fail(err)
+    }
+    if int64(count)*30 > int64(r.Len()) {
+        return fail(fmt.Errorf("%d layers do not fit in %d bytes", count, r.Len()))
+    }
+    readString := func() (string, error) {
+        var n uint16
+        if err := binary.Read(r, order, &n); err != nil {
+            return "", err
+        }
+        s := make([]byte, n)
+        _, err := io.ReadFull(r, s)
+        return string(s), err
+    }
+    layers := make([]Layer, count)
+    for i := range layers {
+        l := &layers[i]
+        var err error
+        if l.Name, err = readString(); err != nil {
+            return fail(err)
+        }
+        if l.Channel, err = readString(); err != nil {
+            return fail(err)
+        }
+        var fixed struct {
+            Parent  int32
+            Flags   uint8
+            Opacity uint8
+            Rect    [4]int32
+            Nested  uint32
+        }
+        if err := binary.Read(r, order, &fixed); err != nil {
+            return fail(err)
+        }
+        if fixed.Parent < -1 || int(fixed.Parent) >= i {
+            return fail(fmt.Errorf("layer %d has invalid parent %d", i, fixed.Parent))
+        }
+        l.Parent = int(fixed.Parent)
+        l.Group, l.Hidden = fixed.Flags&1 != 0, fixed.Flags&2 != 0
+        l.Opacity = fixed.Opacity
+        l.Rect = image.Rect(int(fixed.Rect[0]), int(fixed.Rect[1]), int(fixed.Rect[2]), int(fixed.Rect[3]))
+        l.Nested = fixed.Nested
+    }
+    return layers, nil
+}
@@ -0,0 +1,117 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "os"
+)
+
+var ErrLocked = errors.New("file is locked by another process")
+
+// LockedFile is a .nest file opened under an advisory lock, which is held
+// until Close. The lock is taken on a NAME.lock sidecar rather than the file
+// itself, so it stays valid when writers atomically replace the file.
+//
+// Locks belong to the open file description and are released by the
+// operating system when the process exits, so a crashed holder never leaves
+// a stale lock behind. A leftover sidecar file is harmless.
+//
+// Locking is opt-in: OpenShared and OpenExclusive create the sidecar, and
+// only files that have one are locked by writers. For those, CreateAtomic,
+// and so WriteNestedImageFileWithOptions, takes the exclusive lock for the
+// duration of the write, so writes fail with ErrLocked while a LockedFile of
+// the same file is open. Files never opened as a LockedFile get no sidecar,
+// and writes to them take no lock.
+type LockedFile struct {
+    *os.File
+    lock *os.File
+}
+
+// OpenShared opens filename for reading. Any number of shared holders may
+// coexist; it fails with ErrLocked while an exclusive holder is active.
+func OpenShared(filename string) (*LockedFile, error) {
+    return openLocked(filename, false)
+}
+
+// OpenExclusive opens filename for reading and writing, creating it if
+// needed. It fails with ErrLocked while any other holder is active.
+func OpenExclusive(filename string) (*LockedFile, error) {
+    return openLocked(filename, true)
+}
+
+func openLocked(filename string, exclusive bool) (*LockedFile, error) {
+    lock, err := lockSidecar(filename, exclusive, true)
+    if err != nil {
+        return nil, err
+    }
+
+    flag := os.O_RDONLY
+    if exclusive {
+        flag = os.O_RDWR | os.O_CREATE
+    }
+    file, err := os.OpenFile(filename, flag, 0o644)
+    if err != nil {
+        releaseSidecar(lock)
+        return nil, fmt.Errorf("failed to open file: %w", err)
+    }
+    if exclusive {
+        // Record the holder for diagnostics; the lock itself does not
+        // depend on it.
+        lock.Truncate(0)
+        fmt.Fprintf(lock, "%d\n", os.Getpid())
+    }
+    return &LockedFile{File: file, lock: lock}, nil
+}
+
+// Close closes the file and releases the lock.
+func (f *LockedFile) Close() error {
+    err := f.File.Close()
+    if rerr := releaseSidecar(f.lock); err == nil {
+        err = rerr
+    }
+    return err
+}
+
+// lockSidecar opens the sidecar of filename, creating it when create is
+// set, and takes its lock.
+func lockSidecar(filename string, exclusive, create bool) (*os.File, error) {
+    flag := os.O_RDWR
+    if create {
+        flag |= os.O_CREATE
+    }
+    lock, err := os.OpenFile(filename+".lock", flag, 0o644)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open lock file: %w", err)
+    }
+    if err := lockFile(lock, exclusive); err != nil {
+        lock.Close()
+        return nil, err
+    }
+    return lock, nil
+}
+
+// lockForWrite takes the exclusive lock a writer of filename holds, if the
+// file has a sidecar. Without one, or on platforms without advisory locks,
+// it returns a nil lock and the write goes ahead unlocked.
+func lockForWrite(filename string) (*os.File, error) {
+    lock, err := lockSidecar(filename, true, false)
+    if errors.Is(err, os.ErrNotExist) || errors.Is(err, errors.ErrUnsupported) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", filename, err)
+    }
+    return lock, nil
+}
+
+// releaseSidecar releases and closes a lock from lockSidecar, if any.
+func releaseSidecar(lock *os.File) error {
+    if lock == nil {
+        return nil
+    }
+    err := unlockFile(lock)
+    if cerr := lock.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
@@ -0,0 +1,16 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package nest
+
+import (
+    "errors"
+    "os"
+)
+
+func lockFile(f *os.File, exclusive bool) error {
+    return errors.ErrUnsupported
+}
+
+func unlockFile(f *os.File) error {
+    return nil
+}
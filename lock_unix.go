@@ -0,0 +1,25 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package nest
+
+import (
+    "errors"
+    "os"
+    "syscall"
+)
+
+func lockFile(f *os.File, exclusive bool) error {
+    how := syscall.LOCK_SH
+    if exclusive {
+        how = syscall.LOCK_EX
+    }
+    err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+    if errors.Is(err, syscall.EWOULDBLOCK) {
+        return ErrLocked
+    }
+    return err
+}
+
+func unlockFile(f *os.File) error {
+    return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,46 @@
+//go:build windows
+
+package nest
+
+import (
+    "os"
+    "syscall"
+    "unsafe"
+)
+
+var (
+    modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+    procLockFileEx   = modkernel32.NewProc("LockFileEx")
+    procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+    lockfileFailImmediately = 0x1
+    lockfileExclusiveLock   = 0x2
+    errorLockViolation      = syscall.Errno(33)
+)
+
+func lockFile(f *os.File, exclusive bool) error {
+    flags := uintptr(lockfileFailImmediately)
+    if exclusive {
+        flags |= lockfileExclusiveLock
+    }
+    var ol syscall.Overlapped
+    r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+    if r != 0 {
+        return nil
+    }
+    if err == errorLockViolation {
+        return ErrLocked
+    }
+    return err
+}
+
+func unlockFile(f *os.File) error {
+    var ol syscall.Overlapped
+    r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+    if r != 0 {
+        return nil
+    }
+    return err
+}
@@ -0,0 +1,145 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+)
+
+// MarshalBinary encodes the file exactly as Write does.
+func (nif *NestedImageFile) MarshalBinary() ([]byte, error) {
+    var buf bytes.Buffer
+    if err := nif.Write(&buf); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func (nif *NestedImageFile) UnmarshalBinary(data []byte) error {
+    *nif = NestedImageFile{}
+    return nif.Read(bytes.NewReader(data))
+}
+
+// MarshalBinary packs the tile's PixeLinks as R, G, B and a little-endian
+// uint32 NestedIdx each.
+func (t *Tile) MarshalBinary() ([]byte, error) {
+    return encodeTile(t.PixeLinks, binary.LittleEndian), nil
+}
+
+func (t *Tile) UnmarshalBinary(data []byte) error {
+    if len(data)%pixeLinkDiskSize != 0 {
+        return fmt.Errorf("tile data is %d bytes, not a multiple of %d", len(data), pixeLinkDiskSize)
+    }
+    t.PixeLinks = make([]PixeLink, len(data)/pixeLinkDiskSize)
+    for i := range t.PixeLinks {
+        b := data[i*pixeLinkDiskSize:]
+        t.PixeLinks[i] = PixeLink{R: b[0], G: b[1], B: b[2], NestedIdx: binary.LittleEndian.Uint32(b[3:7])}
+    }
+    return nil
+}
+
+// MarshalBinary encodes the image as Write does followed by its Role, which
+// inside a file lives in the ROLE chunk instead.
+func (ni *NestedImage) MarshalBinary() ([]byte, error) {
+    var buf bytes.Buffer
+    if err := ni.Write(&buf); err != nil {
+        return nil, err
+    }
+    buf.WriteByte(byte(ni.Role))
+    return buf.Bytes(), nil
+}
+
+func (ni *NestedImage) UnmarshalBinary(data []byte) error {
+    r := bytes.NewReader(data)
+    if err := ni.Read(r); err != nil {
+        return err
+    }
+    role, err := r.ReadByte()
+    if err != nil {
+        return fmt.Errorf("failed to read nested image role: %w", err)
+    }
+    ni.Role = NestedRole(role)
+    if r.Len() != 0 {
+        return fmt.Errorf("nested image has %d trailing bytes", r.Len())
+    }
+    return nil
+}
+
+// FileHeader marshals to JSON with Magic as a string and enums by name.
+func (h FileHeader) MarshalJSON() ([]byte, error) {
+    type header FileHeader
+    return json.Marshal(struct {
+        Magic string
+        header
+    }{string(h.Magic[:]), header(h)})
+}
+
+func (h *FileHeader) UnmarshalJSON(data []byte) error {
+    type header FileHeader
+    v := struct {
+        Magic string
+        *header
+    }{header: (*header)(h)}
+    if err := json.Unmarshal(data, &v); err != nil {
+        return err
+    }
+    if len(v.Magic) > len(h.Magic) {
+        return fmt.Errorf("magic %q is longer than %d bytes", v.Magic, len(h.Magic))
+    }
+    h.Magic = [4]byte{}
+    copy(h.Magic[:], v.Magic)
+    return nil
+}
+
+func (e Endianness) MarshalText() ([]byte, error) {
+    return []byte(e.String()), nil
+}
+
+func (e *Endianness) UnmarshalText(text []byte) error {
+    v, err := ParseEndianness(string(text))
+    if err != nil {
+        return err
+    }
+    *e = v
+    return nil
+}
+
+func (o TileOrder) MarshalText() ([]byte, error) {
+    return []byte(o.String()), nil
+}
+
+func (o *TileOrder) UnmarshalText(text []byte) error {
+    v, err := ParseTileOrder(string(text))
+    if err != nil {
+        return err
+    }
+    *o = v
+    return nil
+}
+
+func (k PayloadKind) MarshalText() ([]byte, error) {
+    return []byte(k.String()), nil
+}
+
+func (k *PayloadKind) UnmarshalText(text []byte) error {
+    v, err := ParsePayloadKind(string(text))
+    if err != nil {
+        return err
+    }
+    *k = v
+    return nil
+}
+
+func (r NestedRole) MarshalText() ([]byte, error) {
+    return []byte(r.String()), nil
+}
+
+func (r *NestedRole) UnmarshalText(text []byte) error {
+    v, err := ParseNestedRole(string(text))
+    if err != nil {
+        return err
+    }
+    *r = v
+    return nil
+}
@@ -0,0 +1,81 @@
+package nest
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+)
+
+// LinksFromMask sets every pixel's NestedIdx from a segmentation mask the
+// size of the main image. Mask colors are compared by their 16-bit RGBA
+// values, so any color.Color implementation may be used as a key; colors
+// missing from mapping clear the link.
+func (nif *NestedImageFile) LinksFromMask(mask image.Image, mapping map[color.Color]uint32) error {
+    b := mask.Bounds()
+    if err := nif.checkLinkSize(b.Dx(), b.Dy()); err != nil {
+        return err
+    }
+    lookup := make(map[color.RGBA64]uint32, len(mapping))
+    for c, idx := range mapping {
+        if err := nif.checkLink(idx); err != nil {
+            return err
+        }
+        lookup[rgba64(c)] = idx
+    }
+    for y := 0; y < b.Dy(); y++ {
+        row := nif.MainImage[y]
+        for x := range row {
+            row[x].NestedIdx = lookup[rgba64(mask.At(b.Min.X+x, b.Min.Y+y))]
+        }
+    }
+    nif.audit(AuditLinksFromMask, "mask", nif.Bounds())
+    return nil
+}
+
+// LinksFromLabelMap sets every pixel's NestedIdx from labels[y][x], as
+// produced by instance segmentation with 0 for background.
+func (nif *NestedImageFile) LinksFromLabelMap(labels [][]uint32) error {
+    width := 0
+    if len(labels) > 0 {
+        width = len(labels[0])
+    }
+    if err := nif.checkLinkSize(width, len(labels)); err != nil {
+        return err
+    }
+    for y, row := range labels {
+        if len(row) != width {
+            return fmt.Errorf("label map row %d has %d labels, want %d", y, len(row), width)
+        }
+        for _, idx := range row {
+            if err := nif.checkLink(idx); err != nil {
+                return err
+            }
+        }
+    }
+    for y, row := range labels {
+        for x, idx := range row {
+            nif.MainImage[y][x].NestedIdx = idx
+        }
+    }
+    nif.audit(AuditLinksFromMask, "label map", nif.Bounds())
+    return nil
+}
+
+func (nif *NestedImageFile) checkLinkSize(width, height int) error {
+    if width != int(nif.Header.Width) || height != int(nif.Header.Height) {
+        return fmt.Errorf("%dx%d mask does not match the %dx%d main image", width, height, nif.Header.Width, nif.Header.Height)
+    }
+    return nil
+}
+
+func (nif *NestedImageFile) checkLink(idx uint32) error {
+    if nif.Header.Payload == PayloadLink && int64(idx) > int64(len(nif.NestedImages)) {
+        return fmt.Errorf("link %d points past the %d nested images", idx, len(nif.NestedImages))
+    }
+    return nil
+}
+
+func rgba64(c color.Color) color.RGBA64 {
+    r, g, b, a := c.RGBA()
+    return color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+}
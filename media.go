@@ -0,0 +1,74 @@
+package nest
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "io"
+    "mime"
+    "strings"
+)
+
+// NewMediaNested builds a nested entry carrying an audio or video clip,
+// such as narration for a kiosk display. The clip is stored as it is and
+// never decoded; the entry's pixels are poster, or a play symbol when
+// poster is nil, for readers that only show pixels.
+func NewMediaNested(mimeType string, data []byte, poster image.Image) (NestedImage, error) {
+    if !isMediaType(mimeType) {
+        return NestedImage{}, fmt.Errorf("%q is not an audio or video MIME type", mimeType)
+    }
+    if poster == nil {
+        poster = mediaPlaceholder()
+    }
+    ni, err := NewNestedImage(poster)
+    if err != nil {
+        return NestedImage{}, err
+    }
+    ni.Content = &NestedContent{MIMEType: mimeType, Data: data}
+    return ni, nil
+}
+
+// IsMedia reports whether nc is an audio or video clip.
+func (nc *NestedContent) IsMedia() bool {
+    return nc != nil && isMediaType(nc.MIMEType)
+}
+
+func isMediaType(mimeType string) bool {
+    t, _, err := mime.ParseMediaType(mimeType)
+    return err == nil && (strings.HasPrefix(t, "audio/") || strings.HasPrefix(t, "video/"))
+}
+
+// mediaPlaceholder draws a white play triangle on dark gray.
+func mediaPlaceholder() *image.RGBA {
+    const w, h = 128, 72
+    img := image.NewRGBA(image.Rect(0, 0, w, h))
+    draw.Draw(img, img.Rect, image.NewUniform(color.RGBA{0x30, 0x30, 0x30, 0xff}), image.Point{}, draw.Src)
+    // The triangle points right, centered, h/2 tall.
+    left, top, size := w/2-h/6, h/4, h/2
+    for y := 0; y < size; y++ {
+        half := min(y, size-1-y)
+        for x := 0; x <= half; x++ {
+            img.SetRGBA(left+x, top+y, color.RGBA{0xff, 0xff, 0xff, 0xff})
+        }
+    }
+    return img
+}
+
+// OpenNestedContent returns the content of nested image i, numbered from
+// 0, as a reader over its bytes in the file, and its MIME type. Nothing is
+// read up front, so a clip can be streamed or seeked into a range at a
+// time. It returns ErrNoContent when the nested image has none.
+func (nr *Reader) OpenNestedContent(i int) (*io.SectionReader, string, error) {
+    if i < 0 || i >= int(nr.Header.NestedCount) {
+        return nil, "", fmt.Errorf("file has no nested image %d", i)
+    }
+    mimeType, offset, length, ok, err := nr.findNestedContent(i)
+    if err != nil {
+        return nil, "", err
+    }
+    if !ok {
+        return nil, "", ErrNoContent
+    }
+    return io.NewSectionReader(nr.r, offset, length), mimeType, nil
+}
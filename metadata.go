@@ -0,0 +1,93 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "sort"
+)
+
+// Metadata holds free-form key/value pairs such as author or capture date.
+// It is stored in the META chunk, so tools can query it without decoding
+// pixel data.
+type Metadata map[string]string
+
+// On disk:
+//
+//	count uint32 | count * (key length uint16 | key | value length uint32 | value)
+//
+// with keys in sorted order.
+func (m Metadata) encode(order binary.ByteOrder) ([]byte, error) {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        if len(k) > 0xffff {
+            return nil, fmt.Errorf("metadata key of %d bytes exceeds the 65535 byte limit", len(k))
+        }
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    var buf bytes.Buffer
+    binary.Write(&buf, order, uint32(len(keys)))
+    for _, k := range keys {
+        binary.Write(&buf, order, uint16(len(k)))
+        buf.WriteString(k)
+        binary.Write(&buf, order, uint32(len(m[k])))
+        buf.WriteString(m[k])
+    }
+    return buf.Bytes(), nil
+}
+
+func decodeMetadata(reader io.Reader, order binary.ByteOrder, length uint64) (Metadata, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkMetadata, err)
+    }
+    next := func(n int) ([]byte, error) {
+        if n > len(data) {
+            return nil, fmt.Errorf("%s chunk is truncated", ChunkMetadata)
+        }
+        b := data[:n]
+        data = data[n:]
+        return b, nil
+    }
+
+    b, err := next(4)
+    if err != nil {
+        return nil, err
+    }
+    count := order.Uint32(b)
+    if uint64(count)*6 > length {
+        return nil, fmt.Errorf("%s chunk lists %d entries but is only %d bytes", ChunkMetadata, count, length)
+    }
+    m := make(Metadata, count)
+    for i := uint32(0); i < count; i++ {
+        if b, err = next(2); err != nil {
+            return nil, err
+        }
+        key, err := next(int(order.Uint16(b)))
+        if err != nil {
+            return nil, err
+        }
+        if b, err = next(4); err != nil {
+            return nil, err
+        }
+        value, err := next(int(order.Uint32(b)))
+        if err != nil {
+            return nil, err
+        }
+        m[string(key)] = string(value)
+    }
+    return m, nil
+}
+
+// Metadata reads the META chunk without touching pixel data. Files without
+// metadata return an empty map.
+func (nr *Reader) Metadata() (Metadata, error) {
+    offset, length, ok, err := nr.findChunk(ChunkMetadata)
+    if err != nil || !ok {
+        return Metadata{}, err
+    }
+    return decodeMetadata(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+}
@@ -0,0 +1,33 @@
+package nest
+
+import (
+    "mime"
+    "net/http"
+)
+
+const MIMEType = "image/x-nest"
+
+func init() {
+    mime.AddExtensionType(".nest", MIMEType)
+}
+
+// Sniff reports whether data starts like a NEST file. Six bytes are enough.
+func Sniff(data []byte) bool {
+    if len(data) < 6 || string(data[:4]) != MAGIC {
+        return false
+    }
+    mark := [2]byte{data[4], data[5]}
+    if mark == littleEndianMark || mark == bigEndianMark {
+        return true
+    }
+    // Versions 1 and 2 have the little-endian version number here.
+    return (mark[0] == 1 || mark[0] == 2) && mark[1] == 0
+}
+
+// DetectContentType extends http.DetectContentType with NEST files.
+func DetectContentType(data []byte) string {
+    if Sniff(data) {
+        return MIMEType
+    }
+    return http.DetectContentType(data)
+}
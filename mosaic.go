@@ -0,0 +1,360 @@
+package nest
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    "math"
+    "os"
+    "path/filepath"
+)
+
+// MosaicBlend selects how overlapping members are combined.
+type MosaicBlend uint8
+
+const (
+    // BlendNone lets later members cover earlier ones.
+    BlendNone MosaicBlend = iota
+    // BlendFeather weights each member by the distance to its own edge, up
+    // to Mosaic.Feather pixels, so overlaps fade from one scan to the next.
+    BlendFeather
+)
+
+const DefaultFeather = 32
+
+func (b MosaicBlend) String() string {
+    switch b {
+    case BlendNone:
+        return "none"
+    case BlendFeather:
+        return "feather"
+    }
+    return "unknown"
+}
+
+func ParseMosaicBlend(s string) (MosaicBlend, error) {
+    for _, b := range []MosaicBlend{BlendNone, BlendFeather} {
+        if b.String() == s {
+            return b, nil
+        }
+    }
+    return BlendNone, fmt.Errorf("unknown mosaic blend %q", s)
+}
+
+// MosaicManifest places member files in a shared coordinate space. Files
+// are relative to the manifest's directory:
+//
+//	{"members": [{"file": "a.nest", "x": 0, "y": 0}, {"file": "b.nest", "x": 4000, "y": 0}],
+//	 "blend": "feather", "feather": 96}
+type MosaicManifest struct {
+    Members []MosaicPlacement `json:"members"`
+    Blend   string            `json:"blend,omitempty"`
+    Feather int               `json:"feather,omitempty"`
+}
+
+type MosaicPlacement struct {
+    File string `json:"file"`
+    X    int    `json:"x"`
+    Y    int    `json:"y"`
+}
+
+// MosaicMember is one file of a mosaic. Its pixels are mapped by Transform,
+// when set, and then moved by Offset into mosaic coordinates. OpenMosaic
+// takes Transform from the file's XFRM chunk.
+type MosaicMember struct {
+    Name      string
+    Offset    image.Point
+    Transform TransformChain
+    Reader    *Reader
+    // NoData marks member pixels that show nothing, letting members below
+    // show through.
+    NoData *NoDataMask
+
+    file *os.File
+}
+
+// Bounds returns the member's main image in mosaic coordinates.
+func (mm *MosaicMember) Bounds() image.Rectangle {
+    if len(mm.Transform) == 0 {
+        return mm.Reader.Bounds().Add(mm.Offset)
+    }
+    return transformBounds(mm.Reader.Bounds(), mm.Transform.Apply).Add(mm.Offset)
+}
+
+// transformBounds returns the pixels covering r mapped by f, sampling its
+// edges since f may bend them.
+func transformBounds(r image.Rectangle, f func(x, y float64) (float64, float64)) image.Rectangle {
+    const steps = 16
+    minX, minY := math.Inf(1), math.Inf(1)
+    maxX, maxY := math.Inf(-1), math.Inf(-1)
+    add := func(x, y float64) {
+        x, y = f(x, y)
+        minX, minY = min(minX, x), min(minY, y)
+        maxX, maxY = max(maxX, x), max(maxY, y)
+    }
+    x0, y0, x1, y1 := float64(r.Min.X), float64(r.Min.Y), float64(r.Max.X), float64(r.Max.Y)
+    for i := 0; i <= steps; i++ {
+        t := float64(i) / steps
+        add(x0+(x1-x0)*t, y0)
+        add(x0+(x1-x0)*t, y1)
+        add(x0, y0+(y1-y0)*t)
+        add(x1, y0+(y1-y0)*t)
+    }
+    return image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY)))
+}
+
+// local maps the mosaic pixel (x, y) to the member pixel under its center,
+// reporting false when that pixel is outside the member or has no data.
+func (mm *MosaicMember) local(x, y int) (image.Point, bool) {
+    if len(mm.Transform) == 0 {
+        p := image.Pt(x, y).Sub(mm.Offset)
+        return p, p.In(mm.Reader.Bounds()) && mm.NoData.Valid(p.X, p.Y)
+    }
+    lx, ly, ok := mm.Transform.Invert(float64(x-mm.Offset.X)+0.5, float64(y-mm.Offset.Y)+0.5)
+    if !ok {
+        return image.Point{}, false
+    }
+    p := image.Pt(int(math.Floor(lx)), int(math.Floor(ly)))
+    return p, p.In(mm.Reader.Bounds()) && mm.NoData.Valid(p.X, p.Y)
+}
+
+// render calls visit for every pixel of part the member covers, with the
+// member pixel it shows and its sRGB color. Transformed members are sampled
+// at the nearest pixel.
+func (mm *MosaicMember) render(part image.Rectangle, visit func(x, y int, local image.Point, rgb []byte)) error {
+    var src *image.RGBA
+    var err error
+    if len(mm.Transform) == 0 {
+        src, err = mm.Reader.ReadRegionImage(part.Sub(mm.Offset))
+    } else {
+        inv := func(x, y float64) (float64, float64) {
+            lx, ly, _ := mm.Transform.Invert(x, y)
+            return lx, ly
+        }
+        need := transformBounds(part.Sub(mm.Offset), inv).Inset(-1).Intersect(mm.Reader.Bounds())
+        if need.Empty() {
+            return nil
+        }
+        src, err = mm.Reader.ReadRegionImage(need)
+    }
+    if err != nil {
+        return fmt.Errorf("%s: %w", mm.Name, err)
+    }
+    for y := part.Min.Y; y < part.Max.Y; y++ {
+        for x := part.Min.X; x < part.Max.X; x++ {
+            p, ok := mm.local(x, y)
+            if !ok || !p.In(src.Rect) {
+                continue
+            }
+            i := src.PixOffset(p.X, p.Y)
+            visit(x, y, p, src.Pix[i:i+3])
+        }
+    }
+    return nil
+}
+
+// Mosaic treats several files as one image. Where members overlap, later
+// ones cover earlier ones unless Blend says otherwise.
+type Mosaic struct {
+    Members []MosaicMember
+    Blend   MosaicBlend
+    // Feather is the width of the BlendFeather ramp in pixels. Zero selects
+    // DefaultFeather.
+    Feather int
+}
+
+// MosaicHit is the pixel a mosaic position falls on.
+type MosaicHit struct {
+    // Member indexes Mosaic.Members.
+    Member int
+    // Point is the position in the member's own pixel coordinates.
+    Point image.Point
+    PixeLink
+}
+
+// OpenMosaic opens the files a manifest lists. Close releases them.
+func OpenMosaic(manifest string) (*Mosaic, error) {
+    data, err := os.ReadFile(manifest)
+    if err != nil {
+        return nil, err
+    }
+    var mf MosaicManifest
+    if err := json.Unmarshal(data, &mf); err != nil {
+        return nil, fmt.Errorf("failed to parse mosaic manifest: %w", err)
+    }
+    m := &Mosaic{Feather: mf.Feather}
+    if mf.Blend != "" {
+        if m.Blend, err = ParseMosaicBlend(mf.Blend); err != nil {
+            return nil, err
+        }
+    }
+    dir := filepath.Dir(manifest)
+    for _, p := range mf.Members {
+        name := p.File
+        if !filepath.IsAbs(name) {
+            name = filepath.Join(dir, filepath.FromSlash(name))
+        }
+        mm, err := openMosaicMember(name)
+        if err != nil {
+            m.Close()
+            return nil, fmt.Errorf("%s: %w", p.File, err)
+        }
+        mm.Name, mm.Offset = p.File, image.Pt(p.X, p.Y)
+        if mm.Transform, err = mm.Reader.Transform(); err != nil {
+            mm.file.Close()
+            m.Close()
+            return nil, fmt.Errorf("%s: %w", p.File, err)
+        }
+        if mm.NoData, err = mm.Reader.NoData(); err != nil {
+            mm.file.Close()
+            m.Close()
+            return nil, fmt.Errorf("%s: %w", p.File, err)
+        }
+        m.Members = append(m.Members, mm)
+    }
+    return m, nil
+}
+
+func openMosaicMember(name string) (MosaicMember, error) {
+    f, err := os.Open(name)
+    if err != nil {
+        return MosaicMember{}, err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return MosaicMember{}, err
+    }
+    r, err := NewReader(f, info.Size())
+    if err != nil {
+        f.Close()
+        return MosaicMember{}, err
+    }
+    return MosaicMember{Reader: r, file: f}, nil
+}
+
+// Close closes the files OpenMosaic opened. Members added by the caller are
+// left alone.
+func (m *Mosaic) Close() error {
+    var errs []error
+    for i := range m.Members {
+        if f := m.Members[i].file; f != nil {
+            errs = append(errs, f.Close())
+            m.Members[i].file = nil
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// Bounds is the smallest rectangle covering every member.
+func (m *Mosaic) Bounds() image.Rectangle {
+    var r image.Rectangle
+    for i := range m.Members {
+        r = r.Union(m.Members[i].Bounds())
+    }
+    return r
+}
+
+// ReadRegionImage renders rect of the mosaic as sRGB, reading only the
+// tiles of members that overlap it. Pixels no member covers are
+// transparent. The image bounds are rect.
+func (m *Mosaic) ReadRegionImage(rect image.Rectangle) (*image.RGBA, error) {
+    if m.Blend == BlendFeather {
+        return m.readFeathered(rect)
+    }
+    img := image.NewRGBA(rect)
+    for i := range m.Members {
+        mm := &m.Members[i]
+        part := rect.Intersect(mm.Bounds())
+        if part.Empty() {
+            continue
+        }
+        err := mm.render(part, func(x, y int, _ image.Point, rgb []byte) {
+            i := img.PixOffset(x, y)
+            copy(img.Pix[i:i+3], rgb)
+            img.Pix[i+3] = 0xff
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    return img, nil
+}
+
+// HitTest finds the member on top at (x, y) and the pixel there. It reports
+// false when no member covers the position.
+func (m *Mosaic) HitTest(x, y int) (MosaicHit, bool, error) {
+    for i := len(m.Members) - 1; i >= 0; i-- {
+        mm := &m.Members[i]
+        local, ok := mm.local(x, y)
+        if !ok {
+            continue
+        }
+        region, err := mm.Reader.ReadRegion(image.Rectangle{local, local.Add(image.Pt(1, 1))})
+        if err != nil {
+            return MosaicHit{}, false, fmt.Errorf("%s: %w", mm.Name, err)
+        }
+        return MosaicHit{Member: i, Point: local, PixeLink: region[0][0]}, true, nil
+    }
+    return MosaicHit{}, false, nil
+}
+
+// Nested reads the nested image a hit links to, or returns nil when the
+// pixel has no link or its file does not carry links.
+func (m *Mosaic) Nested(hit MosaicHit) (*NestedImage, error) {
+    r := m.Members[hit.Member].Reader
+    if r.Header.Payload != PayloadLink || hit.NestedIdx == 0 {
+        return nil, nil
+    }
+    return r.ReadNestedImage(int(hit.NestedIdx) - 1)
+}
+
+// readFeathered sums every member's colors over rect weighted by featherWeight
+// and normalizes by the total weight.
+func (m *Mosaic) readFeathered(rect image.Rectangle) (*image.RGBA, error) {
+    feather := m.Feather
+    if feather <= 0 {
+        feather = DefaultFeather
+    }
+    w := rect.Dx()
+    acc := make([]float64, w*rect.Dy()*4)
+    for i := range m.Members {
+        mm := &m.Members[i]
+        part := rect.Intersect(mm.Bounds())
+        if part.Empty() {
+            continue
+        }
+        bounds := mm.Reader.Bounds()
+        err := mm.render(part, func(x, y int, local image.Point, rgb []byte) {
+            wt := featherWeight(local.X, local.Y, bounds, feather)
+            a := ((y-rect.Min.Y)*w + x - rect.Min.X) * 4
+            acc[a] += wt * float64(rgb[0])
+            acc[a+1] += wt * float64(rgb[1])
+            acc[a+2] += wt * float64(rgb[2])
+            acc[a+3] += wt
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    img := image.NewRGBA(rect)
+    for i := 0; i < len(acc); i += 4 {
+        if wt := acc[i+3]; wt > 0 {
+            img.Pix[i] = uint8(acc[i]/wt + 0.5)
+            img.Pix[i+1] = uint8(acc[i+1]/wt + 0.5)
+            img.Pix[i+2] = uint8(acc[i+2]/wt + 0.5)
+            img.Pix[i+3] = 0xff
+        }
+    }
+    return img, nil
+}
+
+// featherWeight ramps from nearly 0 at the edge of the member's bounds to 1 at feather
+// pixels inside it. It never reaches 0, so a pixel only one member covers
+// keeps that member's color.
+func featherWeight(x, y int, bounds image.Rectangle, feather int) float64 {
+    d := min(x-bounds.Min.X, bounds.Max.X-1-x, y-bounds.Min.Y, bounds.Max.Y-1-y)
+    return min(float64(d)+0.5, float64(feather)) / float64(feather)
+}
@@ -1,13 +1,19 @@
 package nest
 
 import (
+    "bytes"
+    "crypto/sha256"
     "encoding/binary"
     "errors"
     "fmt"
     "io"
     "os"
+    "math"
     "math/rand"
     "time"
+    "unsafe"
+
+    "github.com/70ziko/NEST/colorspace"
 )
 
 type ImageWriter interface {
@@ -25,6 +31,21 @@ type FileHeader struct {
     Height      uint32
     TileSize    uint16
     NestedCount uint32
+    ByteOrder   Endianness
+    TileOrder   TileOrder
+    ColorSpace  colorspace.Space
+    LinkBits    uint8
+    Payload     PayloadKind
+    // Bands is the number of spectral bands stored besides the RGB main
+    // image. Writing sets it from NestedImageFile.Bands.
+    Bands uint16
+    // Orientation says how the main image is turned for display. Pixels,
+    // tiles and links stay in stored coordinates.
+    Orientation Orientation
+    // Dictionary is the ID of the dictionary zstd planes were compressed
+    // with, zero when there is none. Writing sets it from
+    // WriteOptions.Dictionary.
+    Dictionary uint32
 }
 
 type PixeLink struct {
@@ -40,97 +61,668 @@ type NestedImage struct {
     Width  uint16
     Height uint16
     Data   []byte
+    Role   NestedRole
+    // Content, when set, is the entry's source, such as an SVG document,
+    // and Data a rendering of it.
+    Content *NestedContent
 }
 
 type NestedImageFile struct {
     Header       FileHeader
     MainImage    [][]PixeLink
     NestedImages []NestedImage
+    Index        *TileIndex
+    LinkChannels []LinkChannel
+    Metadata     Metadata
+    Pyramid      []PyramidLevel
+    Chunks       []Chunk
+    // Transform maps the main image into a parent space. It is stored and
+    // never applied to the pixels.
+    Transform TransformChain
+    // Provenance, when set, records the operations that produced each tile.
+    Provenance *Provenance
+    // Audit, when set, records every change made through the library.
+    Audit *AuditLog
+    // Planes holds the focal planes of a Z stack after the main image,
+    // which is plane 0.
+    Planes []Plane
+    // Bands holds multispectral samples, in index order.
+    Bands []Band
+    // NoData, when set, marks the main image pixels that hold no data.
+    NoData *NoDataMask
+    // TileTimes holds when each main image tile was last updated, in
+    // row-major order, for files kept current from live sources. Zero times
+    // are unknown. Resize, Extract and Frame.File leave them out.
+    TileTimes []time.Time
+    // Annotations are notes on regions of the main image, sorted by ID.
+    Annotations []Annotation
+    // Collab, when set, records shared edits to links and annotations.
+    Collab *Collab
+    // Layers describes imported layered artwork, parents before members.
+    Layers []Layer
+    // Templates are the reusable nested images, sorted by name.
+    Templates []Template
+    // Adjustments, when set, change how the main image is displayed.
+    Adjustments *Adjustments
+    // Canvas, when set, places the main image on a larger document with a
+    // background color.
+    Canvas *Canvas
+    // Trailer is the trailer the file was read with. Writes always record
+    // a new one.
+    Trailer *Trailer
+
+    // pyramidSource holds the main image tile checksums the pyramid was
+    // built from, so RebuildPyramid can tell which tiles changed.
+    pyramidSource []uint32
+    // dictionary is the one the file was read with, for decoding the
+    // pyramid and focal planes.
+    dictionary *Dictionary
+    // trailerSum is the hash of the bytes before Trailer, when a read
+    // verifies it.
+    trailerSum []byte
+    // searchIndexed records that the file was read with a search index.
+    searchIndexed bool
 }
 
 const MAGIC = "NEST"
 
+// Before version 5 PixeLinks were stored packed: R, G, B and a 4 byte
+// NestedIdx.
+const pixeLinkDiskSize = 7
+
+const VERSION = 6
+
+func NewNestedImageFile(width, height int, tileSize uint16) *NestedImageFile {
+    nif := &NestedImageFile{
+        Header: FileHeader{
+            Version:  VERSION,
+            Width:    uint32(width),
+            Height:   uint32(height),
+            TileSize: tileSize,
+        },
+        MainImage: pixelRows(width, height),
+    }
+    copy(nif.Header.Magic[:], MAGIC)
+    return nif
+}
+
 func (nif *NestedImageFile) Write(writer io.Writer) error {
-    if err := binary.Write(writer, binary.LittleEndian, &nif.Header); err != nil {
-        return fmt.Errorf("failed to write header: %w", err)
+    return nif.WriteWithOptions(writer, WriteOptions{})
+}
+
+func (nif *NestedImageFile) WriteWithOptions(writer io.Writer, opts WriteOptions) error {
+    return nif.write(writer, opts, nil)
+}
+
+// write encodes the file to writer. With a journal, tiles that survived an
+// interrupted write are kept and every new tile is recorded once written.
+func (nif *NestedImageFile) write(writer io.Writer, opts WriteOptions, j *journal) error {
+    header := nif.Header
+    header.Version = VERSION
+    header.TileOrder = opts.TileOrder
+    bits, err := header.payloadBits()
+    if err != nil {
+        return err
+    }
+    header.LinkBits = bits
+    if len(nif.Bands) > math.MaxUint16 {
+        return fmt.Errorf("file has %d bands, the limit is %d", len(nif.Bands), math.MaxUint16)
+    }
+    header.Bands = uint16(len(nif.Bands))
+    if header.Orientation > OrientationRotate270 {
+        return fmt.Errorf("unknown orientation %d", header.Orientation)
+    }
+    if len(opts.Encoder) > maxEncoderLength {
+        return fmt.Errorf("encoder name is %d bytes, the limit is %d", len(opts.Encoder), maxEncoderLength)
+    }
+    order := header.ByteOrder.order()
+    var embedded *Dictionary
+    header.Dictionary = 0
+    if opts.Dictionary != nil {
+        if err := opts.Dictionary.check(); err != nil {
+            return err
+        }
+        header.Dictionary = opts.Dictionary.ID()
+        if !opts.SharedDictionary {
+            embedded = opts.Dictionary
+        }
+    }
+
+    tileSize := int(header.TileSize)
+    cols, rows := tileGrid(header.Width, header.Height, header.TileSize)
+    index := &TileIndex{Order: opts.TileOrder, Cols: cols, Rows: rows, HasChecksums: true}
+    codec := header.tileCodec(opts.Dictionary)
+    codec.quality = opts.Quality
+    codec.linkCodec = opts.LinkCodec
+    codec.adaptive = opts.Adaptive
+    codec.sampler = opts.sampler
+    codec.predict = opts.Predict
+    if opts.Predict && opts.Quality > 0 {
+        return errors.New("prediction needs lossless tiles and can't be combined with Quality")
+    }
+    seq := tileSequence(opts.TileOrder, cols, rows)
+    // pos holds where each tile comes in seq, since tiles are only
+    // predicted from neighbors written before them.
+    var pos []int
+    if opts.Predict {
+        pos = make([]int, len(seq))
+        for i, t := range seq {
+            pos[t.Y*cols+t.X] = i
+        }
+    }
+    neighbors := func(i int) *prediction {
+        if pos == nil {
+            return nil
+        }
+        return nif.neighbors(seq[i], func(x, y int) int { return pos[y*cols+x] })
+    }
+    // source checksums the pixels tile i is encoded from, including the
+    // neighbors it is predicted from, so a journal only keeps tiles whose
+    // encoding would come out the same.
+    source := func(i int, tile []PixeLink) uint32 {
+        data := encodeTile(tile, order)
+        if p := neighbors(i); p != nil {
+            for _, n := range [][]PixeLink{p.left, p.top} {
+                if n != nil {
+                    data = append(data, encodeTile(n, order)...)
+                }
+            }
+        }
+        return tileChecksum(data)
+    }
+    var stats []TileStats
+    if opts.TileStats {
+        stats = make([]TileStats, len(seq))
+    }
+    tileStats := func(i int, tile []PixeLink) {
+        if stats != nil {
+            stats[i] = computeTileStats(tile, nif.grid().TileBounds(seq[i].X, seq[i].Y), tileSize, nif.NoData)
+        }
+    }
+    var classes []TileClass
+    if opts.Adaptive {
+        classes = make([]TileClass, len(seq))
+    }
+    tileClass := func(i int, tile []PixeLink) TileClass {
+        if classes == nil {
+            return ClassUnknown
+        }
+        b := nif.grid().TileBounds(seq[i].X, seq[i].Y)
+        classes[i] = classifyTile(tile, tileSize, b.Dx(), b.Dy())
+        return classes[i]
+    }
+    ecc, err := newECCWriter(opts.ECCLevel)
+    if err != nil {
+        return err
+    }
+    for i := range nif.NestedImages {
+        if err := nif.NestedImages[i].check(i, 0, true); err != nil {
+            return err
+        }
     }
 
-    for y := 0; y < len(nif.MainImage); y += int(nif.Header.TileSize) {
-        for x := 0; x < len(nif.MainImage[0]); x += int(nif.Header.TileSize) {
-            tile := nif.extractTile(x, y, int(nif.Header.TileSize))
-            if err := binary.Write(writer, binary.LittleEndian, tile); err != nil {
-                return fmt.Errorf("failed to write tile at (%d, %d): %w", x, y, err)
+    sp := newSpiller(opts.SpillDir, opts.SpillThreshold)
+    defer sp.close()
+    // sum hashes the whole file for the trailer.
+    sum := sha256.New()
+    cw := &countingWriter{w: io.MultiWriter(writer, sum), limit: opts.MaxOutputBytes}
+    var sources []uint32
+    var resumed []journalRecord
+    if j != nil {
+        var hb bytes.Buffer
+        if err := header.write(&hb, embedded); err != nil {
+            return fmt.Errorf("failed to write header: %w", err)
+        }
+        settings := append(codec.fingerprint(), byte(opts.ECCLevel))
+        sources = make([]uint32, len(seq))
+        resumed, err = j.resume(hb.Bytes(), settings, func(rec journalRecord) bool {
+            if int(rec.Seq) >= len(seq) {
+                return false
             }
+            t := seq[rec.Seq]
+            return rec.Source == source(int(rec.Seq), nif.extractTile(t.X*tileSize, t.Y*tileSize, tileSize))
+        })
+        if err != nil {
+            return err
+        }
+        cw.n = j.end
+        if len(resumed) > 0 {
+            sum.Write(hb.Bytes())
+        }
+    }
+    if len(resumed) == 0 {
+        if err := header.write(cw, embedded); err != nil {
+            return fmt.Errorf("failed to write header: %w", err)
+        }
+    }
+    for _, rec := range resumed {
+        data, err := j.tile(rec)
+        if err != nil {
+            return err
+        }
+        t := seq[rec.Seq]
+        tile := nif.extractTile(t.X*tileSize, t.Y*tileSize, tileSize)
+        tileStats(int(rec.Seq), tile)
+        tileClass(int(rec.Seq), tile)
+        index.Entries = append(index.Entries, TileIndexEntry{Tile: t, Offset: rec.Offset, Length: rec.Length, Checksum: rec.Checksum})
+        ecc.add(data)
+        sum.Write(data)
+    }
+
+    start := len(resumed)
+    err = encodeInOrder(len(seq)-start, opts.Workers, sp, func(i int) ([]byte, error) {
+        i += start
+        x, y := seq[i].X*tileSize, seq[i].Y*tileSize
+        tile := nif.extractTile(x, y, tileSize)
+        tileStats(i, tile)
+        if sources != nil {
+            sources[i] = source(i, tile)
+        }
+        class := tileClass(i, tile)
+        data, err := codec.sampler.encode(i, int(class), func() ([]byte, error) {
+            if pred := neighbors(i); pred != nil {
+                // Predicted encodings depend on the neighbors too, so they
+                // can't be shared through Dedup.
+                return codec.encode(tile, class, pred)
+            }
+            return opts.Dedup.encode(codec, tile, class)
+        })
+        if err != nil {
+            return nil, fmt.Errorf("failed to encode tile at (%d, %d): %w", x, y, err)
+        }
+        return data, nil
+    }, func(i int, data []byte) error {
+        i += start
+        offset := cw.n
+        if _, err := cw.Write(data); err != nil {
+            return fmt.Errorf("failed to write tile at (%d, %d): %w", seq[i].X*tileSize, seq[i].Y*tileSize, err)
         }
+        e := TileIndexEntry{Tile: seq[i], Offset: offset, Length: cw.n - offset, Checksum: tileChecksum(data)}
+        index.Entries = append(index.Entries, e)
+        ecc.add(data)
+        if j != nil {
+            return j.record(journalRecord{Seq: uint32(i), Offset: e.Offset, Length: e.Length, Checksum: e.Checksum, Source: sources[i]})
+        }
+        return nil
+    })
+    if err != nil {
+        return err
     }
 
     for i, img := range nif.NestedImages {
-        if err := img.Write(writer); err != nil {
+        if err := img.write(cw, order); err != nil {
             return fmt.Errorf("failed to write nested image %d: %w", i, err)
         }
     }
 
+    tail := tailChunk{ChunksOffset: cw.n, IndexOffset: cw.n}
+    data, err := index.encode(order)
+    if err != nil {
+        return fmt.Errorf("failed to encode tile index: %w", err)
+    }
+    if err := (&Chunk{Type: ChunkIndex, Data: data}).write(cw, order); err != nil {
+        return fmt.Errorf("failed to write tile index: %w", err)
+    }
+    if err := (&Chunk{Type: ChunkChecksums, Data: index.encodeChecksums(order)}).write(cw, order); err != nil {
+        return fmt.Errorf("failed to write tile checksums: %w", err)
+    }
+    if stats != nil {
+        index.Stats = stats
+        if err := (&Chunk{Type: ChunkStats, Data: index.encodeStats(order)}).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write tile statistics: %w", err)
+        }
+    }
+    if classes != nil {
+        index.Classes = classes
+        if err := (&Chunk{Type: ChunkClasses, Data: index.encodeClasses(order)}).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write tile classes: %w", err)
+        }
+    }
+    if parity := ecc.chunk(order); parity != nil {
+        if err := parity.write(cw, order); err != nil {
+            return fmt.Errorf("failed to write parity: %w", err)
+        }
+    }
+
+    if len(nif.Metadata) > 0 {
+        data, err := nif.Metadata.encode(order)
+        if err != nil {
+            return fmt.Errorf("failed to encode metadata: %w", err)
+        }
+        if err := (&Chunk{Type: ChunkMetadata, Data: data}).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write metadata: %w", err)
+        }
+    }
+
+    if roles := nif.roleChunk(); roles != nil {
+        if err := roles.write(cw, order); err != nil {
+            return fmt.Errorf("failed to write nested image roles: %w", err)
+        }
+    }
+
+    if err := nif.writeNestedContent(cw, order); err != nil {
+        return err
+    }
+
+    if len(nif.Transform) > 0 {
+        c, err := nif.Transform.chunk(order)
+        if err != nil {
+            return err
+        }
+        if err := c.write(cw, order); err != nil {
+            return fmt.Errorf("failed to write transform: %w", err)
+        }
+    }
+
+    if nif.NoData != nil {
+        if nif.NoData.Width != int(header.Width) || nif.NoData.Height != int(header.Height) {
+            return fmt.Errorf("no-data mask is %dx%d, the main image is %dx%d", nif.NoData.Width, nif.NoData.Height, header.Width, header.Height)
+        }
+        if err := nif.NoData.chunk(nif.grid(), order).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write no-data mask: %w", err)
+        }
+    }
+
+    if len(nif.Annotations) > 0 {
+        for _, a := range nif.Annotations {
+            if err := checkAnnotation(a); err != nil {
+                return err
+            }
+        }
+        if err := (&Chunk{Type: ChunkAnnotations, Data: encodeAnnotations(nif.Annotations, order)}).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write annotations: %w", err)
+        }
+    }
+
+    if opts.SearchIndex {
+        if err := (&Chunk{Type: ChunkSearchIndex, Data: buildSearchIndex(nif.Annotations, nif.Metadata).encode()}).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write search index: %w", err)
+        }
+    }
+
+    if len(nif.Layers) > 0 {
+        if err := nif.checkLayers(); err != nil {
+            return err
+        }
+        if err := (&Chunk{Type: ChunkLayers, Data: encodeLayers(nif.Layers, order)}).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write layers: %w", err)
+        }
+    }
+
+    if nif.Adjustments != nil {
+        if err := nif.Adjustments.check(); err != nil {
+            return err
+        }
+        if err := (&Chunk{Type: ChunkAdjustments, Data: nif.Adjustments.encode(order)}).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write adjustments: %w", err)
+        }
+    }
+
+    if nif.Canvas != nil {
+        if err := nif.Canvas.check(header.Orientation.Size(int(header.Width), int(header.Height))); err != nil {
+            return err
+        }
+        if err := (&Chunk{Type: ChunkCanvas, Data: nif.Canvas.encode(order)}).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write canvas: %w", err)
+        }
+    }
+
+    if len(nif.Templates) > 0 {
+        if err := nif.checkTemplates(); err != nil {
+            return err
+        }
+        if err := (&Chunk{Type: ChunkTemplates, Data: encodeTemplates(nif.Templates, order)}).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write templates: %w", err)
+        }
+    }
+
+    if nif.Collab != nil {
+        c, err := nif.Collab.chunk(order)
+        if err != nil {
+            return err
+        }
+        if err := c.write(cw, order); err != nil {
+            return fmt.Errorf("failed to write edit history: %w", err)
+        }
+    }
+
+    if nif.TileTimes != nil {
+        if len(nif.TileTimes) != cols*rows {
+            return fmt.Errorf("file has %d tile update times for %d tiles", len(nif.TileTimes), cols*rows)
+        }
+        if err := (&Chunk{Type: ChunkTileTimes, Data: encodeTileTimes(nif.TileTimes, order)}).write(cw, order); err != nil {
+            return fmt.Errorf("failed to write tile update times: %w", err)
+        }
+    }
+
+    if nif.Provenance != nil {
+        c, err := nif.Provenance.chunk(order)
+        if err != nil {
+            return err
+        }
+        if err := c.write(cw, order); err != nil {
+            return fmt.Errorf("failed to write provenance: %w", err)
+        }
+    }
+
+    if nif.Audit != nil {
+        c, err := nif.Audit.chunk(order)
+        if err != nil {
+            return err
+        }
+        if err := c.write(cw, order); err != nil {
+            return fmt.Errorf("failed to write audit log: %w", err)
+        }
+    }
+
+    if err := nif.writeLinkChannels(cw, order); err != nil {
+        return fmt.Errorf("failed to write link channels: %w", err)
+    }
+
+    if err := nif.writePyramid(cw, codec, opts.Workers, sp); err != nil {
+        return fmt.Errorf("failed to write pyramid: %w", err)
+    }
+
+    if err := nif.writePlanes(cw, codec, opts.Workers, sp); err != nil {
+        return fmt.Errorf("failed to write focal planes: %w", err)
+    }
+
+    if err := nif.writeBands(cw, order); err != nil {
+        return fmt.Errorf("failed to write bands: %w", err)
+    }
+
+    if err := nif.writeChunks(cw, order); err != nil {
+        return fmt.Errorf("failed to write chunks: %w", err)
+    }
+
+    trailer := &Trailer{Encoder: opts.encoder(), Written: opts.written()}
+    copy(trailer.Hash[:], sum.Sum(nil))
+    if err := trailer.chunk(order).write(cw, order); err != nil {
+        return fmt.Errorf("failed to write trailer: %w", err)
+    }
+
+    if err := tail.write(cw, order); err != nil {
+        return fmt.Errorf("failed to write tail chunk: %w", err)
+    }
+
     return nil
 }
 
 func (nif *NestedImageFile) Read(reader io.Reader) error {
-    if err := binary.Read(reader, binary.LittleEndian, &nif.Header); err != nil {
-        return fmt.Errorf("failed to read header: %w", err)
+    return nif.ReadWithOptions(reader, ReadOptions{})
+}
+
+func (nif *NestedImageFile) ReadWithOptions(reader io.Reader, opts ReadOptions) error {
+    budget := newMemoryBudget(opts.MaxMemory, opts.Deadline)
+
+    if ra, ok := reader.(io.ReaderAt); ok {
+        if seeker, ok := reader.(io.Seeker); ok {
+            return nif.readParallel(ra, seeker, opts, budget)
+        }
     }
 
-    if string(nif.Header.Magic[:]) != MAGIC {
-        return errors.New("invalid file format")
+    if opts.VerifyTrailer {
+        reader = &hashingReader{r: reader, h: sha256.New()}
+    }
+    dict, err := nif.Header.read(reader)
+    if err != nil {
+        return fmt.Errorf("failed to read header: %w", err)
     }
+    nif.dictionary = dict
+    order := nif.Header.ByteOrder.order()
 
-    nif.MainImage = make([][]PixeLink, nif.Header.Height)
-    for i := range nif.MainImage {
-        nif.MainImage[i] = make([]PixeLink, nif.Header.Width)
+    if err := nif.allocMainImage(budget, opts.Arena); err != nil {
+        return err
     }
 
     tileSize := int(nif.Header.TileSize)
-    for y := 0; y < int(nif.Header.Height); y += tileSize {
-        for x := 0; x < int(nif.Header.Width); x += tileSize {
-            tile := make([]PixeLink, tileSize*tileSize)
-            if err := binary.Read(reader, binary.LittleEndian, &tile); err != nil {
+    if err := budget.reserve(int64(tileSize)*int64(tileSize)*pixeLinkSize, "tile buffer"); err != nil {
+        return err
+    }
+    tile := make([]PixeLink, tileSize*tileSize)
+    cols, rows := tileGrid(nif.Header.Width, nif.Header.Height, nif.Header.TileSize)
+    codec := nif.Header.tileCodec(dict)
+    seq, err := orderTiles(nif.Header.TileOrder, cols, rows, budget)
+    if err != nil {
+        return err
+    }
+    for _, tc := range seq {
+        if err := budget.check(); err != nil {
+            return err
+        }
+        x, y := tc.X*tileSize, tc.Y*tileSize
+        if nif.Header.Version >= 5 {
+            if err := codec.decode(reader, tile, nif.neighborSource(tc)); err != nil {
                 return fmt.Errorf("failed to read tile at (%d, %d): %w", x, y, err)
             }
-            nif.fillTile(tile, x, y, tileSize)
+        } else if err := binary.Read(reader, order, &tile); err != nil {
+            return fmt.Errorf("failed to read tile at (%d, %d): %w", x, y, err)
         }
+        nif.fillTile(tile, x, y, tileSize)
     }
 
+    if err := nif.readNestedAndChunks(reader, order, budget, opts.MaxNestedImageSize); err != nil {
+        return err
+    }
+    if opts.VerifyTrailer {
+        switch {
+        case nif.Trailer == nil:
+            return ErrNoTrailer
+        case !bytes.Equal(nif.trailerSum, nif.Trailer.Hash[:]):
+            return ErrTrailerMismatch
+        }
+    }
+    return nil
+}
+
+func (nif *NestedImageFile) readParallel(ra io.ReaderAt, seeker io.Seeker, opts ReadOptions, budget *memoryBudget) error {
+    start, err := seeker.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return err
+    }
+    end, err := seeker.Seek(0, io.SeekEnd)
+    if err != nil {
+        return err
+    }
+
+    nr, err := newReader(io.NewSectionReader(ra, start, end-start), end-start, budget)
+    if err != nil {
+        return err
+    }
+    nif.Header = nr.Header
+    nif.dictionary = nr.dictionary
+    if opts.VerifyTrailer {
+        if err := nr.VerifyTrailer(); err != nil {
+            return err
+        }
+    }
+    if err := nif.allocMainImage(budget, opts.Arena); err != nil {
+        return err
+    }
+    if err := nr.decodeTiles(nif.MainImage, opts.Workers, budget); err != nil {
+        return err
+    }
+
+    nestedOffset := nr.tilesEnd()
+    sr := io.NewSectionReader(ra, start+nestedOffset, end-start-nestedOffset)
+    return nif.readNestedAndChunks(sr, nr.order, budget, opts.MaxNestedImageSize)
+}
+
+func (nif *NestedImageFile) allocMainImage(budget *memoryBudget, arena *Arena) error {
+    width, height := int(nif.Header.Width), int(nif.Header.Height)
+    if !arena.fits(width, height) {
+        if err := budget.reserve(int64(height)*24+int64(width)*int64(height)*pixeLinkSize, "main image"); err != nil {
+            return err
+        }
+    }
+    nif.MainImage = arena.image(width, height)
+    return nil
+}
+
+func (nif *NestedImageFile) readNestedAndChunks(reader io.Reader, order binary.ByteOrder, budget *memoryBudget, limit int64) error {
+    if err := budget.reserve(int64(nif.Header.NestedCount)*int64(unsafe.Sizeof(NestedImage{})), "nested image table"); err != nil {
+        return err
+    }
     nif.NestedImages = make([]NestedImage, nif.Header.NestedCount)
     for i := range nif.NestedImages {
-        if err := nif.NestedImages[i].Read(reader); err != nil {
+        if err := budget.check(); err != nil {
+            return err
+        }
+        if err := nif.NestedImages[i].read(reader, order, budget, i, limit); err != nil {
+            var nerr *NestedImageError
+            if errors.As(err, &nerr) {
+                return err
+            }
             return fmt.Errorf("failed to read nested image %d: %w", i, err)
         }
     }
 
+    if nif.Header.Version >= 2 {
+        if err := nif.readChunks(reader, order, budget); err != nil {
+            return fmt.Errorf("failed to read chunks: %w", err)
+        }
+    }
+
     return nil
 }
 
+// extractTile always returns a full size*size tile; pixels past the image
+// edge are left zero so the reader can consume fixed-size records.
 func (nif *NestedImageFile) extractTile(x, y, size int) []PixeLink {
-    tile := make([]PixeLink, 0, size*size)
-    for j := y; j < y+size && j < len(nif.MainImage); j++ {
-        for i := x; i < x+size && i < len(nif.MainImage[j]); i++ {
-            tile = append(tile, nif.MainImage[j][i])
+    tile := make([]PixeLink, size*size)
+    for j := 0; j < size && y+j < len(nif.MainImage); j++ {
+        for i := 0; i < size && x+i < len(nif.MainImage[y+j]); i++ {
+            tile[j*size+i] = nif.MainImage[y+j][x+i]
         }
     }
     return tile
 }
 
 func (nif *NestedImageFile) fillTile(tile []PixeLink, x, y, tileSize int) {
-    for j := 0; j < tileSize && y+j < len(nif.MainImage); j++ {
-        for i := 0; i < tileSize && x+i < len(nif.MainImage[y+j]); i++ {
-            nif.MainImage[y+j][x+i] = tile[j*tileSize+i]
+    fillTile(nif.MainImage, tile, x, y, tileSize)
+}
+
+func fillTile(dst [][]PixeLink, tile []PixeLink, x, y, tileSize int) {
+    for j := 0; j < tileSize && y+j < len(dst); j++ {
+        for i := 0; i < tileSize && x+i < len(dst[y+j]); i++ {
+            dst[y+j][x+i] = tile[j*tileSize+i]
         }
     }
 }
 
 func (ni *NestedImage) Write(writer io.Writer) error {
-    if err := binary.Write(writer, binary.LittleEndian, ni.Width); err != nil {
+    return ni.write(writer, binary.LittleEndian)
+}
+
+func (ni *NestedImage) Read(reader io.Reader) error {
+    return ni.read(reader, binary.LittleEndian, nil, 0, 0)
+}
+
+func (ni *NestedImage) write(writer io.Writer, order binary.ByteOrder) error {
+    if err := binary.Write(writer, order, ni.Width); err != nil {
         return fmt.Errorf("failed to write nested image width: %w", err)
     }
-    if err := binary.Write(writer, binary.LittleEndian, ni.Height); err != nil {
+    if err := binary.Write(writer, order, ni.Height); err != nil {
         return fmt.Errorf("failed to write nested image height: %w", err)
     }
     if _, err := writer.Write(ni.Data); err != nil {
@@ -139,14 +731,22 @@ func (ni *NestedImage) Write(writer io.Writer) error {
     return nil
 }
 
-func (ni *NestedImage) Read(reader io.Reader) error {
-    if err := binary.Read(reader, binary.LittleEndian, &ni.Width); err != nil {
+// read checks the dimensions against limit before allocating; index only
+// labels errors.
+func (ni *NestedImage) read(reader io.Reader, order binary.ByteOrder, budget *memoryBudget, index int, limit int64) error {
+    if err := binary.Read(reader, order, &ni.Width); err != nil {
         return fmt.Errorf("failed to read nested image width: %w", err)
     }
-    if err := binary.Read(reader, binary.LittleEndian, &ni.Height); err != nil {
+    if err := binary.Read(reader, order, &ni.Height); err != nil {
         return fmt.Errorf("failed to read nested image height: %w", err)
     }
-    ni.Data = make([]byte, ni.Width*ni.Height*3) // Assuming RGB format
+    if err := ni.check(index, limit, false); err != nil {
+        return err
+    }
+    if err := budget.reserve(ni.Size(), "nested image data"); err != nil {
+        return err
+    }
+    ni.Data = make([]byte, ni.Size()) // Assuming RGB format
     if _, err := io.ReadFull(reader, ni.Data); err != nil {
         return fmt.Errorf("failed to read nested image data: %w", err)
     }
@@ -154,13 +754,28 @@ func (ni *NestedImage) Read(reader io.Reader) error {
 }
 
 func WriteNestedImageFile(filename string, nif *NestedImageFile) error {
-    file, err := os.Create(filename)
+    return WriteNestedImageFileWithOptions(filename, nif, WriteOptions{})
+}
+
+// WriteNestedImageFileWithOptions writes to a temporary file and renames it
+// over filename once the write succeeds. See WriteOptions.Journal for
+// resumable writes. When filename has a lock sidecar, see LockedFile, it
+// holds the exclusive lock of OpenExclusive while writing, and fails with
+// ErrLocked while anyone else holds it.
+func WriteNestedImageFileWithOptions(filename string, nif *NestedImageFile, opts WriteOptions) error {
+    if opts.Journal {
+        return writeJournaled(filename, nif, opts)
+    }
+    file, err := CreateAtomic(filename, opts.Sync)
     if err != nil {
         return fmt.Errorf("failed to create file: %w", err)
     }
-    defer file.Close()
+    defer file.Abort()
 
-    return nif.Write(file)
+    if err := nif.WriteWithOptions(file, opts); err != nil {
+        return err
+    }
+    return file.Commit()
 }
 
 func ReadNestedImageFile(filename string) (*NestedImageFile, error) {
@@ -178,11 +793,25 @@ func ReadNestedImageFile(filename string) (*NestedImageFile, error) {
     return nif, nil
 }
 
+func ReadNestedImageFileWithOptions(filename string, opts ReadOptions) (*NestedImageFile, error) {
+    file, err := os.Open(filename)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open file: %w", err)
+    }
+    defer file.Close()
+
+    nif := &NestedImageFile{}
+    if err := nif.ReadWithOptions(file, opts); err != nil {
+        return nil, err
+    }
+
+    return nif, nil
+}
+
 func generateSampleMainImage(width, height int) [][]PixeLink {
     rant := rand.New(rand.NewSource(time.Now().UnixNano()))
-    mainImage := make([][]PixeLink, height)
+    mainImage := pixelRows(width, height)
     for y := range mainImage {
-        mainImage[y] = make([]PixeLink, width)
         for x := range mainImage[y] {
             mainImage[y][x] = PixeLink{
                 R:         byte(rant.Intn(256)),
@@ -223,7 +852,7 @@ func main() {
     nif := &NestedImageFile{
         Header: FileHeader{
             Magic:       [4]byte{'N', 'E', 'S', 'T'},
-            Version:     1,
+            Version:     VERSION,
             Width:       1024,
             Height:      768,
             TileSize:    256,
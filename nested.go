@@ -0,0 +1,118 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+)
+
+var (
+    ErrNestedImageEmpty    = errors.New("nested image has no pixels")
+    ErrNestedImageTooLarge = errors.New("nested image exceeds the size limit")
+    ErrNestedImageData     = errors.New("nested image data does not match its dimensions")
+)
+
+// NestedImageError reports a nested image that failed a size check. Err is
+// one of the ErrNestedImage errors.
+type NestedImageError struct {
+    Index  int
+    Width  int
+    Height int
+    Err    error
+}
+
+func (e *NestedImageError) Error() string {
+    return fmt.Sprintf("nested image %d (%dx%d): %v", e.Index, e.Width, e.Height, e.Err)
+}
+
+func (e *NestedImageError) Unwrap() error {
+    return e.Err
+}
+
+// Size is the byte length of the image's RGB data, computed without
+// overflowing the uint16 dimensions.
+func (ni *NestedImage) Size() int64 {
+    return int64(ni.Width) * int64(ni.Height) * 3
+}
+
+// check validates the dimensions against limit, with zero meaning no limit.
+// Data is only compared when withData is set, since it isn't read yet when
+// decoding.
+func (ni *NestedImage) check(index int, limit int64, withData bool) error {
+    var err error
+    switch {
+    case ni.Width == 0 || ni.Height == 0:
+        err = ErrNestedImageEmpty
+    case limit > 0 && ni.Size() > limit:
+        err = fmt.Errorf("%w: %d bytes, the limit is %d", ErrNestedImageTooLarge, ni.Size(), limit)
+    case withData && int64(len(ni.Data)) != ni.Size():
+        err = fmt.Errorf("%w: %d bytes, want %d", ErrNestedImageData, len(ni.Data), ni.Size())
+    }
+    if err != nil {
+        return &NestedImageError{Index: index, Width: int(ni.Width), Height: int(ni.Height), Err: err}
+    }
+    return nil
+}
+
+// ReadNestedImage decodes nested image i, numbered from 0, with its role
+// and content. OpenNestedContent streams large content instead.
+// Earlier nested images are stepped over by their dimensions.
+func (nr *Reader) ReadNestedImage(i int) (*NestedImage, error) {
+    images, err := nr.readNestedImages([]int{i})
+    if err != nil {
+        return nil, err
+    }
+    return images[0], nil
+}
+
+// readNestedImages decodes the nested images listed in want, which must be
+// in increasing order, in one pass over the nested image section.
+func (nr *Reader) readNestedImages(want []int) ([]*NestedImage, error) {
+    var roles []byte
+    off, length, ok, err := nr.findChunk(ChunkRoles)
+    if err != nil {
+        return nil, err
+    }
+    if ok && length == uint64(nr.Header.NestedCount) {
+        roles = make([]byte, length)
+        if _, err := nr.r.ReadAt(roles, off); err != nil {
+            return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkRoles, err)
+        }
+    }
+
+    images := make([]*NestedImage, 0, len(want))
+    offset := nr.tilesEnd()
+    var dims [4]byte
+    for j := 0; len(images) < len(want); j++ {
+        i := want[len(images)]
+        if i < j || i >= int(nr.Header.NestedCount) {
+            return nil, fmt.Errorf("file has no nested image %d", i)
+        }
+        if _, err := nr.r.ReadAt(dims[:], offset); err != nil {
+            return nil, fmt.Errorf("failed to read nested image %d: %w", j, err)
+        }
+        ni := &NestedImage{Width: nr.order.Uint16(dims[0:2]), Height: nr.order.Uint16(dims[2:4])}
+        if j < i {
+            offset += 4 + ni.Size()
+            continue
+        }
+        if err := ni.check(i, 0, false); err != nil {
+            return nil, err
+        }
+        if offset+4+ni.Size() > nr.size {
+            return nil, fmt.Errorf("nested image %d extends past the end of the file", i)
+        }
+        ni.Data = make([]byte, ni.Size())
+        if _, err := nr.r.ReadAt(ni.Data, offset+4); err != nil {
+            return nil, fmt.Errorf("failed to read nested image %d: %w", i, err)
+        }
+        if roles != nil {
+            ni.Role = NestedRole(roles[i])
+        }
+        if ni.Content, err = nr.nestedContent(i); err != nil {
+            return nil, err
+        }
+        images = append(images, ni)
+        offset += 4 + ni.Size()
+    }
+    return images, nil
+}
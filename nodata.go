@@ -0,0 +1,206 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "math/bits"
+
+    "github.com/70ziko/NEST/tilemath"
+)
+
+// NoDataMask marks main image pixels that hold no data, such as the area
+// outside a scan or sensor dropouts. Tile statistics, Resize and mosaics
+// leave those pixels out instead of treating their padding as real samples.
+// A nil mask has no such pixels.
+type NoDataMask struct {
+    Width, Height int
+    // bits has one bit per pixel, row by row, set where there is no data.
+    bits []uint64
+}
+
+func NewNoDataMask(width, height int) *NoDataMask {
+    return &NoDataMask{Width: width, Height: height, bits: make([]uint64, (width*height+63)/64)}
+}
+
+// Valid reports whether (x, y) holds data. Pixels outside the mask are
+// invalid.
+func (m *NoDataMask) Valid(x, y int) bool {
+    if m == nil {
+        return true
+    }
+    if x < 0 || y < 0 || x >= m.Width || y >= m.Height {
+        return false
+    }
+    i := y*m.Width + x
+    return m.bits[i/64]&(1<<(i%64)) == 0
+}
+
+// SetValid marks (x, y) as holding data or not.
+func (m *NoDataMask) SetValid(x, y int, valid bool) {
+    if x < 0 || y < 0 || x >= m.Width || y >= m.Height {
+        return
+    }
+    i := y*m.Width + x
+    if valid {
+        m.bits[i/64] &^= 1 << (i % 64)
+    } else {
+        m.bits[i/64] |= 1 << (i % 64)
+    }
+}
+
+// Fill marks every pixel of r.
+func (m *NoDataMask) Fill(r image.Rectangle, valid bool) {
+    r = r.Intersect(image.Rect(0, 0, m.Width, m.Height))
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        for x := r.Min.X; x < r.Max.X; x++ {
+            m.SetValid(x, y, valid)
+        }
+    }
+}
+
+// Count returns the number of pixels without data.
+func (m *NoDataMask) Count() int {
+    if m == nil {
+        return 0
+    }
+    n := 0
+    for _, w := range m.bits {
+        n += bits.OnesCount64(w)
+    }
+    return n
+}
+
+// sub returns the mask of r, which must lie inside m.
+func (m *NoDataMask) sub(r image.Rectangle) *NoDataMask {
+    if m == nil {
+        return nil
+    }
+    out := NewNoDataMask(r.Dx(), r.Dy())
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        for x := r.Min.X; x < r.Max.X; x++ {
+            if !m.Valid(x, y) {
+                out.SetValid(x-r.Min.X, y-r.Min.Y, false)
+            }
+        }
+    }
+    return out
+}
+
+// resampleMasked scales RGB samples like resampleRGB but weights each
+// source pixel by its validity, so pixels without data don't bleed into
+// their neighbours. Destination pixels that are mostly made of missing data
+// become invalid in the returned mask.
+func resampleMasked(src []byte, mask *NoDataMask, dw, dh int, f ResampleFilter) ([]byte, *NoDataMask) {
+    sw, sh := mask.Width, mask.Height
+    planes := make([]float64, sw*sh*4)
+    for i := 0; i < sw*sh; i++ {
+        if mask.Valid(i%sw, i/sw) {
+            planes[i*4] = float64(src[i*3])
+            planes[i*4+1] = float64(src[i*3+1])
+            planes[i*4+2] = float64(src[i*3+2])
+            planes[i*4+3] = 1
+        }
+    }
+    planes = resamplePlanes(planes, 4, sw, sh, dw, dh, f)
+    dst := make([]byte, dw*dh*3)
+    out := NewNoDataMask(dw, dh)
+    for i := 0; i < dw*dh; i++ {
+        w := planes[i*4+3]
+        if w < 0.5 {
+            out.SetValid(i%dw, i/dw, false)
+            continue
+        }
+        for c := 0; c < 3; c++ {
+            dst[i*3+c] = byte(min(max(math.Round(planes[i*4+c]/w), 0), 255))
+        }
+    }
+    return dst, out
+}
+
+// The NODT chunk lists only the tiles that have pixels without data:
+//
+//	count uint32 | x uint32 | y uint32 | TileSize*TileSize bits ...
+//
+// Each tile's bits run row by row, least significant bit first, with
+// padding beyond the image edge left clear.
+func (m *NoDataMask) chunk(grid tilemath.Grid, order binary.ByteOrder) *Chunk {
+    ts := grid.TileSize
+    count := 0
+    var body bytes.Buffer
+    tile := make([]byte, (ts*ts+7)/8)
+    for ty := 0; ty < grid.Rows(); ty++ {
+        for tx := 0; tx < grid.Cols(); tx++ {
+            clear(tile)
+            empty := true
+            r := grid.TileBounds(tx, ty)
+            for y := r.Min.Y; y < r.Max.Y; y++ {
+                for x := r.Min.X; x < r.Max.X; x++ {
+                    if !m.Valid(x, y) {
+                        i := (y-r.Min.Y)*ts + x - r.Min.X
+                        tile[i/8] |= 1 << (i % 8)
+                        empty = false
+                    }
+                }
+            }
+            if !empty {
+                count++
+                binary.Write(&body, order, [2]uint32{uint32(tx), uint32(ty)})
+                body.Write(tile)
+            }
+        }
+    }
+    var buf bytes.Buffer
+    binary.Write(&buf, order, uint32(count))
+    buf.Write(body.Bytes())
+    return &Chunk{Type: ChunkNoData, Data: buf.Bytes()}
+}
+
+func decodeNoDataMask(reader io.Reader, order binary.ByteOrder, length uint64, grid tilemath.Grid) (*NoDataMask, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkNoData, err)
+    }
+    ts := grid.TileSize
+    tileBytes := (ts*ts + 7) / 8
+    if len(data) < 4 {
+        return nil, fmt.Errorf("%s chunk is %d bytes", ChunkNoData, len(data))
+    }
+    count := int(order.Uint32(data))
+    if uint64(count)*uint64(8+tileBytes)+4 != length {
+        return nil, fmt.Errorf("%s chunk lists %d tiles in %d bytes", ChunkNoData, count, length)
+    }
+    m := NewNoDataMask(grid.Width, grid.Height)
+    data = data[4:]
+    for range count {
+        tx, ty := int(order.Uint32(data)), int(order.Uint32(data[4:]))
+        if tx >= grid.Cols() || ty >= grid.Rows() {
+            return nil, fmt.Errorf("%s chunk lists tile (%d, %d) outside the grid", ChunkNoData, tx, ty)
+        }
+        tile := data[8 : 8+tileBytes]
+        r := grid.TileBounds(tx, ty)
+        for y := r.Min.Y; y < r.Max.Y; y++ {
+            for x := r.Min.X; x < r.Max.X; x++ {
+                i := (y-r.Min.Y)*ts + x - r.Min.X
+                if tile[i/8]&(1<<(i%8)) != 0 {
+                    m.SetValid(x, y, false)
+                }
+            }
+        }
+        data = data[8+tileBytes:]
+    }
+    return m, nil
+}
+
+// NoData reads the NODT chunk. Files without one return nil, which treats
+// every pixel as valid.
+func (nr *Reader) NoData() (*NoDataMask, error) {
+    offset, length, ok, err := nr.findChunk(ChunkNoData)
+    if err != nil || !ok {
+        return nil, err
+    }
+    return decodeNoDataMask(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length, nr.Grid())
+}
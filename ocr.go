@@ -0,0 +1,284 @@
+package nest
+
+import (
+    "encoding/xml"
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// WordAnnotationPrefix starts the ID of the annotations AddWords makes, one
+// per recognized word, followed by a zero-padded number in reading order.
+const WordAnnotationPrefix = "word-"
+
+// A Word is one word an OCR engine recognized, with its bounding box in
+// pixels of the page image it read.
+type Word struct {
+    Rect image.Rectangle
+    Text string
+}
+
+// ParseHOCR reads the ocrx_word elements of an hOCR document, as written by
+// Tesseract and other engines, in document order.
+func ParseHOCR(r io.Reader) ([]Word, error) {
+    d := xml.NewDecoder(r)
+    // hOCR is HTML, usually but not always well-formed XHTML.
+    d.Strict = false
+    d.AutoClose = xml.HTMLAutoClose
+    d.Entity = xml.HTMLEntity
+
+    var words []Word
+    var word *Word
+    depth := 0
+    for {
+        tok, err := d.Token()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse hOCR: %w", err)
+        }
+        switch t := tok.(type) {
+        case xml.StartElement:
+            if word != nil {
+                depth++
+                continue
+            }
+            if !hasClass(t, "ocrx_word") {
+                continue
+            }
+            rect, err := hocrBBox(attr(t, "title"))
+            if err != nil {
+                return nil, err
+            }
+            word, depth = &Word{Rect: rect}, 0
+        case xml.EndElement:
+            if word == nil {
+                continue
+            }
+            if depth > 0 {
+                depth--
+                continue
+            }
+            word.Text = strings.TrimSpace(word.Text)
+            if word.Text != "" {
+                words = append(words, *word)
+            }
+            word = nil
+        case xml.CharData:
+            if word != nil {
+                word.Text += string(t)
+            }
+        }
+    }
+    return words, nil
+}
+
+func attr(e xml.StartElement, name string) string {
+    for _, a := range e.Attr {
+        if a.Name.Local == name {
+            return a.Value
+        }
+    }
+    return ""
+}
+
+func hasClass(e xml.StartElement, class string) bool {
+    for _, c := range strings.Fields(attr(e, "class")) {
+        if c == class {
+            return true
+        }
+    }
+    return false
+}
+
+// hocrBBox reads the bbox property from an hOCR title such as
+// "bbox 36 92 96 116; x_wconf 93".
+func hocrBBox(title string) (image.Rectangle, error) {
+    for _, prop := range strings.Split(title, ";") {
+        fields := strings.Fields(prop)
+        if len(fields) == 0 || fields[0] != "bbox" {
+            continue
+        }
+        var v [4]int
+        if len(fields) != 5 {
+            return image.Rectangle{}, fmt.Errorf("bad hOCR bbox %q", prop)
+        }
+        for i := range v {
+            n, err := strconv.Atoi(fields[i+1])
+            if err != nil {
+                return image.Rectangle{}, fmt.Errorf("bad hOCR bbox %q", prop)
+            }
+            v[i] = n
+        }
+        return image.Rect(v[0], v[1], v[2], v[3]), nil
+    }
+    return image.Rectangle{}, fmt.Errorf("hOCR word without a bbox: %q", title)
+}
+
+// ParseALTO reads the String elements of an ALTO document in document
+// order. Measurements in mm10 or inch1200 units are converted to pixels at
+// dpi, which is unused for documents measured in pixels.
+func ParseALTO(r io.Reader, dpi float64) ([]Word, error) {
+    d := xml.NewDecoder(r)
+    var words []Word
+    scale := 1.0
+    for {
+        tok, err := d.Token()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse ALTO: %w", err)
+        }
+        t, ok := tok.(xml.StartElement)
+        if !ok {
+            continue
+        }
+        switch t.Name.Local {
+        case "MeasurementUnit":
+            var unit string
+            if err := d.DecodeElement(&unit, &t); err != nil {
+                return nil, fmt.Errorf("failed to parse ALTO: %w", err)
+            }
+            if scale, err = altoScale(strings.TrimSpace(unit), dpi); err != nil {
+                return nil, err
+            }
+        case "String":
+            var v [4]float64
+            for i, name := range []string{"HPOS", "VPOS", "WIDTH", "HEIGHT"} {
+                if v[i], err = strconv.ParseFloat(attr(t, name), 64); err != nil {
+                    return nil, fmt.Errorf("ALTO String %q has a bad %s", attr(t, "CONTENT"), name)
+                }
+            }
+            text := strings.TrimSpace(attr(t, "CONTENT"))
+            if text == "" {
+                continue
+            }
+            x0, y0 := math.Round(v[0]*scale), math.Round(v[1]*scale)
+            x1, y1 := math.Round((v[0]+v[2])*scale), math.Round((v[1]+v[3])*scale)
+            words = append(words, Word{Rect: image.Rect(int(x0), int(y0), int(x1), int(y1)), Text: text})
+        }
+    }
+    return words, nil
+}
+
+// altoScale converts an ALTO MeasurementUnit to pixels.
+func altoScale(unit string, dpi float64) (float64, error) {
+    switch unit {
+    case "pixel":
+        return 1, nil
+    case "mm10", "inch1200":
+        if dpi <= 0 {
+            return 0, fmt.Errorf("ALTO measured in %s needs a resolution", unit)
+        }
+        if unit == "mm10" {
+            return dpi / 254, nil
+        }
+        return dpi / 1200, nil
+    }
+    return 0, fmt.Errorf("unknown ALTO measurement unit %q", unit)
+}
+
+// AddWords puts words on the annotation layer as searchable text, each an
+// annotation with its box moved by offset, such as the top left corner of
+// the page the words were read from. Words already on the layer are kept,
+// and the new ones follow them in reading order.
+func (nif *NestedImageFile) AddWords(words []Word, offset image.Point) error {
+    next := 0
+    for _, a := range nif.Annotations {
+        if n, ok := wordNumber(a.ID); ok {
+            next = max(next, n+1)
+        }
+    }
+    for i, w := range words {
+        a := Annotation{
+            ID:   fmt.Sprintf("%s%08d", WordAnnotationPrefix, next+i),
+            Rect: w.Rect.Add(offset),
+            Text: w.Text,
+        }
+        if err := nif.Annotate(a); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func wordNumber(id string) (int, bool) {
+    s, ok := strings.CutPrefix(id, WordAnnotationPrefix)
+    if !ok {
+        return 0, false
+    }
+    n, err := strconv.Atoi(s)
+    return n, err == nil
+}
+
+// Words returns the words on the annotation layer in reading order.
+func (nif *NestedImageFile) Words() []Word {
+    var words []Word
+    // Zero-padded numbers sort annotations in reading order.
+    for _, a := range nif.Annotations {
+        if _, ok := wordNumber(a.ID); ok {
+            words = append(words, Word{Rect: a.Rect, Text: a.Text})
+        }
+    }
+    return words
+}
+
+// A Region is a match of SearchText: the box around the matching words and
+// their text.
+type Region struct {
+    Rect image.Rectangle
+    Text string
+}
+
+// SearchText finds query in the words on the annotation layer, ignoring case
+// and the punctuation around words. A query of several words matches them
+// in consecutive order, across line breaks, and each query word matches a
+// word containing it, so "inv" finds "Invoice".
+func (nif *NestedImageFile) SearchText(query string) []Region {
+    terms := strings.Fields(normalizeWord(query))
+    if len(terms) == 0 {
+        return nil
+    }
+    words := nif.Words()
+    norm := make([]string, len(words))
+    for i, w := range words {
+        norm[i] = normalizeWord(w.Text)
+    }
+    var regions []Region
+    for i := 0; i+len(terms) <= len(words); i++ {
+        match := true
+        for j, term := range terms {
+            if !strings.Contains(norm[i+j], term) {
+                match = false
+                break
+            }
+        }
+        if !match {
+            continue
+        }
+        r := Region{Rect: words[i].Rect, Text: words[i].Text}
+        for _, w := range words[i+1 : i+len(terms)] {
+            r.Rect = r.Rect.Union(w.Rect)
+            r.Text += " " + w.Text
+        }
+        regions = append(regions, r)
+    }
+    return regions
+}
+
+// normalizeWord folds case and trims the punctuation around each word of s.
+func normalizeWord(s string) string {
+    fields := strings.Fields(strings.ToLower(s))
+    for i, f := range fields {
+        fields[i] = strings.TrimFunc(f, func(r rune) bool {
+            return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+        })
+    }
+    return strings.Join(fields, " ")
+}
@@ -0,0 +1,166 @@
+package nest
+
+import (
+    "time"
+
+    "github.com/70ziko/NEST/colorspace"
+)
+
+type ReadOptions struct {
+    // MaxMemory bounds the bytes the decoder may allocate. Zero means no limit.
+    MaxMemory int64
+    // Workers decodes tiles concurrently when the source also implements
+    // io.ReaderAt and io.Seeker. Zero or one decodes sequentially.
+    Workers int
+    // Arena, when set, provides the main image storage and is reused by
+    // later decodes given the same Arena.
+    Arena *Arena
+    // MaxNestedImageSize rejects any nested image whose RGB data is larger
+    // than this many bytes, before it is allocated. Zero means no limit.
+    MaxNestedImageSize int64
+    // VerifyTrailer checks the file against the hash in its trailer and
+    // fails with ErrTrailerMismatch when they differ, or ErrNoTrailer when
+    // the file has none.
+    VerifyTrailer bool
+    // Deadline, when set, fails the decode with ErrDecodeTimeout once it
+    // has passed.
+    Deadline time.Time
+}
+
+type WriteOptions struct {
+    // TileOrder controls the order tiles are emitted in. It is recorded in
+    // the header and the tile index.
+    TileOrder TileOrder
+    // Dedup, when set, reuses encoded tiles whose content was seen before.
+    Dedup *DedupStore
+    // Quality between 1 and 100 stores the RGB plane of each tile as JPEG.
+    // Zero keeps it lossless. The link plane is always lossless.
+    Quality int
+    // LinkCodec compresses the link plane. CodecRLE falls back to raw for
+    // tiles where it would not save space.
+    LinkCodec TileCodec
+    // Workers encodes tiles concurrently. Output is identical to a
+    // sequential write.
+    Workers int
+    // ECCLevel adds that many Reed–Solomon parity tiles per group of 16, so
+    // up to ECCLevel damaged tiles per group are rebuilt on read. Zero
+    // writes no parity.
+    ECCLevel int
+    // Sync makes the file path helpers flush the file and its directory
+    // entry to stable storage before returning.
+    Sync bool
+    // Journal makes the file path helpers write through NAME.partial and
+    // record finished tiles in NAME.journal. Writing the same image again
+    // after an interruption keeps every recorded tile that still matches
+    // its checksum and source pixels, and encodes only the rest.
+    Journal bool
+    // TileStats stores per-tile statistics next to the tile index.
+    TileStats bool
+    // Adaptive classifies every tile and picks its RGB codec by class:
+    // blank and line-art tiles are run-length encoded when that is smaller,
+    // and line art otherwise stays raw, while photographic tiles use JPEG at
+    // Quality, or raw when Quality is zero. The classes are stored next to
+    // the tile index.
+    Adaptive bool
+    // MaxOutputBytes, when positive, aborts the write with
+    // ErrOutputTooLarge before the output grows past that many bytes. The
+    // file path helpers then remove what they wrote, journal included, so
+    // unattended pipelines can't fill a disk.
+    MaxOutputBytes int64
+    // Predict stores each lossless RGB plane as the deflated residuals of a
+    // prediction wherever that is smaller, which suits smooth imagery. Each
+    // pixel is predicted from its left and upper neighbors, reaching into
+    // the tiles to the left and above when they were written first, within
+    // blocks of 8x8 tiles so that reading one tile decodes at most its
+    // block. Focal planes are predicted from the plane before, and pyramid
+    // tiles from themselves. It can't be combined with Quality, and Dedup
+    // is not used for main image tiles.
+    Predict bool
+    // Dictionary, when set, compresses every tile plane with zstd against
+    // it and keeps the result where it is smaller than the plane's other
+    // encodings. The dictionary is embedded in the header unless
+    // SharedDictionary is set, in which case only its ID is recorded and
+    // readers must RegisterDictionary it first, which saves its size in
+    // every file of a collection trained on one dictionary.
+    Dictionary       *Dictionary
+    SharedDictionary bool
+    // SpillThreshold, when positive, lets workers encode ahead of a slow
+    // output and bounds the encoded tiles held in memory while waiting to
+    // be written, those of the pyramid level or focal plane being encoded
+    // included, to that many bytes. The rest go to a temporary file in
+    // SpillDir, or the system temporary directory when SpillDir is empty,
+    // which is removed when the write ends.
+    SpillThreshold int64
+    SpillDir       string
+    // SearchIndex stores an index of the words in the annotation text and
+    // metadata values, so Reader.Search finds them without scanning either.
+    // It is rebuilt on every write.
+    SearchIndex bool
+    // Encoder names the software writing the file, and its version, in the
+    // trailer. Empty records this package and its module version.
+    Encoder string
+    // Written is recorded in the trailer as when the file was written.
+    // Zero records the current time; a fixed time makes writing the same
+    // file twice give the same bytes.
+    Written time.Time
+
+    // sampler makes EstimateSize encode only a sample of the tiles.
+    sampler *sizeSampler
+}
+
+type ImportOptions struct {
+    // TileSize of the resulting file. Zero selects DefaultTileSize.
+    TileSize uint16
+    // ColorSpace the main image is stored in. Sources are assumed to be sRGB.
+    ColorSpace colorspace.Space
+    // Dither selects how rounding error is spread when sources with more
+    // than 8 bits per channel, or a reduced Levels count, are quantized.
+    Dither DitherMode
+    // Levels per channel in the output, between 2 and 256. Zero means 256.
+    Levels int
+    // Source, when set, starts provenance tracking with every tile recorded
+    // as imported from Source.
+    Source string
+    // NoDataFromAlpha marks fully transparent pixels as holding no data.
+    NoDataFromAlpha bool
+    // HighBitDepth keeps the samples of sources with 16 bits per channel,
+    // such as developed camera raw files, as the bands named in
+    // HighBitDepthBands next to the 8-bit main image.
+    HighBitDepth bool
+}
+
+type CaptureOptions struct {
+    ImportOptions
+    // MainSize bounds the longer side of the main image. Zero keeps the
+    // source's full resolution.
+    MainSize int
+}
+
+type CatalogOptions struct {
+    // ThumbnailSize bounds the longer side of entry thumbnails. Zero selects
+    // DefaultThumbnailSize and a negative value skips thumbnails.
+    ThumbnailSize int
+    // Workers is passed to ReadOptions when decoding files for thumbnails.
+    Workers int
+}
+
+const DefaultTileSize = 256
+
+const DefaultThumbnailSize = 128
+
+type ProgressiveOptions struct {
+    // Width the region will be displayed at. Pyramid levels finer than
+    // needed for it are not fetched, and full resolution only when no level
+    // is wide enough. Zero asks for full resolution.
+    Width int
+    // Budget is how long a refinement may take at the throughput observed
+    // so far. Refinements expected to take longer are skipped; the first one
+    // is always fetched. Zero fetches every refinement.
+    Budget time.Duration
+    // OnLoading is called before each refinement is fetched with its level
+    // and expected duration, zero before anything was measured, so viewers
+    // can show a "loading higher quality" state. OnSkip is called for
+    // refinements left out because of Budget.
+    OnLoading func(level int, expected time.Duration)
+    OnSkip    func(level int, expected time.Duration)
+}
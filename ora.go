@@ -0,0 +1,306 @@
+package nest
+
+import (
+    "archive/zip"
+    "encoding/xml"
+    "fmt"
+    "image"
+    "image/draw"
+    "image/png"
+    "io"
+    "slices"
+    "strconv"
+    "time"
+)
+
+// oraNode is a stack or layer element of stack.xml.
+type oraNode struct {
+    XMLName    xml.Name
+    Name       string    `xml:"name,attr"`
+    Src        string    `xml:"src,attr,omitempty"`
+    X          int       `xml:"x,attr,omitempty"`
+    Y          int       `xml:"y,attr,omitempty"`
+    Opacity    string    `xml:"opacity,attr,omitempty"`
+    Visibility string    `xml:"visibility,attr,omitempty"`
+    Children   []oraNode `xml:",any"`
+}
+
+type oraImage struct {
+    XMLName xml.Name `xml:"image"`
+    Version string   `xml:"version,attr,omitempty"`
+    Width   int      `xml:"w,attr"`
+    Height  int      `xml:"h,attr"`
+    Stack   oraNode  `xml:"stack"`
+}
+
+// DecodeORA reads an OpenRaster file: a zip archive holding stack.xml,
+// a PNG per layer and mergedimage.png. Stacks become groups. Composite
+// operations other than normal blending are not applied to the layers, so
+// the merged image is used as the composite when the file has one.
+func DecodeORA(r io.ReaderAt, size int64) (*LayeredImage, error) {
+    zr, err := zip.NewReader(r, size)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read OpenRaster archive: %w", err)
+    }
+    files := make(map[string]*zip.File, len(zr.File))
+    for _, f := range zr.File {
+        files[f.Name] = f
+    }
+    f := files["stack.xml"]
+    if f == nil {
+        return nil, fmt.Errorf("OpenRaster archive has no stack.xml")
+    }
+    rc, err := f.Open()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read stack.xml: %w", err)
+    }
+    var doc oraImage
+    err = xml.NewDecoder(rc).Decode(&doc)
+    rc.Close()
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode stack.xml: %w", err)
+    }
+    if doc.Width <= 0 || doc.Height <= 0 {
+        return nil, fmt.Errorf("OpenRaster canvas is %dx%d", doc.Width, doc.Height)
+    }
+
+    li := &LayeredImage{Width: doc.Width, Height: doc.Height}
+    if li.Layers, err = decodeORAStack(files, doc.Stack.Children, image.Pt(doc.Stack.X, doc.Stack.Y)); err != nil {
+        return nil, err
+    }
+    if f := files["mergedimage.png"]; f != nil {
+        if li.Composite, err = decodeORAPNG(f); err != nil {
+            return nil, err
+        }
+    }
+    return li, nil
+}
+
+// decodeORAStack returns the members of a stack bottom to top; stack.xml
+// lists them top first. Elements other than stacks and layers, such as
+// text, are skipped.
+func decodeORAStack(files map[string]*zip.File, nodes []oraNode, offset image.Point) ([]SourceLayer, error) {
+    var layers []SourceLayer
+    for i := len(nodes) - 1; i >= 0; i-- {
+        n := nodes[i]
+        l := SourceLayer{Name: n.Name, Opacity: 1, Hidden: n.Visibility == "hidden"}
+        if n.Opacity != "" {
+            o, err := strconv.ParseFloat(n.Opacity, 64)
+            if err != nil {
+                return nil, fmt.Errorf("OpenRaster layer %q has bad opacity %q", n.Name, n.Opacity)
+            }
+            l.Opacity = o
+        }
+        at := offset.Add(image.Pt(n.X, n.Y))
+        switch n.XMLName.Local {
+        case "stack":
+            children, err := decodeORAStack(files, n.Children, at)
+            if err != nil {
+                return nil, err
+            }
+            l.Group, l.Children = true, children
+        case "layer":
+            f := files[n.Src]
+            if f == nil {
+                return nil, fmt.Errorf("OpenRaster layer %q: archive has no %s", n.Name, n.Src)
+            }
+            img, err := decodeORAPNG(f)
+            if err != nil {
+                return nil, err
+            }
+            b := img.Bounds()
+            l.Image = image.NewNRGBA(b.Sub(b.Min).Add(at))
+            draw.Draw(l.Image, l.Image.Rect, img, b.Min, draw.Src)
+        default:
+            continue
+        }
+        layers = append(layers, l)
+    }
+    return layers, nil
+}
+
+func decodeORAPNG(f *zip.File) (image.Image, error) {
+    rc, err := f.Open()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read %s: %w", f.Name, err)
+    }
+    defer rc.Close()
+    img, err := png.Decode(rc)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode %s: %w", f.Name, err)
+    }
+    return img, nil
+}
+
+// oraThumbnailSize bounds Thumbnails/thumbnail.png, as the format requires.
+const oraThumbnailSize = 256
+
+// EncodeORA writes nif as an OpenRaster file for editing in GIMP or Krita.
+// Imported layers become ORA layers and their groups stacks; each layer's
+// pixels come from its nested image, transparent where its link channel
+// does not cover them. Nested images no layer uses go into a hidden
+// "Nested images" stack, each placed over the main image pixels linking to
+// it, and a file without layers gets the main image as its bottom layer.
+// Links themselves have no place in ORA and are left out.
+func EncodeORA(w io.Writer, nif *NestedImageFile) error {
+    if err := nif.checkLayers(); err != nil {
+        return err
+    }
+    ow := &oraWriter{zw: zip.NewWriter(w)}
+    // The mimetype comes first and uncompressed so the format can be
+    // sniffed from the archive's first bytes.
+    mw, err := ow.zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store, Modified: time.Now()})
+    if err != nil {
+        return err
+    }
+    if _, err := io.WriteString(mw, "image/openraster"); err != nil {
+        return err
+    }
+
+    // Group composites are rebuilt from their members, so only nested
+    // images no layer uses are exported on their own.
+    used := make([]bool, len(nif.NestedImages))
+    members := make([][]int, len(nif.Layers)+1)
+    for i, l := range nif.Layers {
+        members[l.Parent+1] = append(members[l.Parent+1], i)
+        if l.Nested != 0 {
+            used[l.Nested-1] = true
+        }
+    }
+    var top []oraNode
+    if len(nif.Layers) == 0 {
+        src, err := ow.png(nif.rawImage())
+        if err != nil {
+            return err
+        }
+        top = []oraNode{{XMLName: xml.Name{Local: "layer"}, Name: "Main image", Src: src}}
+    } else if top, err = ow.layers(nif, members, -1); err != nil {
+        return err
+    }
+
+    bounds := make([]image.Rectangle, len(nif.NestedImages))
+    for y, row := range nif.MainImage {
+        for x, p := range row {
+            if p.NestedIdx != 0 && int(p.NestedIdx) <= len(bounds) {
+                bounds[p.NestedIdx-1] = bounds[p.NestedIdx-1].Union(image.Rect(x, y, x+1, y+1))
+            }
+        }
+    }
+    var extra []oraNode
+    for i, ni := range nif.NestedImages {
+        if used[i] {
+            continue
+        }
+        src, err := ow.png(ni.ToImage())
+        if err != nil {
+            return err
+        }
+        at := bounds[i].Min
+        extra = append(extra, oraNode{XMLName: xml.Name{Local: "layer"}, Name: fmt.Sprintf("Nested image %d", i+1), Src: src, X: at.X, Y: at.Y})
+    }
+    if extra != nil {
+        top = append([]oraNode{{XMLName: xml.Name{Local: "stack"}, Name: "Nested images", Visibility: "hidden", Children: extra}}, top...)
+    }
+
+    doc := oraImage{
+        Version: "0.0.5",
+        Width:   int(nif.Header.Width),
+        Height:  int(nif.Header.Height),
+        Stack:   oraNode{XMLName: xml.Name{Local: "stack"}, Children: top},
+    }
+    sw, err := ow.zw.Create("stack.xml")
+    if err != nil {
+        return err
+    }
+    io.WriteString(sw, xml.Header)
+    if err := xml.NewEncoder(sw).Encode(doc); err != nil {
+        return fmt.Errorf("failed to write stack.xml: %w", err)
+    }
+
+    merged := nif.rawImage()
+    for _, f := range []struct {
+        name string
+        img  image.Image
+    }{
+        {"mergedimage.png", merged},
+        {"Thumbnails/thumbnail.png", fitBox(merged, oraThumbnailSize)},
+    } {
+        fw, err := ow.zw.Create(f.name)
+        if err != nil {
+            return err
+        }
+        if err := png.Encode(fw, f.img); err != nil {
+            return fmt.Errorf("failed to write %s: %w", f.name, err)
+        }
+    }
+    return ow.zw.Close()
+}
+
+type oraWriter struct {
+    zw *zip.Writer
+    n  int
+}
+
+// png stores img as the next layer PNG and returns its path in the archive.
+func (ow *oraWriter) png(img image.Image) (string, error) {
+    ow.n++
+    name := fmt.Sprintf("data/layer%d.png", ow.n)
+    fw, err := ow.zw.Create(name)
+    if err != nil {
+        return "", err
+    }
+    if err := png.Encode(fw, img); err != nil {
+        return "", fmt.Errorf("failed to write %s: %w", name, err)
+    }
+    return name, nil
+}
+
+// layers returns the members of parent as ORA elements, top first.
+func (ow *oraWriter) layers(nif *NestedImageFile, members [][]int, parent int) ([]oraNode, error) {
+    var nodes []oraNode
+    for _, i := range members[parent+1] {
+        l := nif.Layers[i]
+        n := oraNode{Name: l.Name, Opacity: strconv.FormatFloat(float64(l.Opacity)/255, 'f', 3, 64), Visibility: "visible"}
+        if l.Hidden {
+            n.Visibility = "hidden"
+        }
+        if l.Group {
+            children, err := ow.layers(nif, members, i)
+            if err != nil {
+                return nil, err
+            }
+            n.XMLName, n.Children = xml.Name{Local: "stack"}, children
+        } else {
+            if l.Nested == 0 {
+                continue
+            }
+            src, err := ow.png(nif.layerImage(l))
+            if err != nil {
+                return nil, err
+            }
+            n.XMLName, n.Src, n.X, n.Y = xml.Name{Local: "layer"}, src, l.Rect.Min.X, l.Rect.Min.Y
+        }
+        nodes = append(nodes, n)
+    }
+    slices.Reverse(nodes)
+    return nodes, nil
+}
+
+// layerImage returns the pixels of l, transparent where its channel does
+// not link to them.
+func (nif *NestedImageFile) layerImage(l Layer) *image.NRGBA {
+    ni := &nif.NestedImages[l.Nested-1]
+    img := image.NewNRGBA(image.Rect(0, 0, int(ni.Width), int(ni.Height)))
+    lc := nif.LinkChannel(l.Channel)
+    if lc != nil && (l.Rect.Dx() != img.Rect.Dx() || l.Rect.Dy() != img.Rect.Dy()) {
+        lc = nil
+    }
+    for i := 0; i*3+2 < len(ni.Data) && i*4 < len(img.Pix); i++ {
+        copy(img.Pix[i*4:i*4+3], ni.Data[i*3:i*3+3])
+        x, y := l.Rect.Min.X+i%img.Rect.Dx(), l.Rect.Min.Y+i/img.Rect.Dx()
+        if lc == nil || lc.At(x, y) == l.Nested {
+            img.Pix[i*4+3] = 0xff
+        }
+    }
+    return img
+}
@@ -0,0 +1,219 @@
+package nest
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+)
+
+// Orientation says how the stored main image is turned for display, with
+// the values of the EXIF Orientation tag. Capture pipelines record it
+// instead of rotating gigapixel data; ToImage and Reader.ReadOrientedRegion
+// apply it. Zero, as in files written before the field existed, displays
+// the image as stored.
+type Orientation uint8
+
+const (
+    // OrientationNormal displays the image as stored.
+    OrientationNormal Orientation = iota + 1
+    // OrientationFlipHorizontal mirrors it left to right.
+    OrientationFlipHorizontal
+    // OrientationRotate180 turns it upside down.
+    OrientationRotate180
+    // OrientationFlipVertical mirrors it top to bottom.
+    OrientationFlipVertical
+    // OrientationTranspose swaps rows and columns.
+    OrientationTranspose
+    // OrientationRotate90 turns it a quarter clockwise.
+    OrientationRotate90
+    // OrientationTransverse swaps rows and columns and turns the result
+    // upside down.
+    OrientationTransverse
+    // OrientationRotate270 turns it a quarter counterclockwise.
+    OrientationRotate270
+)
+
+func (o Orientation) String() string {
+    switch o {
+    case 0, OrientationNormal:
+        return "normal"
+    case OrientationFlipHorizontal:
+        return "flip-horizontal"
+    case OrientationRotate180:
+        return "rotate-180"
+    case OrientationFlipVertical:
+        return "flip-vertical"
+    case OrientationTranspose:
+        return "transpose"
+    case OrientationRotate90:
+        return "rotate-90"
+    case OrientationTransverse:
+        return "transverse"
+    case OrientationRotate270:
+        return "rotate-270"
+    }
+    return "unknown"
+}
+
+func ParseOrientation(s string) (Orientation, error) {
+    for o := OrientationNormal; o <= OrientationRotate270; o++ {
+        if o.String() == s {
+            return o, nil
+        }
+    }
+    return OrientationNormal, fmt.Errorf("unknown orientation %q", s)
+}
+
+// Swaps reports whether o exchanges width and height.
+func (o Orientation) Swaps() bool {
+    return o >= OrientationTranspose && o <= OrientationRotate270
+}
+
+// Size returns the displayed size of a w by h stored image.
+func (o Orientation) Size(w, h int) (int, int) {
+    if o.Swaps() {
+        return h, w
+    }
+    return w, h
+}
+
+// StoredPoint maps a displayed pixel of a w by h stored image to the
+// stored pixel shown there, for looking up the link under a click.
+func (o Orientation) StoredPoint(p image.Point, w, h int) image.Point {
+    x, y := p.X, p.Y
+    switch o {
+    case OrientationFlipHorizontal:
+        return image.Pt(w-1-x, y)
+    case OrientationRotate180:
+        return image.Pt(w-1-x, h-1-y)
+    case OrientationFlipVertical:
+        return image.Pt(x, h-1-y)
+    case OrientationTranspose:
+        return image.Pt(y, x)
+    case OrientationRotate90:
+        return image.Pt(y, h-1-x)
+    case OrientationTransverse:
+        return image.Pt(w-1-y, h-1-x)
+    case OrientationRotate270:
+        return image.Pt(w-1-y, x)
+    }
+    return p
+}
+
+// StoredRect maps a displayed rectangle of a w by h stored image to the
+// stored rectangle it shows.
+func (o Orientation) StoredRect(r image.Rectangle, w, h int) image.Rectangle {
+    if r.Empty() {
+        return image.Rectangle{}
+    }
+    a := o.StoredPoint(r.Min, w, h)
+    b := o.StoredPoint(r.Max.Sub(image.Pt(1, 1)), w, h)
+    s := image.Rect(a.X, a.Y, b.X, b.Y)
+    s.Max = s.Max.Add(image.Pt(1, 1))
+    return s
+}
+
+// orient turns src, holding at least the stored pixels under the displayed
+// rectangle r of a w by h stored image, into an image with bounds r.
+func (o Orientation) orient(src *image.RGBA, r image.Rectangle, w, h int) *image.RGBA {
+    if o <= OrientationNormal && src.Rect == r {
+        return src
+    }
+    dst := image.NewRGBA(r)
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        i := dst.PixOffset(r.Min.X, y)
+        for x := r.Min.X; x < r.Max.X; x, i = x+1, i+4 {
+            p := o.StoredPoint(image.Pt(x, y), w, h)
+            j := src.PixOffset(p.X, p.Y)
+            copy(dst.Pix[i:i+4], src.Pix[j:j+4])
+        }
+    }
+    return dst
+}
+
+// ReadOrientedRegion is ReadRegionImage for a rectangle in displayed
+// coordinates: the stored pixels under it are read and turned by the
+// header's Orientation. The image bounds are rect after clipping.
+func (nr *Reader) ReadOrientedRegion(rect image.Rectangle) (*image.RGBA, error) {
+    o := nr.Header.Orientation
+    w, h := int(nr.Header.Width), int(nr.Header.Height)
+    rect = rect.Intersect(nr.OrientedBounds())
+    if rect.Empty() {
+        return nil, errors.New("region does not overlap the image")
+    }
+    img, err := nr.ReadRegionImage(o.StoredRect(rect, w, h))
+    if err != nil {
+        return nil, err
+    }
+    return o.orient(img, rect, w, h), nil
+}
+
+// OrientedBounds returns the bounds of the main image as displayed.
+func (nr *Reader) OrientedBounds() image.Rectangle {
+    w, h := nr.Header.Orientation.Size(int(nr.Header.Width), int(nr.Header.Height))
+    return image.Rect(0, 0, w, h)
+}
+
+// SourceOrientation reads the orientation tag of a JPEG's EXIF data or of
+// a TIFF's first image, so converters can record it instead of rotating
+// the pixels. It returns OrientationNormal when there is none.
+func SourceOrientation(r io.ReaderAt) Orientation {
+    var b [12]byte
+    if _, err := r.ReadAt(b[:4], 0); err != nil {
+        return OrientationNormal
+    }
+    if b[0] != 0xff || b[1] != 0xd8 {
+        return tiffOrientation(r, 0)
+    }
+    // Walk the JPEG markers up to the first scan looking for APP1 "Exif".
+    for off := int64(2); ; {
+        if _, err := r.ReadAt(b[:10], off); err != nil || b[0] != 0xff {
+            return OrientationNormal
+        }
+        marker, length := b[1], int64(binary.BigEndian.Uint16(b[2:4]))
+        if marker == 0xda || marker == 0xd9 {
+            return OrientationNormal
+        }
+        if marker == 0xe1 && string(b[4:10]) == "Exif\x00\x00" {
+            return tiffOrientation(r, off+10)
+        }
+        off += 2 + length
+    }
+}
+
+// tiffOrientation reads tag 274 from the first IFD of the TIFF structure
+// at base.
+func tiffOrientation(r io.ReaderAt, base int64) Orientation {
+    var b [12]byte
+    if _, err := r.ReadAt(b[:8], base); err != nil {
+        return OrientationNormal
+    }
+    var order binary.ByteOrder
+    switch string(b[:4]) {
+    case "II*\x00":
+        order = binary.LittleEndian
+    case "MM\x00*":
+        order = binary.BigEndian
+    default:
+        return OrientationNormal
+    }
+    ifd := base + int64(order.Uint32(b[4:8]))
+    if _, err := r.ReadAt(b[:2], ifd); err != nil {
+        return OrientationNormal
+    }
+    for i := int64(0); i < int64(order.Uint16(b[:2])); i++ {
+        if _, err := r.ReadAt(b[:], ifd+2+i*12); err != nil {
+            return OrientationNormal
+        }
+        if order.Uint16(b[:2]) == 274 {
+            o := Orientation(order.Uint16(b[8:10]))
+            if o < OrientationNormal || o > OrientationRotate270 {
+                return OrientationNormal
+            }
+            return o
+        }
+    }
+    return OrientationNormal
+}
@@ -0,0 +1,221 @@
+package nest
+
+import (
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "image"
+    "io"
+    "math"
+    "slices"
+
+    "github.com/70ziko/NEST/tilemath"
+)
+
+// mainTileHashes returns a checksum of the colors of every main image tile,
+// in row-major order. Links are left out since the pyramid doesn't keep them.
+func (nif *NestedImageFile) mainTileHashes() []uint32 {
+    grid := nif.grid()
+    hashes := make([]uint32, 0, grid.Cols()*grid.Rows())
+    row := make([]byte, 0, grid.TileSize*3)
+    for ty := 0; ty < grid.Rows(); ty++ {
+        for tx := 0; tx < grid.Cols(); tx++ {
+            var h uint32
+            r := grid.TileBounds(tx, ty)
+            for y := r.Min.Y; y < r.Max.Y; y++ {
+                row = row[:0]
+                for _, p := range nif.MainImage[y][r.Min.X:r.Max.X] {
+                    row = append(row, p.R, p.G, p.B)
+                }
+                h = crc32.Update(h, crcTable, row)
+            }
+            hashes = append(hashes, h)
+        }
+    }
+    return hashes
+}
+
+// RebuildPyramid brings pyramid levels up to date with the main image after
+// edits, regenerating only the tiles whose source tiles changed since the
+// pyramid was last built. Changes are found by comparing main image tile
+// checksums with those stored next to the pyramid, so edits made in an
+// earlier session count too. It returns the number of tiles regenerated.
+//
+// With no levels, the levels already in the pyramid are refreshed, or every
+// level when there are none. Afterwards the pyramid holds exactly the listed
+// levels. Each level is computed from the one below it, so refreshing a
+// level the pyramid lacks, or whose parent it lacks, regenerates it whole.
+// The filter recorded under PyramidFilterKey is reused.
+func (nif *NestedImageFile) RebuildPyramid(levels ...int) (int, error) {
+    grid := nif.grid()
+    if len(levels) == 0 {
+        for _, l := range nif.Pyramid {
+            levels = append(levels, l.Level)
+        }
+        if len(levels) == 0 {
+            for n := 1; n < grid.Levels(); n++ {
+                levels = append(levels, n)
+            }
+        }
+    } else {
+        levels = slices.Clone(levels)
+    }
+    slices.Sort(levels)
+    levels = slices.Compact(levels)
+    if len(levels) > 0 && (levels[0] < 1 || levels[len(levels)-1] >= grid.Levels()) {
+        return 0, fmt.Errorf("pyramid levels run from 1 to %d, not %d to %d", grid.Levels()-1, levels[0], levels[len(levels)-1])
+    }
+
+    f := BoxFilter
+    if name, ok := nif.Metadata[PyramidFilterKey]; ok {
+        var err error
+        if f, err = ParseResampleFilter(name); err != nil {
+            return 0, err
+        }
+    }
+
+    // dirty flags the stale tiles of the level below the one being built;
+    // nil means all of them are.
+    hashes := nif.mainTileHashes()
+    var dirty []bool
+    if len(nif.pyramidSource) == len(hashes) {
+        dirty = make([]bool, len(hashes))
+        for i := range hashes {
+            dirty[i] = hashes[i] != nif.pyramidSource[i]
+        }
+    }
+
+    count := 0
+    var pyramid []PyramidLevel
+    prev := &PyramidLevel{Width: grid.Width, Height: grid.Height, Data: nif.rgbData()}
+    for n := 1; len(levels) > 0 && n <= levels[len(levels)-1]; n++ {
+        g := grid.Level(n)
+        cur := nif.PyramidLevel(n)
+        if dirty == nil || cur == nil || cur.Width != g.Width || cur.Height != g.Height {
+            cur = &PyramidLevel{Level: n, Width: g.Width, Height: g.Height, Data: resampleRGB(prev.Data, prev.Width, prev.Height, g.Width, g.Height, f)}
+            dirty = nil
+            count += g.Cols() * g.Rows()
+        } else {
+            cur = &PyramidLevel{Level: n, Width: cur.Width, Height: cur.Height, Data: slices.Clone(cur.Data)}
+            dirty = refreshTiles(cur, prev, dirty, grid.Level(n-1), g, f)
+            for _, d := range dirty {
+                if d {
+                    count++
+                }
+            }
+        }
+        if slices.Contains(levels, n) {
+            pyramid = append(pyramid, *cur)
+        }
+        prev = cur
+    }
+
+    nif.Pyramid = pyramid
+    nif.pyramidSource = hashes
+    if nif.Metadata == nil {
+        nif.Metadata = Metadata{}
+    }
+    nif.Metadata[PyramidFilterKey] = f.Name()
+    return count, nil
+}
+
+// refreshTiles recomputes the tiles of cur that draw on the dirty tiles of
+// prev, and returns which tiles of cur it recomputed.
+func refreshTiles(cur, prev *PyramidLevel, dirty []bool, pg, g tilemath.Grid, f ResampleFilter) []bool {
+    cols := filterWeights(prev.Width, cur.Width, f)
+    rows := filterWeights(prev.Height, cur.Height, f)
+    stale := make([]bool, g.Cols()*g.Rows())
+    for i, d := range dirty {
+        if !d {
+            continue
+        }
+        src := pg.TileBounds(i%pg.Cols(), i/pg.Cols())
+        x0, x1 := affected(cols, src.Min.X, src.Max.X)
+        y0, y1 := affected(rows, src.Min.Y, src.Max.Y)
+        tiles := g.TileRange(image.Rect(x0, y0, x1, y1))
+        for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+            for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+                stale[ty*g.Cols()+tx] = true
+            }
+        }
+    }
+    for i, s := range stale {
+        if s {
+            resampleRegion(cur.Data, g.Bounds(), prev.Data, pg.Bounds(), cols, rows, g.TileBounds(i%g.Cols(), i/g.Cols()))
+        }
+    }
+    return stale
+}
+
+// affected returns the destination range whose contributions touch source
+// pixels lo to hi.
+func affected(cs []contribution, lo, hi int) (int, int) {
+    first, last := len(cs), 0
+    for i, c := range cs {
+        if c.first < hi && c.first+len(c.weights) > lo {
+            first, last = min(first, i), i+1
+        }
+    }
+    return first, last
+}
+
+// resampleRegion recomputes the destination pixels in r exactly as
+// resampleRGB would, filtering rows first and then columns. dst holds the
+// destination pixels inside dr and src the source pixels inside sr, which
+// must cover every contribution to r.
+func resampleRegion(dst []byte, dr image.Rectangle, src []byte, sr image.Rectangle, cols, rows []contribution, r image.Rectangle) {
+    sw, dw := sr.Dx(), dr.Dx()
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        rc := rows[y]
+        for x := r.Min.X; x < r.Max.X; x++ {
+            cc := cols[x]
+            var acc [3]float64
+            for k, wy := range rc.weights {
+                var tmp [3]float64
+                for j, wx := range cc.weights {
+                    s := ((rc.first+k-sr.Min.Y)*sw + cc.first + j - sr.Min.X) * 3
+                    for i := range tmp {
+                        tmp[i] += wx * float64(src[s+i])
+                    }
+                }
+                for i := range acc {
+                    acc[i] += wy * tmp[i]
+                }
+            }
+            d := ((y-dr.Min.Y)*dw + x - dr.Min.X) * 3
+            for i, v := range acc {
+                dst[d+i] = byte(min(max(math.Round(v), 0), 255))
+            }
+        }
+    }
+}
+
+// The main image tile checksums the pyramid was built from are kept in a
+// PSRC chunk after the PYRM chunks:
+//
+//	count uint32 | count * checksum uint32
+func (nif *NestedImageFile) writePyramidSource(writer io.Writer, order binary.ByteOrder) error {
+    grid := nif.grid()
+    if len(nif.Pyramid) == 0 || len(nif.pyramidSource) != grid.Cols()*grid.Rows() {
+        return nil
+    }
+    data := make([]byte, 4, 4+4*len(nif.pyramidSource))
+    order.PutUint32(data, uint32(len(nif.pyramidSource)))
+    data, _ = binary.Append(data, order, nif.pyramidSource)
+    return (&Chunk{Type: ChunkPyramidSource, Data: data}).write(writer, order)
+}
+
+func decodePyramidSource(reader io.Reader, order binary.ByteOrder, length uint64) ([]uint32, error) {
+    var count uint32
+    if err := binary.Read(reader, order, &count); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkPyramidSource, err)
+    }
+    if length != 4+4*uint64(count) {
+        return nil, fmt.Errorf("%s chunk is %d bytes for %d tiles", ChunkPyramidSource, length, count)
+    }
+    hashes := make([]uint32, count)
+    if err := binary.Read(reader, order, hashes); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkPyramidSource, err)
+    }
+    return hashes, nil
+}
@@ -0,0 +1,538 @@
+package nest
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "image"
+    "io"
+
+    "github.com/70ziko/NEST/colorspace"
+    "github.com/70ziko/NEST/tilemath"
+)
+
+// ErrNotEditableInPlace is returned by PasteImage for files it can't edit
+// without rewriting them, such as ones with compressed tiles.
+var ErrNotEditableInPlace = errors.New("file can't be edited in place")
+
+// PasteOptions describe the audit log entry of a paste.
+type PasteOptions struct {
+    // Actor and Detail are recorded in the AuditSetPixels entry added to
+    // files with an audit log.
+    Actor, Detail string
+}
+
+// PasteImage composites img over the main image of the file open in ws,
+// with img's top left corner at at, without rewriting the file. Only the
+// tiles img overlaps are read, blended and written back in place, together
+// with their checksums, statistics and parity, and the pyramid tiles drawn
+// from them are recomputed the same way, as is the trailer's hash. Links are
+// left alone. This makes
+// it the primitive for editing very large files on a server.
+//
+// ws must also implement io.ReaderAt, as *os.File does. Tiles are rewritten
+// at their current length, so the file must store them uncompressed, or
+// PasteImage fails with ErrNotEditableInPlace.
+func PasteImage(ws io.WriteSeeker, img image.Image, at image.Point) error {
+    return PasteImageWithOptions(ws, img, at, PasteOptions{})
+}
+
+// PasteImageWithOptions is PasteImage recording the paste as opts describe.
+// In files with an audit log, the AUDT chunk is marked ChunkFree and the
+// extended log written after the other chunks, followed by the trailer and
+// TAIL chunk, so the file only grows by the log.
+func PasteImageWithOptions(ws io.WriteSeeker, img image.Image, at image.Point, opts PasteOptions) error {
+    ra, ok := ws.(io.ReaderAt)
+    if !ok {
+        return errors.New("PasteImage needs a file that can also be read at offsets, such as *os.File")
+    }
+    size, err := ws.Seek(0, io.SeekEnd)
+    if err != nil {
+        return err
+    }
+    nr, err := NewReader(ra, size)
+    if err != nil {
+        return err
+    }
+    if nr.Header.Version < 5 {
+        return fmt.Errorf("file format version %d predates tile planes: %w", nr.Header.Version, ErrNotEditableInPlace)
+    }
+    b := img.Bounds()
+    rect := b.Sub(b.Min).Add(at).Intersect(nr.Bounds())
+    if rect.Empty() {
+        return errors.New("image does not overlap the main image")
+    }
+    p := &paster{nr: nr, ws: ws, opts: opts}
+    return p.paste(img, at.Sub(b.Min), rect)
+}
+
+type paster struct {
+    nr   *Reader
+    ws   io.WriteSeeker
+    opts PasteOptions
+    // entries are the positions in the tile index of the rewritten tiles.
+    entries []int
+}
+
+func (p *paster) writeAt(data []byte, offset int64) error {
+    if _, err := p.ws.Seek(offset, io.SeekStart); err != nil {
+        return err
+    }
+    _, err := p.ws.Write(data)
+    return err
+}
+
+func (p *paster) paste(img image.Image, shift image.Point, rect image.Rectangle) error {
+    nr := p.nr
+    grid := nr.Grid()
+    ts := grid.TileSize
+    rgbLen := planeHeaderSize + 3*ts*ts
+    var mask *NoDataMask
+    if nr.Index.Stats != nil {
+        var err error
+        if mask, err = nr.NoData(); err != nil {
+            return err
+        }
+    }
+    // Colors of the rewritten tiles before and after, for the PSRC chunk.
+    hashes := map[int][2]uint32{}
+
+    tiles := grid.TileRange(rect)
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            i := nr.Index.position(tx, ty)
+            if i < 0 {
+                return fmt.Errorf("tile (%d, %d) is not in the index", tx, ty)
+            }
+            e := nr.Index.Entries[i]
+            buf := make([]byte, e.Length)
+            if _, err := nr.r.ReadAt(buf, e.Offset); err != nil {
+                return fmt.Errorf("failed to read tile (%d, %d): %w", tx, ty, err)
+            }
+            buf, err := nr.checkTile(e, buf)
+            if err != nil {
+                return err
+            }
+            if len(buf) < rgbLen || TileCodec(buf[0]) != CodecRaw || int(nr.order.Uint32(buf[1:])) != 3*ts*ts {
+                return fmt.Errorf("tile (%d, %d) is not stored uncompressed: %w", tx, ty, ErrNotEditableInPlace)
+            }
+            bounds := grid.TileBounds(tx, ty)
+            before := tileColorHash(buf[planeHeaderSize:], bounds, ts)
+            blendTile(buf[planeHeaderSize:rgbLen], bounds.Min, ts, rect.Intersect(bounds), img, shift, nr.Header.ColorSpace)
+            hashes[ty*grid.Cols()+tx] = [2]uint32{before, tileColorHash(buf[planeHeaderSize:], bounds, ts)}
+
+            if err := p.writeAt(buf[:rgbLen], e.Offset); err != nil {
+                return fmt.Errorf("failed to write tile (%d, %d): %w", tx, ty, err)
+            }
+            nr.Index.Entries[i].Checksum = tileChecksum(buf)
+            if nr.Index.Stats != nil {
+                tile, err := nr.decodeTile(TileCoord{tx, ty}, buf)
+                if err != nil {
+                    return err
+                }
+                nr.Index.Stats[i] = computeTileStats(tile, bounds, ts, mask)
+            }
+            p.entries = append(p.entries, i)
+        }
+    }
+
+    if err := p.writeIndexChunks(); err != nil {
+        return err
+    }
+    if err := p.writeParity(); err != nil {
+        return err
+    }
+    if err := p.refreshPyramid(rect, hashes); err != nil {
+        return err
+    }
+    if err := p.appendAudit(rect); err != nil {
+        return err
+    }
+    return nr.refreshTrailer(p.ws)
+}
+
+// appendAudit records the paste of rect in the file's audit log, if it has
+// one. The log moves to the end of the chunks, ahead of the trailer and
+// TAIL chunk, which are copied after it.
+func (p *paster) appendAudit(rect image.Rectangle) error {
+    nr := p.nr
+    offset, length, ok, err := nr.findChunk(ChunkAudit)
+    if err != nil || !ok {
+        return err
+    }
+    log, err := decodeAuditLog(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+    if err != nil {
+        return err
+    }
+    log.Actor = p.opts.Actor
+    log.Append(AuditSetPixels, p.opts.Detail, rect)
+    c, err := log.chunk(nr.order)
+    if err != nil {
+        return err
+    }
+
+    // Everything from the trailer on, or else the TAIL chunk, follows the
+    // log.
+    end := nr.size
+    if nr.trailer != nil {
+        end = nr.trailerOffset
+    } else if nr.size >= tailChunkSize {
+        buf := make([]byte, tailChunkSize)
+        if _, err := nr.r.ReadAt(buf, nr.size-tailChunkSize); err != nil {
+            return fmt.Errorf("failed to read tail chunk: %w", err)
+        }
+        if _, ok := decodeTail(buf, nr.order); ok {
+            end = nr.size - tailChunkSize
+        }
+    }
+    rest := make([]byte, nr.size-end)
+    if _, err := nr.r.ReadAt(rest, end); err != nil {
+        return fmt.Errorf("failed to read trailer: %w", err)
+    }
+
+    if _, err := p.ws.Seek(end, io.SeekStart); err != nil {
+        return err
+    }
+    if err := c.write(p.ws, nr.order); err != nil {
+        return fmt.Errorf("failed to write audit log: %w", err)
+    }
+    if _, err := p.ws.Write(rest); err != nil {
+        return fmt.Errorf("failed to write trailer: %w", err)
+    }
+    if err := p.writeAt(ChunkFree[:], offset-chunkHeaderSize); err != nil {
+        return fmt.Errorf("failed to free audit log: %w", err)
+    }
+    grown := chunkHeaderSize + int64(len(c.Data))
+    nr.trailerOffset += grown
+    nr.size += grown
+    return nil
+}
+
+// blendTile draws img, offset by shift, over the raw RGB plane of the tile
+// whose top left pixel is origin, inside r.
+func blendTile(rgb []byte, origin image.Point, ts int, r image.Rectangle, img image.Image, shift image.Point, space colorspace.Space) {
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        for x := r.Min.X; x < r.Max.X; x++ {
+            sr, sg, sb, sa := img.At(x-shift.X, y-shift.Y).RGBA()
+            if sa == 0 {
+                continue
+            }
+            d := rgb[((y-origin.Y)*ts+x-origin.X)*3:]
+            if sa < 0xffff {
+                dr, dg, db := colorspace.Convert8(d[0], d[1], d[2], space, colorspace.SRGB)
+                k := 0xffff - sa
+                sr += uint32(dr) * 0x101 * k / 0xffff
+                sg += uint32(dg) * 0x101 * k / 0xffff
+                sb += uint32(db) * 0x101 * k / 0xffff
+            }
+            d[0], d[1], d[2] = colorspace.Convert8(uint8(sr>>8), uint8(sg>>8), uint8(sb>>8), colorspace.SRGB, space)
+        }
+    }
+}
+
+// tileColorHash is the checksum mainTileHashes computes for a tile, from
+// its raw RGB plane.
+func tileColorHash(rgb []byte, bounds image.Rectangle, ts int) uint32 {
+    var h uint32
+    for y := 0; y < bounds.Dy(); y++ {
+        h = crc32.Update(h, crcTable, rgb[y*ts*3:(y*ts+bounds.Dx())*3])
+    }
+    return h
+}
+
+// writeIndexChunks updates the checksums and statistics of the rewritten
+// tiles in the TSUM and TSTA chunks.
+func (p *paster) writeIndexChunks() error {
+    nr := p.nr
+    var b [4]byte
+    if offset, _, ok, err := nr.findChunk(ChunkChecksums); err != nil {
+        return err
+    } else if ok {
+        for _, i := range p.entries {
+            nr.order.PutUint32(b[:], nr.Index.Entries[i].Checksum)
+            if err := p.writeAt(b[:], offset+4+4*int64(i)); err != nil {
+                return fmt.Errorf("failed to write tile checksums: %w", err)
+            }
+        }
+    }
+    if nr.Index.Stats == nil {
+        return nil
+    }
+    offset, _, ok, err := nr.findChunk(ChunkStats)
+    if err != nil || !ok {
+        return err
+    }
+    size := int64(binary.Size(TileStats{}))
+    for _, i := range p.entries {
+        data, _ := binary.Append(nil, nr.order, &nr.Index.Stats[i])
+        if err := p.writeAt(data, offset+4+size*int64(i)); err != nil {
+            return fmt.Errorf("failed to write tile statistics: %w", err)
+        }
+    }
+    return nil
+}
+
+// writeParity recomputes the Reed–Solomon parity of every group holding a
+// rewritten tile. Tiles keep their lengths, so the shards do too.
+func (p *paster) writeParity() error {
+    nr := p.nr
+    par := nr.parity
+    if par == nil {
+        return nil
+    }
+    done := map[int]bool{}
+    for _, i := range p.entries {
+        g := i / int(par.GroupSize)
+        if done[g] {
+            continue
+        }
+        done[g] = true
+        first := g * int(par.GroupSize)
+        last := min(first+int(par.GroupSize), len(nr.Index.Entries))
+        shardLen := int(par.shardLens[g])
+        data := make([][]byte, last-first)
+        for j := range data {
+            e := nr.Index.Entries[first+j]
+            data[j] = make([]byte, shardLen)
+            if _, err := nr.r.ReadAt(data[j][:e.Length], e.Offset); err != nil {
+                return fmt.Errorf("failed to read tile (%d, %d): %w", e.Tile.X, e.Tile.Y, err)
+            }
+        }
+        for j, shard := range encodeParity(data, int(par.GroupSize), int(par.Parity), shardLen) {
+            if err := p.writeAt(shard, par.offsets[g]+int64(j*shardLen)); err != nil {
+                return fmt.Errorf("failed to write parity: %w", err)
+            }
+        }
+    }
+    return nil
+}
+
+// storedLevel locates a PYRM chunk's tiles in the file.
+type storedLevel struct {
+    hdr     pyramidHeader
+    offsets []int64
+    lengths []uint32
+}
+
+func (p *paster) storedLevels() (map[int]*storedLevel, error) {
+    nr := p.nr
+    levels := map[int]*storedLevel{}
+    err := nr.walkChunks(func(t ChunkType, offset int64, length uint64) (bool, error) {
+        if t != ChunkPyramid {
+            return true, nil
+        }
+        l := &storedLevel{}
+        hdrSize := int64(binary.Size(l.hdr))
+        if err := binary.Read(io.NewSectionReader(nr.r, offset, hdrSize), nr.order, &l.hdr); err != nil {
+            return false, fmt.Errorf("failed to read pyramid header: %w", err)
+        }
+        l.lengths = make([]uint32, l.hdr.Count)
+        if hdrSize+4*int64(l.hdr.Count) > int64(length) {
+            return false, fmt.Errorf("pyramid level %d is truncated", l.hdr.Level)
+        }
+        if err := binary.Read(io.NewSectionReader(nr.r, offset+hdrSize, 4*int64(l.hdr.Count)), nr.order, l.lengths); err != nil {
+            return false, fmt.Errorf("failed to read pyramid tile lengths: %w", err)
+        }
+        pos := offset + hdrSize + 4*int64(l.hdr.Count)
+        for _, n := range l.lengths {
+            l.offsets = append(l.offsets, pos)
+            pos += int64(n)
+        }
+        levels[int(l.hdr.Level)] = l
+        return true, nil
+    })
+    return levels, err
+}
+
+// refreshPyramid recomputes the stored pyramid tiles drawn from rect, as
+// RebuildPyramid would, and records the new main tile colors in the PSRC
+// chunk for tiles whose pyramid was up to date before.
+func (p *paster) refreshPyramid(rect image.Rectangle, hashes map[int][2]uint32) error {
+    nr := p.nr
+    stored, err := p.storedLevels()
+    if err != nil || len(stored) == 0 {
+        return err
+    }
+    md, err := nr.Metadata()
+    if err != nil {
+        return err
+    }
+    f := BoxFilter
+    if name, ok := md[PyramidFilterKey]; ok {
+        if f, err = ParseResampleFilter(name); err != nil {
+            return err
+        }
+    }
+    top := 0
+    for n := range stored {
+        top = max(top, n)
+    }
+
+    grid := nr.Grid()
+    ts := grid.TileSize
+    dirty := rect
+    for n := 1; n <= top && !dirty.Empty(); n++ {
+        g, pg := grid.Level(n), grid.Level(n-1)
+        cols := filterWeights(pg.Width, g.Width, f)
+        rows := filterWeights(pg.Height, g.Height, f)
+        x0, x1 := affected(cols, dirty.Min.X, dirty.Max.X)
+        y0, y1 := affected(rows, dirty.Min.Y, dirty.Max.Y)
+        dirty = image.Rect(x0, y0, x1, y1)
+        l, ok := stored[n]
+        if !ok {
+            continue
+        }
+        if int(l.hdr.Width) != g.Width || int(l.hdr.Height) != g.Height {
+            return fmt.Errorf("pyramid level %d is %dx%d, want %dx%d", n, l.hdr.Width, l.hdr.Height, g.Width, g.Height)
+        }
+        // Whole tiles are rewritten, so every pixel of them is refreshed.
+        tr := g.TileRange(dirty)
+        dirty = image.Rect(tr.Min.X*ts, tr.Min.Y*ts, tr.Max.X*ts, tr.Max.Y*ts).Intersect(g.Bounds())
+        data, err := p.computeLevel(n, dirty, stored, f)
+        if err != nil {
+            return err
+        }
+        if err := p.writeLevelTiles(l, g, tr, dirty, data); err != nil {
+            return err
+        }
+    }
+    return p.writePyramidSource(hashes)
+}
+
+// levelPixels returns the RGB pixels inside r of pyramid level n, level 0
+// being the main image. Stored levels are read from the file and the others
+// computed from the level below.
+func (p *paster) levelPixels(n int, r image.Rectangle, stored map[int]*storedLevel, f ResampleFilter) ([]byte, error) {
+    nr := p.nr
+    grid := nr.Grid()
+    if n == 0 {
+        data := make([]byte, 0, r.Dx()*r.Dy()*3)
+        rows, err := nr.ReadRegion(r)
+        if err != nil {
+            return nil, err
+        }
+        for _, row := range rows {
+            for _, px := range row {
+                data = append(data, px.R, px.G, px.B)
+            }
+        }
+        return data, nil
+    }
+    if l, ok := stored[n]; ok {
+        return p.readLevel(l, grid.Level(n), r)
+    }
+    return p.computeLevel(n, r, stored, f)
+}
+
+// computeLevel resamples the pixels inside r of pyramid level n from the
+// level below, exactly as RebuildPyramid does.
+func (p *paster) computeLevel(n int, r image.Rectangle, stored map[int]*storedLevel, f ResampleFilter) ([]byte, error) {
+    grid := p.nr.Grid()
+    g, pg := grid.Level(n), grid.Level(n-1)
+    cols := filterWeights(pg.Width, g.Width, f)
+    rows := filterWeights(pg.Height, g.Height, f)
+    sr := image.Rectangle{Min: image.Pt(cols[r.Min.X].first, rows[r.Min.Y].first)}
+    for x := r.Min.X; x < r.Max.X; x++ {
+        sr.Min.X = min(sr.Min.X, cols[x].first)
+        sr.Max.X = max(sr.Max.X, cols[x].first+len(cols[x].weights))
+    }
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        sr.Min.Y = min(sr.Min.Y, rows[y].first)
+        sr.Max.Y = max(sr.Max.Y, rows[y].first+len(rows[y].weights))
+    }
+    src, err := p.levelPixels(n-1, sr, stored, f)
+    if err != nil {
+        return nil, err
+    }
+    data := make([]byte, r.Dx()*r.Dy()*3)
+    resampleRegion(data, r, src, sr, cols, rows, r)
+    return data, nil
+}
+
+// readLevel decodes the pixels inside r of a stored pyramid level.
+func (p *paster) readLevel(l *storedLevel, g tilemath.Grid, r image.Rectangle) ([]byte, error) {
+    nr := p.nr
+    tc := nr.codec()
+    ts := g.TileSize
+    data := make([]byte, r.Dx()*r.Dy()*3)
+    tile := make([]PixeLink, ts*ts)
+    tiles := g.TileRange(r)
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            i := ty*g.Cols() + tx
+            if err := tc.decodeRGB(io.NewSectionReader(nr.r, l.offsets[i], int64(l.lengths[i])), tile, nil); err != nil {
+                return nil, fmt.Errorf("failed to decode pyramid level %d tile %d: %w", l.hdr.Level, i, err)
+            }
+            part := g.TileBounds(tx, ty).Intersect(r)
+            for y := part.Min.Y; y < part.Max.Y; y++ {
+                for x := part.Min.X; x < part.Max.X; x++ {
+                    px := tile[(y-ty*ts)*ts+x-tx*ts]
+                    d := ((y-r.Min.Y)*r.Dx() + x - r.Min.X) * 3
+                    data[d], data[d+1], data[d+2] = px.R, px.G, px.B
+                }
+            }
+        }
+    }
+    return data, nil
+}
+
+// writeLevelTiles rewrites the tiles in tiles of a stored pyramid level from
+// data, the level's pixels inside r.
+func (p *paster) writeLevelTiles(l *storedLevel, g tilemath.Grid, tiles, r image.Rectangle, data []byte) error {
+    nr := p.nr
+    ts := g.TileSize
+    var codec [1]byte
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            i := ty*g.Cols() + tx
+            if _, err := nr.r.ReadAt(codec[:], l.offsets[i]); err != nil {
+                return fmt.Errorf("failed to read pyramid level %d tile %d: %w", l.hdr.Level, i, err)
+            }
+            if TileCodec(codec[0]) != CodecRaw || int(l.lengths[i]) != planeHeaderSize+3*ts*ts {
+                return fmt.Errorf("pyramid level %d tile %d is not stored uncompressed and can't be rewritten in place", l.hdr.Level, i)
+            }
+            plane := make([]byte, planeHeaderSize+3*ts*ts)
+            plane[0] = byte(CodecRaw)
+            nr.order.PutUint32(plane[1:], uint32(3*ts*ts))
+            part := g.TileBounds(tx, ty)
+            for y := part.Min.Y; y < part.Max.Y; y++ {
+                s := ((y-r.Min.Y)*r.Dx() + part.Min.X - r.Min.X) * 3
+                copy(plane[planeHeaderSize+(y-ty*ts)*ts*3:], data[s:s+part.Dx()*3])
+            }
+            if err := p.writeAt(plane, l.offsets[i]); err != nil {
+                return fmt.Errorf("failed to write pyramid level %d tile %d: %w", l.hdr.Level, i, err)
+            }
+        }
+    }
+    return nil
+}
+
+// writePyramidSource records the new colors of rewritten main tiles in the
+// PSRC chunk, keyed by row-major tile number, where the pyramid had been
+// built from their old colors. Tiles that were already stale stay stale.
+func (p *paster) writePyramidSource(hashes map[int][2]uint32) error {
+    nr := p.nr
+    offset, length, ok, err := nr.findChunk(ChunkPyramidSource)
+    if err != nil || !ok {
+        return err
+    }
+    grid := nr.Grid()
+    if length != 4+4*uint64(grid.Cols()*grid.Rows()) {
+        return nil
+    }
+    var b [4]byte
+    for i, h := range hashes {
+        if _, err := nr.r.ReadAt(b[:], offset+4+4*int64(i)); err != nil {
+            return fmt.Errorf("failed to read %s chunk: %w", ChunkPyramidSource, err)
+        }
+        if nr.order.Uint32(b[:]) != h[0] {
+            continue
+        }
+        nr.order.PutUint32(b[:], h[1])
+        if err := p.writeAt(b[:], offset+4+4*int64(i)); err != nil {
+            return fmt.Errorf("failed to write %s chunk: %w", ChunkPyramidSource, err)
+        }
+    }
+    return nil
+}
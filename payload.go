@@ -0,0 +1,106 @@
+package nest
+
+import (
+    "fmt"
+    "math"
+)
+
+// PayloadKind declares how the per-pixel NestedIdx slot is interpreted. Files
+// that are not link maps, such as segmentation masks or sensor overlays, use
+// the slot for a small value of their own.
+type PayloadKind uint8
+
+const (
+    // PayloadLink values index NestedImages, with 0 meaning no link.
+    PayloadLink PayloadKind = iota
+    // PayloadUint values are unsigned integers such as class labels.
+    PayloadUint
+    // PayloadInt values are two's complement integers such as depth offsets.
+    PayloadInt
+    // PayloadFloat values are float32 bits such as temperatures.
+    PayloadFloat
+)
+
+func (k PayloadKind) String() string {
+    switch k {
+    case PayloadLink:
+        return "link"
+    case PayloadUint:
+        return "uint"
+    case PayloadInt:
+        return "int"
+    case PayloadFloat:
+        return "float"
+    }
+    return "unknown"
+}
+
+func ParsePayloadKind(s string) (PayloadKind, error) {
+    for _, k := range []PayloadKind{PayloadLink, PayloadUint, PayloadInt, PayloadFloat} {
+        if k.String() == s {
+            return k, nil
+        }
+    }
+    return PayloadLink, fmt.Errorf("unknown payload kind %q", s)
+}
+
+// payloadBits returns the stored width for the header's payload. Links are
+// sized from NestedCount; other kinds keep the declared LinkBits, with zero
+// meaning 32.
+func (h *FileHeader) payloadBits() (uint8, error) {
+    switch h.Payload {
+    case PayloadLink:
+        return linkBitsFor(h.NestedCount), nil
+    case PayloadFloat:
+        if h.LinkBits != 0 && h.LinkBits != 32 {
+            return 0, fmt.Errorf("float payloads must be 32 bits, not %d", h.LinkBits)
+        }
+        return 32, nil
+    case PayloadUint, PayloadInt:
+        switch h.LinkBits {
+        case 0:
+            return 32, nil
+        case 8, 16, 32:
+            return h.LinkBits, nil
+        }
+        return 0, fmt.Errorf("unsupported %s payload width of %d bits", h.Payload, h.LinkBits)
+    }
+    return 0, fmt.Errorf("unknown payload kind %d", h.Payload)
+}
+
+func (p PixeLink) Uint() uint32 {
+    return p.NestedIdx
+}
+
+func (p PixeLink) Int() int32 {
+    return int32(p.NestedIdx)
+}
+
+func (p PixeLink) Float() float32 {
+    return math.Float32frombits(p.NestedIdx)
+}
+
+func (p *PixeLink) SetUint(v uint32) {
+    p.NestedIdx = v
+}
+
+func (p *PixeLink) SetInt(v int32) {
+    p.NestedIdx = uint32(v)
+}
+
+func (p *PixeLink) SetFloat(v float32) {
+    p.NestedIdx = math.Float32bits(v)
+}
+
+// Nested returns the nested image linked from (x, y), or nil when the pixel
+// has no link or the file does not carry links.
+func (nif *NestedImageFile) Nested(x, y int) *NestedImage {
+    if nif.Header.Payload != PayloadLink {
+        return nil
+    }
+    idx := nif.MainImage[y][x].NestedIdx
+    if idx == 0 || int(idx) > len(nif.NestedImages) {
+        return nil
+    }
+    return &nif.NestedImages[idx-1]
+}
@@ -0,0 +1,175 @@
+package nest
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "image/png"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "slices"
+    "strconv"
+    "strings"
+)
+
+// DefaultPDFRenderer is the program ImportPDF renders pages with, pdftoppm
+// from Poppler.
+const DefaultPDFRenderer = "pdftoppm"
+
+// PageAnnotationPrefix starts the ID of the annotation ImportPDF puts on
+// each page, followed by the page number from 1.
+const PageAnnotationPrefix = "page-"
+
+// DefaultPDFMaxPixels bounds the main image ImportPDF stacks the pages into
+// when PDFOptions.MaxPixels is zero: 16384 pixels square, or about 125 Letter
+// pages at 150 dpi.
+const DefaultPDFMaxPixels = 1 << 28
+
+type PDFOptions struct {
+    ImportOptions
+    // Renderer is a program taking pdftoppm's options. Empty selects
+    // DefaultPDFRenderer, looked up on PATH.
+    Renderer string
+    // MaxPixels bounds the main image the pages are stacked into, which is
+    // allocated whole. Zero means DefaultPDFMaxPixels.
+    MaxPixels int64
+}
+
+// ImportPDF renders every page of the PDF at path at dpi, see
+// ImportPDFWithOptions.
+func ImportPDF(path string, dpi float64) (*NestedImageFile, error) {
+    return ImportPDFWithOptions(path, dpi, PDFOptions{})
+}
+
+// ImportPDFWithOptions renders every page of the PDF at path at dpi into a
+// new file, so a document archive becomes one image to pan and zoom
+// through.
+//
+// The format has a single main image rather than a list of pages, so each
+// PDF page becomes a NEST page as a region of it: the pages are stacked top
+// to bottom on white, an eighth of an inch apart, and each is annotated with
+// the ID "page-N" and the text "Page N" over its region, which is how
+// viewers and nest ocr --page find a page. The whole stack is allocated at
+// once, so documents that would stack to more than opts.MaxPixels pixels
+// are refused before any page is decoded; lower dpi for those. Build a
+// pyramid afterwards to make zooming out fast.
+func ImportPDFWithOptions(path string, dpi float64, opts PDFOptions) (*NestedImageFile, error) {
+    if dpi <= 0 {
+        return nil, fmt.Errorf("invalid resolution %g dpi", dpi)
+    }
+    renderer := opts.Renderer
+    if renderer == "" {
+        renderer = DefaultPDFRenderer
+    }
+    tool, err := exec.LookPath(renderer)
+    if err != nil {
+        return nil, fmt.Errorf("failed to find PDF renderer: %w", err)
+    }
+    dir, err := os.MkdirTemp("", "nest-pdf-*")
+    if err != nil {
+        return nil, err
+    }
+    defer os.RemoveAll(dir)
+
+    var stderr bytes.Buffer
+    cmd := exec.Command(tool, "-r", strconv.FormatFloat(dpi, 'f', -1, 64), "-png", path, filepath.Join(dir, "page"))
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        if msg := strings.TrimSpace(stderr.String()); msg != "" {
+            return nil, fmt.Errorf("failed to render %s: %w: %s", path, err, msg)
+        }
+        return nil, fmt.Errorf("failed to render %s: %w", path, err)
+    }
+    pages, err := renderedPages(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    // Lay the pages out from their sizes first, to allocate the canvas once.
+    gap := int(dpi / 8)
+    rects := make([]image.Rectangle, len(pages))
+    width, height := 0, 0
+    for i, page := range pages {
+        cfg, err := decodePNGConfig(page)
+        if err != nil {
+            return nil, err
+        }
+        if i > 0 {
+            height += gap
+        }
+        rects[i] = image.Rect(0, height, cfg.Width, height+cfg.Height)
+        width = max(width, cfg.Width)
+        height += cfg.Height
+    }
+    limit := opts.MaxPixels
+    if limit <= 0 {
+        limit = DefaultPDFMaxPixels
+    }
+    if int64(width)*int64(height) > limit {
+        return nil, fmt.Errorf("%d pages at %g dpi stack to %dx%d pixels, the limit is %d", len(pages), dpi, width, height, limit)
+    }
+    canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+    draw.Draw(canvas, canvas.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+    for i, page := range pages {
+        img, err := decodePNGFile(page)
+        if err != nil {
+            return nil, err
+        }
+        // Center pages narrower than the widest one.
+        rects[i] = rects[i].Add(image.Pt((width-rects[i].Dx())/2, 0))
+        draw.Draw(canvas, rects[i], img, img.Bounds().Min, draw.Over)
+    }
+
+    nif := FromImage(canvas, opts.ImportOptions)
+    for i, r := range rects {
+        n := strconv.Itoa(i + 1)
+        if err := nif.Annotate(Annotation{ID: PageAnnotationPrefix + n, Rect: r, Text: "Page " + n}); err != nil {
+            return nil, err
+        }
+    }
+    return nif, nil
+}
+
+// renderedPages lists the PNG files pdftoppm wrote in page order. It pads
+// page numbers to the width of the highest, so they sort by name.
+func renderedPages(dir string) ([]string, error) {
+    pages, err := filepath.Glob(filepath.Join(dir, "page-*.png"))
+    if err != nil {
+        return nil, err
+    }
+    if len(pages) == 0 {
+        return nil, errors.New("PDF has no pages")
+    }
+    slices.Sort(pages)
+    return pages, nil
+}
+
+func decodePNGConfig(path string) (image.Config, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return image.Config{}, err
+    }
+    defer f.Close()
+    cfg, err := png.DecodeConfig(f)
+    if err != nil {
+        return image.Config{}, fmt.Errorf("failed to read rendered page: %w", err)
+    }
+    return cfg, nil
+}
+
+func decodePNGFile(path string) (image.Image, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    img, err := png.Decode(f)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read rendered page: %w", err)
+    }
+    return img, nil
+}
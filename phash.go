@@ -0,0 +1,84 @@
+package nest
+
+import (
+    "image"
+    "math/bits"
+)
+
+// PerceptualHash returns a 64-bit difference hash (dHash) of the main image,
+// computed from the coarsest pyramid level when the file has one. Near
+// duplicates differ in few bits; compare hashes with HashDistance.
+func (nif *NestedImageFile) PerceptualHash() uint64 {
+    if n := len(nif.Pyramid); n > 0 {
+        coarsest := &nif.Pyramid[0]
+        for i := range nif.Pyramid {
+            if nif.Pyramid[i].Level > coarsest.Level {
+                coarsest = &nif.Pyramid[i]
+            }
+        }
+        return dHash(coarsest.ToImage())
+    }
+    return dHash(nif.rawImage())
+}
+
+// PerceptualHash reads only the coarsest pyramid level when there is one and
+// decodes the main image otherwise.
+func (nr *Reader) PerceptualHash() (uint64, error) {
+    levels, err := nr.PyramidLevels()
+    if err != nil {
+        return 0, err
+    }
+    if len(levels) > 0 {
+        coarsest := levels[0]
+        for _, l := range levels {
+            coarsest = max(coarsest, l)
+        }
+        level, err := nr.ReadPyramidLevel(coarsest)
+        if err != nil {
+            return 0, err
+        }
+        return dHash(level.ToImage()), nil
+    }
+
+    region, err := nr.ReadRegion(nr.Bounds())
+    if err != nil {
+        return 0, err
+    }
+    img := image.NewRGBA(nr.Bounds())
+    for y, row := range region {
+        for x, p := range row {
+            i := img.PixOffset(x, y)
+            img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = p.R, p.G, p.B, 0xff
+        }
+    }
+    return dHash(img), nil
+}
+
+// HashDistance is the number of differing bits between two perceptual
+// hashes.
+func HashDistance(a, b uint64) int {
+    return bits.OnesCount64(a ^ b)
+}
+
+// dHash shrinks img to 9x8 luma samples and sets one bit per horizontally
+// adjacent pair that gets brighter.
+func dHash(img *image.RGBA) uint64 {
+    small := boxResize(img, 9, 8)
+    var luma [8][9]int
+    for y := 0; y < 8; y++ {
+        for x := 0; x < 9; x++ {
+            i := small.PixOffset(x, y)
+            luma[y][x] = 299*int(small.Pix[i]) + 587*int(small.Pix[i+1]) + 114*int(small.Pix[i+2])
+        }
+    }
+    var hash uint64
+    for y := 0; y < 8; y++ {
+        for x := 0; x < 8; x++ {
+            hash <<= 1
+            if luma[y][x+1] > luma[y][x] {
+                hash |= 1
+            }
+        }
+    }
+    return hash
+}
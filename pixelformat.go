@@ -0,0 +1,155 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+
+    "github.com/70ziko/NEST/colorspace"
+)
+
+// PixelFormat is an in-memory image layout ReadAs decodes into.
+type PixelFormat uint8
+
+const (
+    // FormatRGBA is *image.RGBA in sRGB, as ReadRegionImage returns.
+    FormatRGBA PixelFormat = iota
+    // FormatNRGBA is *image.NRGBA in sRGB.
+    FormatNRGBA
+    // FormatRGBA64 is *image.RGBA64 in sRGB. Linear and YCbCr files are
+    // converted at 16 bits, so dark linear values keep their steps.
+    FormatRGBA64
+    // FormatGray is *image.Gray holding luma.
+    FormatGray
+    // FormatGray16 is *image.Gray16 holding luma.
+    FormatGray16
+    // FormatYCbCr is *image.YCbCr with 4:4:4 sampling. YCbCr files are
+    // copied without conversion.
+    FormatYCbCr
+)
+
+func (f PixelFormat) String() string {
+    switch f {
+    case FormatRGBA:
+        return "rgba"
+    case FormatNRGBA:
+        return "nrgba"
+    case FormatRGBA64:
+        return "rgba64"
+    case FormatGray:
+        return "gray"
+    case FormatGray16:
+        return "gray16"
+    case FormatYCbCr:
+        return "ycbcr"
+    }
+    return "unknown"
+}
+
+func ParsePixelFormat(s string) (PixelFormat, error) {
+    for _, f := range []PixelFormat{FormatRGBA, FormatNRGBA, FormatRGBA64, FormatGray, FormatGray16, FormatYCbCr} {
+        if f.String() == s {
+            return f, nil
+        }
+    }
+    return FormatRGBA, fmt.Errorf("unknown pixel format %q", s)
+}
+
+// ReadAs decodes the main image straight into format, converting each tile
+// from the file's color space as it is decoded rather than in a second
+// pass over the whole image. Multispectral files convert their RGB
+// rendering; ReadBandRegion reads the bands themselves.
+func (nr *Reader) ReadAs(format PixelFormat) (image.Image, error) {
+    return nr.ReadRegionAs(nr.Bounds(), format)
+}
+
+// ReadRegionAs is ReadAs for the pixels inside rect. The image bounds start
+// at rect.Min after clipping.
+func (nr *Reader) ReadRegionAs(rect image.Rectangle, format PixelFormat) (image.Image, error) {
+    rect = rect.Intersect(nr.Bounds())
+    if rect.Empty() {
+        return nil, errors.New("region does not overlap the image")
+    }
+    img, set, err := formatImage(format, rect, nr.Header.ColorSpace)
+    if err != nil {
+        return nil, err
+    }
+    if err := nr.regionTiles(rect, set); err != nil {
+        return nil, err
+    }
+    return img, nil
+}
+
+// formatImage allocates an image in format and returns a function storing
+// one pixel of a file in color space space into it.
+func formatImage(format PixelFormat, rect image.Rectangle, space colorspace.Space) (image.Image, func(x, y int, p PixeLink), error) {
+    srgb8 := func(p PixeLink) (uint8, uint8, uint8) {
+        return colorspace.Convert8(p.R, p.G, p.B, space, colorspace.SRGB)
+    }
+    switch format {
+    case FormatRGBA, FormatNRGBA:
+        // Opaque pixels are laid out the same either way.
+        var pix []uint8
+        var stride int
+        var img image.Image
+        if format == FormatRGBA {
+            m := image.NewRGBA(rect)
+            img, pix, stride = m, m.Pix, m.Stride
+        } else {
+            m := image.NewNRGBA(rect)
+            img, pix, stride = m, m.Pix, m.Stride
+        }
+        return img, func(x, y int, p PixeLink) {
+            i := (y-rect.Min.Y)*stride + (x-rect.Min.X)*4
+            pix[i], pix[i+1], pix[i+2] = srgb8(p)
+            pix[i+3] = 0xff
+        }, nil
+    case FormatRGBA64:
+        m := image.NewRGBA64(rect)
+        return m, func(x, y int, p PixeLink) {
+            r, g, b := srgb16(p, space)
+            m.SetRGBA64(x, y, color.RGBA64{r, g, b, 0xffff})
+        }, nil
+    case FormatGray:
+        m := image.NewGray(rect)
+        return m, func(x, y int, p PixeLink) {
+            if space == colorspace.YCbCr {
+                m.Pix[m.PixOffset(x, y)] = p.R
+                return
+            }
+            r, g, b := srgb8(p)
+            m.Pix[m.PixOffset(x, y)] = uint8((19595*uint32(r) + 38470*uint32(g) + 7471*uint32(b) + 1<<15) >> 16)
+        }, nil
+    case FormatGray16:
+        m := image.NewGray16(rect)
+        return m, func(x, y int, p PixeLink) {
+            r, g, b := srgb16(p, space)
+            m.SetGray16(x, y, color.Gray16{uint16((19595*uint32(r) + 38470*uint32(g) + 7471*uint32(b) + 1<<15) >> 16)})
+        }, nil
+    case FormatYCbCr:
+        m := image.NewYCbCr(rect, image.YCbCrSubsampleRatio444)
+        return m, func(x, y int, p PixeLink) {
+            yy, cb, cr := p.R, p.G, p.B
+            if space != colorspace.YCbCr {
+                yy, cb, cr = color.RGBToYCbCr(srgb8(p))
+            }
+            m.Y[m.YOffset(x, y)] = yy
+            i := m.COffset(x, y)
+            m.Cb[i], m.Cr[i] = cb, cr
+        }, nil
+    }
+    return nil, nil, fmt.Errorf("unknown pixel format %d", format)
+}
+
+// srgb16 converts one stored pixel to 16-bit sRGB.
+func srgb16(p PixeLink, space colorspace.Space) (uint16, uint16, uint16) {
+    switch space {
+    case colorspace.Linear:
+        return colorspace.ToSRGB16(p.R), colorspace.ToSRGB16(p.G), colorspace.ToSRGB16(p.B)
+    case colorspace.YCbCr:
+        r, g, b, _ := color.YCbCr{Y: p.R, Cb: p.G, Cr: p.B}.RGBA()
+        return uint16(r), uint16(g), uint16(b)
+    }
+    return uint16(p.R) * 0x101, uint16(p.G) * 0x101, uint16(p.B) * 0x101
+}
@@ -0,0 +1,69 @@
+package nest
+
+import "image"
+
+// Bounds returns the main image rectangle, which starts at (0, 0).
+func (nif *NestedImageFile) Bounds() image.Rectangle {
+    return image.Rect(0, 0, int(nif.Header.Width), int(nif.Header.Height))
+}
+
+func (nif *NestedImageFile) inBounds(x, y int) bool {
+    return y >= 0 && y < len(nif.MainImage) && x >= 0 && x < len(nif.MainImage[y])
+}
+
+// At returns the PixeLink at (x, y), or the zero PixeLink outside the main
+// image, like image.RGBA.At.
+func (nif *NestedImageFile) At(x, y int) PixeLink {
+    if !nif.inBounds(x, y) {
+        return PixeLink{}
+    }
+    return nif.MainImage[y][x]
+}
+
+// Set stores p at (x, y). Coordinates outside the main image are ignored, as
+// image.RGBA.Set does; Set reports whether p was stored.
+func (nif *NestedImageFile) Set(x, y int, p PixeLink) bool {
+    if !nif.inBounds(x, y) {
+        return false
+    }
+    nif.MainImage[y][x] = p
+    if nif.Audit != nil {
+        nif.Audit.touch(x, y)
+    }
+    return true
+}
+
+// SetRGB changes the color at (x, y) and keeps its link.
+func (nif *NestedImageFile) SetRGB(x, y int, r, g, b uint8) bool {
+    if !nif.inBounds(x, y) {
+        return false
+    }
+    p := &nif.MainImage[y][x]
+    p.R, p.G, p.B = r, g, b
+    if nif.Audit != nil {
+        nif.Audit.touch(x, y)
+    }
+    return true
+}
+
+// SetLink changes the NestedIdx at (x, y) and keeps its color.
+func (nif *NestedImageFile) SetLink(x, y int, idx uint32) bool {
+    if !nif.inBounds(x, y) {
+        return false
+    }
+    nif.MainImage[y][x].NestedIdx = idx
+    if nif.Audit != nil {
+        nif.Audit.touch(x, y)
+    }
+    return true
+}
+
+// UncheckedAt and UncheckedSet skip the bounds check for tight loops that
+// already clip to Bounds; they panic on coordinates outside the image.
+func (nif *NestedImageFile) UncheckedAt(x, y int) PixeLink {
+    return nif.MainImage[y][x]
+}
+
+func (nif *NestedImageFile) UncheckedSet(x, y int, p PixeLink) {
+    nif.MainImage[y][x] = p
+}
@@ -0,0 +1,292 @@
+package nest
+
+import (
+    "bytes"
+    "compress/flate"
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+)
+
+// A CodecDelta plane stores the residuals of each sample from a prediction,
+// deflated:
+//
+//	uses uint8 | deflated residuals
+//
+// uses says which tiles the prediction draws on. Without any, each pixel
+// is predicted from the pixels left of, above and above-left of it in the
+// same tile with the median edge detector of LOCO-I. predictLeft and
+// predictTop extend that across the tile's left and top edges into the
+// neighboring tiles, and predictRef predicts every pixel as the same pixel
+// of a reference tile instead, such as the previous focal plane.
+const (
+    predictLeft uint8 = 1 << iota
+    predictTop
+    predictRef
+)
+
+// predictionBlock bounds the chains of neighbors a main image tile depends
+// on: tiles in the first column or row of each block of predictionBlock x
+// predictionBlock tiles don't predict from the block to their left or above,
+// so reading one tile decodes at most a block's worth.
+const predictionBlock = 8
+
+// prediction holds the decoded tiles a tile is predicted from. Nil tiles
+// are not used.
+type prediction struct {
+    left, top, ref []PixeLink
+}
+
+func (p *prediction) uses() uint8 {
+    var u uint8
+    if p.left != nil {
+        u |= predictLeft
+    }
+    if p.top != nil {
+        u |= predictTop
+    }
+    if p.ref != nil {
+        u |= predictRef
+    }
+    return u
+}
+
+// predictionSource returns the tiles named by uses, for decoding a tile
+// predicted from them.
+type predictionSource func(uses uint8) (*prediction, error)
+
+// at returns pixel (x, y) of the tile, reaching into the left and top
+// neighbors for x or y of -1.
+func (p *prediction) at(cur []PixeLink, ts, x, y int) (PixeLink, bool) {
+    switch {
+    case x >= 0 && y >= 0:
+        return cur[y*ts+x], true
+    case x < 0 && y >= 0 && p.left != nil:
+        return p.left[y*ts+ts-1], true
+    case y < 0 && x >= 0 && p.top != nil:
+        return p.top[(ts-1)*ts+x], true
+    }
+    return PixeLink{}, false
+}
+
+// predict returns the prediction of pixel (x, y) from the pixels of cur
+// before it in raster order.
+func (p *prediction) predict(cur []PixeLink, ts, x, y int) [3]int {
+    if p.ref != nil {
+        q := p.ref[y*ts+x]
+        return [3]int{int(q.R), int(q.G), int(q.B)}
+    }
+    a, okA := p.at(cur, ts, x-1, y)
+    b, okB := p.at(cur, ts, x, y-1)
+    c, okC := p.at(cur, ts, x-1, y-1)
+    av := [3]int{int(a.R), int(a.G), int(a.B)}
+    bv := [3]int{int(b.R), int(b.G), int(b.B)}
+    cv := [3]int{int(c.R), int(c.G), int(c.B)}
+    var out [3]int
+    for k := range out {
+        switch {
+        case okA && okB && okC:
+            lo, hi := min(av[k], bv[k]), max(av[k], bv[k])
+            switch {
+            case cv[k] >= hi:
+                out[k] = lo
+            case cv[k] <= lo:
+                out[k] = hi
+            default:
+                out[k] = av[k] + bv[k] - cv[k]
+            }
+        case okA && okB:
+            out[k] = (av[k] + bv[k]) / 2
+        case okA:
+            out[k] = av[k]
+        case okB:
+            out[k] = bv[k]
+        }
+    }
+    return out
+}
+
+// encodeDelta returns the CodecDelta payload of tile.
+func (tc *tileCodec) encodeDelta(tile []PixeLink, p *prediction) []byte {
+    ts := tc.tileSize
+    res := make([]byte, 3*len(tile))
+    for y := 0; y < ts; y++ {
+        for x := 0; x < ts; x++ {
+            i := y*ts + x
+            q := p.predict(tile, ts, x, y)
+            res[3*i] = tile[i].R - byte(q[0])
+            res[3*i+1] = tile[i].G - byte(q[1])
+            res[3*i+2] = tile[i].B - byte(q[2])
+        }
+    }
+    return append([]byte{p.uses()}, tc.deflate(res)...)
+}
+
+// decodeDelta reconstructs the colors of dst from a CodecDelta payload.
+func (tc *tileCodec) decodeDelta(payload []byte, dst []PixeLink, src predictionSource) error {
+    if len(payload) == 0 {
+        return errors.New("empty delta plane")
+    }
+    uses := payload[0]
+    if uses&^(predictLeft|predictTop|predictRef) != 0 {
+        return fmt.Errorf("delta plane uses unknown references %#x", uses)
+    }
+    p := &prediction{}
+    if uses != 0 {
+        if src == nil {
+            return errors.New("tile is predicted from other tiles, which are not available here")
+        }
+        var err error
+        if p, err = src(uses); err != nil {
+            return fmt.Errorf("failed to read the tiles a tile is predicted from: %w", err)
+        }
+    }
+    res, err := tc.inflate(payload[1:], 3*len(dst))
+    if err != nil {
+        return err
+    }
+    ts := tc.tileSize
+    for y := 0; y < ts; y++ {
+        for x := 0; x < ts; x++ {
+            i := y*ts + x
+            q := p.predict(dst, ts, x, y)
+            dst[i].R = res[3*i] + byte(q[0])
+            dst[i].G = res[3*i+1] + byte(q[1])
+            dst[i].B = res[3*i+2] + byte(q[2])
+        }
+    }
+    return nil
+}
+
+// neighbors returns the left and top neighbors tile t of a main image is
+// predicted from, given where every tile comes in the write order.
+func (nif *NestedImageFile) neighbors(t TileCoord, pos func(x, y int) int) *prediction {
+    ts := int(nif.Header.TileSize)
+    p := &prediction{}
+    if t.X%predictionBlock != 0 && pos(t.X-1, t.Y) < pos(t.X, t.Y) {
+        p.left = nif.extractTile((t.X-1)*ts, t.Y*ts, ts)
+    }
+    if t.Y%predictionBlock != 0 && pos(t.X, t.Y-1) < pos(t.X, t.Y) {
+        p.top = nif.extractTile(t.X*ts, (t.Y-1)*ts, ts)
+    }
+    return p
+}
+
+// neighborSource is the predictionSource of main image tile t when the
+// tiles it depends on are already in nif.MainImage.
+func (nif *NestedImageFile) neighborSource(t TileCoord) predictionSource {
+    return func(uses uint8) (*prediction, error) {
+        if uses&predictRef != 0 || (uses&predictLeft != 0 && t.X == 0) || (uses&predictTop != 0 && t.Y == 0) {
+            return nil, fmt.Errorf("tile (%d, %d) can't be predicted from references %#x", t.X, t.Y, uses)
+        }
+        ts := int(nif.Header.TileSize)
+        p := &prediction{}
+        if uses&predictLeft != 0 {
+            p.left = nif.extractTile((t.X-1)*ts, t.Y*ts, ts)
+        }
+        if uses&predictTop != 0 {
+            p.top = nif.extractTile(t.X*ts, (t.Y-1)*ts, ts)
+        }
+        return p, nil
+    }
+}
+
+// maxPredictionCache bounds the decoded tiles a Reader keeps for the tiles
+// predicted from them.
+const maxPredictionCache = 256
+
+// predictionCache holds decoded main image tiles that other tiles are
+// predicted from.
+type predictionCache struct {
+    mu    sync.Mutex
+    tiles map[TileCoord][]PixeLink
+}
+
+// neighborSource is the predictionSource of tile t, reading the tiles it
+// depends on and caching them for the tiles around.
+func (nr *Reader) neighborSource(t TileCoord) predictionSource {
+    return func(uses uint8) (*prediction, error) {
+        if uses&predictRef != 0 {
+            return nil, fmt.Errorf("tile (%d, %d) can't be predicted from references %#x", t.X, t.Y, uses)
+        }
+        p := &prediction{}
+        var err error
+        if uses&predictLeft != 0 {
+            if p.left, err = nr.cachedTile(TileCoord{t.X - 1, t.Y}); err != nil {
+                return nil, err
+            }
+        }
+        if uses&predictTop != 0 {
+            if p.top, err = nr.cachedTile(TileCoord{t.X, t.Y - 1}); err != nil {
+                return nil, err
+            }
+        }
+        return p, nil
+    }
+}
+
+func (nr *Reader) cachedTile(t TileCoord) ([]PixeLink, error) {
+    c := &nr.predicted
+    c.mu.Lock()
+    tile, ok := c.tiles[t]
+    c.mu.Unlock()
+    if ok {
+        return tile, nil
+    }
+    tile, err := nr.ReadTile(t.X, t.Y)
+    if err != nil {
+        return nil, err
+    }
+    c.mu.Lock()
+    if c.tiles == nil || len(c.tiles) >= maxPredictionCache {
+        c.tiles = map[TileCoord][]PixeLink{}
+    }
+    c.tiles[t] = tile
+    c.mu.Unlock()
+    return tile, nil
+}
+
+// levelSource is the predictionSource of tile (tx, ty) of a pyramid level
+// or focal plane whose tiles may be predicted from those of ref.
+func levelSource(tx, ty, ts int, ref func() (*PyramidLevel, error)) predictionSource {
+    return func(uses uint8) (*prediction, error) {
+        if uses != predictRef || ref == nil {
+            return nil, fmt.Errorf("level tiles can't be predicted from references %#x", uses)
+        }
+        l, err := ref()
+        if err != nil {
+            return nil, err
+        }
+        return &prediction{ref: l.tile(tx, ty, ts)}, nil
+    }
+}
+
+// deflate compresses delta residuals.
+func (tc *tileCodec) deflate(payload []byte) []byte {
+    var buf bytes.Buffer
+    w, _ := tc.deflaters.Get().(*flate.Writer)
+    if w == nil {
+        w, _ = flate.NewWriter(&buf, flate.BestCompression)
+    } else {
+        w.Reset(&buf)
+    }
+    w.Write(payload)
+    w.Close()
+    tc.deflaters.Put(w)
+    return buf.Bytes()
+}
+
+// inflate expands deflated residuals that must hold exactly n bytes.
+func (tc *tileCodec) inflate(payload []byte, n int) ([]byte, error) {
+    r := flate.NewReader(bytes.NewReader(payload))
+    defer r.Close()
+    out := make([]byte, n)
+    if _, err := io.ReadFull(r, out); err != nil {
+        return nil, fmt.Errorf("failed to inflate plane: %w", err)
+    }
+    if k, _ := r.Read(make([]byte, 1)); k != 0 {
+        return nil, fmt.Errorf("deflated plane holds more than %d bytes", n)
+    }
+    return out, nil
+}
@@ -0,0 +1,232 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "io/fs"
+    "time"
+
+    "github.com/70ziko/NEST/colorspace"
+)
+
+// TitleKey and DescriptionKey are the metadata keys PreviewCard reads the
+// caption of a card from.
+const (
+    TitleKey       = "title"
+    DescriptionKey = "description"
+)
+
+// ErrNoPreview is returned by PreviewCard for files with neither a
+// thumbnail nor a pyramid, whose main image is too large to preview.
+var ErrNoPreview = errors.New("file has no thumbnail or pyramid to preview")
+
+const (
+    // previewHead and previewTail are the bytes PreviewCard reads up front
+    // from the start and the end of a file.
+    previewHead = 16 << 10
+    previewTail = 256 << 10
+    // previewMemory bounds what decoding the preview image may allocate,
+    // since the files unfurled come from anyone.
+    previewMemory = 32 << 20
+    // previewMaxPixels bounds a main image PreviewCard decodes when there
+    // is nothing smaller.
+    previewMaxPixels = 1 << 20
+)
+
+// PreviewInfo is what a preview card shows beside the image.
+type PreviewInfo struct {
+    // Width and Height are the size of the main image as displayed.
+    Width, Height int
+    // Title and Description are the metadata under TitleKey and
+    // DescriptionKey, empty when missing.
+    Title, Description string
+}
+
+// PreviewCard reads what a link preview needs from a file, for bots that
+// unfurl links to it: a small image, the title and description, and the
+// dimensions. The image is the nested image with RoleThumbnail, or else the
+// smallest pyramid level with the display adjustments and orientation
+// applied, or else the main image if it is small.
+//
+// r must have a Size method, as *io.SectionReader and remote.ReaderAt do, or
+// be an *os.File. The start and the end of the file are each read once up
+// front, or the whole file in one read when it is small: the start holds
+// the header and the end the smallest pyramid level and the chunks after
+// it. Reads past those are only made for what lies elsewhere, such as
+// metadata ahead of a large pyramid, or the tile index and the nested image
+// a thumbnail needs.
+func PreviewCard(r io.ReaderAt) (image.Image, PreviewInfo, error) {
+    var info PreviewInfo
+    size, err := readerAtSize(r)
+    if err != nil {
+        return nil, info, err
+    }
+    pr, err := prefetch(r, size)
+    if err != nil {
+        return nil, info, err
+    }
+    nr, indexOffset, err := openReader(pr, size)
+    if err != nil {
+        return nil, info, err
+    }
+    budget := newMemoryBudget(previewMemory, time.Time{})
+    w, h := int(nr.Header.Width), int(nr.Header.Height)
+    info.Width, info.Height = nr.Header.Orientation.Size(w, h)
+
+    var index, meta, roles, smallest ByteRange
+    level := 0
+    var b [1]byte
+    err = nr.walkChunks(func(t ChunkType, offset int64, length uint64) (bool, error) {
+        at := ByteRange{Offset: offset, Length: int64(length)}
+        switch t {
+        case ChunkIndex:
+            index = at
+        case ChunkMetadata:
+            meta = at
+        case ChunkRoles:
+            roles = at
+        case ChunkAdjustments:
+            adj, err := decodeAdjustments(io.NewSectionReader(pr, offset, int64(length)), nr.order, length)
+            if err != nil {
+                return false, err
+            }
+            nr.adjustments = adj
+        case ChunkPyramid:
+            if length == 0 {
+                break
+            }
+            if _, err := pr.ReadAt(b[:], offset); err != nil {
+                return false, fmt.Errorf("failed to read pyramid level: %w", err)
+            }
+            if int(b[0]) > level {
+                level, smallest = int(b[0]), at
+            }
+        }
+        return true, nil
+    })
+    if err != nil {
+        return nil, info, err
+    }
+    if meta.Length > 0 {
+        m, err := decodeMetadata(io.NewSectionReader(pr, meta.Offset, meta.Length), nr.order, uint64(meta.Length))
+        if err != nil {
+            return nil, info, err
+        }
+        info.Title, info.Description = m[TitleKey], m[DescriptionKey]
+    }
+
+    if roles.Length > 0 && roles.Length == int64(nr.Header.NestedCount) {
+        data := make([]byte, roles.Length)
+        if _, err := pr.ReadAt(data, roles.Offset); err != nil {
+            return nil, info, fmt.Errorf("failed to read %s chunk: %w", ChunkRoles, err)
+        }
+        for i, role := range data {
+            if NestedRole(role) != RoleThumbnail {
+                continue
+            }
+            // The index is decoded in many small reads.
+            if index.Length > 0 {
+                if err := pr.fetch(index.Offset-chunkHeaderSize, index.Length+chunkHeaderSize); err != nil {
+                    return nil, info, err
+                }
+            }
+            if err := nr.loadIndex(indexOffset, budget); err != nil {
+                return nil, info, err
+            }
+            ni, err := nr.ReadNestedImage(i)
+            if err != nil {
+                return nil, info, err
+            }
+            return ni.ToImage(), info, nil
+        }
+    }
+
+    o := nr.Header.Orientation
+    if level > 0 {
+        l, err := decodePyramidLevel(io.NewSectionReader(pr, smallest.Offset, smallest.Length), nr.codec(), uint64(smallest.Length), budget, nil)
+        if err != nil {
+            return nil, info, err
+        }
+        colorspace.ConvertPix(l.Data, nr.Header.ColorSpace, colorspace.SRGB)
+        img := l.ToImage()
+        nr.adjustments.apply(img)
+        dw, dh := o.Size(l.Width, l.Height)
+        return o.orient(img, image.Rect(0, 0, dw, dh), l.Width, l.Height), info, nil
+    }
+    if int64(w)*int64(h) > previewMaxPixels {
+        return nil, info, ErrNoPreview
+    }
+    if err := nr.loadIndex(indexOffset, budget); err != nil {
+        return nil, info, err
+    }
+    img, err := nr.ReadOrientedRegion(nr.OrientedBounds())
+    if err != nil {
+        return nil, info, err
+    }
+    return img, info, nil
+}
+
+// readerAtSize returns the size of the file behind r.
+func readerAtSize(r io.ReaderAt) (int64, error) {
+    switch s := r.(type) {
+    case interface{ Size() int64 }:
+        return s.Size(), nil
+    case interface{ Stat() (fs.FileInfo, error) }:
+        info, err := s.Stat()
+        if err != nil {
+            return 0, fmt.Errorf("failed to stat file: %w", err)
+        }
+        return info.Size(), nil
+    }
+    return 0, fmt.Errorf("cannot tell the size of a %T", r)
+}
+
+// prefetch reads the start and end of a file of size bytes from r, and
+// returns an io.ReaderAt serving reads within them from memory.
+func prefetch(r io.ReaderAt, size int64) (*spanReaderAt, error) {
+    sr := &spanReaderAt{r: r, size: size}
+    if size <= previewHead+previewTail {
+        return sr, sr.fetch(0, size)
+    }
+    if err := sr.fetch(0, previewHead); err != nil {
+        return nil, err
+    }
+    return sr, sr.fetch(size-previewTail, previewTail)
+}
+
+type span struct {
+    off  int64
+    data []byte
+}
+
+// spanReaderAt reads from spans held in memory when they cover the whole
+// read, and from r otherwise.
+type spanReaderAt struct {
+    r     io.ReaderAt
+    size  int64
+    spans []span
+}
+
+// fetch reads n bytes at off into a new span.
+func (s *spanReaderAt) fetch(off, n int64) error {
+    if off < 0 || n < 0 || off+n > s.size {
+        return fmt.Errorf("range of %d bytes at offset %d is outside the file", n, off)
+    }
+    data := make([]byte, n)
+    if _, err := s.r.ReadAt(data, off); err != nil && !(errors.Is(err, io.EOF) && off+n == s.size) {
+        return fmt.Errorf("failed to read file: %w", err)
+    }
+    s.spans = append(s.spans, span{off, data})
+    return nil
+}
+
+func (s *spanReaderAt) ReadAt(p []byte, off int64) (int, error) {
+    for _, sp := range s.spans {
+        if off >= sp.off && off+int64(len(p)) <= sp.off+int64(len(sp.data)) {
+            return copy(p, sp.data[off-sp.off:]), nil
+        }
+    }
+    return s.r.ReadAt(p, off)
+}
@@ -0,0 +1,130 @@
+package nest
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+    "time"
+)
+
+// previewFile writes a small file with a pyramid and a title, the common
+// shape of the files PreviewCard unfurls.
+func previewFile(t *testing.T) []byte {
+    t.Helper()
+    nif := NewNestedImageFile(64, 48, 16)
+    for y, row := range nif.MainImage {
+        for x := range row {
+            row[x] = PixeLink{R: uint8(x * 4), G: uint8(y * 5), B: 128}
+        }
+    }
+    nif.Metadata = Metadata{TitleKey: "Harbour"}
+    nif.BuildPyramid()
+    var buf bytes.Buffer
+    if err := nif.Write(&buf); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+// previewWithin runs PreviewCard on data, failing the test if it panics or
+// does not return within a few seconds.
+func previewWithin(t *testing.T, data []byte) (PreviewInfo, error) {
+    t.Helper()
+    type result struct {
+        info  PreviewInfo
+        err   error
+        panic error
+    }
+    done := make(chan result, 1)
+    go func() {
+        defer func() {
+            if v := recover(); v != nil {
+                done <- result{panic: fmt.Errorf("%v", v)}
+            }
+        }()
+        _, info, err := PreviewCard(bytes.NewReader(data))
+        done <- result{info: info, err: err}
+    }()
+    select {
+    case r := <-done:
+        if r.panic != nil {
+            t.Fatalf("PreviewCard panicked: %v", r.panic)
+        }
+        return r.info, r.err
+    case <-time.After(5 * time.Second):
+        t.Fatal("PreviewCard did not return")
+        return PreviewInfo{}, nil
+    }
+}
+
+func TestPreviewCard(t *testing.T) {
+    info, err := previewWithin(t, previewFile(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.Width != 64 || info.Height != 48 || info.Title != "Harbour" {
+        t.Errorf("got %+v", info)
+    }
+}
+
+// TestPreviewCardCraftedLengths gives each chunk of a file lengths that
+// wrap negative or run past the end of the file. PreviewCard must reject
+// them rather than hang or panic.
+func TestPreviewCardCraftedLengths(t *testing.T) {
+    data := previewFile(t)
+    nr, err := NewReader(bytes.NewReader(data), int64(len(data)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var chunks []int64
+    err = nr.walkChunks(func(ct ChunkType, offset int64, length uint64) (bool, error) {
+        chunks = append(chunks, offset-chunkHeaderSize)
+        return true, nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(chunks) == 0 {
+        t.Fatal("file has no chunks")
+    }
+
+    lengths := []uint64{1<<64 - chunkHeaderSize, 1 << 63, uint64(len(data))}
+    for _, offset := range chunks {
+        for _, length := range lengths {
+            crafted := bytes.Clone(data)
+            nr.order.PutUint64(crafted[offset+4:], length)
+            if _, err := previewWithin(t, crafted); err == nil {
+                t.Errorf("chunk at offset %d with length %d: no error", offset, length)
+            }
+        }
+    }
+}
+
+// TestPreviewCardIndexGrid gives a file without a pyramid, which PreviewCard
+// decodes through the tile index, an index for a grid of 2^34 tiles.
+func TestPreviewCardIndexGrid(t *testing.T) {
+    nif := NewNestedImageFile(64, 64, 16)
+    var buf bytes.Buffer
+    if err := nif.Write(&buf); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := previewWithin(t, buf.Bytes()); err != nil {
+        t.Fatal(err)
+    }
+    data := withIndexGrid(t, buf.Bytes(), 1<<20, 1<<14)
+    if _, err := previewWithin(t, data); err == nil {
+        t.Fatal("PreviewCard accepted an index for another tile grid")
+    }
+}
+
+// TestPreviewCardTruncated cuts the file short, which PreviewCard may
+// reject but must not hang or panic on.
+func TestPreviewCardTruncated(t *testing.T) {
+    data := previewFile(t)
+    for _, n := range []int{0, 1, 16, len(data) / 2, len(data) - 1} {
+        _, err := previewWithin(t, data[:n])
+        if n <= 16 && err == nil {
+            t.Errorf("file cut to %d bytes: no error", n)
+        }
+    }
+}
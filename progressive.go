@@ -0,0 +1,126 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "slices"
+    "time"
+
+    "github.com/70ziko/NEST/colorspace"
+    "github.com/70ziko/NEST/tilemath"
+)
+
+// Refinement is one step of a progressive read: rect rendered as sRGB at a
+// pyramid level, with bounds in that level's coordinates. Level 0 is full
+// resolution.
+type Refinement struct {
+    Level int
+    Image *image.RGBA
+    // Throughput is the bytes per second observed so far, counting decoding.
+    Throughput float64
+}
+
+type progressiveStage struct {
+    level  int
+    offset int64
+    bytes  int64
+}
+
+// ReadProgressive delivers rect coarse to fine, starting with the smallest
+// stored pyramid level and ending with the finest one opts.Width needs. It
+// measures how fast each step arrives and skips steps that would exceed
+// opts.Budget, which suits readers on a slow remote.ReaderAt. Codec quality
+// is fixed when a file is written, so the level is the only thing chosen.
+// Returning false from deliver stops early.
+func (nr *Reader) ReadProgressive(rect image.Rectangle, opts ProgressiveOptions, deliver func(Refinement) bool) error {
+    rect = rect.Intersect(nr.Bounds())
+    if rect.Empty() {
+        return errors.New("region does not overlap the image")
+    }
+    stages, err := nr.progressiveStages(rect, opts.Width)
+    if err != nil {
+        return err
+    }
+
+    var throughput float64
+    for i, s := range stages {
+        var expected time.Duration
+        if throughput > 0 {
+            expected = time.Duration(float64(s.bytes) / throughput * float64(time.Second))
+        }
+        if i > 0 && opts.Budget > 0 && expected > opts.Budget {
+            if opts.OnSkip != nil {
+                opts.OnSkip(s.level, expected)
+            }
+            continue
+        }
+        if opts.OnLoading != nil {
+            opts.OnLoading(s.level, expected)
+        }
+
+        start := time.Now()
+        img, err := nr.readStage(s, rect)
+        if err != nil {
+            return err
+        }
+        if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+            observed := float64(s.bytes) / elapsed
+            if throughput == 0 {
+                throughput = observed
+            } else {
+                throughput = 0.5*throughput + 0.5*observed
+            }
+        }
+        if !deliver(Refinement{Level: s.level, Image: img, Throughput: throughput}) {
+            return nil
+        }
+    }
+    return nil
+}
+
+// progressiveStages lists the pyramid levels coarse to fine, followed by
+// full resolution unless a level already covers width.
+func (nr *Reader) progressiveStages(rect image.Rectangle, width int) ([]progressiveStage, error) {
+    var stages []progressiveStage
+    var b [1]byte
+    err := nr.walkChunks(func(t ChunkType, offset int64, length uint64) (bool, error) {
+        if t != ChunkPyramid || length == 0 {
+            return true, nil
+        }
+        if _, err := nr.r.ReadAt(b[:], offset); err != nil {
+            return false, fmt.Errorf("failed to read pyramid level: %w", err)
+        }
+        stages = append(stages, progressiveStage{level: int(b[0]), offset: offset, bytes: int64(length)})
+        return true, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    slices.SortFunc(stages, func(a, b progressiveStage) int { return b.level - a.level })
+
+    for i, s := range stages {
+        if width > 0 && tilemath.RectToLevel(rect, s.level).Dx() >= width {
+            return stages[:i+1], nil
+        }
+    }
+    full := progressiveStage{}
+    for _, br := range nr.RegionRanges(rect) {
+        full.bytes += br.Length
+    }
+    return append(stages, full), nil
+}
+
+func (nr *Reader) readStage(s progressiveStage, rect image.Rectangle) (*image.RGBA, error) {
+    if s.level == 0 {
+        return nr.ReadRegionImage(rect)
+    }
+    l, err := decodePyramidLevel(io.NewSectionReader(nr.r, s.offset, s.bytes), nr.codec(), uint64(s.bytes), nil, nil)
+    if err != nil {
+        return nil, err
+    }
+    colorspace.ConvertPix(l.Data, nr.Header.ColorSpace, colorspace.SRGB)
+    r := tilemath.RectToLevel(rect, s.level).Intersect(image.Rect(0, 0, l.Width, l.Height))
+    return l.ToImage().SubImage(r).(*image.RGBA), nil
+}
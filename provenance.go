@@ -0,0 +1,267 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "slices"
+    "time"
+
+    "github.com/70ziko/NEST/tilemath"
+)
+
+// ProvenanceOp is the kind of operation that produced a tile's pixels.
+type ProvenanceOp uint8
+
+const (
+    OpImport ProvenanceOp = iota
+    OpMerge
+    OpEdit
+    OpResample
+)
+
+func (op ProvenanceOp) String() string {
+    switch op {
+    case OpImport:
+        return "import"
+    case OpMerge:
+        return "merge"
+    case OpEdit:
+        return "edit"
+    case OpResample:
+        return "resample"
+    }
+    return "unknown"
+}
+
+func ParseProvenanceOp(s string) (ProvenanceOp, error) {
+    for _, op := range []ProvenanceOp{OpImport, OpMerge, OpEdit, OpResample} {
+        if op.String() == s {
+            return op, nil
+        }
+    }
+    return OpImport, fmt.Errorf("unknown provenance operation %q", s)
+}
+
+// ProvenanceRecord describes one operation. Source names the input, such as
+// a file path, and Detail holds free-form parameters.
+type ProvenanceRecord struct {
+    Op     ProvenanceOp
+    Source string
+    Detail string
+    Time   time.Time
+}
+
+// Provenance lists, for each tile of the main image, the records of the
+// operations that produced it, oldest first. Records are shared between
+// tiles and stored once.
+type Provenance struct {
+    Records []ProvenanceRecord
+    tiles   map[TileCoord][]uint32
+}
+
+// Tile returns the records of tile (tx, ty), oldest first.
+func (p *Provenance) Tile(tx, ty int) []ProvenanceRecord {
+    if p == nil {
+        return nil
+    }
+    var out []ProvenanceRecord
+    for _, i := range p.tiles[TileCoord{tx, ty}] {
+        out = append(out, p.Records[i])
+    }
+    return out
+}
+
+func (p *Provenance) add(tile TileCoord, record uint32) {
+    if p.tiles == nil {
+        p.tiles = map[TileCoord][]uint32{}
+    }
+    if !slices.Contains(p.tiles[tile], record) {
+        p.tiles[tile] = append(p.tiles[tile], record)
+    }
+}
+
+// RecordProvenance notes that rec produced every tile touching rect,
+// starting provenance tracking if the file had none. A zero Time is set to
+// now.
+func (nif *NestedImageFile) RecordProvenance(rect image.Rectangle, rec ProvenanceRecord) {
+    if nif.Provenance == nil {
+        nif.Provenance = &Provenance{}
+    }
+    if rec.Time.IsZero() {
+        rec.Time = time.Now()
+    }
+    p := nif.Provenance
+    p.Records = append(p.Records, rec)
+    i := uint32(len(p.Records) - 1)
+    tiles := nif.grid().TileRange(rect)
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            p.add(TileCoord{tx, ty}, i)
+        }
+    }
+}
+
+// PixelProvenance returns the records of the tile holding (x, y).
+func (nif *NestedImageFile) PixelProvenance(x, y int) []ProvenanceRecord {
+    ts := int(nif.Header.TileSize)
+    if !nif.inBounds(x, y) || ts == 0 {
+        return nil
+    }
+    return nif.Provenance.Tile(x/ts, y/ts)
+}
+
+// resampled returns the provenance of a copy of the image scaled from the
+// src grid to dst: each new tile inherits the records of the tiles it was
+// sampled from, followed by recs. Without recs it only moves the records to
+// a grid of another tile size.
+func (p *Provenance) resampled(src, dst tilemath.Grid, recs ...ProvenanceRecord) *Provenance {
+    out := &Provenance{Records: append(slices.Clone(p.Records), recs...)}
+    added := uint32(len(p.Records))
+    for ty := 0; ty < dst.Rows(); ty++ {
+        for tx := 0; tx < dst.Cols(); tx++ {
+            b := dst.TileBounds(tx, ty)
+            from := image.Rect(b.Min.X*src.Width/dst.Width, b.Min.Y*src.Height/dst.Height,
+                ceilDiv(b.Max.X*src.Width, dst.Width), ceilDiv(b.Max.Y*src.Height, dst.Height))
+            tiles := src.TileRange(from)
+            tile := TileCoord{tx, ty}
+            for sy := tiles.Min.Y; sy < tiles.Max.Y; sy++ {
+                for sx := tiles.Min.X; sx < tiles.Max.X; sx++ {
+                    for _, i := range p.tiles[TileCoord{sx, sy}] {
+                        out.add(tile, i)
+                    }
+                }
+            }
+            for i := added; i < uint32(len(out.Records)); i++ {
+                out.add(tile, i)
+            }
+        }
+    }
+    return out
+}
+
+// The PROV chunk holds the record table and then the tiles that have
+// records:
+//
+//	record count uint32 | op uint8 | source length uint16 | source |
+//	    detail length uint16 | detail | unix nanoseconds int64 ...
+//	tile count uint32 | x uint32 | y uint32 | count uint16 | record uint32...
+func (p *Provenance) chunk(order binary.ByteOrder) (*Chunk, error) {
+    var buf bytes.Buffer
+    binary.Write(&buf, order, uint32(len(p.Records)))
+    for i, r := range p.Records {
+        if len(r.Source) > math.MaxUint16 || len(r.Detail) > math.MaxUint16 {
+            return nil, fmt.Errorf("provenance record %d has a field longer than %d bytes", i, math.MaxUint16)
+        }
+        buf.WriteByte(byte(r.Op))
+        binary.Write(&buf, order, uint16(len(r.Source)))
+        buf.WriteString(r.Source)
+        binary.Write(&buf, order, uint16(len(r.Detail)))
+        buf.WriteString(r.Detail)
+        binary.Write(&buf, order, r.Time.UnixNano())
+    }
+
+    tiles := make([]TileCoord, 0, len(p.tiles))
+    for t := range p.tiles {
+        tiles = append(tiles, t)
+    }
+    slices.SortFunc(tiles, func(a, b TileCoord) int {
+        if a.Y != b.Y {
+            return a.Y - b.Y
+        }
+        return a.X - b.X
+    })
+    binary.Write(&buf, order, uint32(len(tiles)))
+    for _, t := range tiles {
+        records := p.tiles[t]
+        binary.Write(&buf, order, [2]uint32{uint32(t.X), uint32(t.Y)})
+        binary.Write(&buf, order, uint16(len(records)))
+        binary.Write(&buf, order, records)
+    }
+    return &Chunk{Type: ChunkProvenance, Data: buf.Bytes()}, nil
+}
+
+func decodeProvenance(reader io.Reader, order binary.ByteOrder, length uint64) (*Provenance, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkProvenance, err)
+    }
+    r := bytes.NewReader(data)
+    fail := func(err error) (*Provenance, error) {
+        return nil, fmt.Errorf("failed to decode %s chunk: %w", ChunkProvenance, err)
+    }
+    readString := func() (string, error) {
+        var n uint16
+        if err := binary.Read(r, order, &n); err != nil {
+            return "", err
+        }
+        b := make([]byte, n)
+        _, err := io.ReadFull(r, b)
+        return string(b), err
+    }
+
+    var count uint32
+    if err := binary.Read(r, order, &count); err != nil {
+        return fail(err)
+    }
+    if int64(count)*13 > int64(r.Len()) {
+        return fail(fmt.Errorf("%d records do not fit in %d bytes", count, r.Len()))
+    }
+    p := &Provenance{Records: make([]ProvenanceRecord, count)}
+    for i := range p.Records {
+        rec := &p.Records[i]
+        op, err := r.ReadByte()
+        if err != nil {
+            return fail(err)
+        }
+        rec.Op = ProvenanceOp(op)
+        if rec.Source, err = readString(); err != nil {
+            return fail(err)
+        }
+        if rec.Detail, err = readString(); err != nil {
+            return fail(err)
+        }
+        var nanos int64
+        if err := binary.Read(r, order, &nanos); err != nil {
+            return fail(err)
+        }
+        rec.Time = time.Unix(0, nanos)
+    }
+
+    if err := binary.Read(r, order, &count); err != nil {
+        return fail(err)
+    }
+    for i := 0; i < int(count); i++ {
+        var pos [2]uint32
+        var n uint16
+        if err := binary.Read(r, order, &pos); err != nil {
+            return fail(err)
+        }
+        if err := binary.Read(r, order, &n); err != nil {
+            return fail(err)
+        }
+        records := make([]uint32, n)
+        if err := binary.Read(r, order, records); err != nil {
+            return fail(err)
+        }
+        for _, rec := range records {
+            if int(rec) >= len(p.Records) {
+                return fail(fmt.Errorf("tile (%d, %d) refers to record %d of %d", pos[0], pos[1], rec, len(p.Records)))
+            }
+            p.add(TileCoord{int(pos[0]), int(pos[1])}, rec)
+        }
+    }
+    return p, nil
+}
+
+// Provenance reads the PROV chunk. Files without one return nil.
+func (nr *Reader) Provenance() (*Provenance, error) {
+    offset, length, ok, err := nr.findChunk(ChunkProvenance)
+    if err != nil || !ok {
+        return nil, err
+    }
+    return decodeProvenance(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+}
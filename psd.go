@@ -0,0 +1,448 @@
+package nest
+
+import (
+    "bufio"
+    "bytes"
+    "compress/zlib"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "unicode/utf16"
+)
+
+// psdMaxSize is the largest side a Photoshop document may have; larger
+// ones are saved as PSB.
+const psdMaxSize = 30000
+
+var errPSDTruncated = errors.New("PSD data is truncated")
+
+// psdCursor reads big-endian values from a PSD section, remembering the
+// first overrun instead of failing every call.
+type psdCursor struct {
+    b   []byte
+    err error
+}
+
+func (c *psdCursor) next(n int) []byte {
+    if c.err != nil {
+        return nil
+    }
+    if n < 0 || n > len(c.b) {
+        c.err = errPSDTruncated
+        return nil
+    }
+    b := c.b[:n]
+    c.b = c.b[n:]
+    return b
+}
+
+func (c *psdCursor) u8() uint8 {
+    if b := c.next(1); b != nil {
+        return b[0]
+    }
+    return 0
+}
+
+func (c *psdCursor) u16() uint16 {
+    if b := c.next(2); b != nil {
+        return binary.BigEndian.Uint16(b)
+    }
+    return 0
+}
+
+func (c *psdCursor) u32() uint32 {
+    if b := c.next(4); b != nil {
+        return binary.BigEndian.Uint32(b)
+    }
+    return 0
+}
+
+type psdChannel struct {
+    id     int16
+    length uint32
+}
+
+type psdLayer struct {
+    rect     image.Rectangle
+    channels []psdChannel
+    opacity  uint8
+    hidden   bool
+    name     string
+    // section is the lsct divider type: 1 and 2 close a group (open or
+    // collapsed in the layers panel), 3 starts one.
+    section uint32
+}
+
+// DecodePSD reads a Photoshop document with 8-bit RGB or grayscale
+// channels. Layers keep their names, opacity, visibility and groups; blend
+// modes, masks, effects and adjustment layers are not applied to them, so
+// the merged image saved with the document is used as the composite. Large
+// documents (PSB) are not supported.
+func DecodePSD(r io.Reader) (*LayeredImage, error) {
+    br := bufio.NewReader(r)
+    var hdr struct {
+        Signature     [4]byte
+        Version       uint16
+        _             [6]byte
+        Channels      uint16
+        Height, Width uint32
+        Depth, Mode   uint16
+    }
+    if err := binary.Read(br, binary.BigEndian, &hdr); err != nil {
+        return nil, fmt.Errorf("failed to read PSD header: %w", err)
+    }
+    switch {
+    case string(hdr.Signature[:]) != "8BPS":
+        return nil, errors.New("not a PSD file")
+    case hdr.Version == 2:
+        return nil, errors.New("large documents (PSB) are not supported")
+    case hdr.Version != 1:
+        return nil, fmt.Errorf("unknown PSD version %d", hdr.Version)
+    case hdr.Depth != 8:
+        return nil, fmt.Errorf("%d-bit PSD channels are not supported", hdr.Depth)
+    case hdr.Mode != 1 && hdr.Mode != 3:
+        return nil, fmt.Errorf("PSD color mode %d is not supported, only RGB and grayscale", hdr.Mode)
+    case hdr.Mode == 3 && hdr.Channels < 3, hdr.Channels == 0:
+        return nil, fmt.Errorf("PSD has %d channels", hdr.Channels)
+    case hdr.Width == 0 || hdr.Height == 0 || hdr.Width > psdMaxSize || hdr.Height > psdMaxSize:
+        return nil, fmt.Errorf("PSD canvas is %dx%d", hdr.Width, hdr.Height)
+    }
+    gray := hdr.Mode == 1
+
+    // Color mode data and image resources are not needed.
+    for range 2 {
+        if _, err := readPSDSection(br); err != nil {
+            return nil, err
+        }
+    }
+    info, err := readPSDSection(br)
+    if err != nil {
+        return nil, err
+    }
+    layers, mergedAlpha, err := decodePSDLayers(info, gray)
+    if err != nil {
+        return nil, err
+    }
+    li := &LayeredImage{Width: int(hdr.Width), Height: int(hdr.Height), Layers: layers}
+
+    merged, err := io.ReadAll(br)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read PSD merged image: %w", err)
+    }
+    composite, err := decodePSDMerged(merged, int(hdr.Channels), li.Width, li.Height, gray, mergedAlpha)
+    switch {
+    case err == nil:
+        li.Composite = composite
+    case len(layers) == 0:
+        return nil, err
+    }
+    return li, nil
+}
+
+// readPSDSection reads a section that starts with its uint32 length.
+func readPSDSection(r io.Reader) ([]byte, error) {
+    var n uint32
+    if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+        return nil, fmt.Errorf("failed to read PSD section: %w", err)
+    }
+    data, err := io.ReadAll(io.LimitReader(r, int64(n)))
+    if err != nil {
+        return nil, fmt.Errorf("failed to read PSD section: %w", err)
+    }
+    if len(data) < int(n) {
+        return nil, errPSDTruncated
+    }
+    return data, nil
+}
+
+// decodePSDLayers decodes the layer and mask information section into the
+// layer tree, reporting whether the merged image has transparency.
+func decodePSDLayers(data []byte, gray bool) ([]SourceLayer, bool, error) {
+    if len(data) == 0 {
+        return nil, false, nil
+    }
+    c := &psdCursor{b: data}
+    info := &psdCursor{b: c.next(int(c.u32()))}
+    if c.err != nil {
+        return nil, false, fmt.Errorf("failed to read PSD layers: %w", c.err)
+    }
+    if len(info.b) == 0 {
+        return nil, false, nil
+    }
+    // A negative count means the first alpha channel of the merged image is
+    // its transparency.
+    count := int(int16(info.u16()))
+    mergedAlpha := count < 0
+    if count < 0 {
+        count = -count
+    }
+
+    records := make([]psdLayer, count)
+    for i := range records {
+        rec := &records[i]
+        top, left := int32(info.u32()), int32(info.u32())
+        bottom, right := int32(info.u32()), int32(info.u32())
+        rec.rect = image.Rect(int(left), int(top), int(right), int(bottom))
+        if rec.rect.Dx() > psdMaxSize || rec.rect.Dy() > psdMaxSize {
+            return nil, false, fmt.Errorf("PSD layer %d is %dx%d", i, rec.rect.Dx(), rec.rect.Dy())
+        }
+        n := info.u16()
+        if n > 56 {
+            return nil, false, fmt.Errorf("PSD layer %d has %d channels", i, n)
+        }
+        rec.channels = make([]psdChannel, n)
+        for j := range rec.channels {
+            rec.channels[j] = psdChannel{id: int16(info.u16()), length: info.u32()}
+        }
+        if sig := info.next(4); info.err == nil && string(sig) != "8BIM" {
+            return nil, false, fmt.Errorf("PSD layer %d has a bad signature", i)
+        }
+        info.next(4) // blend mode
+        rec.opacity = info.u8()
+        info.u8() // clipping
+        rec.hidden = info.u8()&2 != 0
+        info.u8() // filler
+        rec.decodeExtra(info.next(int(info.u32())))
+        if info.err != nil {
+            return nil, false, fmt.Errorf("failed to read PSD layer %d: %w", i, info.err)
+        }
+    }
+
+    // Records run bottom to top, a group's start divider below its members
+    // and the record carrying its name above them.
+    stack := [][]SourceLayer{nil}
+    for i, rec := range records {
+        l := SourceLayer{Name: rec.name, Opacity: float64(rec.opacity) / 255, Hidden: rec.hidden}
+        var pixels [][]byte
+        for _, ch := range rec.channels {
+            data := info.next(int(ch.length))
+            if info.err != nil {
+                return nil, false, fmt.Errorf("failed to read PSD layer %d channel %d: %w", i, ch.id, info.err)
+            }
+            if rec.section != 0 || rec.rect.Empty() || ch.id < -1 || ch.id > 2 {
+                continue
+            }
+            plane, err := decodePSDChannel(data, rec.rect.Dx(), rec.rect.Dy())
+            if err != nil {
+                return nil, false, fmt.Errorf("PSD layer %d channel %d: %w", i, ch.id, err)
+            }
+            if pixels == nil {
+                pixels = make([][]byte, 4)
+            }
+            pixels[(ch.id+4)%4] = plane // alpha (-1) goes last
+        }
+        switch rec.section {
+        case 3:
+            stack = append(stack, nil)
+            continue
+        case 1, 2:
+            if len(stack) == 1 {
+                return nil, false, fmt.Errorf("PSD layer %d closes a group that was not opened", i)
+            }
+            l.Group, l.Children = true, stack[len(stack)-1]
+            stack = stack[:len(stack)-1]
+        default:
+            if pixels != nil {
+                l.Image = psdImage(rec.rect, pixels, gray)
+            }
+        }
+        stack[len(stack)-1] = append(stack[len(stack)-1], l)
+    }
+    if len(stack) != 1 {
+        return nil, false, errors.New("PSD layer groups are not closed")
+    }
+    return stack[0], mergedAlpha, nil
+}
+
+// decodeExtra reads the layer name, preferring the Unicode one, and the
+// group divider type from a record's extra data.
+func (rec *psdLayer) decodeExtra(data []byte) {
+    c := &psdCursor{b: data}
+    c.next(int(c.u32())) // layer mask
+    c.next(int(c.u32())) // blending ranges
+    n := int(c.u8())
+    rec.name = string(c.next(n))
+    c.next(3 - n%4) // pad the Pascal string to 4 bytes
+    for c.err == nil && len(c.b) >= 12 {
+        c.next(4) // 8BIM or 8B64
+        key := string(c.next(4))
+        block := &psdCursor{b: c.next(int(c.u32()))}
+        switch key {
+        case "luni":
+            // Ignore names longer than their block rather than allocating
+            // for them.
+            length := block.u32()
+            if uint64(length) > uint64(len(block.b)/2) {
+                break
+            }
+            units := make([]uint16, length)
+            for i := range units {
+                units[i] = block.u16()
+            }
+            if block.err == nil {
+                rec.name = string(utf16.Decode(units))
+            }
+        case "lsct", "lsdk":
+            rec.section = block.u32()
+        }
+    }
+}
+
+// decodePSDChannel decodes one layer channel of w x h samples, which starts
+// with its compression method.
+func decodePSDChannel(data []byte, w, h int) ([]byte, error) {
+    if len(data) < 2 {
+        return nil, errPSDTruncated
+    }
+    method := binary.BigEndian.Uint16(data)
+    data = data[2:]
+    switch method {
+    case 0:
+        if len(data) < w*h {
+            return nil, errPSDTruncated
+        }
+        return data[:w*h], nil
+    case 1:
+        planes, err := unpackPSDPlanes(data, 1, w, h)
+        if err != nil {
+            return nil, err
+        }
+        return planes[0], nil
+    case 2, 3:
+        zr, err := zlib.NewReader(bytes.NewReader(data))
+        if err != nil {
+            return nil, err
+        }
+        plane := make([]byte, w*h)
+        if _, err := io.ReadFull(zr, plane); err != nil {
+            return nil, err
+        }
+        if method == 3 {
+            // Each sample is stored as the difference from its left
+            // neighbour.
+            for y := 0; y < h; y++ {
+                row := plane[y*w : (y+1)*w]
+                for x := 1; x < w; x++ {
+                    row[x] += row[x-1]
+                }
+            }
+        }
+        return plane, nil
+    }
+    return nil, fmt.Errorf("unknown PSD compression %d", method)
+}
+
+// unpackPSDPlanes decodes n planes of PackBits rows, preceded by the byte
+// count of every row of every plane.
+func unpackPSDPlanes(data []byte, n, w, h int) ([][]byte, error) {
+    if len(data) < n*h*2 {
+        return nil, errPSDTruncated
+    }
+    counts, data := data[:n*h*2], data[n*h*2:]
+    planes := make([][]byte, n)
+    for p := range planes {
+        plane := make([]byte, w*h)
+        for y := 0; y < h; y++ {
+            count := int(binary.BigEndian.Uint16(counts[(p*h+y)*2:]))
+            if count > len(data) {
+                return nil, errPSDTruncated
+            }
+            if err := unpackBits(plane[y*w:(y+1)*w], data[:count]); err != nil {
+                return nil, err
+            }
+            data = data[count:]
+        }
+        planes[p] = plane
+    }
+    return planes, nil
+}
+
+// unpackBits fills dst from PackBits runs.
+func unpackBits(dst, src []byte) error {
+    for len(dst) > 0 {
+        if len(src) == 0 {
+            return errPSDTruncated
+        }
+        n := int(int8(src[0]))
+        src = src[1:]
+        switch {
+        case n >= 0:
+            n++
+            if n > len(src) || n > len(dst) {
+                return errors.New("PackBits literal overruns its row")
+            }
+            copy(dst, src[:n])
+            dst, src = dst[n:], src[n:]
+        case n > -128:
+            n = 1 - n
+            if len(src) == 0 || n > len(dst) {
+                return errors.New("PackBits run overruns its row")
+            }
+            for i := range dst[:n] {
+                dst[i] = src[0]
+            }
+            dst, src = dst[n:], src[1:]
+        }
+    }
+    return nil
+}
+
+// psdImage assembles planes, ordered red, green, blue and alpha with nil
+// for missing ones, into an image placed at rect.
+func psdImage(rect image.Rectangle, planes [][]byte, gray bool) *image.NRGBA {
+    img := image.NewNRGBA(rect)
+    if gray {
+        planes = [][]byte{planes[0], planes[0], planes[0], planes[3]}
+    }
+    for i := 0; i < rect.Dx()*rect.Dy(); i++ {
+        p := img.Pix[i*4 : i*4+4]
+        for c := range 4 {
+            switch {
+            case planes[c] != nil:
+                p[c] = planes[c][i]
+            case c == 3:
+                p[c] = 0xff
+            }
+        }
+    }
+    return img
+}
+
+// decodePSDMerged decodes the merged image that ends the document.
+func decodePSDMerged(data []byte, channels, w, h int, gray, alpha bool) (image.Image, error) {
+    if len(data) < 2 {
+        return nil, errors.New("PSD has no merged image")
+    }
+    method := binary.BigEndian.Uint16(data)
+    data = data[2:]
+    var planes [][]byte
+    switch method {
+    case 0:
+        if len(data) < channels*w*h {
+            return nil, errPSDTruncated
+        }
+        for c := range channels {
+            planes = append(planes, data[c*w*h:(c+1)*w*h])
+        }
+    case 1:
+        var err error
+        if planes, err = unpackPSDPlanes(data, channels, w, h); err != nil {
+            return nil, fmt.Errorf("failed to decode PSD merged image: %w", err)
+        }
+    default:
+        return nil, fmt.Errorf("unknown PSD compression %d", method)
+    }
+
+    ordered := make([][]byte, 4)
+    n := 3
+    if gray {
+        n = 1
+    }
+    copy(ordered, planes[:n])
+    if alpha && channels > n {
+        ordered[3] = planes[n]
+    }
+    return psdImage(image.Rect(0, 0, w, h), ordered, gray), nil
+}
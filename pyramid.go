@@ -0,0 +1,297 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "io"
+
+    "github.com/70ziko/NEST/tilemath"
+)
+
+// PyramidLevel is a reduced resolution copy of the main image's colors. Level
+// n has the dimensions of tilemath.Grid.Level(n). Links are not kept.
+type PyramidLevel struct {
+    Level  int
+    Width  int
+    Height int
+    // Data holds RGB samples row by row, in the header color space.
+    Data []byte
+}
+
+func (l *PyramidLevel) ToImage() *image.RGBA {
+    img := image.NewRGBA(image.Rect(0, 0, l.Width, l.Height))
+    for i := 0; i*3+2 < len(l.Data) && i*4 < len(img.Pix); i++ {
+        copy(img.Pix[i*4:i*4+3], l.Data[i*3:i*3+3])
+        img.Pix[i*4+3] = 0xff
+    }
+    return img
+}
+
+func (nif *NestedImageFile) grid() tilemath.Grid {
+    return tilemath.NewGrid(int(nif.Header.Width), int(nif.Header.Height), int(nif.Header.TileSize))
+}
+
+// BuildPyramid replaces nif.Pyramid with levels 1 and up, each half the size
+// of the one before, until a level fits in a single tile.
+func (nif *NestedImageFile) BuildPyramid() {
+    nif.BuildPyramidWithFilter(BoxFilter)
+}
+
+// BuildPyramidWithFilter is BuildPyramid with a choice of downsampling
+// filter. The filter's name is recorded in the metadata under
+// PyramidFilterKey.
+func (nif *NestedImageFile) BuildPyramidWithFilter(f ResampleFilter) {
+    grid := nif.grid()
+    nif.Pyramid = nil
+    prev := &PyramidLevel{Width: grid.Width, Height: grid.Height, Data: nif.rgbData()}
+    for n := 1; n < grid.Levels(); n++ {
+        w, h := (prev.Width+1)/2, (prev.Height+1)/2
+        nif.Pyramid = append(nif.Pyramid, PyramidLevel{
+            Level:  n,
+            Width:  w,
+            Height: h,
+            Data:   resampleRGB(prev.Data, prev.Width, prev.Height, w, h, f),
+        })
+        prev = &nif.Pyramid[len(nif.Pyramid)-1]
+    }
+    nif.pyramidSource = nif.mainTileHashes()
+    if nif.Metadata == nil {
+        nif.Metadata = Metadata{}
+    }
+    nif.Metadata[PyramidFilterKey] = f.Name()
+}
+
+// PyramidLevel returns level n, or nil when the file has no such level.
+func (nif *NestedImageFile) PyramidLevel(n int) *PyramidLevel {
+    for i := range nif.Pyramid {
+        if nif.Pyramid[i].Level == n {
+            return &nif.Pyramid[i]
+        }
+    }
+    return nil
+}
+
+func (nif *NestedImageFile) rgbData() []byte {
+    width, height := int(nif.Header.Width), int(nif.Header.Height)
+    data := make([]byte, width*height*3)
+    for y := 0; y < height && y < len(nif.MainImage); y++ {
+        for x, p := range nif.MainImage[y][:min(width, len(nif.MainImage[y]))] {
+            i := (y*width + x) * 3
+            data[i], data[i+1], data[i+2] = p.R, p.G, p.B
+        }
+    }
+    return data
+}
+
+type pyramidHeader struct {
+    Level  uint8
+    Width  uint32
+    Height uint32
+    Count  uint32
+}
+
+// Each level is stored in its own PYRM chunk:
+//
+//	pyramidHeader | Count * tile length uint32 | tiles
+//
+// Tiles are in row-major order and each is a single RGB plane framed like the
+// planes of main image tiles, padded to the full tile size.
+//
+// writeChunk writes the level as a chunk of type t. Encoded tiles past the
+// threshold of sp wait on disk until the chunk length is known. A
+// predicting codec may predict each tile from the same tile of ref, when
+// set, as focal planes are from the plane before.
+func (l *PyramidLevel) writeChunk(writer io.Writer, t ChunkType, tc *tileCodec, workers int, sp *spiller, ref *PyramidLevel) error {
+    tiles, err := l.encodeTiles(tc, workers, sp, ref)
+    if err != nil {
+        return err
+    }
+    length := int64(binary.Size(pyramidHeader{})) + 4*int64(len(tiles))
+    for _, t := range tiles {
+        length += int64(len(t.data)) + t.length
+    }
+    if err := writeChunkHeader(writer, tc.order, t, uint64(length)); err != nil {
+        return err
+    }
+    return l.writeTiles(writer, tc, tiles, sp)
+}
+
+// encodeTiles encodes the tiles of the level in row-major order, holding
+// them in sp.
+func (l *PyramidLevel) encodeTiles(tc *tileCodec, workers int, sp *spiller, ref *PyramidLevel) ([]spilled, error) {
+    grid := tilemath.NewGrid(l.Width, l.Height, tc.tileSize)
+    cols, rows := grid.Cols(), grid.Rows()
+    if len(l.Data) != l.Width*l.Height*3 {
+        return nil, fmt.Errorf("pyramid level %d has %d bytes of data, want %d", l.Level, len(l.Data), l.Width*l.Height*3)
+    }
+
+    tiles := make([]spilled, 0, cols*rows)
+    err := encodeInOrder(cols*rows, workers, sp, func(i int) ([]byte, error) {
+        // Pyramid tiles are sampled apart from main image tiles.
+        return tc.sampler.encode(i, -1, func() ([]byte, error) {
+            var buf bytes.Buffer
+            tile, class := l.tile(i%cols, i/cols, tc.tileSize), ClassUnknown
+            if tc.adaptive {
+                b := grid.TileBounds(i%cols, i/cols)
+                class = classifyTile(tile, tc.tileSize, b.Dx(), b.Dy())
+            }
+            pred := &prediction{}
+            if ref != nil {
+                pred.ref = ref.tile(i%cols, i/cols, tc.tileSize)
+            }
+            if err := tc.encodeRGB(&buf, tile, class, pred); err != nil {
+                return nil, err
+            }
+            return buf.Bytes(), nil
+        })
+    }, func(i int, data []byte) error {
+        held, err := sp.put(data)
+        tiles = append(tiles, held)
+        return err
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to encode pyramid level %d: %w", l.Level, err)
+    }
+    return tiles, nil
+}
+
+func (l *PyramidLevel) writeTiles(writer io.Writer, tc *tileCodec, tiles []spilled, sp *spiller) error {
+    hdr := pyramidHeader{Level: uint8(l.Level), Width: uint32(l.Width), Height: uint32(l.Height), Count: uint32(len(tiles))}
+    if err := binary.Write(writer, tc.order, &hdr); err != nil {
+        return fmt.Errorf("failed to write pyramid header: %w", err)
+    }
+    lengths := make([]uint32, len(tiles))
+    for i, t := range tiles {
+        lengths[i] = uint32(len(t.data)) + uint32(t.length)
+    }
+    if err := binary.Write(writer, tc.order, lengths); err != nil {
+        return fmt.Errorf("failed to write pyramid tile lengths: %w", err)
+    }
+    for i, t := range tiles {
+        data, err := sp.take(t)
+        if err != nil {
+            return err
+        }
+        if _, err := writer.Write(data); err != nil {
+            return fmt.Errorf("failed to write pyramid level %d tile %d: %w", l.Level, i, err)
+        }
+    }
+    return nil
+}
+
+func (l *PyramidLevel) tile(tx, ty, ts int) []PixeLink {
+    tile := make([]PixeLink, ts*ts)
+    for j := 0; j < ts && ty*ts+j < l.Height; j++ {
+        for i := 0; i < ts && tx*ts+i < l.Width; i++ {
+            s := ((ty*ts+j)*l.Width + tx*ts + i) * 3
+            tile[j*ts+i] = PixeLink{R: l.Data[s], G: l.Data[s+1], B: l.Data[s+2]}
+        }
+    }
+    return tile
+}
+
+// decodePyramidLevel decodes a PYRM or ZPLN chunk. ref supplies the level
+// its tiles may be predicted from, and is only called when one is.
+func decodePyramidLevel(reader io.Reader, tc *tileCodec, length uint64, budget *memoryBudget, ref func() (*PyramidLevel, error)) (PyramidLevel, error) {
+    var l PyramidLevel
+    var hdr pyramidHeader
+    if err := binary.Read(reader, tc.order, &hdr); err != nil {
+        return l, fmt.Errorf("failed to read pyramid header: %w", err)
+    }
+    grid := tilemath.NewGrid(int(hdr.Width), int(hdr.Height), tc.tileSize)
+    if tc.tileSize == 0 || int64(hdr.Count) != int64(grid.Cols())*int64(grid.Rows()) {
+        return l, fmt.Errorf("pyramid level %d lists %d tiles for a %dx%d image", hdr.Level, hdr.Count, hdr.Width, hdr.Height)
+    }
+    if uint64(binary.Size(hdr))+uint64(hdr.Count)*4 > length {
+        return l, fmt.Errorf("pyramid level %d lists %d tiles but the chunk is only %d bytes", hdr.Level, hdr.Count, length)
+    }
+    if err := budget.reserve(int64(hdr.Width)*int64(hdr.Height)*3, "pyramid level"); err != nil {
+        return l, err
+    }
+    lengths := make([]uint32, hdr.Count)
+    if err := binary.Read(reader, tc.order, lengths); err != nil {
+        return l, fmt.Errorf("failed to read pyramid tile lengths: %w", err)
+    }
+
+    l = PyramidLevel{Level: int(hdr.Level), Width: int(hdr.Width), Height: int(hdr.Height)}
+    l.Data = make([]byte, l.Width*l.Height*3)
+    ts := tc.tileSize
+    tile := make([]PixeLink, ts*ts)
+    cols := grid.Cols()
+    for i := range lengths {
+        if err := budget.check(); err != nil {
+            return l, err
+        }
+        if err := tc.decodeRGB(reader, tile, levelSource(i%cols, i/cols, ts, ref)); err != nil {
+            return l, fmt.Errorf("failed to decode pyramid level %d tile %d: %w", l.Level, i, err)
+        }
+        tx, ty := i%cols, i/cols
+        for j := 0; j < ts && ty*ts+j < l.Height; j++ {
+            for k := 0; k < ts && tx*ts+k < l.Width; k++ {
+                p := tile[j*ts+k]
+                d := ((ty*ts+j)*l.Width + tx*ts + k) * 3
+                l.Data[d], l.Data[d+1], l.Data[d+2] = p.R, p.G, p.B
+            }
+        }
+    }
+    return l, nil
+}
+
+func (nif *NestedImageFile) writePyramid(writer io.Writer, tc *tileCodec, workers int, sp *spiller) error {
+    for i := range nif.Pyramid {
+        if err := nif.Pyramid[i].writeChunk(writer, ChunkPyramid, tc, workers, sp, nil); err != nil {
+            return err
+        }
+    }
+    return nif.writePyramidSource(writer, tc.order)
+}
+
+// PyramidLevels lists the levels stored in the file, reading one byte of each
+// PYRM chunk.
+func (nr *Reader) PyramidLevels() ([]int, error) {
+    var levels []int
+    var b [1]byte
+    err := nr.walkChunks(func(t ChunkType, offset int64, length uint64) (bool, error) {
+        if t != ChunkPyramid || length == 0 {
+            return true, nil
+        }
+        if _, err := nr.r.ReadAt(b[:], offset); err != nil {
+            return false, fmt.Errorf("failed to read pyramid level: %w", err)
+        }
+        levels = append(levels, int(b[0]))
+        return true, nil
+    })
+    return levels, err
+}
+
+// ReadPyramidLevel decodes level n without touching the main image.
+func (nr *Reader) ReadPyramidLevel(n int) (*PyramidLevel, error) {
+    var level *PyramidLevel
+    var b [1]byte
+    err := nr.walkChunks(func(t ChunkType, offset int64, length uint64) (bool, error) {
+        if t != ChunkPyramid || length == 0 {
+            return true, nil
+        }
+        if _, err := nr.r.ReadAt(b[:], offset); err != nil {
+            return false, fmt.Errorf("failed to read pyramid level: %w", err)
+        }
+        if int(b[0]) != n {
+            return true, nil
+        }
+        l, err := decodePyramidLevel(io.NewSectionReader(nr.r, offset, int64(length)), nr.codec(), length, nil, nil)
+        if err != nil {
+            return false, err
+        }
+        level = &l
+        return false, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if level == nil {
+        return nil, fmt.Errorf("file has no pyramid level %d", n)
+    }
+    return level, nil
+}
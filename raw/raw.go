@@ -0,0 +1,280 @@
+// Package raw imports camera raw files, such as DNG, CR2 and NEF, by
+// developing them with dcraw or a program taking the same options. The
+// developed image keeps 16 bits per channel, for ImportOptions.HighBitDepth,
+// and the capture settings dcraw reports become metadata.
+//
+// Register adds the importer to the nest package's registry:
+//
+//	raw.Register(raw.Options{Quality: raw.AHD})
+//	li, err := nest.ImportFile("IMG_0001.CR2")
+package raw
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// DefaultTool is the program Decode runs when Options.Tool is empty.
+const DefaultTool = "dcraw"
+
+// Extensions lists the raw formats Register adds.
+var Extensions = []string{".dng", ".cr2", ".cr3", ".crw", ".nef", ".nrw", ".arw", ".orf", ".raf", ".rw2", ".pef", ".srw"}
+
+// Quality selects the demosaicing algorithm, trading speed for detail.
+type Quality int
+
+const (
+    // AHD is adaptive homogeneity-directed interpolation, the slowest and
+    // sharpest.
+    AHD Quality = iota
+    // PPG is patterned pixel grouping.
+    PPG
+    // VNG is variable number of gradients.
+    VNG
+    // Bilinear is the fastest.
+    Bilinear
+)
+
+func (q Quality) String() string {
+    switch q {
+    case AHD:
+        return "ahd"
+    case PPG:
+        return "ppg"
+    case VNG:
+        return "vng"
+    case Bilinear:
+        return "bilinear"
+    }
+    return "unknown"
+}
+
+func ParseQuality(s string) (Quality, error) {
+    for _, q := range []Quality{AHD, PPG, VNG, Bilinear} {
+        if q.String() == s {
+            return q, nil
+        }
+    }
+    return AHD, fmt.Errorf("unknown demosaic quality %q", s)
+}
+
+// dcrawQuality is the value of dcraw's -q option for q.
+func (q Quality) dcrawQuality() int {
+    switch q {
+    case Bilinear:
+        return 0
+    case VNG:
+        return 1
+    case PPG:
+        return 2
+    }
+    return 3
+}
+
+type Options struct {
+    // Tool is the dcraw-compatible program to run. Empty selects
+    // DefaultTool, looked up on PATH.
+    Tool    string
+    Quality Quality
+    // Timeout bounds each run of Tool. Zero means no limit.
+    Timeout time.Duration
+}
+
+func (opts Options) tool() string {
+    if opts.Tool != "" {
+        return opts.Tool
+    }
+    return DefaultTool
+}
+
+// ErrNoTool is returned when the raw development program can't be found.
+var ErrNoTool = errors.New("raw development program not found")
+
+// Register makes nest.ImportFile, and so the nest tool, develop files with
+// the extensions in Extensions with opts. Registering again replaces the
+// options.
+func Register(opts Options) {
+    for _, ext := range Extensions {
+        nest.RegisterImporter(ext, func(r io.ReaderAt, size int64) (*nest.LayeredImage, error) {
+            return DecodeReader(r, size, opts)
+        })
+    }
+}
+
+// DecodeReader develops the raw file in r. dcraw reads files by name, so
+// unless r is an *os.File it is copied to a temporary file first.
+func DecodeReader(r io.ReaderAt, size int64, opts Options) (*nest.LayeredImage, error) {
+    if f, ok := r.(*os.File); ok {
+        return Decode(f.Name(), opts)
+    }
+    tmp, err := os.CreateTemp("", "nest-raw-*")
+    if err != nil {
+        return nil, err
+    }
+    defer os.Remove(tmp.Name())
+    _, err = io.Copy(tmp, io.NewSectionReader(r, 0, size))
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to copy raw file: %w", err)
+    }
+    return Decode(tmp.Name(), opts)
+}
+
+// Decode develops the raw file at path with the camera's white balance
+// into a 16-bit sRGB image, and reads its capture settings.
+func Decode(path string, opts Options) (*nest.LayeredImage, error) {
+    tool, err := exec.LookPath(opts.tool())
+    if err != nil {
+        return nil, fmt.Errorf("%w: %w", ErrNoTool, err)
+    }
+    info, err := run(tool, opts.Timeout, "-i", "-v", path)
+    if err != nil {
+        return nil, err
+    }
+    ppm, err := run(tool, opts.Timeout, "-c", "-w", "-6", "-q", fmt.Sprint(opts.Quality.dcrawQuality()), path)
+    if err != nil {
+        return nil, err
+    }
+    img, err := decodePPM(ppm)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read developed image: %w", err)
+    }
+    li := nest.SingleLayer(img)
+    li.Metadata = parseInfo(info)
+    return li, nil
+}
+
+func run(tool string, timeout time.Duration, args ...string) ([]byte, error) {
+    ctx := context.Background()
+    if timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
+    }
+    var stderr bytes.Buffer
+    cmd := exec.CommandContext(ctx, tool, args...)
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    if err != nil {
+        if msg := strings.TrimSpace(stderr.String()); msg != "" {
+            return nil, fmt.Errorf("%s: %w: %s", tool, err, msg)
+        }
+        return nil, fmt.Errorf("%s: %w", tool, err)
+    }
+    return out, nil
+}
+
+// infoKeys maps the lines of dcraw -i -v to metadata keys.
+var infoKeys = map[string]string{
+    "Camera":       "camera",
+    "Owner":        "owner",
+    "ISO speed":    "iso",
+    "Shutter":      "exposure-time",
+    "Aperture":     "aperture",
+    "Focal length": "focal-length",
+}
+
+// parseInfo reads the capture settings from dcraw -i -v output such as
+//
+//	Timestamp: Sat Jun  1 10:32:00 2024
+//	Camera: Canon EOS 5D Mark II
+//	ISO speed: 100
+//	Shutter: 1/200.0 sec
+func parseInfo(info []byte) nest.Metadata {
+    m := nest.Metadata{}
+    scanner := bufio.NewScanner(bytes.NewReader(info))
+    for scanner.Scan() {
+        name, value, ok := strings.Cut(scanner.Text(), ":")
+        value = strings.TrimSpace(value)
+        if !ok || value == "" {
+            continue
+        }
+        if name == "Timestamp" {
+            // dcraw prints the camera clock without a zone, recorded
+            // here as UTC.
+            if t, err := time.Parse(time.ANSIC, value); err == nil {
+                m[nest.CaptureTimeKey] = t.Format(time.RFC3339)
+            }
+            continue
+        }
+        if key := infoKeys[name]; key != "" {
+            m[key] = strings.TrimSuffix(value, " sec")
+        }
+    }
+    return m
+}
+
+// decodePPM reads the binary PPM dcraw writes, with 8 or 16-bit samples.
+func decodePPM(data []byte) (image.Image, error) {
+    var fields [4]int
+    rest := data
+    for i := range fields {
+        // Skip whitespace and comments before each header field.
+        for {
+            rest = bytes.TrimLeft(rest, " \t\r\n")
+            if len(rest) == 0 || rest[0] != '#' {
+                break
+            }
+            if end := bytes.IndexByte(rest, '\n'); end >= 0 {
+                rest = rest[end:]
+            } else {
+                rest = nil
+            }
+        }
+        end := bytes.IndexAny(rest, " \t\r\n")
+        if end < 0 {
+            return nil, errors.New("PPM header is truncated")
+        }
+        field := string(rest[:end])
+        rest = rest[end+1:]
+        if i == 0 {
+            if field != "P6" {
+                return nil, fmt.Errorf("not a binary PPM: %q", field)
+            }
+            continue
+        }
+        if _, err := fmt.Sscan(field, &fields[i]); err != nil || fields[i] <= 0 {
+            return nil, fmt.Errorf("bad PPM header field %q", field)
+        }
+    }
+    w, h, maxval := fields[1], fields[2], fields[3]
+    if maxval > 0xffff {
+        return nil, fmt.Errorf("PPM maximum %d is out of range", maxval)
+    }
+    bytesPerSample := 1
+    if maxval > 0xff {
+        bytesPerSample = 2
+    }
+    if len(rest)/(3*bytesPerSample)/w < h {
+        return nil, errors.New("PPM data is truncated")
+    }
+    img := image.NewRGBA64(image.Rect(0, 0, w, h))
+    for i := 0; i < w*h; i++ {
+        for c := 0; c < 3; c++ {
+            var v uint32
+            if bytesPerSample == 2 {
+                v = uint32(rest[0])<<8 | uint32(rest[1])
+            } else {
+                v = uint32(rest[0])
+            }
+            rest = rest[bytesPerSample:]
+            // Scale to the full 16-bit range.
+            img.Pix[i*8+c*2], img.Pix[i*8+c*2+1] = uint8(v*0xffff/uint32(maxval)>>8), uint8(v*0xffff/uint32(maxval))
+        }
+        img.Pix[i*8+6], img.Pix[i*8+7] = 0xff, 0xff
+    }
+    return img, nil
+}
@@ -0,0 +1,536 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "runtime/debug"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/70ziko/NEST/tilemath"
+)
+
+type ByteRange struct {
+    Offset int64
+    Length int64
+}
+
+// Reader gives random access to the tiles of a file through an io.ReaderAt,
+// so regions can be read without decoding the whole main image.
+type Reader struct {
+    Header FileHeader
+    Index  *TileIndex
+
+    r            io.ReaderAt
+    size         int64
+    order        binary.ByteOrder
+    tilesOffset  int64
+    chunksOffset int64
+    parity       *eccIndex
+    updated      []time.Time
+    adjustments  *Adjustments
+    canvas       *Canvas
+    ttl          time.Duration
+    dictionary   *Dictionary
+    predicted    predictionCache
+    trailer      *Trailer
+    // trailerOffset is where the TRLR chunk starts.
+    trailerOffset int64
+}
+
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+    return newReader(r, size, nil)
+}
+
+// newReader is NewReader charging the tile index to budget.
+func newReader(r io.ReaderAt, size int64, budget *memoryBudget) (*Reader, error) {
+    nr, indexOffset, err := openReader(r, size)
+    if err != nil {
+        return nil, err
+    }
+    if err := nr.loadIndex(indexOffset, budget); err != nil {
+        return nil, err
+    }
+    if err := nr.loadChecksums(); err != nil {
+        return nil, err
+    }
+    if err := nr.loadStats(); err != nil {
+        return nil, err
+    }
+    if err := nr.loadClasses(); err != nil {
+        return nil, err
+    }
+    if err := nr.loadTileTimes(); err != nil {
+        return nil, err
+    }
+    if err := nr.loadAdjustments(); err != nil {
+        return nil, err
+    }
+    if err := nr.loadCanvas(); err != nil {
+        return nil, err
+    }
+    if err := nr.loadTrailer(); err != nil {
+        return nil, err
+    }
+    if nr.Index.HasChecksums {
+        if err := nr.loadParity(); err != nil {
+            return nil, err
+        }
+    }
+    return nr, nil
+}
+
+// openReader reads the header and finds the chunk section, returning the
+// offset of the tile index as locateChunks does. Nothing else is loaded.
+func openReader(r io.ReaderAt, size int64) (*Reader, int64, error) {
+    sr := io.NewSectionReader(r, 0, size)
+    nr := &Reader{r: r, size: size}
+    var err error
+    if nr.dictionary, err = nr.Header.read(sr); err != nil {
+        return nil, 0, fmt.Errorf("failed to read header: %w", err)
+    }
+    nr.order = nr.Header.ByteOrder.order()
+    nr.tilesOffset, _ = sr.Seek(0, io.SeekCurrent)
+
+    indexOffset, err := nr.locateChunks()
+    if err != nil {
+        return nil, 0, err
+    }
+    return nr, indexOffset, nil
+}
+
+// loadIndex decodes the tile index at indexOffset, or scans the tiles of
+// files without one, unless locateChunks already has. It checks the entries
+// against the file and builds the coordinate lookup under budget now, so
+// concurrent tile reads don't race on it.
+func (nr *Reader) loadIndex(indexOffset int64, budget *memoryBudget) error {
+    if err := nr.checkGrid(); err != nil {
+        return err
+    }
+    if indexOffset >= 0 {
+        cr := io.NewSectionReader(nr.r, indexOffset, nr.size-indexOffset)
+        t, length, err := readChunkHeader(cr, nr.order)
+        if err != nil {
+            return fmt.Errorf("failed to read tile index: %w", err)
+        }
+        if t != ChunkIndex {
+            return fmt.Errorf("expected %s chunk at offset %d, found %s", ChunkIndex, indexOffset, t)
+        }
+        cols, rows := tileGrid(nr.Header.Width, nr.Header.Height, nr.Header.TileSize)
+        if nr.Index, err = decodeTileIndex(cr, nr.order, length, cols, rows); err != nil {
+            return err
+        }
+    } else if nr.Index == nil {
+        var err error
+        if nr.Index, err = nr.scanTiles(); err != nil {
+            return err
+        }
+    }
+    if err := nr.Index.check(nr.size, nr.maxTileLength()); err != nil {
+        return err
+    }
+    return nr.Index.buildLookup(budget)
+}
+
+// checkGrid rejects headers declaring more tiles than the file could hold,
+// which bounds the index and lookup built for the grid by the file size.
+func (nr *Reader) checkGrid() error {
+    cols, rows := tileGrid(nr.Header.Width, nr.Header.Height, nr.Header.TileSize)
+    if cols == 0 || rows == 0 {
+        return nil
+    }
+    minLength := int64(2 * planeHeaderSize)
+    if nr.Header.Version < 5 {
+        minLength = nr.maxTileLength()
+    }
+    if int64(cols)*int64(rows) > (nr.size-nr.tilesOffset)/minLength {
+        return fmt.Errorf("file is too short for a %dx%d tile grid", cols, rows)
+    }
+    return nil
+}
+
+func (nr *Reader) maxTileLength() int64 {
+    return nr.Header.maxTileLength()
+}
+
+// locateChunks finds the start of the chunk section and the tile index,
+// using the trailing TAIL chunk when present and walking the file otherwise.
+// It returns -1 when the file has no tile index.
+func (nr *Reader) locateChunks() (int64, error) {
+    if nr.Header.Version < 2 {
+        nr.chunksOffset = nr.size
+        return -1, nil
+    }
+
+    if nr.size >= tailChunkSize {
+        buf := make([]byte, tailChunkSize)
+        if _, err := nr.r.ReadAt(buf, nr.size-tailChunkSize); err != nil {
+            return -1, fmt.Errorf("failed to read tail chunk: %w", err)
+        }
+        if tail, ok := decodeTail(buf, nr.order); ok {
+            nr.chunksOffset = tail.ChunksOffset
+            return tail.IndexOffset, nil
+        }
+    }
+
+    var err error
+    if nr.Index, err = nr.scanTiles(); err != nil {
+        return -1, err
+    }
+    offset := nr.tilesEnd()
+    var dims [4]byte
+    for i := 0; i < int(nr.Header.NestedCount); i++ {
+        if _, err := nr.r.ReadAt(dims[:], offset); err != nil {
+            return -1, fmt.Errorf("failed to read nested image %d: %w", i, err)
+        }
+        w, h := nr.order.Uint16(dims[0:2]), nr.order.Uint16(dims[2:4])
+        offset += 4 + int64(w)*int64(h)*3
+    }
+    nr.chunksOffset = offset
+
+    var hdr [chunkHeaderSize]byte
+    for offset+chunkHeaderSize <= nr.size {
+        if _, err := nr.r.ReadAt(hdr[:], offset); err != nil {
+            return -1, fmt.Errorf("failed to read chunk at offset %d: %w", offset, err)
+        }
+        t, length, err := readChunkHeader(bytes.NewReader(hdr[:]), nr.order)
+        if err != nil {
+            return -1, err
+        }
+        if t == ChunkIndex {
+            return offset, nil
+        }
+        if length > uint64(nr.size-offset-chunkHeaderSize) {
+            return -1, fmt.Errorf("%s chunk at offset %d extends past the end of the file", t, offset)
+        }
+        offset += chunkHeaderSize + int64(length)
+    }
+    return -1, nil
+}
+
+// scanTiles reconstructs tile offsets for files written without an index by
+// walking the tile records.
+func (nr *Reader) scanTiles() (*TileIndex, error) {
+    if err := nr.checkGrid(); err != nil {
+        return nil, err
+    }
+    ts := int64(nr.Header.TileSize)
+    cols, rows := tileGrid(nr.Header.Width, nr.Header.Height, nr.Header.TileSize)
+    index := &TileIndex{Order: nr.Header.TileOrder, Cols: cols, Rows: rows}
+    offset := nr.tilesOffset
+    for _, tc := range tileSequence(nr.Header.TileOrder, cols, rows) {
+        length := ts * ts * pixeLinkDiskSize
+        if nr.Header.Version >= 5 {
+            var err error
+            if length, err = nr.tileRecordLength(offset); err != nil {
+                return nil, fmt.Errorf("failed to scan tile (%d, %d): %w", tc.X, tc.Y, err)
+            }
+        }
+        index.Entries = append(index.Entries, TileIndexEntry{Tile: tc, Offset: offset, Length: length})
+        offset += length
+    }
+    return index, nil
+}
+
+func (nr *Reader) tileRecordLength(offset int64) (int64, error) {
+    var hdr [planeHeaderSize]byte
+    length := int64(0)
+    for plane := 0; plane < 2; plane++ {
+        if _, err := nr.r.ReadAt(hdr[:], offset+length); err != nil {
+            return 0, err
+        }
+        length += planeHeaderSize + int64(nr.order.Uint32(hdr[1:]))
+    }
+    return length, nil
+}
+
+func (nr *Reader) codec() *tileCodec {
+    return nr.Header.tileCodec(nr.dictionary)
+}
+
+func (nr *Reader) Grid() tilemath.Grid {
+    return tilemath.NewGrid(int(nr.Header.Width), int(nr.Header.Height), int(nr.Header.TileSize))
+}
+
+func (nr *Reader) Bounds() image.Rectangle {
+    return nr.Grid().Bounds()
+}
+
+func (nr *Reader) tilesIn(rect image.Rectangle) []TileIndexEntry {
+    tiles := nr.Grid().TileRange(rect)
+    var entries []TileIndexEntry
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            if e, ok := nr.Index.Lookup(tx, ty); ok {
+                entries = append(entries, e)
+            }
+        }
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+    return entries
+}
+
+// RegionRanges returns the byte ranges needed to decode rect, with adjacent
+// tiles merged so each range can be fetched with a single read.
+func (nr *Reader) RegionRanges(rect image.Rectangle) []ByteRange {
+    var ranges []ByteRange
+    for _, e := range nr.tilesIn(rect) {
+        if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == e.Offset {
+            ranges[n-1].Length += e.Length
+            continue
+        }
+        ranges = append(ranges, ByteRange{Offset: e.Offset, Length: e.Length})
+    }
+    return ranges
+}
+
+func (nr *Reader) ReadTile(x, y int) ([]PixeLink, error) {
+    e, ok := nr.Index.Lookup(x, y)
+    if !ok {
+        return nil, fmt.Errorf("tile (%d, %d) is not in the index", x, y)
+    }
+    buf := make([]byte, e.Length)
+    if _, err := nr.r.ReadAt(buf, e.Offset); err != nil {
+        return nil, fmt.Errorf("failed to read tile (%d, %d): %w", x, y, err)
+    }
+    buf, err := nr.checkTile(e, buf)
+    if err != nil {
+        return nil, err
+    }
+    return nr.decodeTile(TileCoord{x, y}, buf)
+}
+
+// decodeTile decodes the stored bytes of tile t, reading the tiles it is
+// predicted from when it is.
+func (nr *Reader) decodeTile(t TileCoord, buf []byte) ([]PixeLink, error) {
+    ts := int(nr.Header.TileSize)
+    tile := make([]PixeLink, ts*ts)
+    if nr.Header.Version >= 5 {
+        if err := nr.codec().decode(bytes.NewReader(buf), tile, nr.neighborSource(t)); err != nil {
+            return nil, err
+        }
+        return tile, nil
+    }
+    if err := binary.Read(bytes.NewReader(buf), nr.order, &tile); err != nil {
+        return nil, err
+    }
+    return tile, nil
+}
+
+// ReadRegion decodes the pixels inside rect, clipped to the image bounds.
+func (nr *Reader) ReadRegion(rect image.Rectangle) ([][]PixeLink, error) {
+    rect = rect.Intersect(nr.Bounds())
+    if rect.Empty() {
+        return nil, errors.New("region does not overlap the image")
+    }
+    region := pixelRows(rect.Dx(), rect.Dy())
+    err := nr.regionTiles(rect, func(x, y int, p PixeLink) {
+        region[y-rect.Min.Y][x-rect.Min.X] = p
+    })
+    if err != nil {
+        return nil, err
+    }
+    return region, nil
+}
+
+// regionTiles decodes the tiles under rect one at a time, calling set for
+// each of their pixels inside rect.
+func (nr *Reader) regionTiles(rect image.Rectangle, set func(x, y int, p PixeLink)) error {
+    ts := int(nr.Header.TileSize)
+    grid := nr.Grid()
+    entries := nr.tilesIn(rect)
+    for _, br := range nr.RegionRanges(rect) {
+        buf := make([]byte, br.Length)
+        if _, err := nr.r.ReadAt(buf, br.Offset); err != nil {
+            return fmt.Errorf("failed to read bytes %d-%d: %w", br.Offset, br.Offset+br.Length, err)
+        }
+        for _, e := range entries {
+            if e.Offset < br.Offset || e.Offset+e.Length > br.Offset+br.Length {
+                continue
+            }
+            data, err := nr.checkTile(e, buf[e.Offset-br.Offset:e.Offset-br.Offset+e.Length])
+            if err != nil {
+                return err
+            }
+            tile, err := nr.decodeTile(e.Tile, data)
+            if err != nil {
+                return fmt.Errorf("failed to decode tile (%d, %d): %w", e.Tile.X, e.Tile.Y, err)
+            }
+            tileRect := grid.TileBounds(e.Tile.X, e.Tile.Y).Intersect(rect)
+            for y := tileRect.Min.Y; y < tileRect.Max.Y; y++ {
+                for x := tileRect.Min.X; x < tileRect.Max.X; x++ {
+                    set(x, y, tile[(y-e.Tile.Y*ts)*ts+(x-e.Tile.X*ts)])
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// ReadRegionImage is ReadRegion rendered as sRGB with the display
+// adjustments applied. Unlike NestedImageFile.ToImage it stays in stored
+// coordinates; ReadOrientedRegion also applies the orientation. The image
+// bounds start at rect.Min after clipping.
+func (nr *Reader) ReadRegionImage(rect image.Rectangle) (*image.RGBA, error) {
+    img, err := nr.ReadRegionAs(rect, FormatRGBA)
+    if err != nil {
+        return nil, err
+    }
+    rgba := img.(*image.RGBA)
+    nr.adjustments.apply(rgba)
+    return rgba, nil
+}
+
+// walkChunks calls visit with the type, payload offset and length of each
+// chunk until visit returns false or the TAIL chunk is reached.
+func (nr *Reader) walkChunks(visit func(t ChunkType, offset int64, length uint64) (bool, error)) error {
+    var hdr [chunkHeaderSize]byte
+    for offset := nr.chunksOffset; offset+chunkHeaderSize <= nr.size; {
+        if _, err := nr.r.ReadAt(hdr[:], offset); err != nil {
+            return fmt.Errorf("failed to read chunk at offset %d: %w", offset, err)
+        }
+        t, length, err := readChunkHeader(bytes.NewReader(hdr[:]), nr.order)
+        if err != nil {
+            return err
+        }
+        if t == ChunkTail {
+            return nil
+        }
+        if length > uint64(nr.size-offset-chunkHeaderSize) {
+            return fmt.Errorf("%s chunk at offset %d extends past the end of the file", t, offset)
+        }
+        more, err := visit(t, offset+chunkHeaderSize, length)
+        if err != nil || !more {
+            return err
+        }
+        offset += chunkHeaderSize + int64(length)
+    }
+    return nil
+}
+
+// findChunk returns the payload offset and length of the first chunk of
+// type t.
+func (nr *Reader) findChunk(t ChunkType) (int64, uint64, bool, error) {
+    var offset int64
+    var length uint64
+    found := false
+    err := nr.walkChunks(func(ct ChunkType, o int64, l uint64) (bool, error) {
+        if ct == t {
+            offset, length, found = o, l, true
+        }
+        return !found, nil
+    })
+    return offset, length, found, err
+}
+
+// tilesEnd returns the offset just past the tile data, where the nested
+// images begin.
+func (nr *Reader) tilesEnd() int64 {
+    end := nr.tilesOffset
+    for _, e := range nr.Index.Entries {
+        if e.Offset+e.Length > end {
+            end = e.Offset + e.Length
+        }
+    }
+    return end
+}
+
+// decodeTiles fills dst with every tile in the index using a bounded pool of
+// workers. Tiles cover disjoint pixels, so workers write to dst directly.
+func (nr *Reader) decodeTiles(dst [][]PixeLink, workers int, budget *memoryBudget) error {
+    ts := int(nr.Header.TileSize)
+    if workers < 1 {
+        workers = 1
+    }
+    if n := len(nr.Index.Entries); workers > n {
+        workers = n
+    }
+    // Each worker holds a decoded tile and a read buffer that grows up to
+    // the largest stored tile.
+    if err := budget.reserve(int64(workers)*(int64(ts)*int64(ts)*pixeLinkSize+nr.maxTileLength()), "tile buffers"); err != nil {
+        return err
+    }
+
+    decode := func(e TileIndexEntry, buf []byte) ([]byte, error) {
+        if err := budget.check(); err != nil {
+            return buf, err
+        }
+        if int64(len(buf)) < e.Length {
+            buf = make([]byte, e.Length)
+        }
+        if _, err := nr.r.ReadAt(buf[:e.Length], e.Offset); err != nil {
+            return buf, fmt.Errorf("failed to read tile at (%d, %d): %w", e.Tile.X*ts, e.Tile.Y*ts, err)
+        }
+        data, err := nr.checkTile(e, buf[:e.Length])
+        if err != nil {
+            return buf, err
+        }
+        tile, err := nr.decodeTile(e.Tile, data)
+        if err != nil {
+            return buf, fmt.Errorf("failed to decode tile at (%d, %d): %w", e.Tile.X*ts, e.Tile.Y*ts, err)
+        }
+        fillTile(dst, tile, e.Tile.X*ts, e.Tile.Y*ts, ts)
+        return buf, nil
+    }
+
+    // A single worker decodes in the calling goroutine, where callers can
+    // recover from a panic.
+    if workers == 1 {
+        buf := make([]byte, ts*ts*pixeLinkDiskSize)
+        for _, e := range nr.Index.Entries {
+            var err error
+            if buf, err = decode(e, buf); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+
+    jobs := make(chan TileIndexEntry)
+    done := make(chan struct{})
+    var wg sync.WaitGroup
+    var once sync.Once
+    var firstErr error
+    fail := func(err error) {
+        once.Do(func() {
+            firstErr = err
+            close(done)
+        })
+    }
+
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            defer func() {
+                if v := recover(); v != nil {
+                    fail(&DecodePanicError{Value: v, Stack: debug.Stack()})
+                }
+            }()
+            buf := make([]byte, ts*ts*pixeLinkDiskSize)
+            for e := range jobs {
+                var err error
+                if buf, err = decode(e, buf); err != nil {
+                    fail(err)
+                }
+            }
+        }()
+    }
+
+feed:
+    for _, e := range nr.Index.Entries {
+        select {
+        case jobs <- e:
+        case <-done:
+            break feed
+        }
+    }
+    close(jobs)
+    wg.Wait()
+    return firstErr
+}
@@ -0,0 +1,342 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "math"
+
+    "github.com/70ziko/NEST/colorspace"
+)
+
+// RedactMode selects how Redact destroys the pixels of a region.
+type RedactMode int
+
+const (
+    // RedactBlur averages the region over blocks a quarter of its shorter
+    // side, and at least 8 pixels, wide and then blurs the blocks together,
+    // leaving an outline of colors but no faces or text to recover.
+    RedactBlur RedactMode = iota
+    // RedactBlackout paints the region black, and band samples zero.
+    RedactBlackout
+)
+
+func (m RedactMode) String() string {
+    switch m {
+    case RedactBlur:
+        return "blur"
+    case RedactBlackout:
+        return "blackout"
+    }
+    return "unknown"
+}
+
+func ParseRedactMode(s string) (RedactMode, error) {
+    for _, m := range []RedactMode{RedactBlur, RedactBlackout} {
+        if m.String() == s {
+            return m, nil
+        }
+    }
+    return RedactBlur, fmt.Errorf("unknown redaction mode %q", s)
+}
+
+// minRedactBlock is the smallest block RedactBlur averages over.
+const minRedactBlock = 8
+
+// Redact irreversibly overwrites regions of the main image, in stored
+// pixels, with mode, rather than covering them: the same pixels of every
+// focal plane and band are overwritten too, and pyramid levels rebuilt from
+// the result. Nested images placed at a known position, as layers and
+// templates are, have the part under the regions redacted, and those with
+// RoleThumbnail or RoleAlternateResolution, which show the whole main image
+// at another size, have the regions scaled to them redacted. Other nested
+// images linked from pixels in the regions are redacted whole. Every
+// redacted nested image loses its content, whose source may show what it
+// does. Recognized words from
+// AddWords in the regions are removed from the annotation layer, since
+// their text is what the pixels showed. Links are kept.
+//
+// Writing the file afterwards leaves none of the original pixels in it. The
+// change is recorded in the audit log as AuditRedact.
+func (nif *NestedImageFile) Redact(regions []image.Rectangle, mode RedactMode) error {
+    if mode != RedactBlur && mode != RedactBlackout {
+        return fmt.Errorf("unknown redaction mode %d", mode)
+    }
+    bounds := nif.Bounds()
+    var clipped []image.Rectangle
+    for _, r := range regions {
+        if r = r.Canon().Intersect(bounds); !r.Empty() {
+            clipped = append(clipped, r)
+        }
+    }
+    if len(clipped) == 0 {
+        return errors.New("no region to redact overlaps the main image")
+    }
+
+    black := [3]float64{}
+    if space := nif.Header.ColorSpace; space != colorspace.SRGB {
+        r, g, b := colorspace.Convert8(0, 0, 0, colorspace.SRGB, space)
+        black = [3]float64{float64(r), float64(g), float64(b)}
+    }
+    main := redactTarget{
+        width: bounds.Dx(), height: bounds.Dy(), channels: 3, fill: black[:],
+        get: func(x, y, c int) float64 {
+            return float64(*pixelChannel(&nif.MainImage[y][x], c))
+        },
+        set: func(x, y, c int, v float64) {
+            *pixelChannel(&nif.MainImage[y][x], c) = clampByte(v)
+        },
+    }
+    for i := range nif.Planes {
+        p := &nif.Planes[i]
+        redactRegions(rgbTarget(p.Data, p.Width, p.Height, black[:]), clipped, mode)
+    }
+    for i := range nif.Bands {
+        redactRegions(bandTarget(nif.Bands[i].Samples, bounds.Dx(), bounds.Dy()), clipped, mode)
+    }
+
+    // Placed nested images have origins on the main image; linked ones are
+    // only known to show something about the pixels linking to them.
+    linked := map[int]bool{}
+    if nif.Header.Payload == PayloadLink {
+        for _, r := range clipped {
+            for y := r.Min.Y; y < r.Max.Y; y++ {
+                for _, p := range nif.MainImage[y][r.Min.X:r.Max.X] {
+                    if p.NestedIdx != 0 && int(p.NestedIdx) <= len(nif.NestedImages) {
+                        linked[int(p.NestedIdx)-1] = true
+                    }
+                }
+            }
+        }
+    }
+    placed := map[int][]image.Point{}
+    for _, l := range nif.Layers {
+        if l.Nested != 0 {
+            placed[int(l.Nested)-1] = append(placed[int(l.Nested)-1], l.Rect.Min)
+        }
+    }
+    for _, t := range nif.Templates {
+        if t.Nested != 0 {
+            placed[int(t.Nested)-1] = append(placed[int(t.Nested)-1], t.Placements...)
+        }
+    }
+
+    redactRegions(main, clipped, mode)
+    redacted := 0
+    for i := range nif.NestedImages {
+        ni := &nif.NestedImages[i]
+        target := rgbTarget(ni.Data, int(ni.Width), int(ni.Height), make([]float64, 3))
+        if origins, ok := placed[i]; ok {
+            hit := false
+            for _, o := range origins {
+                var local []image.Rectangle
+                for _, r := range clipped {
+                    if l := r.Sub(o).Intersect(image.Rect(0, 0, int(ni.Width), int(ni.Height))); !l.Empty() {
+                        local = append(local, l)
+                    }
+                }
+                if len(local) > 0 {
+                    redactRegions(target, local, mode)
+                    hit = true
+                }
+            }
+            if hit {
+                ni.Content = nil
+                redacted++
+            }
+            continue
+        }
+        if ni.Role == RoleThumbnail || ni.Role == RoleAlternateResolution {
+            var scaled []image.Rectangle
+            for _, r := range clipped {
+                scaled = append(scaled, scaleRect(r, bounds.Dx(), bounds.Dy(), int(ni.Width), int(ni.Height)))
+            }
+            redactRegions(target, scaled, mode)
+            ni.Content = nil
+            redacted++
+            continue
+        }
+        if linked[i] {
+            redactRegions(target, []image.Rectangle{image.Rect(0, 0, int(ni.Width), int(ni.Height))}, mode)
+            ni.Content = nil
+            redacted++
+        }
+    }
+
+    var words []string
+    for _, a := range nif.Annotations {
+        if _, ok := wordNumber(a.ID); !ok {
+            continue
+        }
+        for _, r := range clipped {
+            if a.Rect.Overlaps(r) {
+                words = append(words, a.ID)
+                break
+            }
+        }
+    }
+    for _, id := range words {
+        nif.RemoveAnnotation(id)
+    }
+
+    if len(nif.Pyramid) > 0 {
+        if _, err := nif.RebuildPyramid(); err != nil {
+            return fmt.Errorf("failed to rebuild the pyramid: %w", err)
+        }
+    }
+    nif.audit(AuditRedact, fmt.Sprintf("%s, %d nested images", mode, redacted), clipped...)
+    return nil
+}
+
+// scaleRect maps r on a w by h image onto the same image scaled to tw by th,
+// rounding outward so the result covers every pixel r touches.
+func scaleRect(r image.Rectangle, w, h, tw, th int) image.Rectangle {
+    return image.Rect(
+        r.Min.X*tw/w, r.Min.Y*th/h,
+        (r.Max.X*tw+w-1)/w, (r.Max.Y*th+h-1)/h,
+    )
+}
+
+// redactTarget is an image Redact overwrites through get and set, with
+// samples of channels values from 0 to 255, or 65535 for bands.
+type redactTarget struct {
+    width, height, channels int
+    // fill is the blackout color.
+    fill []float64
+    get  func(x, y, c int) float64
+    set  func(x, y, c int, v float64)
+}
+
+// rgbTarget is a buffer of RGB samples row by row, as focal planes and
+// nested images hold.
+func rgbTarget(data []byte, width, height int, fill []float64) redactTarget {
+    if len(data) < width*height*3 {
+        width, height = 0, 0
+    }
+    return redactTarget{
+        width: width, height: height, channels: 3, fill: fill,
+        get: func(x, y, c int) float64 {
+            return float64(data[(y*width+x)*3+c])
+        },
+        set: func(x, y, c int, v float64) {
+            data[(y*width+x)*3+c] = clampByte(v)
+        },
+    }
+}
+
+func bandTarget(samples []uint16, width, height int) redactTarget {
+    if len(samples) < width*height {
+        width, height = 0, 0
+    }
+    return redactTarget{
+        width: width, height: height, channels: 1, fill: []float64{0},
+        get: func(x, y, _ int) float64 {
+            return float64(samples[y*width+x])
+        },
+        set: func(x, y, _ int, v float64) {
+            samples[y*width+x] = uint16(math.Round(max(0, min(v, math.MaxUint16))))
+        },
+    }
+}
+
+func pixelChannel(p *PixeLink, c int) *byte {
+    switch c {
+    case 0:
+        return &p.R
+    case 1:
+        return &p.G
+    }
+    return &p.B
+}
+
+func clampByte(v float64) byte {
+    return byte(math.Round(max(0, min(v, 255))))
+}
+
+func redactRegions(t redactTarget, regions []image.Rectangle, mode RedactMode) {
+    for _, r := range regions {
+        r = r.Intersect(image.Rect(0, 0, t.width, t.height))
+        if r.Empty() {
+            continue
+        }
+        if mode == RedactBlackout {
+            for y := r.Min.Y; y < r.Max.Y; y++ {
+                for x := r.Min.X; x < r.Max.X; x++ {
+                    for c := 0; c < t.channels; c++ {
+                        t.set(x, y, c, t.fill[c])
+                    }
+                }
+            }
+            continue
+        }
+        blurRegion(t, r)
+    }
+}
+
+// blurRegion replaces each block of r with its mean, so nothing finer than
+// a block survives, and then box blurs r to soften the block edges. Only
+// samples inside r are read.
+func blurRegion(t redactTarget, r image.Rectangle) {
+    w, h, n := r.Dx(), r.Dy(), t.channels
+    block := max(minRedactBlock, min(w, h)/4)
+    buf := make([]float64, w*h*n)
+    for by := 0; by < h; by += block {
+        for bx := 0; bx < w; bx += block {
+            b := image.Rect(bx, by, min(bx+block, w), min(by+block, h))
+            for c := 0; c < n; c++ {
+                sum := 0.0
+                for y := b.Min.Y; y < b.Max.Y; y++ {
+                    for x := b.Min.X; x < b.Max.X; x++ {
+                        sum += t.get(r.Min.X+x, r.Min.Y+y, c)
+                    }
+                }
+                mean := sum / float64(b.Dx()*b.Dy())
+                for y := b.Min.Y; y < b.Max.Y; y++ {
+                    for x := b.Min.X; x < b.Max.X; x++ {
+                        buf[(y*w+x)*n+c] = mean
+                    }
+                }
+            }
+        }
+    }
+    radius := block / 2
+    buf = boxBlurAxis(buf, w, h, n, radius, 1, 0)
+    buf = boxBlurAxis(buf, w, h, n, radius, 0, 1)
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            for c := 0; c < n; c++ {
+                t.set(r.Min.X+x, r.Min.Y+y, c, buf[(y*w+x)*n+c])
+            }
+        }
+    }
+}
+
+// boxBlurAxis averages each sample with those within radius along the axis
+// (dx, dy), over the samples that exist at the edges, from running sums so
+// large radii stay fast.
+func boxBlurAxis(src []float64, w, h, n, radius, dx, dy int) []float64 {
+    dst := make([]float64, len(src))
+    lines, length := h, w
+    if dy != 0 {
+        lines, length = w, h
+    }
+    at := func(line, i int) int {
+        if dy != 0 {
+            return i*w + line
+        }
+        return line*w + i
+    }
+    sums := make([]float64, length+1)
+    for line := 0; line < lines; line++ {
+        for c := 0; c < n; c++ {
+            for i := 0; i < length; i++ {
+                sums[i+1] = sums[i] + src[at(line, i)*n+c]
+            }
+            for i := 0; i < length; i++ {
+                lo, hi := max(0, i-radius), min(length, i+radius+1)
+                dst[at(line, i)*n+c] = (sums[hi] - sums[lo]) / float64(hi-lo)
+            }
+        }
+    }
+    return dst
+}
@@ -0,0 +1,286 @@
+// Package remote reads NEST files over HTTP with Range requests, so a
+// nest.Reader can decode tiles of a file on a web server or in an object
+// store such as S3 without downloading all of it.
+package remote
+
+import (
+    "container/list"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    DefaultBlockSize       = 64 << 10
+    DefaultMaxConnsPerHost = 8
+    DefaultCacheBlocks     = 64
+)
+
+type Options struct {
+    // Client sends the requests. Nil selects http.DefaultClient.
+    Client *http.Client
+    // Header is added to every request, for example Authorization.
+    Header http.Header
+    // BlockSize aligns every fetch. Reads that touch a block already being
+    // fetched wait for it instead of asking again. Zero selects
+    // DefaultBlockSize.
+    BlockSize int64
+    // MaxConnsPerHost bounds the requests in flight to one host across all
+    // ReaderAts in the process. The first ReaderAt opened for a host sets
+    // its limit. Zero selects DefaultMaxConnsPerHost.
+    MaxConnsPerHost int
+    // CacheBlocks is how many recently read blocks are kept, so the small
+    // reads of headers and chunk tables don't each go to the network.
+    // Zero selects DefaultCacheBlocks and a negative value disables it.
+    CacheBlocks int
+    // Retry decides how failed requests are retried.
+    Retry RetryPolicy
+}
+
+// ReaderAt is an io.ReaderAt over a URL. It is safe for concurrent use;
+// concurrent reads of overlapping ranges are coalesced into one ranged GET
+// per run of blocks that are neither cached nor already being fetched.
+type ReaderAt struct {
+    url  string
+    opts Options
+    size int64
+    sem  chan struct{}
+
+    mu       sync.Mutex
+    inflight map[int64]*fetch
+    cache    map[int64]*list.Element
+    lru      *list.List
+}
+
+type cachedBlock struct {
+    block int64
+    data  []byte
+}
+
+// fetch is one ranged GET covering blocks [first, last).
+type fetch struct {
+    first, last int64
+    done        chan struct{}
+    data        []byte
+    err         error
+}
+
+var (
+    hostsMu sync.Mutex
+    hosts   = map[string]chan struct{}{}
+)
+
+func hostSemaphore(host string, limit int) chan struct{} {
+    hostsMu.Lock()
+    defer hostsMu.Unlock()
+    sem, ok := hosts[host]
+    if !ok {
+        sem = make(chan struct{}, limit)
+        hosts[host] = sem
+    }
+    return sem
+}
+
+// Open learns the size of the resource at rawURL with a one-byte ranged GET.
+func Open(rawURL string, opts Options) (*ReaderAt, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+    }
+    if opts.Client == nil {
+        opts.Client = http.DefaultClient
+    }
+    if opts.BlockSize <= 0 {
+        opts.BlockSize = DefaultBlockSize
+    }
+    if opts.MaxConnsPerHost <= 0 {
+        opts.MaxConnsPerHost = DefaultMaxConnsPerHost
+    }
+    if opts.CacheBlocks == 0 {
+        opts.CacheBlocks = DefaultCacheBlocks
+    }
+    ra := &ReaderAt{
+        url:      rawURL,
+        opts:     opts,
+        sem:      hostSemaphore(u.Host, opts.MaxConnsPerHost),
+        inflight: map[int64]*fetch{},
+        cache:    map[int64]*list.Element{},
+        lru:      list.New(),
+    }
+    _, size, err := ra.get(0, 1)
+    if err != nil {
+        return nil, err
+    }
+    ra.size = size
+    return ra, nil
+}
+
+func (ra *ReaderAt) Size() int64 {
+    return ra.size
+}
+
+func (ra *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+    if off < 0 {
+        return 0, errors.New("negative offset")
+    }
+    if off >= ra.size {
+        return 0, io.EOF
+    }
+    end := min(off+int64(len(p)), ra.size)
+    bs := ra.opts.BlockSize
+    first, last := off/bs, (end+bs-1)/bs
+
+    // Take cached blocks, join fetches already covering some of the others
+    // and start one for each run of the rest.
+    var waits, own []*fetch
+    ra.mu.Lock()
+    for b := first; b < last; {
+        if el, ok := ra.cache[b]; ok {
+            ra.lru.MoveToFront(el)
+            f := &fetch{first: b, last: b + 1, data: el.Value.(*cachedBlock).data, done: closed}
+            waits = append(waits, f)
+            b++
+            continue
+        }
+        if f, ok := ra.inflight[b]; ok {
+            if len(waits) == 0 || waits[len(waits)-1] != f {
+                waits = append(waits, f)
+            }
+            b = f.last
+            continue
+        }
+        f := &fetch{first: b, done: make(chan struct{})}
+        for f.last = b; f.last < last; f.last++ {
+            _, fetching := ra.inflight[f.last]
+            _, cached := ra.cache[f.last]
+            if fetching || cached {
+                break
+            }
+            ra.inflight[f.last] = f
+        }
+        own = append(own, f)
+        waits = append(waits, f)
+        b = f.last
+    }
+    ra.mu.Unlock()
+
+    for _, f := range own {
+        f.data, _, f.err = ra.get(f.first*bs, min(f.last*bs, ra.size))
+        ra.mu.Lock()
+        for b := f.first; b < f.last; b++ {
+            delete(ra.inflight, b)
+            if f.err == nil {
+                ra.remember(b, f.data[(b-f.first)*bs:min((b-f.first+1)*bs, int64(len(f.data)))])
+            }
+        }
+        ra.mu.Unlock()
+        close(f.done)
+    }
+
+    n := 0
+    for _, f := range waits {
+        <-f.done
+        if f.err != nil {
+            return n, f.err
+        }
+        start := f.first * bs
+        lo, hi := max(off, start), min(end, start+int64(len(f.data)))
+        if lo < hi {
+            copy(p[lo-off:], f.data[lo-start:hi-start])
+            n += int(hi - lo)
+        }
+    }
+    if n < len(p) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+var closed = make(chan struct{})
+
+func init() {
+    close(closed)
+}
+
+// remember caches one block, evicting the least recently used. ra.mu must be
+// held.
+func (ra *ReaderAt) remember(block int64, data []byte) {
+    if ra.opts.CacheBlocks < 0 {
+        return
+    }
+    ra.cache[block] = ra.lru.PushFront(&cachedBlock{block, data})
+    for ra.lru.Len() > ra.opts.CacheBlocks {
+        el := ra.lru.Back()
+        ra.lru.Remove(el)
+        delete(ra.cache, el.Value.(*cachedBlock).block)
+    }
+}
+
+// get fetches [start, end) and returns the total size of the resource from
+// the Content-Range header, retrying as the policy allows.
+func (ra *ReaderAt) get(start, end int64) ([]byte, int64, error) {
+    policy := ra.opts.Retry.withDefaults()
+    for attempt := 1; ; attempt++ {
+        data, size, err := ra.try(start, end)
+        if err == nil || attempt >= policy.MaxAttempts || !policy.Retryable(err) {
+            return data, size, err
+        }
+        time.Sleep(policy.delay(attempt, err))
+    }
+}
+
+func (ra *ReaderAt) try(start, end int64) ([]byte, int64, error) {
+    ra.sem <- struct{}{}
+    defer func() { <-ra.sem }()
+
+    req, err := http.NewRequest(http.MethodGet, ra.url, nil)
+    if err != nil {
+        return nil, 0, err
+    }
+    for k, v := range ra.opts.Header {
+        req.Header[k] = v
+    }
+    req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+    resp, err := ra.opts.Client.Do(req)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusPartialContent {
+        if resp.StatusCode == http.StatusOK {
+            return nil, 0, fmt.Errorf("%s does not support range requests", ra.url)
+        }
+        return nil, 0, &StatusError{URL: ra.url, StatusCode: resp.StatusCode, Status: resp.Status, RetryAfter: retryAfter(resp.Header)}
+    }
+    size, err := contentRangeSize(resp.Header.Get("Content-Range"))
+    if err != nil {
+        return nil, 0, err
+    }
+    data := make([]byte, end-start)
+    if _, err := io.ReadFull(resp.Body, data); err != nil {
+        return nil, 0, fmt.Errorf("failed to read bytes %d-%d of %s: %w", start, end-1, ra.url, err)
+    }
+    return data, size, nil
+}
+
+// contentRangeSize parses the complete length from "bytes a-b/size".
+func contentRangeSize(header string) (int64, error) {
+    _, size, ok := strings.Cut(header, "/")
+    if !ok || !strings.HasPrefix(header, "bytes ") {
+        return 0, fmt.Errorf("invalid Content-Range %q", header)
+    }
+    n, err := strconv.ParseInt(size, 10, 64)
+    if err != nil || n < 0 {
+        return 0, fmt.Errorf("Content-Range %q has no usable size", header)
+    }
+    return n, nil
+}
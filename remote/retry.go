@@ -0,0 +1,104 @@
+package remote
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "math/rand/v2"
+    "net"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// RetryPolicy retries requests that fail transiently, waiting an
+// exponentially growing, jittered delay between attempts. The zero value
+// selects the defaults of each field.
+type RetryPolicy struct {
+    // MaxAttempts counts the first request. Zero selects 4 and 1 disables
+    // retries.
+    MaxAttempts int
+    // InitialBackoff is the delay before the second attempt, doubled for
+    // each one after. Zero selects 100ms.
+    InitialBackoff time.Duration
+    // MaxBackoff caps the delay, including one asked for by Retry-After.
+    // Zero selects 5s.
+    MaxBackoff time.Duration
+    // Retryable classifies errors. Nil selects IsRetryable.
+    Retryable func(error) bool
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+    if p.MaxAttempts <= 0 {
+        p.MaxAttempts = 4
+    }
+    if p.InitialBackoff <= 0 {
+        p.InitialBackoff = 100 * time.Millisecond
+    }
+    if p.MaxBackoff <= 0 {
+        p.MaxBackoff = 5 * time.Second
+    }
+    if p.Retryable == nil {
+        p.Retryable = IsRetryable
+    }
+    return p
+}
+
+// delay returns the wait after the given failed attempt, from half to all
+// of the exponential backoff, or the server's Retry-After when longer.
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+    d := p.InitialBackoff << min(attempt-1, 30)
+    if d <= 0 || d > p.MaxBackoff {
+        d = p.MaxBackoff
+    }
+    d = d/2 + rand.N(d/2+1)
+    var se *StatusError
+    if errors.As(err, &se) && se.RetryAfter > d {
+        d = se.RetryAfter
+    }
+    return min(d, p.MaxBackoff)
+}
+
+// StatusError is returned for a response other than 206 Partial Content.
+type StatusError struct {
+    URL        string
+    StatusCode int
+    Status     string
+    // RetryAfter is the delay the server asked for, or zero.
+    RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+    return fmt.Sprintf("failed to fetch %s: %s", e.URL, e.Status)
+}
+
+// IsRetryable reports whether err is likely transient: a network error, a
+// response cut short, or a 408, 429, 500, 502, 503 or 504 status.
+func IsRetryable(err error) bool {
+    var se *StatusError
+    if errors.As(err, &se) {
+        switch se.StatusCode {
+        case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+            http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+            return true
+        }
+        return false
+    }
+    var ne net.Error
+    return errors.As(err, &ne) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a date.
+func retryAfter(h http.Header) time.Duration {
+    v := h.Get("Retry-After")
+    if v == "" {
+        return 0
+    }
+    if s, err := strconv.Atoi(v); err == nil && s > 0 {
+        return time.Duration(s) * time.Second
+    }
+    if t, err := http.ParseTime(v); err == nil {
+        return max(time.Until(t), 0)
+    }
+    return 0
+}
@@ -0,0 +1,278 @@
+package nest
+
+import (
+    "fmt"
+    "image"
+    "math"
+    "time"
+)
+
+// ResampleFilter is a separable reconstruction kernel. When shrinking, the
+// kernel is stretched by the scale factor so every source pixel contributes.
+type ResampleFilter interface {
+    Name() string
+    // Support is the kernel radius in destination pixels.
+    Support() float64
+    Kernel(x float64) float64
+}
+
+var (
+    BoxFilter      ResampleFilter = boxFilter{}
+    BilinearFilter ResampleFilter = bilinearFilter{}
+    LanczosFilter  ResampleFilter = lanczosFilter{}
+    // AreaFilter weights source pixels by how much of each the destination
+    // pixel covers, which keeps fine detail such as text legible when
+    // shrinking by fractional factors.
+    AreaFilter ResampleFilter = areaFilter{}
+)
+
+// PyramidFilterKey is the metadata key BuildPyramidWithFilter records the
+// filter name under.
+const PyramidFilterKey = "pyramid-filter"
+
+func ParseResampleFilter(s string) (ResampleFilter, error) {
+    for _, f := range []ResampleFilter{BoxFilter, BilinearFilter, LanczosFilter, AreaFilter} {
+        if f.Name() == s {
+            return f, nil
+        }
+    }
+    return nil, fmt.Errorf("unknown resampling filter %q", s)
+}
+
+type boxFilter struct{}
+
+func (boxFilter) Name() string     { return "box" }
+func (boxFilter) Support() float64 { return 0.5 }
+
+func (boxFilter) Kernel(x float64) float64 {
+    if x >= -0.5 && x < 0.5 {
+        return 1
+    }
+    return 0
+}
+
+type bilinearFilter struct{}
+
+func (bilinearFilter) Name() string     { return "bilinear" }
+func (bilinearFilter) Support() float64 { return 1 }
+
+func (bilinearFilter) Kernel(x float64) float64 {
+    return max(1-math.Abs(x), 0)
+}
+
+type lanczosFilter struct{}
+
+func (lanczosFilter) Name() string     { return "lanczos" }
+func (lanczosFilter) Support() float64 { return 3 }
+
+func (lanczosFilter) Kernel(x float64) float64 {
+    x = math.Abs(x)
+    if x < 1e-9 {
+        return 1
+    }
+    if x >= 3 {
+        return 0
+    }
+    px := math.Pi * x
+    return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+}
+
+// areaFilter is a box whose weights are computed from exact pixel overlap
+// rather than by sampling the kernel at pixel centers.
+type areaFilter struct{}
+
+func (areaFilter) Name() string     { return "area" }
+func (areaFilter) Support() float64 { return 0.5 }
+
+func (areaFilter) Kernel(x float64) float64 {
+    return boxFilter{}.Kernel(x)
+}
+
+// overlap returns how much of the source pixel centered at d lies inside a
+// destination pixel of width scale centered at 0, both in source pixels.
+func (areaFilter) overlap(d, scale float64) float64 {
+    return max(min(d+0.5, scale/2)-max(d-0.5, -scale/2), 0)
+}
+
+// contribution lists the source pixels that make up one destination pixel.
+type contribution struct {
+    first   int
+    weights []float64
+}
+
+func filterWeights(srcLen, dstLen int, f ResampleFilter) []contribution {
+    scale := float64(srcLen) / float64(dstLen)
+    stretch := max(scale, 1)
+    support := f.Support() * stretch
+    area, isArea := f.(areaFilter)
+    if isArea {
+        support = scale/2 + 0.5
+    }
+
+    out := make([]contribution, dstLen)
+    for i := range out {
+        center := (float64(i)+0.5)*scale - 0.5
+        lo := max(int(math.Ceil(center-support)), 0)
+        hi := min(int(math.Floor(center+support)), srcLen-1)
+        c := contribution{first: lo}
+        sum := 0.0
+        for j := lo; j <= hi; j++ {
+            var w float64
+            if isArea {
+                w = area.overlap(float64(j)-center, scale)
+            } else {
+                w = f.Kernel((float64(j) - center) / stretch)
+            }
+            c.weights = append(c.weights, w)
+            sum += w
+        }
+        if sum == 0 {
+            // The kernel missed every sample; fall back to the nearest.
+            c.first = min(max(int(math.Round(center)), 0), srcLen-1)
+            c.weights = []float64{1}
+            sum = 1
+        }
+        for k := range c.weights {
+            c.weights[k] /= sum
+        }
+        out[i] = c
+    }
+    return out
+}
+
+// resampleRGB scales RGB samples from sw x sh to dw x dh, filtering rows
+// first and then columns.
+func resampleRGB(src []byte, sw, sh, dw, dh int, f ResampleFilter) []byte {
+    planes := make([]float64, len(src))
+    for i, v := range src {
+        planes[i] = float64(v)
+    }
+    planes = resamplePlanes(planes, 3, sw, sh, dw, dh, f)
+    dst := make([]byte, dw*dh*3)
+    for i, v := range planes {
+        dst[i] = byte(min(max(math.Round(v), 0), 255))
+    }
+    return dst
+}
+
+// resamplePlanes scales interleaved samples with ch channels.
+func resamplePlanes(src []float64, ch, sw, sh, dw, dh int, f ResampleFilter) []float64 {
+    cols := filterWeights(sw, dw, f)
+    rows := filterWeights(sh, dh, f)
+
+    tmp := make([]float64, dw*sh*ch)
+    for y := 0; y < sh; y++ {
+        for x, c := range cols {
+            acc := tmp[(y*dw+x)*ch : (y*dw+x+1)*ch]
+            for k, w := range c.weights {
+                s := (y*sw + c.first + k) * ch
+                for i := range acc {
+                    acc[i] += w * src[s+i]
+                }
+            }
+        }
+    }
+
+    dst := make([]float64, dw*dh*ch)
+    for y, c := range rows {
+        for x := 0; x < dw; x++ {
+            acc := dst[(y*dw+x)*ch : (y*dw+x+1)*ch]
+            for k, w := range c.weights {
+                s := ((c.first+k)*dw + x) * ch
+                for i := range acc {
+                    acc[i] += w * tmp[s+i]
+                }
+            }
+        }
+    }
+    return dst
+}
+
+// ResizeImage scales img to width x height with f. Alpha is dropped.
+func ResizeImage(img *image.RGBA, width, height int, f ResampleFilter) *image.RGBA {
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    src := make([]byte, w*h*3)
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            i := img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+            copy(src[(y*w+x)*3:], img.Pix[i:i+3])
+        }
+    }
+    l := PyramidLevel{Width: width, Height: height, Data: resampleRGB(src, w, h, width, height, f)}
+    return l.ToImage()
+}
+
+// nearestIndex maps destination coordinate i to the source pixel whose
+// center is closest, for values such as links that can't be blended.
+func nearestIndex(i, srcLen, dstLen int) int {
+    return min((2*i+1)*srcLen/(2*dstLen), srcLen-1)
+}
+
+// Resize returns a copy of the file scaled to width x height. Colors and
+// focal planes are filtered with f; links and link channels take the nearest
+// source pixel. Pixels without data are left out of the filter, and output
+// pixels mostly covering them have no data. Nested images, metadata and
+// chunks are shared with nif, and the pyramid and bands are dropped.
+func (nif *NestedImageFile) Resize(width, height int, f ResampleFilter) (*NestedImageFile, error) {
+    if width <= 0 || height <= 0 {
+        return nil, fmt.Errorf("cannot resize to %dx%d", width, height)
+    }
+    sw, sh := int(nif.Header.Width), int(nif.Header.Height)
+    if sw == 0 || sh == 0 {
+        return nil, fmt.Errorf("cannot resize an empty image")
+    }
+
+    out := NewNestedImageFile(width, height, nif.Header.TileSize)
+    out.Header = nif.Header
+    out.Header.Width, out.Header.Height = uint32(width), uint32(height)
+    out.NestedImages = nif.NestedImages
+    out.Metadata = nif.Metadata
+    out.Chunks = nif.Chunks
+    if nif.Provenance != nil {
+        out.Provenance = nif.Provenance.resampled(nif.grid(), out.grid(), ProvenanceRecord{
+            Op:     OpResample,
+            Detail: fmt.Sprintf("%dx%d to %dx%d with %s", sw, sh, width, height, f.Name()),
+            Time:   time.Now(),
+        })
+    }
+    if nif.Transform != nil {
+        scale := Affine{float64(sw) / float64(width), 0, 0, 0, float64(sh) / float64(height), 0}
+        out.Transform = append(TransformChain{scale}, nif.Transform...)
+    }
+
+    var rgb []byte
+    if nif.NoData != nil {
+        rgb, out.NoData = resampleMasked(nif.rgbData(), nif.NoData, width, height, f)
+    } else {
+        rgb = resampleRGB(nif.rgbData(), sw, sh, width, height, f)
+    }
+    for y := 0; y < height; y++ {
+        sy := nearestIndex(y, sh, height)
+        for x := 0; x < width; x++ {
+            i := (y*width + x) * 3
+            out.MainImage[y][x] = PixeLink{
+                R:         rgb[i],
+                G:         rgb[i+1],
+                B:         rgb[i+2],
+                NestedIdx: nif.MainImage[sy][nearestIndex(x, sw, width)].NestedIdx,
+            }
+        }
+    }
+    for _, p := range nif.Planes {
+        out.Planes = append(out.Planes, Plane{Z: p.Z, Width: width, Height: height, Data: resampleRGB(p.Data, sw, sh, width, height, f)})
+    }
+    for _, lc := range nif.LinkChannels {
+        dst, _ := out.AddLinkChannel(lc.Name)
+        for y := 0; y < height; y++ {
+            sy := nearestIndex(y, sh, height)
+            for x := 0; x < width; x++ {
+                dst.Set(x, y, lc.At(nearestIndex(x, sw, width), sy))
+            }
+        }
+    }
+    if nif.Audit != nil {
+        out.Audit = nif.Audit.clone()
+        out.Audit.Append(AuditResize, fmt.Sprintf("%dx%d to %dx%d", sw, sh, width, height), nif.Bounds())
+    }
+    return out, nil
+}
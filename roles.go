@@ -0,0 +1,86 @@
+package nest
+
+import (
+    "fmt"
+    "io"
+)
+
+// NestedRole describes how a nested image relates to the main image, so
+// generic viewers can pick sensible defaults.
+type NestedRole uint8
+
+const (
+    RoleUnspecified NestedRole = iota
+    RoleThumbnail
+    RoleDetail
+    RoleAlternateResolution
+    RoleCaptionGraphic
+    RoleSourceScan
+)
+
+func (r NestedRole) String() string {
+    switch r {
+    case RoleUnspecified:
+        return "unspecified"
+    case RoleThumbnail:
+        return "thumbnail"
+    case RoleDetail:
+        return "detail"
+    case RoleAlternateResolution:
+        return "alternate-resolution"
+    case RoleCaptionGraphic:
+        return "caption-graphic"
+    case RoleSourceScan:
+        return "source-scan"
+    }
+    return "unknown"
+}
+
+func ParseNestedRole(s string) (NestedRole, error) {
+    for r := RoleUnspecified; r <= RoleSourceScan; r++ {
+        if r.String() == s {
+            return r, nil
+        }
+    }
+    return RoleUnspecified, fmt.Errorf("unknown nested image role %q", s)
+}
+
+// NestedByRole returns the nested images with the given role, in file order.
+func (nif *NestedImageFile) NestedByRole(role NestedRole) []*NestedImage {
+    var images []*NestedImage
+    for i := range nif.NestedImages {
+        if nif.NestedImages[i].Role == role {
+            images = append(images, &nif.NestedImages[i])
+        }
+    }
+    return images
+}
+
+// Roles are stored in a ROLE chunk holding one byte per nested image. Files
+// without the chunk have every role unspecified.
+func (nif *NestedImageFile) roleChunk() *Chunk {
+    data := make([]byte, len(nif.NestedImages))
+    set := false
+    for i, img := range nif.NestedImages {
+        data[i] = byte(img.Role)
+        set = set || img.Role != RoleUnspecified
+    }
+    if !set {
+        return nil
+    }
+    return &Chunk{Type: ChunkRoles, Data: data}
+}
+
+func (nif *NestedImageFile) readRoles(reader io.Reader, length uint64) error {
+    if length != uint64(len(nif.NestedImages)) {
+        return fmt.Errorf("%s chunk lists %d roles for %d nested images", ChunkRoles, length, len(nif.NestedImages))
+    }
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return fmt.Errorf("failed to read %s chunk: %w", ChunkRoles, err)
+    }
+    for i, r := range data {
+        nif.NestedImages[i].Role = NestedRole(r)
+    }
+    return nil
+}
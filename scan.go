@@ -0,0 +1,69 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// ScanEntry describes a file found by Scan.
+type ScanEntry struct {
+    Path     string
+    Header   FileHeader
+    Metadata Metadata
+}
+
+// Scan walks dir for .nest files and returns those accepted by match, which
+// may be nil to accept all. Only headers, indexes and metadata are read.
+// Files that cannot be read are skipped and reported in the returned error.
+func Scan(dir string, match func(*ScanEntry) bool) ([]ScanEntry, error) {
+    var entries []ScanEntry
+    var errs []error
+    err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".nest") {
+            return nil
+        }
+        entry, err := scanFile(path)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", path, err))
+            return nil
+        }
+        if match == nil || match(&entry) {
+            entries = append(entries, entry)
+        }
+        return nil
+    })
+    if err != nil {
+        return entries, err
+    }
+    return entries, errors.Join(errs...)
+}
+
+func scanFile(path string) (ScanEntry, error) {
+    entry := ScanEntry{Path: path}
+    file, err := os.Open(path)
+    if err != nil {
+        return entry, err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return entry, err
+    }
+
+    nr, err := NewReader(file, info.Size())
+    if err != nil {
+        return entry, err
+    }
+    entry.Header = nr.Header
+    if entry.Metadata, err = nr.Metadata(); err != nil {
+        return entry, err
+    }
+    return entry, nil
+}
@@ -0,0 +1,84 @@
+package nest
+
+import (
+    "slices"
+    "sort"
+    "strings"
+    "time"
+)
+
+// ScrubTime is the time files are recorded as written when they are
+// rewritten after Scrub, so scrubbing the same file twice gives the same
+// bytes and the file no longer tells when it was prepared.
+var ScrubTime = time.Unix(0, 0).UTC()
+
+// A ScrubPolicy says what Scrub keeps. The zero policy removes everything
+// Scrub can.
+type ScrubPolicy struct {
+    // KeepMetadata lists the metadata keys to keep, such as a title or a
+    // license.
+    KeepMetadata []string
+    // KeepAnnotations keeps the annotation layer, whose notes may name
+    // people or places.
+    KeepAnnotations bool
+    // KeepProvenance keeps the record of the sources and operations that
+    // produced each tile.
+    KeepProvenance bool
+    // KeepHistory keeps the audit log, the shared edit history and the tile
+    // update times, which record who changed the file and when.
+    KeepHistory bool
+}
+
+// scrubSafeKeys are metadata the library reads to process the file, which
+// say nothing about where it came from, so Scrub always keeps them.
+var scrubSafeKeys = []string{PyramidFilterKey, TileTTLKey}
+
+// Scrub removes what could identify where a file came from or who handled
+// it before it is published: free-form metadata, including the camera
+// settings and capture time recorded on import, provenance, the audit log
+// and edit history, and annotations, except what policy keeps. Pixels,
+// nested images and the display orientation are left alone. It returns
+// what it removed, such as "metadata camera" or "audit log", in a stable
+// order. When the history is kept, the scrub is recorded in it.
+//
+// Write the file with WriteOptions.Written set to ScrubTime, so the trailer
+// does not record when it was scrubbed either.
+func (nif *NestedImageFile) Scrub(policy ScrubPolicy) []string {
+    var removed []string
+    var keys []string
+    for k := range nif.Metadata {
+        if !slices.Contains(policy.KeepMetadata, k) && !slices.Contains(scrubSafeKeys, k) {
+            keys = append(keys, k)
+        }
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        delete(nif.Metadata, k)
+        removed = append(removed, "metadata "+k)
+    }
+    if !policy.KeepAnnotations && len(nif.Annotations) > 0 {
+        nif.Annotations = nil
+        removed = append(removed, "annotations")
+    }
+    if !policy.KeepProvenance && nif.Provenance != nil {
+        nif.Provenance = nil
+        removed = append(removed, "provenance")
+    }
+    if !policy.KeepHistory {
+        if nif.Audit != nil {
+            nif.Audit = nil
+            removed = append(removed, "audit log")
+        }
+        if nif.Collab != nil {
+            nif.Collab = nil
+            removed = append(removed, "edit history")
+        }
+        if nif.TileTimes != nil {
+            nif.TileTimes = nil
+            removed = append(removed, "tile update times")
+        }
+    } else {
+        nif.audit(AuditScrub, strings.Join(removed, ", "))
+    }
+    return removed
+}
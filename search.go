@@ -0,0 +1,357 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "io"
+    "slices"
+    "sort"
+    "strings"
+    "unicode"
+)
+
+// A SearchHit is a match of Search, in the text of an annotation or a
+// metadata value.
+type SearchHit struct {
+    // Annotation is the ID of the annotation the match starts in, or empty
+    // for a match in metadata.
+    Annotation string
+    // Key is the metadata key whose value matched.
+    Key string
+    // Rect bounds the annotations the match covers, several when a phrase
+    // runs across words added by AddWords.
+    Rect image.Rectangle
+}
+
+// searchDoc is an annotation or metadata value with indexed terms.
+type searchDoc struct {
+    key  string
+    meta bool
+    rect image.Rectangle
+    // start is the position of the first term, and terms their count.
+    start, terms int
+}
+
+// searchIndex maps every term of the annotation text and metadata values to
+// the positions it occurs at. Positions count terms across all documents,
+// annotations in ID order first, so a phrase is a run of positions.
+type searchIndex struct {
+    docs     []searchDoc
+    terms    []string
+    postings [][]int
+}
+
+// searchTerms splits s into lower case runs of letters and digits.
+func searchTerms(s string) []string {
+    return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+}
+
+func buildSearchIndex(annotations []Annotation, m Metadata) *searchIndex {
+    idx := &searchIndex{}
+    byTerm := map[string][]int{}
+    pos := 0
+    add := func(d searchDoc, text string) {
+        terms := searchTerms(text)
+        if len(terms) == 0 {
+            return
+        }
+        d.start, d.terms = pos, len(terms)
+        idx.docs = append(idx.docs, d)
+        for _, t := range terms {
+            byTerm[t] = append(byTerm[t], pos)
+            pos++
+        }
+    }
+    for _, a := range annotations {
+        add(searchDoc{key: a.ID, rect: a.Rect}, a.Text)
+    }
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        add(searchDoc{key: k, meta: true}, m[k])
+    }
+    for t := range byTerm {
+        idx.terms = append(idx.terms, t)
+    }
+    sort.Strings(idx.terms)
+    for _, t := range idx.terms {
+        idx.postings = append(idx.postings, byTerm[t])
+    }
+    return idx
+}
+
+// positions returns where terms starting with prefix occur, in order.
+func (idx *searchIndex) positions(prefix string) []int {
+    var pos []int
+    for i := sort.SearchStrings(idx.terms, prefix); i < len(idx.terms) && strings.HasPrefix(idx.terms[i], prefix); i++ {
+        pos = append(pos, idx.postings[i]...)
+    }
+    slices.Sort(pos)
+    return pos
+}
+
+// docAt returns the index of the document holding position p.
+func (idx *searchIndex) docAt(p int) int {
+    return sort.Search(len(idx.docs), func(i int) bool {
+        return idx.docs[i].start > p
+    }) - 1
+}
+
+func (idx *searchIndex) search(query string) []SearchHit {
+    terms := searchTerms(query)
+    if len(terms) == 0 {
+        return nil
+    }
+    rest := make([]map[int]bool, len(terms))
+    for i := 1; i < len(terms); i++ {
+        rest[i] = map[int]bool{}
+        for _, p := range idx.positions(terms[i]) {
+            rest[i][p] = true
+        }
+    }
+    var hits []SearchHit
+next:
+    for _, p := range idx.positions(terms[0]) {
+        for i := 1; i < len(terms); i++ {
+            if !rest[i][p+i] {
+                continue next
+            }
+        }
+        first, last := idx.docAt(p), idx.docAt(p+len(terms)-1)
+        // Phrases only run on across recognized words, which are split
+        // into one annotation each.
+        if first != last {
+            for _, d := range idx.docs[first : last+1] {
+                if _, ok := wordNumber(d.key); d.meta || !ok {
+                    continue next
+                }
+            }
+        }
+        d := idx.docs[first]
+        if d.meta {
+            hits = append(hits, SearchHit{Key: d.key})
+            continue
+        }
+        hit := SearchHit{Annotation: d.key, Rect: d.rect}
+        for _, d := range idx.docs[first+1 : last+1] {
+            hit.Rect = hit.Rect.Union(d.rect)
+        }
+        hits = append(hits, hit)
+    }
+    return hits
+}
+
+// Search finds query in the annotation text and metadata values. Matching
+// ignores case and punctuation, each word of the query matches words
+// starting with it, and a query of several words matches them in
+// consecutive order. Hits in annotations come first, in ID order.
+func (nif *NestedImageFile) Search(query string) []SearchHit {
+    return buildSearchIndex(nif.Annotations, nif.Metadata).search(query)
+}
+
+// HasSearchIndex reports whether the file was read with a search index, for
+// rewriting it with WriteOptions.SearchIndex.
+func (nif *NestedImageFile) HasSearchIndex() bool {
+    return nif.searchIndexed
+}
+
+// Search finds query as NestedImageFile.Search does, from the search index
+// when the file has one, and otherwise from its annotations and metadata.
+// Neither decodes any pixels.
+func (nr *Reader) Search(query string) ([]SearchHit, error) {
+    offset, length, ok, err := nr.findChunk(ChunkSearchIndex)
+    if err != nil {
+        return nil, err
+    }
+    if ok {
+        idx, err := decodeSearchIndex(io.NewSectionReader(nr.r, offset, int64(length)), length)
+        if err != nil {
+            return nil, err
+        }
+        return idx.search(query), nil
+    }
+    var annotations []Annotation
+    offset, length, ok, err = nr.findChunk(ChunkAnnotations)
+    if err != nil {
+        return nil, err
+    }
+    if ok {
+        if annotations, err = decodeAnnotations(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length); err != nil {
+            return nil, err
+        }
+    }
+    m, err := nr.Metadata()
+    if err != nil {
+        return nil, err
+    }
+    return buildSearchIndex(annotations, m).search(query), nil
+}
+
+// The search index is stored in an SIDX chunk of unsigned varints, with
+// keys and terms front-coded against the one before:
+//
+//	doc count | docs: flags byte (1 for metadata) | shared prefix length |
+//	    suffix length | suffix | term count | annotation rect as 4 signed varints
+//	term count | terms in sorted order: shared prefix length | suffix length |
+//	    suffix | posting count | position deltas
+//
+// Document positions follow from their term counts.
+func (idx *searchIndex) encode() []byte {
+    var b []byte
+    frontCode := func(prev, s string) {
+        n := 0
+        for n < len(prev) && n < len(s) && prev[n] == s[n] {
+            n++
+        }
+        b = binary.AppendUvarint(b, uint64(n))
+        b = binary.AppendUvarint(b, uint64(len(s)-n))
+        b = append(b, s[n:]...)
+    }
+    b = binary.AppendUvarint(b, uint64(len(idx.docs)))
+    prev := ""
+    for _, d := range idx.docs {
+        var flags byte
+        if d.meta {
+            flags = 1
+        }
+        b = append(b, flags)
+        frontCode(prev, d.key)
+        prev = d.key
+        b = binary.AppendUvarint(b, uint64(d.terms))
+        if !d.meta {
+            for _, v := range []int{d.rect.Min.X, d.rect.Min.Y, d.rect.Max.X, d.rect.Max.Y} {
+                b = binary.AppendVarint(b, int64(v))
+            }
+        }
+    }
+    b = binary.AppendUvarint(b, uint64(len(idx.terms)))
+    prev = ""
+    for i, t := range idx.terms {
+        frontCode(prev, t)
+        prev = t
+        b = binary.AppendUvarint(b, uint64(len(idx.postings[i])))
+        last := 0
+        for _, p := range idx.postings[i] {
+            b = binary.AppendUvarint(b, uint64(p-last))
+            last = p
+        }
+    }
+    return b
+}
+
+func decodeSearchIndex(reader io.Reader, length uint64) (*searchIndex, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkSearchIndex, err)
+    }
+    r := bytes.NewReader(data)
+    fail := func(err error) (*searchIndex, error) {
+        return nil, fmt.Errorf("failed to decode %s chunk: %w", ChunkSearchIndex, err)
+    }
+    // count reads a count of items taking at least size bytes each, which
+    // bounds what a corrupt count can make the decoder allocate.
+    count := func(size int) (int, error) {
+        n, err := binary.ReadUvarint(r)
+        if err != nil {
+            return 0, err
+        }
+        if n > uint64(r.Len()/size) {
+            return 0, fmt.Errorf("%d entries do not fit in %d bytes", n, r.Len())
+        }
+        return int(n), nil
+    }
+    frontCoded := func(prev string) (string, error) {
+        shared, err := binary.ReadUvarint(r)
+        if err != nil {
+            return "", err
+        }
+        if shared > uint64(len(prev)) {
+            return "", fmt.Errorf("prefix of %d bytes is longer than the %d before", shared, len(prev))
+        }
+        n, err := count(1)
+        if err != nil {
+            return "", err
+        }
+        suffix := make([]byte, n)
+        if _, err := io.ReadFull(r, suffix); err != nil {
+            return "", err
+        }
+        return prev[:shared] + string(suffix), nil
+    }
+
+    idx := &searchIndex{}
+    n, err := count(3)
+    if err != nil {
+        return fail(err)
+    }
+    idx.docs = make([]searchDoc, n)
+    prev, pos := "", 0
+    for i := range idx.docs {
+        d := &idx.docs[i]
+        flags, err := r.ReadByte()
+        if err != nil {
+            return fail(err)
+        }
+        d.meta = flags&1 != 0
+        if d.key, err = frontCoded(prev); err != nil {
+            return fail(err)
+        }
+        prev = d.key
+        if d.terms, err = count(1); err != nil {
+            return fail(err)
+        }
+        d.start = pos
+        pos += d.terms
+        if d.meta {
+            continue
+        }
+        var v [4]int64
+        for j := range v {
+            if v[j], err = binary.ReadVarint(r); err != nil {
+                return fail(err)
+            }
+        }
+        d.rect = image.Rect(int(v[0]), int(v[1]), int(v[2]), int(v[3]))
+    }
+    if n, err = count(3); err != nil {
+        return fail(err)
+    }
+    idx.terms = make([]string, n)
+    idx.postings = make([][]int, n)
+    prev = ""
+    for i := range idx.terms {
+        t, err := frontCoded(prev)
+        if err != nil {
+            return fail(err)
+        }
+        if i > 0 && t <= prev {
+            return fail(fmt.Errorf("term %q is out of order", t))
+        }
+        idx.terms[i], prev = t, t
+        np, err := count(1)
+        if err != nil {
+            return fail(err)
+        }
+        idx.postings[i] = make([]int, np)
+        p := 0
+        for j := range idx.postings[i] {
+            delta, err := binary.ReadUvarint(r)
+            if err != nil {
+                return fail(err)
+            }
+            if delta >= uint64(pos-p) {
+                return fail(fmt.Errorf("term %q occurs past the %d indexed", t, pos))
+            }
+            p += int(delta)
+            idx.postings[i][j] = p
+        }
+    }
+    return idx, nil
+}
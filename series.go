@@ -0,0 +1,154 @@
+package nest
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "slices"
+    "time"
+)
+
+// CaptureTimeKey is the metadata key, holding an RFC 3339 time, that
+// OpenSeries falls back to for frames the manifest gives no time.
+const CaptureTimeKey = "capture-time"
+
+// SeriesManifest lists the frames of a time series, such as the revisits of
+// a satellite over one area. Files are relative to the manifest's directory:
+//
+//	{"frames": [{"file": "2024-06-01.nest", "time": "2024-06-01T10:32:00Z"},
+//	            {"file": "2024-06-06.nest"}]}
+type SeriesManifest struct {
+    Frames []SeriesEntry `json:"frames"`
+}
+
+type SeriesEntry struct {
+    File string    `json:"file"`
+    Time time.Time `json:"time"`
+}
+
+// SeriesFrame is one epoch of a series. Its links lead to the detail
+// captures of that epoch.
+type SeriesFrame struct {
+    Name   string
+    Time   time.Time
+    Reader *Reader
+
+    file *os.File
+}
+
+// Series is a stack of files over time, ordered by Time.
+type Series struct {
+    Frames []SeriesFrame
+}
+
+// OpenSeries opens the files a manifest lists. Close releases them.
+func OpenSeries(manifest string) (*Series, error) {
+    data, err := os.ReadFile(manifest)
+    if err != nil {
+        return nil, err
+    }
+    var sm SeriesManifest
+    if err := json.Unmarshal(data, &sm); err != nil {
+        return nil, fmt.Errorf("failed to parse series manifest: %w", err)
+    }
+    s := &Series{}
+    dir := filepath.Dir(manifest)
+    for _, e := range sm.Frames {
+        name := e.File
+        if !filepath.IsAbs(name) {
+            name = filepath.Join(dir, filepath.FromSlash(name))
+        }
+        frame, err := openSeriesFrame(name, e.Time)
+        if err != nil {
+            s.Close()
+            return nil, fmt.Errorf("%s: %w", e.File, err)
+        }
+        frame.Name = e.File
+        s.Frames = append(s.Frames, frame)
+    }
+    s.sort()
+    return s, nil
+}
+
+func openSeriesFrame(name string, t time.Time) (SeriesFrame, error) {
+    m, err := openMosaicMember(name)
+    if err != nil {
+        return SeriesFrame{}, err
+    }
+    frame := SeriesFrame{Time: t, Reader: m.Reader, file: m.file}
+    if t.IsZero() {
+        md, err := m.Reader.Metadata()
+        if err != nil {
+            m.file.Close()
+            return SeriesFrame{}, err
+        }
+        v, ok := md[CaptureTimeKey]
+        if !ok {
+            m.file.Close()
+            return SeriesFrame{}, fmt.Errorf("no time in the manifest or %s metadata", CaptureTimeKey)
+        }
+        if frame.Time, err = time.Parse(time.RFC3339, v); err != nil {
+            m.file.Close()
+            return SeriesFrame{}, fmt.Errorf("invalid %s: %w", CaptureTimeKey, err)
+        }
+    }
+    return frame, nil
+}
+
+// Add inserts a frame the caller opened, keeping the series in time order.
+func (s *Series) Add(name string, t time.Time, r *Reader) {
+    s.Frames = append(s.Frames, SeriesFrame{Name: name, Time: t, Reader: r})
+    s.sort()
+}
+
+func (s *Series) sort() {
+    slices.SortStableFunc(s.Frames, func(a, b SeriesFrame) int {
+        return a.Time.Compare(b.Time)
+    })
+}
+
+// Close closes the files OpenSeries opened. Frames added by the caller are
+// left alone.
+func (s *Series) Close() error {
+    var errs []error
+    for i := range s.Frames {
+        if f := s.Frames[i].file; f != nil {
+            errs = append(errs, f.Close())
+            s.Frames[i].file = nil
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// FrameAt returns the latest frame taken at or before t, or nil when t is
+// before the first frame.
+func (s *Series) FrameAt(t time.Time) *SeriesFrame {
+    i, found := slices.BinarySearchFunc(s.Frames, t, func(f SeriesFrame, t time.Time) int {
+        return f.Time.Compare(t)
+    })
+    if found {
+        // Take the last of frames sharing the time.
+        for i+1 < len(s.Frames) && s.Frames[i+1].Time.Equal(t) {
+            i++
+        }
+        return &s.Frames[i]
+    }
+    if i == 0 {
+        return nil
+    }
+    return &s.Frames[i-1]
+}
+
+// RangeFrames returns the frames taken in [from, to), oldest first.
+func (s *Series) RangeFrames(from, to time.Time) []*SeriesFrame {
+    var out []*SeriesFrame
+    for i := range s.Frames {
+        f := &s.Frames[i]
+        if !f.Time.Before(from) && f.Time.Before(to) {
+            out = append(out, f)
+        }
+    }
+    return out
+}
@@ -0,0 +1,137 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// spillPrefix starts the name of every spill file, so CleanSpillDir can
+// tell them from other files in a shared temporary directory.
+const spillPrefix = "nest-spill-"
+
+// spiller holds encoded tiles in memory up to a threshold and appends the
+// rest to a temporary file, so workers that run ahead of a slow writer and
+// large pyramid levels don't exhaust memory. A nil spiller keeps
+// everything in memory.
+type spiller struct {
+    dir       string
+    threshold int64
+
+    mu     sync.Mutex
+    held   int64
+    file   *os.File
+    end    int64
+    closed bool
+}
+
+// spilled is an encoded tile held by a spiller, in memory when onDisk is
+// clear.
+type spilled struct {
+    data           []byte
+    onDisk         bool
+    offset, length int64
+}
+
+// newSpiller returns nil, which never spills, unless threshold is positive.
+func newSpiller(dir string, threshold int64) *spiller {
+    if threshold <= 0 {
+        return nil
+    }
+    return &spiller{dir: dir, threshold: threshold}
+}
+
+// put stores data, on disk when holding it would pass the threshold.
+func (s *spiller) put(data []byte) (spilled, error) {
+    if s == nil {
+        return spilled{data: data}, nil
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return spilled{}, errors.New("spill file already closed")
+    }
+    if s.held+int64(len(data)) <= s.threshold {
+        s.held += int64(len(data))
+        return spilled{data: data}, nil
+    }
+    if s.file == nil {
+        f, err := os.CreateTemp(s.dir, spillPrefix+"*")
+        if err != nil {
+            return spilled{}, fmt.Errorf("failed to create spill file: %w", err)
+        }
+        s.file = f
+    }
+    if _, err := s.file.WriteAt(data, s.end); err != nil {
+        return spilled{}, fmt.Errorf("failed to write spill file: %w", err)
+    }
+    sp := spilled{onDisk: true, offset: s.end, length: int64(len(data))}
+    s.end += sp.length
+    return sp, nil
+}
+
+// take returns the data of sp and stops counting it against the threshold.
+func (s *spiller) take(sp spilled) ([]byte, error) {
+    if !sp.onDisk {
+        if s != nil {
+            s.mu.Lock()
+            s.held -= int64(len(sp.data))
+            s.mu.Unlock()
+        }
+        return sp.data, nil
+    }
+    data := make([]byte, sp.length)
+    if _, err := s.file.ReadAt(data, sp.offset); err != nil {
+        return nil, fmt.Errorf("failed to read spill file: %w", err)
+    }
+    return data, nil
+}
+
+// close removes the spill file. Later puts fail rather than create another.
+func (s *spiller) close() {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.closed = true
+    if s.file != nil {
+        s.file.Close()
+        os.Remove(s.file.Name())
+        s.file = nil
+    }
+}
+
+// CleanSpillDir removes spill files older than age from dir, or from the
+// system temporary directory when dir is empty. Writes remove their own
+// spill files when they end, so only files left by a process that was
+// killed mid-write are found; age keeps the files of writes still running
+// safe. It returns how many files were removed.
+func CleanSpillDir(dir string, age time.Duration) (int, error) {
+    if dir == "" {
+        dir = os.TempDir()
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return 0, fmt.Errorf("failed to list spill directory: %w", err)
+    }
+    n := 0
+    for _, e := range entries {
+        if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), spillPrefix) {
+            continue
+        }
+        info, err := e.Info()
+        if err != nil || time.Since(info.ModTime()) < age {
+            continue
+        }
+        if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+            return n, fmt.Errorf("failed to remove spill file: %w", err)
+        }
+        n++
+    }
+    return n, nil
+}
@@ -0,0 +1,100 @@
+package nest
+
+import (
+    "bufio"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "unsafe"
+)
+
+// Info describes a file from its header alone, like image.DecodeConfig.
+type Info struct {
+    Header      FileHeader
+    Width       int
+    Height      int
+    TileSize    int
+    NestedCount int
+    // Compression is the codec of the first tile's color plane.
+    Compression TileCodec
+    // Tiles is the number of tiles in the main image, taken from the tile
+    // index when Indexed is set.
+    Tiles   int
+    Indexed bool
+    // DecodeMemory estimates the bytes a full decode allocates for the main
+    // image and the nested image table. Nested pixel data is not included
+    // since its size is only known after the tiles.
+    DecodeMemory int64
+}
+
+// Stat reads the header and the first tile's plane header. When r is also an
+// io.ReaderAt and io.Seeker it reads the tile index header from the end of
+// the file as well, without touching the tiles in between.
+func Stat(r io.Reader) (Info, error) {
+    var info Info
+    ra, isReaderAt := r.(io.ReaderAt)
+    seeker, isSeeker := r.(io.Seeker)
+    var start int64
+    if isReaderAt && isSeeker {
+        var err error
+        if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+            return info, err
+        }
+    }
+
+    br := bufio.NewReaderSize(r, 64)
+    h := &info.Header
+    if _, err := h.read(br); err != nil {
+        return info, fmt.Errorf("failed to read header: %w", err)
+    }
+    info.Width, info.Height = int(h.Width), int(h.Height)
+    info.TileSize = int(h.TileSize)
+    info.NestedCount = int(h.NestedCount)
+    cols, rows := tileGrid(h.Width, h.Height, h.TileSize)
+    info.Tiles = cols * rows
+    info.DecodeMemory = int64(h.Height)*24 + int64(h.Width)*int64(h.Height)*pixeLinkSize +
+        int64(h.TileSize)*int64(h.TileSize)*pixeLinkSize +
+        int64(h.NestedCount)*int64(unsafe.Sizeof(NestedImage{}))
+
+    if h.Version >= 5 && info.Tiles > 0 {
+        codec, err := br.ReadByte()
+        if err != nil {
+            return info, fmt.Errorf("failed to read first tile: %w", err)
+        }
+        info.Compression = TileCodec(codec)
+    }
+
+    if isReaderAt && isSeeker && h.Version >= 2 {
+        end, err := seeker.Seek(0, io.SeekEnd)
+        if err != nil {
+            return info, err
+        }
+        if err := info.statIndex(io.NewSectionReader(ra, start, end-start), end-start); err != nil {
+            return info, err
+        }
+    }
+    return info, nil
+}
+
+func (info *Info) statIndex(r io.ReaderAt, size int64) error {
+    order := info.Header.ByteOrder.order()
+    if size < tailChunkSize {
+        return nil
+    }
+    buf := make([]byte, tailChunkSize)
+    if _, err := r.ReadAt(buf, size-tailChunkSize); err != nil {
+        return fmt.Errorf("failed to read tail chunk: %w", err)
+    }
+    tail, ok := decodeTail(buf, order)
+    if !ok || tail.IndexOffset < 0 {
+        return nil
+    }
+    var hdr indexHeader
+    sr := io.NewSectionReader(r, tail.IndexOffset+chunkHeaderSize, int64(binary.Size(hdr)))
+    if err := binary.Read(sr, order, &hdr); err != nil {
+        return fmt.Errorf("failed to read tile index: %w", err)
+    }
+    info.Tiles = int(hdr.Count)
+    info.Indexed = true
+    return nil
+}
@@ -0,0 +1,181 @@
+package nest
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+
+    "github.com/70ziko/NEST/colorspace"
+)
+
+// HistogramBins is the number of bins per channel in TileStats, each
+// covering 256/HistogramBins sample values.
+const HistogramBins = 32
+
+// TileStats summarizes the stored RGB samples of one tile, counting only
+// pixels inside the image that hold data, so contrast stretching and
+// overviews need no pixel decoding.
+type TileStats struct {
+    Count     uint32
+    Min, Max  [3]uint8
+    Mean      [3]float32
+    Histogram [3][HistogramBins]uint32
+}
+
+// computeTileStats summarizes the tile covering bounds of the main image.
+func computeTileStats(tile []PixeLink, bounds image.Rectangle, tileSize int, mask *NoDataMask) TileStats {
+    s := TileStats{Min: [3]uint8{255, 255, 255}}
+    var sum [3]uint64
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            if !mask.Valid(x, y) {
+                continue
+            }
+            p := tile[(y-bounds.Min.Y)*tileSize+x-bounds.Min.X]
+            for c, v := range [3]uint8{p.R, p.G, p.B} {
+                s.Min[c], s.Max[c] = min(s.Min[c], v), max(s.Max[c], v)
+                sum[c] += uint64(v)
+                s.Histogram[c][int(v)*HistogramBins/256]++
+            }
+            s.Count++
+        }
+    }
+    if s.Count == 0 {
+        return TileStats{}
+    }
+    for c := range sum {
+        s.Mean[c] = float32(float64(sum[c]) / float64(s.Count))
+    }
+    return s
+}
+
+// Merge combines o into s, as if both tiles were one.
+func (s *TileStats) Merge(o TileStats) {
+    if o.Count == 0 {
+        return
+    }
+    if s.Count == 0 {
+        *s = o
+        return
+    }
+    n := float64(s.Count) + float64(o.Count)
+    for c := range 3 {
+        s.Min[c], s.Max[c] = min(s.Min[c], o.Min[c]), max(s.Max[c], o.Max[c])
+        s.Mean[c] = float32((float64(s.Mean[c])*float64(s.Count) + float64(o.Mean[c])*float64(o.Count)) / n)
+        for b := range s.Histogram[c] {
+            s.Histogram[c][b] += o.Histogram[c][b]
+        }
+    }
+    s.Count += o.Count
+}
+
+// Percentile returns, for each channel, the sample value below which about
+// p of the pixels fall, for p between 0 and 1. It is exact at 0 and 1 and
+// otherwise interpolated within a histogram bin.
+func (s *TileStats) Percentile(p float64) [3]uint8 {
+    var out [3]uint8
+    for c := range 3 {
+        switch {
+        case s.Count == 0:
+        case p <= 0:
+            out[c] = s.Min[c]
+        case p >= 1:
+            out[c] = s.Max[c]
+        default:
+            target := p * float64(s.Count)
+            var seen float64
+            for b, n := range s.Histogram[c] {
+                if seen+float64(n) >= target && n > 0 {
+                    v := (float64(b) + (target-seen)/float64(n)) * 256 / HistogramBins
+                    out[c] = uint8(min(max(v, float64(s.Min[c])), float64(s.Max[c])))
+                    break
+                }
+                seen += float64(n)
+            }
+        }
+    }
+    return out
+}
+
+// StatsAt returns the statistics of tile (x, y) when the index has them.
+func (ti *TileIndex) StatsAt(x, y int) (TileStats, bool) {
+    i := ti.position(x, y)
+    if i < 0 || ti.Stats == nil {
+        return TileStats{}, false
+    }
+    return ti.Stats[i], true
+}
+
+// RegionStats merges the statistics of every tile rect touches. Tiles are
+// counted whole, so the result is approximate at the edges of rect.
+func (nr *Reader) RegionStats(rect image.Rectangle) (TileStats, error) {
+    if nr.Index.Stats == nil {
+        return TileStats{}, errors.New("file has no tile statistics")
+    }
+    var s TileStats
+    tiles := nr.Grid().TileRange(rect.Intersect(nr.Bounds()))
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            if ts, ok := nr.Index.StatsAt(tx, ty); ok {
+                s.Merge(ts)
+            }
+        }
+    }
+    return s, nil
+}
+
+// StatsOverview draws one pixel per tile in its mean color, as a preview
+// that reads no tile data. Colors are converted to sRGB.
+func (nr *Reader) StatsOverview() (*image.RGBA, error) {
+    if nr.Index.Stats == nil {
+        return nil, errors.New("file has no tile statistics")
+    }
+    img := image.NewRGBA(image.Rect(0, 0, nr.Index.Cols, nr.Index.Rows))
+    for i, e := range nr.Index.Entries {
+        m := nr.Index.Stats[i].Mean
+        o := img.PixOffset(e.Tile.X, e.Tile.Y)
+        img.Pix[o], img.Pix[o+1], img.Pix[o+2] = colorspace.Convert8(uint8(m[0]+0.5), uint8(m[1]+0.5), uint8(m[2]+0.5), nr.Header.ColorSpace, colorspace.SRGB)
+        img.Pix[o+3] = 0xff
+    }
+    return img, nil
+}
+
+// Tile statistics are kept in a TSTA chunk next to the TSUM chunk: a count
+// followed by one TileStats per index entry, in index order.
+func (ti *TileIndex) encodeStats(order binary.ByteOrder) []byte {
+    size := binary.Size(TileStats{})
+    data := make([]byte, 4, 4+size*len(ti.Stats))
+    order.PutUint32(data, uint32(len(ti.Stats)))
+    data, _ = binary.Append(data, order, ti.Stats)
+    return data
+}
+
+func (ti *TileIndex) decodeStats(reader io.Reader, order binary.ByteOrder, length uint64) error {
+    size := uint64(binary.Size(TileStats{}))
+    if length != 4+size*uint64(len(ti.Entries)) {
+        return fmt.Errorf("%s chunk is %d bytes for %d tiles", ChunkStats, length, len(ti.Entries))
+    }
+    var count uint32
+    if err := binary.Read(reader, order, &count); err != nil {
+        return fmt.Errorf("failed to read %s chunk: %w", ChunkStats, err)
+    }
+    if int(count) != len(ti.Entries) {
+        return fmt.Errorf("%s chunk lists %d tiles, the index has %d", ChunkStats, count, len(ti.Entries))
+    }
+    stats := make([]TileStats, count)
+    if err := binary.Read(reader, order, stats); err != nil {
+        return fmt.Errorf("failed to read %s chunk: %w", ChunkStats, err)
+    }
+    ti.Stats = stats
+    return nil
+}
+
+func (nr *Reader) loadStats() error {
+    offset, length, ok, err := nr.findChunk(ChunkStats)
+    if err != nil || !ok {
+        return err
+    }
+    return nr.Index.decodeStats(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+}
@@ -0,0 +1,132 @@
+package nest
+
+import (
+    "fmt"
+    "slices"
+)
+
+// StorageReport breaks down the bytes of a file by what they hold, so users
+// can see where the space went and tune their write options.
+type StorageReport struct {
+    // Total is the file size.
+    Total int64
+    // Header is the fixed file header.
+    Header int64
+    // Tiles is the main image tile data, split by plane and codec in
+    // Planes.
+    Tiles int64
+    // NestedImages is the nested image pixel data stored after the tiles.
+    NestedImages int64
+    // Chunks holds the bytes of each chunk type, chunk headers included.
+    // Pyramid levels, the tile index and metadata all live in chunks.
+    Chunks map[ChunkType]int64
+    // Other counts bytes outside every known region, such as data
+    // trailing a file without a TAIL chunk.
+    Other int64
+    // Planes summarizes the tile planes of files from version 5 on.
+    Planes []PlaneUsage
+}
+
+// PlaneUsage totals the tile planes of one kind stored with one codec.
+type PlaneUsage struct {
+    // Links is set for link planes and clear for RGB planes.
+    Links bool
+    Codec TileCodec
+    // Count is the number of planes.
+    Count int
+    // Bytes is what the planes take, plane headers included.
+    Bytes int64
+    // RawBytes is what the same planes would take uncompressed.
+    RawBytes int64
+}
+
+// Saved returns the bytes the codec saves over raw planes, negative when
+// it costs space.
+func (u PlaneUsage) Saved() int64 {
+    return u.RawBytes - u.Bytes
+}
+
+// Ratio returns the compression ratio, raw bytes over stored bytes.
+func (u PlaneUsage) Ratio() float64 {
+    if u.Bytes == 0 {
+        return 0
+    }
+    return float64(u.RawBytes) / float64(u.Bytes)
+}
+
+// StorageReport tallies the file from its header, tile index, plane headers
+// and chunk headers, without decoding any pixels.
+func (nr *Reader) StorageReport() (*StorageReport, error) {
+    rep := &StorageReport{
+        Total:        nr.size,
+        Header:       nr.tilesOffset,
+        NestedImages: nr.chunksOffset - nr.tilesEnd(),
+        Chunks:       map[ChunkType]int64{},
+    }
+    for _, e := range nr.Index.Entries {
+        rep.Tiles += e.Length
+    }
+    if nr.Header.Version >= 5 {
+        if err := nr.planeUsage(rep); err != nil {
+            return nil, err
+        }
+    }
+
+    end := nr.chunksOffset
+    err := nr.walkChunks(func(t ChunkType, offset int64, length uint64) (bool, error) {
+        rep.Chunks[t] += chunkHeaderSize + int64(length)
+        end = offset + int64(length)
+        return true, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if rest := nr.size - end; rest == tailChunkSize && nr.Header.Version >= 2 {
+        rep.Chunks[ChunkTail] = rest
+    }
+
+    rep.Other = rep.Total - rep.Header - rep.Tiles - rep.NestedImages
+    for _, n := range rep.Chunks {
+        rep.Other -= n
+    }
+    return rep, nil
+}
+
+func (nr *Reader) planeUsage(rep *StorageReport) error {
+    ts := int64(nr.Header.TileSize)
+    raw := [2]int64{3 * ts * ts, int64(nr.codec().linkBytes) * ts * ts}
+    usage := map[[2]uint8]*PlaneUsage{}
+    var hdr [planeHeaderSize]byte
+    for _, e := range nr.Index.Entries {
+        offset := e.Offset
+        for plane := range raw {
+            if _, err := nr.r.ReadAt(hdr[:], offset); err != nil {
+                return fmt.Errorf("failed to read tile (%d, %d): %w", e.Tile.X, e.Tile.Y, err)
+            }
+            n := planeHeaderSize + int64(nr.order.Uint32(hdr[1:]))
+            key := [2]uint8{uint8(plane), hdr[0]}
+            u := usage[key]
+            if u == nil {
+                u = &PlaneUsage{Links: plane == 1, Codec: TileCodec(hdr[0])}
+                usage[key] = u
+            }
+            u.Count++
+            u.Bytes += n
+            u.RawBytes += planeHeaderSize + raw[plane]
+            offset += n
+        }
+    }
+    for _, u := range usage {
+        rep.Planes = append(rep.Planes, *u)
+    }
+    slices.SortFunc(rep.Planes, func(a, b PlaneUsage) int {
+        if a.Links != b.Links {
+            if a.Links {
+                return 1
+            }
+            return -1
+        }
+        return int(a.Codec) - int(b.Codec)
+    })
+    return nil
+}
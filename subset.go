@@ -0,0 +1,86 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "slices"
+)
+
+type SubsetOptions struct {
+    // MetadataKeys lists the metadata to disclose. Other keys are left out.
+    MetadataKeys []string
+    // Annotations keeps the annotations lying wholly inside the region.
+    Annotations bool
+}
+
+// ExportSubset returns a new file holding only what is chosen for
+// disclosure, so a slice of a confidential document can be shared without
+// the rest: the part of the main image inside region, and the nested images
+// numbered in indices, from 1 like links, renumbered in that order. Links
+// from the region to any other nested image are cleared.
+//
+// Everything else that could describe the rest of the file is left out:
+// metadata not in opts.MetadataKeys, annotations unless opts.Annotations
+// is set, focal planes, bands, the pyramid, link channels, layers,
+// templates, the canvas, the transform, provenance, the audit log and the
+// edit history. The no-data mask under region and display adjustments are
+// kept.
+func (nif *NestedImageFile) ExportSubset(indices []uint32, region image.Rectangle, opts SubsetOptions) (*NestedImageFile, error) {
+    region = region.Canon().Intersect(nif.Bounds())
+    if region.Empty() {
+        return nil, errors.New("subset region does not overlap the main image")
+    }
+    if len(indices) > 0 && nif.Header.Payload != PayloadLink {
+        return nil, fmt.Errorf("file holds %s values, not links to nested images", nif.Header.Payload)
+    }
+
+    out := &NestedImageFile{Header: nif.Header, Metadata: Metadata{}}
+    out.Header.Width, out.Header.Height = uint32(region.Dx()), uint32(region.Dy())
+    renumber := map[uint32]uint32{}
+    for _, idx := range indices {
+        if idx == 0 || int(idx) > len(nif.NestedImages) {
+            return nil, fmt.Errorf("no nested image %d, the file has %d", idx, len(nif.NestedImages))
+        }
+        if _, dup := renumber[idx]; dup {
+            return nil, fmt.Errorf("nested image %d is listed twice", idx)
+        }
+        ni := nif.NestedImages[idx-1]
+        ni.Data = slices.Clone(ni.Data)
+        out.NestedImages = append(out.NestedImages, ni)
+        renumber[idx] = uint32(len(out.NestedImages))
+    }
+    out.Header.NestedCount = uint32(len(out.NestedImages))
+
+    out.MainImage = make([][]PixeLink, region.Dy())
+    for y := range out.MainImage {
+        row := slices.Clone(nif.MainImage[region.Min.Y+y][region.Min.X:region.Max.X])
+        if nif.Header.Payload == PayloadLink {
+            for x := range row {
+                row[x].NestedIdx = renumber[row[x].NestedIdx]
+            }
+        }
+        out.MainImage[y] = row
+    }
+    out.NoData = nif.NoData.sub(region)
+
+    for _, k := range opts.MetadataKeys {
+        if v, ok := nif.Metadata[k]; ok {
+            out.Metadata[k] = v
+        }
+    }
+    if opts.Annotations {
+        for _, a := range nif.Annotations {
+            // Notes on no particular region may be about any of it.
+            if !a.Rect.Empty() && a.Rect.In(region) {
+                a.Rect = a.Rect.Sub(region.Min)
+                out.Annotations = append(out.Annotations, a)
+            }
+        }
+    }
+    if nif.Adjustments != nil {
+        a := *nif.Adjustments
+        out.Adjustments = &a
+    }
+    return out, nil
+}
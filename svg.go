@@ -0,0 +1,893 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "io"
+    "math"
+    "strconv"
+    "strings"
+
+    "golang.org/x/image/colornames"
+    "golang.org/x/image/vector"
+)
+
+// The SVG renderer covers what diagrams use: rect, circle, ellipse, line,
+// polyline, polygon and path elements with solid fills and strokes, group
+// transforms and opacity. Text, gradients, clipping, masks, filters and
+// <use> are not drawn. Group opacity is applied to each member rather than
+// to the group as a whole, and fills use the non-zero rule.
+
+// svgMatrix is an affine transform mapping (x, y) to
+// (a*x + c*y + e, b*x + d*y + f).
+type svgMatrix [6]float64
+
+var svgIdentity = svgMatrix{1, 0, 0, 1, 0, 0}
+
+// mul returns the transform applying n, then m.
+func (m svgMatrix) mul(n svgMatrix) svgMatrix {
+    return svgMatrix{
+        m[0]*n[0] + m[2]*n[1],
+        m[1]*n[0] + m[3]*n[1],
+        m[0]*n[2] + m[2]*n[3],
+        m[1]*n[2] + m[3]*n[3],
+        m[0]*n[4] + m[2]*n[5] + m[4],
+        m[1]*n[4] + m[3]*n[5] + m[5],
+    }
+}
+
+func (m svgMatrix) apply(x, y float64) svgPoint {
+    return svgPoint{m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]}
+}
+
+// scale is how much m stretches lengths, on average over directions.
+func (m svgMatrix) scale() float64 {
+    return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+type svgPoint struct{ X, Y float64 }
+
+// svgStyle holds the properties an element inherits from its parent.
+type svgStyle struct {
+    m             svgMatrix
+    fill, stroke  *color.NRGBA
+    fillOpacity   float64
+    strokeOpacity float64
+    opacity       float64
+    strokeWidth   float64
+    lineCap       string
+}
+
+// svgSkipped elements hold content that is not drawn in place, or that the
+// renderer does not support.
+var svgSkipped = map[string]bool{
+    "defs": true, "clipPath": true, "mask": true, "symbol": true, "marker": true,
+    "pattern": true, "linearGradient": true, "radialGradient": true, "filter": true,
+    "style": true, "script": true, "title": true, "desc": true, "metadata": true,
+    "text": true, "foreignObject": true, "use": true, "image": true, "switch": true,
+}
+
+// svgSize returns the size an SVG document asks to be shown at: its width
+// and height, else its viewBox, else 300x150 as browsers assume.
+func svgSize(data []byte) (int, int, error) {
+    d := xml.NewDecoder(bytes.NewReader(data))
+    d.Strict = false
+    root, err := svgRoot(d)
+    if err != nil {
+        return 0, 0, err
+    }
+    w, h := root.size()
+    return max(int(math.Round(w)), 1), max(int(math.Round(h)), 1), nil
+}
+
+type svgRootElement struct {
+    attrs   map[string]string
+    viewBox []float64
+}
+
+func svgRoot(d *xml.Decoder) (*svgRootElement, error) {
+    for {
+        tok, err := d.Token()
+        if err == io.EOF {
+            return nil, errors.New("not an SVG document")
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse SVG: %w", err)
+        }
+        se, ok := tok.(xml.StartElement)
+        if !ok {
+            continue
+        }
+        if se.Name.Local != "svg" {
+            return nil, errors.New("not an SVG document")
+        }
+        root := &svgRootElement{attrs: svgAttrs(se)}
+        if vb := svgNumbers(root.attrs["viewBox"]); len(vb) == 4 && vb[2] > 0 && vb[3] > 0 {
+            root.viewBox = vb
+        }
+        return root, nil
+    }
+}
+
+// size returns the root's width and height in pixels.
+func (root *svgRootElement) size() (float64, float64) {
+    w, wok := svgLength(root.attrs["width"])
+    h, hok := svgLength(root.attrs["height"])
+    switch {
+    case wok && hok:
+    case root.viewBox != nil && wok:
+        h = w * root.viewBox[3] / root.viewBox[2]
+    case root.viewBox != nil && hok:
+        w = h * root.viewBox[2] / root.viewBox[3]
+    case root.viewBox != nil:
+        w, h = root.viewBox[2], root.viewBox[3]
+    default:
+        return 300, 150
+    }
+    return w, h
+}
+
+// viewport returns the transform from user space to a w x h raster,
+// honouring preserveAspectRatio.
+func (root *svgRootElement) viewport(w, h int) svgMatrix {
+    vb := root.viewBox
+    if vb == nil {
+        sw, sh := root.size()
+        vb = []float64{0, 0, sw, sh}
+    }
+    sx, sy := float64(w)/vb[2], float64(h)/vb[3]
+    par := root.attrs["preserveAspectRatio"]
+    if strings.HasPrefix(strings.TrimSpace(par), "none") {
+        return svgMatrix{sx, 0, 0, sy, -vb[0] * sx, -vb[1] * sy}
+    }
+    s := min(sx, sy)
+    if strings.Contains(par, "slice") {
+        s = max(sx, sy)
+    }
+    ax, ay := 0.5, 0.5
+    switch {
+    case strings.Contains(par, "xMin"):
+        ax = 0
+    case strings.Contains(par, "xMax"):
+        ax = 1
+    }
+    switch {
+    case strings.Contains(par, "YMin"):
+        ay = 0
+    case strings.Contains(par, "YMax"):
+        ay = 1
+    }
+    tx := (float64(w)-vb[2]*s)*ax - vb[0]*s
+    ty := (float64(h)-vb[3]*s)*ay - vb[1]*s
+    return svgMatrix{s, 0, 0, s, tx, ty}
+}
+
+// rasterizeSVG renders an SVG document at w x h over transparency.
+func rasterizeSVG(data []byte, w, h int) (*image.RGBA, error) {
+    if w <= 0 || h <= 0 {
+        return nil, fmt.Errorf("cannot render SVG at %dx%d", w, h)
+    }
+    d := xml.NewDecoder(bytes.NewReader(data))
+    d.Strict = false
+    root, err := svgRoot(d)
+    if err != nil {
+        return nil, err
+    }
+    r := &svgRenderer{dst: image.NewRGBA(image.Rect(0, 0, w, h)), z: vector.NewRasterizer(0, 0)}
+    style := svgStyle{
+        m:             root.viewport(w, h),
+        fill:          &color.NRGBA{A: 0xff},
+        fillOpacity:   1,
+        strokeOpacity: 1,
+        opacity:       1,
+        strokeWidth:   1,
+        lineCap:       "butt",
+    }
+    stack := []svgStyle{style.with(root.attrs)}
+    skip := 0
+    for {
+        tok, err := d.Token()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse SVG: %w", err)
+        }
+        switch t := tok.(type) {
+        case xml.StartElement:
+            if skip > 0 || svgSkipped[t.Name.Local] {
+                skip++
+                continue
+            }
+            attrs := svgAttrs(t)
+            s := stack[len(stack)-1].with(attrs)
+            stack = append(stack, s)
+            r.draw(t.Name.Local, attrs, s)
+        case xml.EndElement:
+            if skip > 0 {
+                skip--
+                continue
+            }
+            if len(stack) > 1 {
+                stack = stack[:len(stack)-1]
+            }
+        }
+    }
+    return r.dst, nil
+}
+
+// svgAttrs returns an element's attributes with its style attribute's
+// declarations taking precedence.
+func svgAttrs(se xml.StartElement) map[string]string {
+    attrs := make(map[string]string, len(se.Attr))
+    for _, a := range se.Attr {
+        attrs[a.Name.Local] = a.Value
+    }
+    for _, decl := range strings.Split(attrs["style"], ";") {
+        if k, v, ok := strings.Cut(decl, ":"); ok {
+            attrs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+        }
+    }
+    return attrs
+}
+
+// with returns s updated by an element's attributes.
+func (s svgStyle) with(attrs map[string]string) svgStyle {
+    if v, ok := attrs["transform"]; ok {
+        s.m = s.m.mul(svgTransform(v))
+    }
+    if v, ok := attrs["fill"]; ok {
+        if c, ok := svgColor(v); ok {
+            s.fill = c
+        }
+    }
+    if v, ok := attrs["stroke"]; ok {
+        if c, ok := svgColor(v); ok {
+            s.stroke = c
+        }
+    }
+    if v, ok := svgLength(attrs["stroke-width"]); ok {
+        s.strokeWidth = v
+    }
+    for name, p := range map[string]*float64{"fill-opacity": &s.fillOpacity, "stroke-opacity": &s.strokeOpacity} {
+        if v, err := strconv.ParseFloat(strings.TrimSpace(attrs[name]), 64); err == nil {
+            *p = min(max(v, 0), 1)
+        }
+    }
+    if v, err := strconv.ParseFloat(strings.TrimSpace(attrs["opacity"]), 64); err == nil {
+        s.opacity *= min(max(v, 0), 1)
+    }
+    if v := attrs["stroke-linecap"]; v == "butt" || v == "round" || v == "square" {
+        s.lineCap = v
+    }
+    return s
+}
+
+// svgColor parses a paint, returning nil for none. Unsupported paints such
+// as gradients are reported as not ok so the inherited paint is kept.
+func svgColor(v string) (*color.NRGBA, bool) {
+    v = strings.TrimSpace(v)
+    switch {
+    case v == "none" || v == "transparent":
+        return nil, true
+    case strings.HasPrefix(v, "#"):
+        hex := v[1:]
+        if len(hex) == 3 {
+            hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+        }
+        n, err := strconv.ParseUint(hex, 16, 32)
+        if len(hex) != 6 || err != nil {
+            return nil, false
+        }
+        return &color.NRGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 0xff}, true
+    case strings.HasPrefix(v, "rgb(") && strings.HasSuffix(v, ")"):
+        parts := strings.Split(v[4:len(v)-1], ",")
+        if len(parts) != 3 {
+            return nil, false
+        }
+        var c [3]uint8
+        for i, p := range parts {
+            p = strings.TrimSpace(p)
+            scale := 1.0
+            if strings.HasSuffix(p, "%") {
+                p, scale = p[:len(p)-1], 2.55
+            }
+            f, err := strconv.ParseFloat(p, 64)
+            if err != nil {
+                return nil, false
+            }
+            c[i] = uint8(min(max(math.Round(f*scale), 0), 255))
+        }
+        return &color.NRGBA{c[0], c[1], c[2], 0xff}, true
+    }
+    if c, ok := colornames.Map[strings.ToLower(v)]; ok {
+        return &color.NRGBA{c.R, c.G, c.B, 0xff}, true
+    }
+    return nil, false
+}
+
+// svgLength parses a length in user units, converting absolute units.
+// Percentages are not ok since they need a viewport to resolve.
+func svgLength(v string) (float64, bool) {
+    v = strings.TrimSpace(v)
+    scale := 1.0
+    for _, u := range []struct {
+        suffix string
+        scale  float64
+    }{{"px", 1}, {"pt", 4.0 / 3}, {"pc", 16}, {"mm", 96 / 25.4}, {"cm", 96 / 2.54}, {"in", 96}} {
+        if strings.HasSuffix(v, u.suffix) {
+            v, scale = v[:len(v)-len(u.suffix)], u.scale
+            break
+        }
+    }
+    f, err := strconv.ParseFloat(v, 64)
+    if err != nil || f < 0 {
+        return 0, false
+    }
+    return f * scale, true
+}
+
+// svgNumbers parses a list of numbers separated by spaces or commas,
+// stopping at the first that is malformed.
+func svgNumbers(v string) []float64 {
+    sc := svgScanner{s: v}
+    var nums []float64
+    for {
+        f, ok := sc.number()
+        if !ok {
+            return nums
+        }
+        nums = append(nums, f)
+    }
+}
+
+// svgTransform parses a transform list, ignoring what follows an error.
+func svgTransform(v string) svgMatrix {
+    m := svgIdentity
+    for {
+        v = strings.TrimLeft(v, " \t\r\n,")
+        name, rest, ok := strings.Cut(v, "(")
+        if !ok {
+            return m
+        }
+        args, rest, ok := strings.Cut(rest, ")")
+        if !ok {
+            return m
+        }
+        v = rest
+        a := svgNumbers(args)
+        var t svgMatrix
+        switch strings.TrimSpace(name) {
+        case "matrix":
+            if len(a) != 6 {
+                return m
+            }
+            t = svgMatrix(a)
+        case "translate":
+            if len(a) == 1 {
+                a = append(a, 0)
+            }
+            if len(a) != 2 {
+                return m
+            }
+            t = svgMatrix{1, 0, 0, 1, a[0], a[1]}
+        case "scale":
+            if len(a) == 1 {
+                a = append(a, a[0])
+            }
+            if len(a) != 2 {
+                return m
+            }
+            t = svgMatrix{a[0], 0, 0, a[1], 0, 0}
+        case "rotate":
+            if len(a) != 1 && len(a) != 3 {
+                return m
+            }
+            sin, cos := math.Sincos(a[0] * math.Pi / 180)
+            t = svgMatrix{cos, sin, -sin, cos, 0, 0}
+            if len(a) == 3 {
+                t = svgMatrix{1, 0, 0, 1, a[1], a[2]}.mul(t).mul(svgMatrix{1, 0, 0, 1, -a[1], -a[2]})
+            }
+        case "skewX":
+            if len(a) != 1 {
+                return m
+            }
+            t = svgMatrix{1, 0, math.Tan(a[0] * math.Pi / 180), 1, 0, 0}
+        case "skewY":
+            if len(a) != 1 {
+                return m
+            }
+            t = svgMatrix{1, math.Tan(a[0] * math.Pi / 180), 0, 1, 0, 0}
+        default:
+            return m
+        }
+        m = m.mul(t)
+    }
+}
+
+// svgScanner reads path data and number lists.
+type svgScanner struct {
+    s string
+    i int
+}
+
+func (sc *svgScanner) skip() {
+    for sc.i < len(sc.s) && strings.IndexByte(" \t\r\n,", sc.s[sc.i]) >= 0 {
+        sc.i++
+    }
+}
+
+func (sc *svgScanner) number() (float64, bool) {
+    sc.skip()
+    start := sc.i
+    if sc.i < len(sc.s) && (sc.s[sc.i] == '+' || sc.s[sc.i] == '-') {
+        sc.i++
+    }
+    digits, dot := false, false
+    for ; sc.i < len(sc.s); sc.i++ {
+        c := sc.s[sc.i]
+        if c >= '0' && c <= '9' {
+            digits = true
+        } else if c == '.' && !dot {
+            dot = true
+        } else {
+            break
+        }
+    }
+    if digits && sc.i < len(sc.s) && (sc.s[sc.i] == 'e' || sc.s[sc.i] == 'E') {
+        j := sc.i + 1
+        if j < len(sc.s) && (sc.s[j] == '+' || sc.s[j] == '-') {
+            j++
+        }
+        if j < len(sc.s) && sc.s[j] >= '0' && sc.s[j] <= '9' {
+            for sc.i = j; sc.i < len(sc.s) && sc.s[sc.i] >= '0' && sc.s[sc.i] <= '9'; sc.i++ {
+            }
+        }
+    }
+    f, err := strconv.ParseFloat(sc.s[start:sc.i], 64)
+    if !digits || err != nil {
+        sc.i = start
+        return 0, false
+    }
+    return f, true
+}
+
+// flag reads an arc flag, which may be written without a separator.
+func (sc *svgScanner) flag() (bool, bool) {
+    sc.skip()
+    if sc.i < len(sc.s) && (sc.s[sc.i] == '0' || sc.s[sc.i] == '1') {
+        sc.i++
+        return sc.s[sc.i-1] == '1', true
+    }
+    return false, false
+}
+
+func (sc *svgScanner) numbers(n int) ([]float64, bool) {
+    nums := make([]float64, n)
+    for i := range nums {
+        f, ok := sc.number()
+        if !ok {
+            return nil, false
+        }
+        nums[i] = f
+    }
+    return nums, true
+}
+
+// svgPath collects subpaths in raster coordinates, with curves flattened.
+type svgPath struct {
+    m    svgMatrix
+    subs []svgSubpath
+    // Current and subpath start points in user space.
+    x, y, sx, sy float64
+}
+
+type svgSubpath struct {
+    pts    []svgPoint
+    closed bool
+}
+
+func (p *svgPath) moveTo(x, y float64) {
+    p.x, p.y, p.sx, p.sy = x, y, x, y
+    p.subs = append(p.subs, svgSubpath{pts: []svgPoint{p.m.apply(x, y)}})
+}
+
+func (p *svgPath) lineTo(x, y float64) {
+    if len(p.subs) == 0 || p.subs[len(p.subs)-1].closed {
+        p.moveTo(p.x, p.y)
+    }
+    sub := &p.subs[len(p.subs)-1]
+    sub.pts = append(sub.pts, p.m.apply(x, y))
+    p.x, p.y = x, y
+}
+
+// cubicTo flattens a cubic Bézier into segments of a few raster pixels.
+func (p *svgPath) cubicTo(x1, y1, x2, y2, x, y float64) {
+    if len(p.subs) == 0 || p.subs[len(p.subs)-1].closed {
+        p.moveTo(p.x, p.y)
+    }
+    sub := &p.subs[len(p.subs)-1]
+    p0, p1, p2, p3 := p.m.apply(p.x, p.y), p.m.apply(x1, y1), p.m.apply(x2, y2), p.m.apply(x, y)
+    l := math.Hypot(p1.X-p0.X, p1.Y-p0.Y) + math.Hypot(p2.X-p1.X, p2.Y-p1.Y) + math.Hypot(p3.X-p2.X, p3.Y-p2.Y)
+    n := min(max(int(math.Ceil(l/4)), 1), 256)
+    for i := 1; i < n; i++ {
+        t := float64(i) / float64(n)
+        u := 1 - t
+        a, b, c, d := u*u*u, 3*u*u*t, 3*u*t*t, t*t*t
+        sub.pts = append(sub.pts, svgPoint{a*p0.X + b*p1.X + c*p2.X + d*p3.X, a*p0.Y + b*p1.Y + c*p2.Y + d*p3.Y})
+    }
+    p.lineTo(x, y)
+}
+
+func (p *svgPath) quadTo(x1, y1, x, y float64) {
+    p.cubicTo(p.x+2.0/3*(x1-p.x), p.y+2.0/3*(y1-p.y), x+2.0/3*(x1-x), y+2.0/3*(y1-y), x, y)
+}
+
+// arcTo follows the endpoint parameterization of SVG elliptical arcs,
+// drawing each quarter turn as a cubic.
+func (p *svgPath) arcTo(rx, ry, rotation float64, large, sweep bool, x, y float64) {
+    x0, y0 := p.x, p.y
+    if x0 == x && y0 == y {
+        return
+    }
+    rx, ry = math.Abs(rx), math.Abs(ry)
+    if rx == 0 || ry == 0 {
+        p.lineTo(x, y)
+        return
+    }
+    sin, cos := math.Sincos(rotation * math.Pi / 180)
+    dx, dy := (x0-x)/2, (y0-y)/2
+    x1, y1 := cos*dx+sin*dy, -sin*dx+cos*dy
+    if l := x1*x1/(rx*rx) + y1*y1/(ry*ry); l > 1 {
+        rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+    }
+    num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+    den := rx*rx*y1*y1 + ry*ry*x1*x1
+    co := math.Sqrt(max(num/den, 0))
+    if large == sweep {
+        co = -co
+    }
+    cx1, cy1 := co*rx*y1/ry, -co*ry*x1/rx
+    cx, cy := cos*cx1-sin*cy1+(x0+x)/2, sin*cx1+cos*cy1+(y0+y)/2
+    angle := func(ux, uy, vx, vy float64) float64 {
+        return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+    }
+    ux, uy := (x1-cx1)/rx, (y1-cy1)/ry
+    theta := angle(1, 0, ux, uy)
+    delta := angle(ux, uy, (-x1-cx1)/rx, (-y1-cy1)/ry)
+    if !sweep && delta > 0 {
+        delta -= 2 * math.Pi
+    } else if sweep && delta < 0 {
+        delta += 2 * math.Pi
+    }
+    n := int(math.Ceil(math.Abs(delta) / (math.Pi / 2)))
+    step := delta / float64(n)
+    k := 4.0 / 3 * math.Tan(step/4)
+    at := func(t float64) (px, py, dx, dy float64) {
+        st, ct := math.Sincos(t)
+        return cx + rx*ct*cos - ry*st*sin, cy + rx*ct*sin + ry*st*cos,
+            -rx*st*cos - ry*ct*sin, -rx*st*sin + ry*ct*cos
+    }
+    for i := range n {
+        t1, t2 := theta+float64(i)*step, theta+float64(i+1)*step
+        ax, ay, adx, ady := at(t1)
+        bx, by, bdx, bdy := at(t2)
+        if i == n-1 {
+            bx, by = x, y
+        }
+        p.cubicTo(ax+k*adx, ay+k*ady, bx-k*bdx, by-k*bdy, bx, by)
+    }
+}
+
+func (p *svgPath) close() {
+    if len(p.subs) > 0 {
+        p.subs[len(p.subs)-1].closed = true
+    }
+    p.x, p.y = p.sx, p.sy
+}
+
+// pathData adds the commands of a path's d attribute, stopping at the
+// first error as browsers do.
+func (p *svgPath) pathData(d string) {
+    sc := svgScanner{s: d}
+    var cmd, prev byte
+    var cx, cy float64 // last control point, for S and T
+    for {
+        sc.skip()
+        if sc.i >= len(sc.s) {
+            return
+        }
+        if c := sc.s[sc.i]; c >= 'A' && c <= 'z' && (c <= 'Z' || c >= 'a') {
+            cmd = c
+            sc.i++
+        } else if cmd == 0 || cmd == 'Z' || cmd == 'z' {
+            return
+        }
+        var ox, oy float64
+        if cmd >= 'a' {
+            ox, oy = p.x, p.y
+        }
+        upper := cmd &^ 0x20
+        var a []float64
+        var ok bool
+        switch upper {
+        case 'Z':
+            p.close()
+        case 'M', 'L', 'T':
+            if a, ok = sc.numbers(2); !ok {
+                return
+            }
+            switch upper {
+            case 'M':
+                p.moveTo(ox+a[0], oy+a[1])
+                // Further pairs are lines.
+                cmd = 'L' | cmd&0x20
+            case 'L':
+                p.lineTo(ox+a[0], oy+a[1])
+            case 'T':
+                qx, qy := p.x, p.y
+                if prev == 'Q' || prev == 'T' {
+                    qx, qy = 2*p.x-cx, 2*p.y-cy
+                }
+                p.quadTo(qx, qy, ox+a[0], oy+a[1])
+                cx, cy = qx, qy
+            }
+        case 'H':
+            if a, ok = sc.numbers(1); !ok {
+                return
+            }
+            p.lineTo(ox+a[0], p.y)
+        case 'V':
+            if a, ok = sc.numbers(1); !ok {
+                return
+            }
+            p.lineTo(p.x, oy+a[0])
+        case 'C':
+            if a, ok = sc.numbers(6); !ok {
+                return
+            }
+            p.cubicTo(ox+a[0], oy+a[1], ox+a[2], oy+a[3], ox+a[4], oy+a[5])
+            cx, cy = ox+a[2], oy+a[3]
+        case 'S':
+            if a, ok = sc.numbers(4); !ok {
+                return
+            }
+            x1, y1 := p.x, p.y
+            if prev == 'C' || prev == 'S' {
+                x1, y1 = 2*p.x-cx, 2*p.y-cy
+            }
+            p.cubicTo(x1, y1, ox+a[0], oy+a[1], ox+a[2], oy+a[3])
+            cx, cy = ox+a[0], oy+a[1]
+        case 'Q':
+            if a, ok = sc.numbers(4); !ok {
+                return
+            }
+            p.quadTo(ox+a[0], oy+a[1], ox+a[2], oy+a[3])
+            cx, cy = ox+a[0], oy+a[1]
+        case 'A':
+            if a, ok = sc.numbers(3); !ok {
+                return
+            }
+            large, ok1 := sc.flag()
+            sweep, ok2 := sc.flag()
+            end, ok3 := sc.numbers(2)
+            if !ok1 || !ok2 || !ok3 {
+                return
+            }
+            p.arcTo(a[0], a[1], a[2], large, sweep, ox+end[0], oy+end[1])
+        default:
+            return
+        }
+        prev = upper
+    }
+}
+
+type svgRenderer struct {
+    dst *image.RGBA
+    z   *vector.Rasterizer
+}
+
+// draw renders one element, if it is a shape.
+func (r *svgRenderer) draw(name string, attrs map[string]string, s svgStyle) {
+    num := func(k string) float64 {
+        f, _ := svgLength(attrs[k])
+        return f
+    }
+    p := &svgPath{m: s.m}
+    fill := true
+    switch name {
+    case "path":
+        p.pathData(attrs["d"])
+    case "rect":
+        x, y, w, h := num("x"), num("y"), num("width"), num("height")
+        if w <= 0 || h <= 0 {
+            return
+        }
+        rx, okx := svgLength(attrs["rx"])
+        ry, oky := svgLength(attrs["ry"])
+        if !okx {
+            rx = ry
+        }
+        if !oky {
+            ry = rx
+        }
+        rx, ry = min(rx, w/2), min(ry, h/2)
+        p.moveTo(x+rx, y)
+        p.lineTo(x+w-rx, y)
+        p.arcTo(rx, ry, 0, false, true, x+w, y+ry)
+        p.lineTo(x+w, y+h-ry)
+        p.arcTo(rx, ry, 0, false, true, x+w-rx, y+h)
+        p.lineTo(x+rx, y+h)
+        p.arcTo(rx, ry, 0, false, true, x, y+h-ry)
+        p.lineTo(x, y+ry)
+        p.arcTo(rx, ry, 0, false, true, x+rx, y)
+        p.close()
+    case "circle", "ellipse":
+        cx, cy := num("cx"), num("cy")
+        rx, ry := num("r"), num("r")
+        if name == "ellipse" {
+            rx, ry = num("rx"), num("ry")
+        }
+        if rx <= 0 || ry <= 0 {
+            return
+        }
+        p.moveTo(cx+rx, cy)
+        p.arcTo(rx, ry, 0, false, true, cx-rx, cy)
+        p.arcTo(rx, ry, 0, false, true, cx+rx, cy)
+        p.close()
+    case "line":
+        p.moveTo(num("x1"), num("y1"))
+        p.lineTo(num("x2"), num("y2"))
+        fill = false
+    case "polyline", "polygon":
+        pts := svgNumbers(attrs["points"])
+        if len(pts) < 4 {
+            return
+        }
+        p.moveTo(pts[0], pts[1])
+        for i := 2; i+1 < len(pts); i += 2 {
+            p.lineTo(pts[i], pts[i+1])
+        }
+        if name == "polygon" {
+            p.close()
+        }
+    default:
+        return
+    }
+
+    if fill && s.fill != nil {
+        var polys [][]svgPoint
+        for _, sub := range p.subs {
+            polys = append(polys, sub.pts)
+        }
+        r.fill(polys, *s.fill, s.fillOpacity*s.opacity)
+    }
+    if s.stroke != nil && s.strokeWidth > 0 {
+        hw := s.strokeWidth * s.m.scale() / 2
+        var polys [][]svgPoint
+        for _, sub := range p.subs {
+            polys = append(polys, strokeOutline(sub, hw, s.lineCap)...)
+        }
+        r.fill(polys, *s.stroke, s.strokeOpacity*s.opacity)
+    }
+}
+
+// fill paints the union of polygons, given in raster coordinates.
+func (r *svgRenderer) fill(polys [][]svgPoint, c color.NRGBA, opacity float64) {
+    c.A = uint8(math.Round(float64(c.A) * opacity))
+    if c.A == 0 || len(polys) == 0 {
+        return
+    }
+    minX, minY := math.Inf(1), math.Inf(1)
+    maxX, maxY := math.Inf(-1), math.Inf(-1)
+    for _, poly := range polys {
+        for _, q := range poly {
+            minX, minY = min(minX, q.X), min(minY, q.Y)
+            maxX, maxY = max(maxX, q.X), max(maxY, q.Y)
+        }
+    }
+    if math.IsNaN(minX+minY+maxX+maxY) || math.IsInf(minX+minY+maxX+maxY, 0) {
+        return
+    }
+    bounds := image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY))).Intersect(r.dst.Rect)
+    if bounds.Empty() {
+        return
+    }
+    ox, oy := float64(bounds.Min.X), float64(bounds.Min.Y)
+    r.z.Reset(bounds.Dx(), bounds.Dy())
+    for _, poly := range polys {
+        if len(poly) < 3 {
+            continue
+        }
+        r.z.MoveTo(float32(poly[0].X-ox), float32(poly[0].Y-oy))
+        for _, q := range poly[1:] {
+            r.z.LineTo(float32(q.X-ox), float32(q.Y-oy))
+        }
+        r.z.ClosePath()
+    }
+    r.z.Draw(r.dst, bounds, image.NewUniform(c), image.Point{})
+}
+
+// strokeOutline returns polygons covering a stroke of half width hw along
+// sub: a quad per segment and round joins. They all wind the same way so
+// their overlaps don't cancel.
+func strokeOutline(sub svgSubpath, hw float64, lineCap string) [][]svgPoint {
+    pts := make([]svgPoint, 0, len(sub.pts))
+    for _, q := range sub.pts {
+        if len(pts) == 0 || q != pts[len(pts)-1] {
+            pts = append(pts, q)
+        }
+    }
+    if sub.closed && len(pts) > 1 && pts[0] == pts[len(pts)-1] {
+        pts = pts[:len(pts)-1]
+    }
+    if len(pts) == 0 {
+        return nil
+    }
+    if len(pts) == 1 {
+        if lineCap == "round" {
+            return [][]svgPoint{svgDisc(pts[0], hw)}
+        }
+        return nil
+    }
+
+    var polys [][]svgPoint
+    segments := len(pts) - 1
+    if sub.closed {
+        segments = len(pts)
+    }
+    for i := range segments {
+        a, b := pts[i], pts[(i+1)%len(pts)]
+        l := math.Hypot(b.X-a.X, b.Y-a.Y)
+        ux, uy := (b.X-a.X)/l, (b.Y-a.Y)/l
+        if !sub.closed && lineCap == "square" {
+            if i == 0 {
+                a = svgPoint{a.X - ux*hw, a.Y - uy*hw}
+            }
+            if i == segments-1 {
+                b = svgPoint{b.X + ux*hw, b.Y + uy*hw}
+            }
+        }
+        nx, ny := -uy*hw, ux*hw
+        polys = append(polys, svgOriented([]svgPoint{
+            {a.X + nx, a.Y + ny}, {b.X + nx, b.Y + ny}, {b.X - nx, b.Y - ny}, {a.X - nx, a.Y - ny},
+        }))
+    }
+    for i, q := range pts {
+        end := !sub.closed && (i == 0 || i == len(pts)-1)
+        if !end || lineCap == "round" {
+            polys = append(polys, svgDisc(q, hw))
+        }
+    }
+    return polys
+}
+
+func svgDisc(c svgPoint, radius float64) []svgPoint {
+    n := min(max(int(math.Ceil(radius*math.Pi)), 8), 64)
+    pts := make([]svgPoint, n)
+    for i := range pts {
+        sin, cos := math.Sincos(2 * math.Pi * float64(i) / float64(n))
+        pts[i] = svgPoint{c.X + radius*cos, c.Y + radius*sin}
+    }
+    return pts
+}
+
+// svgOriented returns poly wound clockwise in raster coordinates, like
+// svgDisc.
+func svgOriented(poly []svgPoint) []svgPoint {
+    var area float64
+    for i, a := range poly {
+        b := poly[(i+1)%len(poly)]
+        area += a.X*b.Y - b.X*a.Y
+    }
+    if area < 0 {
+        for i, j := 0, len(poly)-1; i < j; i, j = i+1, j-1 {
+            poly[i], poly[j] = poly[j], poly[i]
+        }
+    }
+    return poly
+}
@@ -0,0 +1,173 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "slices"
+    "strings"
+)
+
+// Template is a named nested image the file reuses, a stamp such as a
+// detail callout in a circuit diagram. Any number of link regions can
+// reference it, with EditLinks and its Nested index, and PlaceTemplate
+// draws it into the main image.
+type Template struct {
+    Name string
+    // Nested numbers the nested image from 1, like links.
+    Nested uint32
+    // Placements are the top-left corners PlaceTemplate drew the template
+    // at, in order.
+    Placements []image.Point
+}
+
+// Template returns the template with the given name, or nil.
+func (nif *NestedImageFile) Template(name string) *Template {
+    i, ok := slices.BinarySearchFunc(nif.Templates, name, func(t Template, name string) int {
+        return strings.Compare(t.Name, name)
+    })
+    if !ok {
+        return nil
+    }
+    return &nif.Templates[i]
+}
+
+// AddTemplate appends ni to the nested images as a template named name,
+// keeping Templates sorted by name.
+func (nif *NestedImageFile) AddTemplate(name string, ni NestedImage) (*Template, error) {
+    if name == "" || len(name) > math.MaxUint16 {
+        return nil, fmt.Errorf("invalid template name %q", name)
+    }
+    i, ok := slices.BinarySearchFunc(nif.Templates, name, func(t Template, name string) int {
+        return strings.Compare(t.Name, name)
+    })
+    if ok {
+        return nil, fmt.Errorf("file already has a template %q", name)
+    }
+    nif.NestedImages = append(nif.NestedImages, ni)
+    nif.Header.NestedCount = uint32(len(nif.NestedImages))
+    nif.Templates = slices.Insert(nif.Templates, i, Template{Name: name, Nested: uint32(len(nif.NestedImages))})
+    return &nif.Templates[i], nil
+}
+
+// PlaceTemplate draws the named template into the main image with its
+// top-left corner at at, links the pixels it covers to it and records the
+// placement. It returns the pixels changed, which are clipped to the main
+// image.
+func (nif *NestedImageFile) PlaceTemplate(name string, at image.Point) (image.Rectangle, error) {
+    t := nif.Template(name)
+    if t == nil {
+        return image.Rectangle{}, fmt.Errorf("file has no template %q", name)
+    }
+    if t.Nested == 0 || int(t.Nested) > len(nif.NestedImages) {
+        return image.Rectangle{}, fmt.Errorf("template %q links to nested image %d of %d", name, t.Nested, len(nif.NestedImages))
+    }
+    ni := &nif.NestedImages[t.Nested-1]
+    rect := image.Rect(0, 0, int(ni.Width), int(ni.Height)).Add(at).Intersect(nif.Bounds())
+    for y := rect.Min.Y; y < rect.Max.Y; y++ {
+        for x := rect.Min.X; x < rect.Max.X; x++ {
+            i := ((y-at.Y)*int(ni.Width) + x - at.X) * 3
+            if i+2 >= len(ni.Data) {
+                continue
+            }
+            nif.MainImage[y][x] = PixeLink{R: ni.Data[i], G: ni.Data[i+1], B: ni.Data[i+2], NestedIdx: t.Nested}
+        }
+    }
+    t.Placements = append(t.Placements, at)
+    nif.record(CollabOp{Kind: CollabLinks, Rect: rect, Link: t.Nested})
+    nif.audit(AuditPlaceTemplate, name, rect)
+    return rect, nil
+}
+
+func (nif *NestedImageFile) checkTemplates() error {
+    for i, t := range nif.Templates {
+        if t.Name == "" || len(t.Name) > math.MaxUint16 {
+            return fmt.Errorf("invalid template name %q", t.Name)
+        }
+        if i > 0 && nif.Templates[i-1].Name >= t.Name {
+            return fmt.Errorf("templates are not sorted by unique name at %q", t.Name)
+        }
+        if t.Nested == 0 || int(t.Nested) > len(nif.NestedImages) {
+            return fmt.Errorf("template %q links to nested image %d of %d", t.Name, t.Nested, len(nif.NestedImages))
+        }
+        if len(t.Placements) > math.MaxUint32 {
+            return fmt.Errorf("template %q has too many placements to store", t.Name)
+        }
+    }
+    return nil
+}
+
+// The template library is stored in a TMPL chunk, sorted by name:
+//
+//	count uint32 | count * (name length uint16 | name | nested uint32 |
+//	    placement count uint32 | placements * (x int32 | y int32))
+func encodeTemplates(templates []Template, order binary.ByteOrder) []byte {
+    var buf bytes.Buffer
+    binary.Write(&buf, order, uint32(len(templates)))
+    for _, t := range templates {
+        binary.Write(&buf, order, uint16(len(t.Name)))
+        buf.WriteString(t.Name)
+        binary.Write(&buf, order, t.Nested)
+        binary.Write(&buf, order, uint32(len(t.Placements)))
+        for _, p := range t.Placements {
+            binary.Write(&buf, order, [2]int32{int32(p.X), int32(p.Y)})
+        }
+    }
+    return buf.Bytes()
+}
+
+func decodeTemplates(reader io.Reader, order binary.ByteOrder, length uint64) ([]Template, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkTemplates, err)
+    }
+    r := bytes.NewReader(data)
+    fail := func(err error) ([]Template, error) {
+        return nil, fmt.Errorf("failed to decode %s chunk: %w", ChunkTemplates, err)
+    }
+    var count uint32
+    if err := binary.Read(r, order, &count); err != nil {
+        return fail(err)
+    }
+    if int64(count)*10 > int64(r.Len()) {
+        return fail(fmt.Errorf("%d templates do not fit in %d bytes", count, r.Len()))
+    }
+    templates := make([]Template, count)
+    for i := range templates {
+        t := &templates[i]
+        var n uint16
+        if err := binary.Read(r, order, &n); err != nil {
+            return fail(err)
+        }
+        name := make([]byte, n)
+        if _, err := io.ReadFull(r, name); err != nil {
+            return fail(err)
+        }
+        t.Name = string(name)
+        var fixed struct {
+            Nested     uint32
+            Placements uint32
+        }
+        if err := binary.Read(r, order, &fixed); err != nil {
+            return fail(err)
+        }
+        if int64(fixed.Placements)*8 > int64(r.Len()) {
+            return fail(fmt.Errorf("template %q placements are truncated", t.Name))
+        }
+        t.Nested = fixed.Nested
+        points := make([][2]int32, fixed.Placements)
+        if err := binary.Read(r, order, points); err != nil {
+            return fail(err)
+        }
+        for _, p := range points {
+            t.Placements = append(t.Placements, image.Pt(int(p[0]), int(p[1])))
+        }
+    }
+    slices.SortFunc(templates, func(a, b Template) int {
+        return strings.Compare(a.Name, b.Name)
+    })
+    return templates, nil
+}
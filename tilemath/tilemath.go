@@ -0,0 +1,166 @@
+// Package tilemath converts between pixel, tile and pyramid coordinates and
+// Bing-style quadkeys for tiled NEST images.
+package tilemath
+
+import (
+    "fmt"
+    "image"
+    "strings"
+)
+
+// Grid describes an image of Width x Height pixels cut into square tiles.
+// Edge tiles extend past the image; TileBounds clips them.
+type Grid struct {
+    Width    int
+    Height   int
+    TileSize int
+}
+
+func NewGrid(width, height, tileSize int) Grid {
+    return Grid{Width: width, Height: height, TileSize: tileSize}
+}
+
+func (g Grid) Cols() int {
+    if g.TileSize <= 0 {
+        return 0
+    }
+    return (g.Width + g.TileSize - 1) / g.TileSize
+}
+
+func (g Grid) Rows() int {
+    if g.TileSize <= 0 {
+        return 0
+    }
+    return (g.Height + g.TileSize - 1) / g.TileSize
+}
+
+func (g Grid) Bounds() image.Rectangle {
+    return image.Rect(0, 0, g.Width, g.Height)
+}
+
+func (g Grid) Contains(tx, ty int) bool {
+    return tx >= 0 && ty >= 0 && tx < g.Cols() && ty < g.Rows()
+}
+
+// TileAt returns the tile containing pixel (x, y).
+func (g Grid) TileAt(x, y int) (tx, ty int) {
+    return floorDiv(x, g.TileSize), floorDiv(y, g.TileSize)
+}
+
+// TileOrigin returns the pixel position of the top-left corner of a tile.
+func (g Grid) TileOrigin(tx, ty int) image.Point {
+    return image.Pt(tx*g.TileSize, ty*g.TileSize)
+}
+
+// TileBounds returns the pixels of a tile that lie inside the image.
+func (g Grid) TileBounds(tx, ty int) image.Rectangle {
+    o := g.TileOrigin(tx, ty)
+    return image.Rect(o.X, o.Y, o.X+g.TileSize, o.Y+g.TileSize).Intersect(g.Bounds())
+}
+
+// TileRange returns the tiles overlapping rect as a rectangle in tile
+// coordinates (Max exclusive). It is empty when rect misses the image.
+func (g Grid) TileRange(rect image.Rectangle) image.Rectangle {
+    rect = rect.Intersect(g.Bounds())
+    if rect.Empty() || g.TileSize <= 0 {
+        return image.Rectangle{}
+    }
+    x0, y0 := g.TileAt(rect.Min.X, rect.Min.Y)
+    x1, y1 := g.TileAt(rect.Max.X-1, rect.Max.Y-1)
+    return image.Rect(x0, y0, x1+1, y1+1)
+}
+
+// Level returns the grid of pyramid level n, where level 0 is full
+// resolution and each level halves both dimensions, rounding up.
+func (g Grid) Level(n int) Grid {
+    w, h := g.Width, g.Height
+    for i := 0; i < n; i++ {
+        w, h = (w+1)/2, (h+1)/2
+    }
+    return Grid{Width: w, Height: h, TileSize: g.TileSize}
+}
+
+// Levels returns how many pyramid levels it takes until the whole image fits
+// in a single tile, counting level 0.
+func (g Grid) Levels() int {
+    if g.TileSize <= 0 || g.Width <= 0 || g.Height <= 0 {
+        return 0
+    }
+    n := 1
+    for l := g; l.Cols() > 1 || l.Rows() > 1; n++ {
+        l = g.Level(n)
+    }
+    return n
+}
+
+// ToLevel maps a full resolution pixel position to pyramid level n.
+func ToLevel(p image.Point, n int) image.Point {
+    return image.Pt(p.X>>n, p.Y>>n)
+}
+
+// FromLevel maps a pixel position on pyramid level n to full resolution.
+func FromLevel(p image.Point, n int) image.Point {
+    return image.Pt(p.X<<n, p.Y<<n)
+}
+
+// RectToLevel maps a full resolution rectangle to pyramid level n, growing it
+// so every touched pixel is covered.
+func RectToLevel(r image.Rectangle, n int) image.Rectangle {
+    scale := 1 << n
+    return image.Rect(floorDiv(r.Min.X, scale), floorDiv(r.Min.Y, scale),
+        -floorDiv(-r.Max.X, scale), -floorDiv(-r.Max.Y, scale))
+}
+
+// Zoom converts a pyramid level into a quadkey zoom, where zoom 0 is the
+// coarsest level and zoom levels-1 is full resolution.
+func Zoom(level, levels int) int {
+    return levels - 1 - level
+}
+
+// QuadKey encodes a tile position at the given zoom as a Bing-style quadkey.
+func QuadKey(tx, ty, zoom int) string {
+    var sb strings.Builder
+    for i := zoom; i > 0; i-- {
+        digit := byte('0')
+        mask := 1 << (i - 1)
+        if tx&mask != 0 {
+            digit++
+        }
+        if ty&mask != 0 {
+            digit += 2
+        }
+        sb.WriteByte(digit)
+    }
+    return sb.String()
+}
+
+func ParseQuadKey(key string) (tx, ty, zoom int, err error) {
+    zoom = len(key)
+    for i := zoom; i > 0; i-- {
+        mask := 1 << (i - 1)
+        switch key[zoom-i] {
+        case '0':
+        case '1':
+            tx |= mask
+        case '2':
+            ty |= mask
+        case '3':
+            tx |= mask
+            ty |= mask
+        default:
+            return 0, 0, 0, fmt.Errorf("invalid quadkey digit %q in %q", key[zoom-i], key)
+        }
+    }
+    return tx, ty, zoom, nil
+}
+
+func floorDiv(a, b int) int {
+    if b <= 0 {
+        return 0
+    }
+    q := a / b
+    if (a%b != 0) && ((a < 0) != (b < 0)) {
+        q--
+    }
+    return q
+}
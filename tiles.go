@@ -0,0 +1,205 @@
+package nest
+
+import (
+    "encoding/binary"
+    "fmt"
+    "math"
+    "sort"
+    "unsafe"
+
+    "github.com/70ziko/NEST/tilemath"
+)
+
+type TileOrder uint8
+
+const (
+    RowMajor TileOrder = iota
+    HilbertOrder
+    CenterOut
+)
+
+func (o TileOrder) String() string {
+    switch o {
+    case RowMajor:
+        return "row-major"
+    case HilbertOrder:
+        return "hilbert"
+    case CenterOut:
+        return "center-out"
+    }
+    return "unknown"
+}
+
+func ParseTileOrder(s string) (TileOrder, error) {
+    for _, o := range []TileOrder{RowMajor, HilbertOrder, CenterOut} {
+        if o.String() == s {
+            return o, nil
+        }
+    }
+    return RowMajor, fmt.Errorf("unknown tile order %q", s)
+}
+
+// TileCoord addresses a tile by column and row in the tile grid.
+type TileCoord struct {
+    X, Y int
+}
+
+func tileGrid(width, height uint32, tileSize uint16) (cols, rows int) {
+    g := tilemath.NewGrid(int(width), int(height), int(tileSize))
+    return g.Cols(), g.Rows()
+}
+
+func tileSequence(order TileOrder, cols, rows int) []TileCoord {
+    seq, _ := orderTiles(order, cols, rows, nil)
+    return seq
+}
+
+// orderTiles is tileSequence for decoders, which stops with
+// ErrDecodeTimeout once budget's deadline passes.
+func orderTiles(order TileOrder, cols, rows int, budget *memoryBudget) ([]TileCoord, error) {
+    if err := budget.reserve(int64(cols)*int64(rows)*int64(unsafe.Sizeof(TileCoord{})), "tile order"); err != nil {
+        return nil, err
+    }
+    seq := make([]TileCoord, 0, cols*rows)
+    switch order {
+    case HilbertOrder:
+        n := 1
+        for n < cols || n < rows {
+            n <<= 1
+        }
+        return hilbertTiles(seq, n, 0, n, cols, rows, budget)
+    case CenterOut:
+        // Sort on keys computed once per tile rather than in every
+        // comparison, breaking ties by row-major position.
+        if err := budget.reserve(int64(cols)*int64(rows)*int64(unsafe.Sizeof(centerOutKey{})), "tile order"); err != nil {
+            return nil, err
+        }
+        keys := make([]centerOutKey, 0, cols*rows)
+        cx, cy := float64(cols-1)/2, float64(rows-1)/2
+        for y := 0; y < rows; y++ {
+            if err := budget.check(); err != nil {
+                return nil, err
+            }
+            for x := 0; x < cols; x++ {
+                seq = append(seq, TileCoord{x, y})
+                dx, dy := float64(x)-cx, float64(y)-cy
+                keys = append(keys, centerOutKey{math.Hypot(dx, dy), math.Atan2(dy, dx), len(keys)})
+            }
+        }
+        t := &centerOutTiles{seq: seq, keys: keys, budget: budget}
+        sort.Sort(t)
+        if t.err != nil {
+            return nil, t.err
+        }
+        return seq, budget.check()
+    default:
+        for y := 0; y < rows; y++ {
+            if err := budget.check(); err != nil {
+                return nil, err
+            }
+            for x := 0; x < cols; x++ {
+                seq = append(seq, TileCoord{x, y})
+            }
+        }
+    }
+    return seq, nil
+}
+
+// centerOutKey orders a tile by its distance from the center of the grid,
+// then by its angle around it.
+type centerOutKey struct {
+    dist, angle float64
+    pos         int
+}
+
+// centerOutTiles sorts tiles by their keys. Once the budget's deadline
+// passes it records the error and treats every tile as equal, so the sort
+// ends quickly.
+type centerOutTiles struct {
+    seq    []TileCoord
+    keys   []centerOutKey
+    budget *memoryBudget
+    calls  int
+    err    error
+}
+
+func (t *centerOutTiles) Len() int { return len(t.seq) }
+
+func (t *centerOutTiles) Less(i, j int) bool {
+    if t.calls++; t.calls%(1<<16) == 0 && t.err == nil {
+        t.err = t.budget.check()
+    }
+    if t.err != nil {
+        return false
+    }
+    a, b := t.keys[i], t.keys[j]
+    if a.dist != b.dist {
+        return a.dist < b.dist
+    }
+    if a.angle != b.angle {
+        return a.angle < b.angle
+    }
+    return a.pos < b.pos
+}
+
+func (t *centerOutTiles) Swap(i, j int) {
+    t.seq[i], t.seq[j] = t.seq[j], t.seq[i]
+    t.keys[i], t.keys[j] = t.keys[j], t.keys[i]
+}
+
+// hilbertTiles appends the tiles of a cols×rows grid that a Hilbert curve
+// over an n×n grid visits from distance d to d+s*s. Those distances fill an
+// aligned s×s square, which is skipped whole when it lies outside the grid,
+// so long thin grids don't walk the full n×n square.
+func hilbertTiles(seq []TileCoord, n, d, s, cols, rows int, budget *memoryBudget) ([]TileCoord, error) {
+    x, y := hilbertPoint(n, d)
+    if x/s*s >= cols || y/s*s >= rows {
+        return seq, nil
+    }
+    if s == 1 {
+        return append(seq, TileCoord{x, y}), nil
+    }
+    if s >= 16 {
+        if err := budget.check(); err != nil {
+            return nil, err
+        }
+    }
+    q := s / 2
+    for i := 0; i < 4; i++ {
+        var err error
+        if seq, err = hilbertTiles(seq, n, d+i*q*q, q, cols, rows, budget); err != nil {
+            return nil, err
+        }
+    }
+    return seq, nil
+}
+
+// hilbertPoint maps distance d along a Hilbert curve filling an n×n grid
+// (n a power of two) to grid coordinates.
+func hilbertPoint(n, d int) (x, y int) {
+    for s := 1; s < n; s <<= 1 {
+        rx := 1 & (d / 2)
+        ry := 1 & (d ^ rx)
+        if ry == 0 {
+            if rx == 1 {
+                x = s - 1 - x
+                y = s - 1 - y
+            }
+            x, y = y, x
+        }
+        x += s * rx
+        y += s * ry
+        d /= 4
+    }
+    return x, y
+}
+
+func encodeTile(tile []PixeLink, order binary.ByteOrder) []byte {
+    buf := make([]byte, len(tile)*pixeLinkDiskSize)
+    for i, p := range tile {
+        b := buf[i*pixeLinkDiskSize:]
+        b[0], b[1], b[2] = p.R, p.G, p.B
+        order.PutUint32(b[3:7], p.NestedIdx)
+    }
+    return buf
+}
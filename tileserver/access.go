@@ -0,0 +1,101 @@
+package tileserver
+
+import (
+    "errors"
+    "image"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// ErrUnauthenticated can be returned, possibly wrapped, by an Authorize
+// callback to answer 401 instead of 403.
+var ErrUnauthenticated = errors.New("authentication required")
+
+// CORS configures cross-origin access. Preflight requests are answered by
+// the handler itself.
+type CORS struct {
+    // AllowedOrigins lists origins that may read responses, or "*" for any.
+    AllowedOrigins []string
+    // AllowedHeaders are accepted in preflight requests in addition to the
+    // CORS-safelisted ones, for example "Authorization".
+    AllowedHeaders []string
+    // MaxAge in seconds lets browsers cache preflight results. Zero omits it.
+    MaxAge int
+}
+
+func (c *CORS) allowOrigin(origin string) string {
+    for _, o := range c.AllowedOrigins {
+        if o == "*" {
+            return "*"
+        }
+        if o == origin {
+            return origin
+        }
+    }
+    return ""
+}
+
+// setCORS adds the CORS response headers and reports whether r was a
+// preflight request that has now been answered.
+func (h *Handler) setCORS(w http.ResponseWriter, r *http.Request) bool {
+    c := h.opts.CORS
+    if c == nil {
+        return false
+    }
+    if !slices.Contains(c.AllowedOrigins, "*") {
+        w.Header().Add("Vary", "Origin")
+    }
+    origin := r.Header.Get("Origin")
+    allowed := c.allowOrigin(origin)
+    if origin == "" || allowed == "" {
+        return false
+    }
+    w.Header().Set("Access-Control-Allow-Origin", allowed)
+    w.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Length, Content-Range")
+    if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+        return false
+    }
+    if h.editor != nil {
+        w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, PUT")
+    } else {
+        w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+    }
+    if len(c.AllowedHeaders) > 0 {
+        w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+    }
+    if c.MaxAge > 0 {
+        w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+    }
+    w.WriteHeader(http.StatusNoContent)
+    return true
+}
+
+// authorize runs the Authorize callback for every tile under rect and
+// writes the error response if one refuses.
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, rect image.Rectangle) bool {
+    if h.opts.Authorize == nil {
+        return true
+    }
+    tiles := h.reader.Grid().TileRange(rect)
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            if err := h.opts.Authorize(r, nest.TileCoord{X: tx, Y: ty}); err != nil {
+                h.refuse(w, err)
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func (h *Handler) refuse(w http.ResponseWriter, err error) {
+    status := http.StatusForbidden
+    if errors.Is(err, ErrUnauthenticated) {
+        status = http.StatusUnauthorized
+    }
+    http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,67 @@
+package tileserver
+
+import (
+    "container/list"
+    "sync"
+)
+
+// cache is an LRU of encoded responses bounded by their total size.
+type cache struct {
+    mu    sync.Mutex
+    limit int64
+    size  int64
+    order *list.List
+    items map[string]*list.Element
+}
+
+type cacheEntry struct {
+    key         string
+    contentType string
+    body        []byte
+}
+
+func newCache(limit int64) *cache {
+    return &cache{limit: limit, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *cache) get(key string) (*cacheEntry, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    el, ok := c.items[key]
+    if !ok {
+        return nil, false
+    }
+    c.order.MoveToFront(el)
+    return el.Value.(*cacheEntry), true
+}
+
+// clear drops every entry, after the file behind them changed.
+func (c *cache) clear() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.order.Init()
+    clear(c.items)
+    c.size = 0
+}
+
+func (c *cache) put(e *cacheEntry) {
+    n := int64(len(e.body))
+    if n > c.limit {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if el, ok := c.items[e.key]; ok {
+        c.size -= int64(len(el.Value.(*cacheEntry).body))
+        c.order.Remove(el)
+    }
+    c.items[e.key] = c.order.PushFront(e)
+    c.size += n
+    for c.size > c.limit {
+        el := c.order.Back()
+        old := el.Value.(*cacheEntry)
+        c.order.Remove(el)
+        delete(c.items, old.key)
+        c.size -= int64(len(old.body))
+    }
+}
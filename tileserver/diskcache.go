@@ -0,0 +1,154 @@
+package tileserver
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+)
+
+// DefaultCacheDirBytes bounds the disk cache when Options.CacheDirBytes is
+// zero.
+const DefaultCacheDirBytes = 1 << 30
+
+const diskCacheExt = ".tile"
+
+// diskCache keeps encoded responses as files named after their ETag. ETags
+// derive from the key and the tile checksums, so entries stay valid across
+// restarts and a changed file simply misses. Each file is
+//
+//	content type | '\n' | body
+type diskCache struct {
+    dir   string
+    limit int64
+
+    mu   sync.Mutex
+    size int64
+}
+
+func newDiskCache(dir string, limit int64) (*diskCache, error) {
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, err
+    }
+    c := &diskCache{dir: dir, limit: limit}
+    entries, err := c.entries()
+    if err != nil {
+        return nil, err
+    }
+    for _, e := range entries {
+        c.size += e.size
+    }
+    return c, nil
+}
+
+func (c *diskCache) path(etag string) string {
+    return filepath.Join(c.dir, strings.Trim(etag, `"`)+diskCacheExt)
+}
+
+func (c *diskCache) get(etag string) (*cacheEntry, bool) {
+    path := c.path(etag)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, false
+    }
+    contentType, body, ok := bytes.Cut(data, []byte{'\n'})
+    if !ok {
+        return nil, false
+    }
+    // The modification time orders eviction, so reads keep entries alive.
+    now := time.Now()
+    os.Chtimes(path, now, now)
+    return &cacheEntry{contentType: string(contentType), body: body}, true
+}
+
+// put writes e through a temporary file so a crash never leaves a torn
+// entry behind. Errors are ignored; the disk cache is only an optimization.
+func (c *diskCache) put(etag string, e *cacheEntry) {
+    n := int64(len(e.contentType) + 1 + len(e.body))
+    if n > c.limit {
+        return
+    }
+    tmp, err := os.CreateTemp(c.dir, "put-*")
+    if err != nil {
+        return
+    }
+    _, err = tmp.WriteString(e.contentType + "\n")
+    if err == nil {
+        _, err = tmp.Write(e.body)
+    }
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        return
+    }
+
+    // The entry may replace one already counted, so the old size is taken
+    // under the lock, together with the rename.
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    path := c.path(etag)
+    var old int64
+    if info, err := os.Stat(path); err == nil {
+        old = info.Size()
+    }
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        os.Remove(tmp.Name())
+        return
+    }
+    c.size += n - old
+    if c.size > c.limit {
+        c.evict()
+    }
+}
+
+type diskCacheFile struct {
+    path    string
+    size    int64
+    modTime time.Time
+}
+
+func (c *diskCache) entries() ([]diskCacheFile, error) {
+    dir, err := os.ReadDir(c.dir)
+    if err != nil {
+        return nil, err
+    }
+    var files []diskCacheFile
+    for _, d := range dir {
+        if d.IsDir() || filepath.Ext(d.Name()) != diskCacheExt {
+            continue
+        }
+        info, err := d.Info()
+        if err != nil {
+            continue
+        }
+        files = append(files, diskCacheFile{filepath.Join(c.dir, d.Name()), info.Size(), info.ModTime()})
+    }
+    return files, nil
+}
+
+// evict removes the least recently used files until the cache is down to
+// three quarters of its limit, so eviction doesn't run on every put.
+func (c *diskCache) evict() {
+    files, err := c.entries()
+    if err != nil {
+        return
+    }
+    slices.SortFunc(files, func(a, b diskCacheFile) int { return a.modTime.Compare(b.modTime) })
+    c.size = 0
+    for _, f := range files {
+        c.size += f.size
+    }
+    for _, f := range files {
+        if c.size <= c.limit/4*3 {
+            break
+        }
+        if os.Remove(f.path) == nil {
+            c.size -= f.size
+        }
+    }
+}
@@ -0,0 +1,357 @@
+package tileserver
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "net/http"
+    "os"
+    "strconv"
+
+    nest "github.com/70ziko/NEST"
+    "github.com/70ziko/NEST/colorspace"
+)
+
+// DefaultMaxUploadBytes bounds the body of an upload when
+// Options.MaxUploadBytes is zero.
+const DefaultMaxUploadBytes = 32 << 20
+
+// Editor applies uploaded tiles and nested images to a file on disk. Every
+// upload is recorded in the file's audit log under the uploader's name and
+// saved before it is acknowledged. Tiles of files that store them
+// uncompressed are written in place with nest.PasteImageWithOptions, under
+// the file's exclusive lock; other uploads rewrite the file through a
+// journal, so an interrupted save resumes where it stopped. An Editor is not
+// safe for concurrent use; the handler NewEditable returns serializes
+// uploads.
+type Editor struct {
+    path   string
+    opts   nest.WriteOptions
+    nif    *nest.NestedImageFile
+    file   *os.File
+    reader *nest.Reader
+    // stale is set once the file is edited in place, until nif is read
+    // again.
+    stale bool
+}
+
+// OpenEditor loads the file at path for editing. opts are used for every
+// save, with Journal always set.
+func OpenEditor(path string, opts nest.WriteOptions) (*Editor, error) {
+    nif, err := nest.ReadNestedImageFile(path)
+    if err != nil {
+        return nil, err
+    }
+    opts.Journal = true
+    e := &Editor{path: path, opts: opts, nif: nif}
+    if nif.Audit == nil {
+        nif.EnableAudit("")
+    }
+    if err := e.open(); err != nil {
+        return nil, err
+    }
+    return e, nil
+}
+
+// open replaces the reader with one over the saved file.
+func (e *Editor) open() error {
+    file, err := os.Open(e.path)
+    if err != nil {
+        return err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return err
+    }
+    reader, err := nest.NewReader(file, info.Size())
+    if err != nil {
+        file.Close()
+        return fmt.Errorf("%s: %w", e.path, err)
+    }
+    if e.file != nil {
+        e.file.Close()
+    }
+    e.file, e.reader = file, reader
+    return nil
+}
+
+// Reader reads the file as last saved. Each save replaces it and closes the
+// previous one.
+func (e *Editor) Reader() *nest.Reader {
+    return e.reader
+}
+
+// Close releases the saved file.
+func (e *Editor) Close() error {
+    return e.file.Close()
+}
+
+// load reads the file again if it was edited in place since nif was read.
+func (e *Editor) load() error {
+    if !e.stale {
+        return nil
+    }
+    nif, err := nest.ReadNestedImageFile(e.path)
+    if err != nil {
+        return err
+    }
+    e.nif, e.stale = nif, false
+    return nil
+}
+
+func (e *Editor) save() error {
+    if err := nest.WriteNestedImageFileWithOptions(e.path, e.nif, e.opts); err != nil {
+        return fmt.Errorf("failed to save %s: %w", e.path, err)
+    }
+    return e.open()
+}
+
+// PutTile replaces the colors of tile (tx, ty) with img, assumed to be
+// sRGB, keeping links. img must be the size of the tile, which is cropped
+// at the image edge. The tile is rewritten in place when the file stores
+// tiles uncompressed. Otherwise the file is saved whole, and a failed save
+// leaves the change in memory for the next one to write.
+func (e *Editor) PutTile(actor string, tx, ty int, img image.Image) error {
+    grid := e.reader.Grid()
+    if !grid.Contains(tx, ty) {
+        return fmt.Errorf("file has no tile (%d, %d)", tx, ty)
+    }
+    rect := grid.TileBounds(tx, ty)
+    b := img.Bounds()
+    if b.Dx() != rect.Dx() || b.Dy() != rect.Dy() {
+        return fmt.Errorf("tile (%d, %d) is %dx%d, the upload is %dx%d", tx, ty, rect.Dx(), rect.Dy(), b.Dx(), b.Dy())
+    }
+    detail := fmt.Sprintf("uploaded tile (%d, %d)", tx, ty)
+    if err := e.pasteTile(actor, detail, rect, img); !errors.Is(err, nest.ErrNotEditableInPlace) {
+        return err
+    }
+
+    if err := e.load(); err != nil {
+        return err
+    }
+    space := e.nif.Header.ColorSpace
+    for y := 0; y < rect.Dy(); y++ {
+        for x := 0; x < rect.Dx(); x++ {
+            r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+            p := e.nif.UncheckedAt(rect.Min.X+x, rect.Min.Y+y)
+            p.R, p.G, p.B = colorspace.Convert8(uint8(r>>8), uint8(g>>8), uint8(bl>>8), colorspace.SRGB, space)
+            e.nif.UncheckedSet(rect.Min.X+x, rect.Min.Y+y, p)
+        }
+    }
+    e.nif.Audit.Actor = actor
+    e.nif.Audit.Append(nest.AuditSetPixels, detail, rect)
+    return e.save()
+}
+
+// pasteTile writes img over the tile at rect in place, replacing its colors
+// whatever their alpha, as PutTile does for saved files.
+func (e *Editor) pasteTile(actor, detail string, rect image.Rectangle, img image.Image) error {
+    opaque := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+    b := img.Bounds()
+    for y := 0; y < rect.Dy(); y++ {
+        for x := 0; x < rect.Dx(); x++ {
+            r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+            i := opaque.PixOffset(x, y)
+            opaque.Pix[i], opaque.Pix[i+1], opaque.Pix[i+2], opaque.Pix[i+3] = uint8(r>>8), uint8(g>>8), uint8(bl>>8), 0xff
+        }
+    }
+    f, err := nest.OpenExclusive(e.path)
+    if err != nil {
+        return err
+    }
+    err = nest.PasteImageWithOptions(f, opaque, rect.Min, nest.PasteOptions{Actor: actor, Detail: detail})
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return err
+    }
+    e.stale = true
+    return e.open()
+}
+
+// PutNested replaces nested image i, numbered from 1 like links, with img
+// and keeps its role. i one past the last nested image appends.
+func (e *Editor) PutNested(actor string, i int, img image.Image) error {
+    if err := e.load(); err != nil {
+        return err
+    }
+    if i < 1 || i > len(e.nif.NestedImages)+1 {
+        return fmt.Errorf("file has %d nested images, cannot put %d", len(e.nif.NestedImages), i)
+    }
+    ni, err := nest.NewNestedImage(img)
+    if err != nil {
+        return err
+    }
+    if i > len(e.nif.NestedImages) {
+        e.nif.NestedImages = append(e.nif.NestedImages, ni)
+        e.nif.Header.NestedCount = uint32(len(e.nif.NestedImages))
+    } else {
+        ni.Role = e.nif.NestedImages[i-1].Role
+        e.nif.NestedImages[i-1] = ni
+    }
+    e.nif.Audit.Actor = actor
+    e.nif.Audit.Append(nest.AuditSetNested, fmt.Sprintf("uploaded nested image %d", i))
+    return e.save()
+}
+
+// NewEditable returns a handler for the editor's file that also accepts
+//
+//	PUT /tiles/{x}/{y}  a PNG or JPEG tile, the size GET /tiles returns
+//	PUT /nested/{i}     a PNG or JPEG nested image; i one past the last appends
+//
+// answering 204 once the upload is saved. Uploads are refused unless
+// Options.AuthorizeWrite or AuthorizeNestedWrite allows them.
+func NewEditable(editor *Editor, opts Options) (*Handler, error) {
+    h, err := New(editor.Reader(), opts)
+    if err != nil {
+        return nil, err
+    }
+    if h.opts.MaxUploadBytes <= 0 {
+        h.opts.MaxUploadBytes = DefaultMaxUploadBytes
+    }
+    h.editor = editor
+    h.mux.HandleFunc("PUT /tiles/{x}/{y}", h.putTile)
+    h.mux.HandleFunc("PUT /nested/{i}", h.putNested)
+    return h, nil
+}
+
+var errReadOnly = errors.New("uploads are not allowed")
+
+func (h *Handler) putTile(w http.ResponseWriter, r *http.Request) {
+    tx, errX := strconv.Atoi(r.PathValue("x"))
+    ty, errY := strconv.Atoi(r.PathValue("y"))
+    // Edits never change the grid, so it can be checked before apply.
+    h.mu.RLock()
+    grid := h.reader.Grid()
+    h.mu.RUnlock()
+    if errX != nil || errY != nil || !grid.Contains(tx, ty) {
+        http.NotFound(w, r)
+        return
+    }
+    if h.opts.AuthorizeWrite == nil {
+        h.refuse(w, errReadOnly)
+        return
+    }
+    if err := h.opts.AuthorizeWrite(r, nest.TileCoord{X: tx, Y: ty}); err != nil {
+        h.refuse(w, err)
+        return
+    }
+    rect := grid.TileBounds(tx, ty)
+    img, ok := h.readUpload(w, r, func(width, height int) error {
+        if width != rect.Dx() || height != rect.Dy() {
+            return fmt.Errorf("tile (%d, %d) is %dx%d, the upload is %dx%d", tx, ty, rect.Dx(), rect.Dy(), width, height)
+        }
+        return nil
+    })
+    if !ok {
+        return
+    }
+    h.apply(w, func() (Event, error) {
+        e := Event{Type: EventTileInvalidated, Tiles: [][2]int{{tx, ty}}}
+        return e, h.editor.PutTile(h.actor(r), tx, ty, img)
+    })
+}
+
+func (h *Handler) putNested(w http.ResponseWriter, r *http.Request) {
+    i, err := strconv.Atoi(r.PathValue("i"))
+    h.mu.RLock()
+    count := int(h.reader.Header.NestedCount)
+    h.mu.RUnlock()
+    if err != nil || i < 1 || i > count+1 {
+        http.NotFound(w, r)
+        return
+    }
+    if h.opts.AuthorizeNestedWrite == nil {
+        h.refuse(w, errReadOnly)
+        return
+    }
+    if err := h.opts.AuthorizeNestedWrite(r, i); err != nil {
+        h.refuse(w, err)
+        return
+    }
+    img, ok := h.readUpload(w, r, func(width, height int) error {
+        if exceeds(width, height, h.opts.MaxRegionPixels) {
+            return fmt.Errorf("nested image is larger than %d pixels", h.opts.MaxRegionPixels)
+        }
+        return nil
+    })
+    if !ok {
+        return
+    }
+    h.apply(w, func() (Event, error) {
+        // Another upload may have appended since the check above.
+        e := Event{Type: EventNestedImageReplaced, Nested: i}
+        if i > int(h.reader.Header.NestedCount) {
+            e.Type = EventNestedImageAdded
+        }
+        return e, h.editor.PutNested(h.actor(r), i, img)
+    })
+}
+
+// readUpload decodes the request body as an image, answering 400 or 413
+// when it can't. check sees the dimensions before the pixels are decoded.
+func (h *Handler) readUpload(w http.ResponseWriter, r *http.Request, check func(width, height int) error) (image.Image, bool) {
+    data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.opts.MaxUploadBytes))
+    if err != nil {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+        } else {
+            http.Error(w, fmt.Sprintf("failed to read upload: %v", err), http.StatusBadRequest)
+        }
+        return nil, false
+    }
+    config, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        http.Error(w, fmt.Sprintf("invalid image: %v", err), http.StatusBadRequest)
+        return nil, false
+    }
+    if err := check(config.Width, config.Height); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return nil, false
+    }
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        http.Error(w, fmt.Sprintf("invalid image: %v", err), http.StatusBadRequest)
+        return nil, false
+    }
+    return img, true
+}
+
+// apply runs an edit while no request is reading, then serves the saved
+// file from then on and tells subscribers about the event edit returns.
+// Edits the editor rejects before saving answer 400.
+func (h *Handler) apply(w http.ResponseWriter, edit func() (Event, error)) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    before := h.editor.Reader()
+    e, err := edit()
+    h.reader = h.editor.Reader()
+    h.display = displayDigest(h.reader)
+    if h.reader != before && h.cache != nil {
+        h.cache.clear()
+    }
+    if info, statErr := os.Stat(h.editor.path); statErr == nil && h.reader != before {
+        h.opts.ModTime = info.ModTime()
+    }
+    switch {
+    case err != nil && h.reader == before:
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    case err != nil:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    default:
+        w.WriteHeader(http.StatusNoContent)
+        h.Notify(e)
+    }
+}
+
+func (h *Handler) actor(r *http.Request) string {
+    if h.opts.Actor != nil {
+        return h.opts.Actor(r)
+    }
+    return r.RemoteAddr
+}
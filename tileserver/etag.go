@@ -0,0 +1,74 @@
+package tileserver
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "image"
+    "strings"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// etag derives a strong ETag for the response named key from the checksums
+// of the tiles under rect and the display settings, so it is known without
+// decoding. It returns "" when the file carries no checksums.
+func (h *Handler) etag(key string, rect image.Rectangle) string {
+    index := h.reader.Index
+    if !index.HasChecksums {
+        return ""
+    }
+    sum := sha256.New()
+    sum.Write([]byte(key))
+    sum.Write(h.display)
+    var b [4]byte
+    tiles := h.reader.Grid().TileRange(rect)
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            e, ok := index.Lookup(tx, ty)
+            if !ok {
+                return ""
+            }
+            binary.LittleEndian.PutUint32(b[:], e.Checksum)
+            sum.Write(b[:])
+        }
+    }
+    return `"` + hex.EncodeToString(sum.Sum(nil)[:16]) + `"`
+}
+
+// displayDigest hashes reader's display settings, which change renderings
+// without changing any tile checksum: the orientation, the canvas and the
+// adjustments.
+func displayDigest(reader *nest.Reader) []byte {
+    sum := sha256.New()
+    sum.Write([]byte{byte(reader.Header.Orientation)})
+    if c := reader.Canvas(); c != nil {
+        binary.Write(sum, binary.LittleEndian, [4]int64{int64(c.Width), int64(c.Height), int64(c.Origin.X), int64(c.Origin.Y)})
+        sum.Write([]byte{c.Background.R, c.Background.G, c.Background.B, c.Background.A})
+    }
+    if a := reader.Adjustments(); a != nil {
+        binary.Write(sum, binary.LittleEndian, [6]float64{a.Exposure, a.Window, a.Level, a.Brightness, a.Contrast, a.Gamma})
+        if a.LUT != nil {
+            binary.Write(sum, binary.LittleEndian, [2]int64{int64(a.LUT.Dimension), int64(a.LUT.Size)})
+            binary.Write(sum, binary.LittleEndian, a.LUT.Table)
+        }
+    }
+    return sum.Sum(nil)
+}
+
+func bodyETag(body []byte) string {
+    sum := sha256.Sum256(body)
+    return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// noneMatch reports whether an If-None-Match header lists etag. Weak
+// validators match too, as RFC 9110 specifies for this header.
+func noneMatch(header, etag string) bool {
+    for _, v := range strings.Split(header, ",") {
+        v = strings.TrimSpace(v)
+        if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,150 @@
+package tileserver
+
+import (
+    "encoding/json"
+    "net/http"
+    "sync"
+
+    nest "github.com/70ziko/NEST"
+)
+
+// Event types pushed to subscribers of /events.
+const (
+    EventTileInvalidated     = "tile-invalidated"
+    EventNestedImageAdded    = "nested-image-added"
+    EventNestedImageReplaced = "nested-image-replaced"
+)
+
+// Event is one change to the document, sent to viewers as a JSON text
+// message:
+//
+//	{"type": "tile-invalidated", "tiles": [[2, 1]]}
+//	{"type": "nested-image-added", "nested": 3}
+type Event struct {
+    Type string `json:"type"`
+    // Tiles lists changed tiles as [x, y] pairs.
+    Tiles [][2]int `json:"tiles,omitempty"`
+    // Nested numbers the nested image from 1, like links.
+    Nested int `json:"nested,omitempty"`
+}
+
+// subscriberQueue is how many events a viewer may fall behind before it is
+// disconnected.
+const subscriberQueue = 64
+
+type subscriber struct {
+    r     *http.Request
+    conn  *wsConn
+    queue chan []byte
+}
+
+// hub fans events out to the connected viewers.
+type hub struct {
+    mu   sync.Mutex
+    subs map[*subscriber]struct{}
+}
+
+func (b *hub) add(s *subscriber) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.subs == nil {
+        b.subs = map[*subscriber]struct{}{}
+    }
+    b.subs[s] = struct{}{}
+}
+
+// remove forgets s and ends its writer. It is safe to call more than once.
+func (b *hub) remove(s *subscriber) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if _, ok := b.subs[s]; ok {
+        delete(b.subs, s)
+        close(s.queue)
+    }
+}
+
+// Notify sends e to every viewer subscribed to /events that the Authorize
+// and AuthorizeNested callbacks would let read what changed. Handlers from
+// NewEditable call it for every upload; applications that change the
+// document some other way call it themselves.
+func (h *Handler) Notify(e Event) {
+    h.events.mu.Lock()
+    defer h.events.mu.Unlock()
+    for s := range h.events.subs {
+        visible := h.visible(s.r, e)
+        if visible == nil {
+            continue
+        }
+        msg, _ := json.Marshal(visible)
+        select {
+        case s.queue <- msg:
+        default:
+            // Too far behind; it will have to reconnect and reload.
+            delete(h.events.subs, s)
+            close(s.queue)
+        }
+    }
+}
+
+// visible trims e to what r may read, or returns nil when that is nothing.
+func (h *Handler) visible(r *http.Request, e Event) *Event {
+    if h.opts.Authorize == nil {
+        return &e
+    }
+    if e.Nested != 0 {
+        if h.opts.AuthorizeNested == nil || h.opts.AuthorizeNested(r, e.Nested) != nil {
+            return nil
+        }
+    }
+    if e.Tiles != nil {
+        var tiles [][2]int
+        for _, t := range e.Tiles {
+            if h.opts.Authorize(r, nest.TileCoord{X: t[0], Y: t[1]}) == nil {
+                tiles = append(tiles, t)
+            }
+        }
+        if tiles == nil {
+            return nil
+        }
+        e.Tiles = tiles
+    }
+    return &e
+}
+
+// serveEvents upgrades the request to a WebSocket that receives an Event
+// message for every change. The connection outlives the request, so uploads
+// are not held up by it.
+func (h *Handler) serveEvents(w http.ResponseWriter, r *http.Request) {
+    if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(r, origin) {
+        if h.opts.CORS == nil || h.opts.CORS.allowOrigin(origin) == "" {
+            http.Error(w, "origin not allowed", http.StatusForbidden)
+            return
+        }
+    }
+    conn, err := upgrade(w, r)
+    if err != nil {
+        return
+    }
+    s := &subscriber{r: r, conn: conn, queue: make(chan []byte, subscriberQueue)}
+    h.events.add(s)
+    go func() {
+        defer conn.conn.Close()
+        for msg := range s.queue {
+            if conn.writeFrame(wsText, msg) != nil {
+                h.events.remove(s)
+                for range s.queue {
+                }
+                return
+            }
+        }
+        conn.writeFrame(wsClose, nil)
+    }()
+    go func() {
+        conn.serve()
+        h.events.remove(s)
+    }()
+}
+
+func sameOrigin(r *http.Request, origin string) bool {
+    return origin == "http://"+r.Host || origin == "https://"+r.Host
+}
@@ -0,0 +1,28 @@
+package tileserver
+
+import (
+    "image"
+    "time"
+)
+
+// freshness returns the newest update time among the tiles under rect and
+// the earliest time one of them expires, which is zero when the file has no
+// TTL. It reports false unless every tile's update time is known.
+func (h *Handler) freshness(rect image.Rectangle) (updated, expires time.Time, ok bool) {
+    tiles := h.reader.Grid().TileRange(rect)
+    for ty := tiles.Min.Y; ty < tiles.Max.Y; ty++ {
+        for tx := tiles.Min.X; tx < tiles.Max.X; tx++ {
+            t, ok := h.reader.TileUpdated(tx, ty)
+            if !ok {
+                return time.Time{}, time.Time{}, false
+            }
+            if t.After(updated) {
+                updated = t
+            }
+            if e, ok := h.reader.TileExpires(tx, ty); ok && (expires.IsZero() || e.Before(expires)) {
+                expires = e
+            }
+        }
+    }
+    return updated, expires, !updated.IsZero()
+}
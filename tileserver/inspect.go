@@ -0,0 +1,190 @@
+package tileserver
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    "net/http"
+    "strconv"
+
+    nest "github.com/70ziko/NEST"
+)
+
+func writeJSON(w http.ResponseWriter, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
+
+// canvasInfo describes a file's canvas in /info. Background is #rrggbbaa.
+type canvasInfo struct {
+    Width      int    `json:"width"`
+    Height     int    `json:"height"`
+    X          int    `json:"x"`
+    Y          int    `json:"y"`
+    Background string `json:"background"`
+}
+
+func (h *Handler) serveInfo(w http.ResponseWriter, r *http.Request) {
+    hdr := h.reader.Header
+    var canvas *canvasInfo
+    if c := h.reader.Canvas(); c != nil {
+        b, bg := h.reader.CanvasBounds(), c.Background
+        canvas = &canvasInfo{b.Dx(), b.Dy(), c.Origin.X, c.Origin.Y, fmt.Sprintf("#%02x%02x%02x%02x", bg.R, bg.G, bg.B, bg.A)}
+    }
+    writeJSON(w, struct {
+        Width       uint32           `json:"width"`
+        Height      uint32           `json:"height"`
+        TileSize    uint16           `json:"tileSize"`
+        NestedCount uint32           `json:"nestedCount"`
+        Payload     nest.PayloadKind `json:"payload"`
+        Orientation string           `json:"orientation"`
+        Canvas      *canvasInfo      `json:"canvas,omitempty"`
+    }{hdr.Width, hdr.Height, hdr.TileSize, hdr.NestedCount, hdr.Payload, hdr.Orientation.String(), canvas})
+}
+
+// servePixel reports the color and link of one pixel, subject to the same
+// authorization as the tile holding it.
+func (h *Handler) servePixel(w http.ResponseWriter, r *http.Request) {
+    x, errX := strconv.Atoi(r.URL.Query().Get("x"))
+    y, errY := strconv.Atoi(r.URL.Query().Get("y"))
+    p := image.Pt(x, y)
+    if errX != nil || errY != nil || !p.In(h.reader.Bounds()) {
+        http.Error(w, "pixel is outside the image", http.StatusBadRequest)
+        return
+    }
+    rect := image.Rectangle{Min: p, Max: p.Add(image.Pt(1, 1))}
+    if !h.authorize(w, r, rect) {
+        return
+    }
+    region, err := h.reader.ReadRegion(rect)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    px := region[0][0]
+    writeJSON(w, struct {
+        R    uint8  `json:"r"`
+        G    uint8  `json:"g"`
+        B    uint8  `json:"b"`
+        Link uint32 `json:"link"`
+    }{px.R, px.G, px.B, px.NestedIdx})
+}
+
+// nestedIndex parses and authorizes the {i} of a nested image request,
+// answering the error itself when it fails.
+func (h *Handler) nestedIndex(w http.ResponseWriter, r *http.Request) (int, bool) {
+    i, err := strconv.Atoi(r.PathValue("i"))
+    if err != nil || i < 1 || i > int(h.reader.Header.NestedCount) {
+        http.NotFound(w, r)
+        return 0, false
+    }
+    switch {
+    case h.opts.AuthorizeNested != nil:
+        if err := h.opts.AuthorizeNested(r, i); err != nil {
+            h.refuse(w, err)
+            return 0, false
+        }
+    case h.opts.Authorize != nil:
+        http.Error(w, "nested images are not served without AuthorizeNested", http.StatusForbidden)
+        return 0, false
+    }
+    return i, true
+}
+
+// serveNested returns nested image {i}, numbered from 1 like links, as PNG.
+// width and height render it at another size, with vector content drawn
+// afresh rather than scaled; when only one is given the other keeps the
+// aspect ratio.
+func (h *Handler) serveNested(w http.ResponseWriter, r *http.Request) {
+    i, ok := h.nestedIndex(w, r)
+    if !ok {
+        return
+    }
+    var width, height int
+    for _, p := range []struct {
+        name string
+        dst  *int
+    }{{"width", &width}, {"height", &height}} {
+        if v := r.URL.Query().Get(p.name); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil || n < 0 {
+                http.Error(w, fmt.Sprintf("invalid %s %q", p.name, v), http.StatusBadRequest)
+                return
+            }
+            *p.dst = n
+        }
+    }
+    // Deriving one side from the other must not overflow.
+    if width > h.opts.MaxRegionPixels || height > h.opts.MaxRegionPixels {
+        http.Error(w, fmt.Sprintf("output is larger than %d pixels", h.opts.MaxRegionPixels), http.StatusBadRequest)
+        return
+    }
+
+    key := fmt.Sprintf("nested/%d", i)
+    if width != 0 || height != 0 {
+        key = fmt.Sprintf("nested/%d/%dx%d", i, width, height)
+    }
+    var e *cacheEntry
+    if h.cache != nil {
+        e, _ = h.cache.get(key)
+    }
+    if e == nil {
+        ni, err := h.reader.ReadNestedImage(i - 1)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        switch {
+        case width == 0 && height == 0:
+            width, height = int(ni.Width), int(ni.Height)
+        case height == 0:
+            height = max(width*int(ni.Height)/int(ni.Width), 1)
+        case width == 0:
+            width = max(height*int(ni.Width)/int(ni.Height), 1)
+        }
+        if exceeds(width, height, h.opts.MaxRegionPixels) {
+            http.Error(w, fmt.Sprintf("output is larger than %d pixels", h.opts.MaxRegionPixels), http.StatusBadRequest)
+            return
+        }
+        img, err := ni.Render(width, height, nest.AreaFilter)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if e, err = encode(img, "png", 0); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        e.key = key
+        if h.cache != nil {
+            h.cache.put(e)
+        }
+    }
+    w.Header().Set("ETag", bodyETag(e.body))
+    w.Header().Set("Content-Type", e.contentType)
+    http.ServeContent(w, r, "", h.opts.ModTime, bytes.NewReader(e.body))
+}
+
+// serveNestedContent returns the source of nested image {i}, such as an
+// SVG document, caption text or a narration clip, with its own content
+// type. It is streamed from the file, so clients can fetch ranges of
+// large clips.
+func (h *Handler) serveNestedContent(w http.ResponseWriter, r *http.Request) {
+    i, ok := h.nestedIndex(w, r)
+    if !ok {
+        return
+    }
+    content, mimeType, err := h.reader.OpenNestedContent(i - 1)
+    switch {
+    case errors.Is(err, nest.ErrNoContent):
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    case err != nil:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", mimeType)
+    http.ServeContent(w, r, "", h.opts.ModTime, content)
+}
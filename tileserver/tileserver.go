@@ -0,0 +1,355 @@
+// Package tileserver serves the main image of a NEST file over HTTP, as
+// individual tiles or as arbitrary regions encoded on the fly.
+package tileserver
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "image"
+    "image/jpeg"
+    "image/png"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    nest "github.com/70ziko/NEST"
+)
+
+const (
+    DefaultCacheBytes      = 64 << 20
+    DefaultMaxRegionPixels = 4096 * 4096
+    defaultQuality         = 80
+)
+
+type Options struct {
+    // CacheBytes bounds the encoded responses kept in memory. Zero selects
+    // DefaultCacheBytes and a negative value disables the cache.
+    CacheBytes int64
+    // CacheDir, when set, spills encoded responses to files in this
+    // directory so they survive restarts. Only responses with a
+    // checksum-derived ETag are stored there.
+    CacheDir string
+    // CacheDirBytes bounds the files in CacheDir. Zero selects
+    // DefaultCacheDirBytes.
+    CacheDirBytes int64
+    // MaxRegionPixels bounds both the region read and the scaled output of
+    // a /region request. Zero selects DefaultMaxRegionPixels.
+    MaxRegionPixels int
+    // ModTime is sent as Last-Modified, typically the file's modification
+    // time. Zero omits it. Files that record tile update times send the
+    // newest among the tiles a response covers instead, along with a
+    // Cache-Control max-age running to the first of them to expire.
+    ModTime time.Time
+    // CORS, when set, allows cross-origin reads.
+    CORS *CORS
+    // Authorize, when set, is called for every tile a request touches before
+    // anything is served from cache or decoded. Returning an error refuses
+    // the request with 403, or 401 for ErrUnauthenticated.
+    Authorize func(*http.Request, nest.TileCoord) error
+    // AuthorizeNested gates nested images, numbered from 1. When Authorize
+    // is set but this is not, nested images are refused.
+    AuthorizeNested func(*http.Request, int) error
+    // AuthorizeWrite and AuthorizeNestedWrite gate uploads to a handler
+    // from NewEditable, like Authorize and AuthorizeNested gate reads. When
+    // one is nil those uploads are refused.
+    AuthorizeWrite       func(*http.Request, nest.TileCoord) error
+    AuthorizeNestedWrite func(*http.Request, int) error
+    // Actor names the uploader in the audit log. Nil records the remote
+    // address.
+    Actor func(*http.Request) string
+    // MaxUploadBytes bounds the body of an upload. Zero selects
+    // DefaultMaxUploadBytes.
+    MaxUploadBytes int64
+}
+
+// Handler serves
+//
+//	GET /tiles/{x}/{y}  one tile as PNG, cropped at the image edge
+//	GET /region?x=&y=&w=&h=[&width=&height=][&format=png|jpeg][&quality=]
+//	    [&filter=box|bilinear|lanczos|area]
+//	GET /pixel?x=&y=    color and link of one pixel as JSON
+//	GET /nested/{i}[?width=&height=]
+//	                    nested image i as PNG, numbered from 1 like links
+//	GET /nested/{i}/content
+//	                    the source of nested image i, such as SVG or caption
+//	                    text, if it has one
+//	GET /info           dimensions, orientation and canvas as JSON
+//	GET /events         a WebSocket of Event messages as the document changes
+//
+// Regions are in canvas coordinates, turned by the header's orientation and
+// placed on the file's canvas, and clipped to the canvas. Tiles and pixels
+// stay in stored coordinates.
+// width and height scale the output; when only one is given the other keeps
+// the aspect ratio.
+type Handler struct {
+    reader *nest.Reader
+    opts   Options
+    cache  *cache
+    disk   *diskCache
+    mux    *http.ServeMux
+    editor *Editor
+    events hub
+    // display is the digest of the reader's display settings.
+    display []byte
+    // mu keeps reads out while an upload replaces reader.
+    mu sync.RWMutex
+}
+
+// New returns a handler for reader. It fails only when CacheDir cannot be
+// created or read.
+func New(reader *nest.Reader, opts Options) (*Handler, error) {
+    if opts.CacheBytes == 0 {
+        opts.CacheBytes = DefaultCacheBytes
+    }
+    if opts.CacheDirBytes <= 0 {
+        opts.CacheDirBytes = DefaultCacheDirBytes
+    }
+    if opts.MaxRegionPixels <= 0 {
+        opts.MaxRegionPixels = DefaultMaxRegionPixels
+    }
+    h := &Handler{reader: reader, opts: opts, mux: http.NewServeMux(), display: displayDigest(reader)}
+    if opts.CacheBytes > 0 {
+        h.cache = newCache(opts.CacheBytes)
+    }
+    if opts.CacheDir != "" {
+        var err error
+        if h.disk, err = newDiskCache(opts.CacheDir, opts.CacheDirBytes); err != nil {
+            return nil, fmt.Errorf("failed to open cache directory: %w", err)
+        }
+    }
+    h.mux.HandleFunc("GET /tiles/{x}/{y}", h.serveTile)
+    h.mux.HandleFunc("GET /region", h.serveRegion)
+    h.mux.HandleFunc("GET /pixel", h.servePixel)
+    h.mux.HandleFunc("GET /nested/{i}", h.serveNested)
+    h.mux.HandleFunc("GET /nested/{i}/content", h.serveNestedContent)
+    h.mux.HandleFunc("GET /info", h.serveInfo)
+    h.mux.HandleFunc("GET /events", h.serveEvents)
+    return h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if h.setCORS(w, r) {
+        return
+    }
+    if h.editor != nil && r.Method != http.MethodPut {
+        h.mu.RLock()
+        defer h.mu.RUnlock()
+    }
+    h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) serveTile(w http.ResponseWriter, r *http.Request) {
+    tx, errX := strconv.Atoi(r.PathValue("x"))
+    ty, errY := strconv.Atoi(r.PathValue("y"))
+    grid := h.reader.Grid()
+    if errX != nil || errY != nil || !grid.Contains(tx, ty) {
+        http.NotFound(w, r)
+        return
+    }
+    rect := grid.TileBounds(tx, ty)
+    key := fmt.Sprintf("tile/%d/%d", tx, ty)
+    h.serve(w, r, key, rect, func() (*cacheEntry, error) {
+        img, err := h.reader.ReadRegionImage(rect)
+        if err != nil {
+            return nil, err
+        }
+        return encode(img, "png", 0)
+    })
+}
+
+type regionRequest struct {
+    // rect is in canvas coordinates and stored the main image pixels under
+    // it, which differ when the file has an orientation or a canvas.
+    rect, stored  image.Rectangle
+    width, height int
+    format        string
+    quality       int
+    filter        nest.ResampleFilter
+}
+
+func (h *Handler) parseRegion(q url.Values) (regionRequest, error) {
+    var req regionRequest
+    var x, y, rw, rh int
+    for _, p := range []struct {
+        name     string
+        dst      *int
+        optional bool
+    }{
+        {"x", &x, false}, {"y", &y, false}, {"w", &rw, false}, {"h", &rh, false},
+        {"width", &req.width, true}, {"height", &req.height, true}, {"quality", &req.quality, true},
+    } {
+        v := q.Get(p.name)
+        if v == "" && p.optional {
+            continue
+        }
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return req, fmt.Errorf("invalid %s %q", p.name, v)
+        }
+        *p.dst = n
+    }
+    req.rect = image.Rect(x, y, x+rw, y+rh).Intersect(h.reader.CanvasBounds())
+    if req.rect.Empty() {
+        return req, errors.New("region does not overlap the image")
+    }
+    req.stored = h.reader.StoredRect(req.rect)
+    if exceeds(req.rect.Dx(), req.rect.Dy(), h.opts.MaxRegionPixels) {
+        return req, fmt.Errorf("region is larger than %d pixels", h.opts.MaxRegionPixels)
+    }
+    // Either side alone may be past the limit, and deriving the other
+    // from it must not overflow.
+    if req.width > h.opts.MaxRegionPixels || req.height > h.opts.MaxRegionPixels {
+        return req, fmt.Errorf("output is larger than %d pixels", h.opts.MaxRegionPixels)
+    }
+
+    switch {
+    case req.width == 0 && req.height == 0:
+        req.width, req.height = req.rect.Dx(), req.rect.Dy()
+    case req.height == 0:
+        req.height = max(req.width*req.rect.Dy()/req.rect.Dx(), 1)
+    case req.width == 0:
+        req.width = max(req.height*req.rect.Dx()/req.rect.Dy(), 1)
+    }
+    if exceeds(req.width, req.height, h.opts.MaxRegionPixels) {
+        return req, fmt.Errorf("output is larger than %d pixels", h.opts.MaxRegionPixels)
+    }
+
+    req.format = q.Get("format")
+    if req.format == "" {
+        req.format = "png"
+    }
+    if req.format != "png" && req.format != "jpeg" {
+        return req, fmt.Errorf("unsupported format %q", req.format)
+    }
+    if req.quality == 0 {
+        req.quality = defaultQuality
+    }
+    if req.quality > 100 {
+        return req, fmt.Errorf("invalid quality %d", req.quality)
+    }
+    name := q.Get("filter")
+    if name == "" {
+        name = nest.AreaFilter.Name()
+    }
+    var err error
+    req.filter, err = nest.ParseResampleFilter(name)
+    return req, err
+}
+
+// exceeds reports whether a w by h image has more than limit pixels,
+// without multiplying sides that could overflow.
+func exceeds(w, h, limit int) bool {
+    return w > 0 && h > limit/w
+}
+
+func (req *regionRequest) key() string {
+    return fmt.Sprintf("region/%d,%d,%d,%d/%dx%d/%s/%d/%s", req.rect.Min.X, req.rect.Min.Y, req.rect.Dx(), req.rect.Dy(),
+        req.width, req.height, req.format, req.quality, req.filter.Name())
+}
+
+func (h *Handler) serveRegion(w http.ResponseWriter, r *http.Request) {
+    req, err := h.parseRegion(r.URL.Query())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    key := req.key()
+    h.serve(w, r, key, req.stored, func() (*cacheEntry, error) {
+        img, err := h.reader.ReadCanvasRegion(req.rect)
+        if err != nil {
+            return nil, err
+        }
+        if req.width != req.rect.Dx() || req.height != req.rect.Dy() {
+            img = nest.ResizeImage(img, req.width, req.height, req.filter)
+        }
+        return encode(img, req.format, req.quality)
+    })
+}
+
+// serve answers from the cache or render after authorizing the tiles under
+// rect. When the file has tile checksums, conditional requests are answered
+// before anything is decoded; otherwise the ETag is a hash of the body.
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request, key string, rect image.Rectangle, render func() (*cacheEntry, error)) {
+    if !h.authorize(w, r, rect) {
+        return
+    }
+    var cacheControl []string
+    if h.opts.Authorize != nil {
+        // Keep shared caches from handing protected tiles to others.
+        cacheControl = append(cacheControl, "private")
+    }
+    modTime := h.opts.ModTime
+    if updated, expires, ok := h.freshness(rect); ok {
+        modTime = updated
+        if !expires.IsZero() {
+            maxAge := max(time.Until(expires)/time.Second, 0)
+            cacheControl = append(cacheControl, fmt.Sprintf("max-age=%d", maxAge))
+        }
+    }
+    if cacheControl != nil {
+        w.Header().Set("Cache-Control", strings.Join(cacheControl, ", "))
+    }
+    etag := h.etag(key, rect)
+    if etag != "" {
+        w.Header().Set("ETag", etag)
+        if noneMatch(r.Header.Get("If-None-Match"), etag) {
+            w.WriteHeader(http.StatusNotModified)
+            return
+        }
+    }
+
+    var e *cacheEntry
+    if h.cache != nil {
+        e, _ = h.cache.get(key)
+    }
+    if e == nil && h.disk != nil && etag != "" {
+        if e, _ = h.disk.get(etag); e != nil {
+            e.key = key
+            if h.cache != nil {
+                h.cache.put(e)
+            }
+        }
+    }
+    if e == nil {
+        var err error
+        if e, err = render(); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        e.key = key
+        if h.cache != nil {
+            h.cache.put(e)
+        }
+        if h.disk != nil && etag != "" {
+            h.disk.put(etag, e)
+        }
+    }
+    if etag == "" {
+        w.Header().Set("ETag", bodyETag(e.body))
+    }
+    w.Header().Set("Content-Type", e.contentType)
+    http.ServeContent(w, r, "", modTime, bytes.NewReader(e.body))
+}
+
+func encode(img image.Image, format string, quality int) (*cacheEntry, error) {
+    var buf bytes.Buffer
+    e := &cacheEntry{}
+    switch format {
+    case "jpeg":
+        e.contentType = "image/jpeg"
+        if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+            return nil, err
+        }
+    default:
+        e.contentType = "image/png"
+        if err := png.Encode(&buf, img); err != nil {
+            return nil, err
+        }
+    }
+    e.body = buf.Bytes()
+    return e, nil
+}
@@ -0,0 +1,156 @@
+package tileserver
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+// A minimal RFC 6455 server side: enough to push text messages to a viewer
+// and answer its pings and close.
+const (
+    wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+    wsText  = 0x1
+    wsClose = 0x8
+    wsPing  = 0x9
+    wsPong  = 0xa
+
+    // wsMaxRead bounds the frames a viewer may send; it has nothing to say
+    // beyond control frames.
+    wsMaxRead = 4096
+)
+
+type wsConn struct {
+    conn net.Conn
+    rw   *bufio.ReadWriter
+    mu   sync.Mutex // serializes writes
+}
+
+func headerHas(h http.Header, name, token string) bool {
+    for _, v := range h.Values(name) {
+        for _, t := range strings.Split(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(t), token) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// upgrade completes the opening handshake, answering the error itself when
+// r is not a valid WebSocket request.
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") || key == "" {
+        http.Error(w, "expected a WebSocket request", http.StatusBadRequest)
+        return nil, errors.New("not a WebSocket request")
+    }
+    if r.Header.Get("Sec-WebSocket-Version") != "13" {
+        w.Header().Set("Sec-WebSocket-Version", "13")
+        http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+        return nil, errors.New("unsupported WebSocket version")
+    }
+    hj, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+        return nil, errors.New("response writer does not support hijacking")
+    }
+    conn, rw, err := hj.Hijack()
+    if err != nil {
+        return nil, err
+    }
+    sum := sha1.Sum([]byte(key + wsGUID))
+    fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+    if err := rw.Flush(); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// writeFrame sends one unmasked, unfragmented frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    hdr := []byte{0x80 | opcode}
+    switch n := len(payload); {
+    case n < 126:
+        hdr = append(hdr, byte(n))
+    case n <= 0xffff:
+        hdr = binary.BigEndian.AppendUint16(append(hdr, 126), uint16(n))
+    default:
+        hdr = binary.BigEndian.AppendUint64(append(hdr, 127), uint64(n))
+    }
+    c.rw.Write(hdr)
+    c.rw.Write(payload)
+    return c.rw.Flush()
+}
+
+// readFrame returns the next frame's opcode and unmasked payload.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+    var hdr [2]byte
+    if _, err := io.ReadFull(c.rw, hdr[:]); err != nil {
+        return 0, nil, err
+    }
+    if hdr[1]&0x80 == 0 {
+        return 0, nil, errors.New("client frame is not masked")
+    }
+    n := uint64(hdr[1] & 0x7f)
+    switch n {
+    case 126:
+        var b [2]byte
+        if _, err := io.ReadFull(c.rw, b[:]); err != nil {
+            return 0, nil, err
+        }
+        n = uint64(binary.BigEndian.Uint16(b[:]))
+    case 127:
+        var b [8]byte
+        if _, err := io.ReadFull(c.rw, b[:]); err != nil {
+            return 0, nil, err
+        }
+        n = binary.BigEndian.Uint64(b[:])
+    }
+    if n > wsMaxRead {
+        return 0, nil, fmt.Errorf("client frame of %d bytes is too large", n)
+    }
+    var mask [4]byte
+    if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+        return 0, nil, err
+    }
+    payload := make([]byte, n)
+    if _, err := io.ReadFull(c.rw, payload); err != nil {
+        return 0, nil, err
+    }
+    for i := range payload {
+        payload[i] ^= mask[i%4]
+    }
+    return hdr[0] & 0x0f, payload, nil
+}
+
+// serve answers pings until the viewer closes the connection or breaks the
+// protocol. Other messages are ignored.
+func (c *wsConn) serve() {
+    defer c.conn.Close()
+    for {
+        op, payload, err := c.readFrame()
+        if err != nil {
+            return
+        }
+        switch op {
+        case wsPing:
+            c.writeFrame(wsPong, payload)
+        case wsClose:
+            c.writeFrame(wsClose, payload)
+            return
+        }
+    }
+}
@@ -0,0 +1,184 @@
+package nest
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "runtime/debug"
+    "time"
+)
+
+const modulePath = "github.com/70ziko/NEST"
+
+// maxEncoderLength bounds the encoder name kept in a trailer.
+const maxEncoderLength = 1024
+
+var (
+    ErrNoTrailer       = errors.New("file has no trailer")
+    ErrTrailerMismatch = errors.New("file contents don't match the hash in its trailer")
+)
+
+// Trailer records who wrote a file and when, with a hash of its contents,
+// so a file can be checked for damage without a sidecar.
+type Trailer struct {
+    // Hash is the SHA-256 of every byte of the file before the trailer.
+    Hash [sha256.Size]byte
+    // Encoder names the software that wrote the file and its version.
+    Encoder string
+    Written time.Time
+}
+
+// The trailer is stored in a TRLR chunk, the last one before the TAIL
+// chunk:
+//
+//	SHA-256 | Written int64 Unix nanoseconds | Encoder, UTF-8 to the end
+//
+// A TRLR chunk followed by other chunks was left behind by an edit and is
+// ignored.
+func (t *Trailer) chunk(order binary.ByteOrder) *Chunk {
+    data := make([]byte, sha256.Size+8, sha256.Size+8+len(t.Encoder))
+    copy(data, t.Hash[:])
+    order.PutUint64(data[sha256.Size:], uint64(t.Written.UnixNano()))
+    data = append(data, t.Encoder...)
+    return &Chunk{Type: ChunkTrailer, Data: data}
+}
+
+func decodeTrailer(reader io.Reader, order binary.ByteOrder, length uint64) (*Trailer, error) {
+    if length < sha256.Size+8 || length > sha256.Size+8+maxEncoderLength {
+        return nil, fmt.Errorf("%s chunk is %d bytes", ChunkTrailer, length)
+    }
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkTrailer, err)
+    }
+    t := &Trailer{}
+    copy(t.Hash[:], data)
+    t.Written = time.Unix(0, int64(order.Uint64(data[sha256.Size:]))).UTC()
+    t.Encoder = string(data[sha256.Size+8:])
+    return t, nil
+}
+
+// defaultEncoder names this package and, when the binary was built from a
+// tagged module, its version.
+func defaultEncoder() string {
+    version := "(devel)"
+    if info, ok := debug.ReadBuildInfo(); ok {
+        if info.Main.Path == modulePath {
+            version = info.Main.Version
+        }
+        for _, dep := range info.Deps {
+            if dep.Path == modulePath {
+                version = dep.Version
+            }
+        }
+    }
+    return fmt.Sprintf("%s %s, format %d", modulePath, version, VERSION)
+}
+
+func (opts *WriteOptions) encoder() string {
+    if opts.Encoder != "" {
+        return opts.Encoder
+    }
+    return defaultEncoder()
+}
+
+func (opts *WriteOptions) written() time.Time {
+    if !opts.Written.IsZero() {
+        return opts.Written.UTC()
+    }
+    return time.Now().UTC()
+}
+
+// hashingReader hashes everything read through it, so a sequential read can
+// check the trailer without seeking back.
+type hashingReader struct {
+    r io.Reader
+    h hash.Hash
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+    n, err := hr.r.Read(p)
+    hr.h.Write(p[:n])
+    return n, err
+}
+
+// hashMark returns the hash of what has been read so far when reader is a
+// hashingReader.
+func hashMark(reader io.Reader) []byte {
+    if hr, ok := reader.(*hashingReader); ok {
+        return hr.h.Sum(nil)
+    }
+    return nil
+}
+
+// loadTrailer finds the TRLR chunk when it is the last chunk of the file.
+func (nr *Reader) loadTrailer() error {
+    var offset int64
+    var length uint64
+    found := false
+    err := nr.walkChunks(func(t ChunkType, o int64, l uint64) (bool, error) {
+        offset, length, found = o, l, t == ChunkTrailer
+        return true, nil
+    })
+    if err != nil || !found {
+        return err
+    }
+    nr.trailer, err = decodeTrailer(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+    nr.trailerOffset = offset - chunkHeaderSize
+    return err
+}
+
+// Trailer returns the file's trailer, or nil when it has none.
+func (nr *Reader) Trailer() *Trailer {
+    return nr.trailer
+}
+
+// VerifyTrailer hashes the file up to its trailer and compares the result
+// with the recorded hash. It returns ErrNoTrailer for files without one.
+func (nr *Reader) VerifyTrailer() error {
+    if nr.trailer == nil {
+        return ErrNoTrailer
+    }
+    sum, err := nr.hashTo(nr.trailerOffset)
+    if err != nil {
+        return err
+    }
+    if !bytes.Equal(sum, nr.trailer.Hash[:]) {
+        return ErrTrailerMismatch
+    }
+    return nil
+}
+
+func (nr *Reader) hashTo(end int64) ([]byte, error) {
+    h := sha256.New()
+    if _, err := io.Copy(h, io.NewSectionReader(nr.r, 0, end)); err != nil {
+        return nil, fmt.Errorf("failed to hash file: %w", err)
+    }
+    return h.Sum(nil), nil
+}
+
+// refreshTrailer rehashes a file edited in place before its trailer and
+// rewrites the trailer's hash and time, keeping the recorded encoder.
+func (nr *Reader) refreshTrailer(ws io.WriteSeeker) error {
+    if nr.trailer == nil {
+        return nil
+    }
+    sum, err := nr.hashTo(nr.trailerOffset)
+    if err != nil {
+        return err
+    }
+    t := &Trailer{Encoder: nr.trailer.Encoder, Written: time.Now().UTC()}
+    copy(t.Hash[:], sum)
+    if _, err := ws.Seek(nr.trailerOffset, io.SeekStart); err != nil {
+        return err
+    }
+    if err := t.chunk(nr.order).write(ws, nr.order); err != nil {
+        return fmt.Errorf("failed to write trailer: %w", err)
+    }
+    nr.trailer = t
+    return nil
+}
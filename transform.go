@@ -0,0 +1,279 @@
+package nest
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+)
+
+// Transform maps main image pixel coordinates into a parent space, such as a
+// mosaic or a registered reference scan. Pixel (x, y) covers [x, x+1) x
+// [y, y+1); its center is (x+0.5, y+0.5).
+type Transform interface {
+    Apply(x, y float64) (float64, float64)
+    // Invert maps a parent position back to pixel space. It reports false
+    // when there is no inverse there.
+    Invert(x, y float64) (float64, float64, bool)
+}
+
+// TransformChain applies its transforms in order. It is stored in the XFRM
+// chunk and leaves the pixels untouched, so registration can be changed
+// without resampling.
+type TransformChain []Transform
+
+func (tc TransformChain) Apply(x, y float64) (float64, float64) {
+    for _, t := range tc {
+        x, y = t.Apply(x, y)
+    }
+    return x, y
+}
+
+func (tc TransformChain) Invert(x, y float64) (float64, float64, bool) {
+    for i := len(tc) - 1; i >= 0; i-- {
+        var ok bool
+        if x, y, ok = tc[i].Invert(x, y); !ok {
+            return 0, 0, false
+        }
+    }
+    return x, y, true
+}
+
+// Affine maps (x, y) to (A[0]x + A[1]y + A[2], A[3]x + A[4]y + A[5]).
+type Affine [6]float64
+
+func Translate(dx, dy float64) Affine {
+    return Affine{1, 0, dx, 0, 1, dy}
+}
+
+func (a Affine) Apply(x, y float64) (float64, float64) {
+    return a[0]*x + a[1]*y + a[2], a[3]*x + a[4]*y + a[5]
+}
+
+func (a Affine) Invert(x, y float64) (float64, float64, bool) {
+    det := a[0]*a[4] - a[1]*a[3]
+    if det == 0 {
+        return 0, 0, false
+    }
+    x, y = x-a[2], y-a[5]
+    return (a[4]*x - a[1]*y) / det, (a[0]*y - a[3]*x) / det, true
+}
+
+// ControlPoint pairs a pixel position with where it lands in the parent
+// space.
+type ControlPoint struct {
+    X, Y     float64
+    ToX, ToY float64
+}
+
+// ThinPlateSpline bends pixel space so every control point lands exactly on
+// its target, for scans that no affine transform aligns.
+type ThinPlateSpline struct {
+    Points []ControlPoint
+    // w holds a weight per point and then the affine part, for x and y.
+    wx, wy []float64
+}
+
+// NewThinPlateSpline fits a spline through at least three control points
+// that are not all on one line.
+func NewThinPlateSpline(points []ControlPoint) (*ThinPlateSpline, error) {
+    n := len(points)
+    if n < 3 {
+        return nil, fmt.Errorf("thin-plate spline needs 3 control points, not %d", n)
+    }
+    // Solve [K P; Pᵀ 0] w = [v; 0] for both coordinates at once.
+    size := n + 3
+    m := make([][]float64, size)
+    for i := range m {
+        m[i] = make([]float64, size+2)
+    }
+    for i, p := range points {
+        for j, q := range points {
+            m[i][j] = tpsKernel(p.X-q.X, p.Y-q.Y)
+        }
+        m[i][n], m[i][n+1], m[i][n+2] = 1, p.X, p.Y
+        m[n][i], m[n+1][i], m[n+2][i] = 1, p.X, p.Y
+        m[i][size], m[i][size+1] = p.ToX, p.ToY
+    }
+    if !solve(m) {
+        return nil, errors.New("thin-plate spline control points are degenerate")
+    }
+    t := &ThinPlateSpline{Points: points, wx: make([]float64, size), wy: make([]float64, size)}
+    for i := range m {
+        t.wx[i], t.wy[i] = m[i][size], m[i][size+1]
+    }
+    return t, nil
+}
+
+func tpsKernel(dx, dy float64) float64 {
+    r2 := dx*dx + dy*dy
+    if r2 == 0 {
+        return 0
+    }
+    return r2 * math.Log(r2) / 2
+}
+
+// solve reduces the augmented matrix m in place with partial pivoting,
+// leaving the solutions in its last columns.
+func solve(m [][]float64) bool {
+    n := len(m)
+    for c := 0; c < n; c++ {
+        p := c
+        for r := c + 1; r < n; r++ {
+            if math.Abs(m[r][c]) > math.Abs(m[p][c]) {
+                p = r
+            }
+        }
+        if math.Abs(m[p][c]) < 1e-12 {
+            return false
+        }
+        m[c], m[p] = m[p], m[c]
+        for r := 0; r < n; r++ {
+            if r == c {
+                continue
+            }
+            f := m[r][c] / m[c][c]
+            for k := c; k < len(m[r]); k++ {
+                m[r][k] -= f * m[c][k]
+            }
+        }
+    }
+    for r := 0; r < n; r++ {
+        d := m[r][r]
+        for k := n; k < len(m[r]); k++ {
+            m[r][k] /= d
+        }
+    }
+    return true
+}
+
+func (t *ThinPlateSpline) Apply(x, y float64) (float64, float64) {
+    n := len(t.Points)
+    ox := t.wx[n] + t.wx[n+1]*x + t.wx[n+2]*y
+    oy := t.wy[n] + t.wy[n+1]*x + t.wy[n+2]*y
+    for i, p := range t.Points {
+        k := tpsKernel(x-p.X, y-p.Y)
+        ox += t.wx[i] * k
+        oy += t.wy[i] * k
+    }
+    return ox, oy
+}
+
+// Invert has no closed form; it runs Newton's method from the inverse of
+// the spline's affine part.
+func (t *ThinPlateSpline) Invert(x, y float64) (float64, float64, bool) {
+    n := len(t.Points)
+    a := Affine{t.wx[n+1], t.wx[n+2], t.wx[n], t.wy[n+1], t.wy[n+2], t.wy[n]}
+    px, py, ok := a.Invert(x, y)
+    if !ok {
+        return 0, 0, false
+    }
+    const h = 1e-3
+    for i := 0; i < 50; i++ {
+        fx, fy := t.Apply(px, py)
+        ex, ey := fx-x, fy-y
+        if math.Abs(ex) < 1e-6 && math.Abs(ey) < 1e-6 {
+            return px, py, true
+        }
+        ax, ay := t.Apply(px+h, py)
+        bx, by := t.Apply(px, py+h)
+        j := Affine{(ax - fx) / h, (bx - fx) / h, 0, (ay - fy) / h, (by - fy) / h, 0}
+        dx, dy, ok := j.Invert(ex, ey)
+        if !ok {
+            return 0, 0, false
+        }
+        px, py = px-dx, py-dy
+    }
+    return 0, 0, false
+}
+
+// The XFRM chunk lists the chain:
+//
+//	count uint16 | kind uint8 | parameters...
+//
+// Kind 'A' is followed by six float64 Affine coefficients and kind 'T' by a
+// uint32 point count and four float64 per ControlPoint.
+const (
+    transformAffine = 'A'
+    transformTPS    = 'T'
+)
+
+func (tc TransformChain) chunk(order binary.ByteOrder) (*Chunk, error) {
+    if len(tc) > math.MaxUint16 {
+        return nil, fmt.Errorf("transform chain has %d steps, the limit is %d", len(tc), math.MaxUint16)
+    }
+    var buf bytes.Buffer
+    binary.Write(&buf, order, uint16(len(tc)))
+    for _, t := range tc {
+        switch t := t.(type) {
+        case Affine:
+            buf.WriteByte(transformAffine)
+            binary.Write(&buf, order, t)
+        case *ThinPlateSpline:
+            buf.WriteByte(transformTPS)
+            binary.Write(&buf, order, uint32(len(t.Points)))
+            binary.Write(&buf, order, t.Points)
+        default:
+            return nil, fmt.Errorf("cannot store transform of type %T", t)
+        }
+    }
+    return &Chunk{Type: ChunkTransform, Data: buf.Bytes()}, nil
+}
+
+func decodeTransformChain(reader io.Reader, order binary.ByteOrder, length uint64) (TransformChain, error) {
+    data := make([]byte, length)
+    if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkTransform, err)
+    }
+    r := bytes.NewReader(data)
+    var count uint16
+    if err := binary.Read(r, order, &count); err != nil {
+        return nil, fmt.Errorf("failed to read %s chunk: %w", ChunkTransform, err)
+    }
+    tc := make(TransformChain, 0, count)
+    for i := 0; i < int(count); i++ {
+        kind, err := r.ReadByte()
+        if err != nil {
+            return nil, fmt.Errorf("failed to read transform %d: %w", i, err)
+        }
+        switch kind {
+        case transformAffine:
+            var a Affine
+            if err := binary.Read(r, order, &a); err != nil {
+                return nil, fmt.Errorf("failed to read transform %d: %w", i, err)
+            }
+            tc = append(tc, a)
+        case transformTPS:
+            var n uint32
+            if err := binary.Read(r, order, &n); err != nil {
+                return nil, fmt.Errorf("failed to read transform %d: %w", i, err)
+            }
+            if int64(n)*32 > int64(r.Len()) {
+                return nil, fmt.Errorf("transform %d lists %d control points in %d bytes", i, n, r.Len())
+            }
+            points := make([]ControlPoint, n)
+            if err := binary.Read(r, order, points); err != nil {
+                return nil, fmt.Errorf("failed to read transform %d: %w", i, err)
+            }
+            t, err := NewThinPlateSpline(points)
+            if err != nil {
+                return nil, fmt.Errorf("transform %d: %w", i, err)
+            }
+            tc = append(tc, t)
+        default:
+            return nil, fmt.Errorf("transform %d has unknown kind %q", i, kind)
+        }
+    }
+    return tc, nil
+}
+
+// Transform reads the XFRM chunk. Files without one return a nil chain.
+func (nr *Reader) Transform() (TransformChain, error) {
+    offset, length, ok, err := nr.findChunk(ChunkTransform)
+    if err != nil || !ok {
+        return nil, err
+    }
+    return decodeTransformChain(io.NewSectionReader(nr.r, offset, int64(length)), nr.order, length)
+}
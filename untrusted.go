@@ -0,0 +1,107 @@
+package nest
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "runtime/debug"
+    "time"
+)
+
+// DefaultUntrustedMemory bounds the bytes DecodeUntrusted may allocate when
+// UntrustedOptions.MaxMemory is zero.
+const DefaultUntrustedMemory = 256 << 20
+
+// DefaultUntrustedTimeout bounds how long DecodeUntrusted may take when
+// UntrustedOptions.Timeout is zero.
+const DefaultUntrustedTimeout = 10 * time.Second
+
+// ErrDecodeTimeout is returned by DecodeUntrusted, and by reads given a
+// ReadOptions.Deadline, when the file takes longer than its time budget to
+// decode.
+var ErrDecodeTimeout = errors.New("decode time budget exceeded")
+
+type UntrustedOptions struct {
+    // MaxMemory bounds the bytes the decoder may allocate, as
+    // ReadOptions.MaxMemory does, but zero means DefaultUntrustedMemory.
+    MaxMemory int64
+    // Timeout bounds how long the decode may take. Zero means
+    // DefaultUntrustedTimeout.
+    Timeout time.Duration
+}
+
+// A DecodePanicError reports a bug in the decoder that a crafted file
+// reached. DecodeUntrusted returns it instead of letting the panic take down
+// the process.
+type DecodePanicError struct {
+    Value any
+    Stack []byte
+}
+
+func (e *DecodePanicError) Error() string {
+    return fmt.Sprintf("decoder panicked: %v", e.Value)
+}
+
+// DecodeUntrusted decodes a file from r that may have been crafted to harm
+// the process decoding it, such as an upload to a web service. Allocations
+// are bounded by opts.MaxMemory, failing with ErrMemoryBudget, and the
+// decode by opts.Timeout, failing with ErrDecodeTimeout. A panic in the
+// decoder is returned as a *DecodePanicError. Nothing but r is read, and
+// nothing is written: the decode runs in the calling goroutine and looks up
+// shared dictionaries only among those registered in memory.
+//
+// The time budget is checked each time the decoder reads from r and for
+// every tile it orders or decodes and every chunk it walks, so no step
+// between checks takes longer than decoding one tile or plane.
+func DecodeUntrusted(r io.Reader, opts UntrustedOptions) (nif *NestedImageFile, err error) {
+    if opts.MaxMemory <= 0 {
+        opts.MaxMemory = DefaultUntrustedMemory
+    }
+    if opts.Timeout <= 0 {
+        opts.Timeout = DefaultUntrustedTimeout
+    }
+    defer func() {
+        if v := recover(); v != nil {
+            nif, err = nil, &DecodePanicError{Value: v, Stack: debug.Stack()}
+        }
+    }()
+
+    // Hiding any io.ReaderAt keeps the decode off worker goroutines, whose
+    // panics could not be recovered here.
+    deadline := time.Now().Add(opts.Timeout)
+    dr := &deadlineReader{r: r, deadline: deadline}
+    nif = &NestedImageFile{}
+    if err := nif.ReadWithOptions(dr, ReadOptions{MaxMemory: opts.MaxMemory, Deadline: deadline}); err != nil {
+        if dr.expired || errors.Is(err, ErrDecodeTimeout) {
+            return nil, fmt.Errorf("%w after %s", ErrDecodeTimeout, opts.Timeout)
+        }
+        return nil, err
+    }
+    // Stream decodes never seek through the index, so check it against the
+    // bytes actually read before handing it to callers that will.
+    if nif.Index != nil {
+        if err := nif.Index.check(dr.n, nif.Header.maxTileLength()); err != nil {
+            return nil, fmt.Errorf("invalid tile index: %w", err)
+        }
+    }
+    return nif, nil
+}
+
+// deadlineReader fails every read once its deadline has passed, and counts
+// the bytes read before it.
+type deadlineReader struct {
+    r        io.Reader
+    deadline time.Time
+    expired  bool
+    n        int64
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+    if time.Now().After(d.deadline) {
+        d.expired = true
+        return 0, ErrDecodeTimeout
+    }
+    n, err := d.r.Read(p)
+    d.n += int64(n)
+    return n, err
+}
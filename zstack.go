@@ -0,0 +1,194 @@
+package nest
+
+import (
+    "fmt"
+    "image"
+    "io"
+    "math"
+    "sync"
+
+    "github.com/70ziko/NEST/colorspace"
+)
+
+// Plane is one focal plane of a Z stack, the size of the main image. Planes
+// share the main image's links.
+type Plane struct {
+    Z      int
+    Width  int
+    Height int
+    // Data holds RGB samples row by row, in the header color space.
+    Data []byte
+}
+
+func (p *Plane) ToImage() *image.RGBA {
+    return (&PyramidLevel{Width: p.Width, Height: p.Height, Data: p.Data}).ToImage()
+}
+
+// Depth is the number of focal planes, counting the main image as plane 0.
+func (nif *NestedImageFile) Depth() int {
+    return 1 + len(nif.Planes)
+}
+
+// Plane returns focal plane z, or nil when there is none. Plane 0 is a copy
+// of the main image's colors.
+func (nif *NestedImageFile) Plane(z int) *Plane {
+    switch {
+    case z == 0:
+        return &Plane{Width: int(nif.Header.Width), Height: int(nif.Header.Height), Data: nif.rgbData()}
+    case z > 0 && z <= len(nif.Planes):
+        return &nif.Planes[z-1]
+    }
+    return nil
+}
+
+// AddPlane appends img, assumed to be sRGB, as the next focal plane. It must
+// be the size of the main image, and a stack holds at most 256 planes.
+func (nif *NestedImageFile) AddPlane(img image.Image) error {
+    width, height := int(nif.Header.Width), int(nif.Header.Height)
+    b := img.Bounds()
+    if b.Dx() != width || b.Dy() != height {
+        return fmt.Errorf("plane is %dx%d, the main image is %dx%d", b.Dx(), b.Dy(), width, height)
+    }
+    if nif.Depth() > math.MaxUint8 {
+        return fmt.Errorf("Z stack already has %d planes", nif.Depth())
+    }
+    data := make([]byte, 0, width*height*3)
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+        for x := b.Min.X; x < b.Max.X; x++ {
+            r, g, bl, _ := img.At(x, y).RGBA()
+            cr, cg, cb := colorspace.Convert8(uint8(r>>8), uint8(g>>8), uint8(bl>>8), colorspace.SRGB, nif.Header.ColorSpace)
+            data = append(data, cr, cg, cb)
+        }
+    }
+    nif.Planes = append(nif.Planes, Plane{Z: nif.Depth(), Width: width, Height: height, Data: data})
+    return nil
+}
+
+// MaxIntensityProjection keeps, for every pixel and channel, the brightest
+// sample across the stack. The result has Z 0.
+func (nif *NestedImageFile) MaxIntensityProjection() *Plane {
+    out := nif.Plane(0)
+    for _, p := range nif.Planes {
+        for i, v := range p.Data {
+            out.Data[i] = max(out.Data[i], v)
+        }
+    }
+    return out
+}
+
+// Each plane after the main image is stored in a ZPLN chunk laid out like a
+// PYRM chunk, with the level byte holding Z. A predicting codec predicts
+// each plane from the one stored before it, the first from the main image.
+func (nif *NestedImageFile) writePlanes(writer io.Writer, tc *tileCodec, workers int, sp *spiller) error {
+    width, height := int(nif.Header.Width), int(nif.Header.Height)
+    var ref *PyramidLevel
+    if tc.predict && len(nif.Planes) > 0 {
+        ref = &PyramidLevel{Width: width, Height: height, Data: nif.rgbData()}
+    }
+    for _, p := range nif.Planes {
+        l := PyramidLevel{Level: p.Z, Width: width, Height: height, Data: p.Data}
+        if err := l.writeChunk(writer, ChunkPlane, tc, workers, sp, ref); err != nil {
+            return fmt.Errorf("focal plane %d: %w", p.Z, err)
+        }
+        if ref != nil {
+            ref = &l
+        }
+    }
+    return nil
+}
+
+// planeRef returns the level a plane decoded after the planes in nif.Planes
+// may be predicted from.
+func (nif *NestedImageFile) planeRef() (*PyramidLevel, error) {
+    if n := len(nif.Planes); n > 0 {
+        p := nif.Planes[n-1]
+        return &PyramidLevel{Level: p.Z, Width: p.Width, Height: p.Height, Data: p.Data}, nil
+    }
+    return &PyramidLevel{Width: int(nif.Header.Width), Height: int(nif.Header.Height), Data: nif.rgbData()}, nil
+}
+
+func (nif *NestedImageFile) decodePlane(reader io.Reader, tc *tileCodec, length uint64, budget *memoryBudget) (Plane, error) {
+    l, err := decodePyramidLevel(reader, tc, length, budget, sync.OnceValues(nif.planeRef))
+    if err != nil {
+        return Plane{}, fmt.Errorf("failed to decode focal plane: %w", err)
+    }
+    if l.Width != int(nif.Header.Width) || l.Height != int(nif.Header.Height) {
+        return Plane{}, fmt.Errorf("focal plane %d is %dx%d, the main image is %dx%d", l.Level, l.Width, l.Height, nif.Header.Width, nif.Header.Height)
+    }
+    return Plane{Z: l.Level, Width: l.Width, Height: l.Height, Data: l.Data}, nil
+}
+
+// Depth counts the focal planes, reading only chunk headers.
+func (nr *Reader) Depth() (int, error) {
+    depth := 1
+    err := nr.walkChunks(func(t ChunkType, offset int64, length uint64) (bool, error) {
+        if t == ChunkPlane {
+            depth++
+        }
+        return true, nil
+    })
+    return depth, err
+}
+
+// ReadPlane decodes focal plane z. Plane 0 is the main image's colors.
+func (nr *Reader) ReadPlane(z int) (*Plane, error) {
+    if z == 0 {
+        region, err := nr.ReadRegion(nr.Bounds())
+        if err != nil {
+            return nil, err
+        }
+        b := nr.Bounds()
+        p := &Plane{Width: b.Dx(), Height: b.Dy(), Data: make([]byte, 0, b.Dx()*b.Dy()*3)}
+        for _, row := range region {
+            for _, px := range row {
+                p.Data = append(p.Data, px.R, px.G, px.B)
+            }
+        }
+        return p, nil
+    }
+    // planes are the ZPLN chunks up to plane z, which may be predicted
+    // from the ones before it.
+    var planes []ByteRange
+    found := false
+    var b [1]byte
+    err := nr.walkChunks(func(t ChunkType, offset int64, length uint64) (bool, error) {
+        if t != ChunkPlane || length == 0 {
+            return true, nil
+        }
+        if _, err := nr.r.ReadAt(b[:], offset); err != nil {
+            return false, fmt.Errorf("failed to read focal plane: %w", err)
+        }
+        planes = append(planes, ByteRange{offset, int64(length)})
+        found = int(b[0]) == z
+        return !found, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, fmt.Errorf("file has no focal plane %d", z)
+    }
+    l, err := nr.decodePlaneAt(planes, len(planes)-1)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode focal plane %d: %w", z, err)
+    }
+    return &Plane{Z: z, Width: l.Width, Height: l.Height, Data: l.Data}, nil
+}
+
+// decodePlaneAt decodes the ZPLN chunk at planes[i], and the planes before
+// it when its tiles are predicted from them.
+func (nr *Reader) decodePlaneAt(planes []ByteRange, i int) (PyramidLevel, error) {
+    ref := sync.OnceValues(func() (*PyramidLevel, error) {
+        if i == 0 {
+            p, err := nr.ReadPlane(0)
+            if err != nil {
+                return nil, err
+            }
+            return &PyramidLevel{Width: p.Width, Height: p.Height, Data: p.Data}, nil
+        }
+        l, err := nr.decodePlaneAt(planes, i-1)
+        return &l, err
+    })
+    br := planes[i]
+    return decodePyramidLevel(io.NewSectionReader(nr.r, br.Offset, br.Length), nr.codec(), uint64(br.Length), nil, ref)
+}